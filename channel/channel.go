@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -27,6 +28,12 @@ type Attacher interface {
 // Default options.
 var ()
 
+// ErrFrameDesync is returned by Attach when the network connection was closed,
+// because its length prefixes stopped lining up with the messages written by
+// the remote peer. This can only be detected when the length prefixes are
+// authenticated (see codec.LengthPrefixOptions.WithAuthenticated).
+var ErrFrameDesync = codec.ErrFrameDesync
+
 // reader represents the read-half of a network connection. It also contains a
 // quit channel that is closed when the reader is no longer being used by the
 // Channel.
@@ -39,6 +46,9 @@ type reader struct {
 	// longer being used. This happens when the network connection faults, or is
 	// replaced by a new network connection.
 	q chan<- struct{}
+	// errs receives the error that caused the reader to be closed, if it is
+	// one that should be returned by Attach.
+	errs chan<- error
 }
 
 // writer represents the write-half of a network connection. It also contains a
@@ -49,12 +59,72 @@ type writer struct {
 	*bufio.Writer
 	codec.Encoder
 
+	// version is the latest MsgVersion that is understood by the remote peer.
+	version uint16
+
 	// q is a quit channel that is closed by the Channel when the writer is no
 	// longer being used. This happens when the network connection faults, or is
 	// replaced by a new network connection.
 	q chan<- struct{}
 }
 
+// hinted returns the io.Writer to which the frames of a message are encoded,
+// so that compression Encoders honour the compression flags of the message.
+func (w writer) hinted(m wire.Msg) io.Writer {
+	compress, ok := m.CompressionOverride()
+	switch {
+	case !ok:
+		return w.Writer
+	case compress:
+		return codec.WithCompressionHint(w.Writer, codec.CompressionForce)
+	default:
+		return codec.WithCompressionHint(w.Writer, codec.CompressionForbid)
+	}
+}
+
+// drop the writer after a failed write. The network connection is closed,
+// because a frame might have been partially written to it, and writing
+// anything else would leave the remote peer unable to find the start of the
+// next frame.
+func (w writer) drop() {
+	// Ignore the error, because we no longer need this connection.
+	_ = w.Conn.Close()
+	close(w.q)
+}
+
+// fullWriter writes to a network connection, retrying writes that return
+// fewer bytes than requested without an error, until the whole buffer has been
+// written. Writes that return an error (for example, because a write deadline
+// was exceeded) are not retried.
+type fullWriter struct {
+	net.Conn
+}
+
+func (w fullWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := w.Conn.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// goodbye represents a request for the Channel to write a goodbye message to
+// the attached network connection, and then close it. The result of writing is
+// sent to the done channel.
+type goodbye struct {
+	reason   wire.GoodbyeReason
+	deadline time.Time
+	drain    bool
+	done     chan<- error
+}
+
 // A Channel is an abstraction over a network connection. It can be created
 // independently of a network connection, it can have network connections
 // attached and detached, it can replace its network connection, and it persists
@@ -100,11 +170,29 @@ type Channel struct {
 
 	inbound  chan<- wire.Packet
 	outbound <-chan wire.Msg
-
-	readers chan reader
-	writers chan writer
+	// oldest receives from the inbound messaging channel, so that the oldest
+	// message can be dropped. It is nil if the Channel was created by New.
+	oldest <-chan wire.Packet
+
+	readers  chan reader
+	writers  chan writer
+	goodbyes chan goodbye
+	detaches chan chan<- detachedWriter
+	flushes  chan *flush
+
+	// controlMu guards the control of the current reader, which is used to
+	// detach it (see Detach).
+	controlMu *sync.Mutex
+	control   *readerControl
+
+	// connMu guards the network connection of the current writer, so that it
+	// can be closed when draining takes too long, and inspected (see Conn).
+	connMu *sync.Mutex
+	conn   net.Conn
 
 	rateLimiter *rate.Limiter
+	dropped     *uint64
+	sizes       sizeHistogram
 }
 
 // New returns an abstract Channel connection to a remote peer. It will have no
@@ -117,19 +205,44 @@ type Channel struct {
 // back-pressure. Back-pressure builds when messages are being written to the
 // outbound messaging channel, but there is no functional attached network
 // connection, or when messages are being received on an attached network
-// connection, but the inbound message channel is not being drained.
+// connection, but the inbound message channel is not being drained. What
+// happens when the inbound messaging channel is full depends on the
+// InboundPolicy. The Channel cannot receive from the inbound messaging
+// channel, so InboundDropOldest drops the newest message instead (see
+// NewWithInbound).
 func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound <-chan wire.Msg) *Channel {
+	return newChannel(opts, remote, inbound, nil, outbound)
+}
+
+// NewWithInbound is the same as New, but the Channel can also receive from the
+// inbound messaging channel. It only does so to drop the oldest message when
+// the InboundPolicy is InboundDropOldest.
+func NewWithInbound(opts Options, remote id.Signatory, inbound chan wire.Packet, outbound <-chan wire.Msg) *Channel {
+	return newChannel(opts, remote, inbound, inbound, outbound)
+}
+
+func newChannel(opts Options, remote id.Signatory, inbound chan<- wire.Packet, oldest <-chan wire.Packet, outbound <-chan wire.Msg) *Channel {
 	return &Channel{
 		opts:   opts,
 		remote: remote,
 
 		inbound:  inbound,
+		oldest:   oldest,
 		outbound: outbound,
 
-		readers: make(chan reader, 1),
-		writers: make(chan writer, 1),
+		readers:  make(chan reader, 1),
+		writers:  make(chan writer, 1),
+		goodbyes: make(chan goodbye),
+		detaches: make(chan chan<- detachedWriter),
+		flushes:  make(chan *flush),
+
+		controlMu: new(sync.Mutex),
+
+		connMu: new(sync.Mutex),
 
 		rateLimiter: rate.NewLimiter(opts.RateLimit, opts.MaxMessageSize),
+		dropped:     new(uint64),
+		sizes:       newSizeHistogram(opts.SizeBuckets),
 	}
 }
 
@@ -174,26 +287,37 @@ func (ch *Channel) Run(ctx context.Context) error {
 //		},
 //		nil,
 //		nil)
-//
 func (ch *Channel) Attach(ctx context.Context, remote id.Signatory, conn net.Conn, enc codec.Encoder, dec codec.Decoder) error {
+	return ch.AttachWithVersion(ctx, remote, conn, enc, dec, wire.MsgVersionLatest)
+}
+
+// AttachWithVersion is the same as Attach, but only writes messages to the
+// network connection in ways that are understood by a remote peer that
+// understands the given MsgVersion (and no later one). Attach assumes that the
+// remote peer understands the MsgVersionLatest. If the remote peer does not
+// understand MsgVersion5, then chunked messages are written with their Data in
+// the message, and so they are dropped if their Data does not fit into the
+// maximum message size, and the messages of batches are written one at a time.
+func (ch *Channel) AttachWithVersion(ctx context.Context, remote id.Signatory, conn net.Conn, enc codec.Encoder, dec codec.Decoder, version uint16) error {
 	if !ch.remote.Equal(&remote) {
 		return fmt.Errorf("bad remote: expected %v, got %v", ch.remote, remote)
 	}
 
 	rq := make(chan struct{})
 	wq := make(chan struct{})
+	rErrs := make(chan error, 1)
 
 	// Signal that a new reader should be used.
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case ch.readers <- reader{Conn: conn, Reader: bufio.NewReaderSize(conn, ch.opts.MaxMessageSize), Decoder: dec, q: rq}:
+	case ch.readers <- reader{Conn: conn, Reader: bufio.NewReaderSize(conn, ch.opts.readBufferSize()), Decoder: dec, q: rq, errs: rErrs}:
 	}
 	// Signal that a new writer should be used.
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case ch.writers <- writer{Conn: conn, Writer: bufio.NewWriterSize(conn, ch.opts.MaxMessageSize), Encoder: enc, q: wq}:
+	case ch.writers <- writer{Conn: conn, Writer: bufio.NewWriterSize(fullWriter{Conn: conn}, ch.opts.writeBufferSize()), Encoder: enc, version: version, q: wq}:
 	}
 
 	// Wait for the reader to be closed.
@@ -209,7 +333,92 @@ func (ch *Channel) Attach(ctx context.Context, remote id.Signatory, conn net.Con
 	case <-wq:
 	}
 
-	return nil
+	select {
+	case err := <-rErrs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Goodbye writes a goodbye message, with the given reason, to the attached
+// network connection and then closes it. The remote peer receives the goodbye
+// message as the last message from the connection, which lets it distinguish
+// the deliberate close from a fault. Messages that are on the outbound queue
+// are written to the next attached network connection. If there is no attached
+// network connection, this method does nothing.
+//
+// Writing the goodbye message is best-effort: if the context has a deadline,
+// then it is used as the write deadline, and the network connection is closed
+// regardless of whether or not the write succeeds. This method blocks until
+// the network connection is closed, or the context is done.
+func (ch *Channel) Goodbye(ctx context.Context, reason wire.GoodbyeReason) error {
+	deadline, _ := ctx.Deadline()
+	done := make(chan error, 1)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch.goodbyes <- goodbye{reason: reason, deadline: deadline, done: done}:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// Drain is the same as Goodbye, except that all messages that are on the
+// outbound queue are written to the attached network connection before the
+// goodbye message, so that messages that have already been sent are delivered
+// before the network connection is closed. Draining stops once the outbound
+// queue is empty, so messages that are sent while draining might not be
+// written.
+//
+// If the context has a deadline, then it is used as the write deadline for
+// draining and writing the goodbye message. If the context is done before
+// draining is finished, then the network connection is forcibly closed, and
+// the messages that have not been written are kept for the next attached
+// network connection.
+func (ch *Channel) Drain(ctx context.Context, reason wire.GoodbyeReason) error {
+	deadline, _ := ctx.Deadline()
+	done := make(chan error, 1)
+	select {
+	case <-ctx.Done():
+		ch.closeConn()
+		return ctx.Err()
+	case ch.goodbyes <- goodbye{reason: reason, deadline: deadline, drain: true, done: done}:
+	}
+	select {
+	case <-ctx.Done():
+		ch.closeConn()
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// closeConn closes the network connection of the current writer, if there is
+// one.
+func (ch *Channel) closeConn() {
+	ch.connMu.Lock()
+	defer ch.connMu.Unlock()
+
+	if ch.conn != nil {
+		// Ignore the error, because the network connection is being
+		// abandoned.
+		_ = ch.conn.Close()
+	}
+}
+
+// Conn returns the network connection that was most recently attached to the
+// Channel, and used for writing. The network connection might have since been
+// closed. False is returned if no network connection has been attached.
+func (ch *Channel) Conn() (net.Conn, bool) {
+	ch.connMu.Lock()
+	defer ch.connMu.Unlock()
+
+	return ch.conn, ch.conn != nil
 }
 
 // Remote peer identity expected by the Channel.
@@ -218,13 +427,21 @@ func (ch Channel) Remote() id.Signatory {
 }
 
 func (ch *Channel) readLoop(ctx context.Context) error {
-	read := func(r reader, drain <-chan struct{}) {
+	read := func(r reader, drain <-chan struct{}, control *readerControl) {
 		draining := uint64(0)
 
+		// The reader is stopped when this function returns, so that it is no
+		// longer detached or drained.
+		defer control.stop()
+
 		// If the drain channel is written to, this signals that this reader is
 		// now expired and we should begin draining it.
 		go func() {
-			<-drain
+			select {
+			case <-control.stopped:
+				return
+			case <-drain:
+			}
 
 			atomic.StoreUint64(&draining, 1)
 
@@ -242,8 +459,26 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 		buf := make([]byte, ch.opts.MaxMessageSize)
 		bufSyncData := make([]byte, ch.opts.MaxMessageSize)
 
+		// The reader waits for the next message without reading any part of it,
+		// so that it can be detached between messages (see Detach).
+		peek := func() error { return nil }
+		if peeker, ok := r.Reader.(interface{ Peek(int) ([]byte, error) }); ok {
+			peek = func() error {
+				_, err := peeker.Peek(1)
+				return err
+			}
+		}
+
 		for {
-			n, err := r.Decoder(r.Reader, buf[:])
+			reply, err := control.wait(peek)
+			if reply != nil {
+				reply <- detachedReader{r: r, ok: true}
+				return
+			}
+			n := 0
+			if err == nil {
+				n, err = r.Decoder(r.Reader, buf[:])
+			}
 			if err != nil {
 				draining := atomic.LoadUint64(&draining)
 
@@ -251,6 +486,15 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 				if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
 					ch.opts.Logger.Error("decode", zap.Uint64("draining", draining), zap.Error(err))
 				}
+				// Nothing that follows a desync can be trusted, so the
+				// network connection is closed, instead of waiting for the
+				// writer to fault.
+				if errors.Is(err, ErrFrameDesync) {
+					if r.errs != nil {
+						r.errs <- err
+					}
+					r.Conn.Close()
+				}
 				close(r.q)
 				return
 			}
@@ -273,6 +517,46 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 				continue
 			}
 
+			// A goodbye message is the last message that the remote peer
+			// writes to the connection before closing it, so there is no
+			// point reading any further. It is still written to the inbound
+			// message channel, so that the reason can be surfaced.
+			if m.Type == wire.MsgTypeGoodbye {
+				ch.opts.Logger.Debug("goodbye", zap.String("remote", ch.remote.String()), zap.String("addr", r.Conn.RemoteAddr().String()))
+				select {
+				case <-ctx.Done():
+				case ch.inbound <- wire.Packet{Msg: m, IPAddr: r.Conn.RemoteAddr()}:
+				}
+				// Stop writing, so that a remote peer that is reading
+				// until it is closed sees the end of the network
+				// connection. Like reading until closed, this is opt-in
+				// (see Options.CloseReadTimeout).
+				if ch.opts.CloseReadTimeout > 0 {
+					closeWrite(r.Conn)
+				}
+				close(r.q)
+				return
+			}
+
+			// The Data of a chunked message follows it, and is read as the
+			// application reads the Body, so the message is delivered first.
+			if chunked(m) {
+				b := newBody()
+				if !ch.deliver(ctx, wire.Packet{Msg: m, IPAddr: r.Conn.RemoteAddr(), Body: b}) {
+					b.finish(io.ErrUnexpectedEOF)
+					close(r.q)
+					return
+				}
+				size, err := ch.readChunks(ctx, r, b, bufSyncData)
+				if err != nil {
+					ch.opts.Logger.Error("read chunks", zap.Error(err))
+					close(r.q)
+					return
+				}
+				ch.sizes.record(n + size)
+				continue
+			}
+
 			// An aggressive filtering strategy would involve pre-filtering
 			// synchronisation messages before reading the synchronisation data.
 			// However, in practice, this does not provide much of an advantage
@@ -293,14 +577,13 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 				m.SyncData = make([]byte, n)
 				copy(m.SyncData, bufSyncData[:n])
 			}
+			ch.sizes.record(n + len(m.SyncData))
 
-			select {
-			case <-ctx.Done():
+			if !ch.deliver(ctx, wire.Packet{Msg: m, IPAddr: r.Conn.RemoteAddr()}) {
 				if r.q != nil {
 					close(r.q)
 				}
 				return
-			case ch.inbound <- wire.Packet{Msg: m, IPAddr: r.Conn.RemoteAddr()}:
 			}
 		}
 	}
@@ -316,7 +599,11 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 
 			drain <- struct{}{}            // Write to the previous drain channel.
 			drain = make(chan struct{}, 1) // Create a new drain channel.
-			go read(r, drain)
+			control := newReaderControl(r.Conn)
+			ch.controlMu.Lock()
+			ch.control = control
+			ch.controlMu.Unlock()
+			go read(r, drain, control)
 		}
 	}
 }
@@ -331,6 +618,14 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 	var mOk bool
 	var mQueue <-chan wire.Msg
 
+	// Flushes wait for the messages that were queued before they were
+	// requested. The outbound queue is first-in-first-out, so they only need to
+	// count the messages that are written (or discarded) after that.
+	var flushes []*flush
+	processed := func() {
+		flushes = processFlushes(flushes)
+	}
+
 	for {
 		switch {
 		case wOk && mOk:
@@ -354,62 +649,203 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 				close(w.q)
 			}
 			w, wOk = v, vOk
-		case m, mOk = <-mQueue:
-			tail, _, err := m.Marshal(buf[:], len(buf))
-			if err != nil {
-				ch.opts.Logger.Error("marshal", zap.Error(err))
-				// Clear the latest message so that we can move on to other
-				// messages. We do this, because failure to marshal is not
-				// something that is typically recoverable.
-				m = wire.Msg{}
-				mOk = false
+			ch.connMu.Lock()
+			ch.conn = w.Conn
+			ch.connMu.Unlock()
+		case f := <-ch.flushes:
+			pending := len(ch.outbound)
+			if mOk {
+				pending++
+			}
+			if f.start(pending) {
+				flushes = append(flushes, f)
+			}
+		case d := <-ch.detaches:
+			if !wOk {
+				d <- detachedWriter{}
 				continue
 			}
-			if _, err := w.Encoder(w.Writer, buf[:len(buf)-len(tail)]); err != nil {
+			// The writer is handed over without closing its quit channel, so
+			// that the network connection stays attached until it is
+			// reattached, or closed, by the caller of Detach.
+			d <- detachedWriter{w: w, ok: true}
+			w, wOk = writer{}, false
+		case g := <-ch.goodbyes:
+			if !wOk {
+				g.done <- nil
+				continue
+			}
+			if g.drain {
+				var err error
+				if m, mOk, err = ch.drain(w, g, m, mOk, buf, processed); err != nil {
+					w.drop()
+					w, wOk = writer{}, false
+					g.done <- fmt.Errorf("drain: %w", err)
+					continue
+				}
+			}
+			g.done <- ch.writeGoodbye(w, g, buf)
+			close(w.q)
+			w, wOk = writer{}, false
+		case m, mOk = <-mQueue:
+			if err := ch.encode(w, m, buf); err != nil {
+				if errors.Is(err, errMarshal) {
+					ch.opts.Logger.Error("marshal", zap.Error(err))
+					// Clear the latest message so that we can move on to
+					// other messages. We do this, because failure to marshal
+					// is not something that is typically recoverable.
+					m = wire.Msg{}
+					mOk = false
+					processed()
+					continue
+				}
 				ch.opts.Logger.Error("encode", zap.Error(err))
 				// If an error happened when trying to write to the writer,
 				// then clean the writer. This will force the Channel to
 				// block on future writes until a new network connection is
 				// attached. The latest message is not replaced (so we will
 				// re-attempt to write it when a new connection is
-				// eventually attached).
-				close(w.q)
+				// eventually attached). The network connection is closed,
+				// because part of the message might have been written.
+				w.drop()
 				w, wOk = writer{}, false
 				continue
 			}
 			if err := w.Writer.Flush(); err != nil {
-				// syscall.EPIPE is returned when the pipeline is broken which
-				// mean the connection has been closed.
-				if !errors.Is(err, syscall.EPIPE) {
+				// Errors that mean that the connection has been closed (by
+				// either peer) are expected, and are not logged.
+				if !errors.Is(err, syscall.EPIPE) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
 					ch.opts.Logger.Error("flush", zap.Error(err))
 				}
 				// An error when flushing is the same as an error when encoding.
-				close(w.q)
+				w.drop()
 				w, wOk = writer{}, false
 				continue
 			}
-			if m.Type == wire.MsgTypeSync {
-				if _, err := w.Encoder(w.Writer, m.SyncData); err != nil {
-					ch.opts.Logger.Error("encode", zap.NamedError("sync data", err))
-					close(w.q)
-					w, wOk = writer{}, false
-					continue
-				}
-				if err := w.Writer.Flush(); err != nil {
-					if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
-						ch.opts.Logger.Error("flush", zap.NamedError("sync data", err))
-					}
-					// An error when flushing is the same as an error when encoding.
-					close(w.q)
-					w, wOk = writer{}, false
-					continue
-				}
-			}
 
 			// Clear the latest message so that we can move on to other
 			// messages.
 			m = wire.Msg{}
 			mOk = false
+			processed()
 		}
 	}
 }
+
+// drain writes the latest message, and then all messages that are on the
+// outbound queue, to the writer, until the outbound queue is empty. If writing
+// fails, then the message that could not be written is returned, so that it
+// can be written to the next attached network connection. The processed
+// function is called once for each message that is discarded, and once for
+// each message that is written after the writer has been flushed.
+func (ch *Channel) drain(w writer, g goodbye, m wire.Msg, mOk bool, buf []byte, processed func()) (wire.Msg, bool, error) {
+	if err := w.Conn.SetWriteDeadline(g.deadline); err != nil {
+		return m, mOk, fmt.Errorf("set deadline: %w", err)
+	}
+	written := 0
+	for {
+		if !mOk {
+			select {
+			case m, mOk = <-ch.outbound:
+				if !mOk {
+					return wire.Msg{}, false, nil
+				}
+			default:
+				if err := w.Writer.Flush(); err != nil {
+					return wire.Msg{}, false, fmt.Errorf("flush: %w", err)
+				}
+				for ; written > 0; written-- {
+					processed()
+				}
+				return wire.Msg{}, false, nil
+			}
+		}
+		if err := ch.encode(w, m, buf); err != nil {
+			if errors.Is(err, errMarshal) {
+				ch.opts.Logger.Error("marshal", zap.Error(err))
+				m, mOk = wire.Msg{}, false
+				processed()
+				continue
+			}
+			return m, mOk, err
+		}
+		m, mOk = wire.Msg{}, false
+		written++
+	}
+}
+
+// errMarshal is wrapped by the errors that are returned by encode when a
+// message cannot be marshaled. Nothing is written to the writer when this
+// happens.
+var errMarshal = errors.New("marshal")
+
+// encode a message to the writer: its header, then its chunks (if it is a
+// chunked message), and then its sync data (if it is a sync message). The
+// writer is not flushed. If an error that does not wrap errMarshal is
+// returned, then part of the message might have been written, and the writer
+// must be dropped.
+func (ch *Channel) encode(w writer, m wire.Msg, buf []byte) error {
+	if w.version < wire.MsgVersion5 {
+		if m.Type == wire.MsgTypeBatch {
+			// The remote peer cannot unpack batches, so the messages are
+			// written one at a time instead. They were marshaled into the
+			// batch, so they can be marshaled again.
+			msgs, err := m.Batch()
+			if err != nil {
+				return fmt.Errorf("%w: %v", errMarshal, err)
+			}
+			for _, msg := range msgs {
+				if err := ch.encode(w, msg, buf); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		// The remote peer cannot read chunks, so the Data is written in the
+		// message instead.
+		m.Flags &^= wire.MsgFlagChunked
+	}
+	tail, _, err := header(m).Marshal(buf[:], len(buf))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMarshal, err)
+	}
+	out := w.hinted(m)
+	if _, err := w.Encoder(out, buf[:len(buf)-len(tail)]); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if chunked(m) {
+		if err := ch.writeChunks(w, out, m.Data); err != nil {
+			return err
+		}
+	}
+	if m.Type == wire.MsgTypeSync {
+		if _, err := w.Encoder(out, m.SyncData); err != nil {
+			return fmt.Errorf("encode sync data: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeGoodbye writes a goodbye message to the writer, and then closes its
+// network connection (after reading until it is closed by the remote peer, if
+// there is a CloseReadTimeout). The network connection is closed even if
+// writing fails.
+func (ch *Channel) writeGoodbye(w writer, g goodbye, buf []byte) error {
+	defer w.Conn.Close()
+
+	if err := w.Conn.SetWriteDeadline(g.deadline); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+	tail, _, err := wire.NewGoodbye(g.reason).Marshal(buf[:], len(buf))
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if _, err := w.Encoder(w.Writer, buf[:len(buf)-len(tail)]); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := w.Writer.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	ch.readUntilClosed(w.Conn, g.deadline)
+	return nil
+}
@@ -3,13 +3,24 @@ package channel_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/tcp"
 	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
+	"github.com/muirglacier/surge"
+	"golang.org/x/time/rate"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -201,4 +212,865 @@ var _ = Describe("Channels", func() {
 			})
 		})
 	})
+
+	Context("when the network connection makes short writes", func() {
+		It("should write the remainder of every frame", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			localCh, _, localOutbound := run(ctx, remotePrivKey.Signatory())
+			remoteCh, remoteInbound, _ := run(ctx, localPrivKey.Signatory())
+
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+			conn := &shortWriteConn{Conn: localConn, max: 3, writes: new(int64)}
+			go localCh.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+			go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			for i := 0; i < 10; i++ {
+				data := make([]byte, 100)
+				rand.Read(data)
+				localOutbound <- wire.Msg{Data: data}
+
+				var packet wire.Packet
+				Eventually(remoteInbound, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal(data))
+			}
+			Expect(atomic.LoadInt64(conn.writes)).To(BeNumerically(">", 10))
+		})
+	})
+
+	Context("when a write fails after a partial write", func() {
+		It("should close the network connection and write the whole frame to the next one", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			localCh, _, localOutbound := run(ctx, remotePrivKey.Signatory())
+			remoteCh, remoteInbound, _ := run(ctx, localPrivKey.Signatory())
+
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+			conn := &deadlineConn{Conn: localConn}
+			go localCh.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+			go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			data := make([]byte, 100)
+			rand.Read(data)
+			localOutbound <- wire.Msg{Data: data}
+
+			// The partially written frame must not be followed by anything
+			// else, so the network connection is closed.
+			buf := make([]byte, 1)
+			Eventually(func() error {
+				_, err := localConn.Write(buf)
+				return err
+			}, 5*time.Second).Should(HaveOccurred())
+
+			nextLocalConn, nextRemoteConn := net.Pipe()
+			defer nextLocalConn.Close()
+			defer nextRemoteConn.Close()
+			go localCh.Attach(ctx, remotePrivKey.Signatory(), nextLocalConn, enc, dec)
+			go remoteCh.Attach(ctx, localPrivKey.Signatory(), nextRemoteConn, enc, dec)
+
+			var packet wire.Packet
+			Eventually(remoteInbound, 5*time.Second).Should(Receive(&packet))
+			Expect(packet.Msg.Data).To(Equal(data))
+		})
+	})
+
+	Context("when receiving a stream of small messages", func() {
+		// countReads returns the number of reads made from the network
+		// connection while receiving n small messages, using a read buffer of
+		// the given size.
+		countReads := func(readBufferSize int, n int) int64 {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			localInbound, localOutbound := make(chan wire.Packet), make(chan wire.Msg, n)
+			localCh := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+			go localCh.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet), make(chan wire.Msg)
+			remoteCh := channel.New(channel.DefaultOptions().WithReadBufferSize(readBufferSize), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remoteCh.Run(ctx)
+
+			// Queue all messages before connecting, so that they are
+			// written as quickly as possible.
+			for i := 0; i < n; i++ {
+				localOutbound <- wire.Msg{Data: []byte{byte(i)}}
+			}
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			go func() {
+				defer GinkgoRecover()
+				conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+				Expect(err).ToNot(HaveOccurred())
+				enc, dec, _, err := handshake.Insecure(localPrivKey.Signatory())(conn, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder), codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+				Expect(err).ToNot(HaveOccurred())
+				localCh.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+			}()
+			accepted, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			conn := &countingConn{Conn: accepted, reads: new(int64)}
+			enc, dec, _, err := handshake.Insecure(remotePrivKey.Signatory())(conn, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder), codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+			Expect(err).ToNot(HaveOccurred())
+			atomic.StoreInt64(conn.reads, 0)
+
+			// Wait for all messages to be written into the network
+			// connection before reading them.
+			flushCtx, flushCancel := context.WithTimeout(ctx, 5*time.Second)
+			defer flushCancel()
+			Expect(localCh.Flush(flushCtx)).To(Succeed())
+			go remoteCh.Attach(ctx, localPrivKey.Signatory(), conn, enc, dec)
+			for i := 0; i < n; i++ {
+				var packet wire.Packet
+				Eventually(remoteInbound, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal([]byte{byte(i)}))
+			}
+			return atomic.LoadInt64(conn.reads)
+		}
+
+		It("should use fewer reads with a larger read buffer", func() {
+			n := 100
+			smallBufferReads := countReads(16, n)
+			largeBufferReads := countReads(channel.DefaultReadBufferSize, n)
+			Expect(smallBufferReads).To(BeNumerically(">=", n))
+			Expect(largeBufferReads).To(BeNumerically("<", smallBufferReads/4))
+		})
+	})
+
+	Context("when the length prefixes stop lining up", func() {
+		It("should close the connection and return a frame desync error", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg, 1)
+			ch := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			defer remoteConn.Close()
+			opts := codec.DefaultLengthPrefixOptions().WithAuthenticated(true)
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+			attached := make(chan error, 1)
+			go func() {
+				attached <- ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			}()
+
+			// The remote end writes bytes that are not a valid length
+			// prefix, and then waits for the connection to be closed.
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				io.Copy(io.Discard, remoteConn)
+			}()
+			_, err := remoteConn.Write(make([]byte, 8))
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(closed, 5*time.Second).Should(BeClosed())
+
+			// The writer faults on its next write.
+			outbound <- wire.Msg{Data: []byte("hello")}
+			var attachErr error
+			Eventually(attached, 5*time.Second).Should(Receive(&attachErr))
+			Expect(errors.Is(attachErr, channel.ErrFrameDesync)).To(BeTrue())
+		})
+	})
+
+	Context("when draining before saying goodbye", func() {
+		It("should write all queued messages before the goodbye", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg, 10)
+			ch := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+
+			// The first message is read once the connection is attached, and
+			// the rest are queued.
+			buf := make([]byte, 1024)
+			outbound <- wire.Msg{Data: []byte{0}}
+			_, err := dec(remoteConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			n := 5
+			for i := 1; i < n; i++ {
+				outbound <- wire.Msg{Data: []byte{byte(i)}}
+			}
+			drained := make(chan error, 1)
+			go func() {
+				drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+				defer drainCancel()
+				drained <- ch.Drain(drainCtx, wire.GoodbyeBanned)
+			}()
+
+			// The remote end reads every message, and then the goodbye, after
+			// which the connection is closed.
+			for i := 1; ; i++ {
+				k, err := dec(remoteConn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				msg := wire.Msg{}
+				_, _, err = msg.Unmarshal(buf[:k], k)
+				Expect(err).ToNot(HaveOccurred())
+				if msg.Type == wire.MsgTypeGoodbye {
+					Expect(i).To(Equal(n))
+					reason, err := msg.GoodbyeReason()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(reason).To(Equal(wire.GoodbyeBanned))
+					break
+				}
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+			Eventually(drained, 5*time.Second).Should(Receive(BeNil()))
+			_, err = remoteConn.Read(buf)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should close the connection when draining takes too long", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg, 10)
+			ch := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+
+			// The first message is read once the connection is attached, and
+			// then the remote end stops reading, so writing blocks.
+			buf := make([]byte, 1024)
+			outbound <- wire.Msg{Data: []byte("hello")}
+			_, err := dec(remoteConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			outbound <- wire.Msg{Data: []byte("hello")}
+			drainCtx, drainCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer drainCancel()
+			Expect(ch.Drain(drainCtx, wire.GoodbyeBanned)).To(HaveOccurred())
+
+			_, err = remoteConn.Write([]byte{0})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when reading until the connection is closed after saying goodbye", func() {
+		// connect returns both ends of a TCP connection, because a synchronous
+		// pipe cannot be closed for writing.
+		connect := func() (net.Conn, net.Conn) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			localConn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			remoteConn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			return localConn, remoteConn
+		}
+
+		It("should deliver the messages that were already written by the remote peer", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg)
+			ch := channel.New(channel.DefaultOptions().WithCloseReadTimeout(5*time.Second), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := connect()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			Eventually(func() bool {
+				_, ok := ch.Conn()
+				return ok
+			}).Should(BeTrue())
+
+			// The remote peer writes messages that nobody has consumed by
+			// the time that the Channel says goodbye.
+			n := 3
+			for i := 0; i < n; i++ {
+				msg := wire.Msg{Data: []byte{byte(i)}}
+				data, err := surge.ToBinary(msg)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = enc(remoteConn, data)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			done := make(chan error, 1)
+			start := time.Now()
+			go func() {
+				done <- ch.Goodbye(ctx, wire.GoodbyeShutdown)
+			}()
+
+			// The goodbye is followed by the end of the connection, after
+			// which the remote peer closes its end.
+			buf := make([]byte, 1024)
+			k, err := dec(remoteConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			msg := wire.Msg{}
+			_, _, err = msg.Unmarshal(buf[:k], k)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg.Type).To(Equal(wire.MsgTypeGoodbye))
+			_, err = dec(remoteConn, buf)
+			Expect(errors.Is(err, io.EOF)).To(BeTrue())
+
+			for i := 0; i < n; i++ {
+				var packet wire.Packet
+				Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal([]byte{byte(i)}))
+			}
+			Expect(remoteConn.Close()).To(Succeed())
+			Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("should close the connection once the timeout expires", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg)
+			timeout := 200 * time.Millisecond
+			ch := channel.New(channel.DefaultOptions().WithCloseReadTimeout(timeout), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := connect()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			Eventually(func() bool {
+				_, ok := ch.Conn()
+				return ok
+			}).Should(BeTrue())
+
+			// The remote peer never closes its end of the connection.
+			start := time.Now()
+			Expect(ch.Goodbye(ctx, wire.GoodbyeShutdown)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", timeout))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			_, err := localConn.Write([]byte{0})
+			Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+		})
+	})
+
+	Context("when flushing the outbound queue", func() {
+		It("should wait for the queued messages to be written", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg, 10)
+			ch := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			// Nothing is written while there is no network connection.
+			n := 3
+			for i := 0; i < n; i++ {
+				outbound <- wire.Msg{Data: []byte{byte(i)}}
+			}
+			flushCtx, flushCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer flushCancel()
+			err := ch.Flush(flushCtx)
+			flushErr := new(channel.FlushError)
+			Expect(errors.As(err, &flushErr)).To(BeTrue())
+			Expect(flushErr.Pending).To(Equal(n))
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+			localConn, remoteConn := net.Pipe()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+
+			received := make(chan []byte, n)
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					k, err := dec(remoteConn, buf)
+					if err != nil {
+						return
+					}
+					msg := wire.Msg{}
+					if _, _, err := msg.Unmarshal(buf[:k], k); err != nil {
+						return
+					}
+					received <- msg.Data
+				}
+			}()
+
+			// Once the network connection is attached, flushing waits for
+			// all queued messages to be written.
+			Expect(ch.Flush(ctx)).To(Succeed())
+			for i := 0; i < n; i++ {
+				Eventually(received).Should(Receive(Equal([]byte{byte(i)})))
+			}
+
+			// Flushing an empty queue returns immediately.
+			Expect(ch.Flush(ctx)).To(Succeed())
+		})
+	})
+
+	Context("when reading messages of different sizes", func() {
+		It("should count them in the size histogram", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet, 10), make(chan wire.Msg)
+			// The buckets are sorted by the Channel.
+			ch := channel.New(channel.DefaultOptions().WithSizeBuckets([]int{1024, 64}), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+
+			sizes := []int{0, 100, 2000}
+			total := 0
+			for _, size := range sizes {
+				msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: make([]byte, size)}
+				buf := make([]byte, msg.SizeHint())
+				_, _, err := msg.Marshal(buf, len(buf))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = enc(remoteConn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				total += len(buf)
+				Eventually(inbound).Should(Receive())
+			}
+
+			histogram := ch.InboundSizes()
+			Expect(histogram.Buckets).To(Equal([]int{64, 1024}))
+			Expect(histogram.Counts).To(Equal([]uint64{1, 1, 1}))
+			Expect(histogram.Cumulative()).To(Equal([]uint64{1, 2, 3}))
+			Expect(histogram.Count()).To(Equal(uint64(3)))
+			Expect(histogram.Sum).To(Equal(uint64(total)))
+		})
+	})
+
+	// connectWithVersion is the same as connect, but the local Channel
+	// only writes messages that are understood by the version.
+	connectWithVersion := func(ctx context.Context, localOpts, remoteOpts channel.Options, version uint16) (chan<- wire.Msg, <-chan wire.Packet) {
+		localPrivKey, remotePrivKey := id.NewPrivKey(), id.NewPrivKey()
+		outbound := make(chan wire.Msg)
+		inbound := make(chan wire.Packet, 10)
+		localCh := channel.New(localOpts, remotePrivKey.Signatory(), make(chan wire.Packet), outbound)
+		remoteCh := channel.New(remoteOpts, localPrivKey.Signatory(), inbound, make(chan wire.Msg))
+		go localCh.Run(ctx)
+		go remoteCh.Run(ctx)
+
+		localConn, remoteConn := net.Pipe()
+		enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+		dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+		go localCh.AttachWithVersion(ctx, remotePrivKey.Signatory(), localConn, enc, dec, version)
+		go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+		return outbound, inbound
+	}
+
+	// connect two Channels using an in-memory network connection. Messages
+	// sent to the outbound channel are received from the inbound channel.
+	connect := func(ctx context.Context, localOpts, remoteOpts channel.Options) (chan<- wire.Msg, <-chan wire.Packet) {
+		return connectWithVersion(ctx, localOpts, remoteOpts, wire.MsgVersionLatest)
+	}
+
+	Context("when sending a chunked message", func() {
+		It("should deliver the data as a stream of chunks", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// The data is larger than the maximum message size of the remote
+			// peer, which is only possible when it is chunked.
+			outbound, inbound := connect(
+				ctx,
+				channel.DefaultOptions().WithChunkSize(1024),
+				channel.DefaultOptions().WithMaxMessageSize(16*1024).WithRateLimit(rate.Inf))
+			data := make([]byte, 64*1024)
+			rand.Read(data)
+			outbound <- wire.Msg{Type: wire.MsgTypeSend, Data: data}.Chunked()
+			go func() {
+				outbound <- wire.Msg{Type: wire.MsgTypeSend, Data: []byte("after")}
+			}()
+
+			var packet wire.Packet
+			Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+			Expect(packet.Msg.IsChunked()).To(BeTrue())
+			Expect(packet.Msg.Data).To(BeEmpty())
+			Expect(packet.Body).ToNot(BeNil())
+
+			// The first chunk can be read before the rest have been read
+			// from the network connection.
+			chunk := make([]byte, 1024)
+			_, err := io.ReadFull(packet.Body, chunk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chunk).To(Equal(data[:1024]))
+			rest, err := io.ReadAll(packet.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rest).To(Equal(data[1024:]))
+
+			Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+			Expect(packet.Body).To(BeNil())
+			Expect(packet.Msg.Data).To(Equal([]byte("after")))
+		})
+
+		It("should discard the chunks when the body is not read in time", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			outbound, inbound := connect(
+				ctx,
+				channel.DefaultOptions().WithChunkSize(1024),
+				channel.DefaultOptions().WithChunkTimeout(100*time.Millisecond))
+			outbound <- wire.Msg{Type: wire.MsgTypeSend, Data: make([]byte, 4*1024)}.Chunked()
+			go func() {
+				outbound <- wire.Msg{Type: wire.MsgTypeSend, Data: []byte("after")}
+			}()
+
+			var chunked, after wire.Packet
+			Eventually(inbound, 5*time.Second).Should(Receive(&chunked))
+			Eventually(inbound, 5*time.Second).Should(Receive(&after))
+			Expect(after.Msg.Data).To(Equal([]byte("after")))
+
+			_, err := io.ReadAll(chunked.Body)
+			Expect(errors.Is(err, channel.ErrChunkTimeout)).To(BeTrue())
+		})
+
+		Context("when the remote peer does not understand chunked messages", func() {
+			It("should deliver the data in the message", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				outbound, inbound := connectWithVersion(
+					ctx,
+					channel.DefaultOptions().WithChunkSize(1024),
+					channel.DefaultOptions().WithRateLimit(rate.Inf),
+					wire.MsgVersion4)
+				data := make([]byte, 4*1024)
+				rand.Read(data)
+				outbound <- wire.Msg{Type: wire.MsgTypeSend, Data: data}.Chunked()
+
+				var packet wire.Packet
+				Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.IsChunked()).To(BeFalse())
+				Expect(packet.Body).To(BeNil())
+				Expect(packet.Msg.Data).To(Equal(data))
+			})
+		})
+	})
+
+	Context("when detaching while a chunked message is being read", func() {
+		It("should finish reading the message before detaching", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet, 1), make(chan wire.Msg)
+			ch := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			localConn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			remoteConn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+
+			// The remote peer writes the header, and the first chunk, of a
+			// chunked message.
+			data, err := surge.ToBinary(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend}.Chunked())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(remoteConn, data)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(remoteConn, []byte("first"))
+			Expect(err).ToNot(HaveOccurred())
+			var packet wire.Packet
+			Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+			Expect(packet.Body).ToNot(BeNil())
+			chunk := make([]byte, 5)
+			_, err = io.ReadFull(packet.Body, chunk)
+			Expect(err).ToNot(HaveOccurred())
+
+			type detachResult struct {
+				d   *channel.Detached
+				err error
+			}
+			detached := make(chan detachResult, 1)
+			go func() {
+				d, err := ch.Detach(ctx)
+				detached <- detachResult{d: d, err: err}
+			}()
+			Consistently(detached, 100*time.Millisecond).ShouldNot(Receive())
+
+			// The rest of the message is read before the network connection
+			// is detached.
+			_, err = enc(remoteConn, []byte("second"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(remoteConn, []byte{})
+			Expect(err).ToNot(HaveOccurred())
+			rest, err := io.ReadAll(packet.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rest).To(Equal([]byte("second")))
+
+			var result detachResult
+			Eventually(detached, 5*time.Second).Should(Receive(&result))
+			Expect(result.err).ToNot(HaveOccurred())
+
+			// The network connection can be used directly.
+			_, err = enc(remoteConn, []byte("direct"))
+			Expect(err).ToNot(HaveOccurred())
+			buf := make([]byte, 64)
+			n, err := result.d.Decoder()(result.d.Conn(), buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf[:n]).To(Equal([]byte("direct")))
+			Expect(result.d.Close()).To(Succeed())
+		})
+	})
+
+	Context("when sending a batch", func() {
+		Context("when the remote peer does not understand batches", func() {
+			It("should deliver the messages one at a time", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				outbound, inbound := connectWithVersion(ctx, channel.DefaultOptions(), channel.DefaultOptions(), wire.MsgVersion4)
+				msgs := make([]wire.Msg, 3)
+				for i := range msgs {
+					msgs[i] = wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}}
+				}
+				batch, err := wire.NewBatch(msgs)
+				Expect(err).ToNot(HaveOccurred())
+				outbound <- batch
+
+				for i := range msgs {
+					var packet wire.Packet
+					Eventually(inbound, 5*time.Second).Should(Receive(&packet))
+					Expect(packet.Msg.Type).To(Equal(wire.MsgTypeSend))
+					Expect(packet.Msg.Data).To(Equal([]byte{byte(i)}))
+				}
+			})
+		})
+	})
+
+	Context("when the inbound messaging channel is full", func() {
+		// overflow sends n messages to a remote Channel that buffers, but does
+		// not consume, two inbound messages. It returns the buffered messages,
+		// and the number of messages that were dropped.
+		overflow := func(policy channel.InboundPolicy, n int) ([]byte, uint64) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			localInbound, localOutbound := make(chan wire.Packet), make(chan wire.Msg, n)
+			localCh := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+			go localCh.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 2), make(chan wire.Msg)
+			remoteCh := channel.NewWithInbound(channel.DefaultOptions().WithInboundPolicy(policy), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remoteCh.Run(ctx)
+
+			for i := 0; i < n; i++ {
+				localOutbound <- wire.Msg{Data: []byte{byte(i)}}
+			}
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go localCh.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			Eventually(func() int { return len(remoteInbound) }, 5*time.Second).Should(Equal(2))
+			// Give the remote Channel time to read (and drop) the rest of the
+			// messages.
+			time.Sleep(100 * time.Millisecond)
+
+			buffered := []byte{}
+			for len(remoteInbound) > 0 {
+				packet := <-remoteInbound
+				buffered = append(buffered, packet.Msg.Data...)
+			}
+			return buffered, remoteCh.Dropped()
+		}
+
+		Context("when dropping the newest messages", func() {
+			It("should keep the oldest messages", func() {
+				buffered, dropped := overflow(channel.InboundDropNewest, 10)
+				Expect(buffered).To(Equal([]byte{0, 1}))
+				Expect(dropped).To(Equal(uint64(8)))
+			})
+		})
+
+		Context("when dropping the oldest messages", func() {
+			It("should keep the newest messages", func() {
+				buffered, dropped := overflow(channel.InboundDropOldest, 10)
+				Expect(buffered).To(Equal([]byte{8, 9}))
+				Expect(dropped).To(Equal(uint64(8)))
+			})
+		})
+
+		Context("when disconnecting slow consumers", func() {
+			It("should stop reading from the connection", func() {
+				buffered, dropped := overflow(channel.InboundDisconnect, 10)
+				Expect(buffered).To(Equal([]byte{0, 1}))
+				Expect(dropped).To(Equal(uint64(1)))
+			})
+		})
+
+		Context("when blocking", func() {
+			It("should not drop messages", func() {
+				// The blocked message can be delivered while the buffered
+				// messages are being drained.
+				buffered, dropped := overflow(channel.InboundBlock, 10)
+				Expect(buffered[:2]).To(Equal([]byte{0, 1}))
+				Expect(dropped).To(BeZero())
+			})
+		})
+
+		Context("when a chunked message is dropped", func() {
+			It("should discard its chunks without waiting for the chunk timeout", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				localPrivKey := id.NewPrivKey()
+				remotePrivKey := id.NewPrivKey()
+
+				localInbound, localOutbound := make(chan wire.Packet), make(chan wire.Msg, 3)
+				localCh := channel.New(channel.DefaultOptions().WithChunkSize(1024), remotePrivKey.Signatory(), localInbound, localOutbound)
+				go localCh.Run(ctx)
+				remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan wire.Msg)
+				remoteOpts := channel.DefaultOptions().WithInboundPolicy(channel.InboundDropNewest).WithChunkTimeout(time.Minute)
+				remoteCh := channel.New(remoteOpts, localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+				go remoteCh.Run(ctx)
+
+				localOutbound <- wire.Msg{Type: wire.MsgTypeSend, Data: []byte("first")}
+				localOutbound <- wire.Msg{Type: wire.MsgTypeSend, Data: make([]byte, 4*1024)}.Chunked()
+				localOutbound <- wire.Msg{Type: wire.MsgTypeSend, Data: []byte("after")}
+				localConn, remoteConn := net.Pipe()
+				defer localConn.Close()
+				defer remoteConn.Close()
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				go localCh.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+				go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+				// The chunked message is dropped, and so is the message that
+				// follows its chunks.
+				Eventually(remoteCh.Dropped, 5*time.Second).Should(Equal(uint64(2)))
+				var packet wire.Packet
+				Expect(remoteInbound).To(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal([]byte("first")))
+			})
+		})
+
+		Context("when dropping the oldest messages from a Channel that cannot receive them", func() {
+			It("should drop the newest messages instead", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				localPrivKey := id.NewPrivKey()
+				remotePrivKey := id.NewPrivKey()
+
+				localInbound, localOutbound := make(chan wire.Packet), make(chan wire.Msg, 3)
+				localCh := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+				go localCh.Run(ctx)
+				remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan wire.Msg)
+				remoteCh := channel.New(channel.DefaultOptions().WithInboundPolicy(channel.InboundDropOldest), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+				go remoteCh.Run(ctx)
+
+				for i := 0; i < 3; i++ {
+					localOutbound <- wire.Msg{Data: []byte{byte(i)}}
+				}
+				localConn, remoteConn := net.Pipe()
+				defer localConn.Close()
+				defer remoteConn.Close()
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				go localCh.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+				go remoteCh.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+				Eventually(remoteCh.Dropped, 5*time.Second).Should(Equal(uint64(2)))
+				var packet wire.Packet
+				Expect(remoteInbound).To(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal([]byte{0}))
+			})
+		})
+	})
 })
+
+// countingConn counts the number of reads made from a network connection.
+type countingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(conn.reads, 1)
+	return conn.Conn.Read(p)
+}
+
+// shortWriteConn writes, at most, max bytes per call to Write, without
+// returning an error.
+type shortWriteConn struct {
+	net.Conn
+	max    int
+	writes *int64
+}
+
+func (conn *shortWriteConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(conn.writes, 1)
+	if len(p) > conn.max {
+		p = p[:conn.max]
+	}
+	return conn.Conn.Write(p)
+}
+
+// deadlineConn writes half of the first write, and then fails as if the write
+// deadline was exceeded.
+type deadlineConn struct {
+	net.Conn
+	failed bool
+}
+
+func (conn *deadlineConn) Write(p []byte) (int, error) {
+	if conn.failed {
+		return conn.Conn.Write(p)
+	}
+	conn.failed = true
+	n, err := conn.Conn.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, os.ErrDeadlineExceeded
+}
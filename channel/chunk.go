@@ -0,0 +1,169 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+)
+
+// ErrChunkTimeout is returned when reading the Body of a chunked message that
+// was closed, because the application did not read one of its chunks before
+// the ChunkTimeout.
+var ErrChunkTimeout = errors.New("chunk timeout")
+
+// chunked returns true if the Data of the message is written as a sequence of
+// chunks. Sync messages are never chunked, because their sync data is already
+// written after them.
+func chunked(m wire.Msg) bool {
+	return m.IsChunked() && m.Type != wire.MsgTypeSync
+}
+
+// header returns the message that is written before the chunks of its Data.
+// If the message is not chunked, it is returned as it is.
+func header(m wire.Msg) wire.Msg {
+	if chunked(m) {
+		m.Data = nil
+	}
+	return m
+}
+
+// body is the Body of a chunked message. Chunks are handed over to the
+// application one at a time, so that the network connection is only read as
+// fast as the application reads the Body.
+type body struct {
+	chunks chan []byte
+	// err is returned once all chunks have been read. It is written before the
+	// chunks channel is closed.
+	err error
+	// chunk is the part of the current chunk that has not been read.
+	chunk []byte
+
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newBody() *body {
+	return &body{
+		chunks:    make(chan []byte),
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+}
+
+// Read the Data of the chunked message, blocking until the next chunk arrives.
+func (b *body) Read(p []byte) (int, error) {
+	for len(b.chunk) == 0 {
+		select {
+		case <-b.done:
+			return 0, io.ErrClosedPipe
+		case chunk, ok := <-b.chunks:
+			if !ok {
+				return 0, b.err
+			}
+			b.chunk = chunk
+		}
+	}
+	n := copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+	return n, nil
+}
+
+// Close the Body. The rest of the chunks are discarded as they arrive.
+func (b *body) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
+
+// push a chunk to the application, waiting at most for the timeout. It returns
+// false if the chunk was not read, in which case the Body has been finished,
+// and no more chunks should be pushed.
+func (b *body) push(ctx context.Context, chunk []byte, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b.chunks <- chunk:
+		return true
+	case <-b.done:
+		b.finish(io.ErrClosedPipe)
+	case <-timer.C:
+		b.finish(ErrChunkTimeout)
+	case <-ctx.Done():
+		b.finish(ctx.Err())
+	}
+	return false
+}
+
+// finish the Body, so that reading from it returns the error once all chunks
+// have been read. It must only be called once.
+func (b *body) finish(err error) {
+	b.err = err
+	close(b.chunks)
+}
+
+// readChunks reads the chunks of a chunked message from the reader, and pushes
+// them to the Body, until the empty chunk that ends them. Once the Body stops
+// accepting chunks, the rest of the chunks are still read, so that the next
+// message can be found, but they are discarded. The total size of the chunks
+// is returned. An error is returned if reading fails, in which case the reader
+// can no longer be used.
+func (ch *Channel) readChunks(ctx context.Context, r reader, b *body, buf []byte) (int, error) {
+	pushing := true
+	finish := func(err error) {
+		if pushing {
+			b.finish(err)
+			pushing = false
+		}
+	}
+	size := 0
+	for {
+		n, err := r.Decoder(r.Reader, buf)
+		if err != nil {
+			finish(io.ErrUnexpectedEOF)
+			return size, fmt.Errorf("decode chunk: %w", err)
+		}
+		if !ch.rateLimiter.AllowN(time.Now(), n) {
+			finish(io.ErrUnexpectedEOF)
+			return size, errors.New("rate limit exceeded")
+		}
+		if n == 0 {
+			finish(io.EOF)
+			return size, nil
+		}
+		size += n
+		if !pushing {
+			continue
+		}
+		chunk := make([]byte, n)
+		copy(chunk, buf[:n])
+		pushing = b.push(ctx, chunk, ch.opts.ChunkTimeout)
+	}
+}
+
+// writeChunks writes the Data of a chunked message to the writer, followed by
+// the empty chunk that ends it. The chunks are encoded to out (see
+// writer.hinted). The writer is not flushed.
+func (ch *Channel) writeChunks(w writer, out io.Writer, data []byte) error {
+	size := ch.opts.chunkSize()
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Encoder(out, data[:n]); err != nil {
+			return fmt.Errorf("encode chunk: %w", err)
+		}
+		data = data[n:]
+	}
+	if _, err := w.Encoder(out, []byte{}); err != nil {
+		return fmt.Errorf("encode end of chunks: %w", err)
+	}
+	return nil
+}
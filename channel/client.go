@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/muirglacier/aw/codec"
 	"github.com/muirglacier/aw/wire"
@@ -35,6 +36,11 @@ type sharedChannel struct {
 	outbound chan<- wire.Msg
 }
 
+// An InboundFilter inspects messages received from remote peers before they are
+// delivered to receivers and subscribers. If it returns an error, then the
+// message is dropped.
+type InboundFilter func(from id.Signatory, msg wire.Msg) error
+
 type Msg struct {
 	wire.Packet
 	From id.Signatory
@@ -44,8 +50,21 @@ type Client struct {
 	opts Options
 	self id.Signatory
 
+	// dropped is the number of inbound messages dropped by Channels that are
+	// no longer bound.
+	dropped *uint64
+	// sizes is the SizeHistogram of Channels that are no longer bound. It is
+	// guarded by the sharedChannelsMu.
+	sizes SizeHistogram
+
 	sharedChannelsMu *sync.RWMutex
 	sharedChannels   map[id.Signatory]*sharedChannel
+	// peerOpts override the Options for the Channels of remote peers. They
+	// are guarded by the sharedChannelsMu.
+	peerOpts map[id.Signatory]PeerOptions
+
+	inboundFilterMu *sync.RWMutex
+	inboundFilter   InboundFilter
 
 	inbound            chan Msg
 	receivers          chan receiver
@@ -58,8 +77,14 @@ func NewClient(opts Options, self id.Signatory) *Client {
 		opts: opts,
 		self: self,
 
+		dropped: new(uint64),
+
 		sharedChannelsMu: new(sync.RWMutex),
 		sharedChannels:   map[id.Signatory]*sharedChannel{},
+		peerOpts:         map[id.Signatory]PeerOptions{},
+
+		inboundFilterMu: new(sync.RWMutex),
+		inboundFilter:   nil,
 
 		inbound:            make(chan Msg),
 		receivers:          make(chan receiver),
@@ -78,11 +103,12 @@ func (client *Client) Bind(remote id.Signatory) {
 		return
 	}
 
-	inbound := make(chan wire.Packet, client.opts.InboundBufferSize)
-	outbound := make(chan wire.Msg, client.opts.OutboundBufferSize)
+	opts := client.opts.override(client.peerOpts[remote])
+	inbound := make(chan wire.Packet, opts.InboundBufferSize)
+	outbound := make(chan wire.Msg, opts.OutboundBufferSize)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	ch := New(client.opts, remote, inbound, outbound)
+	ch := NewWithInbound(opts, remote, inbound, outbound)
 	go func() {
 		if err := ch.Run(ctx); err != nil {
 			if !errors.Is(err, context.Canceled) {
@@ -96,10 +122,23 @@ func (client *Client) Bind(remote id.Signatory) {
 			case <-ctx.Done():
 				return
 			case packet := <-inbound:
-				select {
-				case <-ctx.Done():
-					return
-				case client.inbound <- Msg{Packet: packet, From: remote}:
+				if packet.Msg.Type != wire.MsgTypeBatch {
+					if !client.deliver(ctx, remote, packet) {
+						return
+					}
+					continue
+				}
+				// The messages of a batch are delivered separately, and in
+				// order, as if they had been sent one at a time.
+				msgs, err := packet.Msg.Batch()
+				if err != nil {
+					client.opts.Logger.Warn("bad batch", zap.String("remote", remote.String()), zap.Error(err))
+					continue
+				}
+				for _, msg := range msgs {
+					if !client.deliver(ctx, remote, wire.Packet{Msg: msg, IPAddr: packet.IPAddr}) {
+						return
+					}
 				}
 			}
 		}
@@ -114,6 +153,48 @@ func (client *Client) Bind(remote id.Signatory) {
 	}
 }
 
+// deliver an inbound packet from the remote peer to the receivers, unless it
+// is rejected by the inbound filter. It returns false if the context is done.
+func (client *Client) deliver(ctx context.Context, remote id.Signatory, packet wire.Packet) bool {
+	if err := client.filterInbound(remote, packet.Msg); err != nil {
+		client.opts.Logger.Debug("inbound filter", zap.String("remote", remote.String()), zap.Error(err))
+		// Nobody will read the Body of a filtered message, so it is closed
+		// to stop waiting for its chunks to be read.
+		if packet.Body != nil {
+			packet.Body.Close()
+		}
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case client.inbound <- Msg{Packet: packet, From: remote}:
+		return true
+	}
+}
+
+// SetInboundFilter sets the InboundFilter that is applied to all messages
+// received from remote peers. It is applied once per message, before the
+// message is delivered to any receiver or subscriber. A nil InboundFilter
+// allows all messages.
+func (client *Client) SetInboundFilter(filter InboundFilter) {
+	client.inboundFilterMu.Lock()
+	defer client.inboundFilterMu.Unlock()
+
+	client.inboundFilter = filter
+}
+
+func (client *Client) filterInbound(from id.Signatory, msg wire.Msg) error {
+	client.inboundFilterMu.RLock()
+	filter := client.inboundFilter
+	client.inboundFilterMu.RUnlock()
+
+	if filter == nil {
+		return nil
+	}
+	return filter(from, msg)
+}
+
 func (client *Client) Unbind(remote id.Signatory) {
 	client.sharedChannelsMu.Lock()
 	defer client.sharedChannelsMu.Unlock()
@@ -126,10 +207,53 @@ func (client *Client) Unbind(remote id.Signatory) {
 	shared.rc--
 	if shared.rc == 0 {
 		shared.cancel()
+		atomic.AddUint64(client.dropped, shared.ch.Dropped())
+		client.sizes.add(shared.ch.InboundSizes())
 		delete(client.sharedChannels, remote)
 	}
 }
 
+// Dropped returns the total number of inbound messages that have been dropped
+// by the Channels of the Client, because of their InboundPolicy.
+func (client *Client) Dropped() uint64 {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	dropped := atomic.LoadUint64(client.dropped)
+	for _, shared := range client.sharedChannels {
+		dropped += shared.ch.Dropped()
+	}
+	return dropped
+}
+
+// InboundSizes returns the SizeHistogram of all inbound messages that have
+// been read by the Channels of the Client. See Channel.InboundSizes for more
+// details.
+func (client *Client) InboundSizes() SizeHistogram {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	sizes := newSizeHistogram(client.opts.SizeBuckets).snapshot()
+	sizes.add(client.sizes)
+	for _, shared := range client.sharedChannels {
+		sizes.add(shared.ch.InboundSizes())
+	}
+	return sizes
+}
+
+// PeerInboundSizes returns the SizeHistogram of the inbound messages that have
+// been read by the Channel bound to the remote peer. False is returned if there
+// is no Channel bound to the remote peer.
+func (client *Client) PeerInboundSizes(remote id.Signatory) (SizeHistogram, bool) {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	client.sharedChannelsMu.RUnlock()
+	if !ok {
+		return SizeHistogram{}, false
+	}
+	return shared.ch.InboundSizes(), true
+}
+
 func (client *Client) IsBound(remote id.Signatory) bool {
 	client.sharedChannelsMu.RLock()
 	defer client.sharedChannelsMu.RUnlock()
@@ -137,12 +261,33 @@ func (client *Client) IsBound(remote id.Signatory) bool {
 	return client.sharedChannels[remote].rc > 0
 }
 
+// Conn returns the network connection that was most recently attached to the
+// Channel bound to the remote peer. See Channel.Conn for more details. False is
+// returned if there is no Channel bound to the remote peer, or if it has no
+// network connection.
+func (client *Client) Conn(remote id.Signatory) (net.Conn, bool) {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	client.sharedChannelsMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return shared.ch.Conn()
+}
+
 // Attach a network connection, encoder, and decoder to the Channel associated
 // with a remote peer without incrementing the reference-counter of the Channel.
 // An error is returned if no Channel is associated with the remote peer. As
 // with the Attach method that is exposed directly by a Channel, this method is
 // blocking.
 func (client *Client) Attach(ctx context.Context, remote id.Signatory, conn net.Conn, enc codec.Encoder, dec codec.Decoder) error {
+	return client.AttachWithVersion(ctx, remote, conn, enc, dec, wire.MsgVersionLatest)
+}
+
+// AttachWithVersion is the same as Attach, but the remote peer is only assumed
+// to understand the given MsgVersion. See Channel.AttachWithVersion for more
+// details.
+func (client *Client) AttachWithVersion(ctx context.Context, remote id.Signatory, conn net.Conn, enc codec.Encoder, dec codec.Decoder, version uint16) error {
 	client.sharedChannelsMu.RLock()
 	shared, ok := client.sharedChannels[remote]
 	if !ok {
@@ -152,12 +297,32 @@ func (client *Client) Attach(ctx context.Context, remote id.Signatory, conn net.
 	client.sharedChannelsMu.RUnlock()
 
 	client.opts.Logger.Debug("attach", zap.String("self", client.self.String()), zap.String("remote", remote.String()), zap.String("addr", conn.RemoteAddr().String()))
-	if err := shared.ch.Attach(ctx, remote, conn, enc, dec); err != nil {
+	if err := shared.ch.AttachWithVersion(ctx, remote, conn, enc, dec, version); err != nil {
 		return fmt.Errorf("attach: %w", err)
 	}
 	return nil
 }
 
+// Detach the network connection attached to the Channel bound to the remote
+// peer. See Channel.Detach for more details. An error is returned if there is
+// no Channel bound to the remote peer.
+func (client *Client) Detach(ctx context.Context, remote id.Signatory) (*Detached, error) {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		client.sharedChannelsMu.RUnlock()
+		return nil, fmt.Errorf("detach: no connection to %v", remote)
+	}
+	client.sharedChannelsMu.RUnlock()
+
+	client.opts.Logger.Debug("detach", zap.String("self", client.self.String()), zap.String("remote", remote.String()))
+	detached, err := shared.ch.Detach(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("detach: %w", err)
+	}
+	return detached, nil
+}
+
 func (client *Client) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
 	client.sharedChannelsMu.RLock()
 	shared, ok := client.sharedChannels[remote]
@@ -175,6 +340,61 @@ func (client *Client) Send(ctx context.Context, remote id.Signatory, msg wire.Ms
 	}
 }
 
+// Goodbye writes a goodbye message, with the given reason, to the network
+// connection attached to the Channel associated with a remote peer, and then
+// closes the network connection. An error is returned if no Channel is
+// associated with the remote peer. See the Goodbye method that is exposed
+// directly by a Channel for more details.
+func (client *Client) Goodbye(ctx context.Context, remote id.Signatory, reason wire.GoodbyeReason) error {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		client.sharedChannelsMu.RUnlock()
+		return fmt.Errorf("goodbye: no connection to %v", remote)
+	}
+	client.sharedChannelsMu.RUnlock()
+
+	client.opts.Logger.Debug("goodbye", zap.String("self", client.self.String()), zap.String("remote", remote.String()), zap.String("reason", reason.String()))
+	if err := shared.ch.Goodbye(ctx, reason); err != nil {
+		return fmt.Errorf("goodbye: %w", err)
+	}
+	return nil
+}
+
+// Drain the outbound queue of the Channel bound to the remote peer, and then
+// say goodbye. See Channel.Drain for more details. An error is returned if
+// there is no Channel bound to the remote peer.
+func (client *Client) Drain(ctx context.Context, remote id.Signatory, reason wire.GoodbyeReason) error {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		client.sharedChannelsMu.RUnlock()
+		return fmt.Errorf("drain: no connection to %v", remote)
+	}
+	client.sharedChannelsMu.RUnlock()
+
+	client.opts.Logger.Debug("drain", zap.String("self", client.self.String()), zap.String("remote", remote.String()), zap.String("reason", reason.String()))
+	if err := shared.ch.Drain(ctx, reason); err != nil {
+		return fmt.Errorf("drain: %w", err)
+	}
+	return nil
+}
+
+// Flush the outbound queue of the Channel bound to the remote peer to its
+// network connection. See Channel.Flush for more details. An error is returned
+// if there is no Channel bound to the remote peer.
+func (client *Client) Flush(ctx context.Context, remote id.Signatory) error {
+	client.sharedChannelsMu.RLock()
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		client.sharedChannelsMu.RUnlock()
+		return fmt.Errorf("flush: no connection to %v", remote)
+	}
+	client.sharedChannelsMu.RUnlock()
+
+	return shared.ch.Flush(ctx)
+}
+
 func (client *Client) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) error) {
 	client.receiversRunningMu.Lock()
 	if client.receiversRunning {
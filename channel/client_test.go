@@ -3,14 +3,22 @@ package channel_test
 import (
 	"context"
 	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
 	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 var _ = Describe("Client", func() {
@@ -165,6 +173,119 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Context("when subscribing with a match function", func() {
+		It("should only deliver matching messages to each subscriber", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			n := 10
+			pushes := remote.Subscribe(ctx, channel.MatchType(wire.MsgTypePush), n)
+			pulls := remote.Subscribe(ctx, channel.MatchType(wire.MsgTypePull), n)
+			all := remote.Subscribe(ctx, channel.MatchFrom(localPrivKey.Signatory()), 2*n)
+
+			for i := 0; i < n; i++ {
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Type: wire.MsgTypePush})).To(Succeed())
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Type: wire.MsgTypePull})).To(Succeed())
+			}
+			for i := 0; i < n; i++ {
+				var msg channel.Msg
+				Eventually(pushes, 5*time.Second).Should(Receive(&msg))
+				Expect(msg.Msg.Type).To(Equal(wire.MsgTypePush))
+				Expect(msg.From).To(Equal(localPrivKey.Signatory()))
+				Eventually(pulls, 5*time.Second).Should(Receive(&msg))
+				Expect(msg.Msg.Type).To(Equal(wire.MsgTypePull))
+			}
+			for i := 0; i < 2*n; i++ {
+				Eventually(all, 5*time.Second).Should(Receive())
+			}
+			Consistently(pushes).ShouldNot(Receive())
+		})
+	})
+
+	Context("when unsubscribing", func() {
+		It("should close the subscription channels", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client := channel.NewClient(channel.DefaultOptions(), id.NewPrivKey().Signatory())
+			subCtx, subCancel := context.WithCancel(ctx)
+			msgs := client.Subscribe(subCtx, channel.MatchType(wire.MsgTypePush), 1)
+			batches := client.SubscribeBatch(subCtx, channel.MatchType(wire.MsgTypePush), 1, time.Millisecond)
+			Consistently(msgs).ShouldNot(BeClosed())
+			subCancel()
+			Eventually(msgs).Should(BeClosed())
+			Eventually(batches).Should(BeClosed())
+		})
+	})
+
+	Context("when subscribing in batches", func() {
+		It("should deliver messages in order, flushed by size or time", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			batchSize := 5
+			batches := remote.SubscribeBatch(ctx, channel.MatchType(wire.MsgTypePush), batchSize, 100*time.Millisecond)
+
+			n := 2*batchSize + 1
+			for i := 0; i < n; i++ {
+				data := [8]byte{}
+				binary.BigEndian.PutUint64(data[:], uint64(i))
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Type: wire.MsgTypePush, Data: data[:]})).To(Succeed())
+			}
+
+			// All messages are delivered in order. The last message does not
+			// fill a batch, so it is flushed by the timer.
+			received := 0
+			for received < n {
+				var batch []channel.Msg
+				Eventually(batches, 5*time.Second).Should(Receive(&batch))
+				Expect(len(batch)).To(BeNumerically("<=", batchSize))
+				for _, msg := range batch {
+					Expect(binary.BigEndian.Uint64(msg.Msg.Data)).To(Equal(uint64(received)))
+					Expect(msg.From).To(Equal(localPrivKey.Signatory()))
+					received++
+				}
+			}
+			Consistently(batches).ShouldNot(Receive())
+		})
+	})
+
 	Context("when sending before binding", func() {
 		It("should return an error", func() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -192,4 +313,141 @@ var _ = Describe("Client", func() {
 			Expect(local.Attach(ctx, remotePrivKey.Signatory(), nil, nil, nil)).To(HaveOccurred())
 		})
 	})
+
+	Context("when overriding the options for a remote peer", func() {
+		It("should apply the rate limit to the existing channel", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			opts := channel.DefaultOptions().WithMaxMessageSize(1024)
+
+			local := channel.NewClient(opts, localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(opts, remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+			Expect(remote.SetPeerOptions(localPrivKey.Signatory(), channel.PeerOptions{}.WithRateLimit(1))).To(Succeed())
+
+			received := int64(0)
+			remote.Receive(ctx, func(id.Signatory, wire.Packet) error {
+				atomic.AddInt64(&received, 1)
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			// The burst of the rate limit only allows one message, so the
+			// connection is dropped before the others are received.
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: make([]byte, 600)})).To(Succeed())
+			Eventually(func() int64 { return atomic.LoadInt64(&received) }).Should(Equal(int64(1)))
+			for i := 0; i < 2; i++ {
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: make([]byte, 600)})).To(Succeed())
+			}
+			Consistently(func() int64 { return atomic.LoadInt64(&received) }, time.Second).Should(Equal(int64(1)))
+		})
+
+		It("should fall back to the options of the client when cleared", func() {
+			remote := id.NewPrivKey().Signatory()
+			client := channel.NewClient(channel.DefaultOptions(), id.NewPrivKey().Signatory())
+
+			_, ok := client.PeerOptions(remote)
+			Expect(ok).To(BeFalse())
+			Expect(client.SetPeerOptions(remote, channel.PeerOptions{}.WithInboundBufferSize(-1))).ToNot(Succeed())
+			_, ok = client.PeerOptions(remote)
+			Expect(ok).To(BeFalse())
+
+			peerOpts := channel.PeerOptions{}.WithRateLimit(1).WithOutboundBufferSize(10)
+			Expect(client.SetPeerOptions(remote, peerOpts)).To(Succeed())
+			got, ok := client.PeerOptions(remote)
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(peerOpts))
+			Expect(got.InboundBufferSize).To(BeNil())
+
+			client.ClearPeerOptions(remote)
+			_, ok = client.PeerOptions(remote)
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
+
+// benchmarkClients returns a pair of Clients that are bound, and attached, to
+// each other over an in-memory connection.
+func benchmarkClients(b *testing.B, ctx context.Context) (*channel.Client, *channel.Client, id.Signatory) {
+	opts := channel.DefaultOptions().WithLogger(zap.NewNop()).WithRateLimit(rate.Inf)
+	localPrivKey := id.NewPrivKey()
+	remotePrivKey := id.NewPrivKey()
+	local := channel.NewClient(opts, localPrivKey.Signatory())
+	local.Bind(remotePrivKey.Signatory())
+	remote := channel.NewClient(opts, remotePrivKey.Signatory())
+	remote.Bind(localPrivKey.Signatory())
+
+	localConn, remoteConn := net.Pipe()
+	attach := func(client *channel.Client, self id.Signatory, conn net.Conn) {
+		enc, dec, other, err := handshake.Insecure(self)(
+			conn,
+			codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder),
+			codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder),
+		)
+		if err != nil {
+			b.Errorf("handshake: %v", err)
+			return
+		}
+		if err := client.Attach(ctx, other, conn, enc, dec); err != nil && ctx.Err() == nil {
+			b.Errorf("attach: %v", err)
+		}
+	}
+	go attach(local, localPrivKey.Signatory(), localConn)
+	go attach(remote, remotePrivKey.Signatory(), remoteConn)
+	return local, remote, remotePrivKey.Signatory()
+}
+
+func BenchmarkSubscribe(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, remote, to := benchmarkClients(b, ctx)
+	msgs := remote.Subscribe(ctx, channel.MatchType(wire.MsgTypePush), 256)
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := local.Send(ctx, to, wire.Msg{Type: wire.MsgTypePush, Data: []byte("benchmark")}); err != nil {
+				b.Errorf("send: %v", err)
+				return
+			}
+		}
+	}()
+	receives := 0
+	for received := 0; received < b.N; received++ {
+		<-msgs
+		receives++
+	}
+	b.ReportMetric(float64(receives)/float64(b.N), "receives/op")
+}
+
+func BenchmarkSubscribeBatch(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, remote, to := benchmarkClients(b, ctx)
+	batches := remote.SubscribeBatch(ctx, channel.MatchType(wire.MsgTypePush), 256, time.Millisecond)
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := local.Send(ctx, to, wire.Msg{Type: wire.MsgTypePush, Data: []byte("benchmark")}); err != nil {
+				b.Errorf("send: %v", err)
+				return
+			}
+		}
+	}()
+	receives := 0
+	for received := 0; received < b.N; {
+		received += len(<-batches)
+		receives++
+	}
+	b.ReportMetric(float64(receives)/float64(b.N), "receives/op")
+}
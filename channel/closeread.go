@@ -0,0 +1,51 @@
+package channel
+
+import (
+	"net"
+	"time"
+)
+
+// readUntilClosed waits for the reader of the network connection to read the
+// messages that the remote peer has already written, until the remote peer
+// closes its side of the network connection, or the CloseReadTimeout expires.
+// The wait is also bounded by the deadline, if it is not zero. The local side
+// of the network connection is closed for writing first, so that the remote
+// peer sees the end of the network connection after the goodbye message. It
+// does nothing if there is no CloseReadTimeout, or if the reader belongs to
+// another network connection.
+func (ch *Channel) readUntilClosed(conn net.Conn, deadline time.Time) {
+	if ch.opts.CloseReadTimeout <= 0 {
+		return
+	}
+	if d := time.Now().Add(ch.opts.CloseReadTimeout); deadline.IsZero() || d.Before(deadline) {
+		deadline = d
+	}
+
+	ch.controlMu.Lock()
+	control := ch.control
+	ch.controlMu.Unlock()
+	if control == nil || control.conn != conn {
+		return
+	}
+
+	closeWrite(conn)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-control.stopped:
+	case <-timer.C:
+	}
+}
+
+// closeWrite closes the network connection for writing, if it supports
+// half-closing (for example, TCP and TLS connections). Reads are unaffected.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		// Ignore the error, because nothing else is written to the network
+		// connection.
+		_ = c.CloseWrite()
+	}
+}
@@ -0,0 +1,310 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+)
+
+// ErrNotAttached is returned when detaching the network connection of a
+// Channel that has no attached network connection.
+var ErrNotAttached = errors.New("not attached")
+
+// readerControl is used to detach a reader from the Channel while it is being
+// read by the read loop. The reader is only ever detached between messages, so
+// that the network connection is handed over with no message part way through
+// being read.
+type readerControl struct {
+	// conn is the network connection of the reader.
+	conn net.Conn
+	// stopped is closed when the reader is no longer being read.
+	stopped chan struct{}
+
+	// mu guards the fields below.
+	mu *sync.Mutex
+	// idle is true while the reader is waiting for the next message, in which
+	// case it can be interrupted without losing any part of a message.
+	idle bool
+	// interrupted is true if the read deadline was set to interrupt the
+	// reader while it was idle.
+	interrupted bool
+	// detach is the reply channel of a pending Detach, if there is one.
+	detach chan<- detachedReader
+}
+
+func newReaderControl(conn net.Conn) *readerControl {
+	return &readerControl{
+		conn:    conn,
+		stopped: make(chan struct{}),
+		mu:      new(sync.Mutex),
+	}
+}
+
+// request that the reader is detached, and replied to the reply channel, once
+// it has finished reading the current message. If it is waiting for the next
+// message, then it is interrupted. False is returned if the reader has
+// stopped.
+func (control *readerControl) request(reply chan<- detachedReader) bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+
+	select {
+	case <-control.stopped:
+		return false
+	default:
+	}
+	control.detach = reply
+	if control.idle && !control.interrupted {
+		control.interrupted = true
+		// If the deadline cannot be set, then the reader is detached once
+		// the next message has been read.
+		_ = control.conn.SetReadDeadline(time.Now())
+	}
+	return true
+}
+
+// cancel a request to detach the reader. False is returned if the reader has
+// already replied to the request.
+func (control *readerControl) cancel(reply chan<- detachedReader) bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+
+	if control.detach != reply {
+		return false
+	}
+	control.detach = nil
+	return true
+}
+
+// wait for the next message, using the peek function, without reading any
+// part of it. If the reader has been requested to detach, then the reply
+// channel is returned, and the reader must be handed over. Otherwise, the
+// error from peeking is returned (with interruptions that have since been
+// cancelled being ignored).
+func (control *readerControl) wait(peek func() error) (chan<- detachedReader, error) {
+	for {
+		control.mu.Lock()
+		if reply := control.handover(); reply != nil {
+			control.mu.Unlock()
+			return reply, nil
+		}
+		control.idle = true
+		control.mu.Unlock()
+
+		err := peek()
+
+		control.mu.Lock()
+		control.idle = false
+		interrupted := control.interrupted
+		reply := control.handover()
+		control.mu.Unlock()
+		if reply != nil {
+			return reply, nil
+		}
+		if err != nil && interrupted {
+			// The read was interrupted by a detach that has since been
+			// cancelled, so the reader keeps waiting.
+			continue
+		}
+		return nil, err
+	}
+}
+
+// handover returns the reply channel of the pending detach, if there is one,
+// and clears any interruption of the reader. It must be called while holding
+// the lock.
+func (control *readerControl) handover() chan<- detachedReader {
+	if control.interrupted {
+		control.interrupted = false
+		if err := control.conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil
+		}
+	}
+	reply := control.detach
+	control.detach = nil
+	return reply
+}
+
+// stop the reader, answering a pending detach so that it does not wait for a
+// reader that will never be handed over.
+func (control *readerControl) stop() {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+
+	if control.detach != nil {
+		control.detach <- detachedReader{}
+		control.detach = nil
+	}
+	close(control.stopped)
+}
+
+type detachedReader struct {
+	r  reader
+	ok bool
+}
+
+type detachedWriter struct {
+	w  writer
+	ok bool
+}
+
+// Detached is a network connection that has been detached from a Channel (see
+// Detach). While it is detached, the Channel neither reads from, nor writes to,
+// the network connection, and it is owned by the caller of Detach. Messages
+// that are sent to the Channel are kept on the outbound queue until a network
+// connection is attached again, so sending blocks once the outbound queue is
+// full (see Options.OutboundBufferSize).
+//
+// A Detached must eventually be reattached, or closed. Until then, the call to
+// Attach that attached the network connection continues to block.
+type Detached struct {
+	ch   *Channel
+	r    reader
+	w    writer
+	once *sync.Once
+}
+
+// Detach the attached network connection from the Channel, so that it can be
+// used directly by the application (for example, to upgrade it to a different
+// protocol) and later reattached. The Channel stops writing to, and reading
+// from, the network connection before returning. ErrNotAttached is returned if
+// there is no attached network connection.
+//
+// The network connection is only detached between messages. If a message (such
+// as a chunked message) is part way through being read, then the Channel
+// finishes reading it first, so Detach blocks until the remote peer has written
+// the rest of it, or the context is done. Messages that the remote peer writes
+// after that are not read by the Channel, so both peers must agree to detach
+// before doing so, and stop writing messages to the network connection
+// beforehand.
+func (ch *Channel) Detach(ctx context.Context) (*Detached, error) {
+	// Detach the writer first, so that nothing else is written to the network
+	// connection while the reader is being detached.
+	wReply := make(chan detachedWriter, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ch.detaches <- wReply:
+	}
+	dw := <-wReply
+	if !dw.ok {
+		return nil, ErrNotAttached
+	}
+
+	ch.controlMu.Lock()
+	control := ch.control
+	ch.controlMu.Unlock()
+
+	dr := detachedReader{}
+	if control != nil {
+		rReply := make(chan detachedReader, 1)
+		if control.request(rReply) {
+			select {
+			case dr = <-rReply:
+			case <-ctx.Done():
+				if control.cancel(rReply) {
+					// The writer is given back, so that the network
+					// connection stays attached.
+					select {
+					case ch.writers <- dw.w:
+					default:
+						dw.w.drop()
+					}
+					return nil, ctx.Err()
+				}
+				// The reader has already replied.
+				dr = <-rReply
+			}
+		}
+	}
+	if !dr.ok || dr.r.Conn != dw.w.Conn {
+		// The reader has already faulted, or belongs to another network
+		// connection, so the writer is given back to the Channel.
+		if dr.ok {
+			close(dr.r.q)
+		}
+		select {
+		case <-ctx.Done():
+			dw.w.drop()
+			return nil, ctx.Err()
+		case ch.writers <- dw.w:
+		}
+		return nil, ErrNotAttached
+	}
+
+	return &Detached{ch: ch, r: dr.r, w: dw.w, once: new(sync.Once)}, nil
+}
+
+// Conn returns the detached network connection. It must be used instead of the
+// underlying network connection, because data that was read by the Channel, but
+// not yet decoded, is returned by the first reads.
+func (d *Detached) Conn() net.Conn {
+	return detachedConn{Conn: d.r.Conn, r: d.r.Reader}
+}
+
+// Encoder that was attached with the network connection.
+func (d *Detached) Encoder() codec.Encoder {
+	return d.w.Encoder
+}
+
+// Decoder that was attached with the network connection.
+func (d *Detached) Decoder() codec.Decoder {
+	return d.r.Decoder
+}
+
+// Reattach the network connection to the Channel that it was detached from.
+// Messages that were sent while it was detached are then written to it. The
+// caller must not use the network connection after reattaching it. Reattaching
+// or closing more than once does nothing.
+func (d *Detached) Reattach(ctx context.Context) error {
+	err := error(nil)
+	d.once.Do(func() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			d.close()
+			return
+		case d.ch.readers <- d.r:
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			d.w.drop()
+		case d.ch.writers <- d.w:
+		}
+	})
+	return err
+}
+
+// Close the detached network connection without reattaching it. The call to
+// Attach that attached the network connection returns.
+func (d *Detached) Close() error {
+	err := error(nil)
+	d.once.Do(func() {
+		err = d.close()
+	})
+	return err
+}
+
+func (d *Detached) close() error {
+	err := d.r.Conn.Close()
+	close(d.r.q)
+	close(d.w.q)
+	return err
+}
+
+// detachedConn reads data that has already been buffered before reading from
+// the network connection.
+type detachedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn detachedConn) Read(p []byte) (int, error) {
+	return conn.r.Read(p)
+}
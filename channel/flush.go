@@ -0,0 +1,87 @@
+package channel
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// A FlushError is returned when the messages that were on the outbound queue
+// of a Channel could not all be written to its network connection before the
+// context was done.
+type FlushError struct {
+	// Pending is the number of messages that were still waiting to be written.
+	Pending int
+	Err     error
+}
+
+// Error implements the error interface.
+func (err *FlushError) Error() string {
+	return fmt.Sprintf("flush: %v messages pending: %v", err.Pending, err.Err)
+}
+
+// Unwrap returns the error of the context.
+func (err *FlushError) Unwrap() error {
+	return err.Err
+}
+
+// flush is a request to be told when a number of messages have been written.
+type flush struct {
+	// pending is the number of messages that still need to be written. It is
+	// decremented by the write loop, and read by the caller of Flush.
+	pending *int64
+	done    chan struct{}
+}
+
+// start the flush, and return true if it must wait for messages to be written.
+func (f *flush) start(pending int) bool {
+	atomic.StoreInt64(f.pending, int64(pending))
+	if pending == 0 {
+		close(f.done)
+		return false
+	}
+	return true
+}
+
+// processFlushes tells all flushes that one more message has been written, and
+// returns the flushes that are still waiting.
+func processFlushes(flushes []*flush) []*flush {
+	marker := 0
+	for _, f := range flushes {
+		if atomic.AddInt64(f.pending, -1) == 0 {
+			close(f.done)
+			continue
+		}
+		flushes[marker] = f
+		marker++
+	}
+	for i := marker; i < len(flushes); i++ {
+		flushes[i] = nil
+	}
+	return flushes[:marker]
+}
+
+// Flush blocks until all messages that were on the outbound queue when it was
+// called have been written to the attached network connection, or the context
+// is done. Written messages have been handed to the kernel, but might not have
+// been received by the remote peer. If there is no attached network connection
+// (for example, because the Channel is detached), then Flush waits for one to
+// be attached. Messages that are sent while flushing are not waited for.
+//
+// If the context is done first, then a FlushError is returned, with the number
+// of messages that were still pending. Messages that are discarded, because
+// they cannot be marshaled, are not waited for.
+func (ch *Channel) Flush(ctx context.Context) error {
+	f := &flush{pending: new(int64), done: make(chan struct{})}
+	select {
+	case <-ctx.Done():
+		return &FlushError{Pending: len(ch.outbound), Err: ctx.Err()}
+	case ch.flushes <- f:
+	}
+	select {
+	case <-ctx.Done():
+		return &FlushError{Pending: int(atomic.LoadInt64(f.pending)), Err: ctx.Err()}
+	case <-f.done:
+		return nil
+	}
+}
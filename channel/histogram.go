@@ -0,0 +1,106 @@
+package channel
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// DefaultSizeBuckets are the default upper bounds, in bytes, of the buckets of
+// a SizeHistogram. They grow by a factor of four, from 64B to 4MB (the default
+// MaxMessageSize).
+var DefaultSizeBuckets = []int{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+
+// A SizeHistogram is a snapshot of the sizes of the inbound messages that have
+// been read from remote peers. Counts[i] is the number of messages that are no
+// larger than Buckets[i] (and larger than Buckets[i-1]). Counts has one more
+// entry than Buckets, which is the number of messages that are larger than
+// every bucket. Sum is the total size of all messages.
+type SizeHistogram struct {
+	Buckets []int
+	Counts  []uint64
+	Sum     uint64
+}
+
+// Count returns the total number of messages.
+func (h SizeHistogram) Count() uint64 {
+	count := uint64(0)
+	for _, c := range h.Counts {
+		count += c
+	}
+	return count
+}
+
+// Cumulative returns the number of messages that are no larger than each
+// bucket, followed by the total number of messages. This is the form used by
+// exporters such as Prometheus.
+func (h SizeHistogram) Cumulative() []uint64 {
+	cumulative := make([]uint64, len(h.Counts))
+	total := uint64(0)
+	for i, c := range h.Counts {
+		total += c
+		cumulative[i] = total
+	}
+	return cumulative
+}
+
+// add the counts of another SizeHistogram, with the same buckets, to this one.
+func (h *SizeHistogram) add(other SizeHistogram) {
+	if h.Counts == nil {
+		h.Buckets = other.Buckets
+		h.Counts = make([]uint64, len(other.Counts))
+	}
+	if len(h.Counts) != len(other.Counts) {
+		return
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+}
+
+// sizeHistogram records the sizes of inbound messages. Recording is lock-free,
+// so that it is cheap enough to do for every message that is read.
+type sizeHistogram struct {
+	buckets []int
+	counts  []uint64
+	sum     *uint64
+}
+
+func newSizeHistogram(buckets []int) sizeHistogram {
+	sorted := make([]int, len(buckets))
+	copy(sorted, buckets)
+	sort.Ints(sorted)
+	return sizeHistogram{
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)+1),
+		sum:     new(uint64),
+	}
+}
+
+// record the size of a message.
+func (h sizeHistogram) record(size int) {
+	// There are only a few buckets, so a linear search is faster than a binary
+	// search, and most messages are expected to fall into the first buckets.
+	i := 0
+	for i < len(h.buckets) && size > h.buckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(h.sum, uint64(size))
+}
+
+// snapshot returns a SizeHistogram of the sizes recorded so far.
+func (h sizeHistogram) snapshot() SizeHistogram {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return SizeHistogram{Buckets: h.buckets, Counts: counts, Sum: atomic.LoadUint64(h.sum)}
+}
+
+// InboundSizes returns a SizeHistogram of the sizes of the inbound messages
+// that have been read by the Channel. The size of a message includes its
+// synchronisation data, and all of its chunks.
+func (ch *Channel) InboundSizes() SizeHistogram {
+	return ch.sizes.snapshot()
+}
@@ -13,6 +13,10 @@ var (
 	DefaultRateLimit          = rate.Limit(1024 * 1024) // 1MB per second
 	DefaultInboundBufferSize  = 0
 	DefaultOutboundBufferSize = 0
+	DefaultReadBufferSize     = 64 * 1024 // 64KB
+	DefaultWriteBufferSize    = 64 * 1024 // 64KB
+	DefaultChunkSize          = 64 * 1024 // 64KB
+	DefaultChunkTimeout       = 10 * time.Second
 )
 
 // Options for parameterizing the behaviour of a Channel.
@@ -23,6 +27,13 @@ type Options struct {
 	RateLimit          rate.Limit
 	InboundBufferSize  int
 	OutboundBufferSize int
+	ReadBufferSize     int
+	WriteBufferSize    int
+	InboundPolicy      InboundPolicy
+	ChunkSize          int
+	ChunkTimeout       time.Duration
+	SizeBuckets        []int
+	CloseReadTimeout   time.Duration
 }
 
 // DefaultOptions returns Options with sane defaults.
@@ -38,6 +49,11 @@ func DefaultOptions() Options {
 		RateLimit:          DefaultRateLimit,
 		InboundBufferSize:  DefaultInboundBufferSize,
 		OutboundBufferSize: DefaultOutboundBufferSize,
+		ReadBufferSize:     DefaultReadBufferSize,
+		WriteBufferSize:    DefaultWriteBufferSize,
+		ChunkSize:          DefaultChunkSize,
+		ChunkTimeout:       DefaultChunkTimeout,
+		SizeBuckets:        DefaultSizeBuckets,
 	}
 }
 
@@ -57,6 +73,23 @@ func (opts Options) WithDrainTimeout(timeout time.Duration) Options {
 	return opts
 }
 
+// WithCloseReadTimeout sets the timeout for reading the messages that the
+// remote peer has already written when a Channel says goodbye (see Goodbye and
+// Drain). After the goodbye message, the Channel stops writing to the network
+// connection, and keeps reading (and delivering) inbound messages until the
+// remote peer closes its side of the network connection, or the timeout
+// expires, before closing it. This prevents messages that the remote peer
+// considered sent from being lost while the network connection is closed.
+// When the timeout is set, a Channel that receives a goodbye message also stops
+// writing to the network connection, so that the remote peer stops waiting as
+// soon as possible. By default, the timeout is zero, the network connection is
+// closed as soon as the goodbye message is written, and receiving a goodbye
+// message does not stop writing.
+func (opts Options) WithCloseReadTimeout(timeout time.Duration) Options {
+	opts.CloseReadTimeout = timeout
+	return opts
+}
+
 // WithMaxMessageSize sets the maximum number of bytes that a channel will read
 // at one time. This number restricts the maximum message size that remote peers
 // can send, defines the buffer size used for unmarshalling messages, and
@@ -82,6 +115,18 @@ func (opts Options) WithInboundBufferSize(size int) Options {
 	return opts
 }
 
+// WithInboundPolicy sets what a Channel does with a message that has been read
+// from a network connection when the inbound messaging channel is full. By
+// default, it is InboundBlock, which never drops messages but allows one slow
+// consumer to stall reading from the network connection, and eventually the
+// remote peer. Any other InboundPolicy keeps reading, and counts the messages
+// that it drops. Dropping requires an inbound buffer: when the buffer size is
+// zero, every message that is not immediately consumed is dropped.
+func (opts Options) WithInboundPolicy(policy InboundPolicy) Options {
+	opts.InboundPolicy = policy
+	return opts
+}
+
 // WithOutboundBufferSize defines the number of outbound messages that can be
 // buffered in memroy before back-pressure will prevent the buffering of new
 // outbound messages.
@@ -89,3 +134,81 @@ func (opts Options) WithOutboundBufferSize(size int) Options {
 	opts.OutboundBufferSize = size
 	return opts
 }
+
+// WithReadBufferSize sets the size of the buffer used when reading from network
+// connections. Larger buffers allow many small messages to be read using one
+// system call. Messages larger than the buffer can still be read. If the size
+// is zero, or less, then the maximum message size is used.
+func (opts Options) WithReadBufferSize(size int) Options {
+	opts.ReadBufferSize = size
+	return opts
+}
+
+// WithWriteBufferSize sets the size of the buffer used when writing to network
+// connections. The buffer is flushed after every message. Messages larger than
+// the buffer can still be written. If the size is zero, or less, then the
+// maximum message size is used.
+func (opts Options) WithWriteBufferSize(size int) Options {
+	opts.WriteBufferSize = size
+	return opts
+}
+
+// WithChunkSize sets the maximum number of bytes in each chunk of the Data of a
+// chunked message (see wire.Msg.Chunked). Smaller chunks let the remote peer
+// start processing the Data sooner, but add framing overhead. The chunk size
+// is capped by the MaxMessageSize of the remote peer, which would otherwise
+// refuse to read the chunks.
+func (opts Options) WithChunkSize(size int) Options {
+	opts.ChunkSize = size
+	return opts
+}
+
+// WithChunkTimeout sets how long the Channel waits for the application to read
+// each chunk of a chunked message (see wire.Packet.Body). Chunks are read from
+// the network connection one at a time, so an application that is slow to
+// read the Body applies back-pressure to the remote peer. If a chunk is not
+// read before the timeout, then the Body is closed, and the rest of the chunks
+// are discarded, so that an abandoned Body cannot stall the Channel forever.
+func (opts Options) WithChunkTimeout(timeout time.Duration) Options {
+	opts.ChunkTimeout = timeout
+	return opts
+}
+
+// WithSizeBuckets sets the upper bounds, in bytes, of the buckets into which
+// the sizes of inbound messages are counted (see SizeHistogram). They do not
+// need to be sorted. Every Channel of a Client must use the same buckets, so
+// that their histograms can be added together.
+func (opts Options) WithSizeBuckets(buckets []int) Options {
+	opts.SizeBuckets = buckets
+	return opts
+}
+
+// readBufferSize returns the size of the buffer used when reading from network
+// connections.
+func (opts Options) readBufferSize() int {
+	if opts.ReadBufferSize <= 0 {
+		return opts.MaxMessageSize
+	}
+	return opts.ReadBufferSize
+}
+
+// writeBufferSize returns the size of the buffer used when writing to network
+// connections.
+func (opts Options) writeBufferSize() int {
+	if opts.WriteBufferSize <= 0 {
+		return opts.MaxMessageSize
+	}
+	return opts.WriteBufferSize
+}
+
+// chunkSize returns the maximum number of bytes in each chunk of a chunked
+// message.
+func (opts Options) chunkSize() int {
+	if opts.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	if opts.ChunkSize > opts.MaxMessageSize {
+		return opts.MaxMessageSize
+	}
+	return opts.ChunkSize
+}
@@ -0,0 +1,102 @@
+package channel
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/muirglacier/aw/wire"
+
+	"go.uber.org/zap"
+)
+
+// An InboundPolicy defines what a Channel does with a message that has been read
+// from a network connection when the inbound messaging channel is full.
+type InboundPolicy uint8
+
+// Enumerate all InboundPolicy values.
+const (
+	// InboundBlock waits until there is room in the inbound messaging
+	// channel. No messages are dropped, but a slow consumer stalls reading
+	// from the network connection (and, eventually, the remote peer).
+	InboundBlock InboundPolicy = iota
+	// InboundDropNewest drops the message that has just been read.
+	InboundDropNewest
+	// InboundDropOldest drops the oldest message that is buffered in the
+	// inbound messaging channel to make room for the message that has just
+	// been read. If nothing is buffered, or the Channel cannot receive from
+	// the inbound messaging channel (see NewWithInbound), then the message
+	// that has just been read is dropped instead.
+	InboundDropOldest
+	// InboundDisconnect drops the message that has just been read and closes
+	// the network connection, so that the remote peer has to reconnect (by
+	// which time the consumer might have caught up).
+	InboundDisconnect
+)
+
+func (policy InboundPolicy) String() string {
+	switch policy {
+	case InboundBlock:
+		return "block"
+	case InboundDropNewest:
+		return "drop newest"
+	case InboundDropOldest:
+		return "drop oldest"
+	case InboundDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// Dropped returns the number of inbound messages that have been dropped by the
+// Channel because the inbound messaging channel was full.
+func (ch *Channel) Dropped() uint64 {
+	return atomic.LoadUint64(ch.dropped)
+}
+
+// deliver a message to the inbound messaging channel, according to the
+// InboundPolicy. It returns false if the network connection that the message
+// was read from should be closed. The Body of every message that is dropped is
+// closed, so that the rest of its chunks are discarded.
+func (ch *Channel) deliver(ctx context.Context, packet wire.Packet) bool {
+	if ch.opts.InboundPolicy == InboundBlock {
+		select {
+		case <-ctx.Done():
+			return false
+		case ch.inbound <- packet:
+			return true
+		}
+	}
+
+	for {
+		select {
+		case ch.inbound <- packet:
+			return true
+		default:
+		}
+
+		switch ch.opts.InboundPolicy {
+		case InboundDropOldest:
+			select {
+			case oldest := <-ch.oldest:
+				ch.drop(oldest)
+				continue
+			default:
+			}
+		case InboundDisconnect:
+			ch.drop(packet)
+			ch.opts.Logger.Error("slow consumer", zap.String("remote", ch.remote.String()))
+			return false
+		}
+		ch.drop(packet)
+		return ctx.Err() == nil
+	}
+}
+
+// drop a message that could not be delivered.
+func (ch *Channel) drop(packet wire.Packet) {
+	atomic.AddUint64(ch.dropped, 1)
+	if packet.Body != nil {
+		packet.Body.Close()
+	}
+}
@@ -0,0 +1,116 @@
+package channel
+
+import (
+	"fmt"
+
+	"github.com/muirglacier/id"
+	"golang.org/x/time/rate"
+)
+
+// PeerOptions override the Options of a Client for the Channel of one remote
+// peer. Fields that are nil fall back to the Options of the Client.
+type PeerOptions struct {
+	RateLimit          *rate.Limit
+	InboundBufferSize  *int
+	OutboundBufferSize *int
+}
+
+// WithRateLimit overrides the bytes-per-second rate limit that is enforced on
+// the network connections of the remote peer.
+func (opts PeerOptions) WithRateLimit(rateLimit rate.Limit) PeerOptions {
+	opts.RateLimit = &rateLimit
+	return opts
+}
+
+// WithInboundBufferSize overrides the number of inbound messages from the
+// remote peer that can be buffered in memory.
+func (opts PeerOptions) WithInboundBufferSize(size int) PeerOptions {
+	opts.InboundBufferSize = &size
+	return opts
+}
+
+// WithOutboundBufferSize overrides the number of outbound messages to the
+// remote peer that can be buffered in memory.
+func (opts PeerOptions) WithOutboundBufferSize(size int) PeerOptions {
+	opts.OutboundBufferSize = &size
+	return opts
+}
+
+// Validate returns an error if the overrides are not valid.
+func (opts PeerOptions) Validate() error {
+	switch {
+	case opts.RateLimit != nil && *opts.RateLimit < 0:
+		return fmt.Errorf("rate limit must not be negative, got %v", *opts.RateLimit)
+	case opts.InboundBufferSize != nil && *opts.InboundBufferSize < 0:
+		return fmt.Errorf("inbound buffer size must not be negative, got %v", *opts.InboundBufferSize)
+	case opts.OutboundBufferSize != nil && *opts.OutboundBufferSize < 0:
+		return fmt.Errorf("outbound buffer size must not be negative, got %v", *opts.OutboundBufferSize)
+	}
+	return nil
+}
+
+// override returns the Options with the fields that are set by the
+// PeerOptions replaced.
+func (opts Options) override(peerOpts PeerOptions) Options {
+	if peerOpts.RateLimit != nil {
+		opts.RateLimit = *peerOpts.RateLimit
+	}
+	if peerOpts.InboundBufferSize != nil {
+		opts.InboundBufferSize = *peerOpts.InboundBufferSize
+	}
+	if peerOpts.OutboundBufferSize != nil {
+		opts.OutboundBufferSize = *peerOpts.OutboundBufferSize
+	}
+	return opts
+}
+
+// SetPeerOptions overrides the Options of the Client for the Channel of the
+// remote peer, replacing any previous overrides. The rate limit is applied to
+// the existing Channel immediately. The buffer sizes of a Channel are fixed
+// when it is created, so they are applied the next time that a Channel is
+// bound to the remote peer (after the existing one, if any, is unbound by all
+// of its users).
+func (client *Client) SetPeerOptions(remote id.Signatory, peerOpts PeerOptions) error {
+	if err := peerOpts.Validate(); err != nil {
+		return fmt.Errorf("invalid peer options: %w", err)
+	}
+
+	client.sharedChannelsMu.Lock()
+	defer client.sharedChannelsMu.Unlock()
+
+	client.peerOpts[remote] = peerOpts
+	if shared, ok := client.sharedChannels[remote]; ok {
+		shared.ch.setRateLimit(client.opts.override(peerOpts).RateLimit)
+	}
+	return nil
+}
+
+// ClearPeerOptions removes the overrides of the Options of the Client for the
+// Channel of the remote peer, so that it falls back to the Options of the
+// Client. Like SetPeerOptions, the rate limit is restored immediately, and the
+// buffer sizes are restored the next time that a Channel is bound.
+func (client *Client) ClearPeerOptions(remote id.Signatory) {
+	client.sharedChannelsMu.Lock()
+	defer client.sharedChannelsMu.Unlock()
+
+	delete(client.peerOpts, remote)
+	if shared, ok := client.sharedChannels[remote]; ok {
+		shared.ch.setRateLimit(client.opts.RateLimit)
+	}
+}
+
+// PeerOptions returns the overrides of the Options of the Client for the
+// Channel of the remote peer. False is returned if there are none.
+func (client *Client) PeerOptions(remote id.Signatory) (PeerOptions, bool) {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	peerOpts, ok := client.peerOpts[remote]
+	return peerOpts, ok
+}
+
+// setRateLimit changes the rate limit that is enforced on the network
+// connections of the Channel.
+func (ch *Channel) setRateLimit(rateLimit rate.Limit) {
+	ch.rateLimiter.SetLimit(rateLimit)
+}
@@ -0,0 +1,200 @@
+package channel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// A Match function returns true when a message, received from a remote peer,
+// should be delivered to a subscriber.
+type Match func(id.Signatory, wire.Msg) bool
+
+// MatchType returns a Match function that matches messages with any of the
+// given types.
+func MatchType(types ...uint16) Match {
+	return func(from id.Signatory, msg wire.Msg) bool {
+		for _, ty := range types {
+			if msg.Type == ty {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchFrom returns a Match function that matches messages received from any of
+// the given remote peers.
+func MatchFrom(remotes ...id.Signatory) Match {
+	return func(from id.Signatory, msg wire.Msg) bool {
+		for _, remote := range remotes {
+			if from.Equal(&remote) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Subscribe to messages received by the Client that match the Match function.
+// Matching messages are written to the returned channel, which has the given
+// buffer size. Messages that do not match are not written to the channel, but
+// are still delivered to all other receivers and subscribers. Each subscriber
+// has its own channel, and receives its own copy of every matching message.
+//
+// When the channel is full, the delivery of inbound messages to all other
+// receivers and subscribers is blocked until the channel is drained, or the
+// context is done. Cancelling the context unsubscribes: no more messages are
+// written to the channel, and the channel is closed.
+func (client *Client) Subscribe(ctx context.Context, match Match, bufferSize int) <-chan Msg {
+	msgs := make(chan Msg, bufferSize)
+
+	// The mutex is held while writing a message, so that the channel is not
+	// closed while a message is being written to it.
+	mu := new(sync.Mutex)
+	closed := false
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+
+		closed = true
+		close(msgs)
+	}()
+
+	client.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		if !match(from, packet.Msg) {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		if closed {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case msgs <- Msg{Packet: packet, From: from}:
+		}
+		return nil
+	})
+	return msgs
+}
+
+// SubscribeBatch to messages received by the Client that match the Match
+// function. It is the same as Subscribe, except that matching messages are
+// written to the returned channel in batches. A batch is written when it has
+// batchSize messages, or when the flushInterval has passed and the batch has
+// at least one message. If the flushInterval is zero, or less, then batches
+// are only written when they are full. This reduces the number of channel
+// operations when many messages are being received. Messages are batched in
+// the order in which they were received, so the order of messages from each
+// remote peer is preserved within, and across, batches.
+//
+// When a full batch cannot be written, because the previous batch has not
+// been read from the channel, the delivery of inbound messages to all other
+// receivers and subscribers is blocked until the channel is drained, or the
+// context is done. Cancelling the context unsubscribes: no more batches are
+// written to the channel, messages that have not been written are dropped,
+// and the channel is closed.
+func (client *Client) SubscribeBatch(ctx context.Context, match Match, batchSize int, flushInterval time.Duration) <-chan []Msg {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	batches := make(chan []Msg)
+
+	// The mutex guards the batch that is being filled, and the batches that
+	// are waiting to be written. It is never held while writing to the
+	// channel: batches are only written by the writer goroutine, and in the
+	// order in which they were queued.
+	mu := new(sync.Mutex)
+	batch := make([]Msg, 0, batchSize)
+	queued := [][]Msg{}
+	ready := make(chan struct{}, 1)
+	written := make(chan struct{}, 1)
+
+	go func() {
+		defer close(batches)
+
+		var tick <-chan time.Time
+		if flushInterval > 0 {
+			ticker := time.NewTicker(flushInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+			case <-tick:
+				mu.Lock()
+				if len(batch) > 0 {
+					queued = append(queued, batch)
+					batch = make([]Msg, 0, batchSize)
+				}
+				mu.Unlock()
+			}
+			for {
+				mu.Lock()
+				if len(queued) == 0 {
+					mu.Unlock()
+					break
+				}
+				next := queued[0]
+				queued = queued[1:]
+				mu.Unlock()
+
+				select {
+				case <-ctx.Done():
+					return
+				case batches <- next:
+				}
+				select {
+				case written <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	client.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		if !match(from, packet.Msg) {
+			return nil
+		}
+		mu.Lock()
+		batch = append(batch, Msg{Packet: packet, From: from})
+		if len(batch) < batchSize {
+			mu.Unlock()
+			return nil
+		}
+		queued = append(queued, batch)
+		batch = make([]Msg, 0, batchSize)
+		mu.Unlock()
+
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+		// Wait for the writer to take the queued batches, so that a slow
+		// subscriber applies back-pressure instead of queueing without
+		// bound.
+		for {
+			mu.Lock()
+			n := len(queued)
+			mu.Unlock()
+			if n == 0 {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-written:
+			}
+		}
+	})
+	return batches
+}
@@ -0,0 +1,164 @@
+// Package clock defines an abstraction over time, so that time-based behaviour
+// (expiries, timeouts, backoffs, and so on) can be controlled in tests. By
+// default, the real clock should be used.
+//
+//	// Use the real clock in production.
+//	c := clock.Real()
+//	// Use a fake clock in tests, and advance it manually.
+//	fake := clock.NewFake(time.Now())
+//	fake.Advance(time.Minute)
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock returns the current time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(time.Duration) <-chan time.Time
+	// NewTimer creates a new Timer that will send the current time on its
+	// channel after at least the duration has elapsed.
+	NewTimer(time.Duration) Timer
+}
+
+// A Timer sends the current time on its channel once it has expired. It is
+// the Clock analogy of the time.Timer.
+type Timer interface {
+	// C returns the channel on which the current time is sent when the Timer
+	// expires.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing. It returns true if the call stops
+	// the Timer, and false if the Timer has already expired or been stopped.
+	Stop() bool
+	// Reset changes the Timer to expire after the duration. It returns true if
+	// the Timer had been active, and false if the Timer had expired or been
+	// stopped.
+	Reset(time.Duration) bool
+}
+
+// Real returns a Clock that is backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{Timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+// Fake is a Clock that only moves forward when it is explicitly advanced. It
+// is safe for concurrent use, and is designed to make time-based behaviour
+// deterministic in tests.
+type Fake struct {
+	mu     *sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+// NewFake returns a Fake clock that starts at the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		mu:     new(sync.Mutex),
+		now:    now,
+		timers: map[*fakeTimer]struct{}{},
+	}
+}
+
+// Now returns the current time of the Fake clock.
+func (fake *Fake) Now() time.Time {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.now
+}
+
+// After returns a channel that receives the current time once the Fake clock
+// has been advanced by at least the duration.
+func (fake *Fake) After(d time.Duration) <-chan time.Time {
+	return fake.NewTimer(d).C()
+}
+
+// NewTimer returns a Timer that expires once the Fake clock has been advanced
+// by at least the duration.
+func (fake *Fake) NewTimer(d time.Duration) Timer {
+	timer := &fakeTimer{fake: fake, c: make(chan time.Time, 1)}
+	timer.Reset(d)
+	return timer
+}
+
+// Advance the Fake clock by the duration, and fire all timers that have
+// expired as a result.
+func (fake *Fake) Advance(d time.Duration) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.now = fake.now.Add(d)
+	for timer := range fake.timers {
+		if !timer.deadline.After(fake.now) {
+			delete(fake.timers, timer)
+			select {
+			case timer.c <- fake.now:
+			default:
+			}
+		}
+	}
+}
+
+type fakeTimer struct {
+	fake     *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.fake.mu.Lock()
+	defer timer.fake.mu.Unlock()
+
+	_, active := timer.fake.timers[timer]
+	delete(timer.fake.timers, timer)
+	return active
+}
+
+func (timer *fakeTimer) Reset(d time.Duration) bool {
+	timer.fake.mu.Lock()
+	defer timer.fake.mu.Unlock()
+
+	_, active := timer.fake.timers[timer]
+	timer.deadline = timer.fake.now.Add(d)
+	if d <= 0 {
+		delete(timer.fake.timers, timer)
+		select {
+		case timer.c <- timer.fake.now:
+		default:
+		}
+		return active
+	}
+	timer.fake.timers[timer] = struct{}{}
+	return active
+}
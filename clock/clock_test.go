@@ -0,0 +1,61 @@
+package clock_test
+
+import (
+	"time"
+
+	"github.com/muirglacier/aw/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fake clock", func() {
+	Context("when advancing the clock", func() {
+		It("should move the current time forward", func() {
+			now := time.Now()
+			fake := clock.NewFake(now)
+			Expect(fake.Now()).To(Equal(now))
+			fake.Advance(time.Minute)
+			Expect(fake.Now()).To(Equal(now.Add(time.Minute)))
+		})
+
+		It("should only fire timers that have expired", func() {
+			fake := clock.NewFake(time.Now())
+			short := fake.After(time.Second)
+			long := fake.After(time.Hour)
+
+			fake.Advance(time.Second)
+			Expect(short).To(Receive())
+			Expect(long).ToNot(Receive())
+
+			fake.Advance(time.Hour)
+			Expect(long).To(Receive())
+		})
+	})
+
+	Context("when stopping a timer", func() {
+		It("should not fire", func() {
+			fake := clock.NewFake(time.Now())
+			timer := fake.NewTimer(time.Second)
+			Expect(timer.Stop()).To(BeTrue())
+			Expect(timer.Stop()).To(BeFalse())
+
+			fake.Advance(time.Minute)
+			Expect(timer.C()).ToNot(Receive())
+		})
+	})
+
+	Context("when resetting a timer", func() {
+		It("should fire relative to the time of the reset", func() {
+			fake := clock.NewFake(time.Now())
+			timer := fake.NewTimer(time.Second)
+			fake.Advance(500 * time.Millisecond)
+			Expect(timer.Reset(time.Second)).To(BeTrue())
+
+			fake.Advance(500 * time.Millisecond)
+			Expect(timer.C()).ToNot(Receive())
+			fake.Advance(500 * time.Millisecond)
+			Expect(timer.C()).To(Receive())
+		})
+	})
+})
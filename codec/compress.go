@@ -0,0 +1,238 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression identifies the algorithm used to compress data. Peers negotiate
+// the Compression that is used for a connection during the handshake.
+type Compression uint8
+
+// Enumerate all supported Compression values. When peers support more than one
+// Compression in common, the greatest value is preferred.
+const (
+	CompressionNone  = Compression(0)
+	CompressionFlate = Compression(1)
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("%d", uint8(c))
+	}
+}
+
+// A CompressionError is returned by a compression Decoder when it decodes a
+// frame that was compressed using a Compression other than the one that was
+// negotiated. It is a protocol error, so the connection should be dropped.
+type CompressionError struct {
+	Negotiated Compression
+	Got        Compression
+}
+
+// Error implements the error interface.
+func (err *CompressionError) Error() string {
+	return fmt.Sprintf("unexpected compression: expected %v, got %v", err.Negotiated, err.Got)
+}
+
+// CompressionOptions define when a compression Encoder compresses data.
+type CompressionOptions struct {
+	// Threshold is the minimum number of bytes that data must have before it
+	// is compressed. Smaller data is not worth the CPU that it would take to
+	// compress it. Data is still only compressed if it gets smaller.
+	Threshold int
+}
+
+// DefaultCompressionThreshold is the default CompressionOptions.Threshold.
+// All data is considered for compression.
+var DefaultCompressionThreshold = 0
+
+// DefaultCompressionOptions returns the default CompressionOptions.
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{
+		Threshold: DefaultCompressionThreshold,
+	}
+}
+
+// WithThreshold sets the minimum number of bytes that data must have before
+// it is compressed.
+func (opts CompressionOptions) WithThreshold(threshold int) CompressionOptions {
+	opts.Threshold = threshold
+	return opts
+}
+
+// CompressionHint overrides the CompressionOptions for a single call to a
+// compression Encoder (see WithCompressionHint).
+type CompressionHint uint8
+
+// Enumerate all CompressionHint values.
+const (
+	// CompressionAuto compresses data according to the CompressionOptions.
+	CompressionAuto = CompressionHint(0)
+	// CompressionForce compresses data regardless of the threshold. It has no
+	// effect when the negotiated Compression is CompressionNone, and data that
+	// does not get smaller is still encoded without compression.
+	CompressionForce = CompressionHint(1)
+	// CompressionForbid never compresses data (for example, because it is
+	// already compressed).
+	CompressionForbid = CompressionHint(2)
+)
+
+// hintedWriter is an io.Writer that carries a CompressionHint to the
+// compression Encoders that write to it.
+type hintedWriter struct {
+	io.Writer
+	hint CompressionHint
+}
+
+// WithCompressionHint returns an io.Writer that writes to another io.Writer,
+// and overrides the CompressionOptions of the compression Encoders that it is
+// passed to. Encoders that wrap other Encoders must pass the io.Writer through
+// unchanged for the CompressionHint to take effect.
+func WithCompressionHint(w io.Writer, hint CompressionHint) io.Writer {
+	if hint == CompressionAuto {
+		return w
+	}
+	return hintedWriter{Writer: w, hint: hint}
+}
+
+// compressionHintOf returns the CompressionHint carried by an io.Writer.
+func compressionHintOf(w io.Writer) CompressionHint {
+	if hw, ok := w.(hintedWriter); ok {
+		return hw.hint
+	}
+	return CompressionAuto
+}
+
+// compressionHeaderSize is the size of the header that is encoded before every
+// frame: one byte for the Compression, and four bytes for the length of the
+// frame.
+const compressionHeaderSize = 5
+
+// decodeSlack is the extra capacity given to buffers that are passed to wrapped
+// Decoders, for Decoders (such as the GCMDecoder) that decode into the
+// capacity beyond the length of the buffer.
+const decodeSlack = 64
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			panic(fmt.Sprintf("creating flate writer: %v", err))
+		}
+		return w
+	},
+}
+
+// CompressionEncoder returns an Encoder that compresses data using the
+// negotiated Compression, before encoding it using another Encoder. Each frame
+// is preceded by a header that declares how the frame was compressed. Data
+// that does not get smaller when compressed is encoded without compression, so
+// the encoded frame is never larger than the data.
+func CompressionEncoder(c Compression, enc Encoder) Encoder {
+	return CompressionEncoderWithOptions(c, DefaultCompressionOptions(), enc)
+}
+
+// CompressionEncoderWithOptions is the same as CompressionEncoder, but data is
+// only compressed if it has at least as many bytes as the threshold defined by
+// the options. The threshold is overridden by the CompressionHint of the
+// io.Writer (see WithCompressionHint). Decoders do not need to know the
+// options, because the header of each frame declares whether or not it was
+// compressed.
+func CompressionEncoderWithOptions(c Compression, opts CompressionOptions, enc Encoder) Encoder {
+	return func(w io.Writer, buf []byte) (int, error) {
+		compress := len(buf) >= opts.Threshold
+		switch compressionHintOf(w) {
+		case CompressionForce:
+			compress = true
+		case CompressionForbid:
+			compress = false
+		}
+
+		frameCompression, frame := CompressionNone, buf
+		if c == CompressionFlate && compress {
+			compressed := new(bytes.Buffer)
+			fw := flateWriters.Get().(*flate.Writer)
+			fw.Reset(compressed)
+			_, err := fw.Write(buf)
+			if err == nil {
+				err = fw.Close()
+			}
+			flateWriters.Put(fw)
+			if err != nil {
+				return 0, fmt.Errorf("compressing data: %v", err)
+			}
+			if compressed.Len() < len(buf) {
+				frameCompression, frame = CompressionFlate, compressed.Bytes()
+			}
+		}
+
+		header := [compressionHeaderSize]byte{}
+		header[0] = uint8(frameCompression)
+		binary.BigEndian.PutUint32(header[1:], uint32(len(frame)))
+		if _, err := enc(w, header[:]); err != nil {
+			return 0, fmt.Errorf("encoding compression header: %w", err)
+		}
+		if _, err := enc(w, frame); err != nil {
+			return 0, fmt.Errorf("encoding compressed data: %w", err)
+		}
+		return len(buf), nil
+	}
+}
+
+// CompressionDecoder returns a Decoder that decodes data using another
+// Decoder, before decompressing it using the negotiated Compression. The
+// buffer must be of the right length with respect to the decompressed data.
+// If a frame was compressed using a Compression other than the negotiated one
+// (frames that are not compressed are always accepted), then a
+// *CompressionError is returned.
+func CompressionDecoder(c Compression, dec Decoder) Decoder {
+	return func(r io.Reader, buf []byte) (int, error) {
+		header := make([]byte, compressionHeaderSize, compressionHeaderSize+decodeSlack)
+		if _, err := dec(r, header); err != nil {
+			return 0, fmt.Errorf("decoding compression header: %w", err)
+		}
+		frameCompression := Compression(header[0])
+		frameLen := binary.BigEndian.Uint32(header[1:])
+
+		switch frameCompression {
+		case CompressionNone:
+			if frameLen != uint32(len(buf)) {
+				return 0, fmt.Errorf("decoding data: expected %v bytes, got %v bytes", len(buf), frameLen)
+			}
+			return dec(r, buf)
+		case c:
+		default:
+			return 0, &CompressionError{Negotiated: c, Got: frameCompression}
+		}
+
+		// Compressed frames are never larger than the data, so there is no
+		// need to decode frames that claim otherwise.
+		if frameLen >= uint32(len(buf)) {
+			return 0, fmt.Errorf("decoding compressed data: expected less than %v bytes, got %v bytes", len(buf), frameLen)
+		}
+		frame := make([]byte, frameLen, int(frameLen)+decodeSlack)
+		n, err := dec(r, frame)
+		if err != nil {
+			return 0, fmt.Errorf("decoding compressed data: %w", err)
+		}
+		fr := flate.NewReader(bytes.NewReader(frame[:n]))
+		defer fr.Close()
+		if _, err := io.ReadFull(fr, buf); err != nil {
+			return 0, fmt.Errorf("decompressing data: %v", err)
+		}
+		if m, _ := fr.Read(make([]byte, 1)); m != 0 {
+			return 0, fmt.Errorf("decompressing data: expected %v bytes, got more", len(buf))
+		}
+		return len(buf), nil
+	}
+}
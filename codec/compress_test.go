@@ -0,0 +1,113 @@
+package codec_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+
+	"github.com/muirglacier/aw/codec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression Codec", func() {
+	roundTrip := func(encCompression, decCompression codec.Compression, data []byte) ([]byte, int, error) {
+		var readerWriter bytes.Buffer
+		enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.CompressionEncoder(encCompression, codec.PlainEncoder))
+		n, err := enc(&readerWriter, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(data)))
+		written := readerWriter.Len()
+
+		buf := make([]byte, 4096)
+		dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.CompressionDecoder(decCompression, codec.PlainDecoder))
+		n, err = dec(&readerWriter, buf)
+		return buf[:n], written, err
+	}
+
+	Context("when encoding and decoding compressible data", func() {
+		It("should compress the data", func() {
+			data := bytes.Repeat([]byte("hello "), 500)
+			for _, c := range []codec.Compression{codec.CompressionNone, codec.CompressionFlate} {
+				decoded, written, err := roundTrip(c, c, data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded).To(Equal(data))
+				if c == codec.CompressionFlate {
+					Expect(written).To(BeNumerically("<", len(data)))
+				}
+			}
+		})
+	})
+
+	Context("when encoding and decoding incompressible data", func() {
+		It("should not grow the data", func() {
+			data := make([]byte, 1024)
+			_, err := rand.Read(data)
+			Expect(err).ToNot(HaveOccurred())
+
+			decoded, written, err := roundTrip(codec.CompressionFlate, codec.CompressionFlate, data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded).To(Equal(data))
+			Expect(written).To(BeNumerically("<=", len(data)+4+5))
+		})
+	})
+
+	Context("when decoding data that is compressed unexpectedly", func() {
+		It("should return a compression error", func() {
+			data := bytes.Repeat([]byte("hello "), 500)
+			_, _, err := roundTrip(codec.CompressionFlate, codec.CompressionNone, data)
+			compressionErr := new(codec.CompressionError)
+			Expect(errors.As(err, &compressionErr)).To(BeTrue())
+			Expect(compressionErr.Negotiated).To(Equal(codec.CompressionNone))
+			Expect(compressionErr.Got).To(Equal(codec.CompressionFlate))
+		})
+	})
+
+	Context("when decoding uncompressed data that was expected to be compressed", func() {
+		It("should accept the data", func() {
+			data := []byte("hello")
+			decoded, _, err := roundTrip(codec.CompressionNone, codec.CompressionFlate, data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded).To(Equal(data))
+		})
+	})
+
+	Context("when encoding data with a compression threshold", func() {
+		encode := func(c codec.Compression, threshold int, hint codec.CompressionHint, data []byte) int {
+			var readerWriter bytes.Buffer
+			opts := codec.DefaultCompressionOptions().WithThreshold(threshold)
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.CompressionEncoderWithOptions(c, opts, codec.PlainEncoder))
+			n, err := enc(codec.WithCompressionHint(&readerWriter, hint), data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(data)))
+			written := readerWriter.Len()
+
+			buf := make([]byte, len(data))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.CompressionDecoder(codec.CompressionFlate, codec.PlainDecoder))
+			n, err = dec(&readerWriter, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf[:n]).To(Equal(data))
+			return written
+		}
+		data := bytes.Repeat([]byte("hello "), 500)
+		uncompressed := len(data) + 4 + 5
+
+		It("should only compress data that is at least as large as the threshold", func() {
+			Expect(encode(codec.CompressionFlate, len(data), codec.CompressionAuto, data)).To(BeNumerically("<", len(data)))
+			Expect(encode(codec.CompressionFlate, len(data)+1, codec.CompressionAuto, data)).To(Equal(uncompressed))
+		})
+
+		It("should compress data below the threshold when compression is forced", func() {
+			Expect(encode(codec.CompressionFlate, len(data)+1, codec.CompressionForce, data)).To(BeNumerically("<", len(data)))
+		})
+
+		It("should not compress data above the threshold when compression is forbidden", func() {
+			Expect(encode(codec.CompressionFlate, 0, codec.CompressionForbid, data)).To(Equal(uncompressed))
+		})
+
+		It("should not compress data when compression is forced without being negotiated", func() {
+			Expect(encode(codec.CompressionNone, 0, codec.CompressionForce, data)).To(Equal(uncompressed))
+		})
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -12,6 +13,10 @@ import (
 	"github.com/muirglacier/id"
 )
 
+// ErrUnauthenticated is returned by a GCMDecoder when sealed data fails to be
+// authenticated.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
 type gcmNonce struct {
 	// top and bottom together represent the top 32 bits and bottom 64 bits of a 96 bit unsigned integer
 	top       uint32
@@ -108,7 +113,7 @@ func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 		buf = buf[:extendedSize]
 		n, err := dec(r, buf)
 		if err != nil {
-			return n, fmt.Errorf("decoding data: %v", err)
+			return n, fmt.Errorf("decoding data: %w", err)
 		}
 		nonceBuf := [12]byte{}
 		binary.BigEndian.PutUint32(nonceBuf[:4], session.readNonce.top)
@@ -117,7 +122,7 @@ func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 		decrypted, err := session.gcm.Open(nil, nonceBuf[:], buf[:n], nil)
 
 		if err != nil {
-			return 0, fmt.Errorf("opening sealed data: %v", err)
+			return 0, fmt.Errorf("opening sealed data: %w: %v", ErrUnauthenticated, err)
 		}
 		copy(buf, decrypted)
 
@@ -2,19 +2,177 @@ package codec
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 )
 
+// ErrLengthPrefixOverflow is returned when encoding data that is too large to
+// have its length represented by the length prefix.
+var ErrLengthPrefixOverflow = errors.New("length prefix overflow")
+
+// ErrFrameDesync is returned when decoding an authenticated length prefix that
+// fails its check. This happens when the reader is no longer aligned with the
+// boundaries of the data written by the remote peer (for example, because of a
+// bug, or corruption), in which case everything that follows is garbage and
+// the connection should be closed.
+var ErrFrameDesync = errors.New("frame desync")
+
+// ErrInvalidLengthPrefixOptions is returned by LengthPrefixOptions.Validate,
+// and by the Encoders and Decoders built from invalid LengthPrefixOptions.
+var ErrInvalidLengthPrefixOptions = errors.New("invalid length prefix options")
+
+// lengthPrefixCheckSize is the size, in bytes, of the check that follows an
+// authenticated length prefix.
+const lengthPrefixCheckSize = 4
+
+// maxLengthPrefixOverhead is the maximum number of bytes that a body Decoder
+// can decode beyond the length of a buffer (the authentication tag of a
+// GCMDecoder).
+const maxLengthPrefixOverhead = 16
+
+var lengthPrefixTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LengthPrefixOptions parameterise the length prefix that is written before all
+// data by a length prefix Encoder, and read by a length prefix Decoder. Both
+// sides of a connection must use the same options.
+type LengthPrefixOptions struct {
+	// Size of the length prefix in bytes. It must be 2, 4, or 8.
+	Size int
+	// ByteOrder used to encode the length prefix.
+	ByteOrder binary.ByteOrder
+	// Authenticated length prefixes are followed by a check, and are encoded
+	// by the body Encoder instead of the prefix Encoder.
+	Authenticated bool
+}
+
+// DefaultLengthPrefixOptions returns LengthPrefixOptions for a 4 byte
+// big-endian length prefix.
+func DefaultLengthPrefixOptions() LengthPrefixOptions {
+	return LengthPrefixOptions{
+		Size:      4,
+		ByteOrder: binary.BigEndian,
+	}
+}
+
+// WithSize sets the size of the length prefix in bytes. It must be 2, 4, or 8.
+func (opts LengthPrefixOptions) WithSize(size int) LengthPrefixOptions {
+	opts.Size = size
+	return opts
+}
+
+// WithByteOrder sets the byte order used to encode the length prefix.
+func (opts LengthPrefixOptions) WithByteOrder(byteOrder binary.ByteOrder) LengthPrefixOptions {
+	opts.ByteOrder = byteOrder
+	return opts
+}
+
+// WithAuthenticated sets whether or not length prefixes are authenticated. An
+// authenticated length prefix is followed by a checksum of the length prefix
+// and the number of length prefixes that have been encoded before it, and both
+// are encoded by the body Encoder. When the body Encoder authenticates its
+// data (for example, a GCMEncoder), this authenticates the length prefix too.
+// Otherwise, the checksum still detects corruption, and readers that have
+// lost their alignment with the boundaries of the data. Either way, decoding
+// fails with ErrFrameDesync. It adds the check, and the overhead of the body
+// Encoder, to every length prefix. Both sides of a connection must agree on
+// whether or not length prefixes are authenticated. By default, they are not.
+func (opts LengthPrefixOptions) WithAuthenticated(authenticated bool) LengthPrefixOptions {
+	opts.Authenticated = authenticated
+	return opts
+}
+
+// Validate returns an error wrapping ErrInvalidLengthPrefixOptions if the
+// options cannot be used to encode and decode length prefixes.
+func (opts LengthPrefixOptions) Validate() error {
+	switch {
+	case opts.Size != 2 && opts.Size != 4 && opts.Size != 8:
+		return fmt.Errorf("%w: size must be 2, 4, or 8, got %v", ErrInvalidLengthPrefixOptions, opts.Size)
+	case opts.ByteOrder == nil:
+		return fmt.Errorf("%w: nil byte order", ErrInvalidLengthPrefixOptions)
+	}
+	return nil
+}
+
+// check returns the check of a length prefix, given the number of length
+// prefixes that came before it.
+func (opts LengthPrefixOptions) check(buf []byte, seq uint64) uint32 {
+	seqBytes := [8]byte{}
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	return crc32.Update(crc32.Checksum(seqBytes[:], lengthPrefixTable), lengthPrefixTable, buf)
+}
+
+// max returns the maximum length that can be represented by the length
+// prefix. The options must be valid.
+func (opts LengthPrefixOptions) max() uint64 {
+	switch opts.Size {
+	case 2:
+		return math.MaxUint16
+	case 4:
+		return math.MaxUint32
+	default:
+		return math.MaxUint64
+	}
+}
+
+func (opts LengthPrefixOptions) put(buf []byte, prefix uint64) {
+	switch opts.Size {
+	case 2:
+		opts.ByteOrder.PutUint16(buf, uint16(prefix))
+	case 4:
+		opts.ByteOrder.PutUint32(buf, uint32(prefix))
+	case 8:
+		opts.ByteOrder.PutUint64(buf, prefix)
+	}
+}
+
+func (opts LengthPrefixOptions) get(buf []byte) uint64 {
+	switch opts.Size {
+	case 2:
+		return uint64(opts.ByteOrder.Uint16(buf))
+	case 4:
+		return uint64(opts.ByteOrder.Uint32(buf))
+	default:
+		return opts.ByteOrder.Uint64(buf)
+	}
+}
+
 // LengthPrefixEncoder returns an Encoder that prefixes all data with a uint32
 // length. The returned Encoder wraps two other Encoders, one that is used to
 // encode the length prefix, and one that is used to encode the actual data.
 func LengthPrefixEncoder(prefixEnc Encoder, bodyEnc Encoder) Encoder {
+	return LengthPrefixEncoderWithOptions(DefaultLengthPrefixOptions(), prefixEnc, bodyEnc)
+}
+
+// LengthPrefixEncoderWithOptions is the same as LengthPrefixEncoder, but the
+// size and byte order of the length prefix are defined by the options. Data
+// that is too large to have its length represented by the length prefix is not
+// encoded, and ErrLengthPrefixOverflow is returned. If the options are not
+// valid, then the Encoder returns the error from LengthPrefixOptions.Validate
+// without encoding anything. Callers should validate the options up front.
+func LengthPrefixEncoderWithOptions(opts LengthPrefixOptions, prefixEnc Encoder, bodyEnc Encoder) Encoder {
+	if err := opts.Validate(); err != nil {
+		return func(io.Writer, []byte) (int, error) {
+			return 0, fmt.Errorf("encoding data length: %w", err)
+		}
+	}
+	max := opts.max()
+	seq := uint64(0)
 	return func(w io.Writer, buf []byte) (int, error) {
-		prefix := uint32(len(buf))
-		prefixBytes := [4]byte{}
-		binary.BigEndian.PutUint32(prefixBytes[:], prefix)
-		if _, err := prefixEnc(w, prefixBytes[:]); err != nil {
+		if uint64(len(buf)) > max {
+			return 0, fmt.Errorf("encoding data length: %w: expected n<=%v, got n=%v", ErrLengthPrefixOverflow, max, len(buf))
+		}
+		prefixBytes := [8 + lengthPrefixCheckSize]byte{}
+		opts.put(prefixBytes[:opts.Size], uint64(len(buf)))
+		if opts.Authenticated {
+			binary.BigEndian.PutUint32(prefixBytes[opts.Size:], opts.check(prefixBytes[:opts.Size], seq))
+			seq++
+			if _, err := bodyEnc(w, prefixBytes[:opts.Size+lengthPrefixCheckSize]); err != nil {
+				return 0, fmt.Errorf("encoding data length: %w", err)
+			}
+		} else if _, err := prefixEnc(w, prefixBytes[:opts.Size]); err != nil {
 			return 0, fmt.Errorf("encoding data length: %w", err)
 		}
 		n, err := bodyEnc(w, buf)
@@ -30,13 +188,43 @@ func LengthPrefixEncoder(prefixEnc Encoder, bodyEnc Encoder) Encoder {
 // used to decode the length prefix, and one that is used to decode the actual
 // data.
 func LengthPrefixDecoder(prefixDec Decoder, bodyDec Decoder) Decoder {
+	return LengthPrefixDecoderWithOptions(DefaultLengthPrefixOptions(), prefixDec, bodyDec)
+}
+
+// LengthPrefixDecoderWithOptions is the same as LengthPrefixDecoder, but the
+// size and byte order of the length prefix are defined by the options. If the
+// options are not valid, then the Decoder returns the error from
+// LengthPrefixOptions.Validate without decoding anything. Callers should
+// validate the options up front.
+func LengthPrefixDecoderWithOptions(opts LengthPrefixOptions, prefixDec Decoder, bodyDec Decoder) Decoder {
+	if err := opts.Validate(); err != nil {
+		return func(io.Reader, []byte) (int, error) {
+			return 0, fmt.Errorf("decoding data length: %w", err)
+		}
+	}
+	seq := uint64(0)
 	return func(r io.Reader, buf []byte) (int, error) {
-		prefixBytes := [4]byte{}
-		if _, err := prefixDec(r, prefixBytes[:]); err != nil {
+		// The buffer has extra capacity for body Decoders, such as the
+		// GCMDecoder, that decode into the capacity beyond the length of the
+		// buffer.
+		prefixBytes := [8 + lengthPrefixCheckSize + maxLengthPrefixOverhead]byte{}
+		if opts.Authenticated {
+			n := opts.Size + lengthPrefixCheckSize
+			if _, err := bodyDec(r, prefixBytes[:n]); err != nil {
+				if errors.Is(err, ErrUnauthenticated) {
+					return 0, fmt.Errorf("decoding data length: %w: %v", ErrFrameDesync, err)
+				}
+				return 0, fmt.Errorf("decoding data length: %w", err)
+			}
+			if binary.BigEndian.Uint32(prefixBytes[opts.Size:n]) != opts.check(prefixBytes[:opts.Size], seq) {
+				return 0, fmt.Errorf("decoding data length: %w: bad check at %v", ErrFrameDesync, seq)
+			}
+			seq++
+		} else if _, err := prefixDec(r, prefixBytes[:opts.Size]); err != nil {
 			return 0, fmt.Errorf("decoding data length: %w", err)
 		}
-		prefix := binary.BigEndian.Uint32(prefixBytes[:])
-		if uint32(len(buf)) < prefix {
+		prefix := opts.get(prefixBytes[:opts.Size])
+		if uint64(len(buf)) < prefix {
 			return 0, fmt.Errorf("decoding data length: expected %v, got %v", len(buf), prefix)
 		}
 		n, err := bodyDec(r, buf[:prefix])
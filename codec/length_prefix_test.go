@@ -2,9 +2,14 @@ package codec_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/muirglacier/aw/codec"
 )
 
 var _ = Describe("Length Prefix Codec", func() {
@@ -47,4 +52,140 @@ var _ = Describe("Length Prefix Codec", func() {
 			Expect(string(buf[:n])).To(Equal("Hi there!"))
 		})
 	})
+
+	Context("when using a custom length prefix size and byte order", func() {
+		It("should successfully transmit message", func() {
+			for _, size := range []int{2, 4, 8} {
+				for _, byteOrder := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+					var readerWriter bytes.Buffer
+					data := "Hi there!"
+					opts := codec.DefaultLengthPrefixOptions().WithSize(size).WithByteOrder(byteOrder)
+
+					enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+					n, err := enc(&readerWriter, []byte(data))
+					Expect(n).To(Equal(9))
+					Expect(err).To(BeNil())
+					Expect(readerWriter.Len()).To(Equal(size + 9))
+
+					var buf [4086]byte
+					dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+					n, err = dec(&readerWriter, buf[:])
+					Expect(n).To(Equal(9))
+					Expect(err).To(BeNil())
+					Expect(string(buf[:n])).To(Equal("Hi there!"))
+				}
+			}
+		})
+	})
+
+	Context("when encoding a message that is too large for the length prefix", func() {
+		It("should return an error", func() {
+			var readerWriter bytes.Buffer
+			opts := codec.DefaultLengthPrefixOptions().WithSize(2)
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+			_, err := enc(&readerWriter, make([]byte, 1<<16))
+			Expect(errors.Is(err, codec.ErrLengthPrefixOverflow)).To(BeTrue())
+			Expect(readerWriter.Len()).To(Equal(0))
+		})
+	})
+
+	Context("when using invalid length prefix options", func() {
+		It("should return an error instead of panicking", func() {
+			for _, opts := range []codec.LengthPrefixOptions{
+				codec.DefaultLengthPrefixOptions().WithSize(3),
+				codec.DefaultLengthPrefixOptions().WithByteOrder(nil),
+			} {
+				Expect(errors.Is(opts.Validate(), codec.ErrInvalidLengthPrefixOptions)).To(BeTrue())
+
+				var readerWriter bytes.Buffer
+				enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+				_, err := enc(&readerWriter, []byte("hello"))
+				Expect(errors.Is(err, codec.ErrInvalidLengthPrefixOptions)).To(BeTrue())
+				Expect(readerWriter.Len()).To(Equal(0))
+
+				dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+				_, err = dec(bytes.NewReader([]byte{0, 0, 0, 5}), make([]byte, 5))
+				Expect(errors.Is(err, codec.ErrInvalidLengthPrefixOptions)).To(BeTrue())
+			}
+			Expect(codec.DefaultLengthPrefixOptions().Validate()).To(Succeed())
+		})
+	})
+
+	Context("when authenticating the length prefix", func() {
+		opts := codec.DefaultLengthPrefixOptions().WithAuthenticated(true)
+
+		It("should successfully transmit messages", func() {
+			var readerWriter bytes.Buffer
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+			for i := 0; i < 3; i++ {
+				_, err := enc(&readerWriter, []byte("Hi there!"))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			for i := 0; i < 3; i++ {
+				var buf [4086]byte
+				n, err := dec(&readerWriter, buf[:])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal("Hi there!"))
+			}
+		})
+
+		It("should detect a corrupted length prefix", func() {
+			var readerWriter bytes.Buffer
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+			_, err := enc(&readerWriter, []byte("Hi there!"))
+			Expect(err).ToNot(HaveOccurred())
+
+			corrupted := readerWriter.Bytes()
+			corrupted[3]++
+			var buf [4086]byte
+			dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+			_, err = dec(bytes.NewReader(corrupted), buf[:])
+			Expect(errors.Is(err, codec.ErrFrameDesync)).To(BeTrue())
+		})
+
+		It("should detect a skipped frame", func() {
+			var skipped, readerWriter bytes.Buffer
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.PlainEncoder)
+			_, err := enc(&skipped, []byte("Hi there!"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(&readerWriter, []byte("Hi there!"))
+			Expect(err).ToNot(HaveOccurred())
+
+			var buf [4086]byte
+			dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.PlainDecoder)
+			_, err = dec(&readerWriter, buf[:])
+			Expect(errors.Is(err, codec.ErrFrameDesync)).To(BeTrue())
+		})
+
+		It("should authenticate the length prefix with the body codec", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			key := [32]byte{}
+			copy(key[:], "an example key that is 32 bytes!")
+			session1, err := codec.NewGCMSession(key, id.NewSignatory(privKey1.PubKey()), id.NewSignatory(privKey2.PubKey()))
+			Expect(err).ToNot(HaveOccurred())
+			session2, err := codec.NewGCMSession(key, id.NewSignatory(privKey2.PubKey()), id.NewSignatory(privKey1.PubKey()))
+			Expect(err).ToNot(HaveOccurred())
+
+			var readerWriter bytes.Buffer
+			enc := codec.LengthPrefixEncoderWithOptions(opts, codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			_, err = enc(&readerWriter, []byte("Hi there!"))
+			Expect(err).ToNot(HaveOccurred())
+			// The length prefix does not appear in the clear.
+			Expect(bytes.HasPrefix(readerWriter.Bytes(), []byte{0, 0, 0, 9})).To(BeFalse())
+
+			valid := append([]byte{}, readerWriter.Bytes()...)
+			var buf [4086]byte
+			dec := codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+			n, err := dec(bytes.NewReader(valid), buf[:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("Hi there!"))
+
+			corrupted := append([]byte{}, valid...)
+			corrupted[0]++
+			dec = codec.LengthPrefixDecoderWithOptions(opts, codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+			_, err = dec(bytes.NewReader(corrupted), buf[:])
+			Expect(errors.Is(err, codec.ErrFrameDesync)).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"github.com/muirglacier/id"
+)
+
+// AddAlias records that a peer has rotated its long-term key from a previous
+// signatory to a current signatory. The previous signatory is deleted from the
+// table, and its network address is moved to the current signatory (unless
+// the current signatory already has one). If the previous signatory was
+// pinned, then the current signatory is pinned too. Aliases of the previous
+// signatory are updated to point to the current signatory, so that peers that
+// rotate more than once can still be found by their first signatory. It
+// returns true if the previous signatory was in the table, otherwise it returns
+// false and the alias is not recorded. This bounds the number of aliases by the
+// number of peers that have been in the table.
+func (table *InMemTable) AddAlias(previous, current id.Signatory) bool {
+	table.sortedMu.Lock()
+	table.addrsBySignatoryMu.Lock()
+
+	defer table.sortedMu.Unlock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	if previous.Equal(&current) || table.self.Equal(&previous) || table.self.Equal(&current) {
+		return false
+	}
+	prevAddr, ok := table.addrsBySignatory[previous]
+	if !ok {
+		return false
+	}
+
+	for alias, to := range table.aliases {
+		if to.Equal(&previous) {
+			table.aliases[alias] = current
+		}
+	}
+	table.aliases[previous] = current
+	delete(table.aliases, current)
+
+	table.deletePeer(previous)
+	if _, ok := table.pinned[previous]; ok {
+		delete(table.pinned, previous)
+		table.pinned[current] = struct{}{}
+	}
+	if _, ok := table.addrsBySignatory[current]; !ok {
+		table.addPeer(current, prevAddr)
+	}
+	return true
+}
+
+// Alias returns the current signatory of a peer that has rotated away from the
+// previous signatory. False is returned if the previous signatory has not been
+// aliased, or if the current signatory has since been deleted from the table.
+func (table *InMemTable) Alias(previous id.Signatory) (id.Signatory, bool) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	current, ok := table.aliases[previous]
+	return current, ok
+}
+
+// unalias deletes all aliases that point to the peer. It assumes that the
+// address map is locked by the caller.
+func (table *InMemTable) unalias(peerID id.Signatory) {
+	for alias, to := range table.aliases {
+		if to.Equal(&peerID) {
+			delete(table.aliases, alias)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"sort"
+
+	"github.com/muirglacier/id"
+)
+
+// ClosestPeers returns the n closest peer IDs to a key. Unlike Peers, the
+// distance is measured from the key instead of the local peer, so the peers
+// have to be sorted for each call.
+func (table *InMemTable) ClosestPeers(key id.Hash, n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+
+	table.sortedMu.RLock()
+	sigs := make([]id.Signatory, len(table.sorted))
+	copy(sigs, table.sorted)
+	table.sortedMu.RUnlock()
+
+	sort.Slice(sigs, func(i, j int) bool {
+		return isCloserTo(key, sigs[i], sigs[j])
+	})
+	return sigs[:min(n, len(sigs))]
+}
+
+// isCloserTo returns true if the first peer is closer to the key than the
+// second peer.
+func isCloserTo(key id.Hash, fst, snd id.Signatory) bool {
+	for b := 0; b < 32; b++ {
+		d1 := key[b] ^ fst[b]
+		d2 := key[b] ^ snd[b]
+		if d1 < d2 {
+			return true
+		}
+		if d2 < d1 {
+			return false
+		}
+	}
+	return false
+}
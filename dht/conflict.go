@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// ConflictPolicy defines how a Table handles a peer that claims a network
+// address that is already claimed by a different peer.
+type ConflictPolicy uint8
+
+// Enumerate all ConflictPolicy values.
+const (
+	// ConflictAccept adds the peer to the table, and records the conflict.
+	ConflictAccept = ConflictPolicy(0)
+	// ConflictReject does not add the peer to the table (or does not update
+	// its network address), and records the conflict.
+	ConflictReject = ConflictPolicy(1)
+)
+
+func (policy ConflictPolicy) String() string {
+	switch policy {
+	case ConflictAccept:
+		return "accept"
+	case ConflictReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// DefaultRejectedClaimTTL is the default time for which a rejected claim
+	// to a network address is remembered.
+	DefaultRejectedClaimTTL = time.Hour
+	// DefaultMaxRejectedClaims is the default maximum number of rejected
+	// claims that are remembered for each network address.
+	DefaultMaxRejectedClaims = 16
+)
+
+// A Conflict is a network address that is claimed by more than one peer. The
+// Signatories are sorted, and include peers whose claims were rejected.
+type Conflict struct {
+	Address     wire.Address
+	Signatories []id.Signatory
+}
+
+// addrKey identifies a network address, independently of its nonce and
+// signature. The value is in its canonical form, so that different spellings
+// of the same IP address are the same network address.
+type addrKey struct {
+	protocol wire.Protocol
+	value    string
+}
+
+func newAddrKey(addr wire.Address) addrKey {
+	return addrKey{protocol: addr.Protocol, value: wire.CanonicalHostPort(addr.Value)}
+}
+
+// AddressConflicts returns all network addresses that are claimed by more than
+// one peer. The conflicts are sorted by their network address, and the peers
+// of each conflict are sorted by their signatory bytes.
+func (table *InMemTable) AddressConflicts() []Conflict {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	now := table.opts.Clock.Now()
+	conflicts := []Conflict{}
+	for key, claims := range table.claimsByAddr {
+		table.pruneRejected(key, now)
+		signatories := make([]id.Signatory, 0, len(claims)+len(table.rejectedByAddr[key]))
+		for peerID := range claims {
+			signatories = append(signatories, peerID)
+		}
+		for peerID := range table.rejectedByAddr[key] {
+			signatories = append(signatories, peerID)
+		}
+		if len(signatories) < 2 {
+			continue
+		}
+		sort.Slice(signatories, func(i, j int) bool {
+			return string(signatories[i][:]) < string(signatories[j][:])
+		})
+		conflicts = append(conflicts, Conflict{
+			Address:     wire.Address{Protocol: key.protocol, Value: key.value},
+			Signatories: signatories,
+		})
+	}
+	sortConflicts(conflicts)
+	return conflicts
+}
+
+// sortConflicts by their network address, so that the order does not depend on
+// the iteration order of a map.
+func sortConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Address.Protocol != conflicts[j].Address.Protocol {
+			return conflicts[i].Address.Protocol < conflicts[j].Address.Protocol
+		}
+		return conflicts[i].Address.Value < conflicts[j].Address.Value
+	})
+}
+
+// claim the network address for a peer. It returns false if the claim was
+// rejected. It assumes that the address map is locked by the caller.
+func (table *InMemTable) claim(peerID id.Signatory, peerAddr wire.Address) bool {
+	key := newAddrKey(peerAddr)
+	claims := table.claimsByAddr[key]
+	_, claimed := claims[peerID]
+	if claimed || len(claims) == 0 {
+		table.addClaim(key, peerID)
+		return true
+	}
+
+	// The network address is already claimed by another peer.
+	if table.opts.ConflictPolicy == ConflictReject {
+		table.reject(key, peerID)
+		table.notify(Change{Type: ChangeConflict, Signatory: peerID, Address: peerAddr})
+		return false
+	}
+	table.addClaim(key, peerID)
+	table.notify(Change{Type: ChangeConflict, Signatory: peerID, Address: peerAddr})
+	return true
+}
+
+// reject the claim of a peer to a network address, and remember it until the
+// RejectedClaimTTL has passed. If too many claims to the network address have
+// been rejected, then the oldest one is forgotten. It assumes that the address
+// map is locked by the caller.
+func (table *InMemTable) reject(key addrKey, peerID id.Signatory) {
+	now := table.opts.Clock.Now()
+	table.pruneRejected(key, now)
+	rejected := table.rejectedByAddr[key]
+	if rejected == nil {
+		rejected = map[id.Signatory]time.Time{}
+		table.rejectedByAddr[key] = rejected
+	}
+	if _, ok := rejected[peerID]; !ok && table.opts.MaxRejectedClaims > 0 && len(rejected) >= table.opts.MaxRejectedClaims {
+		oldest, oldestAt := id.Signatory{}, time.Time{}
+		for rejectedID, rejectedAt := range rejected {
+			if oldestAt.IsZero() || rejectedAt.Before(oldestAt) {
+				oldest, oldestAt = rejectedID, rejectedAt
+			}
+		}
+		delete(rejected, oldest)
+	}
+	rejected[peerID] = now
+}
+
+// pruneRejected forgets the rejected claims to a network address that are
+// older than the RejectedClaimTTL. It assumes that the address map is locked
+// by the caller.
+func (table *InMemTable) pruneRejected(key addrKey, now time.Time) {
+	if table.opts.RejectedClaimTTL <= 0 {
+		return
+	}
+	for rejectedID, rejectedAt := range table.rejectedByAddr[key] {
+		if now.Sub(rejectedAt) >= table.opts.RejectedClaimTTL {
+			delete(table.rejectedByAddr[key], rejectedID)
+		}
+	}
+	if len(table.rejectedByAddr[key]) == 0 {
+		delete(table.rejectedByAddr, key)
+	}
+}
+
+// addClaim assumes that the address map is locked by the caller.
+func (table *InMemTable) addClaim(key addrKey, peerID id.Signatory) {
+	if table.claimsByAddr[key] == nil {
+		table.claimsByAddr[key] = map[id.Signatory]struct{}{}
+	}
+	table.claimsByAddr[key][peerID] = struct{}{}
+}
+
+// unclaim the network address of a peer. When no peer in the table claims the
+// network address, any rejected claims are forgotten. It assumes that the
+// address map is locked by the caller.
+func (table *InMemTable) unclaim(peerID id.Signatory, peerAddr wire.Address) {
+	key := newAddrKey(peerAddr)
+	delete(table.claimsByAddr[key], peerID)
+	if len(table.claimsByAddr[key]) == 0 {
+		delete(table.claimsByAddr, key)
+		delete(table.rejectedByAddr, key)
+	}
+}
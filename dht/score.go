@@ -0,0 +1,56 @@
+package dht
+
+import "github.com/muirglacier/id"
+
+// A Scorer scores peers by the outcomes of connecting to them, so that peers
+// that are reliably reachable can be preferred, and peers that are not can be
+// evicted. A Table is not required to be a Scorer. If it is, then a Transport
+// using the Table records the outcome of every connection that it establishes,
+// or fails to establish, with a peer (unless auto-scoring is disabled in its
+// Options). The InMemTable is a Scorer.
+type Scorer interface {
+	// RecordSuccess records that a connection with the peer was
+	// established, and that the peer was authenticated.
+	RecordSuccess(id.Signatory)
+	// RecordFailure records that a connection with the peer could not be
+	// established, because dialing, or the handshake, failed.
+	RecordFailure(id.Signatory)
+}
+
+// Force InMemTable to implement the Scorer interface.
+var _ Scorer = &InMemTable{}
+
+// RecordSuccess marks the peer as the most recently used peer (see Touch), and
+// forgets its consecutive failures. If the peer is not in the table, this
+// method does nothing.
+func (table *InMemTable) RecordSuccess(peerID id.Signatory) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	delete(table.failures, peerID)
+	table.touch(peerID)
+}
+
+// RecordFailure marks the peer as the least recently used peer, so that it will
+// be the first to be evicted, and counts the failure. If the peer is not in the
+// table, this method does nothing.
+func (table *InMemTable) RecordFailure(peerID id.Signatory) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	elem, ok := table.lruBySignatory[peerID]
+	if !ok {
+		return
+	}
+	table.failures[peerID]++
+	table.lru.MoveToBack(elem)
+}
+
+// Failures returns the number of consecutive failures that have been recorded
+// for the peer since its last recorded success.
+func (table *InMemTable) Failures(peerID id.Signatory) int {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	return table.failures[peerID]
+}
@@ -0,0 +1,237 @@
+package dht
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// Force StaticTable to implement the Table interface.
+var _ Table = &StaticTable{}
+
+// A StaticTable is a Table with a fixed set of peers and network addresses,
+// for small clusters with a static topology that do not need peer discovery.
+// Peers cannot be added, deleted, expired, or aliased, so those methods do
+// nothing, and no Changes are ever emitted. Subnets are still supported,
+// because they are used to address the fixed peers in groups.
+type StaticTable struct {
+	self   id.Signatory
+	addrs  map[id.Signatory]wire.Address
+	sorted []id.Signatory
+
+	subnetsByHashMu *sync.Mutex
+	subnetsByHash   map[id.Hash][]id.Signatory
+
+	subscribersMu *sync.Mutex
+	subscribers   map[<-chan Change]chan Change
+}
+
+// NewStaticTable returns a StaticTable with the given peers and network
+// addresses. The addresses are copied, so modifying them afterwards does not
+// modify the table. The local peer is ignored, if it is included.
+func NewStaticTable(self id.Signatory, addrs map[id.Signatory]wire.Address) *StaticTable {
+	table := &StaticTable{
+		self:   self,
+		addrs:  make(map[id.Signatory]wire.Address, len(addrs)),
+		sorted: make([]id.Signatory, 0, len(addrs)),
+
+		subnetsByHashMu: new(sync.Mutex),
+		subnetsByHash:   map[id.Hash][]id.Signatory{},
+
+		subscribersMu: new(sync.Mutex),
+		subscribers:   map[<-chan Change]chan Change{},
+	}
+	for peerID, peerAddr := range addrs {
+		if peerID.Equal(&self) {
+			continue
+		}
+		table.addrs[peerID] = peerAddr
+		table.sorted = append(table.sorted, peerID)
+	}
+	sort.Slice(table.sorted, func(i, j int) bool {
+		return isCloserTo(id.Hash(self), table.sorted[i], table.sorted[j])
+	})
+	return table
+}
+
+func (table *StaticTable) Self() id.Signatory {
+	return table.self
+}
+
+// AddPeer does nothing, and returns false.
+func (table *StaticTable) AddPeer(id.Signatory, wire.Address) bool {
+	return false
+}
+
+// DeletePeer does nothing.
+func (table *StaticTable) DeletePeer(id.Signatory) {}
+
+func (table *StaticTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
+	addr, ok := table.addrs[peerID]
+	return addr, ok
+}
+
+// Touch does nothing, because peers are never evicted.
+func (table *StaticTable) Touch(id.Signatory) {}
+
+// Peers returns the n closest peer IDs.
+func (table *StaticTable) Peers(n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+	sigs := make([]id.Signatory, min(n, len(table.sorted)))
+	copy(sigs, table.sorted)
+	return sigs
+}
+
+// RandomPeers returns n random peer IDs.
+func (table *StaticTable) RandomPeers(n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+	m := len(table.sorted)
+	n = min(n, m)
+	sigs := make([]id.Signatory, n)
+	indexPerm := rand.Perm(m)
+	for i := 0; i < n; i++ {
+		sigs[i] = table.sorted[indexPerm[i]]
+	}
+	return sigs
+}
+
+// ClosestPeers returns the n closest peer IDs to a key.
+func (table *StaticTable) ClosestPeers(key id.Hash, n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+	sigs := make([]id.Signatory, len(table.sorted))
+	copy(sigs, table.sorted)
+	sort.Slice(sigs, func(i, j int) bool {
+		return isCloserTo(key, sigs[i], sigs[j])
+	})
+	return sigs[:min(n, len(sigs))]
+}
+
+func (table *StaticTable) NumPeers() int {
+	return len(table.addrs)
+}
+
+// HandleExpired returns false, because peers never expire.
+func (table *StaticTable) HandleExpired(id.Signatory) bool {
+	return false
+}
+
+// AddExpiry does nothing, because peers never expire.
+func (table *StaticTable) AddExpiry(id.Signatory, time.Duration) {}
+
+// DeleteExpiry does nothing, because peers never expire.
+func (table *StaticTable) DeleteExpiry(id.Signatory) {}
+
+func (table *StaticTable) AddSubnet(signatories []id.Signatory) id.Hash {
+	copied := make([]id.Signatory, len(signatories))
+	copy(copied, signatories)
+	sort.Slice(copied, func(i, j int) bool {
+		return isCloserTo(id.Hash(table.self), copied[i], copied[j])
+	})
+	// The merkle root hash is computed from the unsorted slice, in the same
+	// way as the InMemTable.
+	hash := id.NewMerkleHashFromSignatories(signatories)
+
+	table.subnetsByHashMu.Lock()
+	defer table.subnetsByHashMu.Unlock()
+
+	table.subnetsByHash[hash] = copied
+	return hash
+}
+
+func (table *StaticTable) DeleteSubnet(hash id.Hash) {
+	table.subnetsByHashMu.Lock()
+	defer table.subnetsByHashMu.Unlock()
+
+	delete(table.subnetsByHash, hash)
+}
+
+func (table *StaticTable) Subnet(hash id.Hash) []id.Signatory {
+	table.subnetsByHashMu.Lock()
+	defer table.subnetsByHashMu.Unlock()
+
+	subnet, ok := table.subnetsByHash[hash]
+	if !ok {
+		return []id.Signatory{}
+	}
+	copied := make([]id.Signatory, len(subnet))
+	copy(copied, subnet)
+	return copied
+}
+
+// Subscribe returns a channel on which no Changes will ever be sent, because
+// the peers in the table never change.
+func (table *StaticTable) Subscribe() <-chan Change {
+	table.subscribersMu.Lock()
+	defer table.subscribersMu.Unlock()
+
+	ch := make(chan Change)
+	table.subscribers[ch] = ch
+	return ch
+}
+
+// Unsubscribe a channel that was returned by Subscribe, and close it. If the
+// channel is not subscribed, this method does nothing.
+func (table *StaticTable) Unsubscribe(sub <-chan Change) {
+	table.subscribersMu.Lock()
+	defer table.subscribersMu.Unlock()
+
+	if ch, ok := table.subscribers[sub]; ok {
+		close(ch)
+		delete(table.subscribers, sub)
+	}
+}
+
+// AddAlias does nothing, and returns false.
+func (table *StaticTable) AddAlias(previous, current id.Signatory) bool {
+	return false
+}
+
+// Alias returns false, because peers are never aliased.
+func (table *StaticTable) Alias(previous id.Signatory) (id.Signatory, bool) {
+	return id.Signatory{}, false
+}
+
+// AddressConflicts returns all network addresses that are used by more than
+// one peer. The conflicts are sorted in the same way as by the InMemTable.
+func (table *StaticTable) AddressConflicts() []Conflict {
+	claimsByAddr := map[addrKey][]id.Signatory{}
+	for peerID, peerAddr := range table.addrs {
+		key := newAddrKey(peerAddr)
+		claimsByAddr[key] = append(claimsByAddr[key], peerID)
+	}
+	conflicts := []Conflict{}
+	for key, signatories := range claimsByAddr {
+		if len(signatories) < 2 {
+			continue
+		}
+		sort.Slice(signatories, func(i, j int) bool {
+			return string(signatories[i][:]) < string(signatories[j][:])
+		})
+		conflicts = append(conflicts, Conflict{
+			Address:     wire.Address{Protocol: key.protocol, Value: key.value},
+			Signatories: signatories,
+		})
+	}
+	sortConflicts(conflicts)
+	return conflicts
+}
+
+// Stats returns the Stats about the peers in the table. All peers are counted
+// as added when the table is created.
+func (table *StaticTable) Stats() Stats {
+	n := uint64(len(table.addrs))
+	return Stats{
+		Size:  n,
+		Added: n,
+	}
+}
@@ -0,0 +1,104 @@
+package dht_test
+
+import (
+	"github.com/muirglacier/aw/dht"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Static table", func() {
+	newAddrs := func(n int) map[id.Signatory]wire.Address {
+		addrs := map[id.Signatory]wire.Address{}
+		for i := 0; i < n; i++ {
+			addrs[id.NewPrivKey().Signatory()] = wire.NewUnsignedAddress(wire.TCP, "localhost:3333", 0)
+		}
+		return addrs
+	}
+
+	Context("when reading peers", func() {
+		It("should return the fixed peers and network addresses", func() {
+			self := id.NewPrivKey().Signatory()
+			addrs := newAddrs(10)
+			addrs[self] = wire.NewUnsignedAddress(wire.TCP, "localhost:4444", 0)
+			table := dht.NewStaticTable(self, addrs)
+
+			Expect(table.Self()).To(Equal(self))
+			Expect(table.NumPeers()).To(Equal(10))
+			_, ok := table.PeerAddress(self)
+			Expect(ok).To(BeFalse())
+			for peerID, peerAddr := range addrs {
+				if peerID.Equal(&self) {
+					continue
+				}
+				addr, ok := table.PeerAddress(peerID)
+				Expect(ok).To(BeTrue())
+				Expect(addr).To(Equal(peerAddr))
+			}
+
+			Expect(table.Peers(20)).To(HaveLen(10))
+			Expect(table.Peers(3)).To(Equal(table.Peers(10)[:3]))
+			Expect(table.RandomPeers(3)).To(HaveLen(3))
+			Expect(table.ClosestPeers(id.Hash(self), 3)).To(Equal(table.Peers(3)))
+			Expect(table.Stats()).To(Equal(dht.Stats{Size: 10, Added: 10}))
+		})
+	})
+
+	Context("when modifying peers", func() {
+		It("should not change", func() {
+			self := id.NewPrivKey().Signatory()
+			addrs := newAddrs(2)
+			table := dht.NewStaticTable(self, addrs)
+
+			other := id.NewPrivKey().Signatory()
+			Expect(table.AddPeer(other, wire.NewUnsignedAddress(wire.TCP, "localhost:4444", 1))).To(BeFalse())
+			_, ok := table.PeerAddress(other)
+			Expect(ok).To(BeFalse())
+
+			for peerID := range addrs {
+				table.DeletePeer(peerID)
+				table.AddExpiry(peerID, 0)
+				Expect(table.HandleExpired(peerID)).To(BeFalse())
+				Expect(table.AddAlias(peerID, other)).To(BeFalse())
+				_, ok := table.PeerAddress(peerID)
+				Expect(ok).To(BeTrue())
+			}
+			Expect(table.NumPeers()).To(Equal(2))
+
+			// Modifying the addresses after creating the table does not
+			// modify the table.
+			addrs[other] = wire.NewUnsignedAddress(wire.TCP, "localhost:4444", 1)
+			Expect(table.NumPeers()).To(Equal(2))
+
+			ch := table.Subscribe()
+			Consistently(ch).ShouldNot(Receive())
+			table.Unsubscribe(ch)
+			Eventually(ch).Should(BeClosed())
+		})
+
+		It("should report network addresses used by more than one peer", func() {
+			table := dht.NewStaticTable(id.NewPrivKey().Signatory(), newAddrs(2))
+			conflicts := table.AddressConflicts()
+			Expect(conflicts).To(HaveLen(1))
+			Expect(conflicts[0].Signatories).To(HaveLen(2))
+		})
+	})
+
+	Context("when adding subnets", func() {
+		It("should return the same subnet hash as an in-memory table", func() {
+			self := id.NewPrivKey().Signatory()
+			addrs := newAddrs(5)
+			table := dht.NewStaticTable(self, addrs)
+			inMemTable := dht.NewInMemTable(self)
+
+			signatories := table.Peers(5)
+			hash := table.AddSubnet(signatories)
+			Expect(hash).To(Equal(inMemTable.AddSubnet(signatories)))
+			Expect(table.Subnet(hash)).To(Equal(inMemTable.Subnet(hash)))
+			table.DeleteSubnet(hash)
+			Expect(table.Subnet(hash)).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/muirglacier/id"
+)
+
+// ErrInvalidInMemTableOptions is returned by InMemTableOptions.Validate, and by
+// NewInMemTableValidated, when the InMemTableOptions cannot be used.
+var ErrInvalidInMemTableOptions = errors.New("invalid in-mem table options")
+
+// WithExpiryJitter sets the factor by which expiries, and the interval of the
+// sweeper, are randomly spread. Each expiry added to the InMemTable lasts for
+// its duration, plus a random extra duration of up to the jitter factor
+// times the duration (so that peers never expire sooner than expected). Each
+// interval of RunSweeper is randomly scaled by a factor between one minus the
+// jitter factor, and one plus the jitter factor. This de-synchronizes expiries
+// (and the re-announcements that follow them) across peers that were started
+// together. It must be between zero and one (see Validate). By default, it is
+// zero, and there is no jitter.
+func (opts InMemTableOptions) WithExpiryJitter(jitter float64) InMemTableOptions {
+	opts.ExpiryJitter = jitter
+	return opts
+}
+
+// Validate returns an error wrapping ErrInvalidInMemTableOptions if the
+// InMemTableOptions cannot be used.
+func (opts InMemTableOptions) Validate() error {
+	switch {
+	case math.IsNaN(opts.ExpiryJitter) || opts.ExpiryJitter < 0 || opts.ExpiryJitter > 1:
+		return fmt.Errorf("%w: expiry jitter must be between 0 and 1, got %v", ErrInvalidInMemTableOptions, opts.ExpiryJitter)
+	}
+	return nil
+}
+
+// NewInMemTableValidated validates the InMemTableOptions, and returns an empty
+// InMemTable. If the InMemTableOptions are invalid, then an error wrapping
+// ErrInvalidInMemTableOptions is returned, and no InMemTable is built.
+func NewInMemTableValidated(self id.Signatory, opts InMemTableOptions) (*InMemTable, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return NewInMemTableWithOptions(self, opts), nil
+}
+
+// SweepExpired deletes all peers with an expiry that has elapsed, and returns
+// them. Unlike HandleExpired, which only checks the expiry of one peer when it
+// fails to be contacted, this checks every expiry in the table.
+func (table *InMemTable) SweepExpired() []id.Signatory {
+	table.expiryBySignatoryMu.Lock()
+	defer table.expiryBySignatoryMu.Unlock()
+
+	now := table.opts.Clock.Now()
+	swept := []id.Signatory{}
+	for peerID, expiry := range table.expiryBySignatory {
+		if now.Sub(expiry.timestamp) <= expiry.minimumExpiryAge {
+			continue
+		}
+		if table.lockAndDeletePeer(peerID) {
+			atomic.AddUint64(table.expired, 1)
+		}
+		delete(table.expiryBySignatory, peerID)
+		swept = append(swept, peerID)
+	}
+	return swept
+}
+
+// RunSweeper calls SweepExpired periodically, until the context is done. The
+// interval between sweeps is spread by the ExpiryJitter, so that the sweepers
+// of peers that were started together do not stay synchronized. This method
+// blocks, so it is usually run in a goroutine.
+//
+// The InMemTable never starts a sweeper by itself (and neither does the
+// Transport that uses it), so the owner of the InMemTable must run one if
+// expiries are to be enforced for peers that are never contacted again.
+// Otherwise, expiries are only checked by HandleExpired.
+func (table *InMemTable) RunSweeper(ctx context.Context, interval time.Duration) {
+	timer := table.opts.Clock.NewTimer(jitter(interval, table.opts.ExpiryJitter, 2*rand.Float64()-1))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+			table.SweepExpired()
+			timer.Reset(jitter(interval, table.opts.ExpiryJitter, 2*rand.Float64()-1))
+		}
+	}
+}
+
+// jitter scales the duration by one plus the jitter factor times the
+// fraction, where the fraction is usually random.
+func jitter(d time.Duration, factor, fraction float64) time.Duration {
+	return d + time.Duration(float64(d)*factor*fraction)
+}
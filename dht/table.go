@@ -1,11 +1,14 @@
 package dht
 
 import (
+	"container/list"
 	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/muirglacier/aw/clock"
 	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
 )
@@ -13,6 +16,43 @@ import (
 // Force InMemTable to implement the Table interface.
 var _ Table = &InMemTable{}
 
+// ChangeType defines the type of a Change to the peers in a Table.
+type ChangeType uint8
+
+// Enumerate all ChangeType values.
+const (
+	ChangeAdded   = ChangeType(1)
+	ChangeRemoved = ChangeType(2)
+	ChangeUpdated = ChangeType(3)
+	// ChangeConflict is emitted when a peer claims a network address that is
+	// already claimed by a different peer.
+	ChangeConflict = ChangeType(4)
+)
+
+func (changeType ChangeType) String() string {
+	switch changeType {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeUpdated:
+		return "updated"
+	case ChangeConflict:
+		return "conflict"
+	default:
+		return "unknown"
+	}
+}
+
+// A Change is emitted by a Table when a peer is added, removed, or has its
+// network address updated. For removals, the Address is the last known network
+// address of the peer.
+type Change struct {
+	Type      ChangeType
+	Signatory id.Signatory
+	Address   wire.Address
+}
+
 type Expiry struct {
 	minimumExpiryAge time.Duration
 	timestamp        time.Time
@@ -26,12 +66,19 @@ type Table interface {
 	// to exist.
 	Self() id.Signatory
 
-	// AddPeer to the table with an associate network address.
-	AddPeer(id.Signatory, wire.Address)
+	// AddPeer to the table with an associate network address. If the peer is
+	// already in the table, then its network address is only replaced by one
+	// with a greater nonce, so that stale addresses cannot overwrite fresh
+	// ones. It returns true if the table was updated, otherwise it returns
+	// false.
+	AddPeer(id.Signatory, wire.Address) bool
 	// DeletePeer from the table.
 	DeletePeer(id.Signatory)
 	// PeerAddress returns the network address associated with the given peer.
 	PeerAddress(id.Signatory) (wire.Address, bool)
+	// Touch marks the peer as recently used, for example, after successfully
+	// connecting to it.
+	Touch(id.Signatory)
 
 	// Peers returns the n closest peers to the local peer, using XORing as the
 	// measure of distance between two peers.
@@ -39,6 +86,9 @@ type Table interface {
 	// RandomPeers returns n random peer IDs, using either partial permutation
 	// or Floyd's sampling algorithm.
 	RandomPeers(int) []id.Signatory
+	// ClosestPeers returns the n closest peers to a key, using XORing as the
+	// measure of distance between a peer and the key.
+	ClosestPeers(key id.Hash, n int) []id.Signatory
 	// NumPeers returns the total number of peers with associated network
 	// addresses in the table.
 	NumPeers() int
@@ -61,10 +111,135 @@ type Table interface {
 	DeleteSubnet(id.Hash)
 	// Subnet returns the peers from the table.
 	Subnet(id.Hash) []id.Signatory
+
+	// Subscribe returns a channel on which Changes to the peers in the table
+	// will be sent. Sending never blocks the table; if the channel is full,
+	// then the Change is dropped.
+	Subscribe() <-chan Change
+	// Unsubscribe a channel that was returned by Subscribe. The channel will
+	// be closed.
+	Unsubscribe(<-chan Change)
+
+	// AddAlias records that a peer has rotated its long-term key from a
+	// previous signatory to a current signatory. The network address of the
+	// previous signatory is moved to the current signatory, unless the
+	// current signatory already has one. It returns true if the previous
+	// signatory was in the table, otherwise it returns false and the alias is
+	// not recorded.
+	AddAlias(previous, current id.Signatory) bool
+	// Alias returns the current signatory of a peer that has rotated away
+	// from the given previous signatory.
+	Alias(previous id.Signatory) (id.Signatory, bool)
+
+	// AddressConflicts returns all network addresses that are claimed by more
+	// than one peer, sorted by their network address. The peers of each
+	// conflict are sorted by their signatory bytes.
+	AddressConflicts() []Conflict
+
+	// Stats returns a snapshot of the Stats about the peers in the table. It
+	// is cheap enough to be called frequently.
+	Stats() Stats
+}
+
+// Stats about the peers in a Table. All counters, except for Size, are
+// monotonic, so the rate of churn can be measured by sampling them
+// periodically.
+type Stats struct {
+	// Size is the number of peers currently in the table.
+	Size uint64
+	// Added is the total number of peers that have been added.
+	Added uint64
+	// Removed is the total number of peers that have been removed, for any
+	// reason (including eviction, and expiry).
+	Removed uint64
+	// Expired is the total number of peers that have been removed, because
+	// they could not be connected to before their expiry.
+	Expired uint64
+}
+
+var (
+	// DefaultSubscriptionBufferSize defines the default number of Changes
+	// that can be buffered for each subscriber.
+	DefaultSubscriptionBufferSize = 64
+)
+
+// InMemTableOptions for parameterising the behaviour of the InMemTable.
+type InMemTableOptions struct {
+	Clock                  clock.Clock
+	Capacity               int
+	SubscriptionBufferSize int
+	ConflictPolicy         ConflictPolicy
+	RejectedClaimTTL       time.Duration
+	MaxRejectedClaims      int
+	ExpiryJitter           float64
+}
+
+// DefaultInMemTableOptions returns the default InMemTableOptions.
+func DefaultInMemTableOptions() InMemTableOptions {
+	return InMemTableOptions{
+		Clock:                  clock.Real(),
+		Capacity:               0,
+		SubscriptionBufferSize: DefaultSubscriptionBufferSize,
+		ConflictPolicy:         ConflictAccept,
+		RejectedClaimTTL:       DefaultRejectedClaimTTL,
+		MaxRejectedClaims:      DefaultMaxRejectedClaims,
+	}
+}
+
+// WithConflictPolicy sets the ConflictPolicy used when a peer claims a network
+// address that is already claimed by a different peer. By default, such peers
+// are accepted, and the conflict is recorded.
+func (opts InMemTableOptions) WithConflictPolicy(policy ConflictPolicy) InMemTableOptions {
+	opts.ConflictPolicy = policy
+	return opts
+}
+
+// WithRejectedClaimTTL sets how long a rejected claim to a network address is
+// remembered (and reported by AddressConflicts). Zero, or less, means that
+// rejected claims are remembered until no peer claims the network address.
+func (opts InMemTableOptions) WithRejectedClaimTTL(ttl time.Duration) InMemTableOptions {
+	opts.RejectedClaimTTL = ttl
+	return opts
+}
+
+// WithMaxRejectedClaims sets the maximum number of rejected claims that are
+// remembered for each network address. When the maximum is exceeded, the
+// oldest rejected claim is forgotten. Zero, or less, means that the number of
+// rejected claims is not limited.
+func (opts InMemTableOptions) WithMaxRejectedClaims(max int) InMemTableOptions {
+	opts.MaxRejectedClaims = max
+	return opts
+}
+
+// WithSubscriptionBufferSize sets the number of Changes that can be buffered
+// for each subscriber. Changes that are emitted while the buffer is full are
+// dropped.
+func (opts InMemTableOptions) WithSubscriptionBufferSize(size int) InMemTableOptions {
+	opts.SubscriptionBufferSize = size
+	return opts
+}
+
+// WithCapacity sets the maximum number of peers that can be stored in the
+// InMemTable. When the capacity is exceeded, the least recently used peer that
+// is not pinned is evicted. The peer that is being added is never evicted, so
+// the capacity is exceeded when all other peers are pinned. Peers that could
+// not be connected to are treated as the least recently used (see
+// RecordFailure). A capacity of zero, or less, means that the InMemTable is
+// unbounded.
+func (opts InMemTableOptions) WithCapacity(capacity int) InMemTableOptions {
+	opts.Capacity = capacity
+	return opts
+}
+
+// WithClock sets the Clock used to timestamp and check expiries.
+func (opts InMemTableOptions) WithClock(clock clock.Clock) InMemTableOptions {
+	opts.Clock = clock
+	return opts
 }
 
 // InMemTable implements the Table using in-memory storage.
 type InMemTable struct {
+	opts InMemTableOptions
 	self id.Signatory
 
 	sortedMu *sync.RWMutex
@@ -72,6 +247,13 @@ type InMemTable struct {
 
 	addrsBySignatoryMu *sync.Mutex
 	addrsBySignatory   map[id.Signatory]wire.Address
+	lru                *list.List
+	lruBySignatory     map[id.Signatory]*list.Element
+	pinned             map[id.Signatory]struct{}
+	failures           map[id.Signatory]int
+	claimsByAddr       map[addrKey]map[id.Signatory]struct{}
+	rejectedByAddr     map[addrKey]map[id.Signatory]time.Time
+	aliases            map[id.Signatory]id.Signatory
 
 	expiryBySignatoryMu *sync.Mutex
 	expiryBySignatory   map[id.Signatory]Expiry
@@ -79,11 +261,30 @@ type InMemTable struct {
 	subnetsByHashMu *sync.Mutex
 	subnetsByHash   map[id.Hash][]id.Signatory
 
+	subscribersMu *sync.Mutex
+	subscribers   map[<-chan Change]chan Change
+
+	added, removed, expired *uint64
+
 	randObj *rand.Rand
 }
 
+// NewInMemTable returns an empty InMemTable using the default
+// InMemTableOptions.
 func NewInMemTable(self id.Signatory) *InMemTable {
+	return NewInMemTableWithOptions(self, DefaultInMemTableOptions())
+}
+
+// NewInMemTableWithCapacity returns an empty InMemTable that stores, at most,
+// the given number of unpinned peers. See InMemTableOptions.WithCapacity.
+func NewInMemTableWithCapacity(self id.Signatory, capacity int) *InMemTable {
+	return NewInMemTableWithOptions(self, DefaultInMemTableOptions().WithCapacity(capacity))
+}
+
+// NewInMemTableWithOptions returns an empty InMemTable.
+func NewInMemTableWithOptions(self id.Signatory, opts InMemTableOptions) *InMemTable {
 	return &InMemTable{
+		opts: opts,
 		self: self,
 
 		sortedMu: new(sync.RWMutex),
@@ -91,6 +292,13 @@ func NewInMemTable(self id.Signatory) *InMemTable {
 
 		addrsBySignatoryMu: new(sync.Mutex),
 		addrsBySignatory:   map[id.Signatory]wire.Address{},
+		lru:                list.New(),
+		lruBySignatory:     map[id.Signatory]*list.Element{},
+		pinned:             map[id.Signatory]struct{}{},
+		failures:           map[id.Signatory]int{},
+		claimsByAddr:       map[addrKey]map[id.Signatory]struct{}{},
+		rejectedByAddr:     map[addrKey]map[id.Signatory]time.Time{},
+		aliases:            map[id.Signatory]id.Signatory{},
 
 		expiryBySignatoryMu: new(sync.Mutex),
 		expiryBySignatory:   map[id.Signatory]Expiry{},
@@ -98,6 +306,13 @@ func NewInMemTable(self id.Signatory) *InMemTable {
 		subnetsByHashMu: new(sync.Mutex),
 		subnetsByHash:   map[id.Hash][]id.Signatory{},
 
+		subscribersMu: new(sync.Mutex),
+		subscribers:   map[<-chan Change]chan Change{},
+
+		added:   new(uint64),
+		removed: new(uint64),
+		expired: new(uint64),
+
 		randObj: rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
@@ -106,43 +321,110 @@ func (table *InMemTable) Self() id.Signatory {
 	return table.self
 }
 
-func (table *InMemTable) AddPeer(peerID id.Signatory, peerAddr wire.Address) {
+// AddPeer to the table. If the peer is already in the table, then its
+// network address is only replaced if the new network address has a greater
+// nonce. Re-adding a network address with the same nonce marks the peer as
+// recently used, but does not update the table. It returns true if the peer
+// was added, or its network address was replaced, otherwise it returns false.
+func (table *InMemTable) AddPeer(peerID id.Signatory, peerAddr wire.Address) bool {
 	table.sortedMu.Lock()
 	table.addrsBySignatoryMu.Lock()
 
 	defer table.sortedMu.Unlock()
 	defer table.addrsBySignatoryMu.Unlock()
 
+	return table.addPeer(peerID, peerAddr)
+}
+
+// addPeer assumes that the sorted list and the address map are locked by the
+// caller.
+func (table *InMemTable) addPeer(peerID id.Signatory, peerAddr wire.Address) bool {
 	if table.self.Equal(&peerID) {
-		return
+		return false
 	}
 
-	_, ok := table.addrsBySignatory[peerID]
+	prevAddr, ok := table.addrsBySignatory[peerID]
+	if ok && peerAddr.Nonce <= prevAddr.Nonce {
+		// Nonces are strictly increasing, so an address with a nonce that
+		// is not greater is either stale, or the one that is already stored.
+		if peerAddr.Nonce == prevAddr.Nonce {
+			table.touch(peerID)
+		}
+		return false
+	}
+	if !ok || newAddrKey(prevAddr) != newAddrKey(peerAddr) {
+		if !table.claim(peerID, peerAddr) {
+			return false
+		}
+		if ok {
+			table.unclaim(peerID, prevAddr)
+		}
+	}
 
 	// Insert into the map to allow for address lookup using the signatory.
 	table.addrsBySignatory[peerID] = peerAddr
+	if !ok {
+		table.notify(Change{Type: ChangeAdded, Signatory: peerID, Address: peerAddr})
+	} else if !prevAddr.Equal(&peerAddr) {
+		table.notify(Change{Type: ChangeUpdated, Signatory: peerID, Address: peerAddr})
+	}
 
 	// Insert into the sorted signatories list based on its XOR distance from our
 	// own address.
 	if !ok {
+		atomic.AddUint64(table.added, 1)
 		i := sort.Search(len(table.sorted), func(i int) bool {
 			return table.isCloser(peerID, table.sorted[i])
 		})
 		table.sorted = append(table.sorted, id.Signatory{})
 		copy(table.sorted[i+1:], table.sorted[i:])
 		table.sorted[i] = peerID
+
+		table.lruBySignatory[peerID] = table.lru.PushFront(peerID)
+		table.evict(peerID)
+		return true
 	}
+	table.touch(peerID)
+	return true
 }
 
 func (table *InMemTable) DeletePeer(peerID id.Signatory) {
+	table.lockAndDeletePeer(peerID)
+}
+
+// lockAndDeletePeer locks the sorted list and the address map, and then
+// deletes the peer. It returns true if the peer was in the table, otherwise it
+// returns false.
+func (table *InMemTable) lockAndDeletePeer(peerID id.Signatory) bool {
 	table.sortedMu.Lock()
 	table.addrsBySignatoryMu.Lock()
 
 	defer table.sortedMu.Unlock()
 	defer table.addrsBySignatoryMu.Unlock()
 
-	// Delete from the map.
+	return table.deletePeer(peerID)
+}
+
+// deletePeer assumes that the sorted list and the address map are locked by
+// the caller. It returns true if the peer was in the table, otherwise it
+// returns false.
+func (table *InMemTable) deletePeer(peerID id.Signatory) bool {
+	addr, ok := table.addrsBySignatory[peerID]
+	if !ok {
+		return false
+	}
+	atomic.AddUint64(table.removed, 1)
+	table.notify(Change{Type: ChangeRemoved, Signatory: peerID, Address: addr})
+
+	// Delete from the map, and from the least recently used list.
 	delete(table.addrsBySignatory, peerID)
+	table.unclaim(peerID, addr)
+	if elem, ok := table.lruBySignatory[peerID]; ok {
+		table.lru.Remove(elem)
+		delete(table.lruBySignatory, peerID)
+	}
+	delete(table.failures, peerID)
+	table.unalias(peerID)
 
 	// Delete from the sorted list.
 	numAddrs := len(table.sorted)
@@ -154,6 +436,7 @@ func (table *InMemTable) DeletePeer(peerID id.Signatory) {
 	if removeIndex >= 0 {
 		table.sorted = append(table.sorted[:removeIndex], table.sorted[removeIndex+1:]...)
 	}
+	return true
 }
 
 func (table *InMemTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
@@ -161,9 +444,85 @@ func (table *InMemTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
 	defer table.addrsBySignatoryMu.Unlock()
 
 	addr, ok := table.addrsBySignatory[peerID]
+	if ok {
+		table.touch(peerID)
+	}
 	return addr, ok
 }
 
+// Touch marks the peer as the most recently used peer, so that it will be the
+// last to be evicted. If the peer is not in the table, this method does
+// nothing.
+func (table *InMemTable) Touch(peerID id.Signatory) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	table.touch(peerID)
+}
+
+// Pin a peer so that it is never evicted from the table, even when the
+// capacity has been exceeded. Pinning is independent of whether or not the
+// peer is in the table. This is useful for seed peers, which should never be
+// forgotten.
+func (table *InMemTable) Pin(peerID id.Signatory) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	table.pinned[peerID] = struct{}{}
+}
+
+// Unpin a peer so that it can be evicted from the table.
+func (table *InMemTable) Unpin(peerID id.Signatory) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	delete(table.pinned, peerID)
+}
+
+// IsPinned returns true if the peer is pinned, otherwise it returns false.
+func (table *InMemTable) IsPinned(peerID id.Signatory) bool {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	_, ok := table.pinned[peerID]
+	return ok
+}
+
+// Capacity returns the maximum number of unpinned peers that can be stored in
+// the table. A capacity of zero, or less, means that the table is unbounded.
+func (table *InMemTable) Capacity() int {
+	return table.opts.Capacity
+}
+
+// touch assumes that the address map is locked by the caller.
+func (table *InMemTable) touch(peerID id.Signatory) {
+	if elem, ok := table.lruBySignatory[peerID]; ok {
+		table.lru.MoveToFront(elem)
+	}
+}
+
+// evict the least recently used, unpinned, peers until the capacity is no
+// longer exceeded. The peer that has just been added is never evicted, so if
+// all other peers are pinned, the capacity can be exceeded. It assumes that the
+// sorted list and the address map are locked by the caller.
+func (table *InMemTable) evict(added id.Signatory) {
+	if table.opts.Capacity <= 0 {
+		return
+	}
+	elem := table.lru.Back()
+	for len(table.addrsBySignatory) > table.opts.Capacity && elem != nil {
+		prev := elem.Prev()
+		peerID := elem.Value.(id.Signatory)
+		if peerID.Equal(&added) {
+			break
+		}
+		if _, ok := table.pinned[peerID]; !ok {
+			table.deletePeer(peerID)
+		}
+		elem = prev
+	}
+}
+
 // Peers returns the n closest peer IDs.
 func (table *InMemTable) Peers(n int) []id.Signatory {
 	table.sortedMu.RLock()
@@ -242,18 +601,26 @@ func (table *InMemTable) HandleExpired(peerID id.Signatory) bool {
 	if !ok {
 		return false
 	}
-	expired := (time.Now().Sub(expiry.timestamp)) > expiry.minimumExpiryAge
+	expired := (table.opts.Clock.Now().Sub(expiry.timestamp)) > expiry.minimumExpiryAge
 	if expired {
-		table.DeletePeer(peerID)
+		if table.lockAndDeletePeer(peerID) {
+			atomic.AddUint64(table.expired, 1)
+		}
 		delete(table.expiryBySignatory, peerID)
 	}
 	return expired
 }
 
+// AddExpiry to the InMemTable, if the peer is in the table and does not already
+// have an expiry. The duration is spread by the ExpiryJitter.
 func (table *InMemTable) AddExpiry(peerID id.Signatory, duration time.Duration) {
 	table.expiryBySignatoryMu.Lock()
 	defer table.expiryBySignatoryMu.Unlock()
-	_, ok := table.PeerAddress(peerID)
+	// Check the address map directly, instead of using PeerAddress, so that
+	// failing to connect to a peer does not mark it as recently used.
+	table.addrsBySignatoryMu.Lock()
+	_, ok := table.addrsBySignatory[peerID]
+	table.addrsBySignatoryMu.Unlock()
 	if !ok {
 		return
 	}
@@ -262,8 +629,8 @@ func (table *InMemTable) AddExpiry(peerID id.Signatory, duration time.Duration)
 		return
 	}
 	table.expiryBySignatory[peerID] = Expiry{
-		minimumExpiryAge: duration,
-		timestamp:        time.Now(),
+		minimumExpiryAge: jitter(duration, table.opts.ExpiryJitter, rand.Float64()),
+		timestamp:        table.opts.Clock.Now(),
 	}
 }
 
@@ -273,6 +640,23 @@ func (table *InMemTable) DeleteExpiry(peerID id.Signatory) {
 	delete(table.expiryBySignatory, peerID)
 }
 
+// Stats returns a snapshot of the Stats about the peers in the table. It does
+// not acquire any locks. The Size is derived from the other counters, so it
+// can briefly lag behind NumPeers while peers are being added or removed.
+func (table *InMemTable) Stats() Stats {
+	// Load the removals before the additions, so that the Size never
+	// underflows.
+	removed := atomic.LoadUint64(table.removed)
+	expired := atomic.LoadUint64(table.expired)
+	added := atomic.LoadUint64(table.added)
+	return Stats{
+		Size:    added - removed,
+		Added:   added,
+		Removed: removed,
+		Expired: expired,
+	}
+}
+
 func (table *InMemTable) AddSubnet(signatories []id.Signatory) id.Hash {
 	copied := make([]id.Signatory, len(signatories))
 	copy(copied, signatories)
@@ -316,18 +700,47 @@ func (table *InMemTable) Subnet(hash id.Hash) []id.Signatory {
 	return copied
 }
 
-func (table *InMemTable) isCloser(fst, snd id.Signatory) bool {
-	for b := 0; b < 32; b++ {
-		d1 := table.self[b] ^ fst[b]
-		d2 := table.self[b] ^ snd[b]
-		if d1 < d2 {
-			return true
-		}
-		if d2 < d1 {
-			return false
+// Subscribe returns a channel on which all Changes to the peers in the table
+// will be sent. The channel is buffered (see SubscriptionBufferSize), and
+// Changes are dropped when the buffer is full, so that a slow subscriber cannot
+// block the table.
+func (table *InMemTable) Subscribe() <-chan Change {
+	table.subscribersMu.Lock()
+	defer table.subscribersMu.Unlock()
+
+	ch := make(chan Change, table.opts.SubscriptionBufferSize)
+	table.subscribers[ch] = ch
+	return ch
+}
+
+// Unsubscribe a channel that was returned by Subscribe, and close it. No more
+// Changes will be sent on the channel. If the channel is not subscribed, this
+// method does nothing.
+func (table *InMemTable) Unsubscribe(sub <-chan Change) {
+	table.subscribersMu.Lock()
+	defer table.subscribersMu.Unlock()
+
+	if ch, ok := table.subscribers[sub]; ok {
+		close(ch)
+		delete(table.subscribers, sub)
+	}
+}
+
+// notify all subscribers of a Change without blocking.
+func (table *InMemTable) notify(change Change) {
+	table.subscribersMu.Lock()
+	defer table.subscribersMu.Unlock()
+
+	for _, ch := range table.subscribers {
+		select {
+		case ch <- change:
+		default:
 		}
 	}
-	return false
+}
+
+func (table *InMemTable) isCloser(fst, snd id.Signatory) bool {
+	return isCloserTo(id.Hash(table.self), fst, snd)
 }
 
 func min(a, b int) int {
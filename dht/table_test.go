@@ -1,13 +1,18 @@
 package dht_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"sort"
 	"strconv"
 	"testing/quick"
 	"time"
 
+	"github.com/muirglacier/aw/clock"
 	"github.com/muirglacier/aw/dht"
 	"github.com/muirglacier/aw/dht/dhtutil"
 	"github.com/muirglacier/aw/wire"
@@ -296,6 +301,50 @@ var _ = Describe("DHT", func() {
 			})
 		})
 
+		Context("when re-inserting an address with an older nonce", func() {
+			It("should keep the newer address", func() {
+				table, _ := initDHT()
+				sig, addr := newPeerWithAddress()
+				Expect(table.AddPeer(sig, addr)).To(BeTrue())
+
+				staleAddr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", addr.Nonce-1)
+				Expect(table.AddPeer(sig, staleAddr)).To(BeFalse())
+				storedAddr, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				Expect(storedAddr).To(Equal(addr))
+			})
+		})
+
+		Context("when re-inserting an address with an equal nonce", func() {
+			It("should keep the stored address", func() {
+				table, _ := initDHT()
+				sig, addr := newPeerWithAddress()
+				Expect(table.AddPeer(sig, addr)).To(BeTrue())
+				Expect(table.AddPeer(sig, addr)).To(BeFalse())
+
+				conflictingAddr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", addr.Nonce)
+				Expect(table.AddPeer(sig, conflictingAddr)).To(BeFalse())
+				storedAddr, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				Expect(storedAddr).To(Equal(addr))
+			})
+		})
+
+		Context("when re-inserting an address with a newer nonce", func() {
+			It("should replace the stored address", func() {
+				table, _ := initDHT()
+				sig, addr := newPeerWithAddress()
+				Expect(table.AddPeer(sig, addr)).To(BeTrue())
+
+				freshAddr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", addr.Nonce+1)
+				Expect(table.AddPeer(sig, freshAddr)).To(BeTrue())
+				storedAddr, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				Expect(storedAddr).To(Equal(freshAddr))
+				Expect(table.NumPeers()).To(Equal(1))
+			})
+		})
+
 		Measure("Adding 10000 addresses to distributed hash table", func(b Benchmarker) {
 			table, _ := initDHT()
 			signatories := make([]id.Signatory, 0)
@@ -389,6 +438,535 @@ var _ = Describe("DHT", func() {
 			})
 		})
 	})
+
+	Describe("Capacity", func() {
+		Context("when the capacity is exceeded", func() {
+			It("should evict the least recently used peer", func() {
+				table := dht.NewInMemTableWithCapacity(id.NewPrivKey().Signatory(), 3)
+				Expect(table.Capacity()).To(Equal(3))
+
+				sig1, addr1 := newPeerWithAddress()
+				sig2, addr2 := newPeerWithAddress()
+				sig3, addr3 := newPeerWithAddress()
+				sig4, addr4 := newPeerWithAddress()
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+				table.AddPeer(sig3, addr3)
+
+				// Use the first peer, so that the second peer becomes the least
+				// recently used peer.
+				_, ok := table.PeerAddress(sig1)
+				Expect(ok).To(BeTrue())
+
+				table.AddPeer(sig4, addr4)
+				Expect(table.NumPeers()).To(Equal(3))
+				Expect(table.Peers(4)).To(HaveLen(3))
+				_, ok = table.PeerAddress(sig2)
+				Expect(ok).To(BeFalse())
+				for _, sig := range []id.Signatory{sig1, sig3, sig4} {
+					_, ok := table.PeerAddress(sig)
+					Expect(ok).To(BeTrue())
+				}
+			})
+		})
+
+		Context("when the least recently used peer is pinned", func() {
+			It("should evict the next least recently used peer", func() {
+				table := dht.NewInMemTableWithCapacity(id.NewPrivKey().Signatory(), 2)
+
+				sig1, addr1 := newPeerWithAddress()
+				sig2, addr2 := newPeerWithAddress()
+				sig3, addr3 := newPeerWithAddress()
+				table.Pin(sig1)
+				Expect(table.IsPinned(sig1)).To(BeTrue())
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+				table.AddPeer(sig3, addr3)
+
+				Expect(table.NumPeers()).To(Equal(2))
+				_, ok := table.PeerAddress(sig1)
+				Expect(ok).To(BeTrue())
+				_, ok = table.PeerAddress(sig2)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when all other peers are pinned", func() {
+			It("should not evict the peer that is added", func() {
+				table := dht.NewInMemTableWithCapacity(id.NewPrivKey().Signatory(), 2)
+				sig1, addr1 := newPeerWithAddress()
+				sig2, addr2 := newPeerWithAddress()
+				table.Pin(sig1)
+				table.Pin(sig2)
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+
+				sub := table.Subscribe()
+				sig3, addr3 := newPeerWithAddress()
+				Expect(table.AddPeer(sig3, addr3)).To(BeTrue())
+				Expect(table.NumPeers()).To(Equal(3))
+				_, ok := table.PeerAddress(sig3)
+				Expect(ok).To(BeTrue())
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeAdded, Signatory: sig3, Address: addr3}))
+				Expect(sub).ToNot(Receive())
+			})
+		})
+
+		Context("when connecting to a peer has failed", func() {
+			It("should evict the failing peer first", func() {
+				table := dht.NewInMemTableWithCapacity(id.NewPrivKey().Signatory(), 2)
+
+				sig1, addr1 := newPeerWithAddress()
+				sig2, addr2 := newPeerWithAddress()
+				sig3, addr3 := newPeerWithAddress()
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+
+				// The second peer is the most recently used peer, but it is
+				// failing, so it is evicted before the first peer.
+				table.RecordFailure(sig2)
+				table.RecordFailure(sig2)
+				Expect(table.Failures(sig2)).To(Equal(2))
+
+				table.AddPeer(sig3, addr3)
+				Expect(table.NumPeers()).To(Equal(2))
+				_, ok := table.PeerAddress(sig2)
+				Expect(ok).To(BeFalse())
+				Expect(table.Failures(sig2)).To(Equal(0))
+				_, ok = table.PeerAddress(sig1)
+				Expect(ok).To(BeTrue())
+
+				// Failures are forgotten once connecting succeeds.
+				table.RecordFailure(sig1)
+				Expect(table.Failures(sig1)).To(Equal(1))
+				table.RecordSuccess(sig1)
+				Expect(table.Failures(sig1)).To(Equal(0))
+			})
+		})
+
+		Context("when the capacity is not set", func() {
+			It("should not evict peers", func() {
+				table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+				for i := 0; i < 100; i++ {
+					table.AddPeer(newPeerWithAddress())
+				}
+				Expect(table.NumPeers()).To(Equal(100))
+			})
+		})
+	})
+
+	Describe("Deleting peers", func() {
+		Context("when deleting a peer that is not in the table", func() {
+			It("should not delete other peers", func() {
+				table, _ := initDHT()
+				sig1, addr1 := newPeerWithAddress()
+				table.AddPeer(sig1, addr1)
+
+				sig2, _ := newPeerWithAddress()
+				table.DeletePeer(sig2)
+				Expect(table.Peers(1)).To(Equal([]id.Signatory{sig1}))
+			})
+		})
+	})
+
+	Describe("Stats", func() {
+		Context("when peers are added, removed, evicted, and expired", func() {
+			It("should count the churn", func() {
+				fake := clock.NewFake(time.Now())
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithCapacity(2).WithClock(fake))
+				Expect(table.Stats()).To(Equal(dht.Stats{}))
+
+				sig1, addr1 := newPeerWithAddress()
+				sig2, addr2 := newPeerWithAddress()
+				sig3, addr3 := newPeerWithAddress()
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+				// Re-adding a peer is not counted.
+				table.AddPeer(sig2, addr2)
+				Expect(table.Stats()).To(Equal(dht.Stats{Size: 2, Added: 2}))
+
+				// Exceeding the capacity evicts a peer.
+				table.AddPeer(sig3, addr3)
+				Expect(table.Stats()).To(Equal(dht.Stats{Size: 2, Added: 3, Removed: 1}))
+
+				// Deleting a peer that is not in the table is not counted.
+				table.DeletePeer(sig1)
+				table.DeletePeer(sig2)
+				Expect(table.Stats()).To(Equal(dht.Stats{Size: 1, Added: 3, Removed: 2}))
+
+				table.AddExpiry(sig3, time.Second)
+				fake.Advance(2 * time.Second)
+				Expect(table.HandleExpired(sig3)).To(BeTrue())
+				Expect(table.Stats()).To(Equal(dht.Stats{Size: 0, Added: 3, Removed: 3, Expired: 1}))
+				Expect(table.NumPeers()).To(Equal(0))
+			})
+		})
+	})
+
+	Describe("Subscriptions", func() {
+		Context("when peers are added, updated, and removed", func() {
+			It("should notify subscribers", func() {
+				table, _ := initDHT()
+				sub := table.Subscribe()
+
+				sig, addr := newPeerWithAddress()
+				table.AddPeer(sig, addr)
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeAdded, Signatory: sig, Address: addr}))
+
+				// Re-adding the same address is not a change.
+				table.AddPeer(sig, addr)
+				Expect(sub).ToNot(Receive())
+
+				newAddr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", addr.Nonce+1)
+				table.AddPeer(sig, newAddr)
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeUpdated, Signatory: sig, Address: newAddr}))
+
+				table.DeletePeer(sig)
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeRemoved, Signatory: sig, Address: newAddr}))
+			})
+		})
+
+		Context("when the subscriber is slow", func() {
+			It("should drop changes instead of blocking", func() {
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithSubscriptionBufferSize(1))
+				sub := table.Subscribe()
+				for i := 0; i < 10; i++ {
+					table.AddPeer(newPeerWithAddress())
+				}
+				Expect(table.NumPeers()).To(Equal(10))
+				Expect(sub).To(HaveLen(1))
+			})
+		})
+
+		Context("when unsubscribing", func() {
+			It("should close the channel", func() {
+				table, _ := initDHT()
+				sub := table.Subscribe()
+				table.Unsubscribe(sub)
+				Expect(sub).To(BeClosed())
+
+				// Changes after unsubscribing must not panic.
+				table.AddPeer(newPeerWithAddress())
+			})
+		})
+	})
+
+	Describe("Address conflicts", func() {
+		Context("when different peers claim the same address", func() {
+			It("should accept the peers and report the conflict", func() {
+				table, _ := initDHT()
+				sub := table.Subscribe()
+
+				sig1, addr := newPeerWithAddress()
+				sig2, _ := newPeerWithAddress()
+				table.AddPeer(sig1, addr)
+				Expect(table.AddressConflicts()).To(BeEmpty())
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeAdded, Signatory: sig1, Address: addr}))
+
+				table.AddPeer(sig2, addr)
+				Expect(<-sub).To(Equal(dht.Change{Type: dht.ChangeConflict, Signatory: sig2, Address: addr}))
+				_, ok := table.PeerAddress(sig2)
+				Expect(ok).To(BeTrue())
+
+				conflicts := table.AddressConflicts()
+				Expect(conflicts).To(HaveLen(1))
+				Expect(conflicts[0].Address.Value).To(Equal(addr.Value))
+				Expect(conflicts[0].Signatories).To(ConsistOf(sig1, sig2))
+
+				// The conflict is resolved when one of the peers moves to a
+				// different address.
+				table.AddPeer(sig2, wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", addr.Nonce+1))
+				Expect(table.AddressConflicts()).To(BeEmpty())
+			})
+
+			It("should reject the newer claim when configured to do so", func() {
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithConflictPolicy(dht.ConflictReject))
+
+				sig1, addr := newPeerWithAddress()
+				sig2, _ := newPeerWithAddress()
+				table.AddPeer(sig1, addr)
+				table.AddPeer(sig2, addr)
+				_, ok := table.PeerAddress(sig2)
+				Expect(ok).To(BeFalse())
+
+				conflicts := table.AddressConflicts()
+				Expect(conflicts).To(HaveLen(1))
+				Expect(conflicts[0].Signatories).To(ConsistOf(sig1, sig2))
+
+				// Re-inserting the original claim is not a conflict.
+				table.AddPeer(sig1, addr)
+				Expect(table.NumPeers()).To(Equal(1))
+
+				// Once the original claim is deleted, the address can be
+				// claimed again.
+				table.DeletePeer(sig1)
+				Expect(table.AddressConflicts()).To(BeEmpty())
+				table.AddPeer(sig2, addr)
+				_, ok = table.PeerAddress(sig2)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("should forget rejected claims that are too old, or too many", func() {
+				fake := clock.NewFake(time.Now())
+				opts := dht.DefaultInMemTableOptions().
+					WithClock(fake).
+					WithConflictPolicy(dht.ConflictReject).
+					WithRejectedClaimTTL(time.Minute).
+					WithMaxRejectedClaims(2)
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), opts)
+
+				sig1, addr := newPeerWithAddress()
+				table.AddPeer(sig1, addr)
+				rejected := []id.Signatory{}
+				for i := 0; i < 3; i++ {
+					sig, _ := newPeerWithAddress()
+					table.AddPeer(sig, addr)
+					rejected = append(rejected, sig)
+					fake.Advance(time.Second)
+				}
+
+				// Only the most recent rejected claims are remembered.
+				conflicts := table.AddressConflicts()
+				Expect(conflicts).To(HaveLen(1))
+				Expect(conflicts[0].Signatories).To(ConsistOf(sig1, rejected[1], rejected[2]))
+
+				// Rejected claims are forgotten once they are too old.
+				fake.Advance(time.Minute)
+				Expect(table.AddressConflicts()).To(BeEmpty())
+			})
+		})
+
+		Context("when there are many conflicts", func() {
+			It("should return them in a stable order", func() {
+				table, _ := initDHT()
+
+				for i := 0; i < 10; i++ {
+					addr := wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("172.16.254.%v:3000", 10-i), wire.NewNonce())
+					for j := 0; j < 3; j++ {
+						table.AddPeer(id.NewPrivKey().Signatory(), addr)
+					}
+				}
+
+				conflicts := table.AddressConflicts()
+				Expect(conflicts).To(HaveLen(10))
+				Expect(sort.SliceIsSorted(conflicts, func(i, j int) bool {
+					return conflicts[i].Address.Value < conflicts[j].Address.Value
+				})).To(BeTrue())
+				for _, conflict := range conflicts {
+					Expect(sort.SliceIsSorted(conflict.Signatories, func(i, j int) bool {
+						return string(conflict.Signatories[i][:]) < string(conflict.Signatories[j][:])
+					})).To(BeTrue())
+				}
+				Expect(table.AddressConflicts()).To(Equal(conflicts))
+			})
+		})
+
+		Context("when different peers claim differently formatted IPv6 addresses", func() {
+			It("should detect the conflict and keep the zone", func() {
+				table, _ := initDHT()
+
+				sig1, sig2 := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				addr1 := wire.NewUnsignedAddress(wire.TCP, "[fe80::1%eth0]:3333", wire.NewNonce())
+				addr2 := wire.NewUnsignedAddress(wire.TCP, "[FE80:0:0::1%eth0]:3333", wire.NewNonce())
+				table.AddPeer(sig1, addr1)
+				table.AddPeer(sig2, addr2)
+				Expect(table.AddressConflicts()).To(HaveLen(1))
+
+				// The same IP address on a different interface is a different
+				// address.
+				table.AddPeer(sig2, wire.NewUnsignedAddress(wire.TCP, "[fe80::1%eth1]:3333", wire.NewNonce()))
+				Expect(table.AddressConflicts()).To(BeEmpty())
+
+				addr, ok := table.PeerAddress(sig1)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Value).To(Equal("[fe80::1%eth0]:3333"))
+			})
+		})
+	})
+
+	Describe("Aliases", func() {
+		Context("when a peer rotates its signatory", func() {
+			It("should move the address to the current signatory", func() {
+				table, _ := initDHT()
+
+				previous, addr := newPeerWithAddress()
+				current := id.NewPrivKey().Signatory()
+				table.AddPeer(previous, addr)
+				Expect(table.AddAlias(previous, current)).To(BeTrue())
+
+				alias, ok := table.Alias(previous)
+				Expect(ok).To(BeTrue())
+				Expect(alias).To(Equal(current))
+				_, ok = table.PeerAddress(previous)
+				Expect(ok).To(BeFalse())
+				currentAddr, ok := table.PeerAddress(current)
+				Expect(ok).To(BeTrue())
+				Expect(currentAddr).To(Equal(addr))
+				Expect(table.NumPeers()).To(Equal(1))
+			})
+		})
+
+		Context("when a peer rotates its signatory more than once", func() {
+			It("should alias every previous signatory to the latest one", func() {
+				table, _ := initDHT()
+
+				first, addr := newPeerWithAddress()
+				second, third := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				table.AddPeer(first, addr)
+				Expect(table.AddAlias(first, second)).To(BeTrue())
+				Expect(table.AddAlias(second, third)).To(BeTrue())
+
+				for _, previous := range []id.Signatory{first, second} {
+					alias, ok := table.Alias(previous)
+					Expect(ok).To(BeTrue())
+					Expect(alias).To(Equal(third))
+				}
+			})
+		})
+
+		Context("when the previous signatory is not in the table", func() {
+			It("should not record the alias", func() {
+				table, _ := initDHT()
+
+				previous, current := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				Expect(table.AddAlias(previous, current)).To(BeFalse())
+				_, ok := table.Alias(previous)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when the current signatory is deleted", func() {
+			It("should delete the alias", func() {
+				table, _ := initDHT()
+
+				previous, addr := newPeerWithAddress()
+				current := id.NewPrivKey().Signatory()
+				table.AddPeer(previous, addr)
+				table.AddAlias(previous, current)
+				table.DeletePeer(current)
+
+				_, ok := table.Alias(previous)
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Closest peers", func() {
+		Context("when querying the closest peers to a key", func() {
+			It("should return the peers in order of their distance from the key", func() {
+				table, _ := initDHT()
+				sigs := make([]id.Signatory, 20)
+				for i := range sigs {
+					sig, addr := newPeerWithAddress()
+					table.AddPeer(sig, addr)
+					sigs[i] = sig
+				}
+
+				key := id.NewHash([]byte("key"))
+				dhtutil.SortSignatories(id.Signatory(key), sigs)
+				Expect(table.ClosestPeers(key, 5)).To(Equal(sigs[:5]))
+				Expect(table.ClosestPeers(key, 100)).To(Equal(sigs))
+				Expect(table.ClosestPeers(key, 0)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Sweeping expiries", func() {
+		Context("when expiries are added at the same time", func() {
+			It("should spread them across a window", func() {
+				fake := clock.NewFake(time.Now())
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithExpiryJitter(0.5).WithClock(fake))
+				for i := 0; i < 100; i++ {
+					sig, addr := newPeerWithAddress()
+					table.AddPeer(sig, addr)
+					table.AddExpiry(sig, 10*time.Second)
+				}
+
+				// No peer expires before its duration.
+				fake.Advance(10 * time.Second)
+				Expect(table.SweepExpired()).To(BeEmpty())
+
+				// The peers expire over the jitter window, instead of all at
+				// once.
+				total := 0
+				for i := 0; i < 5; i++ {
+					fake.Advance(time.Second)
+					n := len(table.SweepExpired())
+					Expect(n).To(BeNumerically("<", 50))
+					total += n
+				}
+				Expect(total).To(Equal(100))
+				Expect(table.NumPeers()).To(Equal(0))
+				Expect(table.Stats().Expired).To(Equal(uint64(100)))
+			})
+		})
+
+		Context("when there is no jitter", func() {
+			It("should expire all peers together", func() {
+				fake := clock.NewFake(time.Now())
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithClock(fake))
+				for i := 0; i < 10; i++ {
+					sig, addr := newPeerWithAddress()
+					table.AddPeer(sig, addr)
+					table.AddExpiry(sig, 10*time.Second)
+				}
+
+				fake.Advance(10 * time.Second)
+				Expect(table.SweepExpired()).To(BeEmpty())
+				fake.Advance(time.Millisecond)
+				Expect(table.SweepExpired()).To(HaveLen(10))
+			})
+		})
+
+		Context("when running the sweeper", func() {
+			It("should periodically remove expired peers", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithExpiryJitter(0.1))
+				sig, addr := newPeerWithAddress()
+				table.AddPeer(sig, addr)
+				table.AddExpiry(sig, 10*time.Millisecond)
+				go table.RunSweeper(ctx, 10*time.Millisecond)
+
+				Eventually(table.NumPeers).Should(Equal(0))
+			})
+
+			It("should sweep on the clock of the table", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				fake := clock.NewFake(time.Now())
+				table := dht.NewInMemTableWithOptions(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithClock(fake))
+				sig, addr := newPeerWithAddress()
+				table.AddPeer(sig, addr)
+				table.AddExpiry(sig, time.Second)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					table.RunSweeper(ctx, time.Minute)
+				}()
+
+				Consistently(table.NumPeers, 100*time.Millisecond).Should(Equal(1))
+				fake.Advance(time.Minute)
+				Eventually(table.NumPeers).Should(Equal(0))
+				cancel()
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("when the expiry jitter is not between zero and one", func() {
+			It("should return an error", func() {
+				for _, jitter := range []float64{-0.1, 1.1, math.NaN()} {
+					_, err := dht.NewInMemTableValidated(id.NewPrivKey().Signatory(), dht.DefaultInMemTableOptions().WithExpiryJitter(jitter))
+					Expect(errors.Is(err, dht.ErrInvalidInMemTableOptions)).To(BeTrue())
+				}
+				for _, jitter := range []float64{0, 0.5, 1} {
+					Expect(dht.DefaultInMemTableOptions().WithExpiryJitter(jitter).Validate()).To(Succeed())
+				}
+			})
+		})
+	})
 })
 
 func initDHT() (dht.Table, id.Signatory) {
@@ -396,3 +974,9 @@ func initDHT() (dht.Table, id.Signatory) {
 	identity := id.NewSignatory((*id.PubKey)(&privKey.PublicKey))
 	return dht.NewInMemTable(identity), identity
 }
+
+func newPeerWithAddress() (id.Signatory, wire.Address) {
+	privKey := id.NewPrivKey()
+	addr := wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("172.16.254.1:%v", 1024+rand.Intn(60000)), uint64(time.Now().UnixNano()))
+	return privKey.Signatory(), addr
+}
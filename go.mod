@@ -10,5 +10,6 @@ require (
 	github.com/muirglacier/surge v1.2.8
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.16.0
+	golang.org/x/sys v0.0.0-20210112080510-489259a85091
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
@@ -0,0 +1,146 @@
+package handshake
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrAuthentication is returned by an Authenticate Handshake when the remote
+// peer cannot prove that it holds the private key of the signatory that it
+// claimed during the wrapped Handshake.
+var ErrAuthentication = errors.New("authentication failed")
+
+const (
+	authNonceSize     = 32
+	authSignatureSize = 65
+	authOverhead      = 16
+)
+
+var authDomain = []byte("aw/handshake/authenticate")
+
+// Authenticate returns a Handshake that runs the wrapped Handshake, and then
+// requires both peers to sign a transcript of the session using their
+// long-term private keys. The transcript contains a random challenge from each
+// peer, and the signatories of both peers. It is exchanged using the encoder
+// and decoder returned by the wrapped Handshake, so the signatures are bound
+// to the session key. If the remote signature was not produced by the
+// signatory returned from the wrapped Handshake, then ErrAuthentication is
+// returned. This prevents a man-in-the-middle from substituting its own keys
+// for the keys of the remote peer.
+func Authenticate(privKey *id.PrivKey, h Handshake) Handshake {
+	return AuthenticateWithKeys(NewInMemKeys(privKey), 0, h)
+}
+
+// AuthenticateWithKeys returns a Handshake that is the same as Authenticate, but
+// signs using the Keys. Signing is bounded by the timeout, so that remote Keys
+// (such as an HSM, or a KMS) cannot stall the handshake. If the timeout is
+// zero, or less, then signing is not bounded.
+func AuthenticateWithKeys(keys Keys, timeout time.Duration, h Handshake) Handshake {
+	return AuthenticateWithRand(keys, timeout, nil, h)
+}
+
+// AuthenticateWithRand returns a Handshake that is the same as
+// AuthenticateWithKeys, but reads the challenge from the source of randomness.
+// If the source is nil, then crypto/rand.Reader is used. A remote peer that can
+// predict the challenge can ask for its signature in advance, so the source
+// must meet the same requirements as the one given to ECIESWithRand.
+func AuthenticateWithRand(keys Keys, timeout time.Duration, random io.Reader, h Handshake) Handshake {
+	random = randOrDefault(random)
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+		self := id.NewSignatory(keys.PubKey())
+
+		ctx, cancel := keysContext(timeout)
+		defer cancel()
+
+		localNonce := [authNonceSize]byte{}
+		if _, err := io.ReadFull(random, localNonce[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate auth nonce: %v", err)
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+
+		// Channel for passing the remote nonce to the writing goroutine.
+		remoteNonceCh := make(chan []byte, 1)
+		defer close(remoteNonceCh)
+
+		go func() {
+			defer close(errCh)
+
+			if _, err := enc(conn, localNonce[:]); err != nil {
+				errCh <- fmt.Errorf("write auth nonce: %v", err)
+				return
+			}
+			remoteNonce, ok := <-remoteNonceCh
+			if !ok {
+				return
+			}
+			transcript := authTranscript(remoteNonce, localNonce[:], self, remote)
+			signature, err := keys.Sign(ctx, &transcript)
+			if err != nil {
+				errCh <- fmt.Errorf("sign auth transcript: %w", err)
+				return
+			}
+			if _, err := enc(conn, signature[:]); err != nil {
+				errCh <- fmt.Errorf("write auth signature: %v", err)
+				return
+			}
+		}()
+
+		remoteNonce := [authNonceSize + authOverhead]byte{}
+		if _, err := dec(conn, remoteNonce[:authNonceSize]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read auth nonce: %w", err)
+		}
+		remoteNonceCh <- remoteNonce[:authNonceSize]
+
+		remoteSignatureBuf := [authSignatureSize + authOverhead]byte{}
+		if _, err := dec(conn, remoteSignatureBuf[:authSignatureSize]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read auth signature: %w", err)
+		}
+
+		// Wait for the writing goroutine to end, so that the caller has
+		// exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, id.Signatory{}, err
+		}
+
+		remoteSignature := id.Signature{}
+		copy(remoteSignature[:], remoteSignatureBuf[:authSignatureSize])
+		transcript := authTranscript(localNonce[:], remoteNonce[:authNonceSize], remote, self)
+		signatory, err := remoteSignature.Signatory(&transcript)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: recover signatory: %v", ErrAuthentication, err)
+		}
+		if !signatory.Equal(&remote) {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: expected %v, got %v", ErrAuthentication, remote, signatory)
+		}
+		return enc, dec, remote, nil
+	})
+}
+
+// authTranscript returns the hash that is signed by the signer to prove that it
+// holds the private key of its signatory. The challenge is the nonce generated
+// by the verifier.
+func authTranscript(challenge, nonce []byte, signer, verifier id.Signatory) id.Hash {
+	hasher := sha256.New()
+	hasher.Write(authDomain)
+	hasher.Write(challenge)
+	hasher.Write(nonce)
+	hasher.Write(signer[:])
+	hasher.Write(verifier[:])
+	transcript := id.Hash{}
+	copy(transcript[:], hasher.Sum(nil))
+	return transcript
+}
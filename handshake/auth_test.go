@@ -0,0 +1,75 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authenticate", func() {
+	run := func(h1, h2 handshake.Handshake) (error, error) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			errCh <- err
+		}()
+		_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		if err != nil {
+			// Unblock the other side of the handshake.
+			conn1.Close()
+		}
+		return err, <-errCh
+	}
+
+	// claim returns a Handshake that does not verify anything, and claims
+	// that the remote peer is the given signatory.
+	claim := func(remote id.Signatory) handshake.Handshake {
+		return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+			return enc, dec, remote, nil
+		}
+	}
+
+	Context("when both peers hold the private keys of their signatories", func() {
+		It("should succeed", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			err1, err2 := run(
+				handshake.Authenticate(privKey1, handshake.ECIES(privKey1)),
+				handshake.Authenticate(privKey2, handshake.ECIES(privKey2)),
+			)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when the remote peer substitutes its own key", func() {
+		It("should return an authentication error", func() {
+			privKey := id.NewPrivKey()
+			victim := id.NewPrivKey().Signatory()
+			attacker := id.NewPrivKey()
+
+			// The local peer has been tricked into believing that it is
+			// talking to the victim, but it is actually talking to the
+			// attacker (who does not hold the private key of the victim).
+			err1, _ := run(
+				handshake.Authenticate(privKey, claim(victim)),
+				handshake.Authenticate(attacker, claim(privKey.Signatory())),
+			)
+			Expect(errors.Is(err1, handshake.ErrAuthentication)).To(BeTrue())
+		})
+	})
+})
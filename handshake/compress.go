@@ -0,0 +1,84 @@
+package handshake
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// Compress returns a Handshake that negotiates the Compression used by the
+// connection after running the wrapped Handshake. Both peers write the set of
+// Compressions that they support using the encoder returned by the wrapped
+// Handshake, and then pick the greatest Compression that is supported by both
+// peers. If there is no overlap, then CompressionNone is used, so peers that do
+// not support compression can still connect. The negotiated Compression is
+// passed to the onNegotiated function, if there is one, and is used to wrap
+// the returned encoder and decoder. Both peers must use a Compress Handshake,
+// even if they do not support any compression.
+func Compress(supported []codec.Compression, onNegotiated func(remote id.Signatory, c codec.Compression), h Handshake) Handshake {
+	return CompressWithOptions(supported, codec.DefaultCompressionOptions(), onNegotiated, h)
+}
+
+// CompressWithOptions is the same as Compress, but the returned encoder
+// compresses data according to the options. The options do not need to be the
+// same for both peers.
+func CompressWithOptions(supported []codec.Compression, opts codec.CompressionOptions, onNegotiated func(remote id.Signatory, c codec.Compression), h Handshake) Handshake {
+	localSet := compressionSet(supported)
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return nil, nil, remote, err
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+			if _, err := enc(conn, []byte{localSet}); err != nil {
+				errCh <- fmt.Errorf("write compressions: %v", err)
+			}
+		}()
+
+		// The buffer has extra capacity for decoders, such as the GCMDecoder,
+		// that decode into the capacity beyond the length of the buffer.
+		remoteSet := [128]byte{}
+		if _, err := dec(conn, remoteSet[:1]); err != nil {
+			return nil, nil, remote, fmt.Errorf("read compressions: %w", err)
+		}
+		if err, ok := <-errCh; ok {
+			return nil, nil, remote, err
+		}
+
+		c := negotiateCompression(localSet & remoteSet[0])
+		if onNegotiated != nil {
+			onNegotiated(remote, c)
+		}
+		return codec.CompressionEncoderWithOptions(c, opts, enc), codec.CompressionDecoder(c, dec), remote, nil
+	})
+}
+
+// compressionSet returns a bitmask where the i-th bit is set if the i-th
+// Compression is supported. CompressionNone is always supported, and unknown
+// Compressions are ignored.
+func compressionSet(supported []codec.Compression) byte {
+	set := byte(1) << codec.CompressionNone
+	for _, c := range supported {
+		if c <= codec.CompressionFlate {
+			set |= 1 << c
+		}
+	}
+	return set
+}
+
+// negotiateCompression returns the greatest Compression in the bitmask.
+func negotiateCompression(set byte) codec.Compression {
+	for c := codec.CompressionFlate; c > codec.CompressionNone; c-- {
+		if set&(1<<c) != 0 {
+			return c
+		}
+	}
+	return codec.CompressionNone
+}
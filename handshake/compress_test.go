@@ -0,0 +1,83 @@
+package handshake_test
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compress", func() {
+	run := func(supported1, supported2 []codec.Compression) (codec.Compression, codec.Compression) {
+		privKey1 := id.NewPrivKey()
+		privKey2 := id.NewPrivKey()
+		negotiated1, negotiated2 := make(chan codec.Compression, 1), make(chan codec.Compression, 1)
+		h1 := handshake.Compress(supported1, func(_ id.Signatory, c codec.Compression) { negotiated1 <- c }, handshake.ECIES(privKey1))
+		h2 := handshake.Compress(supported2, func(_ id.Signatory, c codec.Compression) { negotiated2 <- c }, handshake.ECIES(privKey2))
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		data := bytes.Repeat([]byte("hello "), 500)
+		errCh := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			enc, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err == nil {
+				_, err = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)(conn2, data)
+			}
+			errCh <- err
+		}()
+		_, dec, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Messages must be readable, no matter what was negotiated.
+		buf := make([]byte, 4096)
+		n, err := codec.LengthPrefixDecoder(codec.PlainDecoder, dec)(conn1, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf[:n]).To(Equal(data))
+		Expect(<-errCh).ToNot(HaveOccurred())
+
+		return <-negotiated1, <-negotiated2
+	}
+
+	flate := []codec.Compression{codec.CompressionFlate}
+
+	Context("when both peers support compression", func() {
+		It("should negotiate compression", func() {
+			c1, c2 := run(flate, flate)
+			Expect(c1).To(Equal(codec.CompressionFlate))
+			Expect(c2).To(Equal(codec.CompressionFlate))
+		})
+	})
+
+	Context("when only the local peer supports compression", func() {
+		It("should fall back to no compression", func() {
+			c1, c2 := run(flate, nil)
+			Expect(c1).To(Equal(codec.CompressionNone))
+			Expect(c2).To(Equal(codec.CompressionNone))
+		})
+	})
+
+	Context("when only the remote peer supports compression", func() {
+		It("should fall back to no compression", func() {
+			c1, c2 := run(nil, flate)
+			Expect(c1).To(Equal(codec.CompressionNone))
+			Expect(c2).To(Equal(codec.CompressionNone))
+		})
+	})
+
+	Context("when neither peer supports compression", func() {
+		It("should not compress", func() {
+			c1, c2 := run(nil, nil)
+			Expect(c1).To(Equal(codec.CompressionNone))
+			Expect(c2).To(Equal(codec.CompressionNone))
+		})
+	})
+})
@@ -2,12 +2,14 @@ package handshake
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/ecies"
@@ -18,8 +20,40 @@ import (
 const sizeOfSecretKey = 32
 const sizeOfEncryptedSecretKey = 145 // 113-byte encryption header + 32-byte secret key
 
+// ECIES returns a Handshake that establishes an encrypted session, using a
+// private key that is kept in memory. See ECIESWithKeys for more details.
 func ECIES(privKey *id.PrivKey) Handshake {
-	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+	return ECIESWithKeys(NewInMemKeys(privKey), 0)
+}
+
+// ECIESWithKeys returns a Handshake that establishes an encrypted session.
+// Both peers exchange public keys, and then exchange secret keys that are
+// encrypted using ECIES. Each peer proves that it can decrypt using the Keys
+// by returning the secret key of the other peer. The session key is the XOR of
+// both secret keys, and application keys can be derived from it by wrapping
+// the Handshake in an Export Handshake. All Keys operations in one handshake
+// are bounded by the timeout, so that remote Keys (such as an HSM, or a KMS)
+// cannot stall the handshake. If the timeout is zero, or less, then the
+// operations are not bounded.
+func ECIESWithKeys(keys Keys, timeout time.Duration) Handshake {
+	return ECIESWithRand(keys, timeout, nil)
+}
+
+// ECIESWithRand returns a Handshake that is the same as ECIESWithKeys, but
+// reads the secret key, and the ephemeral keys used for encryption, from the
+// source of randomness. If the source is nil, then crypto/rand.Reader is used.
+//
+// The source of randomness is security-sensitive. Anyone that can predict it
+// can recover the session key, and decrypt the session. It must only be set to
+// a cryptographically secure source (for example, a vetted RNG that is
+// required for compliance), or to a deterministic source in tests. The source
+// must be safe for concurrent use if the Handshake is run concurrently.
+func ECIESWithRand(keys Keys, timeout time.Duration, random io.Reader) Handshake {
+	random = randOrDefault(random)
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		ctx, cancel := keysContext(timeout)
+		defer cancel()
+
 		// Channel for passing errors from the writing goroutine to the reading
 		// goroutine (which has the ability to return the error).
 		errCh := make(chan error, 1)
@@ -34,16 +68,19 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		remoteSecretKeyCh := make(chan []byte, 1)
 		defer close(remoteSecretKeyCh)
 
-		// A pointer to the pubKey contained in the privKey struct
-		localPubKey := privKey.PubKey()
+		localPubKey := keys.PubKey()
 
 		// Generate a local secret key. We do it here, because it is needed by
 		// the writing and reading goroutine.
 		localSecretKey := [sizeOfSecretKey]byte{}
-		if _, err := rand.Read(localSecretKey[:]); err != nil {
+		if _, err := io.ReadFull(random, localSecretKey[:]); err != nil {
 			return nil, nil, id.Signatory{}, fmt.Errorf("generate local secret key: %v", err)
 		}
 
+		// Channel that is closed once the start of the local pubkey has been
+		// written, or has failed to be written.
+		wrotePubKeyX := make(chan struct{})
+
 		// Begin background goroutine for writing information to the network
 		// connection.
 		go func() {
@@ -53,12 +90,14 @@ func ECIES(privKey *id.PrivKey) Handshake {
 			// its secret key and send it back to the local peer.
 			xBuf := paddedTo32(localPubKey.X)
 			yBuf := paddedTo32(localPubKey.Y)
-			if _, err := conn.Write(xBuf[:]); err != nil {
-				errCh <- fmt.Errorf("write local pubkey x: %v", err)
+			_, err := conn.Write(xBuf[:])
+			close(wrotePubKeyX)
+			if err != nil {
+				errCh <- fmt.Errorf("write local pubkey x: %w", err)
 				return
 			}
 			if _, err := conn.Write(yBuf[:]); err != nil {
-				errCh <- fmt.Errorf("write local pubkey y: %v", err)
+				errCh <- fmt.Errorf("write local pubkey y: %w", err)
 				return
 			}
 
@@ -69,13 +108,13 @@ func ECIES(privKey *id.PrivKey) Handshake {
 				return
 			}
 			importedRemotePubKey := ecies.ImportECDSAPublic((*ecdsa.PublicKey)(&remotePubKey))
-			encryptedLocalSecretKey, err := ecies.Encrypt(rand.Reader, importedRemotePubKey, localSecretKey[:], nil, nil)
+			encryptedLocalSecretKey, err := ecies.Encrypt(random, importedRemotePubKey, localSecretKey[:], nil, nil)
 			if err != nil {
 				errCh <- fmt.Errorf("encrypt local secret key: %v", err)
 				return
 			}
 			if _, err := conn.Write(encryptedLocalSecretKey); err != nil {
-				errCh <- fmt.Errorf("write local secret key: %v", err)
+				errCh <- fmt.Errorf("write local secret key: %w", err)
 				return
 			}
 
@@ -87,21 +126,34 @@ func ECIES(privKey *id.PrivKey) Handshake {
 			if !ok {
 				return
 			}
-			encryptedRemoteSecretKey, err := ecies.Encrypt(rand.Reader, importedRemotePubKey, remoteSecretKey, nil, nil)
+			encryptedRemoteSecretKey, err := ecies.Encrypt(random, importedRemotePubKey, remoteSecretKey, nil, nil)
 			if err != nil {
 				errCh <- fmt.Errorf("encrypt remote secret key: %v", err)
 				return
 			}
 			if _, err := conn.Write(encryptedRemoteSecretKey); err != nil {
-				errCh <- fmt.Errorf("write remote secret key: %v", err)
+				errCh <- fmt.Errorf("write remote secret key: %w", err)
 				return
 			}
 		}()
 
 		// Read the remote pubkey.
 		remotePubKeyBuf := [64]byte{}
-		if _, err := io.ReadFull(conn, remotePubKeyBuf[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read remote pubkey: %v", err)
+		// The start is read first, so that a remote peer using an Insecure
+		// Handshake is recognised before waiting for the rest of the pubkey
+		// (which it will never write).
+		if _, err := io.ReadFull(conn, remotePubKeyBuf[:len(insecureMagic)]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read remote pubkey: %w", err)
+		}
+		if isInsecureMagic(remotePubKeyBuf[:]) {
+			// Wait for the start of the pubkey to be written, so that the
+			// remote peer can recognise the mismatch too, before the
+			// connection is closed.
+			<-wrotePubKeyX
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: remote peer is insecure", ErrInsecureMismatch)
+		}
+		if _, err := io.ReadFull(conn, remotePubKeyBuf[len(insecureMagic):]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read remote pubkey: %w", err)
 		}
 		remotePubKey := id.PubKey{
 			Curve: crypto.S256(),
@@ -113,11 +165,11 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		// Read the encrypted remote secret key, and then decrypt it.
 		encryptedRemoteSecretKey := [sizeOfEncryptedSecretKey]byte{}
 		if _, err := io.ReadFull(conn, encryptedRemoteSecretKey[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read remote secret key: %v", err)
+			return nil, nil, id.Signatory{}, fmt.Errorf("read remote secret key: %w", err)
 		}
-		remoteSecretKey, err := ecies.ImportECDSA((*ecdsa.PrivateKey)(privKey)).Decrypt(encryptedRemoteSecretKey[:], nil, nil)
+		remoteSecretKey, err := keys.Decrypt(ctx, encryptedRemoteSecretKey[:])
 		if err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("decrypt remote secret key: %v", err)
+			return nil, nil, id.Signatory{}, decryptError(fmt.Errorf("decrypt remote secret key: %w", err))
 		}
 		remoteSecretKeyCh <- remoteSecretKey
 
@@ -126,14 +178,14 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		// previously asserted pubkey.
 		encryptedLocalSecretKeyCheck := [sizeOfEncryptedSecretKey]byte{}
 		if _, err := io.ReadFull(conn, encryptedLocalSecretKeyCheck[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read local secret key: %v", err)
+			return nil, nil, id.Signatory{}, fmt.Errorf("read local secret key: %w", err)
 		}
-		localSecretKeyCheck, err := ecies.ImportECDSA((*ecdsa.PrivateKey)(privKey)).Decrypt(encryptedLocalSecretKeyCheck[:], nil, nil)
+		localSecretKeyCheck, err := keys.Decrypt(ctx, encryptedLocalSecretKeyCheck[:])
 		if err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("decrypt local secret key: %v", err)
+			return nil, nil, id.Signatory{}, decryptError(fmt.Errorf("decrypt local secret key: %w", err))
 		}
 		if !bytes.Equal(localSecretKey[:], localSecretKeyCheck[:]) {
-			return nil, nil, id.Signatory{}, fmt.Errorf("check local secret key")
+			return nil, nil, id.Signatory{}, authError(fmt.Errorf("check local secret key"))
 		}
 
 		// Check whether or not that an error happened in the writing goroutine
@@ -155,8 +207,20 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		if err != nil {
 			return nil, nil, id.Signatory{}, fmt.Errorf("establish gcm session: %v", err)
 		}
+		offerExporter(conn, func() *Exporter {
+			return newExporter(sessionKey[:], self, remote)
+		})
 		return codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), remote, nil
+	})
+}
+
+// decryptError classifies a failure to decrypt a secret key as a failure to
+// authenticate, unless the Keys timed out.
+func decryptError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: ErrorTimeout, Err: err}
 	}
+	return authError(err)
 }
 
 // paddedTo32 encodes a big integer as a big-endian into a 32-byte array. It
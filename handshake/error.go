@@ -0,0 +1,145 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrorKind classifies the reason that a Handshake failed.
+type ErrorKind uint8
+
+// Enumerate all ErrorKind values.
+const (
+	// ErrorOther is any failure that does not fit another ErrorKind.
+	ErrorOther ErrorKind = iota
+	// ErrorRemoteRejected is a failure caused by the remote peer deliberately
+	// rejecting the local peer. The Handshakes in this package cannot tell a
+	// rejection apart from a remote peer that has crashed, or a network
+	// connection that has dropped, so they never return it: a remote peer
+	// that hangs up during the Handshake is an ErrorNetwork. It is available
+	// to Handshakes that can detect a deliberate rejection.
+	ErrorRemoteRejected
+	// ErrorRejected is a failure caused by the local peer rejecting the remote
+	// peer (see Filter).
+	ErrorRejected
+	// ErrorAuthentication is a failure caused by the remote peer not proving
+	// its identity, or not agreeing on the cryptography or protocol that is
+	// used to prove it.
+	ErrorAuthentication
+	// ErrorTimeout is a failure caused by the Handshake not finishing in time.
+	ErrorTimeout
+	// ErrorNetwork is a failure caused by the network connection, including
+	// the remote peer hanging up (or resetting the network connection) during
+	// the Handshake.
+	ErrorNetwork
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case ErrorRemoteRejected:
+		return "remote rejected"
+	case ErrorRejected:
+		return "rejected"
+	case ErrorAuthentication:
+		return "authentication"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorNetwork:
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+// An Error is returned by a Handshake when it fails. The Kind allows callers
+// to react to different failures (for example, by backing off after
+// timeouts, but not re-dialing after being rejected), without inspecting the
+// wrapped error. The Remote is only known if the failure happened after the
+// remote peer revealed its identity.
+type Error struct {
+	Kind   ErrorKind
+	Remote id.Signatory
+	Err    error
+}
+
+// Error implements the error interface.
+func (err *Error) Error() string {
+	return fmt.Sprintf("handshake failed (%v): %v", err.Kind, err.Err)
+}
+
+// Unwrap returns the error that caused the Handshake to fail.
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Classify returns the ErrorKind of an error returned by a Handshake. If the
+// error wraps an Error, then its Kind is returned. Otherwise, the ErrorKind is
+// derived from the wrapped errors, checking for authentication failures, then
+// timeouts, and then network errors (including hang ups), in that order.
+// ErrorOther is returned if the error is nil, or does not match any of these.
+func Classify(err error) ErrorKind {
+	if err == nil {
+		return ErrorOther
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	switch {
+	case errors.Is(err, ErrAuthentication),
+		errors.Is(err, ErrInsecureMismatch),
+		errors.Is(err, ErrNetworkMismatch),
+		errors.Is(err, ErrNotTLS),
+		errors.Is(err, ErrTLSUnauthorized),
+		errors.Is(err, ErrNoPeerCertificates):
+		return ErrorAuthentication
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, io.ErrClosedPipe),
+		errors.As(err, &netErr):
+		return ErrorNetwork
+	}
+	return ErrorOther
+}
+
+// classify wraps the errors returned by a Handshake in an Error, unless they
+// already wrap one. Every Handshake in this package is wrapped, so that the
+// errors of all of them can be told apart by Kind.
+func classify(h Handshake) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err == nil {
+			return enc, dec, remote, nil
+		}
+		var e *Error
+		if errors.As(err, &e) {
+			return enc, dec, remote, err
+		}
+		return enc, dec, remote, &Error{Kind: Classify(err), Remote: remote, Err: err}
+	}
+}
+
+// authError returns an Error that classifies a failure to prove the identity
+// of the remote peer.
+func authError(err error) error {
+	return &Error{Kind: ErrorAuthentication, Err: err}
+}
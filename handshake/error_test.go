@@ -0,0 +1,167 @@
+package handshake_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	// run the Handshake against a remote peer that is simulated by the given
+	// function, and return the error of the Handshake.
+	run := func(h handshake.Handshake, remote func(net.Conn)) error {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		go remote(conn2)
+		_, _, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		return err
+	}
+
+	expectKind := func(err error, kind handshake.ErrorKind) {
+		Expect(err).To(HaveOccurred())
+		Expect(handshake.Classify(err)).To(Equal(kind))
+		var e *handshake.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Kind).To(Equal(kind))
+	}
+
+	Context("when the local peer rejects the remote peer", func() {
+		It("should classify the failure as rejected", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			errReject := errors.New("reject")
+			h := handshake.Filter(func(id.Signatory) error { return errReject }, handshake.ECIES(privKey1))
+			err := run(h, func(conn net.Conn) {
+				handshake.ECIES(privKey2)(conn, codec.PlainEncoder, codec.PlainDecoder)
+			})
+			expectKind(err, handshake.ErrorRejected)
+			Expect(errors.Is(err, errReject)).To(BeTrue())
+
+			var e *handshake.Error
+			Expect(errors.As(err, &e)).To(BeTrue())
+			Expect(e.Remote).To(Equal(privKey2.Signatory()))
+		})
+	})
+
+	Context("when the remote peer hangs up during the handshake", func() {
+		It("should classify the failure as a network failure", func() {
+			err := run(handshake.ECIES(id.NewPrivKey()), func(conn net.Conn) {
+				conn.Close()
+			})
+			expectKind(err, handshake.ErrorNetwork)
+		})
+
+		It("should classify the failure of handshakes that wrap other handshakes", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			h := handshake.Version(5, nil, handshake.ECIES(privKey1))
+			err := run(h, func(conn net.Conn) {
+				// Complete the wrapped handshake, and then hang up instead of
+				// writing the version.
+				handshake.ECIES(privKey2)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				conn.Close()
+			})
+			expectKind(err, handshake.ErrorNetwork)
+
+			var e *handshake.Error
+			Expect(errors.As(err, &e)).To(BeTrue())
+			Expect(e.Remote).To(Equal(privKey2.Signatory()))
+		})
+	})
+
+	Context("when the local peer rejects the metadata of the remote peer", func() {
+		It("should classify the failure as rejected", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			errReject := errors.New("reject")
+			h := handshake.Metadata(nil, 1024, func(id.Signatory, []byte) error { return errReject }, handshake.ECIES(privKey1))
+			err := run(h, func(conn net.Conn) {
+				handshake.Metadata([]byte("metadata"), 1024, nil, handshake.ECIES(privKey2))(conn, codec.PlainEncoder, codec.PlainDecoder)
+			})
+			expectKind(err, handshake.ErrorRejected)
+			Expect(errors.Is(err, errReject)).To(BeTrue())
+		})
+	})
+
+	Context("when the remote peer cannot prove its identity", func() {
+		It("should classify the failure as an authentication failure", func() {
+			err := run(handshake.ECIES(id.NewPrivKey()), func(conn net.Conn) {
+				// Claim the identity of a peer, and then send a secret key
+				// that is not encrypted for the local peer.
+				go io.Copy(ioutil.Discard, conn)
+				pubKey := id.NewPrivKey().PubKey()
+				buf := make([]byte, 64)
+				pubKey.X.FillBytes(buf[:32])
+				pubKey.Y.FillBytes(buf[32:])
+				conn.Write(buf)
+				conn.Write(make([]byte, 145))
+			})
+			expectKind(err, handshake.ErrorAuthentication)
+		})
+
+		It("should classify a failure to return the secret key of the local peer as an authentication failure", func() {
+			privKey := id.NewPrivKey()
+			err := run(handshake.ECIES(privKey), func(conn net.Conn) {
+				// Send a secret key that is encrypted for the local peer, but
+				// do not return the secret key of the local peer.
+				go io.Copy(ioutil.Discard, conn)
+				pubKey := id.NewPrivKey().PubKey()
+				buf := make([]byte, 64)
+				pubKey.X.FillBytes(buf[:32])
+				pubKey.Y.FillBytes(buf[32:])
+				conn.Write(buf)
+				encrypted, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic((*ecdsa.PublicKey)(privKey.PubKey())), make([]byte, 32), nil, nil)
+				if err != nil {
+					panic(err)
+				}
+				conn.Write(encrypted)
+				conn.Write(encrypted)
+			})
+			expectKind(err, handshake.ErrorAuthentication)
+		})
+	})
+
+	Context("when the remote peer does not respond in time", func() {
+		It("should classify the failure as a timeout", func() {
+			inner := handshake.ECIES(id.NewPrivKey())
+			h := func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+				conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+				return inner(conn, enc, dec)
+			}
+			err := run(h, func(conn net.Conn) {
+				go io.Copy(ioutil.Discard, conn)
+			})
+			expectKind(err, handshake.ErrorTimeout)
+		})
+	})
+
+	Context("when classifying errors that do not wrap an Error", func() {
+		It("should derive the kind from the wrapped errors", func() {
+			Expect(handshake.Classify(nil)).To(Equal(handshake.ErrorOther))
+			Expect(handshake.Classify(errors.New("unknown"))).To(Equal(handshake.ErrorOther))
+			Expect(handshake.Classify(fmt.Errorf("auth: %w", handshake.ErrAuthentication))).To(Equal(handshake.ErrorAuthentication))
+			Expect(handshake.Classify(fmt.Errorf("read: %w", io.EOF))).To(Equal(handshake.ErrorNetwork))
+			Expect(handshake.Classify(fmt.Errorf("read: %w", io.ErrUnexpectedEOF))).To(Equal(handshake.ErrorNetwork))
+			Expect(handshake.Classify(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})).To(Equal(handshake.ErrorNetwork))
+			Expect(handshake.Classify(&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE})).To(Equal(handshake.ErrorNetwork))
+			Expect(handshake.Classify(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH})).To(Equal(handshake.ErrorNetwork))
+			Expect(handshake.Classify(fmt.Errorf("read: %w", net.ErrClosed))).To(Equal(handshake.ErrorNetwork))
+
+			// Authentication failures are classified before network failures.
+			Expect(handshake.Classify(fmt.Errorf("%w: %v", handshake.ErrInsecureMismatch, io.EOF))).To(Equal(handshake.ErrorAuthentication))
+		})
+	})
+})
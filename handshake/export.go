@@ -0,0 +1,194 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrNoExporter is returned by an Export Handshake when the wrapped Handshake
+// does not establish a secret from which keys can be exported (for example, an
+// Insecure Handshake).
+var ErrNoExporter = errors.New("no exporter")
+
+// MaxExportedKeySize is the maximum number of bytes that an Exporter can
+// derive for one key.
+const MaxExportedKeySize = 255 * sha256.Size
+
+var exporterDomain = []byte("aw/handshake/exporter")
+
+// An Exporter derives application keys that are bound to the session of a
+// connection, in the style of a TLS exporter (RFC 5705). Both peers of a
+// session derive the same keys, and nobody else can. This lets applications
+// bind their own protocols to the connection (for example, by authenticating
+// higher-layer tokens with a key that is only valid for this session).
+//
+// The master secret of the session is never exposed. The Exporter only keeps a
+// key that is derived from it using HKDF (RFC 5869), and the session key used
+// to encrypt the connection cannot be recovered from the Exporter, or from the
+// keys that it derives.
+type Exporter struct {
+	prk [sha256.Size]byte
+}
+
+// newExporter returns an Exporter for the master secret of a session between
+// two peers. The order of the peers does not matter, so that both peers of a
+// session derive the same keys.
+func newExporter(secret []byte, peer1, peer2 id.Signatory) *Exporter {
+	if bytes.Compare(peer1[:], peer2[:]) > 0 {
+		peer1, peer2 = peer2, peer1
+	}
+	mac := hmac.New(sha256.New, exporterDomain)
+	mac.Write(secret)
+	mac.Write(peer1[:])
+	mac.Write(peer2[:])
+
+	e := &Exporter{}
+	copy(e.prk[:], mac.Sum(nil))
+	return e
+}
+
+// DeriveKey returns a key of the given length that is derived from the master
+// secret of the session. Keys are domain-separated by the label, so keys with
+// different labels (or lengths) are unrelated, and uses of the Exporter with
+// different labels never collide. Labels should be unique to the application
+// protocol that uses them (for example, "myapp/token/v1"). It panics if the
+// length is negative, or greater than MaxExportedKeySize.
+func (e *Exporter) DeriveKey(label string, length int) []byte {
+	if length < 0 || length > MaxExportedKeySize {
+		panic(fmt.Sprintf("derive key: expected 0<=length<=%v, got length=%v", MaxExportedKeySize, length))
+	}
+
+	// The info declares the length of the label, so that no label is a
+	// prefix of the info of another label.
+	info := make([]byte, 8+len(label))
+	binary.BigEndian.PutUint32(info, uint32(len(label)))
+	copy(info[4:], label)
+	binary.BigEndian.PutUint32(info[4+len(label):], uint32(length))
+
+	key := make([]byte, 0, length+sha256.Size)
+	block := []byte{}
+	for i := 1; len(key) < length; i++ {
+		mac := hmac.New(sha256.New, e.prk[:])
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{byte(i)})
+		block = mac.Sum(nil)
+		key = append(key, block...)
+	}
+	return key[:length]
+}
+
+// String implements the fmt.Stringer interface, without revealing anything
+// that is derived from the master secret.
+func (e *Exporter) String() string {
+	return "Exporter"
+}
+
+// Export returns a Handshake that runs the wrapped Handshake, and then passes
+// an Exporter for the session that it established to the onExported function.
+// Sessions are established by ECIES Handshakes, and by TLS connections (in
+// which case the Exporter is derived from the TLS exporter). If the wrapped
+// Handshake does not establish a session, then ErrNoExporter is returned. The
+// Handshakes that are wrapped must pass the connection along to the Handshake
+// that establishes the session as it is, instead of wrapping it.
+func Export(onExported func(remote id.Signatory, exporter *Exporter), h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		c, wrapped := newExportConn(conn)
+		enc, dec, remote, err := h(wrapped, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+		exporter := c.exporter
+		if exporter == nil {
+			if c, ok := conn.(tlsConn); ok {
+				state := c.ConnectionState()
+				secret, err := state.ExportKeyingMaterial(string(exporterDomain), nil, sha256.Size)
+				if err != nil {
+					return nil, nil, remote, fmt.Errorf("export tls keying material: %v", err)
+				}
+				exporter = newExporter(secret, id.Signatory{}, id.Signatory{})
+			}
+		}
+		if exporter == nil {
+			return nil, nil, remote, fmt.Errorf("%w: %T does not establish a session", ErrNoExporter, conn)
+		}
+		if onExported != nil {
+			onExported(remote, exporter)
+		}
+		return enc, dec, remote, nil
+	})
+}
+
+// exportConn is the connection that an Export Handshake passes to the
+// Handshake that it wraps. The Handshake that establishes the session (such as
+// an ECIES Handshake) offers its Exporter to the connection, so that the
+// Exporter is only ever handed to the Export Handshake that asked for it.
+// Handshakes between the two must pass the connection along as it is.
+type exportConn struct {
+	net.Conn
+	exporter *Exporter
+}
+
+// exportTLSConn is the exportConn of a TLS connection, so that the Handshakes
+// that it wraps can still use the state of the TLS connection.
+type exportTLSConn struct {
+	*exportConn
+	tls tlsConn
+}
+
+func (c exportTLSConn) Handshake() error {
+	return c.tls.Handshake()
+}
+
+func (c exportTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+// newExportConn wraps a connection in an exportConn, and returns it alongside
+// the connection that should be passed to the wrapped Handshake.
+func newExportConn(conn net.Conn) (*exportConn, net.Conn) {
+	c := &exportConn{Conn: conn}
+	if tc, ok := conn.(tlsConn); ok {
+		return c, exportTLSConn{exportConn: c, tls: tc}
+	}
+	return c, c
+}
+
+// asExportConn returns the exportConn of a connection, if it is one.
+func asExportConn(conn net.Conn) (*exportConn, bool) {
+	switch c := conn.(type) {
+	case *exportConn:
+		return c, true
+	case exportTLSConn:
+		return c.exportConn, true
+	default:
+		return nil, false
+	}
+}
+
+// offerExporter for the session of a connection. The newExporter function is
+// only called if the connection belongs to an Export Handshake.
+func offerExporter(conn net.Conn, newExporter func() *Exporter) {
+	if c, ok := asExportConn(conn); ok {
+		c.exporter = newExporter()
+	}
+}
+
+// unwrapConn returns the connection that was passed to an Export Handshake, if
+// the connection belongs to one, so that it can be compared with the
+// connections that are known outside of the Handshake.
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := asExportConn(conn); ok {
+		return c.Conn
+	}
+	return conn
+}
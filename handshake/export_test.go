@@ -0,0 +1,155 @@
+package handshake_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	// connect a pair of peers using the given Handshakes, each wrapped in an
+	// Export Handshake, and return their Exporters.
+	connect := func(h1, h2 handshake.Handshake) (*handshake.Exporter, *handshake.Exporter, error, error) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		var exporter1, exporter2 *handshake.Exporter
+		h1 = handshake.Export(func(_ id.Signatory, e *handshake.Exporter) { exporter1 = e }, h1)
+		h2 = handshake.Export(func(_ id.Signatory, e *handshake.Exporter) { exporter2 = e }, h2)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			errCh <- err
+		}()
+		_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		return exporter1, exporter2, err, <-errCh
+	}
+
+	connectECIES := func() (*handshake.Exporter, *handshake.Exporter) {
+		exporter1, exporter2, err1, err2 := connect(handshake.ECIES(id.NewPrivKey()), handshake.ECIES(id.NewPrivKey()))
+		Expect(err1).ToNot(HaveOccurred())
+		Expect(err2).ToNot(HaveOccurred())
+		Expect(exporter1).ToNot(BeNil())
+		Expect(exporter2).ToNot(BeNil())
+		return exporter1, exporter2
+	}
+
+	Context("when both peers of a session derive a key", func() {
+		It("should derive the same key", func() {
+			exporter1, exporter2 := connectECIES()
+			for _, length := range []int{0, 1, 32, 33, 100, handshake.MaxExportedKeySize} {
+				key := exporter1.DeriveKey("test", length)
+				Expect(key).To(HaveLen(length))
+				Expect(exporter2.DeriveKey("test", length)).To(Equal(key))
+			}
+		})
+	})
+
+	Context("when deriving keys with different labels", func() {
+		It("should derive unrelated keys", func() {
+			exporter, _ := connectECIES()
+			Expect(exporter.DeriveKey("a", 32)).ToNot(Equal(exporter.DeriveKey("b", 32)))
+			Expect(exporter.DeriveKey("a", 32)).ToNot(Equal(exporter.DeriveKey("a\x00", 32)))
+			Expect(exporter.DeriveKey("a", 64)[:32]).ToNot(Equal(exporter.DeriveKey("a", 32)))
+		})
+	})
+
+	Context("when deriving keys for different sessions", func() {
+		It("should derive unrelated keys", func() {
+			exporter1, _ := connectECIES()
+			exporter2, _ := connectECIES()
+			Expect(exporter1.DeriveKey("test", 32)).ToNot(Equal(exporter2.DeriveKey("test", 32)))
+		})
+	})
+
+	Context("when formatting an exporter", func() {
+		It("should not reveal the secret", func() {
+			exporter, _ := connectECIES()
+			Expect(fmt.Sprintf("%v", exporter)).To(Equal("Exporter"))
+		})
+	})
+
+	Context("when deriving a key of an invalid length", func() {
+		It("should panic", func() {
+			exporter, _ := connectECIES()
+			Expect(func() { exporter.DeriveKey("test", -1) }).To(Panic())
+			Expect(func() { exporter.DeriveKey("test", handshake.MaxExportedKeySize+1) }).To(Panic())
+		})
+	})
+
+	Context("when the wrapped handshake does not establish a session", func() {
+		It("should return an error", func() {
+			exporter1, exporter2, err1, err2 := connect(handshake.Insecure(id.NewPrivKey().Signatory()), handshake.Insecure(id.NewPrivKey().Signatory()))
+			Expect(errors.Is(err1, handshake.ErrNoExporter)).To(BeTrue())
+			Expect(errors.Is(err2, handshake.ErrNoExporter)).To(BeTrue())
+			Expect(exporter1).To(BeNil())
+			Expect(exporter2).To(BeNil())
+		})
+	})
+
+	Context("when the connection is not comparable", func() {
+		It("should export keys", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			var exporter1, exporter2 *handshake.Exporter
+			h1 := handshake.Export(func(_ id.Signatory, e *handshake.Exporter) { exporter1 = e }, handshake.ECIES(id.NewPrivKey()))
+			h2 := handshake.Export(func(_ id.Signatory, e *handshake.Exporter) { exporter2 = e }, handshake.ECIES(id.NewPrivKey()))
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, _, _, err := h2(uncomparableConn{Conn: conn2}, codec.PlainEncoder, codec.PlainDecoder)
+				errCh <- err
+			}()
+			_, _, _, err := h1(uncomparableConn{Conn: conn1}, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errCh).ToNot(HaveOccurred())
+			Expect(exporter1.DeriveKey("test", 32)).To(Equal(exporter2.DeriveKey("test", 32)))
+		})
+	})
+
+	Context("when the connection is kept by a once pool", func() {
+		It("should be removed using the connection that was exported", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			opts := handshake.DefaultOncePoolOptions().WithReconnectPolicy(handshake.ReconnectKeep)
+			pool1, pool2 := handshake.NewOncePool(opts), handshake.NewOncePool(opts)
+			h1 := handshake.Export(nil, handshake.Once(privKey1.Signatory(), &pool1, handshake.ECIES(privKey1)))
+			h2 := handshake.Export(nil, handshake.Once(privKey2.Signatory(), &pool2, handshake.ECIES(privKey2)))
+
+			for i := 0; i < 2; i++ {
+				conn1, conn2 := net.Pipe()
+				errCh := make(chan error, 1)
+				go func() {
+					_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+					errCh <- err
+				}()
+				_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(<-errCh).ToNot(HaveOccurred())
+
+				// Once the connection is removed, the remote peer can
+				// reconnect, even though existing connections are kept.
+				conn1.Close()
+				conn2.Close()
+				pool1.Remove(privKey2.Signatory(), conn1)
+				pool2.Remove(privKey1.Signatory(), conn2)
+			}
+		})
+	})
+})
+
+// uncomparableConn is a net.Conn that cannot be used as a map key.
+type uncomparableConn struct {
+	net.Conn
+	_ []byte
+}
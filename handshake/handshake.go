@@ -1,10 +1,14 @@
 package handshake
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
 )
 
@@ -22,19 +26,82 @@ const encryptedKeySize = encryptionHeaderSize + keySize
 // and encryption. The identity of the remote peer is also returned.
 type Handshake func(net.Conn, codec.Encoder, codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error)
 
+// ErrInsecureMismatch is returned when one peer uses an Insecure Handshake,
+// and the other peer uses an encrypted Handshake (such as an ECIES Handshake).
+// Such peers cannot communicate, so the Handshake fails cleanly instead of
+// either peer misinterpreting the other.
+var ErrInsecureMismatch = errors.New("insecure handshake mismatch")
+
+// insecureMagic is written by an Insecure Handshake before anything else. It is
+// not encoded, so that it is recognised regardless of the codecs that are
+// used.
+var insecureMagic = [16]byte{'a', 'w', '/', 'i', 'n', 's', 'e', 'c', 'u', 'r', 'e', '/', 'v', '1'}
+
 // Insecure returns a Handshake that does no authentication or encryption.
-// During the handshake, the local peer writes its own identity to the
-// connection, and then reads the identity of the remote peer. No verification
-// of identities is done. Insecure should only be used in private networks.
+// During the handshake, the local peer writes a marker, and its own identity,
+// to the connection, and then reads the marker and the identity of the remote
+// peer. No verification of identities is done, and messages are not encrypted
+// after the handshake, which saves the cost of encryption in networks that are
+// already isolated (or encrypted at a lower layer). Insecure should only be
+// used in private networks. Both peers must use an Insecure Handshake. If the
+// remote peer uses an encrypted Handshake, then the marker does not match, and
+// ErrInsecureMismatch is returned by both peers.
 func Insecure(self id.Signatory) Handshake {
-	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
-		if _, err := enc(conn, self[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("encoding local id: %v", err)
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		// Channel that is closed once the marker has been written, or has
+		// failed to be written.
+		wroteMagic := make(chan struct{})
+		go func() {
+			defer close(errCh)
+
+			_, err := conn.Write(insecureMagic[:])
+			close(wroteMagic)
+			if err != nil {
+				errCh <- fmt.Errorf("write insecure marker: %v", err)
+				return
+			}
+			if _, err := enc(conn, wire.SignatoryPeerID(self).Bytes()); err != nil {
+				errCh <- fmt.Errorf("encoding local id: %v", err)
+				return
+			}
+		}()
+
+		remoteMagic := [len(insecureMagic)]byte{}
+		if n, err := io.ReadFull(conn, remoteMagic[:]); err != nil {
+			// The remote peer can hang up part of the way through the
+			// marker. That is only a mismatch if the bytes that were read
+			// already differ from the marker. Otherwise, nothing is known
+			// about the remote peer, and the error is returned as it is.
+			if n > 0 && !bytes.Equal(remoteMagic[:n], insecureMagic[:n]) {
+				return nil, nil, id.Signatory{}, fmt.Errorf("%w: remote peer is not insecure", ErrInsecureMismatch)
+			}
+			return nil, nil, id.Signatory{}, fmt.Errorf("read insecure marker: %w", err)
+		}
+		if remoteMagic != insecureMagic {
+			// Wait for the marker to be written, so that the remote peer can
+			// recognise the mismatch too, before the connection is closed.
+			<-wroteMagic
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: remote peer is not insecure", ErrInsecureMismatch)
 		}
 		remote := id.Signatory{}
 		if _, err := dec(conn, remote[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("decoding remote id: %v", err)
+			return nil, nil, id.Signatory{}, fmt.Errorf("decoding remote id: %w", err)
+		}
+
+		// Wait for the writing goroutine to end, so that the caller has
+		// exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, id.Signatory{}, err
 		}
 		return enc, dec, remote, nil
-	}
+	})
+}
+
+// isInsecureMagic returns true if the buffer starts with the marker that is
+// written by an Insecure Handshake.
+func isInsecureMagic(buf []byte) bool {
+	return len(buf) >= len(insecureMagic) && bytes.Equal(buf[:len(insecureMagic)], insecureMagic[:])
 }
@@ -0,0 +1,104 @@
+package handshake_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Insecure handshake", func() {
+	type result struct {
+		remote id.Signatory
+		err    error
+	}
+
+	run := func(h handshake.Handshake, conn net.Conn, results chan<- result) {
+		enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+		dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+		_, _, remote, err := h(conn, enc, dec)
+		conn.Close()
+		results <- result{remote: remote, err: err}
+	}
+
+	Context("when both peers are insecure", func() {
+		It("should exchange identities", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			conn1, conn2 := net.Pipe()
+			results1, results2 := make(chan result, 1), make(chan result, 1)
+
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				_, _, remote, err := handshake.Insecure(privKey1.Signatory())(conn1, enc, dec)
+				results1 <- result{remote: remote, err: err}
+			}()
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				_, _, remote, err := handshake.Insecure(privKey2.Signatory())(conn2, enc, dec)
+				results2 <- result{remote: remote, err: err}
+			}()
+
+			r1, r2 := <-results1, <-results2
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+			Expect(r1.remote).To(Equal(privKey2.Signatory()))
+			Expect(r2.remote).To(Equal(privKey1.Signatory()))
+			conn1.Close()
+			conn2.Close()
+		})
+	})
+
+	Context("when only one peer is insecure", func() {
+		It("should fail cleanly on both peers", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			conn1, conn2 := net.Pipe()
+			results1, results2 := make(chan result, 1), make(chan result, 1)
+
+			go run(handshake.Insecure(privKey1.Signatory()), conn1, results1)
+			go run(handshake.ECIES(privKey2), conn2, results2)
+
+			r1, r2 := <-results1, <-results2
+			Expect(errors.Is(r1.err, handshake.ErrInsecureMismatch)).To(BeTrue())
+			Expect(errors.Is(r2.err, handshake.ErrInsecureMismatch)).To(BeTrue())
+		})
+	})
+
+	Context("when the remote peer hangs up", func() {
+		It("should return the error, instead of a mismatch, if nothing was read", func() {
+			conn1, conn2 := net.Pipe()
+			results := make(chan result, 1)
+
+			go run(handshake.Insecure(id.NewPrivKey().Signatory()), conn1, results)
+			_, err := io.ReadFull(conn2, make([]byte, 16))
+			Expect(err).ToNot(HaveOccurred())
+			conn2.Close()
+
+			r := <-results
+			Expect(errors.Is(r.err, io.EOF)).To(BeTrue())
+			Expect(errors.Is(r.err, handshake.ErrInsecureMismatch)).To(BeFalse())
+		})
+
+		It("should return a mismatch if the bytes that were read are not the marker", func() {
+			conn1, conn2 := net.Pipe()
+			results := make(chan result, 1)
+
+			go run(handshake.Insecure(id.NewPrivKey().Signatory()), conn1, results)
+			go io.Copy(ioutil.Discard, conn2)
+			_, err := conn2.Write([]byte("not aw"))
+			Expect(err).ToNot(HaveOccurred())
+			conn2.Close()
+
+			r := <-results
+			Expect(errors.Is(r.err, handshake.ErrInsecureMismatch)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,56 @@
+package handshake
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/muirglacier/id"
+)
+
+// Keys perform the private key operations needed by handshakes, without
+// exposing the private key. This allows the private key to be kept in an HSM,
+// or a KMS, that performs the operations remotely. Implementations must respect
+// the context, which is done when the handshake has taken too long.
+type Keys interface {
+	// PubKey returns the public key of the private key.
+	PubKey() *id.PubKey
+	// Decrypt an ECIES ciphertext that was encrypted using the public key.
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+	// Sign a hash using the private key.
+	Sign(ctx context.Context, hash *id.Hash) (id.Signature, error)
+}
+
+// inMemKeys are Keys backed by a private key that is kept in memory.
+type inMemKeys struct {
+	privKey *id.PrivKey
+}
+
+// NewInMemKeys returns Keys that are backed by a private key that is kept in
+// memory. This is the default used by ECIES and Authenticate. The operations
+// are fast, so the context is ignored.
+func NewInMemKeys(privKey *id.PrivKey) Keys {
+	return inMemKeys{privKey: privKey}
+}
+
+func (keys inMemKeys) PubKey() *id.PubKey {
+	return keys.privKey.PubKey()
+}
+
+func (keys inMemKeys) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return ecies.ImportECDSA((*ecdsa.PrivateKey)(keys.privKey)).Decrypt(ciphertext, nil, nil)
+}
+
+func (keys inMemKeys) Sign(ctx context.Context, hash *id.Hash) (id.Signature, error) {
+	return keys.privKey.Sign(hash)
+}
+
+// keysContext returns the context used for all Keys operations in one
+// handshake. If the timeout is zero, or less, then the context is never done.
+func keysContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
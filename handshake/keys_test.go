@@ -0,0 +1,91 @@
+package handshake_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// remoteKeys simulate Keys that are kept in an HSM, or a KMS, by delaying
+// every operation.
+type remoteKeys struct {
+	handshake.Keys
+	delay time.Duration
+}
+
+func (keys remoteKeys) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(keys.delay):
+	}
+	return keys.Keys.Decrypt(ctx, ciphertext)
+}
+
+func (keys remoteKeys) Sign(ctx context.Context, hash *id.Hash) (id.Signature, error) {
+	select {
+	case <-ctx.Done():
+		return id.Signature{}, ctx.Err()
+	case <-time.After(keys.delay):
+	}
+	return keys.Keys.Sign(ctx, hash)
+}
+
+var _ = Describe("Keys", func() {
+	run := func(h1, h2 handshake.Handshake) (id.Signatory, error, error) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			errCh <- err
+		}()
+		_, _, remote, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		if err != nil {
+			// Unblock the other side of the handshake.
+			conn1.Close()
+		}
+		return remote, err, <-errCh
+	}
+
+	Context("when the keys are remote", func() {
+		It("should succeed within the timeout", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			keys := remoteKeys{Keys: handshake.NewInMemKeys(privKey1), delay: 10 * time.Millisecond}
+			remote, err1, err2 := run(
+				handshake.AuthenticateWithKeys(keys, time.Second, handshake.ECIESWithKeys(keys, time.Second)),
+				handshake.Authenticate(privKey2, handshake.ECIES(privKey2)),
+			)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(remote).To(Equal(privKey2.Signatory()))
+		})
+
+		It("should fail when the operations exceed the timeout", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			keys := remoteKeys{Keys: handshake.NewInMemKeys(privKey1), delay: time.Minute}
+			_, err1, err2 := run(
+				handshake.ECIESWithKeys(keys, 10*time.Millisecond),
+				handshake.ECIES(privKey2),
+			)
+			Expect(errors.Is(err1, context.DeadlineExceeded)).To(BeTrue())
+			Expect(err2).To(HaveOccurred())
+		})
+	})
+})
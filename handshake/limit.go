@@ -0,0 +1,53 @@
+package handshake
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrMessageTooLarge is returned by a Limit Handshake when the wrapped
+// Handshake tries to decode a message that is larger than the maximum size.
+var ErrMessageTooLarge = errors.New("handshake message too large")
+
+// DefaultMaxMessageSize is the default maximum size, in bytes, of a message
+// decoded during a Limit Handshake. The messages defined by this package are
+// much smaller than this (the largest fixed-size message is an encrypted
+// secret key of 145 bytes), so it only needs to leave room for metadata.
+const DefaultMaxMessageSize = 4096
+
+// MaxMessageOverhead is the maximum number of bytes that the encoders of this
+// package add to a message (the authentication tag of an encrypted session).
+const MaxMessageOverhead = 16
+
+// Limit returns a Handshake that runs the wrapped Handshake with a decoder that
+// refuses to decode any message larger than the maximum size, including the
+// overhead added by encryption. The size is checked before anything is read, so
+// an oversized message fails the Handshake with ErrMessageTooLarge without any
+// of it being read. The size of a message is only known to the Limit once its
+// buffer has been allocated, so Handshakes that read a length declared by the
+// remote peer (such as the Metadata Handshake) check it against their own
+// maximum size before allocating. That maximum size should be no larger than
+// the maximum size of the Limit, less the MaxMessageOverhead, for the Limit to
+// bound every buffer allocated for the remote peer before the Handshake
+// completes. Once the wrapped Handshake is done, the decoder that it returns is
+// no longer limited.
+func Limit(maxSize int, h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		done := uint32(0)
+		limited := func(r io.Reader, buf []byte) (int, error) {
+			if atomic.LoadUint32(&done) == 0 && len(buf) > maxSize {
+				return 0, fmt.Errorf("%w: expected at most %v bytes, got %v bytes", ErrMessageTooLarge, maxSize, len(buf))
+			}
+			return dec(r, buf)
+		}
+		enc, wrappedDec, remote, err := h(conn, enc, limited)
+		atomic.StoreUint32(&done, 1)
+		return enc, wrappedDec, remote, err
+	})
+}
@@ -0,0 +1,69 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limit", func() {
+	Context("when the remote peer sends an oversized handshake message", func() {
+		It("should fail promptly without reading the message", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			// The remote peer writes its metadata in one message, which blocks
+			// until it is read.
+			written := make(chan error, 1)
+			go func() {
+				h := handshake.Metadata(make([]byte, 512), 1024, nil, handshake.ECIES(id.NewPrivKey()))
+				_, _, _, err := h(conn2, codec.PlainEncoder, codec.PlainDecoder)
+				written <- err
+			}()
+
+			h := handshake.Limit(64, handshake.Metadata(nil, 1024, nil, handshake.ECIES(id.NewPrivKey())))
+			start := time.Now()
+			_, _, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(errors.Is(err, handshake.ErrMessageTooLarge)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+			conn1.Close()
+			Eventually(written).Should(Receive(HaveOccurred()))
+		})
+	})
+
+	Context("when the handshake is done", func() {
+		It("should not limit the returned decoder", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			data := make([]byte, 128)
+			errCh := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				enc, _, _, err := handshake.ECIES(id.NewPrivKey())(conn2, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = enc(conn2, data)
+				errCh <- err
+			}()
+
+			h := handshake.Limit(64, handshake.ECIES(id.NewPrivKey()))
+			_, dec, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(err).ToNot(HaveOccurred())
+			// The buffer has extra capacity for the encryption overhead.
+			buf := make([]byte, len(data), len(data)+handshake.MaxMessageOverhead)
+			_, err = dec(conn1, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errCh).ToNot(HaveOccurred())
+		})
+	})
+})
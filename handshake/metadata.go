@@ -0,0 +1,88 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrMetadataTooLarge is returned by a Metadata Handshake when the remote peer
+// declares metadata that is larger than the maximum size.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+const (
+	metadataSizeSize = 4
+	metadataOverhead = 16
+)
+
+// Metadata returns a Handshake that exchanges opaque application metadata
+// after running the wrapped Handshake. This allows applications to learn about
+// the remote peer (for example, its software version) without defining their
+// own first message. Both peers write their metadata using the encoder
+// returned by the wrapped Handshake, and then read the metadata of the remote
+// peer. If the remote metadata is larger than the maximum size, then
+// ErrMetadataTooLarge is returned before any of it is read. Otherwise, it is
+// passed to the onMetadata function, if there is one, and the error returned
+// by the function (if any) fails the Handshake with an ErrorRejected. Both
+// peers must use a Metadata Handshake, even if they have no metadata of their
+// own.
+func Metadata(local []byte, maxSize int, onMetadata func(remote id.Signatory, metadata []byte) error, h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+
+			localSize := [metadataSizeSize]byte{}
+			binary.BigEndian.PutUint32(localSize[:], uint32(len(local)))
+			if _, err := enc(conn, localSize[:]); err != nil {
+				errCh <- fmt.Errorf("write metadata size: %v", err)
+				return
+			}
+			if len(local) == 0 {
+				return
+			}
+			if _, err := enc(conn, local); err != nil {
+				errCh <- fmt.Errorf("write metadata: %v", err)
+				return
+			}
+		}()
+
+		remoteSizeBuf := [metadataSizeSize + metadataOverhead]byte{}
+		if _, err := dec(conn, remoteSizeBuf[:metadataSizeSize]); err != nil {
+			return nil, nil, remote, fmt.Errorf("read metadata size: %w", err)
+		}
+		remoteSize := binary.BigEndian.Uint32(remoteSizeBuf[:metadataSizeSize])
+		if int64(remoteSize) > int64(maxSize) {
+			return nil, nil, remote, fmt.Errorf("%w: expected at most %v bytes, got %v bytes", ErrMetadataTooLarge, maxSize, remoteSize)
+		}
+		remoteMetadata := make([]byte, remoteSize, remoteSize+metadataOverhead)
+		if remoteSize > 0 {
+			if _, err := dec(conn, remoteMetadata); err != nil {
+				return nil, nil, remote, fmt.Errorf("read metadata: %w", err)
+			}
+		}
+
+		// Wait for the writing goroutine to end, so that the caller has
+		// exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, remote, err
+		}
+		if onMetadata != nil {
+			if err := onMetadata(remote, remoteMetadata); err != nil {
+				return nil, nil, remote, &Error{Kind: ErrorRejected, Remote: remote, Err: fmt.Errorf("metadata: %w", err)}
+			}
+		}
+		return enc, dec, remote, nil
+	})
+}
@@ -0,0 +1,93 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metadata", func() {
+	errIncompatible := errors.New("incompatible")
+
+	run := func(metadata1, metadata2 []byte, maxSize int, onMetadata2 func(id.Signatory, []byte) error) ([]byte, error, error) {
+		privKey1 := id.NewPrivKey()
+		privKey2 := id.NewPrivKey()
+		received := make(chan []byte, 1)
+		h1 := handshake.Metadata(metadata1, maxSize, func(_ id.Signatory, metadata []byte) error {
+			received <- metadata
+			return nil
+		}, handshake.ECIES(privKey1))
+		h2 := handshake.Metadata(metadata2, maxSize, onMetadata2, handshake.ECIES(privKey2))
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			errCh <- err
+		}()
+		_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		if err != nil {
+			conn1.Close()
+		}
+		err2 := <-errCh
+
+		select {
+		case metadata := <-received:
+			return metadata, err, err2
+		default:
+			return nil, err, err2
+		}
+	}
+
+	Context("when both peers have metadata", func() {
+		It("should exchange the metadata", func() {
+			var remoteMetadata []byte
+			metadata, err1, err2 := run([]byte("v1.0.0"), []byte("v2.0.0"), 16, func(_ id.Signatory, metadata []byte) error {
+				remoteMetadata = metadata
+				return nil
+			})
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal([]byte("v2.0.0")))
+			Expect(remoteMetadata).To(Equal([]byte("v1.0.0")))
+		})
+	})
+
+	Context("when a peer has no metadata", func() {
+		It("should receive empty metadata", func() {
+			metadata, err1, err2 := run([]byte("v1.0.0"), nil, 16, nil)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(metadata).To(BeEmpty())
+		})
+	})
+
+	Context("when the remote metadata is too large", func() {
+		It("should return a metadata too large error", func() {
+			_, err1, _ := run(nil, make([]byte, 17), 16, nil)
+			Expect(errors.Is(err1, handshake.ErrMetadataTooLarge)).To(BeTrue())
+		})
+	})
+
+	Context("when the remote metadata is rejected", func() {
+		It("should fail the handshake", func() {
+			_, _, err2 := run([]byte("v0.1.0"), []byte("v2.0.0"), 16, func(id.Signatory, []byte) error {
+				return errIncompatible
+			})
+			Expect(errors.Is(err2, errIncompatible)).To(BeTrue())
+		})
+	})
+})
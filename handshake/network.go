@@ -0,0 +1,160 @@
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrNetworkMismatch is returned by a Network Handshake when the remote peer
+// does not prove knowledge of the same network key as the local peer.
+var ErrNetworkMismatch = errors.New("network mismatch")
+
+const networkNonceSize = 32
+
+var networkDomain = []byte("aw/handshake/network")
+
+// Network returns a Handshake that checks that the remote peer belongs to the
+// same network as the local peer before running the wrapped Handshake. Both
+// peers write a random nonce to the connection, and then respond with an HMAC
+// of their own nonce followed by the remote nonce, keyed by the network key.
+// The order of the nonces binds the HMAC to the peer that writes it, so a
+// remote peer cannot pass the check by replaying the HMAC of the local peer.
+// For the same reason, remote nonces that are the same as the nonce of a
+// handshake that the local peer is still running are refused. If the remote
+// peer does not respond with the expected HMAC, then ErrNetworkMismatch is
+// returned and the wrapped Handshake is never run. If the network key is empty, then the wrapped
+// Handshake is returned and peers from any network are accepted.
+func Network(key []byte, h Handshake) Handshake {
+	return NetworkWithRand(key, nil, h)
+}
+
+// NetworkWithRand returns a Handshake that is the same as Network, but reads
+// the nonce from the source of randomness. If the source is nil, then
+// crypto/rand.Reader is used. A remote peer that can predict the nonce can
+// replay the responses of another peer from the same network, so the source
+// must meet the same requirements as the one given to ECIESWithRand.
+func NetworkWithRand(key []byte, random io.Reader, h Handshake) Handshake {
+	if len(key) == 0 {
+		return h
+	}
+	random = randOrDefault(random)
+	pending := newNoncePool()
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		localNonce := [networkNonceSize]byte{}
+		if _, err := io.ReadFull(random, localNonce[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate network nonce: %v", err)
+		}
+		pending.add(localNonce)
+		defer pending.remove(localNonce)
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+
+		// Channel for passing the remote nonce to the writing goroutine.
+		remoteNonceCh := make(chan []byte, 1)
+		defer close(remoteNonceCh)
+
+		go func() {
+			defer close(errCh)
+
+			if _, err := conn.Write(localNonce[:]); err != nil {
+				errCh <- fmt.Errorf("write network nonce: %v", err)
+				return
+			}
+			remoteNonce, ok := <-remoteNonceCh
+			if !ok {
+				return
+			}
+			if _, err := conn.Write(networkMAC(key, localNonce[:], remoteNonce)); err != nil {
+				errCh <- fmt.Errorf("write network mac: %v", err)
+				return
+			}
+		}()
+
+		remoteNonce := [networkNonceSize]byte{}
+		if _, err := io.ReadFull(conn, remoteNonce[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read network nonce: %v", err)
+		}
+		// The remote nonce is checked before the local peer writes its HMAC,
+		// so that the HMAC is never written for a nonce that the remote peer
+		// has reflected from another handshake.
+		if pending.contains(remoteNonce) {
+			return nil, nil, id.Signatory{}, ErrNetworkMismatch
+		}
+		remoteNonceCh <- remoteNonce[:]
+
+		remoteMAC := [sha256.Size]byte{}
+		if _, err := io.ReadFull(conn, remoteMAC[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read network mac: %v", err)
+		}
+
+		// Wait for the writing goroutine to end, so that the wrapped Handshake
+		// has exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, id.Signatory{}, err
+		}
+		if !hmac.Equal(remoteMAC[:], networkMAC(key, remoteNonce[:], localNonce[:])) {
+			return nil, nil, id.Signatory{}, ErrNetworkMismatch
+		}
+		return h(conn, enc, dec)
+	})
+}
+
+// networkMAC returns the HMAC written by the peer that generated the writer
+// nonce to the peer that generated the reader nonce.
+func networkMAC(key, writerNonce, readerNonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(networkDomain)
+	mac.Write(writerNonce)
+	mac.Write(readerNonce)
+	return mac.Sum(nil)
+}
+
+// noncePool is the set of local nonces of the Network handshakes that are
+// still running. Without it, a remote peer could open two connections, and
+// pass the nonce of each one as its own nonce on the other, so that the local
+// peer writes the HMAC that the remote peer needs on the other connection. It
+// is safe for concurrent use.
+type noncePool struct {
+	mu     *sync.Mutex
+	nonces map[[networkNonceSize]byte]int
+}
+
+func newNoncePool() noncePool {
+	return noncePool{
+		mu:     new(sync.Mutex),
+		nonces: map[[networkNonceSize]byte]int{},
+	}
+}
+
+func (pool noncePool) add(nonce [networkNonceSize]byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.nonces[nonce]++
+}
+
+func (pool noncePool) remove(nonce [networkNonceSize]byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.nonces[nonce]--; pool.nonces[nonce] <= 0 {
+		delete(pool.nonces, nonce)
+	}
+}
+
+func (pool noncePool) contains(nonce [networkNonceSize]byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.nonces[nonce] > 0
+}
@@ -0,0 +1,176 @@
+package handshake_test
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network", func() {
+	run := func(key1, key2 []byte) (error, error) {
+		privKey1 := id.NewPrivKey()
+		privKey2 := id.NewPrivKey()
+		sig1, sig2 := privKey1.Signatory(), privKey2.Signatory()
+		h1 := handshake.Network(key1, handshake.ECIES(privKey1))
+		h2 := handshake.Network(key2, handshake.ECIES(privKey2))
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, remote, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err == nil && !remote.Equal(&sig1) {
+				err = errors.New("bad remote")
+			}
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			errCh <- err
+		}()
+		_, _, remote, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		if err == nil && !remote.Equal(&sig2) {
+			err = errors.New("bad remote")
+		}
+		if err != nil {
+			conn1.Close()
+		}
+		return err, <-errCh
+	}
+
+	Context("when both peers use the same network key", func() {
+		It("should complete the handshake", func() {
+			err1, err2 := run([]byte("network"), []byte("network"))
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when the peers use different network keys", func() {
+		It("should return a network mismatch error", func() {
+			err1, err2 := run([]byte("network"), []byte("other network"))
+			Expect(errors.Is(err1, handshake.ErrNetworkMismatch)).To(BeTrue())
+			Expect(errors.Is(err2, handshake.ErrNetworkMismatch)).To(BeTrue())
+		})
+	})
+
+	Context("when neither peer uses a network key", func() {
+		It("should complete the handshake", func() {
+			err1, err2 := run(nil, nil)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+
+	// passed is the Handshake wrapped by Network Handshakes that must not pass
+	// the network check.
+	errPassed := errors.New("passed")
+	passed := func(net.Conn, codec.Encoder, codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		return nil, nil, id.Signatory{}, errPassed
+	}
+
+	// replay the mac of the local peer from a remote peer that does not know
+	// the network key, and return the error of the local peer. The remote peer
+	// either echoes the nonce of the local peer, or uses its own nonce.
+	replay := func(echo bool) error {
+		h := handshake.Network([]byte("network"), passed)
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		go func() {
+			nonce := [32]byte{}
+			if _, err := io.ReadFull(conn2, nonce[:]); err != nil {
+				return
+			}
+			if !echo {
+				nonce = [32]byte{1}
+			}
+			if _, err := conn2.Write(nonce[:]); err != nil {
+				return
+			}
+			mac := [32]byte{}
+			if _, err := io.ReadFull(conn2, mac[:]); err != nil {
+				return
+			}
+			conn2.Write(mac[:])
+		}()
+		_, _, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		return err
+	}
+
+	Context("when the remote peer echoes the nonce and replays the mac of the local peer", func() {
+		It("should return a network mismatch error", func() {
+			Expect(errors.Is(replay(true), handshake.ErrNetworkMismatch)).To(BeTrue())
+		})
+	})
+
+	Context("when the remote peer replays the mac of the local peer", func() {
+		It("should return a network mismatch error", func() {
+			Expect(errors.Is(replay(false), handshake.ErrNetworkMismatch)).To(BeTrue())
+		})
+	})
+
+	Context("when the remote peer reflects the nonces and the macs of the local peer across two connections", func() {
+		It("should not pass the network check on either connection", func() {
+			h := handshake.Network([]byte("network"), passed)
+
+			conn1, remote1 := net.Pipe()
+			conn2, remote2 := net.Pipe()
+			defer remote1.Close()
+			defer remote2.Close()
+
+			errCh1 := make(chan error, 1)
+			errCh2 := make(chan error, 1)
+			go func() {
+				defer conn1.Close()
+				_, _, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+				errCh1 <- err
+			}()
+			go func() {
+				defer conn2.Close()
+				_, _, _, err := h(conn2, codec.PlainEncoder, codec.PlainDecoder)
+				errCh2 <- err
+			}()
+
+			// Each connection is given the nonce of the other, so that the
+			// mac written to one is the mac expected from the other. If
+			// either connection fails, then the other is closed.
+			nonce1, nonce2 := [32]byte{}, [32]byte{}
+			_, err := io.ReadFull(remote1, nonce1[:])
+			Expect(err).ToNot(HaveOccurred())
+			_, err = io.ReadFull(remote2, nonce2[:])
+			Expect(err).ToNot(HaveOccurred())
+			reflect := func(from, to net.Conn, nonce [32]byte) {
+				defer to.Close()
+				if _, err := to.Write(nonce[:]); err != nil {
+					return
+				}
+				mac := [32]byte{}
+				if _, err := io.ReadFull(from, mac[:]); err != nil {
+					return
+				}
+				to.Write(mac[:])
+			}
+			go reflect(remote1, remote2, nonce1)
+			go reflect(remote2, remote1, nonce2)
+
+			err1, err2 := <-errCh1, <-errCh2
+			Expect(err1).To(HaveOccurred())
+			Expect(err2).To(HaveOccurred())
+			Expect(errors.Is(err1, errPassed)).To(BeFalse())
+			Expect(errors.Is(err2, errPassed)).To(BeFalse())
+			Expect(errors.Is(err1, handshake.ErrNetworkMismatch) || errors.Is(err2, handshake.ErrNetworkMismatch)).To(BeTrue())
+		})
+	})
+})
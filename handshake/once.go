@@ -1,12 +1,15 @@
 package handshake
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/muirglacier/aw/clock"
 	"github.com/muirglacier/aw/codec"
 	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
@@ -14,13 +17,55 @@ import (
 
 var DefaultMinimumExpiryAge = time.Minute
 
+// ReconnectPolicy decides what happens when a remote peer, that already has a
+// connection in the pool, completes the handshake of a new connection.
+type ReconnectPolicy uint8
+
+// Enumerate all ReconnectPolicy values.
+const (
+	// ReconnectReplaceIfDead replaces the existing connection if it appears
+	// to be dead, and otherwise keeps the existing connection and rejects the
+	// new one. A connection appears to be dead when nothing has been decoded
+	// from it for longer than the MinimumExpiryAge.
+	ReconnectReplaceIfDead ReconnectPolicy = iota
+	// ReconnectReplace always replaces the existing connection with the new
+	// one.
+	ReconnectReplace
+	// ReconnectKeep always keeps the existing connection and rejects the new
+	// one, until the existing connection is replaced by the remote peer or
+	// removed from the pool.
+	//
+	// With all policies, a connection is removed from the pool when it is
+	// passed to OncePool.Remove, or as soon as decoding from it fails, so a
+	// remote peer can always reconnect after its connection has been closed.
+	ReconnectKeep
+)
+
+func (policy ReconnectPolicy) String() string {
+	switch policy {
+	case ReconnectReplaceIfDead:
+		return "replace if dead"
+	case ReconnectReplace:
+		return "replace"
+	case ReconnectKeep:
+		return "keep"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(policy))
+	}
+}
+
 type OncePoolOptions struct {
 	MinimumExpiryAge time.Duration
+	ReconnectPolicy  ReconnectPolicy
+	Clock            clock.Clock
+	OnReplace        func(remote id.Signatory, addr string)
 }
 
 func DefaultOncePoolOptions() OncePoolOptions {
 	return OncePoolOptions{
 		MinimumExpiryAge: DefaultMinimumExpiryAge,
+		ReconnectPolicy:  ReconnectReplaceIfDead,
+		Clock:            clock.Real(),
 	}
 }
 
@@ -29,9 +74,43 @@ func (opts OncePoolOptions) WithMinimumExpiryAge(minExpiryAge time.Duration) Onc
 	return opts
 }
 
+// WithReconnectPolicy sets the ReconnectPolicy used when a remote peer with an
+// existing connection completes the handshake of a new connection. Only the
+// policy of the peer with the greater peer ID is used, and the other peer
+// obeys its decision, so both peers should use the same policy.
+func (opts OncePoolOptions) WithReconnectPolicy(policy ReconnectPolicy) OncePoolOptions {
+	opts.ReconnectPolicy = policy
+	return opts
+}
+
+// WithClock sets the Clock used to timestamp connections in the pool.
+func (opts OncePoolOptions) WithClock(clock clock.Clock) OncePoolOptions {
+	opts.Clock = clock
+	return opts
+}
+
+// WithOnReplace sets a function that is called whenever an existing connection
+// to a remote peer is closed, because it is being replaced by a new
+// connection. The function is given the network address of the connection
+// being replaced. It is called synchronously during the handshake of the new
+// connection, and must not block.
+func (opts OncePoolOptions) WithOnReplace(onReplace func(remote id.Signatory, addr string)) OncePoolOptions {
+	opts.OnReplace = onReplace
+	return opts
+}
+
 type onceConn struct {
-	timestamp time.Time
-	conn      net.Conn
+	conn net.Conn
+	// activity is the time, in nanoseconds since the Unix epoch, at which a
+	// message was last decoded from the connection. It starts as the time at
+	// which the connection was added to the pool.
+	activity *int64
+}
+
+// lastActivity returns the time at which a message was last decoded from the
+// connection.
+func (c onceConn) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(c.activity))
 }
 
 type OncePool struct {
@@ -51,44 +130,73 @@ func NewOncePool(opts OncePoolOptions) OncePool {
 }
 
 func Once(self id.Signatory, pool *OncePool, h Handshake) Handshake {
-	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+	return OnceWithFilter(self, pool, nil, h)
+}
+
+// OnceWithFilter returns a Handshake that is the same as Once, except that
+// the remote peer is passed to the filter function before the OncePool is
+// used. If the filter returns an error, then the connection is rejected
+// without replacing an existing connection, or being kept by the OncePool.
+// The keep-alive exchange is still completed, so that the returned Encoder
+// can be used to send one last message (for example, a goodbye) that the
+// remote peer will be able to read.
+func OnceWithFilter(self id.Signatory, pool *OncePool, filter func(id.Signatory) error, h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
 		enc, dec, remote, err := h(conn, enc, dec)
 		if err != nil {
-			return enc, dec, remote, fmt.Errorf("handshake error = %v", err)
+			return enc, dec, remote, fmt.Errorf("handshake error = %w", err)
 		}
 
-		cmp := bytes.Compare(self[:], remote[:])
+		cmp := wire.ComparePeerIDs(wire.SignatoryPeerID(self), wire.SignatoryPeerID(remote))
+		if filter != nil {
+			if err := filter(remote); err != nil {
+				switch {
+				case cmp < 0:
+					keepAlive := [128]byte{}
+					_, _ = dec(conn, keepAlive[:1])
+				case cmp > 0:
+					_, _ = enc(conn, msgKeepAliveTrue)
+				}
+				return enc, dec, remote, &Error{Kind: ErrorRejected, Remote: remote, Err: fmt.Errorf("filter %v: %w", remote, err)}
+			}
+		}
 		if cmp == 0 {
 			return enc, dec, remote, nil
 		}
 		if cmp < 0 {
 			keepAlive := [128]byte{}
 			if _, err := dec(conn, keepAlive[:1]); err != nil {
-				return enc, dec, remote, fmt.Errorf("decoding keep-alive message: %v", err)
+				return enc, dec, remote, fmt.Errorf("decoding keep-alive message: %w", err)
 			}
 			if keepAlive[0] == 0x00 {
 				return nil, nil, remote, wire.NewNegligibleError(fmt.Errorf("kill connection from %v", remote))
 			}
 
+			newConn, dec := pool.track(remote, conn, dec)
 			pool.connsMu.Lock()
-			defer pool.connsMu.Unlock()
-
-			if existingConn, ok := pool.conns[remote]; ok {
+			existingConn, existingConnIsOk := pool.conns[remote]
+			if existingConnIsOk {
 				// Ignore the error, because we no longer need this connection.
 				_ = existingConn.conn.Close()
 			}
-			pool.conns[remote] = onceConn{timestamp: time.Now(), conn: conn}
+			pool.conns[remote] = newConn
+			pool.connsMu.Unlock()
+
+			if existingConnIsOk {
+				pool.replaced(remote, existingConn.conn)
+			}
 			return enc, dec, remote, nil
 		}
 
 		// Lock, perform non-blocking operations, and then unblock. This allows
 		// us to avoid doing blocking operations (such as encoding/decoding
 		// keep-alive messages) while holding the mutex lock.
+		newConn, dec := pool.track(remote, conn, dec)
 		pool.connsMu.Lock()
 		existingConn, existingConnIsOk := pool.conns[remote]
-		existingConnNeedsReplacement := !existingConnIsOk || time.Now().Sub(existingConn.timestamp) > pool.opts.MinimumExpiryAge
+		existingConnNeedsReplacement := !existingConnIsOk || pool.needsReplacement(existingConn)
 		if existingConnNeedsReplacement {
-			pool.conns[remote] = onceConn{timestamp: time.Now(), conn: conn}
+			pool.conns[remote] = newConn
 		}
 		pool.connsMu.Unlock()
 
@@ -105,6 +213,7 @@ func Once(self id.Signatory, pool *OncePool, h Handshake) Handshake {
 		if existingConnIsOk {
 			// Ignore the error, because we no longer need this connection.
 			_ = existingConn.conn.Close()
+			pool.replaced(remote, existingConn.conn)
 		}
 		if _, err := enc(conn, msgKeepAliveTrue); err != nil {
 			// An error occurred while writing the "keep alive" message to
@@ -122,7 +231,79 @@ func Once(self id.Signatory, pool *OncePool, h Handshake) Handshake {
 		}
 
 		return enc, dec, remote, nil
+	})
+}
+
+// track returns a pool entry for the connection, and a Decoder that records
+// activity on the entry whenever it decodes a message. When decoding fails,
+// the connection is assumed to be dead, and the entry is removed from the
+// pool (unless it has already been replaced).
+func (pool *OncePool) track(remote id.Signatory, conn net.Conn, dec codec.Decoder) (onceConn, codec.Decoder) {
+	// The connection is compared with the one passed to Remove, which is the
+	// connection that was passed to the outermost Handshake.
+	c := onceConn{conn: unwrapConn(conn), activity: new(int64)}
+	*c.activity = pool.opts.Clock.Now().UnixNano()
+	return c, func(r io.Reader, buf []byte) (int, error) {
+		n, err := dec(r, buf)
+		if err != nil {
+			pool.remove(remote, c)
+			return n, err
+		}
+		atomic.StoreInt64(c.activity, pool.opts.Clock.Now().UnixNano())
+		return n, err
+	}
+}
+
+// Remove the connection of a remote peer from the pool, if it is the connection
+// that is in the pool. It should be called when a connection returned by the
+// handshake is closed, so that the remote peer can reconnect, whatever the
+// ReconnectPolicy. Connections that are not comparable are ignored.
+func (pool *OncePool) Remove(remote id.Signatory, conn net.Conn) {
+	if conn == nil || !reflect.TypeOf(conn).Comparable() {
+		return
+	}
+	pool.connsMu.Lock()
+	defer pool.connsMu.Unlock()
+
+	if existing, ok := pool.conns[remote]; ok && existing.conn == conn {
+		delete(pool.conns, remote)
+	}
+}
+
+// remove the entry of the remote peer from the pool, if it is the given entry.
+func (pool *OncePool) remove(remote id.Signatory, c onceConn) {
+	pool.connsMu.Lock()
+	defer pool.connsMu.Unlock()
+
+	if existing, ok := pool.conns[remote]; ok && existing.activity == c.activity {
+		delete(pool.conns, remote)
+	}
+}
+
+// needsReplacement returns true if the ReconnectPolicy allows the existing
+// connection to be replaced by a new connection.
+func (pool *OncePool) needsReplacement(existing onceConn) bool {
+	switch pool.opts.ReconnectPolicy {
+	case ReconnectReplace:
+		return true
+	case ReconnectKeep:
+		return false
+	default:
+		return pool.opts.Clock.Now().Sub(existing.lastActivity()) > pool.opts.MinimumExpiryAge
+	}
+}
+
+// replaced notifies the OnReplace function, if there is one, that the
+// connection to the remote peer has been replaced.
+func (pool *OncePool) replaced(remote id.Signatory, conn net.Conn) {
+	if pool.opts.OnReplace == nil {
+		return
+	}
+	addr := ""
+	if conn.RemoteAddr() != nil {
+		addr = conn.RemoteAddr().String()
 	}
+	pool.opts.OnReplace(remote, addr)
 }
 
 var (
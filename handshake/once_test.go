@@ -2,11 +2,13 @@ package handshake_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync/atomic"
 	"time"
 
+	"github.com/muirglacier/aw/clock"
 	"github.com/muirglacier/aw/codec"
 	"github.com/muirglacier/aw/handshake"
 	"github.com/muirglacier/aw/policy"
@@ -208,5 +210,293 @@ var _ = Describe("Handshake", func() {
 				Expect(atomic.LoadInt64(&connectionKillCount)).To(Equal(int64(2)))
 			})
 		})
+
+		Context("when an existing connection is replaced", func() {
+			It("should notify both peers", func() {
+				fake := clock.NewFake(time.Now())
+				replaced1 := make(chan id.Signatory, 2)
+				replaced2 := make(chan id.Signatory, 2)
+				pool1 := handshake.NewOncePool(handshake.DefaultOncePoolOptions().WithClock(fake).WithOnReplace(func(remote id.Signatory, addr string) {
+					replaced1 <- remote
+				}))
+				pool2 := handshake.NewOncePool(handshake.DefaultOncePoolOptions().WithClock(fake).WithOnReplace(func(remote id.Signatory, addr string) {
+					replaced2 <- remote
+				}))
+
+				privKey1 := id.NewPrivKey()
+				privKey2 := id.NewPrivKey()
+				h1 := handshake.Once(privKey1.Signatory(), &pool1, handshake.ECIES(privKey1))
+				h2 := handshake.Once(privKey2.Signatory(), &pool2, handshake.ECIES(privKey2))
+
+				connect := func() {
+					conn1, conn2 := net.Pipe()
+					errCh := make(chan error, 1)
+					go func() {
+						_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+						errCh <- err
+					}()
+					_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(<-errCh).ToNot(HaveOccurred())
+				}
+
+				connect()
+				Expect(replaced1).ToNot(Receive())
+				Expect(replaced2).ToNot(Receive())
+
+				fake.Advance(2 * handshake.DefaultMinimumExpiryAge)
+				connect()
+				Expect(replaced1).To(Receive(Equal(privKey2.Signatory())))
+				Expect(replaced2).To(Receive(Equal(privKey1.Signatory())))
+			})
+		})
+
+		Context("when the filter rejects the remote peer", func() {
+			It("should not replace the existing connection, and should let one last message through", func() {
+				fake := clock.NewFake(time.Now())
+				replaced := make(chan id.Signatory, 2)
+				pool1 := handshake.NewOncePool(handshake.DefaultOncePoolOptions().WithClock(fake).WithOnReplace(func(remote id.Signatory, addr string) {
+					replaced <- remote
+				}))
+				pool2 := handshake.NewOncePool(handshake.DefaultOncePoolOptions().WithClock(fake))
+
+				privKey1 := id.NewPrivKey()
+				privKey2 := id.NewPrivKey()
+				rejected := int64(0)
+				errRejected := fmt.Errorf("rejected")
+				h1 := handshake.OnceWithFilter(privKey1.Signatory(), &pool1, func(id.Signatory) error {
+					if atomic.LoadInt64(&rejected) != 0 {
+						return errRejected
+					}
+					return nil
+				}, handshake.ECIES(privKey1))
+				h2 := handshake.Once(privKey2.Signatory(), &pool2, handshake.ECIES(privKey2))
+
+				type result struct {
+					enc codec.Encoder
+					dec codec.Decoder
+					err error
+				}
+				connect := func() (net.Conn, result, net.Conn, result) {
+					conn1, conn2 := net.Pipe()
+					ch := make(chan result, 1)
+					go func() {
+						enc, dec, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+						ch <- result{enc: enc, dec: dec, err: err}
+					}()
+					enc, dec, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+					return conn1, result{enc: enc, dec: dec, err: err}, conn2, <-ch
+				}
+
+				_, old1, _, old2 := connect()
+				Expect(old1.err).ToNot(HaveOccurred())
+				Expect(old2.err).ToNot(HaveOccurred())
+
+				atomic.StoreInt64(&rejected, 1)
+				fake.Advance(2 * handshake.DefaultMinimumExpiryAge)
+				conn1, new1, conn2, new2 := connect()
+				Expect(errors.Is(new1.err, errRejected)).To(BeTrue())
+				Expect(handshake.Classify(new1.err)).To(Equal(handshake.ErrorRejected))
+				Expect(new2.err).ToNot(HaveOccurred())
+				Expect(replaced).ToNot(Receive())
+
+				go new1.enc(conn1, []byte{0x42})
+				buf := [128]byte{}
+				n, err := new2.dec(conn2, buf[:1])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buf[:n]).To(Equal([]byte{0x42}))
+			})
+		})
+
+		Context("when a peer reconnects while it has an existing connection", func() {
+			type conn struct {
+				conn net.Conn
+				enc  codec.Encoder
+				dec  codec.Decoder
+				err  error
+			}
+
+			// setupWithRemove returns a function that connects a pair of
+			// peers, using the given ReconnectPolicy, a channel that receives
+			// the remote peer whenever one of the peers replaces a
+			// connection, and a function that removes a pair of connections
+			// from the pools of the peers.
+			setupWithRemove := func(fake *clock.Fake, policy handshake.ReconnectPolicy) (func() (conn, conn), chan id.Signatory, func(conn, conn)) {
+				replaced := make(chan id.Signatory, 4)
+				opts := handshake.DefaultOncePoolOptions().
+					WithClock(fake).
+					WithReconnectPolicy(policy).
+					WithOnReplace(func(remote id.Signatory, addr string) {
+						replaced <- remote
+					})
+				pool1 := handshake.NewOncePool(opts)
+				pool2 := handshake.NewOncePool(opts)
+
+				privKey1 := id.NewPrivKey()
+				privKey2 := id.NewPrivKey()
+				h1 := handshake.Once(privKey1.Signatory(), &pool1, handshake.ECIES(privKey1))
+				h2 := handshake.Once(privKey2.Signatory(), &pool2, handshake.ECIES(privKey2))
+
+				connect := func() (conn, conn) {
+					conn1, conn2 := net.Pipe()
+					ch := make(chan conn, 1)
+					go func() {
+						enc, dec, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+						ch <- conn{conn: conn2, enc: enc, dec: dec, err: err}
+					}()
+					enc, dec, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+					return conn{conn: conn1, enc: enc, dec: dec, err: err}, <-ch
+				}
+				remove := func(c1, c2 conn) {
+					pool1.Remove(privKey2.Signatory(), c1.conn)
+					pool2.Remove(privKey1.Signatory(), c2.conn)
+				}
+				return connect, replaced, remove
+			}
+			setup := func(fake *clock.Fake, policy handshake.ReconnectPolicy) (func() (conn, conn), chan id.Signatory) {
+				connect, replaced, _ := setupWithRemove(fake, policy)
+				return connect, replaced
+			}
+
+			// exchange a message both ways over an established connection, so
+			// that both peers record activity on it.
+			exchange := func(c1, c2 conn) {
+				for _, pair := range [][2]conn{{c1, c2}, {c2, c1}} {
+					from, to := pair[0], pair[1]
+					go from.enc(from.conn, []byte{0x42})
+					buf := [128]byte{}
+					_, err := to.dec(to.conn, buf[:1])
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}
+
+			Context("when replacing dead connections", func() {
+				It("should keep an active connection", func() {
+					fake := clock.NewFake(time.Now())
+					connect, replaced := setup(fake, handshake.ReconnectReplaceIfDead)
+
+					old1, old2 := connect()
+					Expect(old1.err).ToNot(HaveOccurred())
+					Expect(old2.err).ToNot(HaveOccurred())
+
+					fake.Advance(2 * handshake.DefaultMinimumExpiryAge)
+					exchange(old1, old2)
+					new1, new2 := connect()
+					Expect(new1.err).To(HaveOccurred())
+					Expect(new2.err).To(HaveOccurred())
+					Expect(replaced).ToNot(Receive())
+
+					// The existing connection is still usable.
+					exchange(old1, old2)
+				})
+
+				It("should replace an inactive connection", func() {
+					fake := clock.NewFake(time.Now())
+					connect, replaced := setup(fake, handshake.ReconnectReplaceIfDead)
+
+					old1, old2 := connect()
+					Expect(old1.err).ToNot(HaveOccurred())
+					Expect(old2.err).ToNot(HaveOccurred())
+					exchange(old1, old2)
+
+					fake.Advance(2 * handshake.DefaultMinimumExpiryAge)
+					new1, new2 := connect()
+					Expect(new1.err).ToNot(HaveOccurred())
+					Expect(new2.err).ToNot(HaveOccurred())
+					Expect(replaced).To(Receive())
+					Expect(replaced).To(Receive())
+				})
+			})
+
+			Context("when always replacing connections", func() {
+				It("should replace an active connection", func() {
+					fake := clock.NewFake(time.Now())
+					connect, replaced := setup(fake, handshake.ReconnectReplace)
+
+					old1, old2 := connect()
+					Expect(old1.err).ToNot(HaveOccurred())
+					Expect(old2.err).ToNot(HaveOccurred())
+					exchange(old1, old2)
+
+					new1, new2 := connect()
+					Expect(new1.err).ToNot(HaveOccurred())
+					Expect(new2.err).ToNot(HaveOccurred())
+					Expect(replaced).To(Receive())
+					Expect(replaced).To(Receive())
+					exchange(new1, new2)
+				})
+			})
+
+			Context("when always keeping connections", func() {
+				It("should reject a new connection, even if the existing one is inactive", func() {
+					fake := clock.NewFake(time.Now())
+					connect, replaced := setup(fake, handshake.ReconnectKeep)
+
+					old1, old2 := connect()
+					Expect(old1.err).ToNot(HaveOccurred())
+					Expect(old2.err).ToNot(HaveOccurred())
+
+					fake.Advance(2 * handshake.DefaultMinimumExpiryAge)
+					new1, new2 := connect()
+					Expect(new1.err).To(HaveOccurred())
+					Expect(new2.err).To(HaveOccurred())
+					Expect(replaced).ToNot(Receive())
+					exchange(old1, old2)
+				})
+			})
+
+			Context("when the existing connection has been closed", func() {
+				for _, policy := range []handshake.ReconnectPolicy{
+					handshake.ReconnectReplaceIfDead,
+					handshake.ReconnectReplace,
+					handshake.ReconnectKeep,
+				} {
+					policy := policy
+					It(fmt.Sprintf("should accept a new connection when the policy is %v", policy), func() {
+						fake := clock.NewFake(time.Now())
+						connect, replaced := setup(fake, policy)
+
+						old1, old2 := connect()
+						Expect(old1.err).ToNot(HaveOccurred())
+						Expect(old2.err).ToNot(HaveOccurred())
+						exchange(old1, old2)
+
+						// Closing the connection fails the reads that are
+						// waiting on it, which removes it from the pools.
+						Expect(old1.conn.Close()).To(Succeed())
+						for _, old := range []conn{old1, old2} {
+							buf := [128]byte{}
+							_, err := old.dec(old.conn, buf[:1])
+							Expect(err).To(HaveOccurred())
+						}
+
+						new1, new2 := connect()
+						Expect(new1.err).ToNot(HaveOccurred())
+						Expect(new2.err).ToNot(HaveOccurred())
+						Expect(replaced).ToNot(Receive())
+						exchange(new1, new2)
+					})
+
+					It(fmt.Sprintf("should accept a new connection once it is removed when the policy is %v", policy), func() {
+						fake := clock.NewFake(time.Now())
+						connect, replaced, remove := setupWithRemove(fake, policy)
+
+						old1, old2 := connect()
+						Expect(old1.err).ToNot(HaveOccurred())
+						Expect(old2.err).ToNot(HaveOccurred())
+						exchange(old1, old2)
+
+						Expect(old1.conn.Close()).To(Succeed())
+						remove(old1, old2)
+
+						new1, new2 := connect()
+						Expect(new1.err).ToNot(HaveOccurred())
+						Expect(new2.err).ToNot(HaveOccurred())
+						Expect(replaced).ToNot(Receive())
+						exchange(new1, new2)
+					})
+				}
+			})
+		})
 	})
 })
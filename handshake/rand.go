@@ -0,0 +1,16 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// randOrDefault returns the source of randomness, or crypto/rand.Reader if it
+// is nil. Handshakes only use another source of randomness when it is given
+// explicitly, so that a predictable source is never used by accident.
+func randOrDefault(random io.Reader) io.Reader {
+	if random == nil {
+		return rand.Reader
+	}
+	return random
+}
@@ -0,0 +1,151 @@
+package handshake_test
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countingReader is a deterministic source of randomness that counts the bytes
+// that are read from it.
+type countingReader struct {
+	mu *sync.Mutex
+	r  *rand.Rand
+	n  int
+}
+
+func newCountingReader(seed int64) *countingReader {
+	return &countingReader{mu: new(sync.Mutex), r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func (r *countingReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.n
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+var _ = Describe("Random sources", func() {
+	run := func(h1, h2 handshake.Handshake) (codec.Encoder, codec.Decoder, net.Conn, codec.Encoder, codec.Decoder, net.Conn, error, error) {
+		conn1, conn2 := net.Pipe()
+
+		type result struct {
+			enc codec.Encoder
+			dec codec.Decoder
+			err error
+		}
+		resultCh := make(chan result, 1)
+		go func() {
+			enc, dec, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			resultCh <- result{enc, dec, err}
+		}()
+		enc1, dec1, _, err1 := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		if err1 != nil {
+			conn1.Close()
+		}
+		r := <-resultCh
+		return enc1, dec1, conn1, r.enc, r.dec, conn2, err1, r.err
+	}
+
+	Context("when using an ECIES handshake with a source of randomness", func() {
+		It("should read from the source, and establish a working session", func() {
+			random1, random2 := newCountingReader(1), newCountingReader(2)
+			h1 := handshake.ECIESWithRand(handshake.NewInMemKeys(id.NewPrivKey()), 0, random1)
+			h2 := handshake.ECIESWithRand(handshake.NewInMemKeys(id.NewPrivKey()), 0, random2)
+			enc1, _, conn1, _, dec2, conn2, err1, err2 := run(h1, h2)
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(random1.count()).To(BeNumerically(">", 0))
+			Expect(random2.count()).To(BeNumerically(">", 0))
+
+			go func() {
+				defer GinkgoRecover()
+				_, err := enc1(conn1, []byte("hello"))
+				Expect(err).ToNot(HaveOccurred())
+			}()
+			buf := make([]byte, 5, 5+16)
+			_, err := dec2(conn2, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf).To(Equal([]byte("hello")))
+		})
+
+		It("should fail if the source fails", func() {
+			h1 := handshake.ECIESWithRand(handshake.NewInMemKeys(id.NewPrivKey()), 0, failingReader{})
+			h2 := handshake.ECIES(id.NewPrivKey())
+			_, _, conn1, _, _, conn2, err1, _ := run(h1, h2)
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(err1).To(HaveOccurred())
+		})
+	})
+
+	Context("when using a network handshake with a source that fails", func() {
+		It("should fail", func() {
+			key := []byte("network")
+			h1 := handshake.NetworkWithRand(key, failingReader{}, handshake.ECIES(id.NewPrivKey()))
+			h2 := handshake.Network(key, handshake.ECIES(id.NewPrivKey()))
+			_, _, conn1, _, _, conn2, err1, _ := run(h1, h2)
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(err1).To(HaveOccurred())
+		})
+	})
+
+	Context("when using an authenticate handshake with a source of randomness", func() {
+		It("should read from the source", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			random := newCountingReader(1)
+			h1 := handshake.AuthenticateWithRand(handshake.NewInMemKeys(privKey1), 0, random, handshake.ECIES(privKey1))
+			h2 := handshake.Authenticate(privKey2, handshake.ECIES(privKey2))
+			_, _, conn1, _, _, conn2, err1, err2 := run(h1, h2)
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(random.count()).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when the source is nil", func() {
+		It("should use crypto/rand", func() {
+			var random io.Reader
+			h1 := handshake.ECIESWithRand(handshake.NewInMemKeys(id.NewPrivKey()), 0, random)
+			h2 := handshake.ECIES(id.NewPrivKey())
+			_, _, conn1, _, _, conn2, err1, err2 := run(h1, h2)
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,129 @@
+package handshake
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrTooManyPreviousKeys is returned by a Rotate Handshake when the remote peer
+// declares more than MaxPreviousKeys previous keys.
+var ErrTooManyPreviousKeys = errors.New("too many previous keys")
+
+// MaxPreviousKeys is the maximum number of previous keys that a peer can
+// present during a Rotate Handshake.
+const MaxPreviousKeys = 8
+
+const (
+	rotateProofSize = 65
+	rotateOverhead  = 16
+)
+
+var rotateDomain = []byte("aw/handshake/rotate")
+
+// Rotate returns a Handshake that allows peers to rotate their long-term keys,
+// without losing remote peers that still know them by a previous signatory.
+// After running the wrapped Handshake, which must authenticate the current
+// key of each peer, both peers write a proof for each of their previous keys:
+// a signature, by the previous key, over the current signatory. Each remote
+// proof is checked against the signatory returned by the wrapped Handshake,
+// and the previous signatory that produced it is passed to the onRotated
+// function, if there is one. Only the holder of a previous key can produce a
+// proof for it, so a remote peer cannot claim to be the successor of a
+// signatory that it does not control. Both peers must use a Rotate Handshake,
+// even if they have no previous keys.
+func Rotate(current id.Signatory, previous []*id.PrivKey, onRotated func(previous, current id.Signatory), h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+		if len(previous) > MaxPreviousKeys {
+			return nil, nil, remote, fmt.Errorf("%w: expected at most %v, got %v", ErrTooManyPreviousKeys, MaxPreviousKeys, len(previous))
+		}
+
+		localProofs := make([]byte, 0, len(previous)*rotateProofSize)
+		hash := rotateHash(current)
+		for _, privKey := range previous {
+			proof, err := privKey.Sign(&hash)
+			if err != nil {
+				return nil, nil, remote, fmt.Errorf("sign rotation proof: %v", err)
+			}
+			localProofs = append(localProofs, proof[:]...)
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+
+			if _, err := enc(conn, []byte{byte(len(previous))}); err != nil {
+				errCh <- fmt.Errorf("write rotation proof count: %v", err)
+				return
+			}
+			if len(localProofs) == 0 {
+				return
+			}
+			if _, err := enc(conn, localProofs); err != nil {
+				errCh <- fmt.Errorf("write rotation proofs: %v", err)
+				return
+			}
+		}()
+
+		// The buffers have extra capacity for decoders, such as the GCMDecoder,
+		// that decode into the capacity beyond the length of the buffer.
+		remoteCount := [1 + rotateOverhead]byte{}
+		if _, err := dec(conn, remoteCount[:1]); err != nil {
+			return nil, nil, remote, fmt.Errorf("read rotation proof count: %w", err)
+		}
+		if remoteCount[0] > MaxPreviousKeys {
+			return nil, nil, remote, fmt.Errorf("%w: expected at most %v, got %v", ErrTooManyPreviousKeys, MaxPreviousKeys, remoteCount[0])
+		}
+		remoteProofs := [MaxPreviousKeys*rotateProofSize + rotateOverhead]byte{}
+		n := int(remoteCount[0]) * rotateProofSize
+		if n > 0 {
+			if _, err := dec(conn, remoteProofs[:n]); err != nil {
+				return nil, nil, remote, fmt.Errorf("read rotation proofs: %w", err)
+			}
+		}
+
+		// Wait for the writing goroutine to end, so that the caller has
+		// exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, remote, err
+		}
+
+		remoteHash := rotateHash(remote)
+		for i := 0; i < n; i += rotateProofSize {
+			proof := id.Signature{}
+			copy(proof[:], remoteProofs[i:i+rotateProofSize])
+			prev, err := proof.Signatory(&remoteHash)
+			if err != nil {
+				return nil, nil, remote, fmt.Errorf("recover previous signatory: %v", err)
+			}
+			if prev.Equal(&remote) {
+				continue
+			}
+			if onRotated != nil {
+				onRotated(prev, remote)
+			}
+		}
+		return enc, dec, remote, nil
+	})
+}
+
+// rotateHash returns the hash that is signed by a previous key to prove that
+// it has been rotated to the current signatory.
+func rotateHash(current id.Signatory) id.Hash {
+	hasher := sha256.New()
+	hasher.Write(rotateDomain)
+	hasher.Write(current[:])
+	hash := id.Hash{}
+	copy(hash[:], hasher.Sum(nil))
+	return hash
+}
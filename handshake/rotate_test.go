@@ -0,0 +1,66 @@
+package handshake_test
+
+import (
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rotate", func() {
+	type rotation struct {
+		previous, current id.Signatory
+	}
+
+	run := func(previous []*id.PrivKey) []rotation {
+		privKey1 := id.NewPrivKey()
+		privKey2 := id.NewPrivKey()
+		rotations := make(chan rotation, len(previous))
+		h1 := handshake.Rotate(privKey1.Signatory(), nil, func(previous, current id.Signatory) {
+			rotations <- rotation{previous: previous, current: current}
+		}, handshake.ECIES(privKey1))
+		h2 := handshake.Rotate(privKey2.Signatory(), previous, nil, handshake.ECIES(privKey2))
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			errCh <- err
+		}()
+		_, _, remote, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-errCh).ToNot(HaveOccurred())
+		Expect(remote).To(Equal(privKey2.Signatory()))
+
+		close(rotations)
+		result := []rotation{}
+		for r := range rotations {
+			Expect(r.current).To(Equal(remote))
+			result = append(result, r)
+		}
+		return result
+	}
+
+	Context("when the remote peer has previous keys", func() {
+		It("should report every previous signatory", func() {
+			previous := []*id.PrivKey{id.NewPrivKey(), id.NewPrivKey()}
+			rotations := run(previous)
+			Expect(rotations).To(HaveLen(2))
+			Expect(rotations[0].previous).To(Equal(previous[0].Signatory()))
+			Expect(rotations[1].previous).To(Equal(previous[1].Signatory()))
+		})
+	})
+
+	Context("when the remote peer has no previous keys", func() {
+		It("should not report any rotation", func() {
+			Expect(run(nil)).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,96 @@
+package handshake
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// ErrNotTLS is returned by a TLS Handshake when the connection is not a TLS
+// connection.
+var ErrNotTLS = errors.New("not a tls connection")
+
+// ErrTLSUnauthorized is returned by an AuthorizeTLS Handshake when the
+// authorization function rejects the state of a TLS connection.
+var ErrTLSUnauthorized = errors.New("tls unauthorized")
+
+// ErrNoPeerCertificates is returned by a TLS Handshake when the remote peer did
+// not present a certificate.
+var ErrNoPeerCertificates = errors.New("no peer certificates")
+
+// tlsConn is implemented by *tls.Conn, and by wrappers of it.
+type tlsConn interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// TLS returns a Handshake that identifies the remote peer by the certificate
+// chain that it presented during the TLS handshake of the connection, instead
+// of by its native key. The chain, starting with the leaf certificate, is
+// passed to the mapping function, which returns the signatory of the remote
+// peer (for example, by looking up the subject of the leaf certificate in a
+// directory). If the mapping function returns an error, then the Handshake
+// fails and the connection is closed. Nothing is written to, or read from, the
+// connection outside of the TLS handshake, and the encoder and decoder are
+// returned unchanged, because the connection is already encrypted.
+//
+// The connection must be a *tls.Conn (for example, by using tls.Listen and
+// tls.Dialer as the listen and dial functions of a Transport), and the TLS
+// configuration is responsible for verifying the certificate chain: servers
+// must use tls.RequireAndVerifyClientCert. The signatory of the local peer
+// must be the one that remote peers map its certificate to.
+func TLS(mapping func(chain []*x509.Certificate) (id.Signatory, error)) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		c, ok := conn.(tlsConn)
+		if !ok {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: got %T", ErrNotTLS, conn)
+		}
+		// The TLS handshake usually happens lazily, on the first read or
+		// write, so it has to be forced before there is a certificate chain.
+		if err := c.Handshake(); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("tls handshake: %w", err)
+		}
+		chain := c.ConnectionState().PeerCertificates
+		if len(chain) == 0 {
+			return nil, nil, id.Signatory{}, ErrNoPeerCertificates
+		}
+		remote, err := mapping(chain)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("map certificate %v: %w", chain[0].Subject, err)
+		}
+		return enc, dec, remote, nil
+	})
+}
+
+// AuthorizeTLS returns a Handshake that completes the TLS handshake of the
+// connection, and passes the state of the TLS connection to the authorization
+// function, before running the wrapped Handshake. This allows policies to
+// authorize remote peers by the server name (SNI) that they requested, the
+// protocol (ALPN) that was negotiated, or the certificates that they presented,
+// before any of the wrapped Handshake is done. For example, a node that serves
+// several tenants can reject remote peers that requested the server name of
+// another tenant. If the authorization function returns an error, then the
+// Handshake fails with ErrTLSUnauthorized. The authorization function is only
+// called for TLS connections: other connections are passed straight to the
+// wrapped Handshake.
+func AuthorizeTLS(authorize func(state *tls.ConnectionState) error, h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		c, ok := conn.(tlsConn)
+		if !ok {
+			return h(conn, enc, dec)
+		}
+		if err := c.Handshake(); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("tls handshake: %w", err)
+		}
+		state := c.ConnectionState()
+		if err := authorize(&state); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: %v", ErrTLSUnauthorized, err)
+		}
+		return h(conn, enc, dec)
+	})
+}
@@ -0,0 +1,232 @@
+package handshake_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS", func() {
+	// newCert returns a certificate for the common name, signed by the parent
+	// (or self-signed, if there is no parent).
+	newCert := func(name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          serial,
+			Subject:               pkix.Name{CommonName: name},
+			DNSNames:              []string{name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		Expect(err).ToNot(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).ToNot(HaveOccurred())
+		return cert, key
+	}
+
+	tlsCert := func(cert *x509.Certificate, key *ecdsa.PrivateKey, chain ...*x509.Certificate) tls.Certificate {
+		tlsCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+		for _, parent := range chain {
+			tlsCert.Certificate = append(tlsCert.Certificate, parent.Raw)
+		}
+		return tlsCert
+	}
+
+	// mapping identifies peers by the common name of their certificates.
+	mapping := func(directory map[string]id.Signatory) func(chain []*x509.Certificate) (id.Signatory, error) {
+		return func(chain []*x509.Certificate) (id.Signatory, error) {
+			sig, ok := directory[chain[0].Subject.CommonName]
+			if !ok {
+				return id.Signatory{}, fmt.Errorf("unknown peer %v", chain[0].Subject.CommonName)
+			}
+			return sig, nil
+		}
+	}
+
+	// runWith runs the Handshake between a TLS client and a TLS server.
+	runWith := func(h handshake.Handshake, clientConfig, serverConfig *tls.Config) (id.Signatory, id.Signatory, error, error) {
+		// TLS writes alerts that nobody reads, so a synchronous pipe cannot be
+		// used.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		conn1, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		conn2, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		client := tls.Client(conn1, clientConfig)
+		server := tls.Server(conn2, serverConfig)
+		defer client.Close()
+		defer server.Close()
+
+		type result struct {
+			remote id.Signatory
+			err    error
+		}
+		resultCh := make(chan result, 1)
+		go func() {
+			_, _, remote, err := h(server, codec.PlainEncoder, codec.PlainDecoder)
+			if err != nil {
+				// Unblock the other side of the handshake.
+				conn2.Close()
+			}
+			resultCh <- result{remote, err}
+		}()
+		_, _, remote, err := h(client, codec.PlainEncoder, codec.PlainDecoder)
+		if err != nil {
+			conn1.Close()
+		}
+		serverResult := <-resultCh
+		return remote, serverResult.remote, err, serverResult.err
+	}
+
+	// run the TLS Handshake between a client and a server, identifying both
+	// peers by the common name of their certificates.
+	run := func(clientCert, serverCert tls.Certificate, roots *x509.CertPool, directory map[string]id.Signatory) (id.Signatory, id.Signatory, error, error) {
+		return runWith(
+			handshake.TLS(mapping(directory)),
+			&tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "server"},
+			&tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert})
+	}
+
+	caCert, caKey := newCert("ca", true, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	clientCert, clientKey := newCert("client", false, caCert, caKey)
+	serverCert, serverKey := newCert("server", false, caCert, caKey)
+	clientSig := id.NewPrivKey().Signatory()
+	serverSig := id.NewPrivKey().Signatory()
+
+	Context("when both peers present certificates that are signed by the same CA", func() {
+		It("should map the certificates to the signatories", func() {
+			directory := map[string]id.Signatory{"client": clientSig, "server": serverSig}
+			remote1, remote2, err1, err2 := run(tlsCert(clientCert, clientKey, caCert), tlsCert(serverCert, serverKey, caCert), roots, directory)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(remote1).To(Equal(serverSig))
+			Expect(remote2).To(Equal(clientSig))
+		})
+	})
+
+	Context("when exporting keys from a TLS connection", func() {
+		It("should derive the same key on both peers", func() {
+			directory := map[string]id.Signatory{"client": clientSig, "server": serverSig}
+			exporters := make(chan *handshake.Exporter, 2)
+			h := handshake.Export(func(_ id.Signatory, exporter *handshake.Exporter) {
+				exporters <- exporter
+			}, handshake.TLS(mapping(directory)))
+			_, _, err1, err2 := runWith(
+				h,
+				&tls.Config{Certificates: []tls.Certificate{tlsCert(clientCert, clientKey, caCert)}, RootCAs: roots, ServerName: "server"},
+				&tls.Config{Certificates: []tls.Certificate{tlsCert(serverCert, serverKey, caCert)}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert})
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+
+			exporter1, exporter2 := <-exporters, <-exporters
+			Expect(exporter1.DeriveKey("test", 32)).To(Equal(exporter2.DeriveKey("test", 32)))
+		})
+	})
+
+	Context("when the certificate cannot be mapped to a signatory", func() {
+		It("should fail the handshake", func() {
+			directory := map[string]id.Signatory{"server": serverSig}
+			_, _, err1, err2 := run(tlsCert(clientCert, clientKey, caCert), tlsCert(serverCert, serverKey, caCert), roots, directory)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).To(HaveOccurred())
+		})
+	})
+
+	Context("when the client certificate is signed by an unknown CA", func() {
+		It("should fail the handshake", func() {
+			otherCACert, otherCAKey := newCert("other ca", true, nil, nil)
+			otherCert, otherKey := newCert("client", false, otherCACert, otherCAKey)
+			directory := map[string]id.Signatory{"client": clientSig, "server": serverSig}
+			_, _, _, err2 := run(tlsCert(otherCert, otherKey, otherCACert), tlsCert(serverCert, serverKey, caCert), roots, directory)
+			Expect(err2).To(HaveOccurred())
+		})
+	})
+
+	Context("when authorizing the state of the TLS connection", func() {
+		// authorize the server name, and the negotiated protocol, that were
+		// requested by the client.
+		authorize := func(state *tls.ConnectionState) error {
+			if state.ServerName != "server" {
+				return fmt.Errorf("unknown tenant %v", state.ServerName)
+			}
+			if state.NegotiatedProtocol != "aw" {
+				return fmt.Errorf("unknown protocol %v", state.NegotiatedProtocol)
+			}
+			return nil
+		}
+		directory := map[string]id.Signatory{"client": clientSig, "server": serverSig}
+		configs := func(serverName string) (*tls.Config, *tls.Config) {
+			return &tls.Config{Certificates: []tls.Certificate{tlsCert(clientCert, clientKey, caCert)}, RootCAs: roots, ServerName: serverName, InsecureSkipVerify: serverName != "server", NextProtos: []string{"aw"}},
+				&tls.Config{Certificates: []tls.Certificate{tlsCert(serverCert, serverKey, caCert)}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert, NextProtos: []string{"aw"}}
+		}
+
+		It("should run the wrapped handshake when the state is authorized", func() {
+			clientConfig, serverConfig := configs("server")
+			remote1, remote2, err1, err2 := runWith(handshake.AuthorizeTLS(authorize, handshake.TLS(mapping(directory))), clientConfig, serverConfig)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+			Expect(remote1).To(Equal(serverSig))
+			Expect(remote2).To(Equal(clientSig))
+		})
+
+		It("should fail the handshake when the state is not authorized", func() {
+			clientConfig, serverConfig := configs("other")
+			_, _, _, err2 := runWith(handshake.AuthorizeTLS(authorize, handshake.TLS(mapping(directory))), clientConfig, serverConfig)
+			Expect(errors.Is(err2, handshake.ErrTLSUnauthorized)).To(BeTrue())
+		})
+
+		It("should not be called for connections that are not TLS connections", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			called := false
+			h := handshake.AuthorizeTLS(func(*tls.ConnectionState) error {
+				called = true
+				return nil
+			}, handshake.TLS(nil))
+			_, _, _, err := h(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(errors.Is(err, handshake.ErrNotTLS)).To(BeTrue())
+			Expect(called).To(BeFalse())
+		})
+	})
+
+	Context("when the connection is not a TLS connection", func() {
+		It("should return a not TLS error", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			_, _, _, err := handshake.TLS(nil)(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(errors.Is(err, handshake.ErrNotTLS)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,61 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// Version returns a Handshake that negotiates the message version used by the
+// connection after running the wrapped Handshake. Both peers write the latest
+// message version that they understand using the encoder returned by the
+// wrapped Handshake, and then pick the lesser of the two, so that neither peer
+// writes messages that the other cannot read. The negotiated version is passed
+// to the onNegotiated function, if there is one. Both peers must use a Version
+// Handshake.
+func Version(local uint16, onNegotiated func(remote id.Signatory, version uint16), h Handshake) Handshake {
+	return classify(func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return nil, nil, remote, err
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+			localVersion := [2]byte{}
+			binary.BigEndian.PutUint16(localVersion[:], local)
+			if _, err := enc(conn, localVersion[:]); err != nil {
+				errCh <- fmt.Errorf("write version: %v", err)
+			}
+		}()
+
+		// The buffer has extra capacity for decoders, such as the GCMDecoder,
+		// that decode into the capacity beyond the length of the buffer.
+		remoteVersion := [128]byte{}
+		n, err := dec(conn, remoteVersion[:2])
+		if err != nil {
+			return nil, nil, remote, fmt.Errorf("read version: %w", err)
+		}
+		if n != 2 {
+			return nil, nil, remote, fmt.Errorf("read version: expected 2 bytes, got %v bytes", n)
+		}
+		if err, ok := <-errCh; ok {
+			return nil, nil, remote, err
+		}
+
+		version := binary.BigEndian.Uint16(remoteVersion[:2])
+		if local < version {
+			version = local
+		}
+		if onNegotiated != nil {
+			onNegotiated(remote, version)
+		}
+		return enc, dec, remote, nil
+	})
+}
@@ -0,0 +1,58 @@
+package handshake_test
+
+import (
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version", func() {
+	run := func(version1, version2 uint16) (uint16, uint16) {
+		privKey1 := id.NewPrivKey()
+		privKey2 := id.NewPrivKey()
+		negotiated1, negotiated2 := make(chan uint16, 1), make(chan uint16, 1)
+		h1 := handshake.Version(version1, func(_ id.Signatory, v uint16) { negotiated1 <- v }, handshake.ECIES(privKey1))
+		h2 := handshake.Version(version2, func(_ id.Signatory, v uint16) { negotiated2 <- v }, handshake.ECIES(privKey2))
+
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+			errCh <- err
+		}()
+		_, _, remote, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote).To(Equal(privKey2.Signatory()))
+		Expect(<-errCh).ToNot(HaveOccurred())
+
+		return <-negotiated1, <-negotiated2
+	}
+
+	Context("when both peers understand the same version", func() {
+		It("should negotiate that version", func() {
+			v1, v2 := run(5, 5)
+			Expect(v1).To(Equal(uint16(5)))
+			Expect(v2).To(Equal(uint16(5)))
+		})
+	})
+
+	Context("when one peer only understands an earlier version", func() {
+		It("should negotiate the earlier version", func() {
+			v1, v2 := run(5, 4)
+			Expect(v1).To(Equal(uint16(4)))
+			Expect(v2).To(Equal(uint16(4)))
+
+			v1, v2 = run(4, 5)
+			Expect(v1).To(Equal(uint16(4)))
+			Expect(v2).To(Equal(uint16(4)))
+		})
+	})
+})
@@ -0,0 +1,200 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+
+	"go.uber.org/zap"
+)
+
+// sendRetryInterval is how long to wait before retrying to grant credits that
+// could not be sent to the remote peer.
+const sendRetryInterval = 100 * time.Millisecond
+
+// flow is the credit-based flow control state of a Stream. The sending half
+// tracks the credits granted by the remote peer, and the receiving half tracks
+// the credits that should be granted to the remote peer. If flow control is
+// disabled, then a flow always has credits, and never grants any.
+type flow struct {
+	enabled          bool
+	maxWindow        int
+	autoTuneInterval time.Duration
+
+	mu *sync.Mutex
+	// credits is the number of messages that can be sent before the remote
+	// peer grants more credits.
+	credits int
+	// window is the number of credits that the remote peer is allowed to
+	// have outstanding.
+	window int
+	// consumed is the number of messages consumed since credits were last
+	// granted to the remote peer.
+	consumed int
+	// pending is the number of credits that need to be granted to the remote
+	// peer.
+	pending int
+	// granted is the time at which credits were last granted to the remote
+	// peer.
+	granted time.Time
+}
+
+func newFlow(opts Options) *flow {
+	window := opts.InitialWindow
+	if window > opts.StreamBufferSize {
+		window = opts.StreamBufferSize
+	}
+	return &flow{
+		enabled:          opts.FlowControl,
+		maxWindow:        opts.StreamBufferSize,
+		autoTuneInterval: opts.AutoTuneInterval,
+
+		mu:      new(sync.Mutex),
+		credits: window,
+		window:  window,
+		granted: time.Now(),
+	}
+}
+
+// takeCredit returns true if there is a credit for sending one message, and
+// uses it.
+func (f *flow) takeCredit() bool {
+	if !f.enabled {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.credits <= 0 {
+		return false
+	}
+	f.credits--
+	return true
+}
+
+// returnCredit that was taken, but not used.
+func (f *flow) returnCredit() {
+	if !f.enabled {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.credits++
+}
+
+// addCredits granted by the remote peer.
+func (f *flow) addCredits(credits int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.credits += credits
+}
+
+// consume one message, and return true if credits need to be granted to the
+// remote peer. Credits are granted once half of the window has been consumed,
+// so that the remote peer does not run out of credits while they are in
+// flight. If that happened within the auto-tune interval, then the window is
+// doubled, and the extra credits are granted too.
+func (f *flow) consume(now time.Time) bool {
+	if !f.enabled {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.consumed++
+	if f.consumed < (f.window+1)/2 {
+		return false
+	}
+	grant := f.consumed
+	if now.Sub(f.granted) < f.autoTuneInterval && f.window < f.maxWindow {
+		grow := f.window
+		if f.window+grow > f.maxWindow {
+			grow = f.maxWindow - f.window
+		}
+		f.window += grow
+		grant += grow
+	}
+	f.consumed = 0
+	f.pending += grant
+	f.granted = now
+	return true
+}
+
+// takeGrant returns the number of credits that need to be granted to the
+// remote peer, and forgets them.
+func (f *flow) takeGrant() int {
+	if !f.enabled {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending := f.pending
+	f.pending = 0
+	return pending
+}
+
+// returnGrant of credits that were taken, but could not be granted to the
+// remote peer, so that they are granted later.
+func (f *flow) returnGrant(credits int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pending += credits
+}
+
+// Window returns the number of credits that the remote peer is allowed to have
+// outstanding on the Stream. It is zero if flow control is disabled.
+func (stream *Stream) Window() int {
+	if !stream.flow.enabled {
+		return 0
+	}
+	stream.flow.mu.Lock()
+	defer stream.flow.mu.Unlock()
+
+	return stream.flow.window
+}
+
+// signal the Mux that there might be outbound messages, or credits, to send.
+func (m *Mux) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendWindow grants credits to the remote peer of the Stream, which must have
+// been acquired. If the credits cannot be sent, then they are returned, and
+// granted again after the retry interval. Otherwise, the remote peer would
+// never be able to send the messages that those credits allowed.
+func (m *Mux) sendWindow(ctx context.Context, stream *Stream, credits int) {
+	data := [4]byte{}
+	binary.BigEndian.PutUint32(data[:], uint32(credits))
+	msg := wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeWindow, Stream: uint16(stream.id), Data: data[:]}
+	m.send(ctx, stream.remote, msg, func(err error) {
+		m.opts.Logger.Error("send window", zap.String("remote", stream.remote.String()), zap.Uint16("stream", uint16(stream.id)), zap.Error(err))
+		time.AfterFunc(sendRetryInterval, func() {
+			stream.flow.returnGrant(credits)
+			m.signal()
+		})
+	})
+}
+
+// receiveWindow adds the credits granted by the remote peer to the Stream.
+// Windows are ignored if flow control is disabled.
+func (m *Mux) receiveWindow(stream *Stream, msg wire.Msg) {
+	if !m.opts.FlowControl {
+		return
+	}
+	if len(msg.Data) != 4 {
+		m.opts.Logger.Warn("bad window", zap.String("remote", stream.remote.String()), zap.Uint16("stream", uint16(stream.id)), zap.Int("size", len(msg.Data)))
+		return
+	}
+	stream.flow.addCredits(int(binary.BigEndian.Uint32(msg.Data)))
+	m.signal()
+}
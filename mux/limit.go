@@ -0,0 +1,203 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrTooManyStreams is returned when opening a Stream with a remote peer
+	// that already has the maximum number of Streams.
+	ErrTooManyStreams = errors.New("too many streams")
+	// ErrStreamRefused is returned when sending on a Stream that was refused
+	// by the remote peer, because the remote peer already had the maximum
+	// number of Streams.
+	ErrStreamRefused = errors.New("stream refused")
+	// ErrStreamClosed is returned when sending, or receiving, on a Stream that
+	// has been closed.
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+const (
+	maxStreamsSize     = 4
+	maxStreamsOverhead = 16
+)
+
+// Handshake returns a Handshake that exchanges the maximum number of Streams
+// after running the wrapped Handshake. Both peers use the lower of the two
+// maximums (where zero means that the number of Streams is not limited), so
+// that neither peer opens Streams that the other peer would refuse. Both peers
+// must use a Mux Handshake. The agreed maximum is kept until it is forgotten
+// (see Forget), or replaced by the next handshake with the remote peer.
+func (m *Mux) Handshake(h handshake.Handshake) handshake.Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+
+		local := m.opts.MaxStreams
+		if local < 0 {
+			local = 0
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+
+			localBuf := [maxStreamsSize]byte{}
+			binary.BigEndian.PutUint32(localBuf[:], uint32(local))
+			if _, err := enc(conn, localBuf[:]); err != nil {
+				errCh <- fmt.Errorf("write max streams: %v", err)
+				return
+			}
+		}()
+
+		remoteBuf := [maxStreamsSize + maxStreamsOverhead]byte{}
+		if _, err := dec(conn, remoteBuf[:maxStreamsSize]); err != nil {
+			return nil, nil, remote, fmt.Errorf("read max streams: %w", err)
+		}
+
+		// Wait for the writing goroutine to end, so that the caller has
+		// exclusive access to the connection.
+		if err, ok := <-errCh; ok {
+			return nil, nil, remote, err
+		}
+
+		agreed := local
+		if remoteMax := int(binary.BigEndian.Uint32(remoteBuf[:maxStreamsSize])); remoteMax > 0 && (agreed == 0 || remoteMax < agreed) {
+			agreed = remoteMax
+		}
+		m.streamsMu.Lock()
+		m.limits[remote] = agreed
+		m.streamsMu.Unlock()
+		return enc, dec, remote, nil
+	}
+}
+
+// MaxStreams returns the maximum number of Streams with the remote peer. It is
+// the maximum agreed during the handshake, or the maximum in the Options if
+// there was no handshake with the remote peer. Zero means that the number of
+// Streams is not limited.
+func (m *Mux) MaxStreams(remote id.Signatory) int {
+	m.streamsMu.Lock()
+	defer m.streamsMu.Unlock()
+
+	return m.maxStreams(remote)
+}
+
+// Forget the maximum number of Streams agreed with the remote peer during the
+// handshake, so that it falls back to the maximum in the Options. It must be
+// called once the connection with the remote peer is closed (for example, by
+// the OnClosed function of the Transport), otherwise the maxima of remote
+// peers that have gone away are kept forever.
+func (m *Mux) Forget(remote id.Signatory) {
+	m.streamsMu.Lock()
+	defer m.streamsMu.Unlock()
+
+	delete(m.limits, remote)
+}
+
+// maxStreams must be called while holding the streams mutex.
+func (m *Mux) maxStreams(remote id.Signatory) int {
+	if max, ok := m.limits[remote]; ok {
+		return max
+	}
+	if m.opts.MaxStreams < 0 {
+		return 0
+	}
+	return m.opts.MaxStreams
+}
+
+// OpenStream returns the logical Stream with the given identifier to the remote
+// peer. If the Stream does not exist, it is created, unless there are already
+// too many Streams with the remote peer, in which case ErrTooManyStreams is
+// returned.
+func (m *Mux) OpenStream(remote id.Signatory, streamID StreamID) (*Stream, error) {
+	return m.stream(remote, streamID, true)
+}
+
+// refuse a Stream that the remote peer tried to open. Refusals are sent by Run,
+// and are dropped if too many of them are waiting to be sent, so that a remote
+// peer cannot use them to make the Mux block.
+func (m *Mux) refuse(remote id.Signatory, streamID StreamID, err error) {
+	m.opts.Logger.Warn("refusing stream", zap.String("remote", remote.String()), zap.Uint16("stream", uint16(streamID)), zap.Error(err))
+	select {
+	case m.refusals <- streamKey{remote: remote, stream: streamID}:
+	default:
+	}
+}
+
+// sendRefusal tells the remote peer that its Stream was refused, and the
+// maximum number of Streams that it can have. Like other refusals that cannot
+// be sent straight away, the refusal is dropped if the remote peer is busy.
+func (m *Mux) sendRefusal(ctx context.Context, key streamKey) {
+	if !m.acquire(key.remote) {
+		return
+	}
+	data := [maxStreamsSize]byte{}
+	binary.BigEndian.PutUint32(data[:], uint32(m.MaxStreams(key.remote)))
+	msg := wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeStreamRefused, Stream: uint16(key.stream), Data: data[:]}
+	m.send(ctx, key.remote, msg, func(err error) {
+		m.opts.Logger.Error("send refusal", zap.String("remote", key.remote.String()), zap.Uint16("stream", uint16(key.stream)), zap.Error(err))
+	})
+}
+
+// receiveRefusal marks the Stream as refused by the remote peer. Refusals for
+// Streams that do not exist are ignored.
+func (m *Mux) receiveRefusal(from id.Signatory, msg wire.Msg) {
+	m.streamsMu.Lock()
+	stream, ok := m.streams[streamKey{remote: from, stream: StreamID(msg.Stream)}]
+	m.streamsMu.Unlock()
+	if !ok {
+		return
+	}
+	err := ErrStreamRefused
+	if len(msg.Data) == maxStreamsSize {
+		err = fmt.Errorf("%w: expected at most %v streams", ErrStreamRefused, binary.BigEndian.Uint32(msg.Data))
+	}
+
+	stream.refusedMu.Lock()
+	if stream.refused == nil {
+		stream.refused = err
+	}
+	stream.refusedMu.Unlock()
+	m.signal()
+}
+
+// Refused returns an error wrapping ErrStreamRefused if the remote peer has
+// refused the Stream, and nil otherwise.
+func (stream *Stream) Refused() error {
+	stream.refusedMu.Lock()
+	defer stream.refusedMu.Unlock()
+
+	return stream.refused
+}
+
+// drainRefused discards the outbound messages of the Stream if the remote peer
+// has refused it, because the remote peer would drop them anyway. It returns
+// true if the Stream was refused.
+func (stream *Stream) drainRefused() bool {
+	if stream.Refused() == nil {
+		return false
+	}
+	for {
+		select {
+		case <-stream.outbound:
+		default:
+			return true
+		}
+	}
+}
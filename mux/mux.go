@@ -0,0 +1,510 @@
+// Package mux implements multiplexing of logical streams over the single
+// connection that is kept with each remote peer. Every Msg is tagged with the
+// identifier of its stream, and each stream has its own ordering and
+// back-pressure. Outbound messages from different streams are interleaved, so
+// that a busy stream cannot starve other streams to the same remote peer.
+// Optionally, streams use credit-based flow control, so that a stream with a
+// slow consumer cannot overflow its inbound buffer (see
+// Options.WithFlowControl).
+package mux
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// Default options.
+var (
+	DefaultStreamBufferSize = 64
+	DefaultInitialWindow    = 16
+	DefaultAutoTuneInterval = 100 * time.Millisecond
+	DefaultMaxStreams       = 256
+)
+
+// A StreamID identifies a logical stream between two peers. The same StreamID
+// refers to the same logical stream on both peers.
+type StreamID uint16
+
+// A Sender sends messages to remote peers. The Transport implements this
+// interface.
+type Sender interface {
+	Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error
+}
+
+// Options used to parameterise the behaviour of a Mux.
+type Options struct {
+	Logger           *zap.Logger
+	StreamBufferSize int
+	FlowControl      bool
+	InitialWindow    int
+	AutoTuneInterval time.Duration
+	MaxStreams       int
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return Options{
+		Logger:           logger,
+		StreamBufferSize: DefaultStreamBufferSize,
+		InitialWindow:    DefaultInitialWindow,
+		AutoTuneInterval: DefaultAutoTuneInterval,
+		MaxStreams:       DefaultMaxStreams,
+	}
+}
+
+// WithLogger sets the Logger used by the Mux.
+func (opts Options) WithLogger(logger *zap.Logger) Options {
+	opts.Logger = logger
+	return opts
+}
+
+// WithStreamBufferSize sets the number of inbound, and outbound, messages that
+// can be buffered by each Stream. When the outbound buffer is full, sending on
+// the Stream blocks. When the inbound buffer is full, receiving messages for
+// the Stream blocks, which applies back-pressure to the remote peer through
+// its connection. Because the connection is shared, this also holds up the
+// other Streams from the same remote peer, so Streams with slow consumers
+// should use flow control (see WithFlowControl).
+func (opts Options) WithStreamBufferSize(size int) Options {
+	opts.StreamBufferSize = size
+	return opts
+}
+
+// WithFlowControl sets whether or not Streams use credit-based flow control.
+// With flow control, a Stream can only send as many messages as the remote
+// peer has granted it credits for, and the remote peer grants more credits as
+// messages are consumed from the Stream using Recv. This stops a fast sender
+// from overflowing the inbound buffer of a slow consumer, and stops a Stream
+// that has run out of credits from using the connection that it shares with
+// other Streams. Both peers must enable flow control, and use the same initial
+// window. By default, flow control is disabled.
+func (opts Options) WithFlowControl(flowControl bool) Options {
+	opts.FlowControl = flowControl
+	return opts
+}
+
+// WithInitialWindow sets the number of credits that each Stream starts with
+// when flow control is enabled. The window of a Stream grows, up to the
+// stream buffer size, while its messages are consumed quickly (see
+// WithAutoTuneInterval).
+func (opts Options) WithInitialWindow(window int) Options {
+	opts.InitialWindow = window
+	return opts
+}
+
+// WithAutoTuneInterval sets the interval used to tune the windows of Streams
+// when flow control is enabled. If half of the window of a Stream is consumed
+// within the interval, then the window is doubled (up to the stream buffer
+// size), so that Streams with high throughput are not limited by the time
+// taken to grant credits. Zero disables auto-tuning.
+func (opts Options) WithAutoTuneInterval(interval time.Duration) Options {
+	opts.AutoTuneInterval = interval
+	return opts
+}
+
+// WithMaxStreams sets the maximum number of Streams that a remote peer can
+// open. Messages that would open more Streams are dropped, and the remote peer
+// is told that the Stream was refused. Peers can agree on a lower maximum
+// during the handshake (see Handshake). Zero, or less, means that the number of
+// Streams is not limited.
+func (opts Options) WithMaxStreams(max int) Options {
+	opts.MaxStreams = max
+	return opts
+}
+
+type streamKey struct {
+	remote id.Signatory
+	stream StreamID
+}
+
+// A Mux multiplexes logical Streams over a Sender. Inbound messages must be
+// passed to the Mux using the Receive method (usually by using it as the
+// receiver of the Transport).
+type Mux struct {
+	opts   Options
+	sender Sender
+
+	// wake is signalled whenever an outbound message is buffered by one of
+	// the streams, or a remote peer is no longer busy.
+	wake chan struct{}
+	// done is closed once Run returns, so that receiving does not block
+	// forever after the Mux has stopped.
+	done     chan struct{}
+	doneOnce *sync.Once
+	// next is the position in the order from which the next round starts.
+	next int
+
+	// busy are the remote peers with a message that is being sent. At most
+	// one message is sent to each remote peer at a time, so that a slow
+	// remote peer does not hold up the Streams of other remote peers.
+	busyMu *sync.Mutex
+	busy   map[id.Signatory]bool
+
+	streamsMu *sync.Mutex
+	streams   map[streamKey]*Stream
+	order     []*Stream
+	// open is the number of Streams with each remote peer, and limits is the
+	// maximum number of Streams agreed with each remote peer during the
+	// handshake.
+	open   map[id.Signatory]int
+	limits map[id.Signatory]int
+
+	// refusals are the Streams that need to be refused, because they were
+	// opened by remote peers that had too many Streams.
+	refusals chan streamKey
+}
+
+// New returns a Mux that uses the Sender to send outbound messages. The Mux
+// must be Run before outbound messages are sent.
+func New(opts Options, sender Sender) *Mux {
+	return &Mux{
+		opts:   opts,
+		sender: sender,
+
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		doneOnce: new(sync.Once),
+
+		busyMu: new(sync.Mutex),
+		busy:   map[id.Signatory]bool{},
+
+		streamsMu: new(sync.Mutex),
+		streams:   map[streamKey]*Stream{},
+		order:     []*Stream{},
+		open:      map[id.Signatory]int{},
+		limits:    map[id.Signatory]int{},
+
+		refusals: make(chan streamKey, opts.StreamBufferSize),
+	}
+}
+
+// Stream returns the logical Stream with the given identifier to the remote
+// peer. If the Stream does not exist, it is created, even if there are already
+// too many Streams with the remote peer (see OpenStream).
+func (m *Mux) Stream(remote id.Signatory, streamID StreamID) *Stream {
+	stream, _ := m.stream(remote, streamID, false)
+	return stream
+}
+
+// stream returns the logical Stream with the given identifier to the remote
+// peer, and creates it if it does not exist. If limited is true, and there are
+// already too many Streams with the remote peer, then ErrTooManyStreams is
+// returned instead of creating the Stream.
+func (m *Mux) stream(remote id.Signatory, streamID StreamID, limited bool) (*Stream, error) {
+	m.streamsMu.Lock()
+	defer m.streamsMu.Unlock()
+
+	key := streamKey{remote: remote, stream: streamID}
+	if stream, ok := m.streams[key]; ok {
+		return stream, nil
+	}
+	if limited {
+		if max := m.maxStreams(remote); max > 0 && m.open[remote] >= max {
+			return nil, fmt.Errorf("opening stream %v: %w: expected at most %v streams", streamID, ErrTooManyStreams, max)
+		}
+	}
+	stream := &Stream{
+		mux:      m,
+		remote:   remote,
+		id:       streamID,
+		inbound:  make(chan wire.Msg, m.opts.StreamBufferSize),
+		outbound: make(chan wire.Msg, m.opts.StreamBufferSize),
+		flow:     newFlow(m.opts),
+
+		refusedMu: new(sync.Mutex),
+
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	m.streams[key] = stream
+	m.order = append(m.order, stream)
+	m.open[remote]++
+	return stream, nil
+}
+
+// Receive an inbound message from a remote peer, and deliver it to its Stream.
+// Messages that do not declare a Stream are delivered to the Stream with
+// identifier zero. If the inbound buffer of the Stream is full, then this
+// method blocks until there is room (or until Run returns), instead of
+// dropping the message. This method has the signature expected by the
+// receiver of the Transport, and never returns an error.
+func (m *Mux) Receive(from id.Signatory, packet wire.Packet) error {
+	msg := packet.Msg
+	if msg.Type == wire.MsgTypeStreamRefused {
+		m.receiveRefusal(from, msg)
+		return nil
+	}
+	stream, err := m.stream(from, StreamID(msg.Stream), true)
+	if err != nil {
+		m.refuse(from, StreamID(msg.Stream), err)
+		return nil
+	}
+	if msg.Type == wire.MsgTypeWindow {
+		m.receiveWindow(stream, msg)
+		return nil
+	}
+	select {
+	case stream.inbound <- msg:
+	case <-stream.closed:
+		m.opts.Logger.Warn("stream closed", zap.String("remote", from.String()), zap.Uint16("stream", msg.Stream))
+	case <-m.done:
+		m.opts.Logger.Warn("stream stopped", zap.String("remote", from.String()), zap.Uint16("stream", msg.Stream))
+	}
+	return nil
+}
+
+// Run the Mux, sending outbound messages from all Streams until the context is
+// done. Streams are visited in a round-robin order, and at most one message is
+// sent from each Stream per round, so that messages from different Streams are
+// interleaved. Messages are sent in the background, one at a time to each
+// remote peer, so that a slow remote peer does not hold up the Streams of
+// other remote peers. This method blocks until the context is done.
+func (m *Mux) Run(ctx context.Context) {
+	defer m.doneOnce.Do(func() { close(m.done) })
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case key := <-m.refusals:
+			m.sendRefusal(ctx, key)
+			continue
+		}
+
+		for m.round(ctx) {
+		}
+	}
+}
+
+// round starts sending at most one outbound message from each Stream whose
+// remote peer is not busy. It returns true if any message was started.
+func (m *Mux) round(ctx context.Context) bool {
+	m.streamsMu.Lock()
+	order := make([]*Stream, len(m.order))
+	copy(order, m.order)
+	m.streamsMu.Unlock()
+	if len(order) == 0 {
+		return false
+	}
+
+	// Start from where the previous round stopped, so that the Streams
+	// that were skipped (because their remote peer was busy) are not
+	// starved by the Streams before them.
+	sent := false
+	start := m.next % len(order)
+	for i := range order {
+		if ctx.Err() != nil {
+			return false
+		}
+		stream := order[(start+i)%len(order)]
+		if stream.drainRefused() {
+			continue
+		}
+		if !m.acquire(stream.remote) {
+			continue
+		}
+		if credits := stream.flow.takeGrant(); credits > 0 {
+			sent = true
+			m.next = start + i + 1
+			m.sendWindow(ctx, stream, credits)
+			continue
+		}
+		if !stream.flow.takeCredit() {
+			// The Stream must wait for the remote peer to grant it more
+			// credits.
+			m.release(stream.remote)
+			continue
+		}
+		select {
+		case msg := <-stream.outbound:
+			sent = true
+			m.next = start + i + 1
+			m.send(ctx, stream.remote, msg, func(err error) {
+				m.opts.Logger.Error("send", zap.String("remote", stream.remote.String()), zap.Uint16("stream", uint16(stream.id)), zap.Error(err))
+			})
+		default:
+			stream.flow.returnCredit()
+			m.release(stream.remote)
+		}
+	}
+	return sent
+}
+
+// acquire the remote peer for sending one message. It returns false if the
+// remote peer is busy.
+func (m *Mux) acquire(remote id.Signatory) bool {
+	m.busyMu.Lock()
+	defer m.busyMu.Unlock()
+
+	if m.busy[remote] {
+		return false
+	}
+	m.busy[remote] = true
+	return true
+}
+
+// release the remote peer, and signal the Mux, so that the next message can
+// be sent to it.
+func (m *Mux) release(remote id.Signatory) {
+	m.busyMu.Lock()
+	delete(m.busy, remote)
+	m.busyMu.Unlock()
+
+	m.signal()
+}
+
+// send a message to a remote peer that has been acquired, in the background.
+// The remote peer is released once the message has been sent, and onErr is
+// called if sending fails.
+func (m *Mux) send(ctx context.Context, remote id.Signatory, msg wire.Msg, onErr func(error)) {
+	go func() {
+		defer m.release(remote)
+
+		if err := m.sender.Send(ctx, remote, msg); err != nil {
+			onErr(err)
+		}
+	}()
+}
+
+// A Stream is a logical, ordered, stream of messages to and from a remote peer.
+// Streams are safe for concurrent use.
+type Stream struct {
+	mux    *Mux
+	remote id.Signatory
+	id     StreamID
+
+	inbound  chan wire.Msg
+	outbound chan wire.Msg
+	flow     *flow
+
+	refusedMu *sync.Mutex
+	refused   error
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// Remote returns the remote peer of the Stream.
+func (stream *Stream) Remote() id.Signatory {
+	return stream.remote
+}
+
+// ID returns the identifier of the Stream.
+func (stream *Stream) ID() StreamID {
+	return stream.id
+}
+
+// Send a message on the Stream. The message is tagged with the identifier of
+// the Stream, and upgraded to wire.MsgVersion3 if necessary. This method
+// blocks until the message is buffered, or until the context is done. If the
+// remote peer has refused the Stream, then ErrStreamRefused is returned, and if
+// the Stream has been closed, then ErrStreamClosed is returned.
+func (stream *Stream) Send(ctx context.Context, msg wire.Msg) error {
+	if err := stream.Refused(); err != nil {
+		return fmt.Errorf("sending on stream %v: %w", stream.id, err)
+	}
+	select {
+	case <-stream.closed:
+		return fmt.Errorf("sending on stream %v: %w", stream.id, ErrStreamClosed)
+	default:
+	}
+	if msg.Version < wire.MsgVersion3 {
+		msg.Version = wire.MsgVersion3
+	}
+	msg.Stream = uint16(stream.id)
+
+	select {
+	case stream.outbound <- msg:
+	default:
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sending on stream %v: %w", stream.id, ctx.Err())
+		case <-stream.closed:
+			return fmt.Errorf("sending on stream %v: %w", stream.id, ErrStreamClosed)
+		case stream.outbound <- msg:
+		}
+	}
+	stream.mux.signal()
+	return nil
+}
+
+// Inbound returns the channel of messages that have been received on the
+// Stream. When flow control is enabled, messages must be consumed with Recv
+// instead, because consuming messages from the channel does not grant credits
+// to the remote peer.
+func (stream *Stream) Inbound() <-chan wire.Msg {
+	return stream.inbound
+}
+
+// Recv returns the next message that has been received on the Stream. When
+// flow control is enabled, consuming the message grants credits to the remote
+// peer, so that it can send more messages on the Stream. This method blocks
+// until there is a message, or until the context is done. Once the Stream has
+// been closed, the messages that were already received are returned, and then
+// ErrStreamClosed is returned.
+func (stream *Stream) Recv(ctx context.Context) (wire.Msg, error) {
+	select {
+	case msg := <-stream.inbound:
+		return stream.consume(msg), nil
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return wire.Msg{}, fmt.Errorf("receiving on stream %v: %w", stream.id, ctx.Err())
+	case <-stream.closed:
+		return wire.Msg{}, fmt.Errorf("receiving on stream %v: %w", stream.id, ErrStreamClosed)
+	case msg := <-stream.inbound:
+		return stream.consume(msg), nil
+	}
+}
+
+func (stream *Stream) consume(msg wire.Msg) wire.Msg {
+	if stream.flow.consume(time.Now()) {
+		stream.mux.signal()
+	}
+	return msg
+}
+
+// Close the Stream, and remove it from the Mux, so that it no longer counts
+// towards the maximum number of Streams with the remote peer. Outbound
+// messages that have not been sent are dropped. The maximum agreed during the
+// handshake is kept, even once the remote peer has no Streams, because it
+// holds for as long as the connection is open (see Forget). Opening a Stream
+// with the same identifier after closing it returns a new Stream. Closing a
+// Stream more than once does nothing.
+func (stream *Stream) Close() {
+	stream.closeOnce.Do(func() {
+		m := stream.mux
+		m.streamsMu.Lock()
+		defer m.streamsMu.Unlock()
+
+		close(stream.closed)
+		key := streamKey{remote: stream.remote, stream: stream.id}
+		if m.streams[key] != stream {
+			return
+		}
+		delete(m.streams, key)
+		for i := range m.order {
+			if m.order[i] == stream {
+				m.order = append(m.order[:i], m.order[i+1:]...)
+				break
+			}
+		}
+		m.open[stream.remote]--
+		if m.open[stream.remote] <= 0 {
+			delete(m.open, stream.remote)
+		}
+	})
+}
@@ -0,0 +1,463 @@
+package mux_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/mux"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+	"github.com/muirglacier/surge"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// loopback is a Sender that records sent messages, and delivers them to
+// another Mux.
+type loopback struct {
+	self id.Signatory
+	to   *mux.Mux
+
+	sentMu *sync.Mutex
+	sent   []wire.Msg
+}
+
+func (l *loopback) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	l.sentMu.Lock()
+	l.sent = append(l.sent, msg)
+	l.sentMu.Unlock()
+
+	// Round-trip the message through its binary representation, to make
+	// sure that the stream is part of the wire format.
+	data, err := surge.ToBinary(msg)
+	if err != nil {
+		return err
+	}
+	received := wire.Msg{}
+	if err := surge.FromBinary(&received, data); err != nil {
+		return err
+	}
+	return l.to.Receive(l.self, wire.Packet{Msg: received})
+}
+
+// senderFunc is a Sender that calls a function.
+type senderFunc func(ctx context.Context, remote id.Signatory, msg wire.Msg) error
+
+func (f senderFunc) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	return f(ctx, remote, msg)
+}
+
+var _ = Describe("Mux", func() {
+	newPair := func() (*mux.Mux, *mux.Mux, *loopback, id.Signatory, id.Signatory) {
+		self, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+		opts := mux.DefaultOptions().WithStreamBufferSize(10)
+		receiver := mux.New(opts, nil)
+		sender := &loopback{self: self, to: receiver, sentMu: new(sync.Mutex)}
+		return mux.New(opts, sender), receiver, sender, self, remote
+	}
+
+	Context("when sending on multiple streams", func() {
+		It("should deliver messages to the matching stream in order", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m, receiver, _, self, remote := newPair()
+			go m.Run(ctx)
+
+			for i := 0; i < 10; i++ {
+				Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{Data: []byte{1, byte(i)}})).To(Succeed())
+				Expect(m.Stream(remote, 2).Send(ctx, wire.Msg{Data: []byte{2, byte(i)}})).To(Succeed())
+			}
+			for i := 0; i < 10; i++ {
+				var msg wire.Msg
+				Eventually(receiver.Stream(self, 2).Inbound()).Should(Receive(&msg))
+				Expect(msg.Stream).To(Equal(uint16(2)))
+				Expect(msg.Data).To(Equal([]byte{2, byte(i)}))
+			}
+			for i := 0; i < 10; i++ {
+				var msg wire.Msg
+				Eventually(receiver.Stream(self, 1).Inbound()).Should(Receive(&msg))
+				Expect(msg.Stream).To(Equal(uint16(1)))
+				Expect(msg.Data).To(Equal([]byte{1, byte(i)}))
+			}
+		})
+
+		It("should interleave messages from different streams", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m, _, sender, _, remote := newPair()
+			for i := 0; i < 5; i++ {
+				Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{})).To(Succeed())
+			}
+			for i := 0; i < 5; i++ {
+				Expect(m.Stream(remote, 2).Send(ctx, wire.Msg{})).To(Succeed())
+			}
+			go m.Run(ctx)
+
+			Eventually(func() int {
+				sender.sentMu.Lock()
+				defer sender.sentMu.Unlock()
+				return len(sender.sent)
+			}).Should(Equal(10))
+			sender.sentMu.Lock()
+			defer sender.sentMu.Unlock()
+			for i, msg := range sender.sent {
+				Expect(msg.Stream).To(Equal(uint16(1 + i%2)))
+			}
+		})
+	})
+
+	Context("when the outbound buffer of a stream is full", func() {
+		It("should block until the context is done", func() {
+			m, _, _, _, remote := newPair()
+			for i := 0; i < 10; i++ {
+				Expect(m.Stream(remote, 1).Send(context.Background(), wire.Msg{})).To(Succeed())
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{})).ToNot(Succeed())
+			Expect(m.Stream(remote, 2).Send(ctx, wire.Msg{})).To(Succeed())
+		})
+	})
+
+	Context("when the inbound buffer of a stream is full", func() {
+		It("should block instead of dropping messages", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m, receiver, _, self, remote := newPair()
+			go m.Run(ctx)
+			go receiver.Run(ctx)
+
+			for i := 0; i < 20; i++ {
+				Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+			}
+			// Wait for the inbound buffer to fill up before consuming it.
+			Eventually(func() int { return len(receiver.Stream(self, 1).Inbound()) }).Should(Equal(10))
+			for i := 0; i < 20; i++ {
+				var msg wire.Msg
+				Eventually(receiver.Stream(self, 1).Inbound()).Should(Receive(&msg))
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+		})
+	})
+
+	Context("when a remote peer is slow", func() {
+		It("should not hold up the streams of other remote peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			slow, fast := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			unblock := make(chan struct{})
+			sent := make(chan id.Signatory, 10)
+			m := mux.New(mux.DefaultOptions(), senderFunc(func(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+				if remote == slow {
+					<-unblock
+				}
+				sent <- remote
+				return nil
+			}))
+			go m.Run(ctx)
+
+			Expect(m.Stream(slow, 1).Send(ctx, wire.Msg{})).To(Succeed())
+			Expect(m.Stream(fast, 1).Send(ctx, wire.Msg{})).To(Succeed())
+			Expect(m.Stream(fast, 1).Send(ctx, wire.Msg{})).To(Succeed())
+			Eventually(sent).Should(Receive(Equal(fast)))
+			Eventually(sent).Should(Receive(Equal(fast)))
+			close(unblock)
+			Eventually(sent).Should(Receive(Equal(slow)))
+		})
+	})
+
+	Context("when using flow control", func() {
+		// newFlowPair returns two Muxes that send to each other, so that
+		// credits can be granted.
+		newFlowPair := func(opts mux.Options) (*mux.Mux, *mux.Mux, id.Signatory, id.Signatory) {
+			self, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			toRemote := &loopback{self: self, sentMu: new(sync.Mutex)}
+			toSelf := &loopback{self: remote, sentMu: new(sync.Mutex)}
+			m, r := mux.New(opts, toRemote), mux.New(opts, toSelf)
+			toRemote.to, toSelf.to = r, m
+			return m, r, self, remote
+		}
+
+		It("should not let a slow stream stall a fast stream", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := mux.DefaultOptions().WithStreamBufferSize(16).WithFlowControl(true).WithInitialWindow(4).WithAutoTuneInterval(0)
+			m, r, self, remote := newFlowPair(opts)
+			go m.Run(ctx)
+			go r.Run(ctx)
+
+			// Nobody consumes the slow stream, so it only receives as many
+			// messages as its window allows.
+			for i := 0; i < 8; i++ {
+				Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+			}
+			slow := r.Stream(self, 1)
+			Eventually(func() int { return len(slow.Inbound()) }).Should(Equal(4))
+
+			// The fast stream sends many times its window, and its messages
+			// are consumed as quickly as they arrive.
+			n := 100
+			go func() {
+				defer GinkgoRecover()
+				for i := 0; i < n; i++ {
+					Expect(m.Stream(remote, 2).Send(ctx, wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+				}
+			}()
+			fast := r.Stream(self, 2)
+			for i := 0; i < n; i++ {
+				recvCtx, recvCancel := context.WithTimeout(ctx, 5*time.Second)
+				msg, err := fast.Recv(recvCtx)
+				recvCancel()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+			Consistently(func() int { return len(slow.Inbound()) }, 50*time.Millisecond).Should(Equal(4))
+
+			// Consuming the slow stream grants it the credits to deliver the
+			// rest of its messages.
+			for i := 0; i < 8; i++ {
+				recvCtx, recvCancel := context.WithTimeout(ctx, 5*time.Second)
+				msg, err := slow.Recv(recvCtx)
+				recvCancel()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+		})
+
+		It("should grow the window of a stream that is consumed quickly", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := mux.DefaultOptions().WithStreamBufferSize(16).WithFlowControl(true).WithInitialWindow(2).WithAutoTuneInterval(time.Hour)
+			m, r, self, remote := newFlowPair(opts)
+			go m.Run(ctx)
+			go r.Run(ctx)
+
+			go func() {
+				defer GinkgoRecover()
+				for i := 0; i < 50; i++ {
+					Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{})).To(Succeed())
+				}
+			}()
+			stream := r.Stream(self, 1)
+			Expect(stream.Window()).To(Equal(2))
+			for i := 0; i < 50; i++ {
+				recvCtx, recvCancel := context.WithTimeout(ctx, 5*time.Second)
+				_, err := stream.Recv(recvCtx)
+				recvCancel()
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(stream.Window()).To(Equal(16))
+		})
+
+		It("should grant credits again if granting them fails", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := mux.DefaultOptions().WithStreamBufferSize(4).WithFlowControl(true).WithInitialWindow(4).WithAutoTuneInterval(0)
+			self, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			toRemote := &loopback{self: self, sentMu: new(sync.Mutex)}
+			toSelf := &loopback{self: remote, sentMu: new(sync.Mutex)}
+			failed := false
+			m := mux.New(opts, toRemote)
+			r := mux.New(opts, senderFunc(func(ctx context.Context, to id.Signatory, msg wire.Msg) error {
+				// Fail to grant the first credits.
+				if msg.Type == wire.MsgTypeWindow && !failed {
+					failed = true
+					return errors.New("failed")
+				}
+				return toSelf.Send(ctx, to, msg)
+			}))
+			toRemote.to, toSelf.to = r, m
+			go m.Run(ctx)
+			go r.Run(ctx)
+
+			go func() {
+				defer GinkgoRecover()
+				for i := 0; i < 8; i++ {
+					Expect(m.Stream(remote, 1).Send(ctx, wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+				}
+			}()
+			stream := r.Stream(self, 1)
+			for i := 0; i < 8; i++ {
+				recvCtx, recvCancel := context.WithTimeout(ctx, 5*time.Second)
+				msg, err := stream.Recv(recvCtx)
+				recvCancel()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+		})
+	})
+
+	Context("when limiting the number of streams", func() {
+		// newLimitPair returns two Muxes, with different options, that send to
+		// each other, so that refusals can be sent back.
+		newLimitPair := func(opts, remoteOpts mux.Options) (*mux.Mux, *mux.Mux, id.Signatory, id.Signatory) {
+			self, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			toRemote := &loopback{self: self, sentMu: new(sync.Mutex)}
+			toSelf := &loopback{self: remote, sentMu: new(sync.Mutex)}
+			m, r := mux.New(opts, toRemote), mux.New(remoteOpts, toSelf)
+			toRemote.to, toSelf.to = r, m
+			return m, r, self, remote
+		}
+
+		It("should open streams up to the maximum", func() {
+			m, _, _, remote := newLimitPair(mux.DefaultOptions().WithMaxStreams(3), mux.DefaultOptions())
+			for i := 0; i < 3; i++ {
+				_, err := m.OpenStream(remote, mux.StreamID(i))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, err := m.OpenStream(remote, 3)
+			Expect(errors.Is(err, mux.ErrTooManyStreams)).To(BeTrue())
+
+			// Streams that are already open can still be opened again.
+			stream, err := m.OpenStream(remote, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stream.ID()).To(Equal(mux.StreamID(1)))
+		})
+
+		It("should open streams again after closing them", func() {
+			m, _, _, remote := newLimitPair(mux.DefaultOptions().WithMaxStreams(3), mux.DefaultOptions())
+			// Open many times the maximum, a few at a time.
+			for i := 0; i < 4; i++ {
+				streams := []*mux.Stream{}
+				for j := 0; j < 3; j++ {
+					stream, err := m.OpenStream(remote, mux.StreamID(3*i+j))
+					Expect(err).ToNot(HaveOccurred())
+					streams = append(streams, stream)
+				}
+				_, err := m.OpenStream(remote, 100)
+				Expect(errors.Is(err, mux.ErrTooManyStreams)).To(BeTrue())
+				for _, stream := range streams {
+					stream.Close()
+				}
+			}
+
+			// Closed streams cannot be used, and closing them again does
+			// nothing.
+			stream, err := m.OpenStream(remote, 100)
+			Expect(err).ToNot(HaveOccurred())
+			stream.Close()
+			stream.Close()
+			Expect(errors.Is(stream.Send(context.Background(), wire.Msg{}), mux.ErrStreamClosed)).To(BeTrue())
+			_, err = stream.Recv(context.Background())
+			Expect(errors.Is(err, mux.ErrStreamClosed)).To(BeTrue())
+
+			// Reopening a closed stream returns a new stream.
+			reopened, err := m.OpenStream(remote, 100)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reopened).ToNot(BeIdenticalTo(stream))
+			Expect(reopened.Send(context.Background(), wire.Msg{})).To(Succeed())
+		})
+
+		It("should refuse streams opened by the remote peer beyond the maximum", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m, r, self, remote := newLimitPair(mux.DefaultOptions().WithMaxStreams(0), mux.DefaultOptions().WithMaxStreams(2))
+			go m.Run(ctx)
+			go r.Run(ctx)
+
+			for i := 0; i < 3; i++ {
+				Expect(m.Stream(remote, mux.StreamID(i)).Send(ctx, wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+			}
+
+			// The streams up to the maximum are accepted.
+			for i := 0; i < 2; i++ {
+				recvCtx, recvCancel := context.WithTimeout(ctx, 5*time.Second)
+				msg, err := r.Stream(self, mux.StreamID(i)).Recv(recvCtx)
+				recvCancel()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Data).To(Equal([]byte{byte(i)}))
+			}
+
+			// The stream beyond the maximum is refused, and the sender is told
+			// about it.
+			refused := m.Stream(remote, 2)
+			Eventually(refused.Refused).Should(HaveOccurred())
+			Expect(errors.Is(refused.Refused(), mux.ErrStreamRefused)).To(BeTrue())
+			err := refused.Send(ctx, wire.Msg{})
+			Expect(errors.Is(err, mux.ErrStreamRefused)).To(BeTrue())
+			_, err = r.OpenStream(self, 2)
+			Expect(errors.Is(err, mux.ErrTooManyStreams)).To(BeTrue())
+
+			// The accepted streams are not affected.
+			Expect(m.Stream(remote, 0).Refused()).ToNot(HaveOccurred())
+			Expect(m.Stream(remote, 0).Send(ctx, wire.Msg{})).To(Succeed())
+		})
+
+		It("should agree on the lower maximum during the handshake", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			m1 := mux.New(mux.DefaultOptions().WithMaxStreams(8), nil)
+			m2 := mux.New(mux.DefaultOptions().WithMaxStreams(4), nil)
+			h1 := m1.Handshake(handshake.ECIES(privKey1))
+			h2 := m2.Handshake(handshake.ECIES(privKey2))
+
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+				errCh <- err
+			}()
+			_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errCh).ToNot(HaveOccurred())
+
+			Expect(m1.MaxStreams(privKey2.Signatory())).To(Equal(4))
+			Expect(m2.MaxStreams(privKey1.Signatory())).To(Equal(4))
+			Expect(m1.MaxStreams(id.NewPrivKey().Signatory())).To(Equal(8))
+		})
+
+		It("should keep the agreed maximum until it is forgotten", func() {
+			privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+			m1 := mux.New(mux.DefaultOptions().WithMaxStreams(256), nil)
+			m2 := mux.New(mux.DefaultOptions().WithMaxStreams(4), nil)
+			h1 := m1.Handshake(handshake.ECIES(privKey1))
+			h2 := m2.Handshake(handshake.ECIES(privKey2))
+
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, _, _, err := h2(conn2, codec.PlainEncoder, codec.PlainDecoder)
+				errCh <- err
+			}()
+			_, _, _, err := h1(conn1, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errCh).ToNot(HaveOccurred())
+
+			// Closing all of the streams does not forget the agreed maximum.
+			remote := privKey2.Signatory()
+			stream, err := m1.OpenStream(remote, 0)
+			Expect(err).ToNot(HaveOccurred())
+			stream.Close()
+			for i := 0; i < 4; i++ {
+				_, err := m1.OpenStream(remote, mux.StreamID(i))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			_, err = m1.OpenStream(remote, 4)
+			Expect(errors.Is(err, mux.ErrTooManyStreams)).To(BeTrue())
+
+			// Once the connection is closed, the agreed maximum is forgotten.
+			m1.Forget(remote)
+			Expect(m1.MaxStreams(remote)).To(Equal(256))
+		})
+	})
+})
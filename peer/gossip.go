@@ -3,6 +3,7 @@ package peer
 import (
 	"context"
 	"encoding/base64"
+	"math/rand"
 	"sync"
 
 	"github.com/muirglacier/aw/channel"
@@ -53,11 +54,24 @@ func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash
 		subnet = &DefaultSubnet
 	}
 
+	// When the transport is at capacity, it will not dial new peers, so only
+	// peers that are already connected are worth gossiping to.
+	atCapacity := g.transport.AtCapacity()
+
 	recipients := []id.Signatory{}
 	if subnet.Equal(&DefaultSubnet) {
-		recipients = g.transport.Table().Peers(g.opts.Alpha)
+		if atCapacity {
+			recipients = connectedPeers(g.transport, g.opts.Alpha)
+		} else {
+			recipients = g.transport.Table().Peers(g.opts.Alpha)
+		}
 	} else {
-		if recipients = g.transport.Table().Subnet(*subnet); len(recipients) > g.opts.Alpha {
+		recipients = g.transport.Table().Subnet(*subnet)
+		if atCapacity {
+			recipients = onlyConnected(g.transport, recipients)
+		}
+		recipients = g.transport.NearestPeers(recipients)
+		if len(recipients) > g.opts.Alpha {
 			recipients = recipients[:g.opts.Alpha]
 		}
 	}
@@ -227,3 +241,31 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 
 	g.Gossip(ctx, msg.Data, &subnet)
 }
+
+// connectedPeers returns at most n random peers that the transport is connected
+// to, preferring the nearest peers (see transport.Transport.NearestPeers). The
+// connected peers are sorted, so they are shuffled explicitly, which makes the
+// selection reproducible when the random source is seeded.
+func connectedPeers(t *transport.Transport, n int) []id.Signatory {
+	peers := t.ConnectedPeers()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	peers = t.NearestPeers(peers)
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// onlyConnected returns the peers that the transport is connected to, in the
+// same order.
+func onlyConnected(t *transport.Transport, peers []id.Signatory) []id.Signatory {
+	connected := make([]id.Signatory, 0, len(peers))
+	for _, peer := range peers {
+		if t.IsConnected(peer) {
+			connected = append(connected, peer)
+		}
+	}
+	return connected
+}
@@ -83,6 +83,10 @@ func (p *Peer) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) {
 	p.gossiper.Gossip(ctx, contentID, subnet)
 }
 
+func (p *Peer) Route(ctx context.Context, key id.Hash, msg wire.Msg) error {
+	return p.gossiper.Route(ctx, key, msg)
+}
+
 func (p *Peer) DiscoverPeers(ctx context.Context) {
 	p.discoveryClient.DiscoverPeers(ctx)
 }
@@ -25,6 +25,12 @@ func setup(numPeers int) ([]peer.Options, []*peer.Peer, []dht.Table, []dht.Conte
 }
 
 func setupWithLogger(numPeers int, logger *zap.Logger) ([]peer.Options, []*peer.Peer, []dht.Table, []dht.ContentResolver, []*channel.Client, []*transport.Transport) {
+	return setupWithTransportOptions(numPeers, logger, func(_ int, opts transport.Options) transport.Options { return opts })
+}
+
+// setupWithTransportOptions is the same as setupWithLogger, but the transport
+// options of each peer are passed through the function before they are used.
+func setupWithTransportOptions(numPeers int, logger *zap.Logger, transportOpts func(i int, opts transport.Options) transport.Options) ([]peer.Options, []*peer.Peer, []dht.Table, []dht.ContentResolver, []*channel.Client, []*transport.Transport) {
 	// Init options for all peers.
 	opts := make([]peer.Options, numPeers)
 	for i := range opts {
@@ -47,11 +53,11 @@ func setupWithLogger(numPeers int, logger *zap.Logger) ([]peer.Options, []*peer.
 		tables[i] = dht.NewInMemTable(self)
 		contentResolvers[i] = dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil)
 		transports[i] = transport.New(
-			transport.DefaultOptions().
+			transportOpts(i, transport.DefaultOptions().
 				WithLogger(logger).
 				WithClientTimeout(5*time.Second).
 				WithOncePoolOptions(handshake.DefaultOncePoolOptions().WithMinimumExpiryAge(10*time.Second)).
-				WithPort(uint16(3333+i)),
+				WithPort(uint16(3333+i))),
 			self,
 			clients[i],
 			h,
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/muirglacier/aw/transport"
@@ -29,13 +30,9 @@ func NewDiscoveryClient(opts DiscoveryOptions, transport *transport.Transport) *
 }
 
 func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
-	var pingData [2]byte
-	binary.LittleEndian.PutUint16(pingData[:], dc.transport.Port())
-
 	msg := wire.Msg{
 		Version: wire.MsgVersion1,
 		Type:    wire.MsgTypePing,
-		Data:    pingData[:],
 	}
 
 	ticker := time.NewTicker(dc.opts.PingTimePeriod)
@@ -45,6 +42,9 @@ func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
 	sendDuration := dc.opts.PingTimePeriod / time.Duration(alpha)
 Outer:
 	for {
+		// The data is re-computed every round, so that it follows changes to
+		// the announce address of the Transport.
+		msg.Data = pingData(dc.transport)
 		for _, sig := range dc.transport.Table().Peers(alpha) {
 			err := func() error {
 				innerCtx, innerCancel := context.WithTimeout(ctx, sendDuration)
@@ -90,18 +90,34 @@ func (dc *DiscoveryClient) didReceivePing(from id.Signatory, ipAddr net.Addr, ms
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if dataLen := len(msg.Data); dataLen != 2 {
-		return fmt.Errorf("malformed port received in ping message. expected: 2 bytes, received: %v bytes", dataLen)
+	addrs, err := decodePingData(msg.Data)
+	if err != nil {
+		return fmt.Errorf("malformed ping message: %v", err)
 	}
-	port := binary.LittleEndian.Uint16(msg.Data)
+	addr := pickPingAddress(dc.transport.Self(), addrs)
 
-	dc.transport.Table().AddPeer(
-		from,
-		wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("%v:%v", ipAddr.(*net.TCPAddr).IP.String(), port), uint64(time.Now().UnixNano())),
-	)
+	// Hosts that cannot be dialed by the local peer are replaced by the IP
+	// address from which the ping was received. Formatting the address as a
+	// net.TCPAddr brackets IPv6 addresses, and keeps the zone of link-local
+	// addresses.
+	tcpAddr := ipAddr.(*net.TCPAddr)
+	value := net.JoinHostPort(addr.host, strconv.Itoa(int(addr.port)))
+	if !dialableHost(addr.host, tcpAddr.IP) {
+		value = (&net.TCPAddr{IP: tcpAddr.IP, Port: int(addr.port), Zone: tcpAddr.Zone}).String()
+	}
+	dc.transport.Table().AddPeer(from, wire.NewUnsignedAddress(wire.TCP, value, wire.NewNonce()))
 
 	peers := dc.transport.Table().Peers(dc.opts.MaxExpectedPeers)
-	addrAndSig := make([]wire.SignatoryAndAddress, 0, len(peers))
+	addrAndSig := make([]wire.SignatoryAndAddress, 0, len(peers)+1)
+	// The announce address is acknowledged first, so that the remote peer
+	// learns the address at which it can reach the local peer, instead of
+	// only the address from which the local peer connects.
+	if announce, ok := dc.transport.AnnounceAddress(); ok {
+		addrAndSig = append(addrAndSig, wire.SignatoryAndAddress{
+			Signatory: dc.transport.Self(),
+			Address:   wire.NewUnsignedAddress(wire.TCP, announce, wire.NewNonce()),
+		})
+	}
 	for _, sig := range peers {
 		addr, addrOk := dc.transport.Table().PeerAddress(sig)
 		if !addrOk {
@@ -140,3 +156,119 @@ func (dc *DiscoveryClient) didReceivePingAck(from id.Signatory, msg wire.Msg) er
 	}
 	return nil
 }
+
+// A pingAddress is one of the addresses advertised by a ping, and the weight
+// with which remote peers should pick it.
+type pingAddress struct {
+	host   string
+	port   uint16
+	weight uint32
+}
+
+// pingData returns the addresses on which the Transport can be reached, and
+// their weights. If there is an announce address, then it is the only address
+// that is advertised, because the listen addresses might not be reachable (for
+// example, when their ports are not forwarded by a NAT). A Transport that only
+// has one address, and that does not know a host that remote peers can dial,
+// sends the two-byte port that peers have always expected. Otherwise, each
+// address is encoded as a little-endian uint32 weight, followed by the length
+// of the address as one byte, followed by the "host:port" address itself.
+// Addresses with a weight of zero are not advertised.
+func pingData(t *transport.Transport) []byte {
+	addrs, weights := t.ListenAddresses(), t.ListenWeights()
+	if announce, ok := t.AnnounceAddress(); ok {
+		addrs, weights = []string{announce}, []int{1}
+	}
+	if len(addrs) == 1 {
+		if host, _, err := net.SplitHostPort(addrs[0]); err == nil && !dialableHost(host, nil) {
+			data := [2]byte{}
+			binary.LittleEndian.PutUint16(data[:], t.AnnouncePort())
+			return data[:]
+		}
+	}
+
+	data := []byte{}
+	for i, addr := range addrs {
+		if weights[i] <= 0 || len(addr) > 255 {
+			continue
+		}
+		entry := [5]byte{}
+		binary.LittleEndian.PutUint32(entry[:4], uint32(weights[i]))
+		entry[4] = byte(len(addr))
+		data = append(data, entry[:]...)
+		data = append(data, addr...)
+	}
+	return data
+}
+
+// decodePingData returns the addresses in the data of a ping. The two-byte
+// form only carries a port, so the host of its address is empty.
+func decodePingData(data []byte) ([]pingAddress, error) {
+	if len(data) == 2 {
+		return []pingAddress{{port: binary.LittleEndian.Uint16(data), weight: 1}}, nil
+	}
+	addrs := []pingAddress{}
+	for len(data) > 0 {
+		if len(data) < 5 || len(data) < 5+int(data[4]) {
+			return nil, fmt.Errorf("expected an address, got %v bytes", len(data))
+		}
+		weight := binary.LittleEndian.Uint32(data[:4])
+		addr := string(data[5 : 5+int(data[4])])
+		data = data[5+int(data[4]):]
+
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("bad address %q: %v", addr, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q: %v", addr, err)
+		}
+		if weight == 0 {
+			continue
+		}
+		addrs = append(addrs, pingAddress{host: host, port: uint16(port), weight: weight})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("expected at least one address")
+	}
+	return addrs, nil
+}
+
+// pickPingAddress returns one of the addresses in the data of a ping, with a
+// probability that is proportional to its weight. Every peer picks the address
+// based on its own identity, so the remote peers that dial a peer with several
+// listen addresses are spread across all of them, and each peer keeps dialing
+// the same address.
+func pickPingAddress(self id.Signatory, addrs []pingAddress) pingAddress {
+	total := uint64(0)
+	for _, addr := range addrs {
+		total += uint64(addr.weight)
+	}
+	x := binary.LittleEndian.Uint64(self[:8]) % total
+	for _, addr := range addrs {
+		if x < uint64(addr.weight) {
+			return addr
+		}
+		x -= uint64(addr.weight)
+	}
+	return addrs[len(addrs)-1]
+}
+
+// dialableHost returns true if the host can be dialed by a peer that receives
+// it from the IP address. Empty and unspecified hosts can never be dialed.
+// Loopback hosts can only be dialed from a loopback IP address (or, when the
+// IP address is nil, they are never assumed to be dialable).
+func dialableHost(host string, from net.IP) bool {
+	if host == "" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		return false
+	}
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return from != nil && from.IsLoopback()
+	}
+	return true
+}
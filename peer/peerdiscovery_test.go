@@ -193,4 +193,90 @@ var _ = Describe("Peer Discovery", func() {
 			}(ctx)
 		})
 	})
+
+	Context("when a peer has an announce address", func() {
+		It("should be learned by the other peers, even after it changes", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			Expect(transports[1].SetAnnounceAddress("0.0.0.0:4444")).ToNot(Succeed())
+			Expect(transports[1].SetAnnounceAddress("localhost:4444")).To(Succeed())
+			Expect(transports[1].AnnouncePort()).To(Equal(uint16(4444)))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].DiscoverPeers(ctx)
+			}
+
+			peerAddress := func() string {
+				addr, _ := tables[0].PeerAddress(transports[1].Self())
+				return addr.Value
+			}
+			Eventually(peerAddress, 5*time.Second).Should(HaveSuffix(":4444"))
+		})
+	})
+
+	Context("when a peer listens on several addresses", func() {
+		It("should advertise the full addresses, in proportion to their weights", func() {
+			_, peers, tables, _, _, transports := setupWithTransportOptions(2, zap.NewNop(), func(i int, opts transport.Options) transport.Options {
+				if i != 0 {
+					return opts
+				}
+				// The host and port of the first peer are not advertised, so
+				// the other peer must learn its additional address.
+				return opts.
+					WithListenAddresses("127.0.0.1:3583").
+					WithListenWeights(map[string]int{"localhost:3333": 0})
+			})
+			Expect(transports[0].ListenWeights()).To(Equal([]int{0, 1}))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(transports[1].Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			go peers[0].DiscoverPeers(ctx)
+
+			peerAddress := func() string {
+				addr, _ := tables[1].PeerAddress(transports[0].Self())
+				return addr.Value
+			}
+			Eventually(peerAddress, 5*time.Second).Should(Equal("127.0.0.1:3583"))
+		})
+
+		Context("when the peer also has an announce address", func() {
+			It("should only advertise the announce address", func() {
+				_, peers, tables, _, _, transports := setupWithTransportOptions(2, zap.NewNop(), func(i int, opts transport.Options) transport.Options {
+					if i != 0 {
+						return opts
+					}
+					// The additional address would be preferred, if it was
+					// advertised.
+					return opts.
+						WithListenAddresses("127.0.0.1:3584").
+						WithListenWeights(map[string]int{"localhost:3333": 0}).
+						WithAnnounceAddress("localhost:4445")
+				})
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				for i := range peers {
+					go peers[i].Run(ctx)
+				}
+				tables[0].AddPeer(transports[1].Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+				go peers[0].DiscoverPeers(ctx)
+
+				peerAddress := func() string {
+					addr, _ := tables[1].PeerAddress(transports[0].Self())
+					return addr.Value
+				}
+				Eventually(peerAddress, 5*time.Second).Should(HaveSuffix(":4445"))
+				Consistently(peerAddress, time.Second).Should(HaveSuffix(":4445"))
+			})
+		})
+	})
 })
@@ -0,0 +1,55 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// Route a message to the Alpha peers that are closest to the routing key, using
+// XORing as the measure of distance. This allows sharded applications to send
+// messages to the peers responsible for the shard of the key. The message is
+// tagged with the routing key, so that receivers can make their own placement
+// decisions, but it is not forwarded any further. An error is returned if there
+// are no peers to route to, or if the message could not be sent to any of them.
+// The context can carry a transport.Budget (see transport.WithBudget), to bound
+// the dial attempts made across all of the peers.
+func (g *Gossiper) Route(ctx context.Context, key id.Hash, msg wire.Msg) error {
+	recipients := g.transport.Table().ClosestPeers(key, g.opts.Alpha)
+	if g.transport.AtCapacity() {
+		recipients = onlyConnected(g.transport, recipients)
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("route %v: %w", key, ErrPeerNotFound)
+	}
+	msg = msg.WithRoutingKey(key)
+
+	errsMu := new(sync.Mutex)
+	errs := make([]error, 0, len(recipients))
+	wg := new(sync.WaitGroup)
+	for i := range recipients {
+		recipient := recipients[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			innerContext, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+			defer cancel()
+
+			if err := g.transport.Send(innerContext, recipient, msg); err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == len(recipients) {
+		return fmt.Errorf("route %v: %w", key, errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/muirglacier/aw/peer"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route", func() {
+	Context("when routing a message by key", func() {
+		It("should send the message, with its routing key, to the closest peers", func() {
+			n := 3
+			opts, peers, tables, _, _, _ := setup(n)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			key := id.NewHash([]byte("shard"))
+			routed := make(chan id.Signatory, 16)
+			for i := range peers {
+				i := i
+				go peers[i].Run(ctx)
+				if i == 0 {
+					continue
+				}
+				peers[i].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					msg := packet.Msg
+					if msg.Version == wire.MsgVersion4 && msg.RoutingKey != nil && msg.RoutingKey.Equal(&key) && string(msg.Data) == "hello" {
+						routed <- opts[i].PrivKey.Signatory()
+					}
+					return nil
+				})
+			}
+			for i := 1; i < n; i++ {
+				tables[0].AddPeer(opts[i].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP,
+						fmt.Sprintf("%v:%v", "localhost", uint16(3333+i)), uint64(time.Now().UnixNano())))
+			}
+
+			// The peers might not be listening yet, so keep routing until
+			// all of them have received the message.
+			recipients := map[id.Signatory]struct{}{}
+			Eventually(func() int {
+				peers[0].Route(ctx, key, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")})
+				for {
+					select {
+					case recipient := <-routed:
+						recipients[recipient] = struct{}{}
+					case <-time.After(100 * time.Millisecond):
+						return len(recipients)
+					}
+				}
+			}, 10*time.Second).Should(Equal(n - 1))
+		})
+	})
+
+	Context("when there are no peers", func() {
+		It("should return a peer not found error", func() {
+			_, peers, _, _, _, _ := setup(1)
+			err := peers[0].Route(context.Background(), id.NewHash([]byte("shard")), wire.Msg{})
+			Expect(errors.Is(err, peer.ErrPeerNotFound)).To(BeTrue())
+		})
+	})
+})
@@ -113,7 +113,16 @@ func (syncer *Syncer) Sync(ctx context.Context, contentID []byte, hint *id.Signa
 	// Get addresses close to our address. We will iterate over these addresses
 	// in order and attempt to synchronise content by sending them pull
 	// messages.
-	peers := syncer.transport.Table().RandomPeers(syncer.opts.Alpha)
+	peers := []id.Signatory{}
+	if syncer.transport.AtCapacity() {
+		// New peers will not be dialed, so only pull from peers that are
+		// already connected.
+		peers = connectedPeers(syncer.transport, syncer.opts.Alpha)
+	} else {
+		peers = syncer.transport.Table().RandomPeers(syncer.opts.Alpha)
+	}
+	// Pull from the nearest peers first.
+	peers = syncer.transport.NearestPeers(peers)
 	if hint != nil {
 		peers = append([]id.Signatory{*hint}, peers...)
 	}
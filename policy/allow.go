@@ -84,6 +84,31 @@ func Any(fs ...Allow) Allow {
 	}
 }
 
+// RemoteIP returns the IP address of the remote end of a connection, without
+// the port. The zone of IPv6 link-local addresses is kept (for example,
+// "fe80::1%eth0"), because the same IP address on different interfaces can
+// belong to different peers. If the remote address is not an IP address, then
+// it is returned unchanged.
+func RemoteIP(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		if addr.Zone != "" {
+			return addr.IP.String() + "%" + addr.Zone
+		}
+		return addr.IP.String()
+	case *net.UDPAddr:
+		if addr.Zone != "" {
+			return addr.IP.String() + "%" + addr.Zone
+		}
+		return addr.IP.String()
+	}
+	remoteAddr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
 // RateLimit returns an Allow function that rejects an IP-address if it attempts
 // too many connections too quickly.
 func RateLimit(r rate.Limit, b, cap int) Allow {
@@ -92,12 +117,7 @@ func RateLimit(r rate.Limit, b, cap int) Allow {
 	back := make(map[string]*rate.Limiter, cap)
 
 	return func(conn net.Conn) (error, Cleanup) {
-		remoteAddr := ""
-		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-			remoteAddr = tcpAddr.IP.String()
-		} else {
-			remoteAddr = conn.RemoteAddr().String()
-		}
+		remoteAddr := RemoteIP(conn)
 
 		allow := func(limiter *rate.Limiter) (error, func()) {
 			if limiter.Allow() {
@@ -1 +1,53 @@
 package policy_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/policy"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn remoteAddrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+var _ = Describe("Allow", func() {
+	Context("when getting the remote IP address of a connection", func() {
+		It("should remove the port and keep the zone", func() {
+			remoteIP := func(addr net.Addr) string {
+				return policy.RemoteIP(remoteAddrConn{remoteAddr: addr})
+			}
+			Expect(remoteIP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3333})).To(Equal("127.0.0.1"))
+			Expect(remoteIP(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 3333})).To(Equal("::1"))
+			Expect(remoteIP(&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 3333, Zone: "eth0"})).To(Equal("fe80::1%eth0"))
+			Expect(remoteIP(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 3333, Zone: "eth1"})).To(Equal("fe80::1%eth1"))
+
+			pipe, _ := net.Pipe()
+			Expect(remoteIP(pipe.RemoteAddr())).To(Equal("pipe"))
+		})
+	})
+
+	Context("when rate limiting link-local addresses", func() {
+		It("should limit each zone separately", func() {
+			allow := policy.RateLimit(rate.Every(time.Hour), 1, 16)
+			eth0 := remoteAddrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 3333, Zone: "eth0"}}
+			eth1 := remoteAddrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 3333, Zone: "eth1"}}
+
+			err, _ := allow(eth0)
+			Expect(err).ToNot(HaveOccurred())
+			err, _ = allow(eth0)
+			Expect(err).To(Equal(policy.ErrRateLimited))
+			err, _ = allow(eth1)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,276 @@
+package policy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrAdmissionQueueFull is returned when a connection is dropped because there
+// is no free slot, and no room for it to wait for one (either because the
+// queue is full, or because its IP address already has the most waiting
+// connections that an IP address is allowed).
+var ErrAdmissionQueueFull = errors.New("admission queue full")
+
+// DefaultMaxQueuedPerIP is the default number of connections from one IP
+// address that can wait for a free slot in a FairAdmission.
+var DefaultMaxQueuedPerIP = 8
+
+// ErrAdmissionTimeout is returned when a connection is dropped because it
+// waited too long for a free slot.
+var ErrAdmissionTimeout = errors.New("admission timeout")
+
+// Fairness selects the algorithm used by a FairAdmission to decide which
+// waiting connection is given the next free slot.
+type Fairness uint8
+
+// Enumerate all Fairness values.
+const (
+	// FairRoundRobin gives free slots to the IP addresses with waiting
+	// connections in turn, so every IP address gets the same share of the
+	// free slots, no matter how many connections it is attempting.
+	FairRoundRobin Fairness = iota
+	// FairLeastAccepted gives the next free slot to the waiting IP address
+	// with the fewest accepted connections, so IP addresses that already hold
+	// many slots are served last.
+	FairLeastAccepted
+)
+
+// String returns a human-readable representation of the Fairness.
+func (fairness Fairness) String() string {
+	switch fairness {
+	case FairRoundRobin:
+		return "round robin"
+	case FairLeastAccepted:
+		return "least accepted"
+	default:
+		return "unknown"
+	}
+}
+
+// admissionWaiter is a connection that is waiting for a free slot. The
+// admitted channel is closed when it is given one.
+type admissionWaiter struct {
+	ip       string
+	admitted chan struct{}
+}
+
+// A FairAdmission bounds the number of connections that are accepted at any
+// one time, and queues connections while there are no free slots. When a slot
+// is freed, it is given to a waiting connection with the Fairness algorithm,
+// instead of to whichever connection arrived first, so that a few aggressive
+// IP addresses cannot monopolise the accepted connections during a
+// connection flood. It is safe for concurrent use.
+//
+// Connections wait inside of the Allow method, so it must only be used by
+// listeners that call Allow in the goroutine of the connection (see
+// tcp.ListenOptions.WithDeferAllow). Otherwise, waiting connections stop the
+// listener from accepting other connections.
+type FairAdmission struct {
+	slots          int
+	fairness       Fairness
+	maxQueued      int
+	maxQueuedPerIP int
+	timeout        time.Duration
+
+	mu       *sync.Mutex
+	admitted int
+	accepted map[string]int
+	queues   map[string][]*admissionWaiter
+	// order of the IP addresses with waiting connections. An IP address is
+	// moved to the back whenever it is given a slot.
+	order  []string
+	queued int
+}
+
+// NewFairAdmission returns a FairAdmission that accepts at most slots
+// connections at any one time. At most maxQueued connections can wait for a
+// free slot, for at most the timeout, and at most DefaultMaxQueuedPerIP of them
+// can be from the same IP address (see WithMaxQueuedPerIP).
+func NewFairAdmission(slots int, fairness Fairness, maxQueued int, timeout time.Duration) *FairAdmission {
+	return &FairAdmission{
+		slots:          slots,
+		fairness:       fairness,
+		maxQueued:      maxQueued,
+		maxQueuedPerIP: DefaultMaxQueuedPerIP,
+		timeout:        timeout,
+
+		mu:       new(sync.Mutex),
+		accepted: map[string]int{},
+		queues:   map[string][]*admissionWaiter{},
+	}
+}
+
+// WithMaxQueuedPerIP sets the maximum number of connections from the same IP
+// address that can wait for a free slot, and returns the FairAdmission. This
+// stops one IP address that floods the FairAdmission with connections from
+// filling the queue, and leaving no room for other IP addresses to wait. Zero,
+// or less, means that the number is only bounded by the size of the queue. By
+// default, it is DefaultMaxQueuedPerIP.
+func (admission *FairAdmission) WithMaxQueuedPerIP(max int) *FairAdmission {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+
+	admission.maxQueuedPerIP = max
+	return admission
+}
+
+// Allow a connection if there is a free slot, or if it is given one while
+// waiting. Otherwise, ErrAdmissionQueueFull or ErrAdmissionTimeout is returned
+// and the connection should be closed. The slot is freed when the connection
+// is closed. This method can be composed with other Allow functions.
+func (admission *FairAdmission) Allow(conn net.Conn) (error, Cleanup) {
+	ip := RemoteIP(conn)
+
+	admission.mu.Lock()
+	if admission.admitted < admission.slots && admission.queued == 0 {
+		admission.admit(ip)
+		admission.mu.Unlock()
+		return nil, admission.cleanup(ip)
+	}
+	if admission.queued >= admission.maxQueued || (admission.maxQueuedPerIP > 0 && len(admission.queues[ip]) >= admission.maxQueuedPerIP) {
+		admission.mu.Unlock()
+		return ErrAdmissionQueueFull, nil
+	}
+	waiter := &admissionWaiter{ip: ip, admitted: make(chan struct{})}
+	if len(admission.queues[ip]) == 0 {
+		admission.order = append(admission.order, ip)
+	}
+	admission.queues[ip] = append(admission.queues[ip], waiter)
+	admission.queued++
+	admission.mu.Unlock()
+
+	timer := time.NewTimer(admission.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-waiter.admitted:
+		return nil, admission.cleanup(ip)
+	case <-timer.C:
+	}
+
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+
+	// The waiter might have been given a slot after the timer fired.
+	select {
+	case <-waiter.admitted:
+		return nil, admission.cleanup(ip)
+	default:
+	}
+	admission.dequeue(waiter)
+	return ErrAdmissionTimeout, nil
+}
+
+// Accepted returns the number of accepted connections, that have not been
+// closed, for every IP address with at least one. It is useful for
+// monitoring.
+func (admission *FairAdmission) Accepted() map[string]int {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+
+	accepted := make(map[string]int, len(admission.accepted))
+	for ip, n := range admission.accepted {
+		accepted[ip] = n
+	}
+	return accepted
+}
+
+// Queued returns the number of connections that are waiting for a free slot.
+func (admission *FairAdmission) Queued() int {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+
+	return admission.queued
+}
+
+// admit a connection from the IP address into a slot. It assumes that the
+// FairAdmission is locked by the caller.
+func (admission *FairAdmission) admit(ip string) {
+	admission.admitted++
+	admission.accepted[ip]++
+}
+
+// cleanup returns a Cleanup that frees the slot of a connection from the IP
+// address, and gives it to the next waiting connection.
+func (admission *FairAdmission) cleanup(ip string) Cleanup {
+	return func() {
+		admission.mu.Lock()
+		defer admission.mu.Unlock()
+
+		admission.admitted--
+		if admission.accepted[ip]--; admission.accepted[ip] <= 0 {
+			delete(admission.accepted, ip)
+		}
+		for admission.admitted < admission.slots && admission.queued > 0 {
+			waiter := admission.queues[admission.next()][0]
+			admission.dequeue(waiter)
+			admission.admit(waiter.ip)
+			admission.rotate(waiter.ip)
+			close(waiter.admitted)
+		}
+	}
+}
+
+// next returns the IP address whose waiting connection should be given the
+// next free slot. It assumes that the FairAdmission is locked by the caller,
+// and that there is at least one waiting connection.
+func (admission *FairAdmission) next() string {
+	switch admission.fairness {
+	case FairLeastAccepted:
+		// Ties are broken by the round-robin order.
+		best := admission.order[0]
+		for _, ip := range admission.order[1:] {
+			if admission.accepted[ip] < admission.accepted[best] {
+				best = ip
+			}
+		}
+		return best
+	default:
+		return admission.order[0]
+	}
+}
+
+// dequeue a waiting connection. Its IP address is removed from the round-robin
+// order if it has no more waiting connections, and otherwise keeps its place.
+// It assumes that the FairAdmission is locked by the caller.
+func (admission *FairAdmission) dequeue(waiter *admissionWaiter) {
+	queue := admission.queues[waiter.ip]
+	for i := range queue {
+		if queue[i] == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	admission.queued--
+
+	if len(queue) == 0 {
+		delete(admission.queues, waiter.ip)
+		admission.remove(waiter.ip)
+		return
+	}
+	admission.queues[waiter.ip] = queue
+}
+
+// rotate the IP address, that has just been given a slot, to the back of the
+// round-robin order, if it still has waiting connections. It assumes that the
+// FairAdmission is locked by the caller.
+func (admission *FairAdmission) rotate(ip string) {
+	if len(admission.queues[ip]) == 0 {
+		return
+	}
+	admission.remove(ip)
+	admission.order = append(admission.order, ip)
+}
+
+// remove the IP address from the round-robin order. It assumes that the
+// FairAdmission is locked by the caller.
+func (admission *FairAdmission) remove(ip string) {
+	for i := range admission.order {
+		if admission.order[i] == ip {
+			admission.order = append(admission.order[:i], admission.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package policy_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/policy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fair admission", func() {
+	conn := func(ip string) net.Conn {
+		return remoteAddrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 3333}}
+	}
+
+	type admitted struct {
+		ip      string
+		cleanup policy.Cleanup
+	}
+
+	// wait for a slot in the background, and send the connection to the
+	// channel once it is admitted. It returns once the connection is queued.
+	wait := func(admission *policy.FairAdmission, ip string, ch chan<- admitted) {
+		queued := admission.Queued()
+		go func() {
+			defer GinkgoRecover()
+			err, cleanup := admission.Allow(conn(ip))
+			Expect(err).ToNot(HaveOccurred())
+			ch <- admitted{ip, cleanup}
+		}()
+		Eventually(admission.Queued).Should(Equal(queued + 1))
+	}
+
+	Context("when using round robin", func() {
+		It("should give free slots to each IP address in turn", func() {
+			admission := policy.NewFairAdmission(1, policy.FairRoundRobin, 10, time.Minute)
+			err, cleanup := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(admission.Accepted()).To(Equal(map[string]int{"10.0.0.1": 1}))
+
+			ch := make(chan admitted, 4)
+			for i := 0; i < 3; i++ {
+				wait(admission, "10.0.0.1", ch)
+			}
+			wait(admission, "10.0.0.2", ch)
+
+			order := []string{}
+			for i := 0; i < 4; i++ {
+				cleanup()
+				var a admitted
+				Eventually(ch).Should(Receive(&a))
+				order = append(order, a.ip)
+				cleanup = a.cleanup
+			}
+			Expect(order).To(Equal([]string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.1"}))
+			Expect(admission.Accepted()).To(Equal(map[string]int{"10.0.0.1": 1}))
+			cleanup()
+			Expect(admission.Accepted()).To(BeEmpty())
+		})
+	})
+
+	Context("when using least accepted", func() {
+		It("should give free slots to the IP address with the fewest accepted connections", func() {
+			admission := policy.NewFairAdmission(2, policy.FairLeastAccepted, 10, time.Minute)
+			err, cleanup := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+			err, _ = admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			ch := make(chan admitted, 2)
+			wait(admission, "10.0.0.1", ch)
+			wait(admission, "10.0.0.2", ch)
+
+			cleanup()
+			var a admitted
+			Eventually(ch).Should(Receive(&a))
+			Expect(a.ip).To(Equal("10.0.0.2"))
+			Expect(admission.Accepted()).To(Equal(map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}))
+		})
+	})
+
+	Context("when the queue is full", func() {
+		It("should reject connections", func() {
+			admission := policy.NewFairAdmission(1, policy.FairRoundRobin, 1, time.Minute)
+			err, _ := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+			wait(admission, "10.0.0.1", make(chan admitted, 1))
+
+			err, _ = admission.Allow(conn("10.0.0.2"))
+			Expect(err).To(Equal(policy.ErrAdmissionQueueFull))
+		})
+	})
+
+	Context("when one IP address floods the queue", func() {
+		It("should leave room for other IP addresses to wait", func() {
+			admission := policy.NewFairAdmission(1, policy.FairRoundRobin, 10, time.Minute).WithMaxQueuedPerIP(2)
+			err, cleanup := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			ch := make(chan admitted, 3)
+			wait(admission, "10.0.0.1", ch)
+			wait(admission, "10.0.0.1", ch)
+			for i := 0; i < 100; i++ {
+				err, _ = admission.Allow(conn("10.0.0.1"))
+				Expect(err).To(Equal(policy.ErrAdmissionQueueFull))
+			}
+			Expect(admission.Queued()).To(Equal(2))
+
+			wait(admission, "10.0.0.2", ch)
+			cleanup()
+			var a admitted
+			Eventually(ch).Should(Receive(&a))
+			Expect(a.ip).To(Equal("10.0.0.1"))
+			a.cleanup()
+			Eventually(ch).Should(Receive(&a))
+			Expect(a.ip).To(Equal("10.0.0.2"))
+		})
+	})
+
+	Context("when a connection waits too long", func() {
+		It("should reject the connection", func() {
+			admission := policy.NewFairAdmission(1, policy.FairRoundRobin, 1, 10*time.Millisecond)
+			err, _ := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			err, _ = admission.Allow(conn("10.0.0.2"))
+			Expect(err).To(Equal(policy.ErrAdmissionTimeout))
+			Expect(admission.Queued()).To(BeZero())
+		})
+
+		It("should not make its IP address lose its turn", func() {
+			admission := policy.NewFairAdmission(1, policy.FairRoundRobin, 10, 500*time.Millisecond)
+			err, cleanup := admission.Allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			timedOut := make(chan error, 1)
+			go func() {
+				err, _ := admission.Allow(conn("10.0.0.2"))
+				timedOut <- err
+			}()
+			Eventually(admission.Queued).Should(Equal(1))
+			time.Sleep(250 * time.Millisecond)
+
+			ch := make(chan admitted, 2)
+			wait(admission, "10.0.0.2", ch)
+			wait(admission, "10.0.0.3", ch)
+			Eventually(timedOut).Should(Receive(Equal(policy.ErrAdmissionTimeout)))
+
+			cleanup()
+			var a admitted
+			Eventually(ch).Should(Receive(&a))
+			Expect(a.ip).To(Equal("10.0.0.2"))
+			a.cleanup()
+			Eventually(ch).Should(Receive(&a))
+			Expect(a.ip).To(Equal("10.0.0.3"))
+			a.cleanup()
+		})
+	})
+})
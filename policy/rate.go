@@ -0,0 +1,117 @@
+package policy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultAcceptRateWindow is the default duration over which accepted
+// connections are counted when computing the acceptance rate of a
+// GlobalRateLimiter.
+var DefaultAcceptRateWindow = time.Second
+
+// A GlobalRateLimiter rejects connections when too many have been accepted too
+// quickly, regardless of their IP address. Unlike RateLimit, a distributed
+// connection flood cannot exceed the limit by using many IP addresses, which
+// protects expensive downstream work, such as handshakes. It is safe for
+// concurrent use.
+type GlobalRateLimiter struct {
+	limiter *rate.Limiter
+
+	mu            *sync.Mutex
+	window        time.Duration
+	windowStart   time.Time
+	current, prev uint64
+	prevOk        bool
+}
+
+// NewGlobalRateLimiter returns a GlobalRateLimiter that accepts, on average, at
+// most perSec connections per second, with bursts of at most burst
+// connections.
+func NewGlobalRateLimiter(perSec float64, burst int) *GlobalRateLimiter {
+	return &GlobalRateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(perSec), burst),
+
+		mu:          new(sync.Mutex),
+		window:      DefaultAcceptRateWindow,
+		windowStart: time.Now(),
+	}
+}
+
+// WithAcceptRateWindow sets the duration over which accepted connections are
+// counted when computing the AcceptRate, and returns the GlobalRateLimiter.
+// The rate includes connections accepted in the current window, and the
+// previous window. By default, the window is DefaultAcceptRateWindow.
+func (limiter *GlobalRateLimiter) WithAcceptRateWindow(window time.Duration) *GlobalRateLimiter {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.window = window
+	return limiter
+}
+
+// Allow a connection if the global rate limit has not been exceeded. Otherwise,
+// ErrRateLimited is returned and the connection is closed immediately. This
+// method can be composed with other Allow functions.
+func (limiter *GlobalRateLimiter) Allow(conn net.Conn) (error, Cleanup) {
+	if !limiter.limiter.Allow() {
+		return ErrRateLimited, nil
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.roll(time.Now())
+	limiter.current++
+	return nil, nil
+}
+
+// AcceptRate returns the number of connections per second that have recently
+// been accepted. It is computed over the last one to two windows (see
+// WithAcceptRateWindow), and is useful for monitoring.
+func (limiter *GlobalRateLimiter) AcceptRate() float64 {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	limiter.roll(now)
+	elapsed := now.Sub(limiter.windowStart)
+	accepted := limiter.current
+	if limiter.prevOk {
+		elapsed += limiter.window
+		accepted += limiter.prev
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(accepted) / elapsed.Seconds()
+}
+
+// roll the windows forward so that the current window contains the given time.
+// It assumes that the limiter is locked by the caller.
+func (limiter *GlobalRateLimiter) roll(now time.Time) {
+	elapsed := now.Sub(limiter.windowStart)
+	if elapsed < limiter.window {
+		return
+	}
+	if elapsed < 2*limiter.window {
+		limiter.prev = limiter.current
+	} else {
+		limiter.prev = 0
+	}
+	limiter.current = 0
+	limiter.prevOk = true
+	limiter.windowStart = now
+}
+
+// GlobalRate returns an Allow function that rejects connections when more than
+// perSec connections per second (with bursts of at most burst connections)
+// are being accepted, regardless of their IP address. It composes with the
+// per-IP RateLimit using All. Use NewGlobalRateLimiter to also monitor the
+// acceptance rate.
+func GlobalRate(perSec float64, burst int) Allow {
+	return NewGlobalRateLimiter(perSec, burst).Allow
+}
@@ -0,0 +1,58 @@
+package policy_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/policy"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Global rate limiting", func() {
+	Context("when connections arrive from many IP addresses", func() {
+		It("should reject connections beyond the burst regardless of the IP address", func() {
+			limiter := policy.NewGlobalRateLimiter(0.001, 2)
+			allow := policy.All(policy.RateLimit(rate.Inf, 1, 16), limiter.Allow)
+
+			conn := func(ip string) net.Conn {
+				return remoteAddrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 3333}}
+			}
+			err, _ := allow(conn("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+			err, _ = allow(conn("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			err, _ = allow(conn("10.0.0.3"))
+			Expect(err).To(Equal(policy.ErrRateLimited))
+
+			Expect(limiter.AcceptRate()).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when no connections have been accepted", func() {
+		It("should report a zero acceptance rate", func() {
+			limiter := policy.NewGlobalRateLimiter(1, 1)
+			Expect(limiter.AcceptRate()).To(BeZero())
+
+			allow := policy.GlobalRate(1, 1)
+			err, _ := allow(nil)
+			Expect(err).ToNot(HaveOccurred())
+			err, _ = allow(nil)
+			Expect(err).To(Equal(policy.ErrRateLimited))
+		})
+	})
+
+	Context("when the accept rate window has passed", func() {
+		It("should compute the acceptance rate over the window", func() {
+			limiter := policy.NewGlobalRateLimiter(1000, 1000).WithAcceptRateWindow(50 * time.Millisecond)
+			for i := 0; i < 10; i++ {
+				err, _ := limiter.Allow(nil)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(limiter.AcceptRate()).To(BeNumerically(">", 0))
+			Eventually(limiter.AcceptRate).Should(BeZero())
+		})
+	})
+})
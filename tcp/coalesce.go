@@ -0,0 +1,98 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/clock"
+)
+
+// A CoalescedError is reported by the function returned from CoalesceErrors
+// in place of errors that were suppressed because they were identical to an
+// error that had already been reported during the same interval.
+type CoalescedError struct {
+	Err      error
+	Count    int
+	Interval time.Duration
+}
+
+// Error implements the error interface.
+func (err *CoalescedError) Error() string {
+	return fmt.Sprintf("%v occurrences of %v in the last %v", err.Count, err.Err, err.Interval)
+}
+
+// Unwrap returns the most recent of the suppressed errors.
+func (err *CoalescedError) Unwrap() error {
+	return err.Err
+}
+
+type coalesced struct {
+	start time.Time
+	count int
+	last  error
+	// flushed is closed when the error is flushed before its timer fires.
+	flushed chan struct{}
+}
+
+// CoalesceErrors returns a function that passes errors to the handleErr
+// function, but limits identical errors (errors with the same type and message)
+// to one per interval. The first occurrence of an error is passed through
+// immediately. Subsequent occurrences during the interval are counted, and
+// passed as a CoalescedError once the interval has passed, even if no other
+// error is handled. The handleErr function is never called concurrently. This
+// is useful for wrapping the handleErr function of Listen, which can be called
+// in a tight loop when accepting connections fails (for example, when there
+// are too many open files).
+func CoalesceErrors(clock clock.Clock, interval time.Duration, handleErr func(error)) func(error) {
+	mu := new(sync.Mutex)
+	errs := map[string]*coalesced{}
+
+	// flush must be called while holding the mutex.
+	flush := func(key string, c *coalesced) {
+		delete(errs, key)
+		if c.count > 0 {
+			handleErr(&CoalescedError{Err: c.last, Count: c.count, Interval: interval})
+		}
+	}
+
+	return func(err error) {
+		now := clock.Now()
+		key := fmt.Sprintf("%T: %v", err, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for k, c := range errs {
+			if now.Sub(c.start) < interval {
+				continue
+			}
+			close(c.flushed)
+			flush(k, c)
+		}
+		if c, ok := errs[key]; ok {
+			c.count++
+			c.last = err
+			return
+		}
+
+		c := &coalesced{start: now, flushed: make(chan struct{})}
+		errs[key] = c
+		timer := clock.NewTimer(interval)
+		go func() {
+			select {
+			case <-timer.C():
+			case <-c.flushed:
+				timer.Stop()
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+
+			if errs[key] == c {
+				flush(key, c)
+			}
+		}()
+		handleErr(err)
+	}
+}
@@ -0,0 +1,78 @@
+package tcp_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Coalescing errors", func() {
+	Context("when the same error is handled many times", func() {
+		It("should report the error once per interval, along with the number of occurrences", func() {
+			fake := clock.NewFake(time.Now())
+			handled := []error{}
+			handleErr := tcp.CoalesceErrors(fake, time.Second, func(err error) {
+				handled = append(handled, err)
+			})
+
+			errTooManyFiles := errors.New("too many open files")
+			for i := 0; i < 1000; i++ {
+				handleErr(errTooManyFiles)
+			}
+			Expect(handled).To(Equal([]error{errTooManyFiles}))
+
+			fake.Advance(time.Second)
+			handleErr(errTooManyFiles)
+			Expect(handled).To(HaveLen(3))
+			coalescedErr := new(tcp.CoalescedError)
+			Expect(errors.As(handled[1], &coalescedErr)).To(BeTrue())
+			Expect(coalescedErr.Count).To(Equal(999))
+			Expect(errors.Is(handled[1], errTooManyFiles)).To(BeTrue())
+			Expect(handled[2]).To(Equal(errTooManyFiles))
+		})
+	})
+
+	Context("when no more errors are handled after the interval", func() {
+		It("should report the number of occurrences when the interval has passed", func() {
+			fake := clock.NewFake(time.Now())
+			handled := make(chan error, 10)
+			handleErr := tcp.CoalesceErrors(fake, time.Second, func(err error) {
+				handled <- err
+			})
+
+			errTooManyFiles := errors.New("too many open files")
+			for i := 0; i < 10; i++ {
+				handleErr(errTooManyFiles)
+			}
+			Expect(<-handled).To(Equal(errTooManyFiles))
+			Consistently(handled).ShouldNot(Receive())
+
+			fake.Advance(time.Second)
+			var err error
+			Eventually(handled).Should(Receive(&err))
+			coalescedErr := new(tcp.CoalescedError)
+			Expect(errors.As(err, &coalescedErr)).To(BeTrue())
+			Expect(coalescedErr.Count).To(Equal(9))
+		})
+	})
+
+	Context("when different errors are handled", func() {
+		It("should report each error", func() {
+			fake := clock.NewFake(time.Now())
+			handled := []error{}
+			handleErr := tcp.CoalesceErrors(fake, time.Second, func(err error) {
+				handled = append(handled, err)
+			})
+
+			handleErr(errors.New("foo"))
+			handleErr(errors.New("bar"))
+			handleErr(errors.New("foo"))
+			Expect(handled).To(HaveLen(2))
+		})
+	})
+})
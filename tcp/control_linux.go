@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"syscall"
+)
+
+// Mark returns a Control function that sets the SO_MARK (fwmark) socket option,
+// so that connections can be matched by policy routing rules. Setting the mark
+// requires the CAP_NET_ADMIN capability.
+func Mark(mark int) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
+
+// BindToDevice returns a Control function that sets the SO_BINDTODEVICE socket
+// option, so that connections are only sent through the given network
+// interface (for example, a VPN interface).
+func BindToDevice(device string) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
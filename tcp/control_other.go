@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"syscall"
+)
+
+// Mark returns a Control function that does nothing, because the SO_MARK
+// socket option is only supported on Linux.
+func Mark(mark int) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+}
+
+// BindToDevice returns a Control function that does nothing, because the
+// SO_BINDTODEVICE socket option is only supported on Linux.
+func BindToDevice(device string) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+}
@@ -0,0 +1,10 @@
+package tcp
+
+import (
+	"errors"
+)
+
+// ErrTCPInfoUnsupported is returned when reading the TCP info of a network
+// connection that is not a TCP socket, or on a platform that does not support
+// it.
+var ErrTCPInfoUnsupported = errors.New("tcp info unsupported")
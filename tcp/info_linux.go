@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCPInfo is the state of a TCP socket, as it is known by the kernel (for
+// example, the round trip time, the number of retransmits, and the size of the
+// congestion window).
+type TCPInfo = unix.TCPInfo
+
+// ReadTCPInfo reads the TCP_INFO socket option of a network connection. An
+// ErrTCPInfoUnsupported error is returned if the network connection is not a
+// TCP socket.
+func ReadTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%T: %w", conn, ErrTCPInfoUnsupported)
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("syscall conn: %w", err)
+	}
+	var info *TCPInfo
+	if ctrlErr := rawConn.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); ctrlErr != nil {
+		return nil, fmt.Errorf("control: %w", ctrlErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getsockopt: %w", err)
+	}
+	return info, nil
+}
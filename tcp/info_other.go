@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// TCPInfo is empty, because the TCP_INFO socket option is only supported on
+// Linux.
+type TCPInfo struct{}
+
+// ReadTCPInfo returns an ErrTCPInfoUnsupported error, because the TCP_INFO
+// socket option is only supported on Linux.
+func ReadTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	return nil, fmt.Errorf("%v: %w", runtime.GOOS, ErrTCPInfoUnsupported)
+}
@@ -0,0 +1,57 @@
+package tcp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TCP info", func() {
+	Context("when reading the TCP info of a TCP socket", func() {
+		It("should return the TCP info on Linux, and an unsupported error otherwise", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, _, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				<-ctx.Done()
+				conn.Close()
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			info, err := tcp.ReadTCPInfo(conn)
+			if runtime.GOOS != "linux" {
+				Expect(errors.Is(err, tcp.ErrTCPInfoUnsupported)).To(BeTrue())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info).ToNot(BeNil())
+		})
+	})
+
+	Context("when reading the TCP info of a connection that is not a TCP socket", func() {
+		It("should return an unsupported error", func() {
+			conn, other := net.Pipe()
+			defer conn.Close()
+			defer other.Close()
+
+			_, err := tcp.ReadTCPInfo(conn)
+			Expect(errors.Is(err, tcp.ErrTCPInfoUnsupported)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"syscall"
+	"time"
+)
+
+// KeepAliveOptions configure TCP keepalives, so that dead peers (for example,
+// peers behind a NAT that has dropped its mapping) are detected sooner than
+// the defaults of the OS allow.
+type KeepAliveOptions struct {
+	// Enable sets whether or not keepalive probes are sent.
+	Enable bool
+	// Idle is how long a connection must be idle before the first probe is
+	// sent.
+	Idle time.Duration
+	// Interval is how long to wait between probes. It is only supported on
+	// Linux.
+	Interval time.Duration
+	// Count is how many unanswered probes are sent before the connection is
+	// dropped. It is only supported on Linux.
+	Count int
+}
+
+// DefaultKeepAliveOptions returns KeepAliveOptions that enable keepalives, but
+// leave the idle time, interval, and count at the defaults of the OS.
+func DefaultKeepAliveOptions() KeepAliveOptions {
+	return KeepAliveOptions{
+		Enable: true,
+	}
+}
+
+// WithEnable sets whether or not keepalive probes are sent.
+func (opts KeepAliveOptions) WithEnable(enable bool) KeepAliveOptions {
+	opts.Enable = enable
+	return opts
+}
+
+// WithIdle sets how long a connection must be idle before the first probe is
+// sent. Zero means that the default of the OS is used.
+func (opts KeepAliveOptions) WithIdle(idle time.Duration) KeepAliveOptions {
+	opts.Idle = idle
+	return opts
+}
+
+// WithInterval sets how long to wait between probes. Zero means that the
+// default of the OS is used.
+func (opts KeepAliveOptions) WithInterval(interval time.Duration) KeepAliveOptions {
+	opts.Interval = interval
+	return opts
+}
+
+// WithCount sets how many unanswered probes are sent before the connection is
+// dropped. Zero means that the default of the OS is used.
+func (opts KeepAliveOptions) WithCount(count int) KeepAliveOptions {
+	opts.Count = count
+	return opts
+}
+
+// WithKeepAlive sets the KeepAliveOptions of accepted connections. By
+// default, the KeepAliveOptions are nil, and keepalives are left as they are
+// configured by Go.
+func (opts ListenOptions) WithKeepAlive(keepAlive KeepAliveOptions) ListenOptions {
+	opts.KeepAlive = &keepAlive
+	return opts
+}
+
+// WithKeepAlive sets the KeepAliveOptions of dialed connections. By default,
+// the KeepAliveOptions are nil, and keepalives are left as they are
+// configured by Go.
+func (opts DialOptions) WithKeepAlive(keepAlive KeepAliveOptions) DialOptions {
+	opts.KeepAlive = &keepAlive
+	return opts
+}
+
+// keepAliveControl returns a Control function that applies the
+// KeepAliveOptions to a socket before it is connected (or, for listeners,
+// before it is bound). Go overrides the keepalive of connected sockets unless
+// its own keepalive is disabled, so this is not exported as a Control.
+func keepAliveControl(opts KeepAliveOptions) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = setKeepAliveSockopts(fd, opts)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
+
+// chainControl returns a Control function that calls all of the non-nil
+// Control functions, in order, until one of them fails.
+func chainControl(controls ...Control) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if control == nil {
+				continue
+			}
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// keepAliveSeconds converts a duration into the whole number of seconds used
+// by keepalive socket options, rounding up so that positive durations are
+// never disabled.
+func keepAliveSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SetKeepAlive applies the KeepAliveOptions to a TCP connection. Connections
+// that are not TCP connections are ignored.
+func SetKeepAlive(conn net.Conn, opts KeepAliveOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("set keepalive: %w", err)
+	}
+	if err := keepAliveControl(opts)("tcp", conn.RemoteAddr().String(), rawConn); err != nil {
+		return fmt.Errorf("set keepalive: %w", err)
+	}
+	return nil
+}
+
+func setKeepAliveSockopts(fd uintptr, opts KeepAliveOptions) error {
+	enable := 0
+	if opts.Enable {
+		enable = 1
+	}
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, enable); err != nil {
+		return fmt.Errorf("set SO_KEEPALIVE: %w", err)
+	}
+	if !opts.Enable {
+		return nil
+	}
+	if opts.Idle > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, keepAliveSeconds(opts.Idle)); err != nil {
+			return fmt.Errorf("set TCP_KEEPIDLE: %w", err)
+		}
+	}
+	if opts.Interval > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, keepAliveSeconds(opts.Interval)); err != nil {
+			return fmt.Errorf("set TCP_KEEPINTVL: %w", err)
+		}
+	}
+	if opts.Count > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, opts.Count); err != nil {
+			return fmt.Errorf("set TCP_KEEPCNT: %w", err)
+		}
+	}
+	return nil
+}
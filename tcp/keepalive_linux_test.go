@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package tcp_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TCP keepalive", func() {
+	// sockopts returns the SO_KEEPALIVE, TCP_KEEPIDLE, TCP_KEEPINTVL, and
+	// TCP_KEEPCNT socket options of a TCP connection.
+	sockopts := func(conn net.Conn) [4]int {
+		rawConn, err := conn.(*net.TCPConn).SyscallConn()
+		Expect(err).ToNot(HaveOccurred())
+		opts := [4]int{}
+		Expect(rawConn.Control(func(fd uintptr) {
+			for i, opt := range [][2]int{
+				{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE},
+				{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE},
+				{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL},
+				{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT},
+			} {
+				opts[i], err = syscall.GetsockoptInt(int(fd), opt[0], opt[1])
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})).To(Succeed())
+		return opts
+	}
+
+	// run a listener and a dialer with the KeepAliveOptions, and return the
+	// socket options of the accepted and dialed connections.
+	run := func(listenOpts tcp.ListenOptions, dialOpts tcp.DialOptions) ([4]int, [4]int) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		accepted := make(chan [4]int, 1)
+		go tcp.ListenWithListenerOptions(ctx, listener, listenOpts, func(conn net.Conn) {
+			defer GinkgoRecover()
+			accepted <- sockopts(conn)
+		}, nil, nil)
+
+		dialed := [4]int{}
+		Expect(tcp.DialWithOptions(ctx, dialOpts, fmt.Sprintf("127.0.0.1:%v", port), func(conn net.Conn) {
+			dialed = sockopts(conn)
+		}, nil, func(int) time.Duration { return time.Second })).To(Succeed())
+		return <-accepted, dialed
+	}
+
+	Context("when keepalives are configured", func() {
+		It("should apply them to accepted and dialed connections", func() {
+			accepted, dialed := run(
+				tcp.DefaultListenOptions().WithKeepAlive(tcp.DefaultKeepAliveOptions().WithIdle(30*time.Second).WithInterval(5*time.Second).WithCount(3)),
+				tcp.DefaultDialOptions().WithKeepAlive(tcp.DefaultKeepAliveOptions().WithIdle(20*time.Second).WithInterval(2*time.Second).WithCount(4)),
+			)
+			Expect(accepted).To(Equal([4]int{1, 30, 5, 3}))
+			Expect(dialed).To(Equal([4]int{1, 20, 2, 4}))
+		})
+	})
+
+	Context("when keepalives are disabled", func() {
+		It("should not send keepalive probes", func() {
+			disabled := tcp.KeepAliveOptions{Enable: false}
+			accepted, dialed := run(
+				tcp.DefaultListenOptions().WithKeepAlive(disabled),
+				tcp.DefaultDialOptions().WithKeepAlive(disabled),
+			)
+			Expect(accepted[0]).To(Equal(0))
+			Expect(dialed[0]).To(Equal(0))
+		})
+	})
+
+	Context("when the keepalive options are nil", func() {
+		It("should leave the keepalives as they are configured by Go", func() {
+			accepted, dialed := run(tcp.DefaultListenOptions(), tcp.DefaultDialOptions())
+			Expect(accepted[0]).To(Equal(1))
+			Expect(dialed[0]).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetKeepAlive applies the KeepAliveOptions to a TCP connection. Connections
+// that are not TCP connections are ignored. The interval and count are only
+// supported on Linux, and are ignored.
+func SetKeepAlive(conn net.Conn, opts KeepAliveOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(opts.Enable); err != nil {
+		return fmt.Errorf("set keepalive: %w", err)
+	}
+	if opts.Enable && opts.Idle > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(opts.Idle); err != nil {
+			return fmt.Errorf("set keepalive period: %w", err)
+		}
+	}
+	return nil
+}
+
+// setKeepAliveSockopts does nothing, because raw keepalive socket options are
+// only set on Linux. Use SetKeepAlive once the connection is established.
+func setKeepAliveSockopts(fd uintptr, opts KeepAliveOptions) error {
+	return nil
+}
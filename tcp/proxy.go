@@ -0,0 +1,172 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrProxyRefused is returned when an HTTP CONNECT proxy responds to a CONNECT
+// request with anything other than a 2xx status.
+var ErrProxyRefused = errors.New("proxy refused")
+
+// ErrInvalidProxyTarget is returned when the address that a proxy is asked to
+// connect to is not a "host:port", or contains characters that would change the
+// meaning of the CONNECT request.
+var ErrInvalidProxyTarget = errors.New("invalid proxy target")
+
+// maxProxyResponseSize is the maximum size, in bytes, of the response to a
+// CONNECT request. Proxies only respond with a status line and a few headers,
+// so anything larger is not a proxy.
+const maxProxyResponseSize = 8192
+
+// An HTTPProxy is an HTTP proxy that supports the CONNECT method. Dialed
+// connections are tunnelled through it, after which the proxy forwards raw
+// bytes in both directions.
+type HTTPProxy struct {
+	// Address of the proxy.
+	Address string
+	// Username and Password used for Basic proxy authentication. If the
+	// Username is empty, then the proxy is not authenticated.
+	Username string
+	Password string
+}
+
+// WithHTTPProxy sets an HTTP proxy that all connections are tunnelled through,
+// using the CONNECT method. The proxy is dialed in the same way that the
+// remote peer would otherwise have been dialed (including the Control and Dial
+// functions), and the CONNECT request is bounded by the same dial attempt
+// timeout. Once the proxy has accepted the CONNECT request, the connection is
+// handled like any other. A nil proxy means that connections are not
+// tunnelled, which is the default.
+func (opts DialOptions) WithHTTPProxy(proxy *HTTPProxy) DialOptions {
+	opts.HTTPProxy = proxy
+	return opts
+}
+
+// tunnel returns a dial function that dials the proxy using the dial function,
+// and then asks the proxy to connect to the address.
+func (proxy HTTPProxy) tunnel(dial func(ctx context.Context, address string) (net.Conn, error)) func(ctx context.Context, address string) (net.Conn, error) {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		if err := validateProxyTarget(address); err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, proxy.Address)
+		if err != nil {
+			return nil, fmt.Errorf("dial proxy: %w", err)
+		}
+		if err := proxy.connect(ctx, conn, address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// validateProxyTarget returns an error wrapping ErrInvalidProxyTarget if the
+// address cannot be written into a CONNECT request as it is. Line breaks are
+// rejected, so that the address cannot inject headers (or whole requests).
+func validateProxyTarget(address string) error {
+	if strings.ContainsAny(address, "\r\n") {
+		return fmt.Errorf("%w %q: contains a line break", ErrInvalidProxyTarget, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidProxyTarget, address, err)
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("%w %q: expected host:port", ErrInvalidProxyTarget, address)
+	}
+	return nil
+}
+
+// connect sends a CONNECT request for the address to the proxy, and reads the
+// response. The response is read one byte at a time, so that nothing the
+// remote peer writes after it is consumed.
+func (proxy HTTPProxy) connect(ctx context.Context, conn net.Conn, address string) (err error) {
+	// Interrupt the request when the context is done, by expiring the
+	// deadline of the connection.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("set deadline: %w", err)
+		}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+		if ctx.Err() != nil {
+			err = fmt.Errorf("connect proxy: %w", ctx.Err())
+			return
+		}
+		if err == nil {
+			if deadlineErr := conn.SetDeadline(time.Time{}); deadlineErr != nil {
+				err = fmt.Errorf("reset deadline: %w", deadlineErr)
+			}
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   address,
+		Header: http.Header{},
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n", address, address)
+	if proxy.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		fmt.Fprintf(buf, "Proxy-Authorization: Basic %v\r\n", credentials)
+	}
+	buf.WriteString("\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write connect request: %w", err)
+	}
+
+	head, err := readProxyResponse(conn)
+	if err != nil {
+		return fmt.Errorf("read connect response: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return fmt.Errorf("read connect response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("connect %v: %w: %v", address, ErrProxyRefused, resp.Status)
+	}
+	return nil
+}
+
+// readProxyResponse reads the status line and headers of a response, up to
+// and including the empty line that ends them.
+func readProxyResponse(r io.Reader) ([]byte, error) {
+	head := make([]byte, 0, 128)
+	b := [1]byte{}
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) == maxProxyResponseSize {
+			return nil, fmt.Errorf("response too large: expected n<=%v", maxProxyResponseSize)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return head, nil
+}
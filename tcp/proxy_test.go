@@ -0,0 +1,206 @@
+package tcp_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP CONNECT proxy", func() {
+	// listenGreeter listens for connections that are greeted, and then have
+	// everything echoed back to them.
+	listenGreeter := func(ctx context.Context) string {
+		listener, _, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.Write([]byte("hello"))
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	// listenProxy listens for CONNECT requests, and tunnels them to the
+	// requested address. Requests that are not authenticated using the
+	// credentials are rejected. If respond is false, then requests are never
+	// responded to.
+	listenProxy := func(ctx context.Context, credentials string, respond bool) string {
+		listener, _, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					req, err := http.ReadRequest(bufio.NewReader(conn))
+					if err != nil || req.Method != http.MethodConnect {
+						return
+					}
+					if !respond {
+						<-ctx.Done()
+						return
+					}
+					if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)) {
+						conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+						return
+					}
+					target, err := net.Dial("tcp", req.Host)
+					if err != nil {
+						conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+						return
+					}
+					defer target.Close()
+					conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+					go io.Copy(target, conn)
+					io.Copy(conn, target)
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	Context("when the proxy accepts the request", func() {
+		It("should tunnel the connection to the remote address", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			addr := listenGreeter(ctx)
+			proxyAddr := listenProxy(ctx, "alice:secret", true)
+			opts := tcp.DefaultDialOptions().WithHTTPProxy(&tcp.HTTPProxy{
+				Address:  proxyAddr,
+				Username: "alice",
+				Password: "secret",
+			})
+
+			received := []byte{}
+			err := tcp.DialWithOptions(ctx, opts, addr, func(conn net.Conn) {
+				defer GinkgoRecover()
+				Expect(conn.RemoteAddr().String()).To(Equal(proxyAddr))
+
+				// The greeting is written by the remote peer immediately, so
+				// it must not have been consumed with the response.
+				greeting := [5]byte{}
+				_, err := io.ReadFull(conn, greeting[:])
+				Expect(err).ToNot(HaveOccurred())
+				received = append(received, greeting[:]...)
+
+				_, err = conn.Write([]byte(", world"))
+				Expect(err).ToNot(HaveOccurred())
+				echo := [7]byte{}
+				_, err = io.ReadFull(conn, echo[:])
+				Expect(err).ToNot(HaveOccurred())
+				received = append(received, echo[:]...)
+			}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(received)).To(Equal("hello, world"))
+		})
+	})
+
+	Context("when the proxy rejects the credentials", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			addr := listenGreeter(ctx)
+			proxyAddr := listenProxy(ctx, "alice:secret", true)
+			opts := tcp.DefaultDialOptions().
+				WithEstablishTimeout(500 * time.Millisecond).
+				WithHTTPProxy(&tcp.HTTPProxy{
+					Address:  proxyAddr,
+					Username: "alice",
+					Password: "wrong",
+				})
+
+			errs := make(chan error, 10)
+			err := tcp.DialWithOptions(ctx, opts, addr, func(net.Conn) {
+				defer GinkgoRecover()
+				Fail("unexpected connection")
+			}, func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}, func(int) time.Duration { return 100 * time.Millisecond })
+			Expect(errors.Is(err, tcp.ErrProxyRefused)).To(BeTrue())
+			Expect(<-errs).To(MatchError(ContainSubstring("407")))
+		})
+	})
+
+	Context("when the remote address is not a host and port", func() {
+		It("should return an error without sending a request", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			proxyAddr := listenProxy(ctx, "", true)
+			opts := tcp.DefaultDialOptions().
+				WithEstablishTimeout(200 * time.Millisecond).
+				WithHTTPProxy(&tcp.HTTPProxy{Address: proxyAddr})
+
+			for _, addr := range []string{
+				"127.0.0.1",
+				":3333",
+				"127.0.0.1:",
+				"127.0.0.1:3333\r\nX-Injected: true",
+				"127.0.0.1:3333\n",
+			} {
+				err := tcp.DialWithOptions(ctx, opts, addr, func(net.Conn) {
+					defer GinkgoRecover()
+					Fail("unexpected connection")
+				}, nil, func(int) time.Duration { return 100 * time.Millisecond })
+				Expect(errors.Is(err, tcp.ErrInvalidProxyTarget)).To(BeTrue())
+			}
+		})
+	})
+
+	Context("when the proxy does not respond", func() {
+		It("should give up when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			addr := listenGreeter(ctx)
+			proxyAddr := listenProxy(ctx, "", false)
+			opts := tcp.DefaultDialOptions().WithHTTPProxy(&tcp.HTTPProxy{
+				Address: proxyAddr,
+			})
+
+			dialCtx, dialCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+			defer dialCancel()
+			start := time.Now()
+			err := tcp.DialWithOptions(dialCtx, opts, addr, func(net.Conn) {
+				defer GinkgoRecover()
+				Fail("unexpected connection")
+			}, nil, func(int) time.Duration { return time.Minute })
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+	})
+})
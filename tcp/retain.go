@@ -0,0 +1,40 @@
+package tcp
+
+import (
+	"context"
+	"net"
+)
+
+// Retention is returned by a handle function that is wrapped by Retain, to
+// signal whether the connection should be retained for another call to the
+// handle function, or closed.
+type Retention uint8
+
+// Enumerate all Retention values.
+const (
+	// Close the connection after the handle function returns. This is the
+	// behaviour of all handle functions that are not wrapped by Retain.
+	Close = Retention(0)
+	// KeepOpen the connection after the handle function returns, and call the
+	// handle function again using the same connection.
+	KeepOpen = Retention(1)
+)
+
+// Retain wraps a handle function, so that it can be used with Listen and Dial,
+// and called repeatedly using the same connection for as long as it returns
+// KeepOpen. This allows request/response patterns where one connection serves
+// many exchanges. The connection is closed as soon as the handle function
+// returns Close, or once the context is done (in which case the handle
+// function is not called again). The handle function should return Close when
+// reading from, or writing to, the connection fails.
+func Retain(ctx context.Context, handle func(net.Conn) Retention) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+
+		for ctx.Err() == nil {
+			if handle(conn) != KeepOpen {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package tcp_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retain", func() {
+	Context("when the handle function keeps the connection open", func() {
+		It("should serve many exchanges using one connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+
+			accepted := make(chan net.Addr, 10)
+			go tcp.ListenWithListener(ctx, listener, tcp.Retain(ctx, func(conn net.Conn) tcp.Retention {
+				// Echo one request back to the dialer.
+				req := [1]byte{}
+				if _, err := io.ReadFull(conn, req[:]); err != nil {
+					return tcp.Close
+				}
+				if _, err := conn.Write(req[:]); err != nil {
+					return tcp.Close
+				}
+				accepted <- conn.RemoteAddr()
+				return tcp.KeepOpen
+			}), nil, nil)
+
+			Expect(tcp.Dial(ctx, fmt.Sprintf("127.0.0.1:%v", port), func(conn net.Conn) {
+				for i := byte(0); i < 3; i++ {
+					_, err := conn.Write([]byte{i})
+					Expect(err).ToNot(HaveOccurred())
+					res := [1]byte{}
+					_, err = io.ReadFull(conn, res[:])
+					Expect(err).ToNot(HaveOccurred())
+					Expect(res[0]).To(Equal(i))
+				}
+			}, nil, nil)).To(Succeed())
+
+			addr := <-accepted
+			Expect(<-accepted).To(Equal(addr))
+			Expect(<-accepted).To(Equal(addr))
+		})
+	})
+
+	Context("when the context is done", func() {
+		It("should stop calling the handle function, and close the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+			calls := 0
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tcp.Retain(ctx, func(conn net.Conn) tcp.Retention {
+					calls++
+					if calls == 2 {
+						cancel()
+					}
+					return tcp.KeepOpen
+				})(server)
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(calls).To(Equal(2))
+
+			// The connection has been closed.
+			_, err := client.Write([]byte{0})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the handle function closes the connection", func() {
+		It("should close the connection without calling the handle function again", func() {
+			client, server := net.Pipe()
+			defer client.Close()
+			calls := 0
+			tcp.Retain(context.Background(), func(conn net.Conn) tcp.Retention {
+				calls++
+				return tcp.Close
+			})(server)
+			Expect(calls).To(Equal(1))
+			_, err := client.Write([]byte{0})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
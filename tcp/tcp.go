@@ -2,13 +2,69 @@ package tcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/muirglacier/aw/policy"
 )
 
+// ErrPoolFull is passed to the error handler of a listener when a connection
+// is rejected because all workers are busy and the queue is full.
+var ErrPoolFull = errors.New("pool full")
+
+// ListenOptions are used to bound the resources used by a listener.
+type ListenOptions struct {
+	Workers    int
+	QueueSize  int
+	DeferAllow bool
+	KeepAlive  *KeepAliveOptions
+}
+
+// DefaultListenOptions returns ListenOptions that spawn a new goroutine for
+// every accepted connection, with no upper bound.
+func DefaultListenOptions() ListenOptions {
+	return ListenOptions{
+		Workers:    0,
+		QueueSize:  0,
+		DeferAllow: false,
+	}
+}
+
+// WithWorkers sets the maximum number of connections that can be handled
+// concurrently, using a pool of worker goroutines. Connections that are
+// accepted while all workers are busy are queued. A value of zero, or less,
+// means that a new goroutine is spawned for every accepted connection.
+func (opts ListenOptions) WithWorkers(workers int) ListenOptions {
+	opts.Workers = workers
+	return opts
+}
+
+// WithQueueSize sets the number of accepted connections that can wait for a
+// worker. Connections accepted while the queue is full are closed, and
+// ErrPoolFull is passed to the error handler. A queue size of zero means that
+// connections are only accepted when a worker is idle. The queue size is
+// ignored when there are no workers.
+func (opts ListenOptions) WithQueueSize(queueSize int) ListenOptions {
+	opts.QueueSize = queueSize
+	return opts
+}
+
+// WithDeferAllow sets whether or not the allow function is called by the
+// goroutine that handles a connection, instead of the goroutine that accepts
+// connections. By default, it is called before the connection is handed off,
+// so a slow allow function (for example, one that does a database lookup)
+// delays accepting all other connections. Deferring it means that one slow
+// call does not throttle other inbound connections, but rejected connections
+// hold a file descriptor (and, when there are workers, a worker or a place in
+// the queue) until the allow function returns.
+func (opts ListenOptions) WithDeferAllow(deferAllow bool) ListenOptions {
+	opts.DeferAllow = deferAllow
+	return opts
+}
+
 // Listen for connections from remote peers until the context is done. The
 // allow function will be used to control the acceptance/rejection of connection
 // attempts, and can be used to implement maximum connection limits, per-IP
@@ -16,8 +72,21 @@ import (
 // their own background goroutines that run the handle function, and then
 // clean-up the connection. This function blocks until the context is done.
 func Listen(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	return ListenWithOptions(ctx, address, DefaultListenOptions(), handle, handleErr, allow)
+}
+
+// ListenWithOptions is the same as Listen, but uses the ListenOptions to bound
+// the number of goroutines that handle connections.
+func ListenWithOptions(ctx context.Context, address string, opts ListenOptions, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
 	// Create a TCP listener from given address and return an error if unable to do so
-	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", address)
+	lc := new(net.ListenConfig)
+	if opts.KeepAlive != nil {
+		// Accepted connections inherit the keepalive options of the
+		// listener, so Go must not override them.
+		lc.KeepAlive = -1
+		lc.Control = keepAliveControl(*opts.KeepAlive)
+	}
+	listener, err := lc.Listen(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
@@ -30,7 +99,7 @@ func Listen(ctx context.Context, address string, handle func(net.Conn), handleEr
 		<- ctx.Done()
 		listener.Close()
 	}()
-	return ListenWithListener(ctx, listener, handle, handleErr, allow)
+	return ListenWithListenerOptions(ctx, listener, opts, handle, handleErr, allow)
 }
 
 // ListenWithListener is the same as Listen but instead of specifying an
@@ -39,6 +108,12 @@ func Listen(ctx context.Context, address string, handle func(net.Conn), handleEr
 // NOTE: The listener passed to this function will be closed when the given
 // context finishes.
 func ListenWithListener(ctx context.Context, listener net.Listener, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	return ListenWithListenerOptions(ctx, listener, DefaultListenOptions(), handle, handleErr, allow)
+}
+
+// ListenWithListenerOptions is the same as ListenWithListener, but uses the
+// ListenOptions to bound the number of goroutines that handle connections.
+func ListenWithListenerOptions(ctx context.Context, listener net.Listener, opts ListenOptions, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
 	if handle == nil {
 		return fmt.Errorf("nil handle function")
 	}
@@ -49,6 +124,31 @@ func ListenWithListener(ctx context.Context, listener net.Listener, handle func(
 
 	defer listener.Close()
 
+	// By default, every connection is handled in its own goroutine.
+	spawn := func(f func()) bool {
+		go f()
+		return true
+	}
+	if opts.Workers > 0 {
+		queue := make(chan func(), opts.QueueSize)
+		defer close(queue)
+		for i := 0; i < opts.Workers; i++ {
+			go func() {
+				for f := range queue {
+					f()
+				}
+			}()
+		}
+		spawn = func(f func()) bool {
+			select {
+			case queue <- f:
+				return true
+			default:
+				return false
+			}
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -62,36 +162,78 @@ func ListenWithListener(ctx context.Context, listener net.Listener, handle func(
 			continue
 		}
 
-		if allow == nil {
-			go func() {
-				defer conn.Close()
+		if opts.KeepAlive != nil {
+			if err := SetKeepAlive(conn, *opts.KeepAlive); err != nil {
+				handleErr(err)
+			}
+		}
 
-				handle(conn)
-			}()
-			continue
+		var cleanup policy.Cleanup
+		if allow != nil && !opts.DeferAllow {
+			var err error
+			if err, cleanup = allow(conn); err != nil {
+				conn.Close()
+				continue
+			}
 		}
 
-		if err, cleanup := allow(conn); err == nil {
-			go func() {
-				defer conn.Close()
-
-				defer func() {
-					if cleanup != nil {
-						cleanup()
-					}
-				}()
-				handle(conn)
+		ok := spawn(func() {
+			defer conn.Close()
+
+			if allow != nil && opts.DeferAllow {
+				var err error
+				if err, cleanup = allow(conn); err != nil {
+					return
+				}
+			}
+			defer func() {
+				if cleanup != nil {
+					cleanup()
+				}
 			}()
-			continue
+			handle(conn)
+		})
+		if !ok {
+			if cleanup != nil {
+				cleanup()
+			}
+			conn.Close()
+			handleErr(fmt.Errorf("accept connection from %v: %w", conn.RemoteAddr(), ErrPoolFull))
 		}
-		conn.Close()
 	}
 }
 
+// newConnInfo returns the ConnInfo of a connection.
+func newConnInfo(conn net.Conn, attempt int) ConnInfo {
+	network := "tcp4"
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		network = "tcp6"
+	}
+	return ConnInfo{
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+		Network:    network,
+		Attempt:    attempt,
+	}
+}
+
+// SetNoDelay sets whether or not Nagle's algorithm is disabled for a TCP
+// connection. Connections that are not TCP connections are ignored.
+func SetNoDelay(conn net.Conn, noDelay bool) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(noDelay); err != nil {
+		return fmt.Errorf("set no delay: %w", err)
+	}
+	return nil
+}
+
 // ListenerWithAssignedPort creates a new listener on a random port assigned by
 // the OS. On success, both the listener and port are returned.
 func ListenerWithAssignedPort(ctx context.Context, ip string) (net.Listener, int, error) {
-	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", fmt.Sprintf("%v:%v", ip, 0))
+	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", net.JoinHostPort(ip, "0"))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -99,13 +241,175 @@ func ListenerWithAssignedPort(ctx context.Context, ip string) (net.Listener, int
 	return listener, port, nil
 }
 
+// MaxDialErrors is the maximum number of errors, from the most recent dial
+// attempts, that are retained in a DialError.
+const MaxDialErrors = 3
+
+// A DialError is returned by Dial when the context is done before a connection
+// could be established. It retains the errors from the most recent dial
+// attempts, so that callers can see why dialing kept failing. The errors.Is
+// and errors.As functions match against the context error, and against each
+// of the retained attempt errors.
+type DialError struct {
+	Err         error
+	Attempts    int
+	AttemptErrs []error
+}
+
+// Error implements the error interface.
+func (err *DialError) Error() string {
+	if len(err.AttemptErrs) == 0 {
+		return fmt.Sprintf("dialing %v", err.Err)
+	}
+	return fmt.Sprintf("dialing %v after %v attempts: %v", err.Err, err.Attempts, err.AttemptErrs[len(err.AttemptErrs)-1])
+}
+
+// Unwrap returns the context error.
+func (err *DialError) Unwrap() error {
+	return err.Err
+}
+
+// Is returns true if any of the retained attempt errors matches the target.
+func (err *DialError) Is(target error) bool {
+	for _, attemptErr := range err.AttemptErrs {
+		if errors.Is(attemptErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As returns true if any of the retained attempt errors can be assigned to the
+// target.
+func (err *DialError) As(target interface{}) bool {
+	for _, attemptErr := range err.AttemptErrs {
+		if errors.As(attemptErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Control function is called after creating a network connection, but before
+// dialing it. It can be used to set socket options on the raw network
+// connection.
+type Control func(network, address string, c syscall.RawConn) error
+
+// DialOptions are used to customise the socket created by DialWithOptions.
+type DialOptions struct {
+	Control          Control
+	Dial             func(ctx context.Context, address string) (net.Conn, error)
+	NoDelay          bool
+	EstablishTimeout time.Duration
+	OnConnect        func(ConnInfo)
+	HTTPProxy        *HTTPProxy
+	KeepAlive        *KeepAliveOptions
+}
+
+// ConnInfo describes a connection that has been established by dialing.
+type ConnInfo struct {
+	// LocalAddr is the local network address used by the connection.
+	LocalAddr net.Addr
+	// RemoteAddr is the remote network address used by the connection.
+	RemoteAddr net.Addr
+	// Network is "tcp4" or "tcp6", depending on the remote network address.
+	Network string
+	// Attempt is the dial attempt that established the connection, starting
+	// from one.
+	Attempt int
+}
+
+// DefaultDialOptions returns DialOptions that do not modify the socket. Nagle's
+// algorithm is disabled, which is the default for all TCP connections in Go.
+func DefaultDialOptions() DialOptions {
+	return DialOptions{
+		NoDelay: true,
+	}
+}
+
+// WithNoDelay sets whether or not Nagle's algorithm is disabled for dialed
+// connections. Disabling it reduces the latency of small messages, and enabling
+// it reduces the overhead of bulk transfers.
+func (opts DialOptions) WithNoDelay(noDelay bool) DialOptions {
+	opts.NoDelay = noDelay
+	return opts
+}
+
+// WithEstablishTimeout sets the maximum duration spent establishing a
+// connection, across all dial attempts. Once a connection is established, the
+// timeout no longer applies, so handling the connection can take much longer.
+// A timeout of zero, or less, means that dialing is only bounded by the
+// context.
+func (opts DialOptions) WithEstablishTimeout(timeout time.Duration) DialOptions {
+	opts.EstablishTimeout = timeout
+	return opts
+}
+
+// WithOnConnect sets a function that is called with the ConnInfo of a
+// connection as soon as it is established, before it is handled.
+func (opts DialOptions) WithOnConnect(onConnect func(ConnInfo)) DialOptions {
+	opts.OnConnect = onConnect
+	return opts
+}
+
+// WithControl sets the Control function that is called for every socket
+// created while dialing. Use Mark or BindToDevice to route connections on
+// Linux.
+func (opts DialOptions) WithControl(control Control) DialOptions {
+	opts.Control = control
+	return opts
+}
+
+// WithDial sets the function used to establish connections, instead of dialing
+// a TCP socket. For example, it can dial through a proxy, wrap connections in
+// TLS, or return in-memory connections for tests. The function must return
+// when its context is done. It is retried in the same way as dialing a TCP
+// socket, and the Control function is not used.
+func (opts DialOptions) WithDial(dial func(ctx context.Context, address string) (net.Conn, error)) DialOptions {
+	opts.Dial = dial
+	return opts
+}
+
 // Dial a remote peer until a connection is successfully established, or until
 // the context is done. Multiple dial attempts can be made, and the timeout
 // function is used to define an upper bound on dial attempts. This function
 // blocks until the connection is handled (and the handle function returns).
 // This function will clean-up the connection.
 func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
-	dialer := new(net.Dialer)
+	return DialWithOptions(ctx, DefaultDialOptions(), address, handle, handleErr, timeout)
+}
+
+// DialWithOptions is the same as Dial, but uses the DialOptions to customise
+// the socket before it is connected.
+func DialWithOptions(ctx context.Context, opts DialOptions, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	if handle == nil {
+		return fmt.Errorf("nil handle function")
+	}
+	return DialSession(ctx, opts, address, func(_ context.Context, conn net.Conn) { handle(conn) }, handleErr, timeout)
+}
+
+// DialSession is the same as DialWithOptions, but passes a context to the
+// handle function. Establishing the connection is bounded by the
+// EstablishTimeout of the DialOptions, but the context passed to the handle
+// function is derived from the original context, so that the session can
+// outlive the establishment timeout while still being cancelled with the
+// original context.
+func DialSession(ctx context.Context, opts DialOptions, address string, handle func(context.Context, net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	dial := opts.Dial
+	if dial == nil {
+		dialer := new(net.Dialer)
+		dialer.Control = opts.Control
+		if opts.KeepAlive != nil {
+			dialer.KeepAlive = -1
+			dialer.Control = chainControl(opts.Control, keepAliveControl(*opts.KeepAlive))
+		}
+		dial = func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", address)
+		}
+	}
+	if opts.HTTPProxy != nil {
+		dial = opts.HTTPProxy.tunnel(dial)
+	}
 
 	if handle == nil {
 		return fmt.Errorf("nil handle function")
@@ -119,29 +423,52 @@ func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr
 		timeout = func(int) time.Duration { return time.Second }
 	}
 
+	establishCtx, establishCancel := ctx, context.CancelFunc(func() {})
+	if opts.EstablishTimeout > 0 {
+		establishCtx, establishCancel = context.WithTimeout(ctx, opts.EstablishTimeout)
+	}
+	defer establishCancel()
+
+	attemptErrs := make([]error, 0, MaxDialErrors)
 	for attempt := 1; ; attempt++ {
 		select {
-		case <-ctx.Done():
-			return fmt.Errorf("dialing %w", ctx.Err())
+		case <-establishCtx.Done():
+			return &DialError{Err: establishCtx.Err(), Attempts: attempt - 1, AttemptErrs: attemptErrs}
 		default:
 		}
 
-		dialCtx, dialCancel := context.WithTimeout(ctx, timeout(attempt))
-		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		dialCtx, dialCancel := context.WithTimeout(establishCtx, timeout(attempt))
+		conn, err := dial(dialCtx, address)
 		if err != nil {
+			if len(attemptErrs) == MaxDialErrors {
+				attemptErrs = append(attemptErrs[:0], attemptErrs[1:]...)
+			}
+			attemptErrs = append(attemptErrs, err)
 			handleErr(err)
 			<-dialCtx.Done()
 			dialCancel()
 			continue
 		}
 		dialCancel()
+		establishCancel()
+		if err := SetNoDelay(conn, opts.NoDelay); err != nil {
+			handleErr(err)
+		}
+		if opts.KeepAlive != nil {
+			if err := SetKeepAlive(conn, *opts.KeepAlive); err != nil {
+				handleErr(err)
+			}
+		}
+		if opts.OnConnect != nil {
+			opts.OnConnect(newConnInfo(conn, attempt))
+		}
 
 		return func() (err error) {
 			defer func() {
 				err = conn.Close()
 			}()
 
-			handle(conn)
+			handle(ctx, conn)
 			return
 		}()
 	}
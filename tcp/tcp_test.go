@@ -2,10 +2,13 @@ package tcp_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/muirglacier/aw/policy"
@@ -211,4 +214,303 @@ var _ = Describe("TCP", func() {
 			}
 		})
 	})
+
+	Context("when dialing with a control function", func() {
+		It("should call the control function before connecting", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			controlled := make(chan string, 1)
+			opts := tcp.DefaultDialOptions().WithControl(func(network, address string, c syscall.RawConn) error {
+				controlled <- address
+				return nil
+			})
+			handled := false
+			err = tcp.DialWithOptions(ctx, opts, fmt.Sprintf("127.0.0.1:%v", port), func(net.Conn) { handled = true }, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handled).To(BeTrue())
+			Expect(controlled).To(Receive(Equal(fmt.Sprintf("127.0.0.1:%v", port))))
+		})
+	})
+
+	Context("when setting no delay", func() {
+		It("should ignore connections that are not TCP connections", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(tcp.SetNoDelay(conn1, false)).To(Succeed())
+		})
+	})
+
+	Context("when dialing with an establish timeout", func() {
+		It("should not apply the timeout to the session", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			opts := tcp.DefaultDialOptions().WithEstablishTimeout(50 * time.Millisecond)
+			Expect(tcp.DialSession(ctx, opts, fmt.Sprintf("127.0.0.1:%v", port), func(ctx context.Context, conn net.Conn) {
+				select {
+				case <-ctx.Done():
+					Fail("session context is done")
+				case <-time.After(100 * time.Millisecond):
+				}
+			}, nil, nil)).To(Succeed())
+		})
+
+		It("should return an error when the connection cannot be established in time", func() {
+			// Find a port that is not being listened on.
+			listener, port, err := tcp.ListenerWithAssignedPort(context.Background(), "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+
+			opts := tcp.DefaultDialOptions().WithEstablishTimeout(50 * time.Millisecond)
+			err = tcp.DialWithOptions(context.Background(), opts, fmt.Sprintf("127.0.0.1:%v", port), func(net.Conn) {}, nil, policy.ConstantTimeout(10*time.Millisecond))
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("should cancel the session when the original context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			opts := tcp.DefaultDialOptions().WithEstablishTimeout(time.Minute)
+			Expect(tcp.DialSession(ctx, opts, fmt.Sprintf("127.0.0.1:%v", port), func(ctx context.Context, conn net.Conn) {
+				cancel()
+				Eventually(ctx.Done()).Should(BeClosed())
+			}, nil, nil)).To(Succeed())
+		})
+	})
+
+	Context("when dialing with a connect function", func() {
+		It("should report the connection info before handling the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			infos := make(chan tcp.ConnInfo, 1)
+			opts := tcp.DefaultDialOptions().WithOnConnect(func(info tcp.ConnInfo) {
+				infos <- info
+			})
+			Expect(tcp.DialWithOptions(ctx, opts, fmt.Sprintf("127.0.0.1:%v", port), func(conn net.Conn) {
+				var info tcp.ConnInfo
+				Expect(infos).To(Receive(&info))
+				Expect(info.RemoteAddr.String()).To(Equal(conn.RemoteAddr().String()))
+				Expect(info.LocalAddr.String()).To(Equal(conn.LocalAddr().String()))
+				Expect(info.Network).To(Equal("tcp4"))
+				Expect(info.Attempt).To(Equal(1))
+			}, nil, nil)).To(Succeed())
+		})
+	})
+
+	Context("when dialing with a custom dial function", func() {
+		It("should retry the dial function and handle its connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			attempts := 0
+			opts := tcp.DefaultDialOptions().WithDial(func(ctx context.Context, address string) (net.Conn, error) {
+				Expect(address).To(Equal("in-memory"))
+				attempts++
+				if attempts < 3 {
+					return nil, fmt.Errorf("attempt %v failed", attempts)
+				}
+				conn, other := net.Pipe()
+				go func() {
+					defer other.Close()
+					other.Write([]byte("hello"))
+				}()
+				return conn, nil
+			})
+			Expect(tcp.DialWithOptions(ctx, opts, "in-memory", func(conn net.Conn) {
+				buf := make([]byte, 5)
+				_, err := io.ReadFull(conn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buf).To(Equal([]byte("hello")))
+			}, nil, policy.ConstantTimeout(10*time.Millisecond))).To(Succeed())
+			Expect(attempts).To(Equal(3))
+		})
+	})
+
+	Context("when dialing IPv6 addresses", func() {
+		It("should accept bracketed addresses on the wildcard address", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "::")
+			if err != nil {
+				Skip(fmt.Sprintf("ipv6 is not available: %v", err))
+			}
+			Expect(listener.Addr().String()).To(Equal(fmt.Sprintf("[::]:%v", port)))
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			Expect(tcp.Dial(ctx, fmt.Sprintf("[::1]:%v", port), func(conn net.Conn) {
+				Expect(conn.RemoteAddr().String()).To(Equal(fmt.Sprintf("[::1]:%v", port)))
+			}, nil, nil)).To(Succeed())
+		})
+
+		It("should dial link-local addresses with a zone", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			host, ok := linkLocalHost()
+			if !ok {
+				Skip("no interface has a link-local address")
+			}
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, host)
+			Expect(err).ToNot(HaveOccurred())
+			go tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+
+			address := net.JoinHostPort(host, fmt.Sprintf("%v", port))
+			Expect(tcp.Dial(ctx, address, func(conn net.Conn) {
+				Expect(conn.RemoteAddr().String()).To(Equal(address))
+			}, nil, nil)).To(Succeed())
+		})
+	})
+
+	Context("when listening with a pool of workers", func() {
+		It("should reject connections when the workers are busy and the queue is full", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+
+			started := make(chan struct{}, 3)
+			busy := make(chan struct{})
+			rejected := make(chan error, 3)
+			opts := tcp.DefaultListenOptions().WithWorkers(1).WithQueueSize(1)
+			go tcp.ListenWithListenerOptions(ctx, listener, opts, func(net.Conn) {
+				started <- struct{}{}
+				<-busy
+			}, func(err error) {
+				if errors.Is(err, tcp.ErrPoolFull) {
+					rejected <- err
+				}
+			}, nil)
+			conns := []net.Conn{}
+			defer func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}()
+			dial := func() {
+				conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+				Expect(err).ToNot(HaveOccurred())
+				conns = append(conns, conn)
+			}
+
+			// The first connection occupies the worker.
+			dial()
+			Eventually(started).Should(Receive())
+			// The second connection is queued, and the third connection is
+			// rejected.
+			dial()
+			dial()
+			Eventually(rejected).Should(Receive())
+			Consistently(rejected).ShouldNot(Receive())
+
+			// Once the worker is free, the queued connection is handled.
+			close(busy)
+			Eventually(started).Should(Receive())
+		})
+	})
+
+	Context("when listening with a slow allow function", func() {
+		It("should keep accepting connections when the allow function is deferred", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+
+			// The first connection blocks the allow function until the test
+			// ends, and all other connections are allowed immediately.
+			blocked := make(chan struct{})
+			defer close(blocked)
+			allowed := 0
+			allowMu := new(sync.Mutex)
+			allow := func(net.Conn) (error, policy.Cleanup) {
+				allowMu.Lock()
+				allowed++
+				first := allowed == 1
+				allowMu.Unlock()
+				if first {
+					<-blocked
+				}
+				return nil, nil
+			}
+			handled := make(chan struct{}, 1)
+			opts := tcp.DefaultListenOptions().WithDeferAllow(true)
+			go tcp.ListenWithListenerOptions(ctx, listener, opts, func(net.Conn) {
+				handled <- struct{}{}
+			}, nil, allow)
+
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+			}
+			Eventually(handled).Should(Receive())
+		})
+	})
+
+	Context("when dialing an address that refuses connections", func() {
+		It("should return the errors from the dial attempts", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			// Find a port that is not being listened on.
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+
+			err = tcp.Dial(ctx, fmt.Sprintf("127.0.0.1:%v", port), func(net.Conn) {}, nil, policy.ConstantTimeout(10*time.Millisecond))
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(errors.Is(err, syscall.ECONNREFUSED)).To(BeTrue())
+			opErr := new(net.OpError)
+			Expect(errors.As(err, &opErr)).To(BeTrue())
+
+			dialErr := new(tcp.DialError)
+			Expect(errors.As(err, &dialErr)).To(BeTrue())
+			Expect(dialErr.Attempts).To(BeNumerically(">", 1))
+			Expect(len(dialErr.AttemptErrs)).To(BeNumerically("<=", tcp.MaxDialErrors))
+		})
+	})
 })
+
+// linkLocalHost returns an IPv6 link-local address, with its zone, that is
+// assigned to one of the network interfaces.
+func linkLocalHost() (string, bool) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", false
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP.String() + "%" + iface.Name, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,129 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/policy"
+)
+
+// TLSHandshakeTimeout is the maximum duration spent on a TLS handshake by
+// ListenWithTLS and DialWithTLS, when the context does not have an earlier
+// deadline. It stops remote peers from holding connections open by never
+// finishing the handshake.
+const TLSHandshakeTimeout = 10 * time.Second
+
+// ListenWithTLS is the same as Listen, but wraps accepted connections in TLS
+// using the server configuration. The TLS handshake is finished before the
+// handle function is called, and failed handshakes are passed to the error
+// handler. The allow function is called with the connection before it is
+// wrapped, so that connections can be rejected before paying for a handshake.
+func ListenWithTLS(ctx context.Context, address string, tlsConfig *tls.Config, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	if handle == nil {
+		return fmt.Errorf("nil handle function")
+	}
+	if tlsConfig == nil {
+		return fmt.Errorf("nil tls config")
+	}
+	if handleErr == nil {
+		handleErr = func(error) {}
+	}
+	return Listen(ctx, address, func(conn net.Conn) {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if err := handshakeTLS(ctx, tlsConn); err != nil {
+			handleErr(fmt.Errorf("tls handshake with %v: %w", conn.RemoteAddr(), err))
+			return
+		}
+		handle(tlsConn)
+	}, handleErr, allow)
+}
+
+// DialWithTLS is the same as Dial, but wraps the dialed connection in TLS
+// using the client configuration. If the configuration does not set a server
+// name, then the host of the address is used (unless verification is
+// skipped). The TLS handshake is finished before the handle function is
+// called. A failed handshake is passed to the error handler, and returned,
+// and the handle function is not called.
+func DialWithTLS(ctx context.Context, address string, tlsConfig *tls.Config, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	return DialWithTLSOptions(ctx, DefaultDialOptions(), address, tlsConfig, handle, handleErr, timeout)
+}
+
+// DialWithTLSOptions is the same as DialWithTLS, but uses the DialOptions to
+// customise the socket before it is connected. The options apply to the
+// connection that is wrapped in TLS, so an HTTPProxy is tunnelled through
+// before the TLS handshake.
+func DialWithTLSOptions(ctx context.Context, opts DialOptions, address string, tlsConfig *tls.Config, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	if handle == nil {
+		return fmt.Errorf("nil handle function")
+	}
+	if tlsConfig == nil {
+		return fmt.Errorf("nil tls config")
+	}
+	if handleErr == nil {
+		handleErr = func(error) {}
+	}
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("split host port: %w", err)
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	var handshakeErr error
+	err := DialSession(ctx, opts, address, func(ctx context.Context, conn net.Conn) {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := handshakeTLS(ctx, tlsConn); err != nil {
+			handshakeErr = fmt.Errorf("tls handshake with %v: %w", conn.RemoteAddr(), err)
+			handleErr(handshakeErr)
+			return
+		}
+		handle(tlsConn)
+	}, handleErr, timeout)
+	if handshakeErr != nil {
+		return handshakeErr
+	}
+	return err
+}
+
+// handshakeTLS finishes the TLS handshake of a connection before the deadline
+// of the context (or the TLSHandshakeTimeout, whichever is first). The
+// handshake is aborted if the context is done. The deadline of the connection
+// is cleared after a successful handshake.
+func handshakeTLS(ctx context.Context, conn *tls.Conn) error {
+	deadline := time.Now().Add(TLSHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Unblock the handshake.
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	err := conn.Handshake()
+	close(done)
+	<-stopped
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("clear deadline: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package tcp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/policy"
+	"github.com/muirglacier/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS", func() {
+	// newCert returns a self-signed certificate for the loopback address, and
+	// a pool of roots that trusts it.
+	newCert := func() (tls.Certificate, *x509.CertPool) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "localhost"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).ToNot(HaveOccurred())
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, roots
+	}
+
+	freePort := func() int {
+		listener, port, err := tcp.ListenerWithAssignedPort(context.Background(), "127.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listener.Close()).To(Succeed())
+		return port
+	}
+
+	timeout := func(int) time.Duration { return time.Second }
+
+	Context("when the remote peer is trusted", func() {
+		It("should handle connections after the TLS handshake", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cert, roots := newCert()
+			port := freePort()
+			go func() {
+				defer GinkgoRecover()
+				Expect(tcp.ListenWithTLS(
+					ctx,
+					fmt.Sprintf("127.0.0.1:%v", port),
+					&tls.Config{Certificates: []tls.Certificate{cert}},
+					func(conn net.Conn) {
+						defer GinkgoRecover()
+						tlsConn, ok := conn.(*tls.Conn)
+						Expect(ok).To(BeTrue())
+						Expect(tlsConn.ConnectionState().HandshakeComplete).To(BeTrue())
+						buf := [5]byte{}
+						_, err := io.ReadFull(conn, buf[:])
+						Expect(err).ToNot(HaveOccurred())
+						_, err = conn.Write(buf[:])
+						Expect(err).ToNot(HaveOccurred())
+					},
+					nil,
+					nil,
+				)).To(Equal(context.Canceled))
+			}()
+
+			received := make(chan []byte, 1)
+			Expect(tcp.DialWithTLS(
+				ctx,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{RootCAs: roots},
+				func(conn net.Conn) {
+					defer GinkgoRecover()
+					tlsConn, ok := conn.(*tls.Conn)
+					Expect(ok).To(BeTrue())
+					Expect(tlsConn.ConnectionState().HandshakeComplete).To(BeTrue())
+					_, err := conn.Write([]byte("hello"))
+					Expect(err).ToNot(HaveOccurred())
+					buf := [5]byte{}
+					_, err = io.ReadFull(conn, buf[:])
+					Expect(err).ToNot(HaveOccurred())
+					received <- buf[:]
+				},
+				nil,
+				timeout,
+			)).To(Succeed())
+			Expect(<-received).To(Equal([]byte("hello")))
+		})
+	})
+
+	Context("when dialing with options", func() {
+		It("should use the options to dial the connection that is wrapped in TLS", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cert, roots := newCert()
+			port := freePort()
+			go tcp.ListenWithTLS(
+				ctx,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{Certificates: []tls.Certificate{cert}},
+				func(net.Conn) {},
+				nil,
+				nil,
+			)
+
+			// The dial function of the options is used to dial the
+			// connection, so that it can be wrapped.
+			dialed := make(chan net.Conn, 1)
+			opts := tcp.DefaultDialOptions().WithDial(func(ctx context.Context, address string) (net.Conn, error) {
+				conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+				if err == nil {
+					dialed <- conn
+				}
+				return conn, err
+			})
+			time.Sleep(100 * time.Millisecond)
+			Expect(tcp.DialWithTLSOptions(
+				ctx,
+				opts,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{RootCAs: roots},
+				func(conn net.Conn) {
+					defer GinkgoRecover()
+					Expect(conn).To(BeAssignableToTypeOf(&tls.Conn{}))
+				},
+				nil,
+				timeout,
+			)).To(Succeed())
+			Expect(dialed).To(Receive())
+		})
+	})
+
+	Context("when the remote peer is not trusted", func() {
+		It("should pass the handshake failure to the error handlers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cert, _ := newCert()
+			_, otherRoots := newCert()
+			port := freePort()
+			listenErrs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				tcp.ListenWithTLS(
+					ctx,
+					fmt.Sprintf("127.0.0.1:%v", port),
+					&tls.Config{Certificates: []tls.Certificate{cert}},
+					func(net.Conn) {
+						defer GinkgoRecover()
+						Fail("listener should not handle the connection")
+					},
+					func(err error) {
+						select {
+						case listenErrs <- err:
+						default:
+						}
+					},
+					nil,
+				)
+			}()
+
+			dialErrs := make(chan error, 1)
+			time.Sleep(100 * time.Millisecond)
+			Expect(tcp.DialWithTLS(
+				ctx,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{RootCAs: otherRoots},
+				func(net.Conn) {
+					defer GinkgoRecover()
+					Fail("dialer should not handle the connection")
+				},
+				func(err error) {
+					select {
+					case dialErrs <- err:
+					default:
+					}
+				},
+				timeout,
+			)).To(MatchError(ContainSubstring("tls handshake")))
+			Eventually(dialErrs).Should(Receive(MatchError(ContainSubstring("tls handshake"))))
+			Eventually(listenErrs).Should(Receive(MatchError(ContainSubstring("tls handshake"))))
+		})
+	})
+
+	Context("when the remote peer does not finish the handshake", func() {
+		It("should fail the handshake when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			go func() {
+				// Accept connections, but never respond to them.
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+				}
+			}()
+
+			dialCtx, dialCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer dialCancel()
+			dialErrs := make(chan error, 1)
+			start := time.Now()
+			tcp.DialWithTLS(
+				dialCtx,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{InsecureSkipVerify: true},
+				func(net.Conn) {
+					defer GinkgoRecover()
+					Fail("dialer should not handle the connection")
+				},
+				func(err error) {
+					select {
+					case dialErrs <- err:
+					default:
+					}
+				},
+				timeout,
+			)
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Eventually(dialErrs).Should(Receive(MatchError(context.DeadlineExceeded)))
+		})
+	})
+
+	Context("when the allow function rejects a connection", func() {
+		It("should reject the connection before the handshake", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cert, roots := newCert()
+			port := freePort()
+			allowed := make(chan net.Conn, 1)
+			listenErrs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				tcp.ListenWithTLS(
+					ctx,
+					fmt.Sprintf("127.0.0.1:%v", port),
+					&tls.Config{Certificates: []tls.Certificate{cert}},
+					func(net.Conn) {
+						defer GinkgoRecover()
+						Fail("listener should not handle the connection")
+					},
+					func(err error) {
+						select {
+						case listenErrs <- err:
+						default:
+						}
+					},
+					func(conn net.Conn) (error, policy.Cleanup) {
+						allowed <- conn
+						return fmt.Errorf("rejected"), nil
+					},
+				)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			tcp.DialWithTLS(
+				ctx,
+				fmt.Sprintf("127.0.0.1:%v", port),
+				&tls.Config{RootCAs: roots},
+				func(net.Conn) {
+					defer GinkgoRecover()
+					Fail("dialer should not handle the connection")
+				},
+				nil,
+				timeout,
+			)
+
+			var conn net.Conn
+			Eventually(allowed).Should(Receive(&conn))
+			Expect(conn).To(BeAssignableToTypeOf(&net.TCPConn{}))
+			Consistently(listenErrs).ShouldNot(Receive())
+		})
+	})
+})
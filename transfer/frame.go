@@ -0,0 +1,57 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	kindChunk  = uint8(1)
+	kindAck    = uint8(2)
+	kindResume = uint8(3)
+)
+
+// frameHeaderSize is the size, in bytes, of the header of a frame: the kind,
+// the ID, the offset, and the size of the transfer.
+const frameHeaderSize = 1 + 8 + 8 + 8
+
+// A frame is the data of a message that is part of a transfer. Chunks carry
+// the data of the transfer from the offset. Acks carry the offset that has
+// been received. Requests to resume carry the offset from which the transfer
+// should be resumed.
+type frame struct {
+	kind   uint8
+	id     ID
+	offset uint64
+	size   uint64
+	data   []byte
+}
+
+func (f frame) marshal() []byte {
+	buf := make([]byte, frameHeaderSize+len(f.data))
+	buf[0] = f.kind
+	binary.BigEndian.PutUint64(buf[1:9], uint64(f.id))
+	binary.BigEndian.PutUint64(buf[9:17], f.offset)
+	binary.BigEndian.PutUint64(buf[17:25], f.size)
+	copy(buf[frameHeaderSize:], f.data)
+	return buf
+}
+
+func unmarshalFrame(buf []byte) (frame, error) {
+	if len(buf) < frameHeaderSize {
+		return frame{}, fmt.Errorf("bad frame: expected at least %v bytes, got %v bytes", frameHeaderSize, len(buf))
+	}
+	f := frame{
+		kind:   buf[0],
+		id:     ID(binary.BigEndian.Uint64(buf[1:9])),
+		offset: binary.BigEndian.Uint64(buf[9:17]),
+		size:   binary.BigEndian.Uint64(buf[17:25]),
+		data:   buf[frameHeaderSize:],
+	}
+	switch f.kind {
+	case kindChunk, kindAck, kindResume:
+	default:
+		return frame{}, fmt.Errorf("bad frame: unknown kind %v", f.kind)
+	}
+	return f, nil
+}
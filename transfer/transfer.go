@@ -0,0 +1,631 @@
+// Package transfer implements resumable transfers of large payloads to remote
+// peers. Payloads are split into chunks that are acknowledged by the receiver,
+// so that a transfer that is interrupted (for example, because the connection
+// was dropped) can be resumed from the last acknowledged offset, instead of
+// starting over. Both peers keep the state of incomplete transfers, keyed by
+// transfer ID, until the transfer completes or expires.
+//
+//	// Send a payload, and resume it if it is interrupted.
+//	transferID, err := transfers.Send(ctx, remote, payload)
+//	if err != nil {
+//		err = transfers.Resume(ctx, transferID)
+//	}
+//
+// Alternatively, the receiver can ask the sender to resume a transfer (for
+// example, after it has reconnected) by using RequestResume.
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// Default options.
+var (
+	DefaultChunkSize        = 64 * 1024        // 64KB
+	DefaultMaxTransferSize  = 64 * 1024 * 1024 // 64MB
+	DefaultMaxTransfers     = 64
+	DefaultMaxPeerTransfers = 8
+	DefaultAckTimeout       = 10 * time.Second
+	DefaultTTL              = 5 * time.Minute
+)
+
+var (
+	// ErrTooManyTransfers is returned when starting a transfer while the
+	// maximum number of incomplete transfers are being retained.
+	ErrTooManyTransfers = errors.New("too many transfers")
+	// ErrTransferTooLarge is returned when starting a transfer of a payload
+	// that is larger than the maximum transfer size.
+	ErrTransferTooLarge = errors.New("transfer too large")
+	// ErrUnknownTransfer is returned when resuming a transfer that has
+	// completed, expired, or never existed.
+	ErrUnknownTransfer = errors.New("unknown transfer")
+	// ErrTransferInProgress is returned when resuming a transfer that is
+	// already being sent.
+	ErrTransferInProgress = errors.New("transfer in progress")
+	// ErrAckTimeout is returned when the remote peer does not acknowledge a
+	// chunk before the AckTimeout.
+	ErrAckTimeout = errors.New("ack timeout")
+)
+
+// An ID identifies a transfer. IDs are chosen at random by the sender, and the
+// same ID refers to the same transfer on both peers.
+type ID uint64
+
+// String returns a human-readable representation of the ID.
+func (transferID ID) String() string {
+	return fmt.Sprintf("%016x", uint64(transferID))
+}
+
+// A Sender sends messages to remote peers. The Transport implements this
+// interface.
+type Sender interface {
+	Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error
+}
+
+// Options used to parameterise the behaviour of Transfers.
+type Options struct {
+	Logger           *zap.Logger
+	Clock            clock.Clock
+	ChunkSize        int
+	MaxTransferSize  int
+	MaxTransfers     int
+	MaxPeerTransfers int
+	AckTimeout       time.Duration
+	TTL              time.Duration
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return Options{
+		Logger:           logger,
+		Clock:            clock.Real(),
+		ChunkSize:        DefaultChunkSize,
+		MaxTransferSize:  DefaultMaxTransferSize,
+		MaxTransfers:     DefaultMaxTransfers,
+		MaxPeerTransfers: DefaultMaxPeerTransfers,
+		AckTimeout:       DefaultAckTimeout,
+		TTL:              DefaultTTL,
+	}
+}
+
+// WithLogger sets the Logger used by Transfers.
+func (opts Options) WithLogger(logger *zap.Logger) Options {
+	opts.Logger = logger
+	return opts
+}
+
+// WithClock sets the Clock used to expire incomplete transfers.
+func (opts Options) WithClock(clock clock.Clock) Options {
+	opts.Clock = clock
+	return opts
+}
+
+// WithChunkSize sets the maximum number of payload bytes that are sent in each
+// message. It must leave room for the header of the chunk within the maximum
+// message size of the remote peer.
+func (opts Options) WithChunkSize(size int) Options {
+	opts.ChunkSize = size
+	return opts
+}
+
+// WithMaxTransferSize sets the maximum size, in bytes, of a payload that can
+// be sent, or received. Together with the MaxTransfers, this bounds the memory
+// used by the state of incomplete inbound transfers.
+func (opts Options) WithMaxTransferSize(size int) Options {
+	opts.MaxTransferSize = size
+	return opts
+}
+
+// WithMaxTransfers sets the maximum number of incomplete outbound transfers,
+// and the maximum number of incomplete inbound transfers, that are retained.
+// When the maximum is reached, new outbound transfers fail with
+// ErrTooManyTransfers, and new inbound transfers are dropped, until a transfer
+// completes or expires.
+func (opts Options) WithMaxTransfers(max int) Options {
+	opts.MaxTransfers = max
+	return opts
+}
+
+// WithMaxPeerTransfers sets the maximum number of incomplete inbound transfers
+// that are retained for each remote peer, so that one remote peer cannot use
+// all of the MaxTransfers. When the maximum is reached, new inbound transfers
+// from the remote peer are dropped, until one of its transfers completes or
+// expires.
+func (opts Options) WithMaxPeerTransfers(max int) Options {
+	opts.MaxPeerTransfers = max
+	return opts
+}
+
+// WithAckTimeout sets the duration that a sender waits for each chunk to be
+// acknowledged before the transfer is interrupted.
+func (opts Options) WithAckTimeout(timeout time.Duration) Options {
+	opts.AckTimeout = timeout
+	return opts
+}
+
+// WithTTL sets the duration after which an incomplete transfer, that has not
+// made any progress, is expired and can no longer be resumed.
+func (opts Options) WithTTL(ttl time.Duration) Options {
+	opts.TTL = ttl
+	return opts
+}
+
+// A Transfer is a payload that has been completely received from a remote peer.
+type Transfer struct {
+	ID   ID
+	From id.Signatory
+	Data []byte
+}
+
+// Progress describes an incomplete inbound transfer.
+type Progress struct {
+	ID     ID
+	From   id.Signatory
+	Offset uint64
+	Size   uint64
+}
+
+type outgoing struct {
+	id     ID
+	remote id.Signatory
+	data   []byte
+
+	// The following fields are guarded by the mutex of the Transfers.
+	acked   uint64
+	active  time.Time
+	pushing bool
+
+	// acks receives the most recent acknowledged offset.
+	acks chan uint64
+}
+
+type incomingKey struct {
+	from id.Signatory
+	id   ID
+}
+
+type incoming struct {
+	size   uint64
+	data   []byte
+	active time.Time
+}
+
+// pendingAck is the most recent offset of an inbound transfer that is waiting
+// to be acknowledged.
+type pendingAck struct {
+	offset  uint64
+	pending bool
+}
+
+// Transfers sends, and receives, resumable transfers. Inbound messages must be
+// passed to Transfers using the Receive method (usually by using it as the
+// receiver of the Transport). Transfers are safe for concurrent use.
+type Transfers struct {
+	opts   Options
+	sender Sender
+
+	mu       *sync.Mutex
+	outgoing map[ID]*outgoing
+	incoming map[incomingKey]*incoming
+	// peerIncoming is the number of incomplete inbound transfers from each
+	// remote peer.
+	peerIncoming map[id.Signatory]int
+	// done is the time at which recent inbound transfers were completed, so
+	// that chunks which are sent again (because the last ack was lost) are
+	// acknowledged instead of starting the transfer over.
+	done map[incomingKey]time.Time
+	acks map[incomingKey]*pendingAck
+
+	completed chan Transfer
+}
+
+// New returns Transfers that use the Sender to send chunks, acknowledgements,
+// and requests to resume.
+func New(opts Options, sender Sender) *Transfers {
+	return &Transfers{
+		opts:   opts,
+		sender: sender,
+
+		mu:           new(sync.Mutex),
+		outgoing:     map[ID]*outgoing{},
+		incoming:     map[incomingKey]*incoming{},
+		peerIncoming: map[id.Signatory]int{},
+		done:         map[incomingKey]time.Time{},
+		acks:         map[incomingKey]*pendingAck{},
+
+		completed: make(chan Transfer, opts.MaxTransfers),
+	}
+}
+
+// Send a payload to the remote peer, and return the ID of the transfer. This
+// method blocks until every chunk has been acknowledged, or until the transfer
+// is interrupted. If the transfer is interrupted, then the ID can be used to
+// Resume it until it expires. The payload must not be modified until the
+// transfer is complete.
+func (t *Transfers) Send(ctx context.Context, remote id.Signatory, data []byte) (ID, error) {
+	if len(data) > t.opts.MaxTransferSize {
+		return 0, fmt.Errorf("%w: expected at most %v bytes, got %v bytes", ErrTransferTooLarge, t.opts.MaxTransferSize, len(data))
+	}
+
+	t.mu.Lock()
+	t.prune(t.opts.Clock.Now())
+	if len(t.outgoing) >= t.opts.MaxTransfers {
+		t.mu.Unlock()
+		return 0, fmt.Errorf("%w: %v incomplete outbound transfers", ErrTooManyTransfers, len(t.outgoing))
+	}
+	transferID, err := t.newID()
+	if err != nil {
+		t.mu.Unlock()
+		return 0, err
+	}
+	out := &outgoing{
+		id:     transferID,
+		remote: remote,
+		data:   data,
+		active: t.opts.Clock.Now(),
+		acks:   make(chan uint64, 1),
+	}
+	t.outgoing[transferID] = out
+	t.mu.Unlock()
+
+	return transferID, t.push(ctx, out)
+}
+
+// Resume an interrupted outbound transfer from the last offset acknowledged by
+// the remote peer. This method blocks until every chunk has been acknowledged,
+// or until the transfer is interrupted again.
+func (t *Transfers) Resume(ctx context.Context, transferID ID) error {
+	t.mu.Lock()
+	t.prune(t.opts.Clock.Now())
+	out, ok := t.outgoing[transferID]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownTransfer, transferID)
+	}
+	return t.push(ctx, out)
+}
+
+// RequestResume asks the sender of an incomplete inbound transfer to resume it
+// from the last offset that was received. The sender resumes the transfer in
+// the background, bounded by the TTL. This is useful after reconnecting to the
+// sender.
+func (t *Transfers) RequestResume(ctx context.Context, from id.Signatory, transferID ID) error {
+	t.mu.Lock()
+	t.prune(t.opts.Clock.Now())
+	in, ok := t.incoming[incomingKey{from: from, id: transferID}]
+	offset := uint64(0)
+	if ok {
+		offset = uint64(len(in.data))
+	}
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownTransfer, transferID)
+	}
+	return t.send(ctx, from, frame{kind: kindResume, id: transferID, offset: offset})
+}
+
+// Completed returns the channel of inbound transfers that have been completely
+// received. If the channel is full, then completed transfers are dropped, so
+// it must be drained.
+func (t *Transfers) Completed() <-chan Transfer {
+	return t.completed
+}
+
+// Incomplete returns the Progress of all incomplete inbound transfers that have
+// not expired.
+func (t *Transfers) Incomplete() []Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(t.opts.Clock.Now())
+	progress := make([]Progress, 0, len(t.incoming))
+	for key, in := range t.incoming {
+		progress = append(progress, Progress{ID: key.id, From: key.from, Offset: uint64(len(in.data)), Size: in.size})
+	}
+	return progress
+}
+
+// Receive an inbound message from a remote peer. Messages that are not part of
+// a transfer are ignored. This method has the signature expected by the
+// receiver of the Transport, and never returns an error.
+func (t *Transfers) Receive(from id.Signatory, packet wire.Packet) error {
+	if packet.Msg.Type != wire.MsgTypeTransfer {
+		return nil
+	}
+	f, err := unmarshalFrame(packet.Msg.Data)
+	if err != nil {
+		t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.Error(err))
+		return nil
+	}
+	switch f.kind {
+	case kindChunk:
+		t.receiveChunk(from, f)
+	case kindAck:
+		t.receiveAck(from, f, false)
+	case kindResume:
+		t.receiveAck(from, f, true)
+	}
+	return nil
+}
+
+// push chunks of an outbound transfer, starting from the last acknowledged
+// offset, until every chunk has been acknowledged.
+func (t *Transfers) push(ctx context.Context, out *outgoing) error {
+	t.mu.Lock()
+	if out.pushing {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrTransferInProgress, out.id)
+	}
+	out.pushing = true
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		out.pushing = false
+		out.active = t.opts.Clock.Now()
+		t.mu.Unlock()
+	}()
+
+	size := uint64(len(out.data))
+	// An empty payload is still sent as one empty chunk, so that the remote
+	// peer completes the transfer, and it is only done once that chunk has
+	// been acknowledged.
+	acknowledged := false
+	for {
+		t.mu.Lock()
+		acked := out.acked
+		out.active = t.opts.Clock.Now()
+		if acked >= size && (size > 0 || acknowledged) {
+			delete(t.outgoing, out.id)
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+
+		end := acked + uint64(t.opts.ChunkSize)
+		if end > size {
+			end = size
+		}
+		if err := t.send(ctx, out.remote, frame{kind: kindChunk, id: out.id, offset: acked, size: size, data: out.data[acked:end]}); err != nil {
+			return fmt.Errorf("sending chunk of %v at %v: %w", out.id, acked, err)
+		}
+
+		timer := t.opts.Clock.NewTimer(t.opts.AckTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("waiting for ack of %v at %v: %w", out.id, acked, ctx.Err())
+		case <-timer.C():
+			return fmt.Errorf("waiting for ack of %v at %v: %w", out.id, acked, ErrAckTimeout)
+		case offset := <-out.acks:
+			timer.Stop()
+			// The offset acknowledged by the remote peer is the source of
+			// truth, even if it has gone backwards (for example, because the
+			// remote peer expired the transfer and started over).
+			if offset > size {
+				offset = size
+			}
+			t.mu.Lock()
+			out.acked = offset
+			t.mu.Unlock()
+			acknowledged = true
+		}
+	}
+}
+
+func (t *Transfers) receiveChunk(from id.Signatory, f frame) {
+	now := t.opts.Clock.Now()
+	key := incomingKey{from: from, id: f.id}
+
+	t.mu.Lock()
+	t.prune(now)
+	if _, ok := t.done[key]; ok {
+		// The transfer has already been completed, so the ack of its last
+		// chunk must have been lost.
+		t.mu.Unlock()
+		t.ack(key, f.size)
+		return
+	}
+	in, ok := t.incoming[key]
+	if !ok {
+		switch {
+		case f.size > uint64(t.opts.MaxTransferSize):
+			t.mu.Unlock()
+			t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.String("id", f.id.String()), zap.Error(ErrTransferTooLarge))
+			return
+		case len(t.incoming) >= t.opts.MaxTransfers:
+			t.mu.Unlock()
+			t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.String("id", f.id.String()), zap.Error(ErrTooManyTransfers))
+			return
+		case t.peerIncoming[from] >= t.opts.MaxPeerTransfers:
+			t.mu.Unlock()
+			t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.String("id", f.id.String()), zap.Error(fmt.Errorf("%w: %v incomplete inbound transfers from the remote peer", ErrTooManyTransfers, t.peerIncoming[from])))
+			return
+		}
+		in = &incoming{size: f.size, data: []byte{}}
+		t.incoming[key] = in
+		t.peerIncoming[from]++
+	}
+	if f.size != in.size || f.offset+uint64(len(f.data)) > in.size {
+		t.mu.Unlock()
+		t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.String("id", f.id.String()), zap.Error(fmt.Errorf("bad chunk at %v", f.offset)))
+		return
+	}
+	// Chunks that are not at the expected offset are not appended, but they
+	// are still acknowledged with the expected offset, so that the sender can
+	// realign itself.
+	if f.offset == uint64(len(in.data)) {
+		in.data = append(in.data, f.data...)
+	}
+	in.active = now
+	offset := uint64(len(in.data))
+	done := offset == in.size
+	if done {
+		t.deleteIncoming(key)
+		t.complete(key, now)
+	}
+	t.mu.Unlock()
+
+	t.ack(key, offset)
+
+	if done {
+		select {
+		case t.completed <- Transfer{ID: f.id, From: from, Data: in.data}:
+		default:
+			t.opts.Logger.Warn("completed transfers full", zap.String("remote", from.String()), zap.String("id", f.id.String()))
+		}
+	}
+}
+
+// ack the offset of an inbound transfer. There is at most one goroutine
+// writing the acks of each inbound transfer, and it only writes the most recent
+// offset, so a burst of chunks is acknowledged by as few acks as possible.
+func (t *Transfers) ack(key incomingKey, offset uint64) {
+	t.mu.Lock()
+	p, writing := t.acks[key]
+	if !writing {
+		p = &pendingAck{}
+		t.acks[key] = p
+	}
+	p.offset, p.pending = offset, true
+	t.mu.Unlock()
+	if writing {
+		return
+	}
+
+	go func() {
+		for {
+			t.mu.Lock()
+			if !p.pending {
+				delete(t.acks, key)
+				t.mu.Unlock()
+				return
+			}
+			offset := p.offset
+			p.pending = false
+			t.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), t.opts.AckTimeout)
+			if err := t.send(ctx, key.from, frame{kind: kindAck, id: key.id, offset: offset}); err != nil {
+				t.opts.Logger.Debug("transfer", zap.String("remote", key.from.String()), zap.String("id", key.id.String()), zap.Error(err))
+			}
+			cancel()
+		}
+	}()
+}
+
+// deleteIncoming forgets the state of an inbound transfer. It assumes that the
+// mutex is locked by the caller.
+func (t *Transfers) deleteIncoming(key incomingKey) {
+	delete(t.incoming, key)
+	if t.peerIncoming[key.from]--; t.peerIncoming[key.from] <= 0 {
+		delete(t.peerIncoming, key.from)
+	}
+}
+
+// complete remembers that an inbound transfer has been completed, until it
+// expires. At most MaxTransfers completed transfers are remembered, and the
+// oldest is forgotten first. It assumes that the mutex is locked by the
+// caller.
+func (t *Transfers) complete(key incomingKey, now time.Time) {
+	if len(t.done) >= t.opts.MaxTransfers {
+		oldest, ok := incomingKey{}, false
+		for k, completed := range t.done {
+			if !ok || completed.Before(t.done[oldest]) {
+				oldest, ok = k, true
+			}
+		}
+		delete(t.done, oldest)
+	}
+	t.done[key] = now
+}
+
+// receiveAck delivers an acknowledged offset to an outbound transfer. If the
+// remote peer has requested that the transfer be resumed, and it is not being
+// sent, then it is resumed in the background.
+func (t *Transfers) receiveAck(from id.Signatory, f frame, resume bool) {
+	t.mu.Lock()
+	out, ok := t.outgoing[f.id]
+	if !ok || !out.remote.Equal(&from) {
+		t.mu.Unlock()
+		return
+	}
+	pushing := out.pushing
+	if pushing {
+		// Replace any acknowledged offset that has not been seen yet,
+		// because only the most recent one is relevant.
+		select {
+		case <-out.acks:
+		default:
+		}
+		out.acks <- f.offset
+	} else if resume {
+		out.acked = f.offset
+	}
+	t.mu.Unlock()
+
+	if resume && !pushing {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), t.opts.TTL)
+			defer cancel()
+			if err := t.push(ctx, out); err != nil {
+				t.opts.Logger.Debug("transfer", zap.String("remote", from.String()), zap.String("id", f.id.String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (t *Transfers) send(ctx context.Context, remote id.Signatory, f frame) error {
+	return t.sender.Send(ctx, remote, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeTransfer, Data: f.marshal()})
+}
+
+// prune expired transfers. It assumes that the mutex is locked by the caller.
+// Outbound transfers are not expired while they are being sent.
+func (t *Transfers) prune(now time.Time) {
+	for transferID, out := range t.outgoing {
+		if !out.pushing && now.Sub(out.active) > t.opts.TTL {
+			delete(t.outgoing, transferID)
+		}
+	}
+	for key, in := range t.incoming {
+		if now.Sub(in.active) > t.opts.TTL {
+			t.deleteIncoming(key)
+		}
+	}
+	for key, completed := range t.done {
+		if now.Sub(completed) > t.opts.TTL {
+			delete(t.done, key)
+		}
+	}
+}
+
+// newID returns a random ID that is not used by an outbound transfer. It
+// assumes that the mutex is locked by the caller.
+func (t *Transfers) newID() (ID, error) {
+	for {
+		buf := [8]byte{}
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, fmt.Errorf("generating transfer id: %v", err)
+		}
+		transferID := ID(binary.BigEndian.Uint64(buf[:]))
+		if _, ok := t.outgoing[transferID]; !ok {
+			return transferID, nil
+		}
+	}
+}
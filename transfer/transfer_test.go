@@ -0,0 +1,266 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/transfer"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var errLinkDown = errors.New("link down")
+
+// link is a Sender that delivers messages to the Transfers of a remote peer,
+// and that can be taken down to interrupt transfers.
+type link struct {
+	self id.Signatory
+	to   *transfer.Transfers
+
+	mu     *sync.Mutex
+	down   bool
+	budget int
+	chunks int
+}
+
+func (l *link) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	l.mu.Lock()
+	if l.budget == 0 {
+		l.down = true
+	}
+	if l.down {
+		l.mu.Unlock()
+		return errLinkDown
+	}
+	if l.budget > 0 {
+		l.budget--
+	}
+	if l.to != nil && len(msg.Data) > 0 && msg.Data[0] == 1 {
+		l.chunks++
+	}
+	l.mu.Unlock()
+	return l.to.Receive(l.self, wire.Packet{Msg: msg})
+}
+
+// setBudget sets the number of messages that can be sent before the link goes
+// down. A negative budget never takes the link down.
+func (l *link) setBudget(budget int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.down = false
+	l.budget = budget
+}
+
+func (l *link) numChunks() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chunks
+}
+
+var _ = Describe("Transfers", func() {
+	newPair := func(opts transfer.Options) (*transfer.Transfers, *transfer.Transfers, *link, *link, id.Signatory, id.Signatory) {
+		self, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+		fwd := &link{self: self, mu: new(sync.Mutex), budget: -1}
+		bwd := &link{self: remote, mu: new(sync.Mutex), budget: -1}
+		sender := transfer.New(opts, fwd)
+		receiver := transfer.New(opts, bwd)
+		fwd.to, bwd.to = receiver, sender
+		return sender, receiver, fwd, bwd, self, remote
+	}
+
+	randomData := func(n int) []byte {
+		data := make([]byte, n)
+		rand.Read(data)
+		return data
+	}
+
+	Context("when sending a large payload", func() {
+		It("should deliver the payload in chunks", func() {
+			opts := transfer.DefaultOptions().WithChunkSize(1024)
+			sender, receiver, fwd, _, self, remote := newPair(opts)
+
+			data := randomData(100*1024 + 1)
+			transferID, err := sender.Send(context.Background(), remote, data)
+			Expect(err).ToNot(HaveOccurred())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.ID).To(Equal(transferID))
+			Expect(completed.From).To(Equal(self))
+			Expect(completed.Data).To(Equal(data))
+			Expect(fwd.numChunks()).To(Equal(101))
+			Expect(receiver.Incomplete()).To(BeEmpty())
+		})
+	})
+
+	Context("when sending an empty payload", func() {
+		It("should deliver the payload in one empty chunk", func() {
+			sender, receiver, fwd, _, self, remote := newPair(transfer.DefaultOptions())
+
+			transferID, err := sender.Send(context.Background(), remote, []byte{})
+			Expect(err).ToNot(HaveOccurred())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.ID).To(Equal(transferID))
+			Expect(completed.From).To(Equal(self))
+			Expect(completed.Data).To(BeEmpty())
+			Expect(fwd.numChunks()).To(Equal(1))
+			Expect(receiver.Incomplete()).To(BeEmpty())
+		})
+	})
+
+	Context("when a transfer is interrupted", func() {
+		It("should resume from the last acknowledged offset", func() {
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithAckTimeout(100 * time.Millisecond)
+			sender, receiver, fwd, _, self, remote := newPair(opts)
+
+			data := randomData(10 * 1024)
+			fwd.setBudget(4)
+			transferID, err := sender.Send(context.Background(), remote, data)
+			Expect(errors.Is(err, errLinkDown)).To(BeTrue())
+
+			progress := receiver.Incomplete()
+			Expect(progress).To(HaveLen(1))
+			Expect(progress[0].ID).To(Equal(transferID))
+			Expect(progress[0].From).To(Equal(self))
+			Expect(progress[0].Offset).To(Equal(uint64(4 * 1024)))
+			Expect(progress[0].Size).To(Equal(uint64(len(data))))
+
+			fwd.setBudget(-1)
+			Expect(sender.Resume(context.Background(), transferID)).To(Succeed())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.Data).To(Equal(data))
+			Expect(fwd.numChunks()).To(Equal(10))
+
+			// Completed transfers can no longer be resumed.
+			err = sender.Resume(context.Background(), transferID)
+			Expect(errors.Is(err, transfer.ErrUnknownTransfer)).To(BeTrue())
+		})
+
+		It("should resume when the receiver requests it", func() {
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithAckTimeout(100 * time.Millisecond)
+			sender, receiver, fwd, _, self, remote := newPair(opts)
+
+			data := randomData(10 * 1024)
+			fwd.setBudget(6)
+			transferID, err := sender.Send(context.Background(), remote, data)
+			Expect(err).To(HaveOccurred())
+
+			fwd.setBudget(-1)
+			Expect(receiver.RequestResume(context.Background(), self, transferID)).To(Succeed())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.ID).To(Equal(transferID))
+			Expect(completed.Data).To(Equal(data))
+			Expect(fwd.numChunks()).To(Equal(10))
+		})
+	})
+
+	Context("when the ack of the last chunk is lost", func() {
+		It("should acknowledge the chunk again without receiving the transfer twice", func() {
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithAckTimeout(100 * time.Millisecond)
+			sender, receiver, _, bwd, _, remote := newPair(opts)
+
+			data := randomData(1024)
+			bwd.setBudget(0)
+			transferID, err := sender.Send(context.Background(), remote, data)
+			Expect(errors.Is(err, transfer.ErrAckTimeout)).To(BeTrue())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.Data).To(Equal(data))
+
+			bwd.setBudget(-1)
+			Expect(sender.Resume(context.Background(), transferID)).To(Succeed())
+			Consistently(receiver.Completed(), 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when incomplete transfers expire", func() {
+		It("should not retain their state", func() {
+			fake := clock.NewFake(time.Now())
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithAckTimeout(100 * time.Millisecond).WithTTL(time.Minute).WithClock(fake)
+			sender, receiver, fwd, _, self, remote := newPair(opts)
+
+			fwd.setBudget(2)
+			transferID, err := sender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(err).To(HaveOccurred())
+			Expect(receiver.Incomplete()).To(HaveLen(1))
+
+			fake.Advance(2 * time.Minute)
+			Expect(receiver.Incomplete()).To(BeEmpty())
+			err = sender.Resume(context.Background(), transferID)
+			Expect(errors.Is(err, transfer.ErrUnknownTransfer)).To(BeTrue())
+			err = receiver.RequestResume(context.Background(), self, transferID)
+			Expect(errors.Is(err, transfer.ErrUnknownTransfer)).To(BeTrue())
+		})
+	})
+
+	Context("when there are too many incomplete transfers", func() {
+		It("should not start new transfers", func() {
+			fake := clock.NewFake(time.Now())
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithMaxTransfers(1).WithTTL(time.Minute).WithClock(fake)
+			sender, receiver, fwd, _, _, remote := newPair(opts)
+
+			fwd.setBudget(1)
+			_, err := sender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(errors.Is(err, errLinkDown)).To(BeTrue())
+
+			fwd.setBudget(-1)
+			_, err = sender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(errors.Is(err, transfer.ErrTooManyTransfers)).To(BeTrue())
+
+			fake.Advance(2 * time.Minute)
+			data := randomData(10 * 1024)
+			_, err = sender.Send(context.Background(), remote, data)
+			Expect(err).ToNot(HaveOccurred())
+
+			var completed transfer.Transfer
+			Eventually(receiver.Completed()).Should(Receive(&completed))
+			Expect(completed.Data).To(Equal(data))
+		})
+
+		It("should not retain too many incomplete transfers from one remote peer", func() {
+			opts := transfer.DefaultOptions().WithChunkSize(1024).WithAckTimeout(100 * time.Millisecond).WithMaxPeerTransfers(1)
+			sender, receiver, fwd, _, _, remote := newPair(opts)
+
+			fwd.setBudget(1)
+			_, err := sender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(errors.Is(err, errLinkDown)).To(BeTrue())
+			Expect(receiver.Incomplete()).To(HaveLen(1))
+
+			// The first chunk of the next transfer is dropped, so it is never
+			// acknowledged.
+			fwd.setBudget(-1)
+			_, err = sender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(errors.Is(err, transfer.ErrAckTimeout)).To(BeTrue())
+			Expect(receiver.Incomplete()).To(HaveLen(1))
+
+			// Transfers from other remote peers are not affected. Their acks
+			// are not delivered, but their first chunk is retained.
+			otherSender := transfer.New(opts, &link{self: id.NewPrivKey().Signatory(), to: receiver, mu: new(sync.Mutex), budget: -1})
+			_, err = otherSender.Send(context.Background(), remote, randomData(10*1024))
+			Expect(errors.Is(err, transfer.ErrAckTimeout)).To(BeTrue())
+			Expect(receiver.Incomplete()).To(HaveLen(2))
+		})
+
+		It("should not send payloads that are too large", func() {
+			opts := transfer.DefaultOptions().WithMaxTransferSize(1024)
+			sender, _, _, _, _, remote := newPair(opts)
+
+			_, err := sender.Send(context.Background(), remote, randomData(1025))
+			Expect(errors.Is(err, transfer.ErrTransferTooLarge)).To(BeTrue())
+		})
+	})
+})
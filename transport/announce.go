@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ErrInvalidAnnounceAddress is returned when an announce address is not a
+// "host:port" that remote peers can dial.
+var ErrInvalidAnnounceAddress = errors.New("invalid announce address")
+
+// validateAnnounceAddress returns an error wrapping ErrInvalidAnnounceAddress
+// if the address is not a host and non-zero port. Unspecified hosts (such as
+// "0.0.0.0") can be bound, but cannot be dialed, so they cannot be announced.
+func validateAnnounceAddress(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidAnnounceAddress, addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("%w %q: no host", ErrInvalidAnnounceAddress, addr)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("%w %q: unspecified host", ErrInvalidAnnounceAddress, addr)
+	}
+	if port, err := strconv.ParseUint(portStr, 10, 16); err != nil {
+		return fmt.Errorf("%w %q: bad port: %v", ErrInvalidAnnounceAddress, addr, err)
+	} else if port == 0 {
+		return fmt.Errorf("%w %q: zero port", ErrInvalidAnnounceAddress, addr)
+	}
+	return nil
+}
+
+// AnnounceAddress returns the address that remote peers must use to reach the
+// Transport (see Options.WithAnnounceAddress). False is returned if there is
+// no announce address.
+func (t *Transport) AnnounceAddress() (string, bool) {
+	t.announceMu.RLock()
+	defer t.announceMu.RUnlock()
+
+	return t.announce, t.announce != ""
+}
+
+// SetAnnounceAddress replaces the announce address, so that a change to the
+// external mapping of the Transport (for example, a new public IP) is
+// announced by peer discovery from its next round. An empty address removes
+// the announce address. An error wrapping ErrInvalidAnnounceAddress is
+// returned, and the announce address is not changed, if the address is not a
+// host and non-zero port.
+func (t *Transport) SetAnnounceAddress(addr string) error {
+	if addr != "" {
+		if err := validateAnnounceAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	t.announceMu.Lock()
+	defer t.announceMu.Unlock()
+
+	t.announce = addr
+	return nil
+}
+
+// AnnouncePort returns the port of the announce address, or the port of the
+// Transport if there is no announce address.
+func (t *Transport) AnnouncePort() uint16 {
+	addr, ok := t.AnnounceAddress()
+	if !ok {
+		return t.opts.Port
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return t.opts.Port
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return t.opts.Port
+	}
+	return uint16(port)
+}
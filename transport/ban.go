@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// DefaultMaxBans is the default maximum number of remote peers that can be
+// banned at the same time.
+var DefaultMaxBans = 1024
+
+// ErrBanned is returned when sending a message to, or accepting a connection
+// from, a remote peer that has been banned.
+var ErrBanned = errors.New("banned")
+
+// A Ban prevents all connections with a remote peer until it expires.
+type Ban struct {
+	Signatory id.Signatory
+	Expiry    time.Time
+}
+
+// Ban a remote peer for the given duration. Inbound connections from the remote
+// peer are closed after the handshake reveals its identity, and outbound
+// connections to the remote peer are not dialed. Existing connections are not
+// closed, unless there is a BanDrainTimeout, in which case they are drained in
+// the background (see WithBanDrainTimeout). Banning a remote peer that is
+// already banned replaces the existing ban. If the maximum number of bans has
+// been reached, then the ban that expires soonest is removed.
+func (t *Transport) Ban(remote id.Signatory, d time.Duration) {
+	t.ban(remote, d)
+	if t.opts.BanDrainTimeout > 0 && t.IsConnected(remote) {
+		go t.drainBanned(remote)
+	}
+}
+
+// ban records the ban of a remote peer.
+func (t *Transport) ban(remote id.Signatory, d time.Duration) {
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	now := t.opts.Clock.Now()
+	expire(t.bans, now)
+	insert(t.bans, remote, now.Add(d), t.opts.MaxBans)
+}
+
+// Unban a remote peer, allowing connections with it. If the remote peer is not
+// banned, this method does nothing.
+func (t *Transport) Unban(remote id.Signatory) {
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	delete(t.bans, remote)
+}
+
+// IsBanned returns true if the remote peer is banned, otherwise it returns
+// false.
+func (t *Transport) IsBanned(remote id.Signatory) bool {
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	expire(t.bans, t.opts.Clock.Now())
+	_, ok := t.bans[remote]
+	return ok
+}
+
+// Bans returns all bans that have not expired, sorted by their expiry.
+func (t *Transport) Bans() []Ban {
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	expire(t.bans, t.opts.Clock.Now())
+	bans := make([]Ban, 0, len(t.bans))
+	for signatory, expiry := range t.bans {
+		bans = append(bans, Ban{Signatory: signatory, Expiry: expiry})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Expiry.Before(bans[j].Expiry)
+	})
+	return bans
+}
+
+// expire removes all expiries that have passed. It is used for bans and
+// backoffs, and assumes that they are locked by the caller.
+func expire(expiries map[id.Signatory]time.Time, now time.Time) {
+	for signatory, expiry := range expiries {
+		if !now.Before(expiry) {
+			delete(expiries, signatory)
+		}
+	}
+}
+
+// insert an expiry for a remote peer. If the remote peer does not already have
+// an expiry, and there are already max expiries, then the expiry that is
+// soonest is removed first. If max is zero, or less, then nothing is inserted.
+// It assumes that the expiries are locked by the caller.
+func insert(expiries map[id.Signatory]time.Time, remote id.Signatory, expiry time.Time, max int) {
+	if max <= 0 {
+		return
+	}
+	if _, ok := expiries[remote]; !ok && len(expiries) >= max {
+		var soonest id.Signatory
+		var soonestExpiry time.Time
+		for signatory, expiry := range expiries {
+			if soonestExpiry.IsZero() || expiry.Before(soonestExpiry) {
+				soonest, soonestExpiry = signatory, expiry
+			}
+		}
+		delete(expiries, soonest)
+	}
+	expiries[remote] = expiry
+}
+
+// drainBanned drains the connection with a banned remote peer, says goodbye
+// with the banned reason, and then closes the connection. It is bounded by the
+// BanDrainTimeout. Errors are logged, and otherwise ignored.
+func (t *Transport) drainBanned(remote id.Signatory) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.BanDrainTimeout)
+	defer cancel()
+
+	if err := t.client.Drain(ctx, remote, wire.GoodbyeBanned); err != nil {
+		t.opts.Logger.Debug("drain", zap.String("remote", remote.String()), zap.Error(err))
+	}
+}
+
+// backOff from dialing a remote peer that has banned the local peer, for the
+// BannedBackoff.
+func (t *Transport) backOff(remote id.Signatory) {
+	if t.opts.BannedBackoff <= 0 {
+		return
+	}
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	now := t.opts.Clock.Now()
+	expire(t.backoffs, now)
+	insert(t.backoffs, remote, now.Add(t.opts.BannedBackoff), t.opts.MaxBans)
+}
+
+// isBackingOff returns true if the remote peer has banned the local peer, and
+// the BannedBackoff has not expired.
+func (t *Transport) isBackingOff(remote id.Signatory) bool {
+	t.bansMu.Lock()
+	defer t.bansMu.Unlock()
+
+	expiry, ok := t.backoffs[remote]
+	if !ok {
+		return false
+	}
+	if !t.opts.Clock.Now().Before(expiry) {
+		delete(t.backoffs, remote)
+		return false
+	}
+	return true
+}
+
+// rejectBanned returns ErrBanned if the remote peer has been banned. It is
+// used to filter handshakes before the OncePool, so that a connection with a
+// banned remote peer never replaces an existing connection, or occupies the
+// OncePool.
+func (t *Transport) rejectBanned(remote id.Signatory) error {
+	if t.IsBanned(remote) {
+		return ErrBanned
+	}
+	return nil
+}
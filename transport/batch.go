@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// DefaultMaxBatchSize is the default maximum size, in bytes, of the messages in
+// a batch, after they have been packed into a single frame.
+var DefaultMaxBatchSize = 1024 * 1024
+
+// ErrBatchTooLarge is returned when sending a batch of messages that would be
+// packed into a frame that is larger than the maximum batch size.
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// SendBatch sends the messages to the remote peer in a single frame. The remote
+// peer unpacks the frame, and delivers each message to its receivers and
+// subscribers separately, in the same order as they are in the batch. Either
+// all of the messages are sent, or none of them are. This saves the framing,
+// and the writes, of sending many small messages one at a time. Sync messages,
+// goodbyes, and chunked messages cannot be batched. If the batch is larger than
+// the maximum batch size, then ErrBatchTooLarge is returned, and nothing is
+// sent. If the remote peer does not understand batches (see
+// WithNegotiateVersion), then the messages are written to it one at a time, in
+// the same order, and some of them might be lost if the connection fails.
+func (t *Transport) SendBatch(ctx context.Context, remote id.Signatory, msgs []wire.Msg) error {
+	batch, err := wire.NewBatch(msgs)
+	if err != nil {
+		return fmt.Errorf("batch: %w", err)
+	}
+	if t.opts.MaxBatchSize > 0 && len(batch.Data) > t.opts.MaxBatchSize {
+		return fmt.Errorf("%w: expected at most %v bytes, got %v bytes", ErrBatchTooLarge, t.opts.MaxBatchSize, len(batch.Data))
+	}
+	return t.Send(ctx, remote, batch)
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/id"
+)
+
+// ErrBudgetExhausted is returned when sending to a remote peer that is not
+// connected, after the Budget of the send has been exhausted.
+var ErrBudgetExhausted = errors.New("budget exhausted")
+
+// A Budget bounds the dial attempts, and the time, that are spent by a batch
+// of sends (for example, gossiping to many remote peers), so that the batch
+// gives up gracefully instead of every remote peer exhausting its own retries.
+// The dial attempts are shared by the whole batch, so remote peers that are
+// reached early leave more attempts for the remote peers that are slow to be
+// reached. Sends to remote peers that are already connected never dial, so
+// they are not bounded by the Budget. Sends to remote peers that are not
+// connected once the Budget is exhausted are not attempted, and fail with
+// ErrBudgetExhausted. These remote peers are recorded (see Skipped).
+//
+// A Budget is used by passing a context that carries it to Send, using
+// WithBudget. It is safe for concurrent use.
+type Budget struct {
+	mu          *sync.Mutex
+	attempts    int
+	maxDuration time.Duration
+	deadline    time.Time
+	skipped     []id.Signatory
+}
+
+// NewBudget returns a Budget that allows, at most, the given number of dial
+// attempts, across all sends in a batch, and no more dial attempts after the
+// maximum duration has passed since the Budget was first used. A maximum
+// number of attempts, or a maximum duration, of zero, or less, means that the
+// Budget is not bounded by it.
+func NewBudget(maxAttempts int, maxDuration time.Duration) *Budget {
+	if maxAttempts <= 0 {
+		maxAttempts = -1
+	}
+	return &Budget{
+		mu:          new(sync.Mutex),
+		attempts:    maxAttempts,
+		maxDuration: maxDuration,
+	}
+}
+
+// Remaining returns the number of dial attempts that remain. It returns a
+// negative number if the dial attempts are not bounded.
+func (budget *Budget) Remaining() int {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	return budget.attempts
+}
+
+// Skipped returns the remote peers that were not sent to, because the Budget
+// was exhausted, in the order in which they were skipped.
+func (budget *Budget) Skipped() []id.Signatory {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	return append([]id.Signatory{}, budget.skipped...)
+}
+
+// exhausted returns true if no more dial attempts are allowed. The maximum
+// duration starts the first time that the Budget is used.
+func (budget *Budget) exhausted(now time.Time) bool {
+	if budget.maxDuration > 0 {
+		if budget.deadline.IsZero() {
+			budget.deadline = now.Add(budget.maxDuration)
+		}
+		if !now.Before(budget.deadline) {
+			return true
+		}
+	}
+	return budget.attempts == 0
+}
+
+// skip returns true, and records the remote peer as skipped, if the Budget is
+// exhausted. A nil Budget is never exhausted.
+func (budget *Budget) skip(now time.Time, remote id.Signatory) bool {
+	if budget == nil {
+		return false
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	if !budget.exhausted(now) {
+		return false
+	}
+	budget.skipped = append(budget.skipped, remote)
+	return true
+}
+
+// take a dial attempt from the Budget. It returns false if the Budget is
+// exhausted. A nil Budget is never exhausted.
+func (budget *Budget) take(now time.Time) bool {
+	if budget == nil {
+		return true
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	if budget.exhausted(now) {
+		return false
+	}
+	if budget.attempts > 0 {
+		budget.attempts--
+	}
+	return true
+}
+
+type budgetKey struct{}
+
+// WithBudget returns a copy of the context that carries the Budget. All sends
+// that use the context share the Budget.
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// budgetFromContext returns the Budget carried by the context, or nil if
+// there is none.
+func budgetFromContext(ctx context.Context) *Budget {
+	budget, _ := ctx.Value(budgetKey{}).(*Budget)
+	return budget
+}
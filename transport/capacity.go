@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// A CapacityPolicy defines what a Transport does with an inbound connection
+// from a new remote peer, once the handshake has revealed its identity, while
+// the Transport is at capacity.
+type CapacityPolicy uint8
+
+// Enumerate all CapacityPolicy values.
+const (
+	// CapacityRejectNew closes the inbound connection.
+	CapacityRejectNew CapacityPolicy = iota
+	// CapacityPreferKnown closes the inbound connection if the remote peer is
+	// unknown (it is not in the table). Otherwise, the remote peer is known,
+	// and an unknown remote peer that is connected, but neither linked nor
+	// kept connected, is evicted to make room for it. If there is no such
+	// remote peer, then the inbound connection is closed. Unknown remote
+	// peers are only ever admitted provisionally, so that anonymous
+	// connections cannot crowd out known remote peers.
+	CapacityPreferKnown
+)
+
+func (policy CapacityPolicy) String() string {
+	switch policy {
+	case CapacityRejectNew:
+		return "reject new"
+	case CapacityPreferKnown:
+		return "prefer known"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrAtCapacity is returned when sending a message to a remote peer that is not
+// connected, while the Transport is connected to the maximum number of remote
+// peers.
+var ErrAtCapacity = errors.New("at capacity")
+
+// AtCapacity returns true if the Transport is connected to at least the
+// MaxConns number of remote peers, in which case it will not connect to new
+// remote peers. It is cheap enough to be called before every selection of
+// remote peers, so that selection can favour remote peers that are already
+// connected. If there is no MaxConns, then it always returns false.
+func (t *Transport) AtCapacity() bool {
+	return t.opts.MaxConns > 0 && atomic.LoadInt64(t.numConns) >= int64(t.opts.MaxConns)
+}
+
+// admit returns nil if an inbound connection from the remote peer can be
+// accepted, evicting another remote peer if the CapacityPolicy requires it.
+// Whether or not the remote peer is known must be determined before the remote
+// peer is touched in the table.
+func (t *Transport) admit(remote id.Signatory, known bool) error {
+	if !t.AtCapacity() || t.IsConnected(remote) {
+		return nil
+	}
+	if t.opts.CapacityPolicy != CapacityPreferKnown || !known {
+		return ErrAtCapacity
+	}
+	evicted, ok := t.evictable()
+	if !ok {
+		return ErrAtCapacity
+	}
+	t.opts.Logger.Debug("evict", zap.String("remote", evicted.String()), zap.String("for", remote.String()))
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.GoodbyeTimeout)
+	defer cancel()
+	if err := t.client.Goodbye(ctx, evicted, wire.GoodbyeCapacity); err != nil {
+		t.opts.Logger.Debug("evict", zap.String("remote", evicted.String()), zap.Error(err))
+		return ErrAtCapacity
+	}
+	return nil
+}
+
+// evictable returns a connected remote peer that is unknown, and that is
+// neither linked nor kept connected. If there are many such remote peers, then
+// one of them is chosen at random, so that remote peers cannot predict which
+// of them will be evicted. False is returned if there is no such remote peer.
+func (t *Transport) evictable() (id.Signatory, bool) {
+	candidates := []id.Signatory{}
+	for _, remote := range t.ConnectedPeers() {
+		if t.IsLinked(remote) || t.IsKeptConnected(remote) {
+			continue
+		}
+		if _, ok := t.table.PeerAddress(remote); ok {
+			continue
+		}
+		candidates = append(candidates, remote)
+	}
+	if len(candidates) == 0 {
+		return id.Signatory{}, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/id"
+)
+
+// Compression returns the Compression that was negotiated during the most
+// recent handshake with a remote peer. False is returned if there is no
+// connection with the remote peer, or if compression is not being negotiated.
+func (t *Transport) Compression(remote id.Signatory) (codec.Compression, bool) {
+	t.compressionsMu.RLock()
+	defer t.compressionsMu.RUnlock()
+
+	c, ok := t.compressions[remote]
+	return c, ok
+}
+
+// negotiated records the Compression that was negotiated with a remote peer
+// during a handshake.
+func (t *Transport) negotiated(remote id.Signatory, c codec.Compression) {
+	t.compressionsMu.Lock()
+	defer t.compressionsMu.Unlock()
+
+	t.compressions[remote] = c
+}
+
+// forgetNegotiated forgets the Compression that was negotiated with a remote
+// peer, once there are no connections with the remote peer.
+func (t *Transport) forgetNegotiated(remote id.Signatory) {
+	t.compressionsMu.Lock()
+	defer t.compressionsMu.Unlock()
+
+	delete(t.compressions, remote)
+}
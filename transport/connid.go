@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+)
+
+// A ConnID uniquely identifies a connection made (or accepted) by a Transport.
+// It is assigned as soon as a connection is accepted, or as soon as a dial
+// attempt starts, before the handshake, so that connections that fail to
+// handshake still have a ConnID. The same ConnID is used by the TraceEvents,
+// the Session, the DisconnectEvent, the logs, and the spans of the connection,
+// so that all of them can be correlated. ConnIDs increase monotonically, and
+// are never re-used by the same Transport.
+type ConnID uint64
+
+// String returns a human-readable representation of the ConnID.
+func (connID ConnID) String() string {
+	return fmt.Sprintf("%016x", uint64(connID))
+}
+
+type connIDKey struct{}
+
+// WithConnID returns a copy of the context that carries the ConnID.
+func WithConnID(ctx context.Context, connID ConnID) context.Context {
+	return context.WithValue(ctx, connIDKey{}, connID)
+}
+
+// ConnIDFromContext returns the ConnID carried by the context. False is
+// returned if the context does not carry a ConnID. The contexts passed to the
+// SpanStarter for the spans of a connection carry its ConnID.
+func ConnIDFromContext(ctx context.Context) (ConnID, bool) {
+	connID, ok := ctx.Value(connIDKey{}).(ConnID)
+	return connID, ok
+}
@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/id"
+)
+
+// Detach the connection with a linked remote peer, so that the application can
+// use it directly, and later give it back to the Transport using
+// Detached.Reattach. While the connection is detached, messages that are sent
+// to the remote peer are queued, and written once the connection is
+// reattached. Sending blocks, until the connection is reattached or the context
+// is done, once the outbound queue of the Channel is full. Both peers must
+// agree to detach, because messages that are in flight might be lost (see
+// channel.Channel.Detach).
+//
+// The application owns the connection until it is reattached or closed, and
+// must do one of the two, even if the remote peer is unlinked or the Transport
+// stops running. Only linked remote peers can be detached, because the
+// connections of other remote peers are closed when they are idle.
+func (t *Transport) Detach(ctx context.Context, remote id.Signatory) (*channel.Detached, error) {
+	if !t.IsLinked(remote) {
+		return nil, fmt.Errorf("detach: %v is not linked", remote)
+	}
+	return t.client.Detach(ctx, remote)
+}
@@ -0,0 +1,24 @@
+package transport
+
+// Direction defines whether a connection was dialed by the local peer, or
+// accepted from a remote peer.
+type Direction uint8
+
+// Enumerate all Direction values.
+const (
+	// DirectionInbound connections were accepted from a remote peer.
+	DirectionInbound = Direction(1)
+	// DirectionOutbound connections were dialed by the local peer.
+	DirectionOutbound = Direction(2)
+)
+
+func (dir Direction) String() string {
+	switch dir {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
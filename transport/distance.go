@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// An AddressDistance estimates how far away an IP address is from the local
+// peer (for example, zero for the same /16, or the latency estimated from a
+// GeoIP database). Lower distances are closer, and are preferred.
+type AddressDistance func(remote net.IP) int
+
+// distance returns the distance to the IP address of a network address. False
+// is returned if there is no AddressDistance, or if the network address does
+// not have an IP address (for example, because it has a host name).
+func (t *Transport) distance(addr wire.Address) (int, bool) {
+	if t.opts.AddressDistance == nil {
+		return 0, false
+	}
+	host, _, err := net.SplitHostPort(addr.Value)
+	if err != nil {
+		return 0, false
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0, false
+	}
+	return t.opts.AddressDistance(ip), true
+}
+
+// NearestPeers returns the remote peers ordered from nearest to farthest, by
+// the AddressDistance of their network addresses in the table. Remote peers
+// with a network address that has no distance (for example, because it is not
+// in the table), are ordered last. Otherwise, the order of the remote peers is
+// kept, so the remote peers are returned unchanged if there is no
+// AddressDistance.
+func (t *Transport) NearestPeers(peers []id.Signatory) []id.Signatory {
+	type nearPeer struct {
+		peer     id.Signatory
+		distance int
+		ok       bool
+	}
+	near := make([]nearPeer, len(peers))
+	for i, peer := range peers {
+		near[i].peer = peer
+		if addr, ok := t.table.PeerAddress(t.current(peer)); ok {
+			near[i].distance, near[i].ok = t.distance(addr)
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool {
+		if near[i].ok != near[j].ok {
+			return near[i].ok
+		}
+		return near[i].distance < near[j].distance
+	})
+	nearest := make([]id.Signatory, len(near))
+	for i := range near {
+		nearest[i] = near[i].peer
+	}
+	return nearest
+}
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/muirglacier/id"
+)
+
+// SendErrorKind classifies the reason that sending a message failed.
+type SendErrorKind uint8
+
+// Enumerate all SendErrorKind values.
+const (
+	SendErrorOther SendErrorKind = iota
+	SendErrorTimeout
+	SendErrorCancelled
+	SendErrorUnknownPeer
+	SendErrorBanned
+	SendErrorAtCapacity
+	SendErrorIdentityMismatch
+	SendErrorBudgetExhausted
+)
+
+func (kind SendErrorKind) String() string {
+	switch kind {
+	case SendErrorTimeout:
+		return "timeout"
+	case SendErrorCancelled:
+		return "cancelled"
+	case SendErrorUnknownPeer:
+		return "unknown peer"
+	case SendErrorBanned:
+		return "banned"
+	case SendErrorAtCapacity:
+		return "at capacity"
+	case SendErrorIdentityMismatch:
+		return "identity mismatch"
+	case SendErrorBudgetExhausted:
+		return "budget exhausted"
+	default:
+		return "other"
+	}
+}
+
+// A SendError is returned by the Transport when sending a message fails. The
+// Kind allows callers to distinguish between timeouts, cancellations, and
+// missing peers, without inspecting the wrapped error.
+type SendError struct {
+	Kind   SendErrorKind
+	Remote id.Signatory
+	Err    error
+}
+
+// Error implements the error interface.
+func (err *SendError) Error() string {
+	return fmt.Sprintf("sending to %v (%v): %v", err.Remote, err.Kind, err.Err)
+}
+
+// Unwrap returns the error that caused the message to fail to send.
+func (err *SendError) Unwrap() error {
+	return err.Err
+}
+
+// newSendError returns a SendError that wraps an error, with a Kind that is
+// derived from the error.
+func newSendError(remote id.Signatory, err error) *SendError {
+	kind := SendErrorOther
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = SendErrorTimeout
+	case errors.Is(err, context.Canceled):
+		kind = SendErrorCancelled
+	}
+	return &SendError{Kind: kind, Remote: remote, Err: err}
+}
@@ -0,0 +1,26 @@
+package transport
+
+import (
+	"sync/atomic"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// filterInbound applies the InboundFilter to a message received from a remote
+// peer. Dropped messages are counted, and the remote peer is banned if the
+// InboundFilterBan is set.
+func (t *Transport) filterInbound(from id.Signatory, msg wire.Msg) error {
+	err := t.opts.InboundFilter(from, msg)
+	if err == nil {
+		return nil
+	}
+	atomic.AddUint64(t.filtered, 1)
+	if t.opts.InboundFilterBan > 0 {
+		t.opts.Logger.Debug("inbound filter: ban", zap.String("remote", from.String()), zap.Duration("duration", t.opts.InboundFilterBan), zap.Error(err))
+		t.Ban(from, t.opts.InboundFilterBan)
+	}
+	return err
+}
@@ -0,0 +1,22 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/muirglacier/id"
+)
+
+// FlushPeer blocks until all messages that have been sent to the remote peer
+// have been written to its connection, or the context is done. This only
+// guarantees that the messages have been handed to the kernel, not that the
+// remote peer has received them. It can be used before Goodbye, or Unlink, so
+// that queued messages are not left behind.
+//
+// If the context is done first, then an error wrapping a channel.FlushError
+// is returned, with the number of messages that were still pending. Sends
+// that are blocked, because the outbound queue is full, are not waited for,
+// because their messages are not on the queue yet. An error is also returned
+// if there is no Channel associated with the remote peer.
+func (t *Transport) FlushPeer(ctx context.Context, remote id.Signatory) error {
+	return t.client.Flush(ctx, t.resolve(remote))
+}
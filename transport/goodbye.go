@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// A DisconnectEvent is emitted by a Transport when a remote peer says goodbye
+// before deliberately closing its connection. Connections that are closed
+// without a goodbye (for example, because the remote peer crashed) do not emit
+// a DisconnectEvent. The Direction is that of the connection over which the
+// goodbye was received. Established is the time at which that connection was
+// authorized, and Closed is the time at which the goodbye was received, so
+// that the lifetime of the connection can be derived (see Duration). The ID is
+// the ConnID of that connection.
+type DisconnectEvent struct {
+	ID          ConnID
+	Remote      id.Signatory
+	Addr        string
+	Direction   Direction
+	Reason      wire.GoodbyeReason
+	Established time.Time
+	Closed      time.Time
+}
+
+// Duration returns the lifetime of the connection that was closed. Both times
+// are read from the Clock of the Transport, so the Duration is measured using
+// the monotonic clock when the Clock is real.
+func (event DisconnectEvent) Duration() time.Duration {
+	return event.Closed.Sub(event.Established)
+}
+
+// Goodbye tells the remote peer why its connection is about to be closed, and
+// then closes it. Writing the goodbye is best-effort, and is bounded by the
+// GoodbyeTimeout. The remote peer is not unlinked, so the connection might be
+// re-established. An error is returned if there is no Channel associated with
+// the remote peer.
+func (t *Transport) Goodbye(ctx context.Context, remote id.Signatory, reason wire.GoodbyeReason) error {
+	ctx, cancel := context.WithTimeout(ctx, t.opts.GoodbyeTimeout)
+	defer cancel()
+
+	return t.client.Goodbye(ctx, remote, reason)
+}
+
+// goodbye says goodbye to the remote peer, if sending goodbyes is enabled.
+// Errors are logged, and otherwise ignored.
+func (t *Transport) goodbye(remote id.Signatory, reason wire.GoodbyeReason) {
+	if !t.opts.SendGoodbye {
+		return
+	}
+	if err := t.Goodbye(context.Background(), remote, reason); err != nil {
+		t.opts.Logger.Debug("goodbye", zap.String("remote", remote.String()), zap.String("reason", reason.String()), zap.Error(err))
+	}
+}
+
+// goodbyeAll says goodbye to all connected remote peers, if sending goodbyes
+// is enabled. It blocks until all goodbyes have been said, or have timed out.
+func (t *Transport) goodbyeAll(reason wire.GoodbyeReason) {
+	if !t.opts.SendGoodbye {
+		return
+	}
+	wg := new(sync.WaitGroup)
+	for _, remote := range t.ConnectedPeers() {
+		wg.Add(1)
+		go func(remote id.Signatory) {
+			defer wg.Done()
+			t.goodbye(remote, reason)
+		}(remote)
+	}
+	wg.Wait()
+}
+
+// writeGoodbye directly to a network connection that is not attached to a
+// Channel, if sending goodbyes is enabled. Errors are logged, and otherwise
+// ignored.
+func (t *Transport) writeGoodbye(conn net.Conn, enc codec.Encoder, reason wire.GoodbyeReason) {
+	if !t.opts.SendGoodbye {
+		return
+	}
+	if err := func() error {
+		if err := conn.SetWriteDeadline(t.opts.Clock.Now().Add(t.opts.GoodbyeTimeout)); err != nil {
+			return fmt.Errorf("set deadline: %w", err)
+		}
+		msg := wire.NewGoodbye(reason)
+		buf := make([]byte, msg.SizeHint())
+		if _, _, err := msg.Marshal(buf, len(buf)); err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		enc = codec.LengthPrefixEncoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainEncoder, enc)
+		if _, err := enc(conn, buf); err != nil {
+			return fmt.Errorf("encode: %w", err)
+		}
+		return nil
+	}(); err != nil {
+		t.opts.Logger.Debug("goodbye", zap.String("addr", conn.RemoteAddr().String()), zap.String("reason", reason.String()), zap.Error(err))
+	}
+}
+
+// receiveGoodbyes from remote peers, and emit a DisconnectEvent for each one,
+// until the context is done. Remote peers that say goodbye because they have
+// banned the local peer are backed off from. If there is no OnDisconnected
+// function, and no BannedBackoff, this method does nothing.
+func (t *Transport) receiveGoodbyes(ctx context.Context) {
+	if t.opts.OnDisconnected == nil && t.opts.BannedBackoff <= 0 {
+		return
+	}
+	goodbyes := t.client.Subscribe(ctx, channel.MatchType(wire.MsgTypeGoodbye), 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-goodbyes:
+				if !ok {
+					return
+				}
+				reason, err := msg.Msg.GoodbyeReason()
+				if err != nil {
+					t.opts.Logger.Debug("goodbye", zap.String("remote", msg.From.String()), zap.Error(err))
+					continue
+				}
+				if reason == wire.GoodbyeBanned {
+					t.backOff(msg.From)
+				}
+				if t.opts.OnDisconnected == nil {
+					continue
+				}
+				addr := ""
+				if msg.IPAddr != nil {
+					addr = msg.IPAddr.String()
+				}
+				// The goodbye is received before the connection is closed, so
+				// its Direction and Session are still known.
+				dir, _ := t.Direction(msg.From)
+				session, _ := t.Session(msg.From)
+				t.opts.OnDisconnected(DisconnectEvent{
+					ID:          session.ID,
+					Remote:      msg.From,
+					Addr:        addr,
+					Direction:   dir,
+					Reason:      reason,
+					Established: session.Established,
+					Closed:      t.opts.Clock.Now(),
+				})
+			}
+		}
+	}()
+}
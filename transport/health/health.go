@@ -0,0 +1,77 @@
+// Package health provides an HTTP handler that reports the health of a
+// Transport as JSON. It is read-only and cheap, so it can be polled by
+// operators and load balancers.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/muirglacier/aw/transport"
+)
+
+// A Report is the JSON body written by the Handler.
+type Report struct {
+	ConnectedPeers       int        `json:"connectedPeers"`
+	ListenAddresses      []string   `json:"listenAddresses"`
+	Listeners            []Listener `json:"listeners"`
+	TableSize            int        `json:"tableSize"`
+	UptimeSeconds        float64    `json:"uptimeSeconds"`
+	RecentHandshakes     uint64     `json:"recentHandshakes"`
+	RecentFailures       uint64     `json:"recentHandshakeFailures"`
+	HandshakeFailureRate float64    `json:"handshakeFailureRate"`
+}
+
+// A Listener reports the inbound connections of one listen address (see
+// transport.ListenerStats).
+type Listener struct {
+	Addr     string `json:"addr"`
+	Accepted uint64 `json:"accepted"`
+	Active   int64  `json:"active"`
+}
+
+// NewReport returns a Report about the current health of the Transport. The
+// HandshakeFailureRate is the fraction of recent handshakes that failed (see
+// transport.Options.WithStatsWindow).
+func NewReport(t *transport.Transport) Report {
+	stats := t.Stats()
+	rate := 0.0
+	if stats.RecentHandshakes > 0 {
+		rate = float64(stats.RecentHandshakeFailures) / float64(stats.RecentHandshakes)
+	}
+	listeners := make([]Listener, len(stats.Listeners))
+	for i, l := range stats.Listeners {
+		listeners[i] = Listener{Addr: l.Addr, Accepted: l.Accepted, Active: l.Active}
+	}
+	return Report{
+		ConnectedPeers:       stats.Connected,
+		ListenAddresses:      t.ListenAddresses(),
+		Listeners:            listeners,
+		TableSize:            t.Table().NumPeers(),
+		UptimeSeconds:        stats.Uptime.Seconds(),
+		RecentHandshakes:     stats.RecentHandshakes,
+		RecentFailures:       stats.RecentHandshakeFailures,
+		HandshakeFailureRate: rate,
+	}
+}
+
+// Handler returns an http.Handler that responds to GET and HEAD requests with
+// the Report of the Transport. All other methods are not allowed.
+func Handler(t *transport.Transport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := json.NewEncoder(w).Encode(NewReport(t)); err != nil {
+			http.Error(w, fmt.Sprintf("encoding report: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
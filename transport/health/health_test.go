@@ -0,0 +1,63 @@
+package health_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/dht"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/transport"
+	"github.com/muirglacier/aw/transport/health"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	newTransport := func(fake *clock.Fake) *transport.Transport {
+		privKey := id.NewPrivKey()
+		self := privKey.Signatory()
+		h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
+		client := channel.NewClient(channel.DefaultOptions(), self)
+		table := dht.NewInMemTable(self)
+		return transport.New(transport.DefaultOptions().WithClock(fake).WithPort(3360), self, client, h, table)
+	}
+
+	Context("when getting the health of a transport", func() {
+		It("should report the health as JSON", func() {
+			fake := clock.NewFake(time.Now())
+			t := newTransport(fake)
+			t.Table().AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3361", uint64(time.Now().UnixNano())))
+			fake.Advance(time.Minute)
+
+			w := httptest.NewRecorder()
+			health.Handler(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			report := health.Report{}
+			Expect(json.Unmarshal(w.Body.Bytes(), &report)).To(Succeed())
+			Expect(report).To(Equal(health.Report{
+				ConnectedPeers:  0,
+				ListenAddresses: []string{"localhost:3360"},
+				Listeners:       []health.Listener{{Addr: "localhost:3360"}},
+				TableSize:       1,
+				UptimeSeconds:   60,
+			}))
+		})
+	})
+
+	Context("when using a method that is not allowed", func() {
+		It("should respond with an error", func() {
+			w := httptest.NewRecorder()
+			health.Handler(newTransport(clock.NewFake(time.Now()))).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/health", nil))
+			Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
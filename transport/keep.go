@@ -0,0 +1,189 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/dht"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// maxKeepConnectedAttempt bounds the attempt passed to the
+// KeepConnectedBackoff, so that exponential backoffs cannot overflow (and
+// return a non-positive duration that would re-dial in a tight loop).
+const maxKeepConnectedAttempt = 32
+
+// KeepConnected maintains a persistent connection to each of the remote peers,
+// regardless of whether or not there are messages being sent. The remote peers
+// are linked, and are re-dialed (using the KeepConnectedBackoff) whenever
+// their connection drops. This is useful for priority peers, such as seeds,
+// because the first message sent to them will not be delayed by dialing and
+// handshaking. Calling this method for a remote peer that is already being kept
+// connected does nothing. Remote peers are only dialed while the Transport is
+// running, and re-dialing stops when the context passed to Run is done.
+func (t *Transport) KeepConnected(remotes ...id.Signatory) {
+	t.keepMu.Lock()
+	defer t.keepMu.Unlock()
+
+	for _, remote := range remotes {
+		if _, ok := t.keep[remote]; ok {
+			continue
+		}
+		if remote.Equal(&t.self) {
+			continue
+		}
+		t.keep[remote] = nil
+		t.Link(remote)
+		if t.keepCtx != nil {
+			t.startKeepingConnected(remote)
+		}
+	}
+}
+
+// StopKeepingConnected reverses KeepConnected for each of the remote peers.
+// The remote peers are unlinked, which allows their connections to be dropped.
+func (t *Transport) StopKeepingConnected(remotes ...id.Signatory) {
+	t.keepMu.Lock()
+	defer t.keepMu.Unlock()
+
+	for _, remote := range remotes {
+		cancel, ok := t.keep[remote]
+		if !ok {
+			continue
+		}
+		if cancel != nil {
+			cancel()
+		}
+		delete(t.keep, remote)
+		t.Unlink(remote)
+	}
+}
+
+// IsKeptConnected returns true if the remote peer is being kept connected,
+// otherwise it returns false.
+func (t *Transport) IsKeptConnected(remote id.Signatory) bool {
+	t.keepMu.Lock()
+	defer t.keepMu.Unlock()
+
+	_, ok := t.keep[remote]
+	return ok
+}
+
+// runKeepConnected starts keeping remote peers connected for as long as the
+// context is not done (including the remote peers that were kept connected
+// before the Transport was running). It returns a function that must be
+// called once the Transport stops running.
+func (t *Transport) runKeepConnected(ctx context.Context) func() {
+	t.keepMu.Lock()
+	defer t.keepMu.Unlock()
+
+	t.keepCtx = ctx
+	for remote, cancel := range t.keep {
+		if cancel != nil {
+			cancel()
+		}
+		t.startKeepingConnected(remote)
+	}
+	return func() {
+		t.keepMu.Lock()
+		defer t.keepMu.Unlock()
+
+		if t.keepCtx != ctx {
+			return
+		}
+		t.keepCtx = nil
+		for remote, cancel := range t.keep {
+			if cancel != nil {
+				cancel()
+			}
+			t.keep[remote] = nil
+		}
+	}
+}
+
+// startKeepingConnected must only be called while the keepMu is held, and the
+// Transport is running.
+func (t *Transport) startKeepingConnected(remote id.Signatory) {
+	ctx, cancel := context.WithCancel(t.keepCtx)
+	t.keep[remote] = cancel
+	go t.keepConnected(ctx, remote)
+}
+
+func (t *Transport) keepConnected(ctx context.Context, remote id.Signatory) {
+	// Start with an expired (and drained) timer, so that it can be reset.
+	timer := t.opts.Clock.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C()
+
+	attempt := 0
+	for {
+		if t.IsConnected(remote) {
+			attempt = 0
+		} else if remoteAddr, ok := t.table.PeerAddress(remote); ok {
+			t.opts.Logger.Debug("keep connected", zap.String("remote", remote.String()), zap.Int("attempt", attempt))
+			// Dialing blocks until the connection is dropped, because the
+			// remote peer is linked.
+			if err := t.dialOnce(ctx, remote, remoteAddr); err != nil {
+				t.opts.Logger.Debug("keep connected", zap.String("remote", remote.String()), zap.Int("attempt", attempt), zap.Error(err))
+			}
+			if attempt < maxKeepConnectedAttempt {
+				attempt++
+			}
+		} else {
+			// There is no point re-dialing until the remote peer has a
+			// network address (for example, after it has expired from the
+			// table).
+			t.opts.Logger.Debug("keep connected: no address", zap.String("remote", remote.String()))
+			if !t.waitForAddress(ctx, remote, timer) {
+				return
+			}
+			continue
+		}
+
+		timer.Reset(t.opts.KeepConnectedBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// waitForAddress waits until the table has a network address for the remote
+// peer. Changes to the table can be dropped, so it gives up waiting after the
+// longest KeepConnectedBackoff, and the caller re-checks the table. It returns
+// false if the context is done.
+func (t *Transport) waitForAddress(ctx context.Context, remote id.Signatory, timer clock.Timer) bool {
+	changes := t.table.Subscribe()
+	defer t.table.Unsubscribe(changes)
+
+	if _, ok := t.table.PeerAddress(remote); ok {
+		return true
+	}
+	timer.Reset(t.opts.KeepConnectedBackoff(maxKeepConnectedAttempt))
+	defer func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C():
+			return true
+		case change, ok := <-changes:
+			if !ok {
+				return true
+			}
+			if change.Signatory.Equal(&remote) && (change.Type == dht.ChangeAdded || change.Type == dht.ChangeUpdated) {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/muirglacier/aw/tcp"
+	"github.com/muirglacier/id"
+	"go.uber.org/zap"
+)
+
+// A KeepAliveScaler returns the TCP keepalive period of network connections,
+// given the number of remote peers that are connected. It allows the period to
+// grow on busy nodes, where frequent keepalive probes on every connection
+// would be a significant overhead. Like PeerOptions.KeepAlive, a negative
+// period disables keepalives.
+type KeepAliveScaler func(connected int) time.Duration
+
+// FixedKeepAlive returns a KeepAliveScaler that always returns the period,
+// regardless of the number of remote peers that are connected.
+func FixedKeepAlive(period time.Duration) KeepAliveScaler {
+	return func(int) time.Duration {
+		return period
+	}
+}
+
+// ScaledKeepAlive returns a KeepAliveScaler that returns the base period while
+// there are, at most, the given number of connected remote peers, and grows
+// the period in proportion to the number of connected remote peers beyond
+// that. This keeps the total overhead of keepalive probes roughly constant,
+// regardless of the number of connected remote peers. The period is bounded by
+// the minimum and the maximum. A maximum of zero, or less, means that the
+// period is not bounded from above.
+func ScaledKeepAlive(base time.Duration, connected int, min, max time.Duration) KeepAliveScaler {
+	return func(n int) time.Duration {
+		period := base
+		if connected > 0 && n > connected {
+			period = time.Duration(float64(base) * float64(n) / float64(connected))
+		}
+		if period < min {
+			period = min
+		}
+		if max > 0 && period > max {
+			period = max
+		}
+		return period
+	}
+}
+
+// WithKeepAliveScaler sets the KeepAliveScaler used to compute the TCP
+// keepalive period of network connections from the number of connected remote
+// peers (see ScaledKeepAlive). The period is re-computed whenever a remote peer
+// connects or disconnects, and is applied to all network connections, except
+// those to remote peers with a PeerOptions.KeepAlive override. By default,
+// there is no KeepAliveScaler, and keepalives are left as they are configured
+// by the DialOptions and ListenOptions.
+func (opts Options) WithKeepAliveScaler(scaler KeepAliveScaler) Options {
+	opts.KeepAliveScaler = scaler
+	return opts
+}
+
+// KeepAlivePeriod returns the TCP keepalive period that is currently computed
+// by the KeepAliveScaler. Zero is returned if there is no KeepAliveScaler.
+func (t *Transport) KeepAlivePeriod() time.Duration {
+	return time.Duration(atomic.LoadInt64(t.keepAlivePeriod))
+}
+
+// rescaleKeepAlive re-computes the keepalive period from the number of
+// connected remote peers. If the period has changed, it is applied to all
+// network connections to remote peers that do not override it. Keepalive
+// periods are set in whole seconds, so the period is rounded up to a whole
+// number of seconds, and small changes are not applied.
+func (t *Transport) rescaleKeepAlive() {
+	if t.opts.KeepAliveScaler == nil {
+		return
+	}
+	period := t.opts.KeepAliveScaler(int(atomic.LoadInt64(t.numConns)))
+	if period > 0 {
+		period = (period + time.Second - 1).Truncate(time.Second)
+	}
+	if time.Duration(atomic.SwapInt64(t.keepAlivePeriod, int64(period))) == period {
+		return
+	}
+	for _, remote := range t.ConnectedPeers() {
+		if t.peerOptions(remote).KeepAlive != nil {
+			continue
+		}
+		if conn, ok := t.client.Conn(remote); ok {
+			t.keepAlive(remote, conn)
+		}
+	}
+}
+
+// keepAlive applies the keepalive period of the remote peer to a network
+// connection: its override, if there is one, or otherwise the period of the
+// KeepAliveScaler, if there is one. Network connections that do not support
+// keepalives are left as they are.
+func (t *Transport) keepAlive(remote id.Signatory, conn net.Conn) {
+	var period time.Duration
+	if override := t.peerOptions(remote).KeepAlive; override != nil {
+		period = *override
+	} else if t.opts.KeepAliveScaler != nil {
+		period = t.KeepAlivePeriod()
+	} else {
+		return
+	}
+	if err := setKeepAlive(conn, period); err != nil {
+		t.opts.Logger.Debug("keepalive", zap.String("remote", remote.String()), zap.Duration("period", period), zap.Error(err))
+	}
+}
+
+// restoreKeepAlive restores the default keepalive of a network connection to
+// the remote peer, once its override has been removed: the period of the
+// KeepAliveScaler, if there is one, or otherwise the KeepAliveOptions of the
+// DialOptions or ListenOptions (depending on the Direction of the connection),
+// or otherwise the keepalive that Go enables by default. Idle times,
+// intervals, and counts that the KeepAliveOptions leave at the defaults of the
+// OS are not reset.
+func (t *Transport) restoreKeepAlive(remote id.Signatory, conn net.Conn) {
+	if t.opts.KeepAliveScaler != nil {
+		t.keepAlive(remote, conn)
+		return
+	}
+	keepAlive := t.opts.ListenOptions.KeepAlive
+	if dir, ok := t.Direction(remote); ok && dir == DirectionOutbound {
+		keepAlive = t.opts.DialOptions.KeepAlive
+	}
+	var err error
+	if keepAlive != nil {
+		err = tcp.SetKeepAlive(conn, *keepAlive)
+	} else {
+		err = setKeepAlive(conn, defaultKeepAlive)
+	}
+	if err != nil {
+		t.opts.Logger.Debug("keepalive", zap.String("remote", remote.String()), zap.Error(err))
+	}
+}
+
+// defaultKeepAlive is the keepalive period that the net.Dialer and the
+// net.ListenConfig use when they are not given one.
+const defaultKeepAlive = 15 * time.Second
+
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	c, ok := conn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	})
+	if !ok {
+		return fmt.Errorf("%T does not support keepalives", conn)
+	}
+	if period < 0 {
+		return c.SetKeepAlive(false)
+	}
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if period > 0 {
+		return c.SetKeepAlivePeriod(period)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ListenerStats are the connection counts of one address on which the
+// Transport listens. They can be used to see which network interfaces are
+// carrying inbound connections.
+type ListenerStats struct {
+	// Addr on which the Transport listens.
+	Addr string
+	// Accepted is the total number of inbound connections that have been
+	// accepted on the address.
+	Accepted uint64
+	// Active is the number of inbound connections, accepted on the address,
+	// that are still open.
+	Active int64
+}
+
+// DefaultListenWeight is the weight of listen addresses that are not given a
+// weight by Options.WithListenWeights.
+var DefaultListenWeight = 1
+
+// listener counts the connections accepted on one listen address.
+type listener struct {
+	addr     string
+	weight   int
+	accepted *uint64
+	active   *int64
+}
+
+// newListeners returns a listener for the host and port of the Options,
+// followed by a listener for each of their additional listen addresses.
+func newListeners(opts Options) []listener {
+	addrs := listenAddresses(opts)
+	listeners := make([]listener, len(addrs))
+	for i, addr := range addrs {
+		weight, ok := opts.ListenWeights[addr]
+		if !ok {
+			weight = DefaultListenWeight
+		}
+		listeners[i] = listener{addr: addr, weight: weight, accepted: new(uint64), active: new(int64)}
+	}
+	return listeners
+}
+
+// listenAddresses returns the host and port of the Options, followed by their
+// additional listen addresses.
+func listenAddresses(opts Options) []string {
+	return append([]string{net.JoinHostPort(opts.Host, strconv.Itoa(int(opts.Port)))}, opts.ListenAddresses...)
+}
+
+// handle returns a function that counts the connection before handling it.
+func (l listener) handle(handle func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		atomic.AddUint64(l.accepted, 1)
+		atomic.AddInt64(l.active, 1)
+		defer atomic.AddInt64(l.active, -1)
+		handle(conn)
+	}
+}
+
+// ListenAddresses returns all addresses on which the Transport listens: its
+// host and port, followed by its additional listen addresses.
+func (t *Transport) ListenAddresses() []string {
+	addrs := make([]string, len(t.listeners))
+	for i, l := range t.listeners {
+		addrs[i] = l.addr
+	}
+	return addrs
+}
+
+// ListenWeights returns the weights of all listen addresses, in the same order
+// as ListenAddresses (see Options.WithListenWeights).
+func (t *Transport) ListenWeights() []int {
+	weights := make([]int, len(t.listeners))
+	for i, l := range t.listeners {
+		weights[i] = l.weight
+	}
+	return weights
+}
+
+// listenerStats returns the ListenerStats of all listen addresses, in the same
+// order as ListenAddresses.
+func (t *Transport) listenerStats() []ListenerStats {
+	stats := make([]ListenerStats, len(t.listeners))
+	for i, l := range t.listeners {
+		stats[i] = ListenerStats{
+			Addr:     l.addr,
+			Accepted: atomic.LoadUint64(l.accepted),
+			Active:   atomic.LoadInt64(l.active),
+		}
+	}
+	return stats
+}
+
+// listenAll accepts inbound connections on all listen addresses until the
+// context is done. If listening on any address fails, then listening on all
+// addresses is stopped (without closing connections that have already been
+// accepted), and the first error is returned so that the caller can start
+// again.
+func (t *Transport) listenAll(ctx context.Context, handle func(net.Conn), handleErr func(error)) error {
+	if len(t.listeners) == 1 {
+		return t.listen(ctx, t.listeners[0].addr, t.listeners[0].handle(handle), handleErr)
+	}
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(t.listeners))
+	wg := new(sync.WaitGroup)
+	for _, l := range t.listeners {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- t.listen(listenCtx, l.addr, l.handle(handle), handleErr)
+			cancel()
+		}()
+	}
+	wg.Wait()
+	return <-errs
+}
@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// ErrIdentityMismatch is returned when the handshake with the network address
+// of a remote peer reveals a different signatory than the remote peer (or the
+// signatory that it has rotated to). This happens when the network address is
+// stale, or when the connection has been intercepted. The connection is always
+// closed.
+var ErrIdentityMismatch = errors.New("identity mismatch")
+
+// DefaultMismatchTTL is the default duration for which an identity mismatch is
+// remembered.
+var DefaultMismatchTTL = 5 * time.Minute
+
+// WithMismatchTTL sets the duration for which an identity mismatch is
+// remembered. Until then, sends to the remote peer fail with
+// SendErrorIdentityMismatch instead of re-dialing the same network address,
+// unless the network address changes, or a handshake with the remote peer
+// reveals the expected signatory. Zero means that mismatches are not
+// remembered. By default, the TTL is DefaultMismatchTTL.
+func (opts Options) WithMismatchTTL(ttl time.Duration) Options {
+	opts.MismatchTTL = ttl
+	return opts
+}
+
+// An identityMismatch records the signatory that was revealed by the network
+// address of a remote peer.
+type identityMismatch struct {
+	addr wire.Address
+	got  id.Signatory
+	at   time.Time
+}
+
+// mismatched records that the handshake with the network address of a remote
+// peer revealed a different signatory, and returns the error that describes
+// it.
+func (t *Transport) mismatched(remote id.Signatory, addr wire.Address, got id.Signatory) error {
+	now := t.opts.Clock.Now()
+
+	t.mismatchesMu.Lock()
+	defer t.mismatchesMu.Unlock()
+
+	// Expired mismatches are pruned whenever a new one is recorded, so that
+	// mismatches for remote peers that are never sent to again are not kept
+	// forever.
+	for r, m := range t.mismatches {
+		if now.Sub(m.at) >= t.opts.MismatchTTL {
+			delete(t.mismatches, r)
+		}
+	}
+	t.mismatches[remote] = identityMismatch{addr: addr, got: got, at: now}
+	return fmt.Errorf("%w: expected %v, got %v", ErrIdentityMismatch, remote, got)
+}
+
+// mismatch returns an error if the network address of a remote peer is known to
+// reveal a different signatory. Once the network address of the remote peer
+// changes, or the MismatchTTL has passed, the mismatch is forgotten, so that
+// the network address can be dialed.
+func (t *Transport) mismatch(remote id.Signatory, addr wire.Address) error {
+	now := t.opts.Clock.Now()
+
+	t.mismatchesMu.Lock()
+	defer t.mismatchesMu.Unlock()
+
+	m, ok := t.mismatches[remote]
+	if !ok {
+		return nil
+	}
+	if m.addr.Protocol != addr.Protocol || m.addr.Value != addr.Value || now.Sub(m.at) >= t.opts.MismatchTTL {
+		delete(t.mismatches, remote)
+		return nil
+	}
+	return fmt.Errorf("%w: expected %v, got %v", ErrIdentityMismatch, remote, m.got)
+}
+
+// matched forgets any mismatch recorded for a remote peer, because the
+// handshake revealed the expected signatory.
+func (t *Transport) matched(remote id.Signatory) {
+	t.mismatchesMu.Lock()
+	defer t.mismatchesMu.Unlock()
+
+	delete(t.mismatches, remote)
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/id"
+	"golang.org/x/time/rate"
+)
+
+// PeerOptions override the Options of a Transport for one remote peer, so that
+// some peers can be treated differently from others (for example, giving seed
+// peers a longer timeout and a keepalive). Fields that are nil fall back to the
+// Options of the Transport.
+type PeerOptions struct {
+	// PeerOptions override the channel.Options of the Channel to the remote
+	// peer.
+	channel.PeerOptions
+
+	// ClientTimeout and ServerTimeout override how long network connections
+	// to the remote peer are kept when the remote peer is not linked. They
+	// apply to network connections that are already attached, as well as to
+	// later ones, and are measured from when the network connection was
+	// dialed or accepted.
+	ClientTimeout *time.Duration
+	ServerTimeout *time.Duration
+	// KeepAlive overrides the TCP keepalive period of network connections to
+	// the remote peer. Like the net.Dialer, a positive period enables
+	// keepalives, and a negative period disables them.
+	KeepAlive *time.Duration
+}
+
+// WithClientTimeout overrides the ClientTimeout for the remote peer.
+func (opts PeerOptions) WithClientTimeout(timeout time.Duration) PeerOptions {
+	opts.ClientTimeout = &timeout
+	return opts
+}
+
+// WithServerTimeout overrides the ServerTimeout for the remote peer.
+func (opts PeerOptions) WithServerTimeout(timeout time.Duration) PeerOptions {
+	opts.ServerTimeout = &timeout
+	return opts
+}
+
+// WithKeepAlive overrides the TCP keepalive period for the remote peer. A
+// negative period disables keepalives.
+func (opts PeerOptions) WithKeepAlive(period time.Duration) PeerOptions {
+	opts.KeepAlive = &period
+	return opts
+}
+
+// WithRateLimit overrides the bytes-per-second rate limit for the remote peer.
+func (opts PeerOptions) WithRateLimit(rateLimit rate.Limit) PeerOptions {
+	opts.PeerOptions = opts.PeerOptions.WithRateLimit(rateLimit)
+	return opts
+}
+
+// WithInboundBufferSize overrides the number of inbound messages from the
+// remote peer that can be buffered in memory.
+func (opts PeerOptions) WithInboundBufferSize(size int) PeerOptions {
+	opts.PeerOptions = opts.PeerOptions.WithInboundBufferSize(size)
+	return opts
+}
+
+// WithOutboundBufferSize overrides the number of outbound messages to the
+// remote peer that can be buffered in memory.
+func (opts PeerOptions) WithOutboundBufferSize(size int) PeerOptions {
+	opts.PeerOptions = opts.PeerOptions.WithOutboundBufferSize(size)
+	return opts
+}
+
+// Validate returns an error if the overrides are not valid.
+func (opts PeerOptions) Validate() error {
+	switch {
+	case opts.ClientTimeout != nil && *opts.ClientTimeout <= 0:
+		return fmt.Errorf("client timeout must be positive, got %v", *opts.ClientTimeout)
+	case opts.ServerTimeout != nil && *opts.ServerTimeout <= 0:
+		return fmt.Errorf("server timeout must be positive, got %v", *opts.ServerTimeout)
+	}
+	return opts.PeerOptions.Validate()
+}
+
+// SetPeerOptions overrides the Options of the Transport for the remote peer,
+// replacing any previous overrides, until they are removed by
+// ClearPeerOptions. The timeouts, keepalive, and rate limit are applied to the
+// existing network connections immediately, and the buffer sizes are applied
+// the next time that a Channel is bound to the remote peer.
+func (t *Transport) SetPeerOptions(remote id.Signatory, opts PeerOptions) error {
+	remote = t.resolve(remote)
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid peer options: %w", err)
+	}
+
+	t.peerOptsMu.Lock()
+	t.peerOpts[remote] = opts
+	t.peerOptsMu.Unlock()
+
+	if err := t.client.SetPeerOptions(remote, opts.PeerOptions); err != nil {
+		return err
+	}
+	t.rearm(remote)
+	if conn, ok := t.client.Conn(remote); ok {
+		t.keepAlive(remote, conn)
+	}
+	return nil
+}
+
+// ClearPeerOptions removes the overrides of the Options of the Transport for
+// the remote peer, so that it falls back to the Options of the Transport. Like
+// SetPeerOptions, the timeouts, keepalive, and rate limit of the existing
+// network connections are restored immediately, and the buffer sizes are
+// restored the next time that a Channel is bound.
+func (t *Transport) ClearPeerOptions(remote id.Signatory) {
+	remote = t.resolve(remote)
+
+	t.peerOptsMu.Lock()
+	opts, ok := t.peerOpts[remote]
+	delete(t.peerOpts, remote)
+	t.peerOptsMu.Unlock()
+
+	t.client.ClearPeerOptions(remote)
+	t.rearm(remote)
+	if !ok || opts.KeepAlive == nil {
+		return
+	}
+	if conn, ok := t.client.Conn(remote); ok {
+		t.restoreKeepAlive(remote, conn)
+	}
+}
+
+// PeerOptions returns the overrides of the Options of the Transport for the
+// remote peer. False is returned if there are none.
+func (t *Transport) PeerOptions(remote id.Signatory) (PeerOptions, bool) {
+	t.peerOptsMu.RLock()
+	defer t.peerOptsMu.RUnlock()
+
+	opts, ok := t.peerOpts[t.resolve(remote)]
+	return opts, ok
+}
+
+func (t *Transport) peerOptions(remote id.Signatory) PeerOptions {
+	t.peerOptsMu.RLock()
+	defer t.peerOptsMu.RUnlock()
+
+	return t.peerOpts[remote]
+}
+
+// clientTimeout returns the ClientTimeout for the remote peer.
+func (t *Transport) clientTimeout(remote id.Signatory) time.Duration {
+	if timeout := t.peerOptions(remote).ClientTimeout; timeout != nil {
+		return *timeout
+	}
+	return t.opts.ClientTimeout
+}
+
+// serverTimeout returns the ServerTimeout for the remote peer.
+func (t *Transport) serverTimeout(remote id.Signatory) time.Duration {
+	if timeout := t.peerOptions(remote).ServerTimeout; timeout != nil {
+		return *timeout
+	}
+	return t.opts.ServerTimeout
+}
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/tcp"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// A ProbeResult describes whether or not a remote peer was reachable when it
+// was probed.
+type ProbeResult struct {
+	// Reachable is true if the remote peer completed a handshake, or if there
+	// was already a connection to the remote peer.
+	Reachable bool
+	// Connected is true if there was already a connection to the remote peer,
+	// in which case it was not dialed.
+	Connected bool
+	// RTT is the duration spent dialing the remote peer and completing the
+	// handshake. It is zero if the remote peer was not dialed.
+	RTT time.Duration
+}
+
+// Probe checks whether or not a remote peer is reachable, without keeping a
+// connection to it. If there is already a connection to the remote peer, then
+// it is left undisturbed and the remote peer is reported as reachable.
+// Otherwise, the address of the remote peer is dialed once, the handshake is
+// completed, and the connection is immediately closed. The result is also
+// recorded against the address, so that it is considered by
+// PreferredAddress. An error is returned if the remote peer is unknown,
+// banned, or unreachable, and ErrIdentityMismatch is returned if the handshake
+// reveals a different signatory than the remote peer.
+//
+// The dial and handshake are bounded by the context and the ClientTimeout (or
+// its override for the remote peer), whichever is done first.
+func (t *Transport) Probe(ctx context.Context, remote id.Signatory) (ProbeResult, error) {
+	remote = t.resolve(remote)
+	remoteAddr, err := t.peerAddress(ctx, remote)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	if t.IsBanned(remote) {
+		return ProbeResult{}, ErrBanned
+	}
+	if t.IsConnected(remote) {
+		return ProbeResult{Reachable: true, Connected: true}, nil
+	}
+	if remoteAddr.Protocol != wire.TCP {
+		return ProbeResult{}, fmt.Errorf("unsupported protocol: %v", remoteAddr.Protocol)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.clientTimeout(remote))
+	defer cancel()
+
+	connID := t.nextConnID()
+	t.trace(connID, DirectionOutbound, TraceDialStart, remote, remoteAddr.Value, nil)
+	dialStart := t.opts.Clock.Now()
+
+	var attemptErr, probeErr error
+	rtt := time.Duration(0)
+	err = tcp.DialWithOptions(
+		ctx,
+		t.dialOptions(),
+		remoteAddr.Value,
+		func(conn net.Conn) {
+			addr := conn.RemoteAddr().String()
+			t.trace(connID, DirectionOutbound, TraceConnected, remote, addr, nil)
+			defer t.trace(connID, DirectionOutbound, TraceClosed, remote, addr, nil)
+
+			if deadline, ok := ctx.Deadline(); ok {
+				if err := conn.SetDeadline(deadline); err != nil {
+					probeErr = fmt.Errorf("set deadline: %w", err)
+					return
+				}
+			}
+
+			t.trace(connID, DirectionOutbound, TraceHandshakeStart, remote, addr, nil)
+			_, _, r, _, err := t.handshake(conn)
+			defer t.oncePool.Remove(r, conn)
+			t.trace(connID, DirectionOutbound, TraceHandshakeDone, r, addr, err)
+			t.recordHandshake(err)
+			switch {
+			case err != nil:
+				probeErr = fmt.Errorf("handshake: %w", err)
+			case r.Equal(&t.self):
+				probeErr = ErrSelfConnection
+			case !t.isRemote(remote, r):
+				probeErr = t.mismatched(remote, remoteAddr, r)
+			default:
+				t.matched(remote)
+			}
+			if probeErr != nil {
+				t.trace(connID, DirectionOutbound, TraceAuthorized, r, addr, probeErr)
+				return
+			}
+			t.trace(connID, DirectionOutbound, TraceAuthorized, r, addr, nil)
+			rtt = t.opts.Clock.Now().Sub(dialStart)
+			t.opts.Logger.Debug("probe", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Duration("rtt", rtt))
+		},
+		func(err error) {
+			t.opts.Logger.Debug("probe", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
+			t.trace(connID, DirectionOutbound, TraceDialFailed, remote, remoteAddr.Value, err)
+			// Only one attempt is made, so that unreachable peers are reported
+			// promptly.
+			attemptErr = err
+			cancel()
+		},
+		t.opts.DialTimeout)
+	if err != nil {
+		if attemptErr != nil {
+			err = attemptErr
+		}
+		probeErr = fmt.Errorf("dial: %w", err)
+	}
+	if probeErr != nil {
+		t.addrQualities.record(t.opts.Clock.Now(), remote, remoteAddr, 0, true)
+		return ProbeResult{}, probeErr
+	}
+	t.addrQualities.record(t.opts.Clock.Now(), remote, remoteAddr, rtt, false)
+	return ProbeResult{Reachable: true, RTT: rtt}, nil
+}
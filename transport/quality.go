@@ -0,0 +1,322 @@
+package transport
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muirglacier/aw/dht"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// DefaultAddressQualityHalfLife is the default duration after which the dial
+// outcomes recorded for an address count for half as much.
+var DefaultAddressQualityHalfLife = 10 * time.Minute
+
+// DefaultMaxAddressQualities is the default maximum number of addresses for
+// which dial outcomes are recorded, per remote peer.
+var DefaultMaxAddressQualities = 8
+
+// WithAddressQualityHalfLife sets the duration after which the dial outcomes
+// recorded for an address count for half as much. This allows an address that
+// was temporarily bad to be preferred again, once its failures have been
+// forgotten. Zero means that outcomes never decay. By default, the half-life
+// is DefaultAddressQualityHalfLife.
+func (opts Options) WithAddressQualityHalfLife(halfLife time.Duration) Options {
+	opts.AddressQualityHalfLife = halfLife
+	return opts
+}
+
+// WithMaxAddressQualities sets the maximum number of addresses for which dial
+// outcomes are recorded, per remote peer. When the maximum is reached, the
+// address that was least recently dialed is forgotten. By default, the
+// maximum is DefaultMaxAddressQualities.
+func (opts Options) WithMaxAddressQualities(max int) Options {
+	opts.MaxAddressQualities = max
+	return opts
+}
+
+// AddressQuality describes the outcomes of recent dials to one address of a
+// remote peer. Successes and Failures decay over time, so they are not whole
+// numbers.
+type AddressQuality struct {
+	Addr      wire.Address
+	Successes float64
+	Failures  float64
+	// Latency is a moving average of the time taken to connect to the
+	// address, including the time taken by failed dial attempts before the
+	// connection was made.
+	Latency time.Duration
+	// Updated is the time at which a dial outcome was last recorded.
+	Updated time.Time
+}
+
+// Score returns the estimated probability, between zero and one, that the
+// next dial to the address will succeed. An address without any recorded
+// outcomes has a score of one half.
+func (quality AddressQuality) Score() float64 {
+	return (quality.Successes + 1) / (quality.Successes + quality.Failures + 2)
+}
+
+// scoreBuckets is the number of equal ranges into which Scores are divided when
+// ordering addresses, so that addresses with similar Scores are ordered by
+// their distance, instead of by small differences between their Scores.
+const scoreBuckets = 10
+
+// scoreBucket returns the range into which a Score falls.
+func scoreBucket(score float64) int {
+	bucket := int(score * scoreBuckets)
+	if bucket >= scoreBuckets {
+		bucket = scoreBuckets - 1
+	}
+	return bucket
+}
+
+// addressQuality is an AddressQuality that tracks how far its outcomes have
+// been decayed.
+type addressQuality struct {
+	AddressQuality
+	decayed time.Time
+}
+
+// decay the recorded outcomes to the given time.
+func (quality *addressQuality) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(quality.decayed)
+	if elapsed <= 0 || halfLife <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	quality.Successes *= factor
+	quality.Failures *= factor
+	quality.decayed = now
+}
+
+// addressQualities records the outcomes of dials to the addresses of remote
+// peers.
+type addressQualities struct {
+	halfLife time.Duration
+	max      int
+	// known returns false for remote peers that are no longer in the table,
+	// so that their qualities can be pruned.
+	known func(id.Signatory) bool
+
+	mu        *sync.Mutex
+	qualities map[id.Signatory]map[string]*addressQuality
+	// pruneAt is the number of remote peers at which the qualities of
+	// unknown remote peers are next pruned.
+	pruneAt int
+}
+
+func newAddressQualities(halfLife time.Duration, max int, known func(id.Signatory) bool) addressQualities {
+	return addressQualities{
+		halfLife: halfLife,
+		max:      max,
+		known:    known,
+
+		mu:        new(sync.Mutex),
+		qualities: map[id.Signatory]map[string]*addressQuality{},
+		pruneAt:   minPruneAddressQualities,
+	}
+}
+
+// inTable returns a function that returns true if a remote peer is in the
+// table.
+func inTable(table dht.Table) func(id.Signatory) bool {
+	return func(remote id.Signatory) bool {
+		_, ok := table.PeerAddress(remote)
+		return ok
+	}
+}
+
+// minPruneAddressQualities is the smallest number of remote peers at which the
+// qualities of unknown remote peers are pruned.
+const minPruneAddressQualities = 64
+
+// record the outcome of dialing an address of a remote peer. The latency is
+// only used when the dial succeeded.
+func (qs *addressQualities) record(now time.Time, remote id.Signatory, addr wire.Address, latency time.Duration, failed bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	byAddr, ok := qs.qualities[remote]
+	if !ok {
+		if len(qs.qualities) >= qs.pruneAt {
+			qs.prune()
+		}
+		byAddr = map[string]*addressQuality{}
+		qs.qualities[remote] = byAddr
+	}
+	quality, ok := byAddr[addr.Value]
+	if !ok {
+		if len(byAddr) >= qs.max {
+			evictAddressQuality(byAddr)
+		}
+		quality = &addressQuality{decayed: now}
+		byAddr[addr.Value] = quality
+	}
+	quality.decay(now, qs.halfLife)
+	quality.Addr = addr
+	quality.Updated = now
+	if failed {
+		quality.Failures++
+		return
+	}
+	quality.Successes++
+	if quality.Latency == 0 {
+		quality.Latency = latency
+	} else {
+		// Exponentially weighted moving average, favouring history so that
+		// one slow connection does not change the preference.
+		quality.Latency = (4*quality.Latency + latency) / 5
+	}
+}
+
+// get the qualities of all recorded addresses of a remote peer, ordered from
+// most preferred to least preferred. Addresses with scores in the same bucket
+// are ordered by their distance (if there is one), then by their score, and
+// then by their latency.
+func (qs *addressQualities) get(now time.Time, remote id.Signatory, distance func(wire.Address) (int, bool)) []AddressQuality {
+	qs.mu.Lock()
+	byAddr := qs.qualities[remote]
+	qualities := make([]AddressQuality, 0, len(byAddr))
+	for _, quality := range byAddr {
+		quality.decay(now, qs.halfLife)
+		qualities = append(qualities, quality.AddressQuality)
+	}
+	qs.mu.Unlock()
+
+	// The distances are computed without holding the lock, because they are
+	// computed by a function that is provided by the application.
+	type distanceOf struct {
+		distance int
+		ok       bool
+	}
+	distances := make(map[string]distanceOf, len(qualities))
+	for _, quality := range qualities {
+		d, ok := distance(quality.Addr)
+		distances[quality.Addr.Value] = distanceOf{d, ok}
+	}
+	sort.Slice(qualities, func(i, j int) bool {
+		si, sj := qualities[i].Score(), qualities[j].Score()
+		if bi, bj := scoreBucket(si), scoreBucket(sj); bi != bj {
+			return bi > bj
+		}
+		di, dj := distances[qualities[i].Addr.Value], distances[qualities[j].Addr.Value]
+		if di.ok != dj.ok {
+			return di.ok
+		}
+		if di.distance != dj.distance {
+			return di.distance < dj.distance
+		}
+		if si != sj {
+			return si > sj
+		}
+		if qualities[i].Latency != qualities[j].Latency {
+			return qualities[i].Latency < qualities[j].Latency
+		}
+		return qualities[i].Addr.Value < qualities[j].Addr.Value
+	})
+	return qualities
+}
+
+// forget the qualities of all addresses of a remote peer.
+func (qs *addressQualities) forget(remote id.Signatory) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	delete(qs.qualities, remote)
+}
+
+// prune the qualities of remote peers that are no longer known. The next prune
+// happens once the number of remote peers has doubled, so that the cost of
+// pruning is amortised across new remote peers. It assumes that the qualities
+// are locked by the caller.
+func (qs *addressQualities) prune() {
+	for remote := range qs.qualities {
+		if !qs.known(remote) {
+			delete(qs.qualities, remote)
+		}
+	}
+	qs.pruneAt = 2 * len(qs.qualities)
+	if qs.pruneAt < minPruneAddressQualities {
+		qs.pruneAt = minPruneAddressQualities
+	}
+}
+
+// evictAddressQuality forgets the address that was least recently dialed. It
+// assumes that the qualities are locked by the caller.
+func evictAddressQuality(byAddr map[string]*addressQuality) {
+	oldest, ok := "", false
+	for value, quality := range byAddr {
+		if !ok || quality.Updated.Before(byAddr[oldest].Updated) {
+			oldest, ok = value, true
+		}
+	}
+	delete(byAddr, oldest)
+}
+
+// AddressQualities returns the recorded dial outcomes for all addresses that
+// have been dialed for a remote peer, ordered from most preferred to least
+// preferred. Addresses are preferred by their Score, then by their distance
+// (see WithAddressDistance), and then by their Latency. Addresses are ordered
+// by their distance when their Scores are in the same tenth (for example,
+// between 0.6 and 0.7), so that nearer addresses are preferred over addresses
+// that are only slightly more reliable.
+func (t *Transport) AddressQualities(remote id.Signatory) []AddressQuality {
+	return t.addrQualities.get(t.opts.Clock.Now(), remote, t.distance)
+}
+
+// PreferredAddress returns the address of a remote peer that has been the most
+// reliable to dial recently. False is returned if no address has been dialed
+// for the remote peer. Dials use the PreferredAddress instead of the address in
+// the table, if it has a better Score.
+func (t *Transport) PreferredAddress(remote id.Signatory) (wire.Address, bool) {
+	qualities := t.AddressQualities(remote)
+	if len(qualities) == 0 {
+		return wire.Address{}, false
+	}
+	return qualities[0].Addr, true
+}
+
+// dialAddress returns the address that should be dialed for a remote peer: the
+// PreferredAddress, if it is preferred over the address in the table (see
+// AddressQualities), or the address in the table. Addresses that have never
+// been dialed have a Score of one half, so a newly announced address is
+// preferred over an address that has been failing.
+func (t *Transport) dialAddress(remote id.Signatory, addr wire.Address) wire.Address {
+	qualities := t.AddressQualities(remote)
+	if len(qualities) == 0 || qualities[0].Addr.Value == addr.Value || qualities[0].Addr.Protocol != wire.TCP {
+		return addr
+	}
+	score := AddressQuality{}.Score()
+	for _, quality := range qualities {
+		if quality.Addr.Value == addr.Value {
+			score = quality.Score()
+			break
+		}
+	}
+	if t.isPreferred(qualities[0], addr, score) {
+		return qualities[0].Addr
+	}
+	return addr
+}
+
+// isPreferred returns true if the address with the given quality is preferred
+// over another address with the given score, using the same order as
+// AddressQualities.
+func (t *Transport) isPreferred(quality AddressQuality, addr wire.Address, score float64) bool {
+	if b, other := scoreBucket(quality.Score()), scoreBucket(score); b != other {
+		return b > other
+	}
+	d, ok := t.distance(quality.Addr)
+	other, otherOk := t.distance(addr)
+	if ok != otherOk {
+		return ok
+	}
+	if d != other {
+		return d < other
+	}
+	return quality.Score() > score
+}
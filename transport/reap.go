@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/muirglacier/id"
+)
+
+// A reaper ends the attachment of a network connection to a remote peer that
+// is not linked. It is re-armed whenever the PeerOptions of the remote peer
+// change, so that timeout overrides also apply to network connections that
+// are already attached.
+type reaper struct {
+	rearm chan struct{}
+}
+
+// reap returns a context that is done once the timeout of the remote peer has
+// elapsed since the start, or once the parent context is done. The timeout is
+// read from the timeout function when reap is called, and again whenever the
+// reaper is re-armed, so a longer timeout keeps the network connection for
+// longer, and a shorter timeout that has already elapsed reaps it straight
+// away.
+func (t *Transport) reap(ctx context.Context, remote id.Signatory, start time.Time, timeout func(id.Signatory) time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &reaper{rearm: make(chan struct{}, 1)}
+
+	t.reapersMu.Lock()
+	if t.reapers[remote] == nil {
+		t.reapers[remote] = map[*reaper]struct{}{}
+	}
+	t.reapers[remote][r] = struct{}{}
+	t.reapersMu.Unlock()
+
+	go func() {
+		defer cancel()
+		defer func() {
+			t.reapersMu.Lock()
+			defer t.reapersMu.Unlock()
+
+			delete(t.reapers[remote], r)
+			if len(t.reapers[remote]) == 0 {
+				delete(t.reapers, remote)
+			}
+		}()
+
+		for {
+			remaining := time.Until(start.Add(timeout(remote)))
+			if remaining <= 0 {
+				return
+			}
+			timer := time.NewTimer(remaining)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			case <-r.rearm:
+				timer.Stop()
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// rearm the reapers of the network connections to the remote peer, so that
+// they read its timeout again.
+func (t *Transport) rearm(remote id.Signatory) {
+	t.reapersMu.Lock()
+	defer t.reapersMu.Unlock()
+
+	for r := range t.reapers[remote] {
+		select {
+		case r.rearm <- struct{}{}:
+		default:
+		}
+	}
+}
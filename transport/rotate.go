@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// rotated is called during the handshake when a remote peer proves that it
+// has rotated from a previous signatory to its current signatory.
+func (t *Transport) rotated(previous, current id.Signatory) {
+	if t.table.AddAlias(previous, current) {
+		t.opts.Logger.Info("rotated", zap.String("previous", previous.String()), zap.String("current", current.String()))
+	}
+}
+
+// current returns the current signatory of a remote peer, following its alias
+// if it has rotated away from the given signatory.
+func (t *Transport) current(remote id.Signatory) id.Signatory {
+	if current, ok := t.table.Alias(remote); ok {
+		return current
+	}
+	return remote
+}
+
+// resolve returns the signatory that should be used to send to a remote peer.
+// This is its current signatory, unless there is still a connection to the
+// given signatory (which happens when the alias was learned by dialing it). In
+// that case, the connection is used until it is closed, because the handshake
+// does not allow a second connection to the same remote peer.
+func (t *Transport) resolve(remote id.Signatory) id.Signatory {
+	if t.IsConnected(remote) {
+		return remote
+	}
+	return t.current(remote)
+}
+
+// isRemote returns true if the signatory revealed by the handshake is the
+// expected remote peer, or the signatory that the expected remote peer has
+// rotated to.
+func (t *Transport) isRemote(expected, got id.Signatory) bool {
+	if got.Equal(&expected) {
+		return true
+	}
+	current, ok := t.table.Alias(expected)
+	return ok && got.Equal(&current)
+}
@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// recordDial records the outcome of dialing an address of a remote peer, both
+// in the address qualities, and in the score of the remote peer. The latency is
+// only used when the dial succeeded.
+func (t *Transport) recordDial(remote id.Signatory, addr wire.Address, latency time.Duration, failed bool) {
+	t.addrQualities.record(t.opts.Clock.Now(), remote, addr, latency, failed)
+	t.score(remote, failed)
+}
+
+// score records the outcome of establishing a connection with a remote peer in
+// the Table, if it is a dht.Scorer, and auto-scoring is enabled.
+func (t *Transport) score(remote id.Signatory, failed bool) {
+	if t.scorer == nil {
+		return
+	}
+	if failed {
+		t.scorer.RecordFailure(remote)
+		return
+	}
+	t.scorer.RecordSuccess(remote)
+}
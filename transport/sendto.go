@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/tcp"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// SendTo dials a network address, completes the handshake with whichever peer
+// is listening at that address, sends one message, and then closes the
+// connection. Unlike Send, the remote peer does not need to be in the table,
+// which is useful for bootstrapping and for ephemeral interactions. The
+// signatory learned during the handshake is returned, but it is not cached:
+// the table is left unchanged, and no Channel is bound. To keep talking to the
+// remote peer, add it to the table using the returned signatory, and then use
+// Send.
+//
+// The dial, handshake, and write are bounded by the context and the
+// ClientTimeout, whichever is done first. If there is already a connection to
+// the remote peer, then the handshake might replace it, so callers should
+// prefer Send for peers that are known.
+func (t *Transport) SendTo(ctx context.Context, addr wire.Address, msg wire.Msg) (id.Signatory, error) {
+	if addr.Protocol != wire.TCP {
+		return id.Signatory{}, fmt.Errorf("unsupported protocol: %v", addr.Protocol)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.opts.ClientTimeout)
+	defer cancel()
+
+	remote := id.Signatory{}
+	connID := t.nextConnID()
+	t.trace(connID, DirectionOutbound, TraceDialStart, remote, addr.Value, nil)
+
+	var sendErr error
+	err := tcp.DialWithOptions(
+		ctx,
+		t.dialOptions(),
+		addr.Value,
+		func(conn net.Conn) {
+			connAddr := conn.RemoteAddr().String()
+			t.trace(connID, DirectionOutbound, TraceConnected, remote, connAddr, nil)
+			defer t.trace(connID, DirectionOutbound, TraceClosed, remote, connAddr, nil)
+
+			if deadline, ok := ctx.Deadline(); ok {
+				if err := conn.SetDeadline(deadline); err != nil {
+					sendErr = fmt.Errorf("set deadline: %w", err)
+					return
+				}
+			}
+
+			t.trace(connID, DirectionOutbound, TraceHandshakeStart, remote, connAddr, nil)
+			enc, _, r, _, err := t.handshake(conn)
+			defer t.oncePool.Remove(r, conn)
+			t.trace(connID, DirectionOutbound, TraceHandshakeDone, r, connAddr, err)
+			t.recordHandshake(err)
+			remote = r
+			if errors.Is(err, ErrBanned) {
+				t.trace(connID, DirectionOutbound, TraceAuthorized, r, connAddr, err)
+				t.writeGoodbye(conn, enc, wire.GoodbyeBanned)
+				sendErr = err
+				return
+			}
+			if err != nil {
+				sendErr = fmt.Errorf("handshake: %w", err)
+				return
+			}
+			if r.Equal(&t.self) {
+				t.trace(connID, DirectionOutbound, TraceAuthorized, r, connAddr, ErrSelfConnection)
+				sendErr = ErrSelfConnection
+				return
+			}
+			t.trace(connID, DirectionOutbound, TraceAuthorized, r, connAddr, nil)
+
+			t.opts.Logger.Debug("send to", zap.String("remote", r.String()), zap.String("addr", connAddr))
+			sendErr = t.writeMsg(conn, enc, msg)
+		},
+		func(err error) {
+			t.opts.Logger.Debug("dial", zap.String("addr", addr.String()), zap.Error(err))
+			t.trace(connID, DirectionOutbound, TraceDialFailed, remote, addr.Value, err)
+		},
+		t.opts.DialTimeout)
+	if err != nil {
+		return remote, newSendError(remote, fmt.Errorf("dial: %w", err))
+	}
+	if sendErr != nil {
+		if errors.Is(sendErr, ErrBanned) {
+			return remote, &SendError{Kind: SendErrorBanned, Remote: remote, Err: sendErr}
+		}
+		return remote, newSendError(remote, sendErr)
+	}
+	return remote, nil
+}
+
+// writeMsg directly to a network connection that is not attached to a
+// Channel. The Msg is framed in the same way that a Channel would frame it, so
+// the remote peer cannot distinguish it from any other Msg.
+func (t *Transport) writeMsg(conn net.Conn, enc codec.Encoder, msg wire.Msg) error {
+	buf := make([]byte, msg.SizeHint())
+	if _, _, err := msg.Marshal(buf, len(buf)); err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	enc = codec.LengthPrefixEncoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainEncoder, enc)
+	if _, err := enc(conn, buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if msg.Type == wire.MsgTypeSync {
+		if _, err := enc(conn, msg.SyncData); err != nil {
+			return fmt.Errorf("encode sync data: %w", err)
+		}
+	}
+	return nil
+}
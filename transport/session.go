@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/muirglacier/aw/codec"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// A Session describes the connection with a remote peer, and the parameters
+// that were negotiated during its handshake. The cipher is not included,
+// because it is fixed by the Handshake that is given to the Transport, rather
+// than negotiated.
+type Session struct {
+	// ID of the connection.
+	ID ConnID
+	// Remote is the signatory revealed by the handshake.
+	Remote id.Signatory
+	// Addr is the network address of the other end of the connection.
+	Addr string
+	// Direction tells whether the connection was dialed by the Transport, or
+	// accepted from the remote peer.
+	Direction Direction
+	// Compression is the Compression that was negotiated. It is
+	// CompressionNone if compression is not being negotiated.
+	Compression codec.Compression
+	// Version is the latest message version that is understood by both
+	// peers. It is wire.MsgVersion4 if versions are not being negotiated.
+	Version uint16
+	// Metadata is the application metadata of the remote peer. It is nil if
+	// metadata is not being exchanged.
+	Metadata []byte
+	// Exporter derives application keys that are bound to the session of the
+	// connection. It is nil if keys are not being exported (see
+	// Options.WithExportKeys).
+	Exporter *handshake.Exporter
+	// Established is the time at which the connection was authorized.
+	Established time.Time
+}
+
+// Session returns the Session of the most recently established connection
+// with the remote peer. False is returned if there is no connection with the
+// remote peer. It can be called from the OnConnected function, and from the
+// receiver of messages, to behave differently for each connection.
+func (t *Transport) Session(remote id.Signatory) (Session, bool) {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	session, ok := t.sessions[remote]
+	return session, ok
+}
+
+// A handshakeState records what the Handshake of one connection learned about
+// the remote peer. It is only added to the Session once the connection has been
+// authorized, so that connections that are refused after their handshake
+// cannot replace what is known about the remote peer.
+type handshakeState struct {
+	metadata []byte
+	version  uint16
+	exporter *handshake.Exporter
+}
+
+// handshake runs the Handshake of the Transport over a connection, and returns
+// the handshakeState of the connection alongside the usual results.
+func (t *Transport) handshake(conn net.Conn) (codec.Encoder, codec.Decoder, id.Signatory, handshakeState, error) {
+	// Remote peers that do not negotiate their version are assumed to only
+	// understand the messages that could be sent before versions were
+	// negotiated.
+	state := handshakeState{version: wire.MsgVersion4}
+	enc, dec, remote, err := t.newHandshake(&state)(conn, t.opts.Encoder, t.opts.Decoder)
+	return enc, dec, remote, state, err
+}
+
+// startSession records the Session of a connection that has been authorized,
+// and returns it. The Session (and the metadata of the remote peer that it
+// holds) is forgotten once there are no connections with the remote peer.
+func (t *Transport) startSession(connID ConnID, remote id.Signatory, addr string, dir Direction, state handshakeState) Session {
+	c, _ := t.Compression(remote)
+	session := Session{
+		ID:          connID,
+		Remote:      remote,
+		Addr:        addr,
+		Direction:   dir,
+		Compression: c,
+		Version:     state.version,
+		Metadata:    state.metadata,
+		Exporter:    state.exporter,
+		Established: t.opts.Clock.Now(),
+	}
+
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	t.sessions[remote] = session
+	return session
+}
+
+// receivedMetadata returns a function that passes the application metadata of
+// a remote peer to the OnMetadata function, if there is one, and then records
+// it in the handshakeState.
+func (t *Transport) receivedMetadata(state *handshakeState) func(id.Signatory, []byte) error {
+	return func(remote id.Signatory, metadata []byte) error {
+		if t.opts.OnMetadata != nil {
+			if err := t.opts.OnMetadata(remote, metadata); err != nil {
+				return err
+			}
+		}
+		state.metadata = append([]byte{}, metadata...)
+		return nil
+	}
+}
+
+// negotiatedVersion returns a function that records the negotiated message
+// version in the handshakeState.
+func negotiatedVersion(state *handshakeState) func(id.Signatory, uint16) {
+	return func(_ id.Signatory, version uint16) {
+		state.version = version
+	}
+}
+
+// exported returns a function that records the Exporter of the session in the
+// handshakeState.
+func exported(state *handshakeState) func(id.Signatory, *handshake.Exporter) {
+	return func(_ id.Signatory, exporter *handshake.Exporter) {
+		state.exporter = exporter
+	}
+}
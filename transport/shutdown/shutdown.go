@@ -0,0 +1,81 @@
+// Package shutdown runs a Transport until the process is asked to terminate,
+// and then shuts it down gracefully. It is separate from the transport package
+// so that applications that handle signals themselves do not depend on it.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/muirglacier/aw/transport"
+)
+
+// ErrGracePeriodExceeded is returned when a Runner does not return within the
+// grace period after it has been asked to shut down.
+var ErrGracePeriodExceeded = errors.New("grace period exceeded")
+
+// A Runner runs until its context is done, and then shuts down. It is
+// implemented by *transport.Transport, which says goodbye to all connected
+// remote peers when shutting down (if sending goodbyes is enabled).
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+var _ Runner = (*transport.Transport)(nil)
+
+// RunWithSignals runs the Runner until the context is done, or until the
+// process receives one of the signals (SIGINT and SIGTERM, if no signals are
+// given). Either way, the context of the Runner is then cancelled, and this
+// function blocks until the Runner has returned.
+//
+// The grace period bounds how long shutdown can take. If the Runner has not
+// returned within the grace period, then this function returns
+// ErrGracePeriodExceeded, and the Runner is left to return in the background.
+// For a Transport, shutdown is normally bounded by its GoodbyeTimeout, so the
+// grace period should be longer than that. A grace period of zero, or less,
+// means that this function waits for the Runner to return for as long as it
+// takes. Signals that are received during the grace period are ignored. The
+// signals are only handled while this function is running.
+func RunWithSignals(ctx context.Context, r Runner, grace time.Duration, sigs ...os.Signal) error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sigs...)
+	defer signal.Stop(signals)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(runCtx)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-signals:
+	case <-done:
+		return nil
+	}
+	cancel()
+
+	if grace <= 0 {
+		<-done
+		return nil
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrGracePeriodExceeded
+	}
+}
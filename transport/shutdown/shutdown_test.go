@@ -0,0 +1,110 @@
+//go:build !windows
+// +build !windows
+
+package shutdown_test
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/dht"
+	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/transport"
+	"github.com/muirglacier/aw/transport/shutdown"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// runner is a Runner that returns after its context is done, and then after
+// the delay.
+type runner struct {
+	delay time.Duration
+}
+
+func (r runner) Run(ctx context.Context) {
+	<-ctx.Done()
+	time.Sleep(r.delay)
+}
+
+var _ = Describe("Shutdown", func() {
+	newTransport := func(opts transport.Options) *transport.Transport {
+		privKey := id.NewPrivKey()
+		self := privKey.Signatory()
+		h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
+		client := channel.NewClient(channel.DefaultOptions(), self)
+		table := dht.NewInMemTable(self)
+		return transport.New(opts, self, client, h, table)
+	}
+
+	Context("when the context is done", func() {
+		It("should shut down the runner", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(shutdown.RunWithSignals(ctx, runner{}, time.Second)).To(Succeed())
+		})
+	})
+
+	Context("when a signal is received", func() {
+		It("should shut down the transport, and say goodbye to connected peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			disconnected := make(chan transport.DisconnectEvent, 1)
+			t1 := newTransport(transport.DefaultOptions().WithSendGoodbye(true).WithPort(3425))
+			t2 := newTransport(transport.DefaultOptions().WithPort(3426).WithOnDisconnected(func(event transport.DisconnectEvent) {
+				select {
+				case disconnected <- event:
+				default:
+				}
+			}))
+			t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3426", uint64(time.Now().UnixNano())))
+			go t2.Run(ctx)
+
+			// SIGWINCH is ignored by default, so sending it before it is
+			// handled does not terminate the test.
+			errs := make(chan error, 1)
+			go func() {
+				errs <- shutdown.RunWithSignals(ctx, t1, 5*time.Second, syscall.SIGWINCH)
+			}()
+
+			t1.Link(t2.Self())
+			defer t1.Unlink(t2.Self())
+			go func() {
+				_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+			}()
+			Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+			Eventually(func() bool {
+				Expect(syscall.Kill(syscall.Getpid(), syscall.SIGWINCH)).To(Succeed())
+				select {
+				case err := <-errs:
+					Expect(err).ToNot(HaveOccurred())
+					return true
+				case <-time.After(50 * time.Millisecond):
+					return false
+				}
+			}, 5*time.Second).Should(BeTrue())
+
+			var event transport.DisconnectEvent
+			Eventually(disconnected, 5*time.Second).Should(Receive(&event))
+			Expect(event.Remote).To(Equal(t1.Self()))
+			Expect(event.Reason).To(Equal(wire.GoodbyeShutdown))
+		})
+	})
+
+	Context("when the runner does not shut down within the grace period", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			start := time.Now()
+			err := shutdown.RunWithSignals(ctx, runner{delay: time.Second}, 100*time.Millisecond)
+			Expect(err).To(Equal(shutdown.ErrGracePeriodExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+})
@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/id"
+)
+
+// DefaultStatsWindow is the default duration over which recent handshakes are
+// counted.
+var DefaultStatsWindow = time.Minute
+
+// WithStatsWindow sets the duration over which recent handshakes are counted
+// by Stats. Recent handshakes include those from the current window, and the
+// previous window. By default, the window is DefaultStatsWindow.
+func (opts Options) WithStatsWindow(window time.Duration) Options {
+	opts.StatsWindow = window
+	return opts
+}
+
+// Stats about the Transport, returned by the Stats method.
+type Stats struct {
+	// Started is the time at which the Transport was created.
+	Started time.Time
+	// Uptime is the duration since the Transport was created.
+	Uptime time.Duration
+	// Connected is the number of remote peers with at least one connection.
+	Connected int
+	// Handshakes is the total number of handshakes that have completed,
+	// successfully or not.
+	Handshakes uint64
+	// HandshakeFailures is the total number of handshakes that have failed.
+	HandshakeFailures uint64
+	// RecentHandshakes is the number of handshakes that have completed in
+	// the last one to two StatsWindows (see Options.WithStatsWindow).
+	RecentHandshakes uint64
+	// RecentHandshakeFailures is the number of handshakes that have failed in
+	// the last one to two StatsWindows.
+	RecentHandshakeFailures uint64
+	// FilteredMessages is the total number of inbound messages that have been
+	// dropped by the InboundFilter.
+	FilteredMessages uint64
+	// DroppedMessages is the total number of inbound messages that have been
+	// dropped because they could not be consumed fast enough. See
+	// channel.InboundPolicy.
+	DroppedMessages uint64
+	// InboundSizes is the SizeHistogram of all inbound messages. The buckets
+	// are set by channel.Options.WithSizeBuckets.
+	InboundSizes channel.SizeHistogram
+	// Listeners are the connection counts of every address on which the
+	// Transport listens, in the same order as ListenAddresses.
+	Listeners []ListenerStats
+}
+
+// handshakeStats counts handshakes, and handshake failures, in total and in
+// fixed windows of time.
+type handshakeStats struct {
+	mu     *sync.Mutex
+	window time.Duration
+
+	total, totalFailures uint64
+
+	windowStart           time.Time
+	current, prev         uint64
+	currentFail, prevFail uint64
+}
+
+func newHandshakeStats(now time.Time, window time.Duration) handshakeStats {
+	return handshakeStats{mu: new(sync.Mutex), window: window, windowStart: now}
+}
+
+// record a completed handshake.
+func (stats *handshakeStats) record(now time.Time, failed bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.roll(now)
+	stats.total++
+	stats.current++
+	if failed {
+		stats.totalFailures++
+		stats.currentFail++
+	}
+}
+
+// roll the windows forward so that the current window contains the given time.
+// It assumes that the stats are locked by the caller.
+func (stats *handshakeStats) roll(now time.Time) {
+	elapsed := now.Sub(stats.windowStart)
+	if elapsed < stats.window {
+		return
+	}
+	if elapsed < 2*stats.window {
+		stats.prev, stats.prevFail = stats.current, stats.currentFail
+	} else {
+		stats.prev, stats.prevFail = 0, 0
+	}
+	stats.current, stats.currentFail = 0, 0
+	stats.windowStart = now
+}
+
+// ConnectedPeers returns all remote peers with at least one connection, sorted
+// by their signatory bytes.
+func (t *Transport) ConnectedPeers() []id.Signatory {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	peers := make([]id.Signatory, 0, len(t.conns))
+	for remote := range t.conns {
+		peers = append(peers, remote)
+	}
+	sortSignatories(peers)
+	return peers
+}
+
+// sortSignatories by their bytes, so that the order does not depend on the
+// iteration order of a map.
+func sortSignatories(signatories []id.Signatory) {
+	sort.Slice(signatories, func(i, j int) bool {
+		return string(signatories[i][:]) < string(signatories[j][:])
+	})
+}
+
+// InboundSizes returns the SizeHistogram of the inbound messages that have
+// been received from the remote peer, for as long as it has been linked, or
+// connected. False is returned if the remote peer is neither.
+func (t *Transport) InboundSizes(remote id.Signatory) (channel.SizeHistogram, bool) {
+	return t.client.PeerInboundSizes(remote)
+}
+
+// Stats returns a snapshot of the Stats about the Transport. It is cheap
+// enough to be called frequently.
+func (t *Transport) Stats() Stats {
+	t.connsMu.RLock()
+	connected := len(t.conns)
+	t.connsMu.RUnlock()
+
+	t.handshakeStats.mu.Lock()
+	defer t.handshakeStats.mu.Unlock()
+
+	now := t.opts.Clock.Now()
+	t.handshakeStats.roll(now)
+	return Stats{
+		Started:                 t.started,
+		Uptime:                  now.Sub(t.started),
+		Connected:               connected,
+		Handshakes:              t.handshakeStats.total,
+		HandshakeFailures:       t.handshakeStats.totalFailures,
+		RecentHandshakes:        t.handshakeStats.current + t.handshakeStats.prev,
+		RecentHandshakeFailures: t.handshakeStats.currentFail + t.handshakeStats.prevFail,
+		FilteredMessages:        atomic.LoadUint64(t.filtered),
+		DroppedMessages:         t.client.Dropped(),
+		InboundSizes:            t.client.InboundSizes(),
+		Listeners:               t.listenerStats(),
+	}
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// DefaultMaxTags is the default maximum number of tags that can be attached to
+// the connection with one remote peer.
+var DefaultMaxTags = 16
+
+// ErrTooManyTags is returned when tagging a connection would attach more than
+// the maximum number of tags to it.
+var ErrTooManyTags = errors.New("too many tags")
+
+// A TagSelector selects remote peers by the tags that are attached to their
+// connections. Selectors can be combined using AllOf and AnyOf.
+type TagSelector func(tags []string) bool
+
+// HasTag returns a TagSelector that selects remote peers with the tag.
+func HasTag(tag string) TagSelector {
+	return func(tags []string) bool {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllOf returns a TagSelector that selects remote peers that are selected by
+// all of the selectors. If there are no selectors, then all remote peers are
+// selected.
+func AllOf(selectors ...TagSelector) TagSelector {
+	return func(tags []string) bool {
+		for _, selector := range selectors {
+			if !selector(tags) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf returns a TagSelector that selects remote peers that are selected by
+// at least one of the selectors. If there are no selectors, then no remote
+// peers are selected.
+func AnyOf(selectors ...TagSelector) TagSelector {
+	return func(tags []string) bool {
+		for _, selector := range selectors {
+			if selector(tags) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TagConnection attaches application-defined tags (for example, "validator")
+// to the connection with the remote peer, so that it can be selected by a
+// TagSelector. Tags that are already attached are ignored. The tags live with
+// the connection: they are cleared once there are no connections with the
+// remote peer, and must be attached again when it reconnects (for example,
+// from the OnConnected function). An error is returned if there is no
+// connection with the remote peer, and ErrTooManyTags is returned if the tags
+// would exceed the MaxTags (in which case none of the tags are attached).
+func (t *Transport) TagConnection(remote id.Signatory, tags ...string) error {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	if t.conns[remote] == 0 {
+		return fmt.Errorf("tag: no connection to %v", remote)
+	}
+	tagged := append([]string{}, t.tags[remote]...)
+	for _, tag := range tags {
+		if !HasTag(tag)(tagged) {
+			tagged = append(tagged, tag)
+		}
+	}
+	if len(tagged) > t.opts.MaxTags {
+		return fmt.Errorf("tag: %w: expected n<=%v, got n=%v", ErrTooManyTags, t.opts.MaxTags, len(tagged))
+	}
+	sort.Strings(tagged)
+	t.tags[remote] = tagged
+	return nil
+}
+
+// UntagConnection detaches tags from the connection with the remote peer. Tags
+// that are not attached are ignored.
+func (t *Transport) UntagConnection(remote id.Signatory, tags ...string) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	tagged := make([]string, 0, len(t.tags[remote]))
+	for _, tag := range t.tags[remote] {
+		if !HasTag(tag)(tags) {
+			tagged = append(tagged, tag)
+		}
+	}
+	if len(tagged) == 0 {
+		delete(t.tags, remote)
+		return
+	}
+	t.tags[remote] = tagged
+}
+
+// Tags returns the sorted tags that are attached to the connection with the
+// remote peer.
+func (t *Transport) Tags(remote id.Signatory) []string {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	return append([]string{}, t.tags[remote]...)
+}
+
+// TaggedPeers returns the connected remote peers whose tags are selected by
+// the TagSelector, sorted by their signatory bytes.
+func (t *Transport) TaggedPeers(selector TagSelector) []id.Signatory {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	peers := []id.Signatory{}
+	for remote := range t.conns {
+		if selector(t.tags[remote]) {
+			peers = append(peers, remote)
+		}
+	}
+	sortSignatories(peers)
+	return peers
+}
+
+// BroadcastTagged sends a message to all connected remote peers whose tags are
+// selected by the TagSelector. The message is sent to all of them
+// concurrently, and this method blocks until all sends have finished, or the
+// context is done. Remote peers that are not connected are never dialed. The
+// errors of the sends that failed are returned, in no particular order, and
+// each one is a SendError.
+func (t *Transport) BroadcastTagged(ctx context.Context, selector TagSelector, msg wire.Msg) []error {
+	recipients := t.TaggedPeers(selector)
+
+	errsMu := new(sync.Mutex)
+	errs := []error{}
+	wg := new(sync.WaitGroup)
+	for i := range recipients {
+		recipient := recipients[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// The recipient was connected when it was selected, so the
+			// message is sent directly to its Channel, instead of dialing.
+			if err := t.send(ctx, recipient, msg); err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/muirglacier/aw/tcp"
+	"github.com/muirglacier/id"
+)
+
+// TCPInfo returns the TCP info of the network connection with the remote peer,
+// as it is known by the kernel (for example, the round trip time, the number
+// of retransmits, and the size of the congestion window). This is only
+// supported on Linux. On other platforms, and for network connections that
+// are not TCP sockets, an error that wraps tcp.ErrTCPInfoUnsupported is
+// returned. An error is also returned if there is no network connection with
+// the remote peer.
+func (t *Transport) TCPInfo(remote id.Signatory) (*tcp.TCPInfo, error) {
+	if !t.IsConnected(remote) {
+		return nil, fmt.Errorf("tcp info: no connection to %v", remote)
+	}
+	conn, ok := t.client.Conn(remote)
+	if !ok {
+		return nil, fmt.Errorf("tcp info: no connection to %v", remote)
+	}
+	info, err := tcp.ReadTCPInfo(conn)
+	if err != nil {
+		return nil, fmt.Errorf("tcp info: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/muirglacier/id"
+
+	"go.uber.org/zap"
+)
+
+// A TraceID identifies a connection attempt made (or accepted) by a Transport.
+// It is the ConnID of the connection, so all TraceEvents emitted for the same
+// connection attempt share the same TraceID, which allows them to be
+// correlated into a timeline, and with the Session of the connection.
+type TraceID = ConnID
+
+// TraceStage identifies the stage of connection establishment at which a
+// TraceEvent was emitted.
+type TraceStage uint8
+
+// Enumerate all TraceStage values.
+const (
+	TraceDialStart TraceStage = iota + 1
+	TraceDialFailed
+	TraceConnected
+	TraceHandshakeStart
+	TraceHandshakeDone
+	TraceAuthorized
+	TraceClosed
+)
+
+func (stage TraceStage) String() string {
+	switch stage {
+	case TraceDialStart:
+		return "dial start"
+	case TraceDialFailed:
+		return "dial failed"
+	case TraceConnected:
+		return "connected"
+	case TraceHandshakeStart:
+		return "handshake start"
+	case TraceHandshakeDone:
+		return "handshake done"
+	case TraceAuthorized:
+		return "authorized"
+	case TraceClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// A TraceEvent is emitted by a Transport at each stage of connection
+// establishment. The Remote is empty until the handshake has completed for
+// inbound connections. The Err is set when the stage failed.
+type TraceEvent struct {
+	ID        TraceID
+	Stage     TraceStage
+	Direction Direction
+	Remote    id.Signatory
+	Addr      string
+	Err       error
+	Time      time.Time
+}
+
+// A Tracer is called synchronously for every TraceEvent emitted by a
+// Transport. It must not block.
+type Tracer func(TraceEvent)
+
+// LogTracer returns a Tracer that writes all TraceEvents to a logger at the
+// debug level.
+func LogTracer(logger *zap.Logger) Tracer {
+	return func(event TraceEvent) {
+		fields := []zap.Field{
+			zap.String("trace", event.ID.String()),
+			zap.String("stage", event.Stage.String()),
+			zap.String("direction", event.Direction.String()),
+			zap.String("remote", event.Remote.String()),
+			zap.String("addr", event.Addr),
+		}
+		if event.Err != nil {
+			fields = append(fields, zap.Error(event.Err))
+		}
+		logger.Debug("trace", fields...)
+	}
+}
+
+// Names of the spans started by a Transport.
+const (
+	// SpanSend covers a call to Send.
+	SpanSend = "aw.send"
+	// SpanDial covers an outbound connection attempt, until the connection is
+	// established or fails.
+	SpanDial = "aw.dial"
+	// SpanHandshake covers the handshake of an inbound or outbound
+	// connection.
+	SpanHandshake = "aw.handshake"
+)
+
+// A SpanStarter is used by a Transport to start tracing spans, so that
+// distributed tracing can attribute latency to connecting, handshaking, and
+// sending, without the Transport depending on a tracing library. StartSpan
+// returns a context that carries the new span as a child of any span already
+// carried by the given context, and a function that finishes the new span.
+// Spans started while sending to a remote peer are children of the context
+// passed to Send, even when they outlive the call to Send (for example, a dial
+// that continues in the background). It is called synchronously, and must not
+// block.
+type SpanStarter interface {
+	StartSpan(ctx context.Context, name string) (context.Context, func())
+}
+
+// startSpan using the SpanStarter of the Options. If there is none, then it
+// returns the given context and a function that does nothing.
+func (t *Transport) startSpan(ctx context.Context, name string) (context.Context, func()) {
+	if t.opts.SpanStarter == nil {
+		return ctx, func() {}
+	}
+	return t.opts.SpanStarter.StartSpan(ctx, name)
+}
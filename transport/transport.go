@@ -7,12 +7,14 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/muirglacier/aw/dht"
 
 	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/clock"
 	"github.com/muirglacier/aw/codec"
 	"github.com/muirglacier/aw/handshake"
 	"github.com/muirglacier/aw/policy"
@@ -25,21 +27,36 @@ import (
 
 // Default options.
 var (
-	DefaultHost          = "localhost"
-	DefaultPort          = uint16(3333)
-	DefaultEncoder       = codec.PlainEncoder
-	DefaultDecoder       = codec.PlainDecoder
-	DefaultDialTimeout   = policy.ConstantTimeout(time.Second)
-	DefaultClientTimeout = 10 * time.Second
-	DefaultServerTimeout = 10 * time.Second
-	DefaultExpiryTimeout = time.Minute
+	DefaultHost           = "localhost"
+	DefaultPort           = uint16(3333)
+	DefaultEncoder        = codec.PlainEncoder
+	DefaultDecoder        = codec.PlainDecoder
+	DefaultDialTimeout    = policy.ConstantTimeout(time.Second)
+	DefaultClientTimeout  = 10 * time.Second
+	DefaultServerTimeout  = 10 * time.Second
+	DefaultExpiryTimeout  = time.Minute
+	DefaultGoodbyeTimeout = 100 * time.Millisecond
+	// DefaultBannedBackoff is a reasonable duration for which a remote peer is
+	// not dialed after it says goodbye because it has banned the local peer. It
+	// is not used unless it is passed to WithBannedBackoff.
+	DefaultBannedBackoff = time.Minute
+	// DefaultMaxMetadataSize is the default maximum size, in bytes, of the
+	// application metadata that remote peers can send during the handshake.
+	DefaultMaxMetadataSize = 1024
+
+	DefaultKeepConnectedBackoff = policy.MaxTimeout(time.Minute, policy.ExponentialBackoff(2, policy.ConstantTimeout(time.Second)))
 )
 
+// ErrSelfConnection is returned when the remote peer of a connection is
+// revealed, by the handshake, to be the local peer.
+var ErrSelfConnection = errors.New("self connection")
+
 // Options used to parameterise the behaviour of a Transport.
 type Options struct {
 	Logger          *zap.Logger
 	Host            string
 	Port            uint16
+	AnnounceAddress string
 	Encoder         codec.Encoder
 	Decoder         codec.Decoder
 	DialTimeout     policy.Timeout
@@ -47,6 +64,59 @@ type Options struct {
 	ServerTimeout   time.Duration
 	OncePoolOptions handshake.OncePoolOptions
 	ExpiryDuration  time.Duration
+	Tracer          Tracer
+	SpanStarter     SpanStarter
+	AddressResolver func(ctx context.Context, remote id.Signatory) (wire.Address, error)
+	NetworkKey      []byte
+	Rand            io.Reader
+	Clock           clock.Clock
+	PruneSelf       bool
+
+	KeepConnectedBackoff policy.Timeout
+	LengthPrefixOptions  codec.LengthPrefixOptions
+	DialOptions          tcp.DialOptions
+	ListenOptions        tcp.ListenOptions
+	Listen               func(ctx context.Context, addr string) (net.Listener, error)
+	ListenAddresses      []string
+	ListenWeights        map[string]int
+	Allow                policy.Allow
+	ListenErrorInterval  time.Duration
+	NoDelay              bool
+	KeepAliveScaler      KeepAliveScaler
+	MaxBans              int
+	MaxTags              int
+	MaxBatchSize         int
+	AutoScore            bool
+	AddressDistance      AddressDistance
+	BanDrainTimeout      time.Duration
+	BannedBackoff        time.Duration
+	SendGoodbye          bool
+	GoodbyeTimeout       time.Duration
+	InboundFilter        channel.InboundFilter
+	InboundFilterBan     time.Duration
+	Compressions         []codec.Compression
+	CompressionOptions   codec.CompressionOptions
+	NegotiateVersion     bool
+	Metadata             []byte
+	MaxMetadataSize      int
+	MaxHandshakeMsgSize  int
+	Rotation             bool
+	PreviousKeys         []*id.PrivKey
+	ExportKeys           bool
+	MaxConns             int
+	CapacityPolicy       CapacityPolicy
+	StatsWindow          time.Duration
+	MismatchTTL          time.Duration
+
+	AddressQualityHalfLife time.Duration
+	MaxAddressQualities    int
+
+	OnConnected    func(remote id.Signatory, addr string)
+	OnOpened       func(session Session)
+	OnReplaced     func(remote id.Signatory, addr string)
+	OnDisconnected func(event DisconnectEvent)
+	OnClosed       func(session Session, closed time.Time)
+	OnMetadata     func(remote id.Signatory, metadata []byte) error
 }
 
 // DefaultOptions returns Options with sensible defaults.
@@ -66,6 +136,26 @@ func DefaultOptions() Options {
 		ServerTimeout:   DefaultServerTimeout,
 		OncePoolOptions: handshake.DefaultOncePoolOptions(),
 		ExpiryDuration:  DefaultExpiryTimeout,
+		Clock:           clock.Real(),
+
+		KeepConnectedBackoff: DefaultKeepConnectedBackoff,
+		LengthPrefixOptions:  codec.DefaultLengthPrefixOptions(),
+		CompressionOptions:   codec.DefaultCompressionOptions(),
+		DialOptions:          tcp.DefaultDialOptions(),
+		ListenOptions:        tcp.DefaultListenOptions(),
+		NoDelay:              true,
+		MaxBans:              DefaultMaxBans,
+		MaxTags:              DefaultMaxTags,
+		MaxBatchSize:         DefaultMaxBatchSize,
+		AutoScore:            true,
+		GoodbyeTimeout:       DefaultGoodbyeTimeout,
+		MaxMetadataSize:      DefaultMaxMetadataSize,
+		MaxHandshakeMsgSize:  handshake.DefaultMaxMessageSize,
+		StatsWindow:          DefaultStatsWindow,
+		MismatchTTL:          DefaultMismatchTTL,
+
+		AddressQualityHalfLife: DefaultAddressQualityHalfLife,
+		MaxAddressQualities:    DefaultMaxAddressQualities,
 	}
 }
 
@@ -84,6 +174,24 @@ func (opts Options) WithPort(port uint16) Options {
 	return opts
 }
 
+// WithAnnounceAddress sets the host and port ("host:port") that remote peers
+// must use to reach the Transport, when it differs from the host and port on
+// which the Transport listens (for example, behind a NAT with port forwarding,
+// or a load balancer). It is announced to remote peers by peer discovery,
+// instead of the listen addresses, but it is never listened on. By default,
+// the address is empty, and remote peers use the address from which the
+// Transport connects to them. The address can be changed at runtime using
+// SetAnnounceAddress.
+func (opts Options) WithAnnounceAddress(addr string) Options {
+	opts.AnnounceAddress = addr
+	return opts
+}
+
+func (opts Options) WithDialTimeout(timeout policy.Timeout) Options {
+	opts.DialTimeout = timeout
+	return opts
+}
+
 func (opts Options) WithClientTimeout(timeout time.Duration) Options {
 	opts.ClientTimeout = timeout
 	return opts
@@ -104,39 +212,643 @@ func (opts Options) WithExpiry(minimumDuration time.Duration) Options {
 	return opts
 }
 
+// WithNetworkKey sets the pre-shared key that identifies the network to which
+// the Transport belongs. Connections with peers that do not know the same key
+// are closed during the handshake. By default, the key is empty and peers from
+// any network are accepted.
+func (opts Options) WithNetworkKey(key []byte) Options {
+	opts.NetworkKey = key
+	return opts
+}
+
+// WithRand sets the source of randomness used by the handshakes that are added
+// by the Transport (such as the network handshake). The Handshake that is
+// passed to New must be given its own source of randomness (for example, using
+// handshake.ECIESWithRand). By default, the source is nil, and crypto/rand is
+// used. A predictable source weakens the handshake, so the source must meet
+// the same requirements as the one given to handshake.ECIESWithRand.
+func (opts Options) WithRand(random io.Reader) Options {
+	opts.Rand = random
+	return opts
+}
+
+// WithLengthPrefixOptions sets the size and byte order of the length prefix
+// that frames all messages sent over a connection. All peers in the network must
+// use the same options.
+func (opts Options) WithLengthPrefixOptions(lengthPrefixOpts codec.LengthPrefixOptions) Options {
+	opts.LengthPrefixOptions = lengthPrefixOpts
+	return opts
+}
+
+// WithDialOptions sets the options used to customise the sockets of outbound
+// connections. For example, tcp.Mark can be used to set the fwmark of all
+// outbound connections on Linux, and tcp.DialOptions.WithDial can be used to
+// dial through a proxy, wrap connections in TLS, or return in-memory
+// connections for tests.
+func (opts Options) WithDialOptions(dialOpts tcp.DialOptions) Options {
+	opts.DialOptions = dialOpts
+	return opts
+}
+
+// WithListenOptions sets the options used to bound the number of goroutines
+// that handle inbound connections. By default, every inbound connection is
+// handled in its own goroutine.
+func (opts Options) WithListenOptions(listenOpts tcp.ListenOptions) Options {
+	opts.ListenOptions = listenOpts
+	return opts
+}
+
+// WithListen sets the function used to create the listener for inbound
+// connections, instead of a TCP listener. For example, it can return a TLS
+// listener, or an in-memory listener for tests. The function is called with
+// the host and port of the Transport, and the listener that it returns is
+// closed when the Transport stops running. Accepted connections are still
+// handshaked and attached like any other. By default, it is nil, and a TCP
+// listener is used.
+func (opts Options) WithListen(listen func(ctx context.Context, addr string) (net.Listener, error)) Options {
+	opts.Listen = listen
+	return opts
+}
+
+// WithListenAddresses sets additional addresses, in the form "host:port", on
+// which to listen for inbound connections. For example, a node with several
+// network interfaces can listen on all of them to distribute its inbound
+// connections. Connections are accepted on all addresses uniformly, and
+// counted per address (see Stats). All addresses are advertised by peer
+// discovery, and each remote peer dials one of them, in proportion to their
+// weights (see WithListenWeights). Peers that expect only one port reject the
+// pings of a Transport with additional listen addresses. By default, the
+// Transport only listens on its host and port.
+func (opts Options) WithListenAddresses(addrs ...string) Options {
+	opts.ListenAddresses = addrs
+	return opts
+}
+
+// WithListenWeights sets the weights of the listen addresses, keyed by the
+// addresses returned by Transport.ListenAddresses. Remote peers that learn the
+// listen addresses from peer discovery dial each address in proportion to its
+// weight, so that inbound connections can be shifted towards the network
+// interfaces with the most capacity. A weight of zero means that the address
+// is still listened on, but not advertised. Addresses without a weight have
+// the DefaultListenWeight.
+func (opts Options) WithListenWeights(weights map[string]int) Options {
+	opts.ListenWeights = weights
+	return opts
+}
+
+// WithAllow sets the Allow function that filters inbound connections before
+// the handshake. For example, policy.GlobalRate can be used to bound the rate
+// at which handshakes are started. By default, all inbound connections are
+// allowed.
+func (opts Options) WithAllow(allow policy.Allow) Options {
+	opts.Allow = allow
+	return opts
+}
+
+// WithNoDelay sets whether or not Nagle's algorithm is disabled for inbound
+// and outbound connections. By default, it is disabled (which is the default
+// for all TCP connections in Go). This overrides the NoDelay setting of the
+// DialOptions.
+func (opts Options) WithNoDelay(noDelay bool) Options {
+	opts.NoDelay = noDelay
+	return opts
+}
+
+// WithMaxTags sets the maximum number of tags that can be attached to the
+// connection with one remote peer (see TagConnection).
+func (opts Options) WithMaxTags(maxTags int) Options {
+	opts.MaxTags = maxTags
+	return opts
+}
+
+// WithMaxBatchSize sets the maximum size, in bytes, of the messages in a batch,
+// after they have been packed into a single frame (see SendBatch). It must not
+// be larger than the maximum message size of remote peers, or they will not
+// read the batch. Zero means that the size of batches is not limited.
+func (opts Options) WithMaxBatchSize(maxBatchSize int) Options {
+	opts.MaxBatchSize = maxBatchSize
+	return opts
+}
+
+// WithAutoScore sets whether or not the Transport records the outcome of
+// establishing connections with remote peers in the Table, if the Table is a
+// dht.Scorer. Successful outbound dials, and inbound connections, are recorded
+// as successes, and failed dials, and failed outbound handshakes, are recorded
+// as failures. Applications that want full control over the scores of peers
+// can disable it. By default, it is enabled.
+func (opts Options) WithAutoScore(autoScore bool) Options {
+	opts.AutoScore = autoScore
+	return opts
+}
+
+// WithAddressDistance sets the function used to estimate how far away the IP
+// address of a remote peer is (for example, using a GeoIP database), so that
+// nearer remote peers, and addresses, can be preferred. It does not replace
+// the preference for addresses that have been reliable to dial: addresses are
+// only ordered by distance when they have similar Scores (see
+// AddressQualities), and the nearest of them is dialed. Remote peers can be
+// ordered by distance using NearestPeers, which is also used when the peer
+// package selects remote peers. By default, there is no distance function.
+func (opts Options) WithAddressDistance(distance AddressDistance) Options {
+	opts.AddressDistance = distance
+	return opts
+}
+
+// WithMaxBans sets the maximum number of remote peers that can be banned at the
+// same time. When the maximum is reached, banning another remote peer removes
+// the ban that expires soonest.
+func (opts Options) WithMaxBans(maxBans int) Options {
+	opts.MaxBans = maxBans
+	return opts
+}
+
+// WithBanDrainTimeout sets the maximum duration spent draining the connection
+// with a remote peer when it is banned. If the timeout is more than zero, then
+// banning a connected remote peer writes all messages that have already been
+// sent to it, says goodbye with the banned reason, and then closes the
+// connection. The connection is forcibly closed if this takes longer than the
+// timeout. By default, the timeout is zero, and existing connections are not
+// closed when a remote peer is banned.
+func (opts Options) WithBanDrainTimeout(timeout time.Duration) Options {
+	opts.BanDrainTimeout = timeout
+	return opts
+}
+
+// WithBannedBackoff sets the duration for which a remote peer is not dialed
+// after it says goodbye with the banned reason, so that the local peer does not
+// keep re-dialing a remote peer that has banned it. Connections accepted from
+// the remote peer are not affected. By default, the duration is zero, and the
+// remote peer is dialed again immediately. At most MaxBans remote peers are
+// backed off from at the same time.
+func (opts Options) WithBannedBackoff(d time.Duration) Options {
+	opts.BannedBackoff = d
+	return opts
+}
+
+// WithSendGoodbye sets whether or not the Transport says goodbye to remote
+// peers before deliberately closing their connections: when the Transport is
+// shutting down, and when a banned remote peer connects. By default, goodbyes
+// are not sent, and remote peers only see the connection being closed.
+func (opts Options) WithSendGoodbye(sendGoodbye bool) Options {
+	opts.SendGoodbye = sendGoodbye
+	return opts
+}
+
+// WithGoodbyeTimeout sets the maximum amount of time spent writing a goodbye
+// to a remote peer. The connection is closed after the timeout, even if the
+// goodbye was not written.
+func (opts Options) WithGoodbyeTimeout(timeout time.Duration) Options {
+	opts.GoodbyeTimeout = timeout
+	return opts
+}
+
+// WithInboundFilter sets a function that inspects every message received from
+// a remote peer before it is delivered to receivers and subscribers. If the
+// function returns an error, then the message is dropped and counted in the
+// Stats. It is called synchronously, once per message, and must not block.
+// This overrides any InboundFilter previously set on the Channel Client.
+func (opts Options) WithInboundFilter(filter channel.InboundFilter) Options {
+	opts.InboundFilter = filter
+	return opts
+}
+
+// WithInboundFilterBan sets the duration for which a remote peer is banned
+// when the InboundFilter drops one of its messages. By default, the duration is
+// zero and remote peers are not banned.
+func (opts Options) WithInboundFilterBan(d time.Duration) Options {
+	opts.InboundFilterBan = d
+	return opts
+}
+
+// WithCompressions sets the Compressions that are supported by the local peer.
+// When this is not nil, the Compression used by each connection is negotiated
+// during the handshake, falling back to no compression when the remote peer
+// does not support any of the same Compressions. All peers in the network must
+// agree on whether or not to negotiate, so an empty (but not nil) slice should
+// be used by peers that negotiate without supporting any compression. By
+// default, the slice is nil and nothing is negotiated.
+func (opts Options) WithCompressions(compressions []codec.Compression) Options {
+	opts.Compressions = compressions
+	return opts
+}
+
+// WithNegotiateVersion sets whether or not the message version used by each
+// connection is negotiated during the handshake (see Session.Version). Chunked
+// messages, and batches, are only written as such to remote peers that
+// understand wire.MsgVersion5. Otherwise, chunked messages are written with
+// their Data in the message, and the messages of a batch are written one at a
+// time. All peers in the network must agree on whether or not to negotiate. By
+// default, nothing is negotiated, and remote peers are assumed to only
+// understand wire.MsgVersion4.
+func (opts Options) WithNegotiateVersion(negotiate bool) Options {
+	opts.NegotiateVersion = negotiate
+	return opts
+}
+
+// WithCompressionOptions sets the options that decide which messages are
+// compressed when a connection has negotiated compression (see
+// WithCompressions). Messages can override the threshold using
+// wire.Msg.WithCompression. By default, all messages are compressed if it
+// makes them smaller.
+func (opts Options) WithCompressionOptions(compressionOpts codec.CompressionOptions) Options {
+	opts.CompressionOptions = compressionOpts
+	return opts
+}
+
+// WithListenErrorInterval sets the interval over which identical errors from
+// the listener are coalesced into a single log entry. By default, the interval
+// is zero and every error is logged.
+func (opts Options) WithListenErrorInterval(interval time.Duration) Options {
+	opts.ListenErrorInterval = interval
+	return opts
+}
+
+// WithKeepConnectedBackoff sets the Timeout used to wait between consecutive
+// attempts to re-dial peers that must be kept connected. The attempt is reset
+// to zero whenever the peer is found to be connected.
+func (opts Options) WithKeepConnectedBackoff(backoff policy.Timeout) Options {
+	opts.KeepConnectedBackoff = backoff
+	return opts
+}
+
+// WithPruneSelf enables the deletion of peers from the table when dialing
+// their network address results in a connection to the local peer. By
+// default, such peers are kept in the table.
+func (opts Options) WithPruneSelf(pruneSelf bool) Options {
+	opts.PruneSelf = pruneSelf
+	return opts
+}
+
+// WithClock sets the Clock used for all time-based behaviour in the Transport.
+func (opts Options) WithClock(clock clock.Clock) Options {
+	opts.Clock = clock
+	return opts
+}
+
+// WithOnConnected sets a function that is called whenever a connection with a
+// remote peer has been authorized, before any messages are read from (or
+// written to) the connection. This allows applications to associate the new
+// connection with state that was kept from a previous connection to the same
+// remote peer. It is called synchronously, and must not block. Use
+// WithOnOpened to also be given the ConnID of the connection, so that it can be
+// matched with its traces, spans, and logs.
+func (opts Options) WithOnConnected(onConnected func(remote id.Signatory, addr string)) Options {
+	opts.OnConnected = onConnected
+	return opts
+}
+
+// WithOnOpened sets a function that is called whenever a connection with a
+// remote peer has been authorized, after the OnConnected function. The
+// function is given the Session of the connection, which carries its ConnID,
+// its Direction, and the parameters that were negotiated during the
+// handshake. It is called synchronously, and must not block.
+func (opts Options) WithOnOpened(onOpened func(session Session)) Options {
+	opts.OnOpened = onOpened
+	return opts
+}
+
+// WithOnReplaced sets a function that is called whenever the connection with a
+// remote peer is closed because a newer connection to the same remote peer
+// has been established. The function is given the network address of the
+// connection being replaced. It is called synchronously, and must not block.
+func (opts Options) WithOnReplaced(onReplaced func(remote id.Signatory, addr string)) Options {
+	opts.OnReplaced = onReplaced
+	return opts
+}
+
+// WithOnDisconnected sets a function that is called whenever a remote peer
+// says goodbye before deliberately closing its connection. The DisconnectEvent
+// declares the reason, which allows applications to decide whether or not the
+// remote peer should be re-dialed. It is called synchronously, and must not
+// block. Goodbyes are received by subscribing to the Channel Client, so inbound
+// messages are delivered (and dropped, if there are no other receivers) even
+// when the application has not called Receive.
+func (opts Options) WithOnDisconnected(onDisconnected func(event DisconnectEvent)) Options {
+	opts.OnDisconnected = onDisconnected
+	return opts
+}
+
+// WithOnClosed sets a function that is called whenever the last connection
+// with a remote peer is closed, whether or not the remote peer said goodbye.
+// The function is given the Session of the most recent connection, and the
+// time at which it was closed, so that Closed.Sub(session.Established) is the
+// lifetime of the connection. Both times are read from the Clock, so the
+// lifetime is measured using the monotonic clock when the Clock is real. It is
+// called synchronously, and must not block.
+func (opts Options) WithOnClosed(onClosed func(session Session, closed time.Time)) Options {
+	opts.OnClosed = onClosed
+	return opts
+}
+
+// WithMetadata sets the opaque application metadata that is sent to remote
+// peers during the handshake. The metadata must be no larger than the
+// MaxMetadataSize. Metadata is only exchanged when this, or the OnMetadata
+// function, is set, and all peers in the network must agree on whether or not
+// to exchange it.
+func (opts Options) WithMetadata(metadata []byte) Options {
+	opts.Metadata = metadata
+	return opts
+}
+
+// WithMaxMetadataSize sets the maximum size, in bytes, of the application
+// metadata that remote peers can send during the handshake. Handshakes with
+// remote peers that declare larger metadata fail before the metadata is read.
+func (opts Options) WithMaxMetadataSize(size int) Options {
+	opts.MaxMetadataSize = size
+	return opts
+}
+
+// WithMaxHandshakeMsgSize sets the maximum size, in bytes, of any one message
+// decoded during the handshake, including the overhead added by encryption.
+// Handshakes with remote peers that send larger messages fail before the
+// message is read, which bounds the memory that unauthenticated peers can
+// cause to be allocated. It must leave room for the MaxMetadataSize when
+// metadata is exchanged. By default, it is handshake.DefaultMaxMessageSize.
+func (opts Options) WithMaxHandshakeMsgSize(size int) Options {
+	opts.MaxHandshakeMsgSize = size
+	return opts
+}
+
+// WithRotation enables long-term key rotation during the handshake, and sets
+// the previous private keys of the local peer (if it has rotated). Remote
+// peers that rotate are aliased from their previous signatory to their current
+// signatory in the table, and sending to, or dialing, a previous signatory
+// reaches the current one. All peers in the network must agree on whether or
+// not rotation is enabled, even if they have no previous keys. At most
+// handshake.MaxPreviousKeys previous keys can be set.
+//
+// To rotate the key of a peer:
+//
+//  1. Enable rotation on all peers in the network, using WithRotation with no
+//     previous keys.
+//  2. Restart the peer with its new key, and with its old key as a previous
+//     key, using WithRotation(oldPrivKey). It now presents its new signatory,
+//     and proves that it holds the old key.
+//  3. Remote peers that still know the old signatory dial it, learn the new
+//     signatory during the handshake, and alias the old signatory to the new
+//     one in their table.
+//  4. Once remote peers have had the chance to connect (for example, after
+//     the expiry of peers in their table), restart the peer without its old
+//     key. Remote peers that have not learned the new signatory by then will
+//     fail to connect to it, and must learn it through peer discovery.
+func (opts Options) WithRotation(previous ...*id.PrivKey) Options {
+	opts.Rotation = true
+	opts.PreviousKeys = previous
+	return opts
+}
+
+// WithExportKeys sets whether or not an Exporter is made available for each
+// connection (see Session.Exporter), so that applications can derive keys that
+// are bound to the session of the connection. The Handshake given to the
+// Transport must establish a session (for example, an ECIES Handshake), or
+// every handshake fails with handshake.ErrNoExporter. By default, keys are not
+// exported.
+func (opts Options) WithExportKeys(enabled bool) Options {
+	opts.ExportKeys = enabled
+	return opts
+}
+
+// WithMaxConns sets the maximum number of remote peers that the Transport can
+// be connected to at the same time. Once the Transport is at capacity, new
+// remote peers are not dialed, and inbound connections from new remote peers
+// are closed after the handshake (unless the CapacityPolicy makes room for
+// them), but connections to remote peers that are already connected are
+// unaffected. Concurrent connections can briefly exceed the maximum, so it
+// must be treated as a soft limit. By default, it is zero, and the number of
+// connections is unlimited.
+func (opts Options) WithMaxConns(maxConns int) Options {
+	opts.MaxConns = maxConns
+	return opts
+}
+
+// WithCapacityPolicy sets the CapacityPolicy that decides what happens to
+// inbound connections from new remote peers while the Transport is at
+// capacity. By default, it is CapacityRejectNew.
+func (opts Options) WithCapacityPolicy(policy CapacityPolicy) Options {
+	opts.CapacityPolicy = policy
+	return opts
+}
+
+// WithOnMetadata sets a function that is called with the application metadata
+// of every remote peer, during the handshake. If the function returns an
+// error, then the handshake fails and the connection is closed, which allows
+// applications to reject incompatible remote peers. It is called
+// synchronously, and must not block.
+func (opts Options) WithOnMetadata(onMetadata func(remote id.Signatory, metadata []byte) error) Options {
+	opts.OnMetadata = onMetadata
+	return opts
+}
+
+// WithTracer sets the Tracer that is called at every stage of connection
+// establishment. By default, there is no Tracer and tracing is disabled.
+func (opts Options) WithTracer(tracer Tracer) Options {
+	opts.Tracer = tracer
+	return opts
+}
+
+// WithSpanStarter sets the SpanStarter that is used to start tracing spans
+// when sending, dialing, and handshaking. By default, there is no SpanStarter
+// and no spans are started.
+func (opts Options) WithSpanStarter(spanStarter SpanStarter) Options {
+	opts.SpanStarter = spanStarter
+	return opts
+}
+
+// WithAddressResolver sets a function that is called when sending to, or
+// probing, a remote peer that has no network address in the table (for
+// example, a function that queries the network for the remote peer). The
+// resolved network address is added to the table, so the function is not
+// called again while the remote peer is in the table. If the function returns
+// an error, then the remote peer is unknown. By default, there is no resolver,
+// and remote peers without a network address are immediately unknown.
+func (opts Options) WithAddressResolver(resolver func(ctx context.Context, remote id.Signatory) (wire.Address, error)) Options {
+	opts.AddressResolver = resolver
+	return opts
+}
+
 type Transport struct {
 	opts Options
 
-	self   id.Signatory
-	client *channel.Client
-	once   handshake.Handshake
+	self         id.Signatory
+	client       *channel.Client
+	newHandshake func(state *handshakeState) handshake.Handshake
+	oncePool     *handshake.OncePool
 
 	linksMu *sync.RWMutex
 	links   map[id.Signatory]bool
 
-	connsMu *sync.RWMutex
-	conns   map[id.Signatory]int64
+	connsMu  *sync.RWMutex
+	conns    map[id.Signatory]int64
+	dirs     map[id.Signatory]Direction
+	sessions map[id.Signatory]Session
+	tags     map[id.Signatory][]string
+	// numConns is the number of remote peers in conns, and can be read
+	// without acquiring the connsMu.
+	numConns *int64
+	// keepAlivePeriod is the keepalive period computed by the
+	// KeepAliveScaler, in nanoseconds.
+	keepAlivePeriod *int64
+
+	dialsMu *sync.Mutex
+	dials   map[id.Signatory]*dialState
+
+	compressionsMu *sync.RWMutex
+	compressions   map[id.Signatory]codec.Compression
+
+	peerOptsMu *sync.RWMutex
+	peerOpts   map[id.Signatory]PeerOptions
+	reapersMu  *sync.Mutex
+	reapers    map[id.Signatory]map[*reaper]struct{}
 
 	table dht.Table
+
+	connIDs *uint64
+
+	keepMu  *sync.Mutex
+	keep    map[id.Signatory]context.CancelFunc
+	keepCtx context.Context
+
+	subsMu  *sync.Mutex
+	subs    map[uint64]context.CancelFunc
+	nextSub uint64
+
+	bansMu   *sync.Mutex
+	bans     map[id.Signatory]time.Time
+	backoffs map[id.Signatory]time.Time
+
+	mismatchesMu *sync.Mutex
+	mismatches   map[id.Signatory]identityMismatch
+
+	started        time.Time
+	handshakeStats handshakeStats
+	addrQualities  addressQualities
+	scorer         dht.Scorer
+	filtered       *uint64
+	listeners      []listener
+
+	announceMu *sync.RWMutex
+	announce   string
 }
 
+// New returns a Transport for the local peer. New does not call
+// Options.Validate, and never fails: invalid Options are used as they are, and
+// fail (or misbehave) at runtime. Use NewValidated, or call Options.Validate
+// before calling New, to catch misconfiguration early.
 func New(opts Options, self id.Signatory, client *channel.Client, h handshake.Handshake, table dht.Table) *Transport {
-	oncePool := handshake.NewOncePool(opts.OncePoolOptions)
-	return &Transport{
+	oncePoolOpts := opts.OncePoolOptions
+	if opts.OnReplaced != nil {
+		onReplace := oncePoolOpts.OnReplace
+		oncePoolOpts.OnReplace = func(remote id.Signatory, addr string) {
+			if onReplace != nil {
+				onReplace(remote, addr)
+			}
+			opts.OnReplaced(remote, addr)
+		}
+	}
+	oncePool := handshake.NewOncePool(oncePoolOpts)
+	t := &Transport{
 		opts: opts,
 
-		self:   self,
-		client: client,
-		once:   handshake.Once(self, &oncePool, h),
+		self:     self,
+		client:   client,
+		oncePool: &oncePool,
 
 		linksMu: new(sync.RWMutex),
 		links:   map[id.Signatory]bool{},
 
-		connsMu: new(sync.RWMutex),
-		conns:   map[id.Signatory]int64{},
+		connsMu:  new(sync.RWMutex),
+		conns:    map[id.Signatory]int64{},
+		dirs:     map[id.Signatory]Direction{},
+		sessions: map[id.Signatory]Session{},
+		tags:     map[id.Signatory][]string{},
+
+		numConns:        new(int64),
+		keepAlivePeriod: new(int64),
+
+		dialsMu: new(sync.Mutex),
+		dials:   map[id.Signatory]*dialState{},
+
+		compressionsMu: new(sync.RWMutex),
+		compressions:   map[id.Signatory]codec.Compression{},
+
+		peerOptsMu: new(sync.RWMutex),
+		peerOpts:   map[id.Signatory]PeerOptions{},
+		reapersMu:  new(sync.Mutex),
+		reapers:    map[id.Signatory]map[*reaper]struct{}{},
 
 		table: table,
+
+		connIDs: new(uint64),
+
+		keepMu: new(sync.Mutex),
+		keep:   map[id.Signatory]context.CancelFunc{},
+
+		subsMu: new(sync.Mutex),
+		subs:   map[uint64]context.CancelFunc{},
+
+		bansMu:   new(sync.Mutex),
+		bans:     map[id.Signatory]time.Time{},
+		backoffs: map[id.Signatory]time.Time{},
+
+		mismatchesMu: new(sync.Mutex),
+		mismatches:   map[id.Signatory]identityMismatch{},
+
+		started:        opts.Clock.Now(),
+		handshakeStats: newHandshakeStats(opts.Clock.Now(), opts.StatsWindow),
+		addrQualities:  newAddressQualities(opts.AddressQualityHalfLife, opts.MaxAddressQualities, inTable(table)),
+		filtered:       new(uint64),
+		listeners:      newListeners(opts),
+
+		announceMu: new(sync.RWMutex),
+		announce:   opts.AnnounceAddress,
+	}
+	if scorer, ok := table.(dht.Scorer); ok && opts.AutoScore {
+		t.scorer = scorer
+	}
+	// The declared size of the remote metadata is checked against the limit of
+	// handshake messages before the metadata is allocated, even if the Options
+	// have not been validated.
+	maxMetadataSize := opts.MaxMetadataSize
+	if limit := opts.MaxHandshakeMsgSize - handshake.MaxMessageOverhead; maxMetadataSize > limit {
+		maxMetadataSize = limit
+	}
+	t.newHandshake = func(state *handshakeState) handshake.Handshake {
+		h := h
+		if opts.Rotation {
+			h = handshake.Rotate(self, opts.PreviousKeys, t.rotated, h)
+		}
+		if opts.Metadata != nil || opts.OnMetadata != nil {
+			h = handshake.Metadata(opts.Metadata, maxMetadataSize, t.receivedMetadata(state), h)
+		}
+		if opts.Compressions != nil {
+			h = handshake.CompressWithOptions(opts.Compressions, opts.CompressionOptions, t.negotiated, h)
+		}
+		if opts.NegotiateVersion {
+			h = handshake.Version(wire.MsgVersionLatest, negotiatedVersion(state), h)
+		}
+		h = handshake.Limit(opts.MaxHandshakeMsgSize, handshake.OnceWithFilter(self, &oncePool, t.rejectBanned, handshake.NetworkWithRand(opts.NetworkKey, opts.Rand, h)))
+		if opts.ExportKeys {
+			// The Exporter is only added to the Session once the
+			// connection has been authorized.
+			h = handshake.Export(exported(state), h)
+		}
+		return h
+	}
+	if opts.InboundFilter != nil {
+		client.SetInboundFilter(t.filterInbound)
 	}
+	t.rescaleKeepAlive()
+	return t
+}
+
+// NewValidated validates the Options, and returns a Transport for the local
+// peer. If the Options are invalid, then an error wrapping ErrInvalidOptions is
+// returned, and no Transport is built.
+func NewValidated(opts Options, self id.Signatory, client *channel.Client, h handshake.Handshake, table dht.Table) (*Transport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return New(opts, self, client, h, table), nil
 }
 
 func (t *Transport) Table() dht.Table {
@@ -156,35 +868,126 @@ func (t *Transport) Port() uint16 {
 }
 
 func (t *Transport) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
-	remoteAddr, ok := t.table.PeerAddress(remote)
-	if !ok {
-		return fmt.Errorf("peer not found: %v", remote)
+	ctx, finish := t.startSpan(ctx, SpanSend)
+	defer finish()
+
+	remote = t.resolve(remote)
+	remoteAddr, err := t.peerAddress(ctx, remote)
+	if err != nil {
+		return &SendError{Kind: SendErrorUnknownPeer, Remote: remote, Err: err}
+	}
+	if t.IsBanned(remote) {
+		return &SendError{Kind: SendErrorBanned, Remote: remote, Err: ErrBanned}
 	}
 
 	if t.IsConnected(remote) {
 		t.opts.Logger.Debug("send", zap.Bool("connected", true), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-		return t.client.Send(ctx, remote, msg)
+		return t.send(ctx, remote, msg)
+	}
+	if err := t.mismatch(remote, remoteAddr); err != nil {
+		return &SendError{Kind: SendErrorIdentityMismatch, Remote: remote, Err: err}
+	}
+	if t.AtCapacity() {
+		return &SendError{Kind: SendErrorAtCapacity, Remote: remote, Err: ErrAtCapacity}
+	}
+	if budgetFromContext(ctx).skip(t.opts.Clock.Now(), remote) {
+		return &SendError{Kind: SendErrorBudgetExhausted, Remote: remote, Err: ErrBudgetExhausted}
 	}
 
 	if t.IsLinked(remote) {
 		t.opts.Logger.Debug("send", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-		go t.dial(ctx, remote, remoteAddr)
-		return t.client.Send(ctx, remote, msg)
+		go t.dialOnce(ctx, remote, remoteAddr)
+		return t.send(ctx, remote, msg)
 	}
 
 	t.opts.Logger.Debug("send", zap.Bool("linked", false), zap.Bool("connected", false), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
 	t.client.Bind(remote)
 	go func() {
 		defer t.client.Unbind(remote)
-		t.dial(ctx, remote, remoteAddr)
+		t.dialOnce(ctx, remote, remoteAddr)
 	}()
-	return t.client.Send(ctx, remote, msg)
+	return t.send(ctx, remote, msg)
+}
+
+// peerAddress returns the network address of the remote peer from the table.
+// If there is none, then the network address is resolved using the
+// AddressResolver of the Options (if there is one), and added to the table.
+func (t *Transport) peerAddress(ctx context.Context, remote id.Signatory) (wire.Address, error) {
+	current := t.current(remote)
+	if remoteAddr, ok := t.table.PeerAddress(current); ok {
+		return remoteAddr, nil
+	}
+	if t.opts.AddressResolver == nil {
+		return wire.Address{}, fmt.Errorf("peer not found: %v", remote)
+	}
+	remoteAddr, err := t.opts.AddressResolver(ctx, current)
+	if err != nil {
+		return wire.Address{}, fmt.Errorf("peer not found: %v: resolving address: %w", remote, err)
+	}
+	t.opts.Logger.Debug("resolved", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
+	t.table.AddPeer(current, remoteAddr)
+	return remoteAddr, nil
+}
+
+// send a message to the channel of the remote peer, and classify any error
+// that happens.
+func (t *Transport) send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	if err := t.client.Send(ctx, remote, msg); err != nil {
+		return newSendError(remote, err)
+	}
+	return nil
 }
 
 func (t *Transport) Receive(ctx context.Context, receiver func(id.Signatory, wire.Packet) error) {
 	t.client.Receive(ctx, receiver)
 }
 
+// Subscribe to messages received by the Transport that match the Match
+// function. The returned channel is closed when the context is done, or when
+// Run returns. See channel.Client.Subscribe for more details.
+func (t *Transport) Subscribe(ctx context.Context, match channel.Match, bufferSize int) <-chan channel.Msg {
+	return t.client.Subscribe(t.subscription(ctx), match, bufferSize)
+}
+
+// SubscribeBatch to messages received by the Transport that match the Match
+// function, and receive them in batches. The returned channel is closed when
+// the context is done, or when Run returns. See channel.Client.SubscribeBatch
+// for more details.
+func (t *Transport) SubscribeBatch(ctx context.Context, match channel.Match, batchSize int, flushInterval time.Duration) <-chan []channel.Msg {
+	return t.client.SubscribeBatch(t.subscription(ctx), match, batchSize, flushInterval)
+}
+
+// subscription returns a context for a subscription that is cancelled when
+// the context is done, or when Run returns.
+func (t *Transport) subscription(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.subsMu.Lock()
+	key := t.nextSub
+	t.nextSub++
+	t.subs[key] = cancel
+	t.subsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.subsMu.Lock()
+		delete(t.subs, key)
+		t.subsMu.Unlock()
+	}()
+	return ctx
+}
+
+// unsubscribeAll cancels all subscriptions, which closes their channels.
+func (t *Transport) unsubscribeAll() {
+	t.subsMu.Lock()
+	defer t.subsMu.Unlock()
+
+	for key, cancel := range t.subs {
+		cancel()
+		delete(t.subs, key)
+	}
+}
+
 func (t *Transport) Link(remote id.Signatory) {
 	t.linksMu.Lock()
 	defer t.linksMu.Unlock()
@@ -220,10 +1023,32 @@ func (t *Transport) IsConnected(remote id.Signatory) bool {
 	return t.conns[remote] > 0
 }
 
+// Direction returns the Direction of the most recently established connection
+// with the remote peer. False is returned if there is no connection with the
+// remote peer.
+func (t *Transport) Direction(remote id.Signatory) (Direction, bool) {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	dir, ok := t.dirs[remote]
+	return dir, ok
+}
+
+// Run the Transport until the context is done. Shutdown is only signalled by
+// the context: none of the channels used to pass messages between the
+// Transport, its Channel Client, and its Channels are ever closed (only the
+// channels returned by Subscribe and SubscribeBatch are closed, once Run
+// returns). This means that messages sent concurrently with shutdown (or after
+// it) never cause a send on a closed channel; instead, Send blocks until the
+// context of the message is done, and returns an error.
 func (t *Transport) Run(ctx context.Context) {
+	defer t.unsubscribeAll()
+	t.receiveGoodbyes(ctx)
+	defer t.runKeepConnected(ctx)()
 	for {
 		select {
 		case <-ctx.Done():
+			t.goodbyeAll(wire.GoodbyeShutdown)
 			return
 		default:
 			t.run(ctx)
@@ -238,157 +1063,451 @@ func (t *Transport) run(ctx context.Context) {
 		}
 	}()
 
+	handleListenErr := func(err error) {
+		if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
+			t.opts.Logger.Error("listen", zap.Error(err))
+		}
+	}
+	if t.opts.ListenErrorInterval > 0 {
+		handleListenErr = tcp.CoalesceErrors(t.opts.Clock, t.opts.ListenErrorInterval, handleListenErr)
+	}
+
 	// Listen for incoming connection attempts.
-	t.opts.Logger.Info("listening", zap.String("host", t.opts.Host), zap.Uint16("port", t.opts.Port))
-	err := tcp.Listen(
-		ctx,
-		fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port),
-		func(conn net.Conn) {
-			addr := conn.RemoteAddr().String()
-			enc, dec, remote, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
-			if err != nil {
-				var e wire.NegligibleError
-				if !errors.As(err, &e) {
-					t.opts.Logger.Error("handshake", zap.String("addr", addr), zap.Error(err))
+	t.opts.Logger.Info("listening", zap.String("host", t.opts.Host), zap.Uint16("port", t.opts.Port), zap.Strings("addrs", t.opts.ListenAddresses))
+	handle := func(conn net.Conn) {
+		addr := conn.RemoteAddr().String()
+		connID := t.nextConnID()
+		t.trace(connID, DirectionInbound, TraceConnected, id.Signatory{}, addr, nil)
+		if err := tcp.SetNoDelay(conn, t.opts.NoDelay); err != nil {
+			t.opts.Logger.Debug("accepted", zap.String("conn", connID.String()), zap.String("addr", addr), zap.Error(err))
+		}
+		defer t.trace(connID, DirectionInbound, TraceClosed, id.Signatory{}, addr, nil)
+
+		t.trace(connID, DirectionInbound, TraceHandshakeStart, id.Signatory{}, addr, nil)
+		_, finishHandshake := t.startSpan(WithConnID(ctx, connID), SpanHandshake)
+		enc, dec, remote, state, err := t.handshake(conn)
+		finishHandshake()
+		// The connection is removed from the OncePool once it is closed, so
+		// that the remote peer can reconnect.
+		defer t.oncePool.Remove(remote, conn)
+		t.trace(connID, DirectionInbound, TraceHandshakeDone, remote, addr, err)
+		t.recordHandshake(err)
+		if errors.Is(err, ErrBanned) {
+			t.opts.Logger.Debug("handshake", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+			t.trace(connID, DirectionInbound, TraceAuthorized, remote, addr, err)
+			t.writeGoodbye(conn, enc, wire.GoodbyeBanned)
+			return
+		}
+		if err != nil {
+			var e wire.NegligibleError
+			if !errors.As(err, &e) {
+				t.opts.Logger.Error("handshake", zap.String("conn", connID.String()), zap.String("addr", addr), zap.Stringer("kind", handshake.Classify(err)), zap.Error(err))
+			}
+			return
+		}
+		if remote.Equal(&t.self) {
+			t.opts.Logger.Debug("handshake", zap.String("conn", connID.String()), zap.String("addr", addr), zap.Error(ErrSelfConnection))
+			t.trace(connID, DirectionInbound, TraceAuthorized, remote, addr, ErrSelfConnection)
+			return
+		}
+		_, known := t.table.PeerAddress(remote)
+		if err := t.admit(remote, known); err != nil {
+			t.opts.Logger.Debug("handshake", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Bool("known", known), zap.Error(err))
+			t.trace(connID, DirectionInbound, TraceAuthorized, remote, addr, err)
+			return
+		}
+		t.matched(remote)
+		t.trace(connID, DirectionInbound, TraceAuthorized, remote, addr, nil)
+		t.table.Touch(remote)
+		t.score(remote, false)
+		session := t.connected(connID, remote, addr, DirectionInbound, state)
+
+		enc = codec.LengthPrefixEncoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainEncoder, enc)
+		dec = codec.LengthPrefixDecoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainDecoder, dec)
+
+		// If the Transport is linked to the remote peer, then the
+		// network connection should be kept alive until the remote peer
+		// is unlinked (or the network connection faults).
+		if t.IsLinked(remote) {
+			t.opts.Logger.Debug("accepted", zap.String("conn", connID.String()), zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+			defer t.opts.Logger.Debug("accepted: drop", zap.String("conn", connID.String()), zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+
+			// Attaching a connection will block until the Channel is
+			// unbound (which happens when the Transport is unlinked), the
+			// connection is replaced, or the connection faults.
+			t.connect(session, conn)
+			defer t.disconnect(remote)
+			if err := t.client.AttachWithVersion(ctx, remote, conn, enc, dec, session.Version); err != nil {
+				// If ctx is canceled, this usually means the entire transport has been shutdown
+				// and we can safely ignore all errors with client.Attach.
+				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+					t.opts.Logger.Error("incoming attachment", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 				}
-				return
 			}
+			if ctx.Err() != nil {
+				t.goodbye(remote, wire.GoodbyeShutdown)
+			}
+			return
+		}
 
-			enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
-			dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
+		// Otherwise, this connection should be short-lived. A Channel still
+		// needs to be created (because one probably does not exist), but a
+		// bounded time should be used.
+		timeout := t.serverTimeout(remote)
+		attachCtx, cancel := t.reap(ctx, remote, time.Now(), t.serverTimeout)
+		defer cancel()
 
-			// If the Transport is linked to the remote peer, then the
-			// network connection should be kept alive until the remote peer
-			// is unlinked (or the network connection faults).
-			if t.IsLinked(remote) {
-				t.opts.Logger.Debug("accepted", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
-				defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+		t.opts.Logger.Debug("accepted", zap.String("conn", connID.String()), zap.Bool("linked", false), zap.Duration("timeout", timeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+		defer t.opts.Logger.Debug("accepted: drop", zap.String("conn", connID.String()), zap.Bool("linked", false), zap.Duration("timeout", timeout), zap.String("remote", remote.String()), zap.String("addr", addr))
 
-				// Attaching a connection will block until the Channel is
-				// unbound (which happens when the Transport is unlinked), the
-				// connection is replaced, or the connection faults.
-				t.connect(remote)
-				defer t.disconnect(remote)
-				if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
-					// If ctx is canceled, this usually means the entire transport has been shutdown
-					// and we can safely ignore all errors with client.Attach.
-					if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-						t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
-					}
-				}
-				return
+		t.client.Bind(remote)
+		defer t.client.Unbind(remote)
+
+		t.connect(session, conn)
+		defer t.disconnect(remote)
+		if err := t.client.AttachWithVersion(attachCtx, remote, conn, enc, dec, session.Version); err != nil {
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				t.opts.Logger.Error("incoming attachment", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 			}
+		}
+		if ctx.Err() != nil {
+			t.goodbye(remote, wire.GoodbyeShutdown)
+		}
+	}
+	err := t.listenAll(ctx, handle, handleListenErr)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			t.opts.Logger.Error("listen", zap.Error(err))
+		}
+	}
+}
+
+// listen accepts inbound connections on the address until the context is done,
+// using the Listen function of the Options if there is one.
+func (t *Transport) listen(ctx context.Context, addr string, handle func(net.Conn), handleErr func(error)) error {
+	if t.opts.Listen == nil {
+		return tcp.ListenWithOptions(ctx, addr, t.opts.ListenOptions, handle, handleErr, t.opts.Allow)
+	}
+	listener, err := t.opts.Listen(ctx, addr)
+	if err != nil {
+		return err
+	}
+	// Closing the listener is the only way to unblock Accept.
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	return tcp.ListenWithListenerOptions(ctx, listener, t.opts.ListenOptions, handle, handleErr, t.opts.Allow)
+}
 
-			// Otherwise, this connection should be short-lived. A Channel still
-			// needs to be created (because one probably does not exist), but a
-			// bounded time should be used.
-			ctx, cancel := context.WithTimeout(ctx, t.opts.ServerTimeout)
-			defer cancel()
+// dialOptions returns the DialOptions used for outbound connections. The
+// NoDelay setting of the Transport applies to both inbound and outbound
+// connections, so it overrides the NoDelay setting of the DialOptions.
+func (t *Transport) dialOptions() tcp.DialOptions {
+	return t.opts.DialOptions.WithNoDelay(t.opts.NoDelay)
+}
 
-			t.opts.Logger.Debug("accepted", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
-			defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+// dialState is a dial to a remote peer that is shared by every caller of
+// dialOnce that is waiting for it.
+type dialState struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
 
-			t.client.Bind(remote)
+// dialOnce dials the remote peer, unless there is already a dial to the remote
+// peer in progress. Dials are in progress until their connection is dropped,
+// so messages sent while a dial is in progress re-use its connection (once it
+// is established) instead of starting a redundant connection and handshake.
+//
+// The dial is shared by all callers, and is not bound to the context of any
+// one of them. Each caller blocks until the dial is done, and gets its error,
+// or until its own context is done. The dial stops retrying once the contexts
+// of all callers are done.
+func (t *Transport) dialOnce(ctx context.Context, remote id.Signatory, remoteAddr wire.Address) error {
+	t.dialsMu.Lock()
+	state, ok := t.dials[remote]
+	if !ok {
+		dialCtx, cancel := context.WithCancel(detach(ctx))
+		state = &dialState{done: make(chan struct{}), cancel: cancel}
+		t.dials[remote] = state
+
+		// The shared dial keeps the remote peer bound, so that its
+		// connection can be attached after the callers have given up.
+		t.client.Bind(remote)
+		go func() {
 			defer t.client.Unbind(remote)
 
-			t.connect(remote)
-			defer t.disconnect(remote)
-			if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
-				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-					t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
-				}
+			err := t.dial(dialCtx, remote, remoteAddr)
+			cancel()
+
+			t.dialsMu.Lock()
+			if t.dials[remote] == state {
+				delete(t.dials, remote)
 			}
-		},
-		func(err error) {
-			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
-				t.opts.Logger.Error("listen", zap.Error(err))
+			t.dialsMu.Unlock()
+			state.err = err
+			close(state.done)
+		}()
+	}
+	state.waiters++
+	t.dialsMu.Unlock()
+
+	select {
+	case <-state.done:
+		return state.err
+	case <-ctx.Done():
+		t.dialsMu.Lock()
+		if state.waiters--; state.waiters == 0 {
+			// Nobody is waiting for the dial, so it stops retrying, and the
+			// next caller starts a new dial.
+			state.cancel()
+			if t.dials[remote] == state {
+				delete(t.dials, remote)
 			}
-		},
-		nil)
-	if err != nil {
-		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			t.opts.Logger.Error("listen", zap.Error(err))
 		}
+		t.dialsMu.Unlock()
+		return ctx.Err()
 	}
 }
 
-func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAddr wire.Address) {
+// detachedContext is a context that has the values of its parent, but is never
+// done.
+type detachedContext struct {
+	parent context.Context
+}
+
+// detach returns a context that has the values of the parent context, but is
+// not done when the parent context is done.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (ctx detachedContext) Done() <-chan struct{} { return nil }
+
+func (ctx detachedContext) Err() error { return nil }
+
+func (ctx detachedContext) Value(key interface{}) interface{} { return ctx.parent.Value(key) }
+
+// dial the remote peer, and retry until it is connected, or the retry context
+// is done. It returns the error of the last attempt, or nil if the connection
+// was established and has been dropped.
+func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAddr wire.Address) error {
 	// It is tempting to skip dialing if there is already a connection. However,
 	// it is desirable to be able to re-dial in the case that the network
 	// address has changed. As such, we do not do any skip checks, and assume
 	// that dial is only called when the caller is absolutely sure that a dial
 	// should happen.
 
+	remoteAddr = t.dialAddress(remote, remoteAddr)
 	if remoteAddr.Protocol != wire.TCP {
 		t.opts.Logger.Debug("skipping non-tcp address", zap.String("addr", remoteAddr.String()))
-		return
+		return fmt.Errorf("unsupported protocol: %v", remoteAddr.Protocol)
+	}
+	if t.IsBanned(remote) {
+		t.opts.Logger.Debug("skipping banned peer", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
+		return ErrBanned
+	}
+	if t.isBackingOff(remote) {
+		t.opts.Logger.Debug("skipping peer that banned us", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
+		return fmt.Errorf("backing off: %w", ErrBanned)
+	}
+	if t.AtCapacity() && !t.IsConnected(remote) {
+		t.opts.Logger.Debug("skipping new peer", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(ErrAtCapacity))
+		return ErrAtCapacity
 	}
 
 	exit := make(chan struct{})
+	refreshed := false
+	budget := budgetFromContext(retryCtx)
 	for {
-		dialCtx, cancel := context.WithTimeout(context.Background(), t.opts.ClientTimeout)
+		if !budget.take(t.opts.Clock.Now()) {
+			t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(ErrBudgetExhausted))
+			return ErrBudgetExhausted
+		}
+		timeout := t.clientTimeout(remote)
+		timeoutStart := time.Now()
+		dialCtx, cancel := context.WithTimeout(context.Background(), timeout)
 
 		t.opts.Logger.Debug("dialing", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-
-		err := tcp.Dial(
+		mismatched := false
+		exhausted := false
+		// connErr is the reason that an established connection was dropped
+		// before it was attached.
+		var connErr error
+		var refreshedAddr wire.Address
+		connID := t.nextConnID()
+		t.trace(connID, DirectionOutbound, TraceDialStart, remote, remoteAddr.Value, nil)
+		dialStart := t.opts.Clock.Now()
+		_, finishDial := t.startSpan(WithConnID(retryCtx, connID), SpanDial)
+		dialFinished := false
+
+		err := tcp.DialWithOptions(
 			dialCtx,
+			t.dialOptions(),
 			remoteAddr.Value,
 			func(conn net.Conn) {
+				finishDial()
+				dialFinished = true
+
 				addr := conn.RemoteAddr().String()
-				enc, dec, r, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
+				t.trace(connID, DirectionOutbound, TraceConnected, remote, addr, nil)
+				defer t.trace(connID, DirectionOutbound, TraceClosed, remote, addr, nil)
+
+				t.trace(connID, DirectionOutbound, TraceHandshakeStart, remote, addr, nil)
+				_, finishHandshake := t.startSpan(WithConnID(retryCtx, connID), SpanHandshake)
+				enc, dec, r, state, err := t.handshake(conn)
+				finishHandshake()
+				defer t.oncePool.Remove(r, conn)
+				t.trace(connID, DirectionOutbound, TraceHandshakeDone, r, addr, err)
+				t.recordHandshake(err)
+				if errors.Is(err, ErrBanned) {
+					t.opts.Logger.Debug("handshake", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					t.trace(connID, DirectionOutbound, TraceAuthorized, r, addr, err)
+					t.writeGoodbye(conn, enc, wire.GoodbyeBanned)
+					connErr = err
+					return
+				}
 				if err != nil {
+					connErr = err
 					var e wire.NegligibleError
 					if !errors.As(err, &e) {
-						t.opts.Logger.Error("handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+						t.opts.Logger.Error("handshake", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Stringer("kind", handshake.Classify(err)), zap.Error(err))
+						t.recordDial(remote, remoteAddr, 0, true)
 					}
 					return
 				}
-				if !r.Equal(&remote) {
-					t.opts.Logger.Error("handshake", zap.String("expected", remote.String()), zap.String("got", r.String()), zap.Error(fmt.Errorf("bad remote")))
+				if r.Equal(&t.self) {
+					// The network address of the remote peer points to the
+					// local peer, so there is no point keeping the connection
+					// (or, optionally, the remote peer).
+					t.opts.Logger.Debug("handshake", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(ErrSelfConnection))
+					t.trace(connID, DirectionOutbound, TraceAuthorized, r, addr, ErrSelfConnection)
+					t.recordDial(remote, remoteAddr, 0, true)
+					connErr = ErrSelfConnection
+					if t.opts.PruneSelf {
+						t.table.DeletePeer(remote)
+						t.addrQualities.forget(remote)
+					}
+					return
+				}
+				if !t.isRemote(remote, r) {
+					// The connection is refused, and the network address is
+					// not re-dialed, because it cannot be trusted.
+					mismatched = true
+					mismatchErr := t.mismatched(remote, remoteAddr, r)
+					t.opts.Logger.Error("handshake", zap.String("conn", connID.String()), zap.String("expected", remote.String()), zap.String("got", r.String()), zap.String("addr", addr), zap.Error(mismatchErr))
+					t.trace(connID, DirectionOutbound, TraceAuthorized, r, addr, mismatchErr)
+					t.recordDial(remote, remoteAddr, 0, true)
+					connErr = mismatchErr
 					return
 				}
+				t.matched(remote)
+				t.trace(connID, DirectionOutbound, TraceAuthorized, remote, addr, nil)
+				t.recordDial(remote, remoteAddr, t.opts.Clock.Now().Sub(dialStart), false)
+				t.table.Touch(remote)
+				session := t.connected(connID, remote, addr, DirectionOutbound, state)
 
-				enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
-				dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
+				enc = codec.LengthPrefixEncoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainEncoder, enc)
+				dec = codec.LengthPrefixDecoderWithOptions(t.opts.LengthPrefixOptions, codec.PlainDecoder, dec)
 
-				t.connect(remote)
+				t.connect(session, conn)
 				defer t.disconnect(remote)
 
+				// If the Transport is linked to the remote peer, then the
+				// network connection should be kept alive until the remote peer
+				// is unlinked (or the network connection faults). Otherwise, it
+				// is reaped once the ClientTimeout of the remote peer has
+				// elapsed since the dial started.
+				attachCtx := context.Background()
 				if t.IsLinked(remote) {
-					t.opts.Logger.Debug("dialed", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
-					defer t.opts.Logger.Debug("dialed: drop", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
-
-					// If the Transport is linked to the remote peer, then the
-					// network connection should be kept alive until the remote peer
-					// is unlinked (or the network connection faults). To do this,
-					// we override the context and re-use it. Otherwise, the
-					// previously defined context will be used, which will
-					// eventually timeout.
-					dialCtx = context.Background()
+					t.opts.Logger.Debug("dialed", zap.String("conn", connID.String()), zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+					defer t.opts.Logger.Debug("dialed: drop", zap.String("conn", connID.String()), zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
 				} else {
-					t.opts.Logger.Debug("dialed", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ClientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
-					defer t.opts.Logger.Debug("dialed: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ClientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+					t.opts.Logger.Debug("dialed", zap.String("conn", connID.String()), zap.Bool("linked", false), zap.Duration("timeout", timeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+					defer t.opts.Logger.Debug("dialed: drop", zap.String("conn", connID.String()), zap.Bool("linked", false), zap.Duration("timeout", timeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+
+					var cancelAttach context.CancelFunc
+					attachCtx, cancelAttach = t.reap(attachCtx, remote, timeoutStart, t.clientTimeout)
+					defer cancelAttach()
 				}
 
-				if err := t.client.Attach(dialCtx, remote, conn, enc, dec); err != nil {
-					// Context deadline exceeds means we decide to drop the
-					// connection and the error could be ignored.
-					if !errors.Is(err, context.DeadlineExceeded) {
-						t.opts.Logger.Error("outgoing", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+				if err := t.client.AttachWithVersion(attachCtx, remote, conn, enc, dec, session.Version); err != nil {
+					// The connection is dropped when it is reaped, so the
+					// error can be ignored.
+					if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+						t.opts.Logger.Error("outgoing", zap.String("conn", connID.String()), zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 					}
 				}
 			},
 			func(err error) {
+				if exhausted {
+					// The attempt was never started, because the Budget was
+					// exhausted before it could be taken.
+					return
+				}
 				t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
+				t.trace(connID, DirectionOutbound, TraceDialFailed, remote, remoteAddr.Value, err)
+				t.recordDial(remote, remoteAddr, 0, true)
+				// The network address might be stale, because the remote
+				// peer has restarted with a new network address, and has
+				// re-announced it. If so, dial the new network address
+				// instead (but only once, so that remote peers that keep
+				// changing their network address cannot keep the dial
+				// going forever).
+				if !refreshed {
+					if addr, ok := t.refreshAddress(remote, remoteAddr); ok {
+						refreshedAddr = addr
+						cancel()
+						return
+					}
+				}
 				t.table.AddExpiry(remote, t.opts.ExpiryDuration)
 				if t.table.HandleExpired(remote) {
-					close(exit)
+					t.addrQualities.forget(remote)
+					// Errors are handled sequentially, but guard against
+					// the peer expiring more than once (for example, if it
+					// is re-added while the dial is still failing), because
+					// closing the exit channel twice would panic.
+					select {
+					case <-exit:
+					default:
+						close(exit)
+					}
 					cancel()
 				}
 			},
-			t.opts.DialTimeout)
+			func(attempt int) time.Duration {
+				// The first attempt was taken from the Budget before the
+				// dial started. Every retry is taken from the Budget of the
+				// send as it starts, so that a batch of sends stops retrying
+				// once it is exhausted.
+				if attempt > 1 && !budget.take(t.opts.Clock.Now()) {
+					exhausted = true
+					cancel()
+					return 0
+				}
+				return t.opts.DialTimeout(attempt)
+			})
+		if !dialFinished {
+			finishDial()
+		}
 		if err != nil {
 			t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
+			if exhausted {
+				t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(ErrBudgetExhausted))
+				cancel()
+				return ErrBudgetExhausted
+			}
+			if refreshedAddr.Value != "" {
+				t.opts.Logger.Debug("dial: refreshed address", zap.String("remote", remote.String()), zap.String("stale", remoteAddr.String()), zap.String("addr", refreshedAddr.String()))
+				refreshed = true
+				remoteAddr = refreshedAddr
+				continue
+			}
 			select {
 			case <-exit:
 				break
@@ -400,30 +1519,118 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 					continue
 				}
 			}
-		} else {
+		} else if !mismatched {
 			t.table.DeleteExpiry(remote)
 		}
 
 		// Cancel last dial context before exiting
 		cancel()
-		return
+		if err != nil {
+			return err
+		}
+		return connErr
 	}
 }
 
-func (t *Transport) connect(remote id.Signatory) {
-	t.connsMu.Lock()
-	defer t.connsMu.Unlock()
+// refreshAddress returns the network address of the remote peer in the table,
+// if it is different from the network address that is being dialed. False is
+// returned if the remote peer is no longer in the table, or if its network
+// address has not changed.
+func (t *Transport) refreshAddress(remote id.Signatory, dialed wire.Address) (wire.Address, bool) {
+	addr, ok := t.table.PeerAddress(t.current(remote))
+	if !ok || addr.Protocol != wire.TCP || (addr.Protocol == dialed.Protocol && addr.Value == dialed.Value) {
+		return wire.Address{}, false
+	}
+	return addr, true
+}
 
-	t.conns[remote]++
+func (t *Transport) connect(session Session, conn net.Conn) {
+	t.connsMu.Lock()
+	remote, opened := session.Remote, false
+	if t.conns[remote]++; t.conns[remote] == 1 {
+		atomic.AddInt64(t.numConns, 1)
+		opened = true
+	}
+	t.dirs[remote] = session.Direction
+	// The Session is recorded again, in case it was forgotten by another
+	// connection that was closed since the Session started.
+	t.sessions[remote] = session
+	t.connsMu.Unlock()
+
+	// The keepalive is applied once the remote peer is connected, so that
+	// the network connection gets a period that accounts for it.
+	if opened {
+		t.rescaleKeepAlive()
+	}
+	t.keepAlive(remote, conn)
 }
 
 func (t *Transport) disconnect(remote id.Signatory) {
 	t.connsMu.Lock()
-	defer t.connsMu.Unlock()
-
+	session, closed := Session{}, false
 	if t.conns[remote] > 0 {
 		if t.conns[remote]--; t.conns[remote] == 0 {
+			session, closed = t.sessions[remote], true
 			delete(t.conns, remote)
+			delete(t.dirs, remote)
+			delete(t.sessions, remote)
+			delete(t.tags, remote)
+			atomic.AddInt64(t.numConns, -1)
 		}
 	}
+	t.connsMu.Unlock()
+	if closed {
+		t.forgetNegotiated(remote)
+		t.rescaleKeepAlive()
+	}
+
+	// The OnClosed function is called without holding the lock, so that it
+	// can use the Transport.
+	if closed && t.opts.OnClosed != nil {
+		t.opts.OnClosed(session, t.opts.Clock.Now())
+	}
+}
+
+// connected starts the Session of a connection with the remote peer that has
+// been authorized, and notifies the OnConnected and OnOpened functions, if
+// there are any.
+func (t *Transport) connected(connID ConnID, remote id.Signatory, addr string, dir Direction, state handshakeState) Session {
+	session := t.startSession(connID, remote, addr, dir, state)
+	if t.opts.OnConnected != nil {
+		t.opts.OnConnected(remote, addr)
+	}
+	if t.opts.OnOpened != nil {
+		t.opts.OnOpened(session)
+	}
+	return session
+}
+
+// recordHandshake in the Stats. Negligible errors, which happen when duplicate
+// connections are killed, are not counted as failures.
+func (t *Transport) recordHandshake(err error) {
+	var e wire.NegligibleError
+	failed := err != nil && !errors.As(err, &e) && !errors.Is(err, ErrBanned)
+	t.handshakeStats.record(t.opts.Clock.Now(), failed)
+}
+
+// nextConnID returns a ConnID that has not been used by this Transport.
+func (t *Transport) nextConnID() ConnID {
+	return ConnID(atomic.AddUint64(t.connIDs, 1))
+}
+
+// trace emits a TraceEvent to the Tracer. If there is no Tracer, this method
+// does nothing.
+func (t *Transport) trace(connID ConnID, dir Direction, stage TraceStage, remote id.Signatory, addr string, err error) {
+	if t.opts.Tracer == nil {
+		return
+	}
+	t.opts.Tracer(TraceEvent{
+		ID:        connID,
+		Stage:     stage,
+		Direction: dir,
+		Remote:    remote,
+		Addr:      addr,
+		Err:       err,
+		Time:      t.opts.Clock.Now(),
+	})
 }
@@ -1,12 +1,25 @@
 package transport_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/muirglacier/aw/channel"
+	"github.com/muirglacier/aw/clock"
+	"github.com/muirglacier/aw/codec"
 	"github.com/muirglacier/aw/dht"
 	"github.com/muirglacier/aw/handshake"
+	"github.com/muirglacier/aw/policy"
+	"github.com/muirglacier/aw/tcp"
 	"github.com/muirglacier/aw/transport"
 	"github.com/muirglacier/aw/wire"
 	"github.com/muirglacier/id"
@@ -25,11 +38,14 @@ var _ = Describe("Transport", func() {
 				client := channel.NewClient(
 					channel.DefaultOptions(),
 					self)
-				table := dht.NewInMemTable(self)
+				fake := clock.NewFake(time.Now())
+				table := dht.NewInMemTableWithOptions(self, dht.DefaultInMemTableOptions().WithClock(fake))
 				transport := transport.New(
 					transport.DefaultOptions().
+						WithClock(fake).
+						WithDialTimeout(policy.ConstantTimeout(10*time.Millisecond)).
 						WithClientTimeout(10*time.Second).
-						WithOncePoolOptions(handshake.DefaultOncePoolOptions().WithMinimumExpiryAge(10*time.Second)).
+						WithOncePoolOptions(handshake.DefaultOncePoolOptions().WithMinimumExpiryAge(10*time.Second).WithClock(fake)).
 						WithExpiry(5*time.Second).
 						WithPort(uint16(3333)),
 					self,
@@ -45,16 +61,3011 @@ var _ = Describe("Transport", func() {
 				Expect(ok).To(BeTrue())
 
 				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
 				go func() {
 					transport.Send(ctx, privKey2.Signatory(), wire.Msg{})
 				}()
 
-				time.Sleep(7 * time.Second)
-				cancel()
+				// The peer must not be deleted before the expiry duration has
+				// passed, no matter how many dial attempts fail.
+				Consistently(func() bool {
+					_, ok := table.PeerAddress(privKey2.Signatory())
+					return ok
+				}, 100*time.Millisecond).Should(BeTrue())
+
+				fake.Advance(6 * time.Second)
+				Eventually(func() bool {
+					_, ok := table.PeerAddress(privKey2.Signatory())
+					return ok
+				}).Should(BeFalse())
+			})
+		})
+	})
+
+	Describe("Tracing", func() {
+		Context("when sending a message to a peer", func() {
+			It("should emit correlated trace events for the connection attempt", func() {
+				eventsMu := new(sync.Mutex)
+				events := []transport.TraceEvent{}
+				tracer := func(event transport.TraceEvent) {
+					eventsMu.Lock()
+					defer eventsMu.Unlock()
+					events = append(events, event)
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithTracer(tracer).WithPort(3340))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3341))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3341", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				eventsMu.Lock()
+				defer eventsMu.Unlock()
+
+				stages := []transport.TraceStage{}
+				for _, event := range events {
+					if event.ID != events[0].ID {
+						continue
+					}
+					if event.Stage == transport.TraceDialFailed {
+						continue
+					}
+					stages = append(stages, event.Stage)
+				}
+				Expect(stages).To(ContainElements(
+					transport.TraceDialStart,
+					transport.TraceConnected,
+					transport.TraceHandshakeStart,
+					transport.TraceHandshakeDone,
+					transport.TraceAuthorized,
+				))
+				Expect(stages[0]).To(Equal(transport.TraceDialStart))
+			})
+		})
+	})
+
+	Describe("Self connections", func() {
+		Context("when the address of a peer points to the local peer", func() {
+			It("should close the connection and prune the peer", func() {
+				selfConnections := make(chan struct{}, 1)
+				tracer := func(event transport.TraceEvent) {
+					if errors.Is(event.Err, transport.ErrSelfConnection) {
+						select {
+						case selfConnections <- struct{}{}:
+						default:
+						}
+					}
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithTracer(tracer).WithPruneSelf(true).WithPort(3342))
+				go t1.Run(ctx)
+
+				other := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(other, wire.NewUnsignedAddress(wire.TCP, "localhost:3342", uint64(time.Now().UnixNano())))
+				go func() {
+					// The message will never be delivered, so the error
+					// is ignored.
+					_ = t1.Send(ctx, other, wire.Msg{})
+				}()
+
+				Eventually(selfConnections, 5*time.Second).Should(Receive())
+				Eventually(func() bool {
+					_, ok := t1.Table().PeerAddress(other)
+					return ok
+				}).Should(BeFalse())
+				Eventually(func() bool {
+					return t1.IsConnected(other) || t1.IsConnected(t1.Self())
+				}).Should(BeFalse())
+			})
+		})
+	})
+
+	Describe("Keeping peers connected", func() {
+		Context("when a peer is kept connected", func() {
+			It("should connect without sending messages", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3343))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3344))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3344", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.KeepConnected(t2.Self())
+				defer t1.StopKeepingConnected(t2.Self())
+				Expect(t1.IsKeptConnected(t2.Self())).To(BeTrue())
+				Expect(t1.IsLinked(t2.Self())).To(BeTrue())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				t1.StopKeepingConnected(t2.Self())
+				Expect(t1.IsKeptConnected(t2.Self())).To(BeFalse())
+				Expect(t1.IsLinked(t2.Self())).To(BeFalse())
+			})
+		})
+
+		Context("when a peer is kept connected before running", func() {
+			It("should connect once the transport is running", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3459))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3460))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3460", uint64(time.Now().UnixNano())))
+				t1.KeepConnected(t2.Self())
+				defer t1.StopKeepingConnected(t2.Self())
+				go t2.Run(ctx)
+				Consistently(func() bool { return t1.IsConnected(t2.Self()) }, 500*time.Millisecond).Should(BeFalse())
+
+				go t1.Run(ctx)
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+			})
+		})
+
+		Context("when a kept peer does not have an address", func() {
+			It("should connect once the address is added", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3461))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3462))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.KeepConnected(t2.Self())
+				defer t1.StopKeepingConnected(t2.Self())
+				Consistently(func() bool { return t1.IsConnected(t2.Self()) }, 200*time.Millisecond).Should(BeFalse())
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3462", uint64(time.Now().UnixNano())))
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+			})
+		})
+	})
+
+	Describe("Connection hooks", func() {
+		Context("when a connection is authorized", func() {
+			It("should notify both peers with the remote signatory", func() {
+				connected1 := make(chan id.Signatory, 1)
+				connected2 := make(chan id.Signatory, 1)
+				onConnected := func(connected chan id.Signatory) func(id.Signatory, string) {
+					return func(remote id.Signatory, addr string) {
+						select {
+						case connected <- remote:
+						default:
+						}
+					}
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithOnConnected(onConnected(connected1)).WithPort(3345))
+				t2, _ := newTransport(transport.DefaultOptions().WithOnConnected(onConnected(connected2)).WithPort(3346))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3346", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				Expect(connected1).To(Receive(Equal(t2.Self())))
+				Expect(connected2).To(Receive(Equal(t1.Self())))
+
+				Expect(t1.ConnectedPeers()).To(ContainElement(t2.Self()))
+				stats := t1.Stats()
+				Expect(stats.Connected).To(BeNumerically(">=", 1))
+				Expect(stats.Handshakes).To(BeNumerically(">=", 1))
+				Expect(stats.RecentHandshakes).To(Equal(stats.Handshakes))
+				Expect(stats.HandshakeFailures).To(BeZero())
+			})
+		})
+
+		Context("when a connection is dialed", func() {
+			It("should be outbound for the dialer and inbound for the listener", func() {
+				dirs1 := make(chan transport.Direction, 1)
+				dirs2 := make(chan transport.Direction, 1)
+				onOpened := func(dirs chan transport.Direction) func(transport.Session) {
+					return func(session transport.Session) {
+						select {
+						case dirs <- session.Direction:
+						default:
+						}
+					}
+				}
+				traced := make(chan transport.TraceEvent, 16)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceAuthorized {
+						traced <- event
+					}
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithOnOpened(onOpened(dirs1)).WithTracer(tracer).WithPort(3386))
+				t2, _ := newTransport(transport.DefaultOptions().WithOnOpened(onOpened(dirs2)).WithPort(3387))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3387", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				Expect(dirs1).To(Receive(Equal(transport.DirectionOutbound)))
+				Expect(dirs2).To(Receive(Equal(transport.DirectionInbound)))
+				Expect(traced).To(Receive(WithTransform(func(event transport.TraceEvent) transport.Direction {
+					return event.Direction
+				}, Equal(transport.DirectionOutbound))))
+
+				dir, ok := t1.Direction(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(dir).To(Equal(transport.DirectionOutbound))
+				Eventually(func() bool {
+					_, ok := t2.Direction(t1.Self())
+					return ok
+				}).Should(BeTrue())
+				dir, _ = t2.Direction(t1.Self())
+				Expect(dir).To(Equal(transport.DirectionInbound))
+			})
+		})
+	})
+
+	Describe("Send errors", func() {
+		Context("when the remote peer is not in the table", func() {
+			It("should return an unknown peer error", func() {
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3347))
+				remote := id.NewPrivKey().Signatory()
+				err := t1.Send(context.Background(), remote, wire.Msg{})
+
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorUnknownPeer))
+				Expect(sendErr.Remote).To(Equal(remote))
+			})
+		})
+
+		Context("when the context times out", func() {
+			It("should return a timeout error", func() {
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3347))
+				remote := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "localhost:3348", uint64(time.Now().UnixNano())))
+
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				err := t1.Send(ctx, remote, wire.Msg{})
+
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorTimeout))
+				Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Bans", func() {
+		Context("when a peer is banned", func() {
+			It("should refuse connections until the ban expires", func() {
+				fake := clock.NewFake(time.Now())
+				rejected := make(chan struct{}, 1)
+				tracer := func(event transport.TraceEvent) {
+					// Banned remote peers are rejected by the handshake,
+					// before the OncePool can keep their connections.
+					if event.Stage == transport.TraceHandshakeDone && errors.Is(event.Err, transport.ErrBanned) {
+						select {
+						case rejected <- struct{}{}:
+						default:
+						}
+					}
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithClock(fake).WithTracer(tracer).WithPort(3349))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3350))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3350", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3349", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Ban(t2.Self(), time.Minute)
+				Expect(t1.IsBanned(t2.Self())).To(BeTrue())
+				Expect(t1.Bans()).To(HaveLen(1))
+				Expect(t1.Bans()[0].Signatory).To(Equal(t2.Self()))
+
+				// Outbound messages are not sent.
+				err := t1.Send(ctx, t2.Self(), wire.Msg{})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorBanned))
+
+				// Inbound connections are closed.
+				go func() {
+					// The message will not be delivered, so the error is
+					// ignored.
+					sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+					defer sendCancel()
+					_ = t2.Send(sendCtx, t1.Self(), wire.Msg{})
+				}()
+				Eventually(rejected, 5*time.Second).Should(Receive())
+				Expect(t1.IsConnected(t2.Self())).To(BeFalse())
+
+				fake.Advance(time.Minute)
+				Expect(t1.IsBanned(t2.Self())).To(BeFalse())
+				Expect(t1.Bans()).To(BeEmpty())
+			})
+		})
+
+		Context("when the maximum number of bans is reached", func() {
+			It("should remove the ban that expires soonest", func() {
+				t1, _ := newTransport(transport.DefaultOptions().WithMaxBans(2).WithPort(3351))
+				sig1, sig2, sig3 := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				t1.Ban(sig1, time.Hour)
+				t1.Ban(sig2, time.Minute)
+				t1.Ban(sig3, time.Hour)
+				Expect(t1.IsBanned(sig1)).To(BeTrue())
+				Expect(t1.IsBanned(sig2)).To(BeFalse())
+				Expect(t1.IsBanned(sig3)).To(BeTrue())
+
+				t1.Unban(sig1)
+				Expect(t1.IsBanned(sig1)).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Goodbyes", func() {
+		onDisconnected := func(disconnected chan transport.DisconnectEvent) func(transport.DisconnectEvent) {
+			return func(event transport.DisconnectEvent) {
+				select {
+				case disconnected <- event:
+				default:
+				}
+			}
+		}
+
+		Context("when saying goodbye to a peer", func() {
+			It("should emit a disconnect event with the reason", func() {
+				disconnected := make(chan transport.DisconnectEvent, 1)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3352))
+				t2, _ := newTransport(transport.DefaultOptions().WithOnDisconnected(onDisconnected(disconnected)).WithPort(3353))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3353", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				Expect(t1.Goodbye(ctx, t2.Self(), wire.GoodbyeMaintenance)).To(Succeed())
+				var event transport.DisconnectEvent
+				Eventually(disconnected, 5*time.Second).Should(Receive(&event))
+				Expect(event.Remote).To(Equal(t1.Self()))
+				Expect(event.Reason).To(Equal(wire.GoodbyeMaintenance))
+				Expect(event.Established.IsZero()).To(BeFalse())
+				Expect(event.Duration()).To(BeNumerically(">", 0))
+			})
+		})
+
+		Context("when a peer shuts down", func() {
+			It("should say goodbye to connected peers", func() {
+				disconnected := make(chan transport.DisconnectEvent, 1)
+
+				ctx1, cancel1 := context.WithCancel(context.Background())
+				defer cancel1()
+				ctx2, cancel2 := context.WithCancel(context.Background())
+				defer cancel2()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithSendGoodbye(true).WithPort(3354))
+				t2, _ := newTransport(transport.DefaultOptions().WithOnDisconnected(onDisconnected(disconnected)).WithPort(3355))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3355", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx1)
+				go t2.Run(ctx2)
+
+				t1.KeepConnected(t2.Self())
+				defer t1.StopKeepingConnected(t2.Self())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				cancel1()
+				var event transport.DisconnectEvent
+				Eventually(disconnected, 5*time.Second).Should(Receive(&event))
+				Expect(event.Remote).To(Equal(t1.Self()))
+				Expect(event.Reason).To(Equal(wire.GoodbyeShutdown))
+			})
+		})
+
+		Context("when a banned peer connects", func() {
+			It("should say goodbye with the banned reason", func() {
+				disconnected := make(chan transport.DisconnectEvent, 1)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithSendGoodbye(true).WithPort(3356))
+				t2, _ := newTransport(transport.DefaultOptions().WithOnDisconnected(onDisconnected(disconnected)).WithPort(3357))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3356", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Ban(t2.Self(), time.Minute)
+				go func() {
+					sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+					defer sendCancel()
+					_ = t2.Send(sendCtx, t1.Self(), wire.Msg{})
+				}()
+				var event transport.DisconnectEvent
+				Eventually(disconnected, 5*time.Second).Should(Receive(&event))
+				Expect(event.Remote).To(Equal(t1.Self()))
+				Expect(event.Reason).To(Equal(wire.GoodbyeBanned))
+			})
+		})
+	})
+
+	Describe("Inbound filters", func() {
+		Context("when the filter returns an error", func() {
+			It("should drop the message and ban the peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				allowSend := func(from id.Signatory, msg wire.Msg) error {
+					if msg.Type != wire.MsgTypeSend {
+						return errors.New("unexpected type")
+					}
+					return nil
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3358))
+				t2, _ := newTransport(transport.DefaultOptions().WithInboundFilter(allowSend).WithInboundFilterBan(time.Minute).WithPort(3359))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3359", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan wire.Msg, 2)
+				t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Type: wire.MsgTypePush, Data: []byte("dropped")})
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Type: wire.MsgTypeSend, Data: []byte("delivered")})
+				}()
 
-				_, ok = table.PeerAddress(privKey2.Signatory())
+				var msg wire.Msg
+				Eventually(received, 5*time.Second).Should(Receive(&msg))
+				Expect(msg.Data).To(Equal([]byte("delivered")))
+				Expect(t2.Stats().FilteredMessages).To(Equal(uint64(1)))
+				Expect(t2.IsBanned(t1.Self())).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Connection reuse", func() {
+		Context("when sending multiple messages to a peer", func() {
+			It("should only connect and handshake once", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3362))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3363))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3363", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+
+				received := make(chan struct{}, 4)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				// Concurrent messages share the dial that is in progress. The
+				// remote peer is started after the messages are sent, so that
+				// both messages are sent before a connection can be made.
+				for i := 0; i < 2; i++ {
+					go func() {
+						defer GinkgoRecover()
+						Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+					}()
+				}
+				time.Sleep(100 * time.Millisecond)
+				go t2.Run(ctx)
+				Eventually(received, 5*time.Second).Should(Receive())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				// Later messages re-use the established connection.
+				Expect(t1.IsConnected(t2.Self())).To(BeTrue())
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				Expect(t1.Stats().Handshakes).To(Equal(uint64(1)))
+				Expect(t2.Stats().Handshakes).To(Equal(uint64(1)))
+			})
+		})
+
+		Context("when a connection has been closed", func() {
+			It("should reconnect, even if existing connections are always kept", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				oncePoolOpts := handshake.DefaultOncePoolOptions().WithReconnectPolicy(handshake.ReconnectKeep)
+				t1, _ := newTransport(transport.DefaultOptions().WithOncePoolOptions(oncePoolOpts).WithClientTimeout(200 * time.Millisecond).WithPort(3472))
+				t2, _ := newTransport(transport.DefaultOptions().WithOncePoolOptions(oncePoolOpts).WithServerTimeout(200 * time.Millisecond).WithPort(3473))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3473", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				for i := 0; i < 2; i++ {
+					sendCtx, sendCancel := context.WithTimeout(ctx, 5*time.Second)
+					Expect(t1.Send(sendCtx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+					sendCancel()
+					Eventually(received, 5*time.Second).Should(Receive())
+					Eventually(func() bool { return t1.IsConnected(t2.Self()) || t2.IsConnected(t1.Self()) }, 5*time.Second).Should(BeFalse())
+				}
+			})
+		})
+
+		Context("when the first sender gives up before the dial is done", func() {
+			It("should keep dialing for the other senders", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3466).WithClientTimeout(200 * time.Millisecond))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3467))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3467", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+
+				received := make(chan []byte, 2)
+				t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg.Data
+					return nil
+				})
+
+				// The first sender starts the dial, and then gives up. The
+				// dial is shared, so it is not stopped by the first sender.
+				firstCtx, firstCancel := context.WithCancel(ctx)
+				firstErr := make(chan error, 1)
+				go func() {
+					firstErr <- t1.Send(firstCtx, t2.Self(), wire.Msg{Data: []byte("first")})
+				}()
+				time.Sleep(50 * time.Millisecond)
+				go func() {
+					defer GinkgoRecover()
+					Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("second")})).To(Succeed())
+				}()
+				time.Sleep(50 * time.Millisecond)
+				firstCancel()
+				Eventually(firstErr).Should(Receive(HaveOccurred()))
+
+				// The remote peer is started after several dial attempts
+				// have timed out.
+				time.Sleep(500 * time.Millisecond)
+				go t2.Run(ctx)
+				Eventually(received, 5*time.Second).Should(Receive(Equal([]byte("second"))))
+			})
+		})
+	})
+
+	Describe("Validating options", func() {
+		Context("when the options are the defaults", func() {
+			It("should succeed", func() {
+				Expect(transport.DefaultOptions().Validate()).To(Succeed())
+				Expect(transport.DefaultOptions().WithSendGoodbye(true).Validate()).To(Succeed())
+				Expect(transport.DefaultOptions().WithAnnounceAddress("203.0.113.1:3333").Validate()).To(Succeed())
+			})
+		})
+
+		Context("when the options are nonsensical", func() {
+			It("should return an invalid options error", func() {
+				opts := transport.DefaultOptions()
+				for _, invalid := range []transport.Options{
+					opts.WithLogger(nil),
+					opts.WithDialTimeout(nil),
+					opts.WithClock(nil),
+					opts.WithClientTimeout(0),
+					opts.WithServerTimeout(-time.Second),
+					opts.WithExpiry(0),
+					opts.WithExpiry(opts.ClientTimeout / 2),
+					opts.WithSendGoodbye(true).WithGoodbyeTimeout(0),
+					opts.WithMaxBans(-1),
+					opts.WithAddressQualityHalfLife(-time.Second),
+					opts.WithMaxAddressQualities(0),
+					opts.WithMaxTags(-1),
+					opts.WithMismatchTTL(-time.Second),
+					opts.WithListenOptions(tcp.DefaultListenOptions().WithWorkers(-1)),
+					opts.WithLengthPrefixOptions(codec.LengthPrefixOptions{Size: 3, ByteOrder: binary.BigEndian}),
+					opts.WithCompressionOptions(codec.DefaultCompressionOptions().WithThreshold(-1)),
+					opts.WithMaxMetadataSize(-1),
+					opts.WithMetadata(make([]byte, opts.MaxMetadataSize+1)),
+					opts.WithMaxHandshakeMsgSize(0),
+					opts.WithMetadata([]byte("v1")).WithMaxHandshakeMsgSize(opts.MaxMetadataSize),
+					opts.WithListenAddresses("localhost"),
+					opts.WithListenAddresses("localhost:65536"),
+					opts.WithListenWeights(map[string]int{"localhost:1": 1}),
+					opts.WithListenWeights(map[string]int{"localhost:3333": -1}),
+					opts.WithListenWeights(map[string]int{"localhost:3333": 0}),
+					opts.WithAnnounceAddress("203.0.113.1"),
+					opts.WithAnnounceAddress(":3333"),
+					opts.WithAnnounceAddress("0.0.0.0:3333"),
+					opts.WithAnnounceAddress("203.0.113.1:0"),
+				} {
+					err := invalid.Validate()
+					Expect(errors.Is(err, transport.ErrInvalidOptions)).To(BeTrue())
+				}
+			})
+		})
+
+		Context("when building a transport with validation", func() {
+			It("should only build it if the options are valid", func() {
+				privKey := id.NewPrivKey()
+				self := privKey.Signatory()
+				client := channel.NewClient(channel.DefaultOptions(), self)
+				h := handshake.ECIES(privKey)
+				table := dht.NewInMemTable(self)
+
+				t, err := transport.NewValidated(transport.DefaultOptions().WithClientTimeout(0), self, client, h, table)
+				Expect(errors.Is(err, transport.ErrInvalidOptions)).To(BeTrue())
+				Expect(t).To(BeNil())
+
+				t, err = transport.NewValidated(transport.DefaultOptions(), self, client, h, table)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Self()).To(Equal(self))
+			})
+		})
+	})
+
+	Describe("Sending to an address", func() {
+		Context("when the remote peer is not in the table", func() {
+			It("should send the message without adding the remote peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3364))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3365))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				self := t1.Self()
+				received := make(chan wire.Packet, 1)
+				t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					if from.Equal(&self) {
+						received <- packet
+					}
+					return nil
+				})
+
+				addr := wire.NewUnsignedAddress(wire.TCP, "localhost:3365", uint64(time.Now().UnixNano()))
+				var remote id.Signatory
+				Eventually(func() error {
+					var err error
+					remote, err = t1.SendTo(ctx, addr, wire.Msg{Data: []byte("hello")})
+					return err
+				}, 5*time.Second).Should(Succeed())
+				Expect(remote).To(Equal(t2.Self()))
+
+				var packet wire.Packet
+				Eventually(received, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal([]byte("hello")))
+
+				_, ok := t1.Table().PeerAddress(remote)
 				Expect(ok).To(BeFalse())
+				Expect(t1.IsConnected(remote)).To(BeFalse())
+			})
+		})
+
+		Context("when the address points to the local peer", func() {
+			It("should return a self connection error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3366))
+				go t1.Run(ctx)
+
+				addr := wire.NewUnsignedAddress(wire.TCP, "localhost:3366", uint64(time.Now().UnixNano()))
+				Eventually(func() error {
+					_, err := t1.SendTo(ctx, addr, wire.Msg{Data: []byte("hello")})
+					return err
+				}, 5*time.Second).Should(MatchError(transport.ErrSelfConnection))
 			})
 		})
 	})
-})
+
+	Describe("Address preference", func() {
+		Context("when one address of a peer fails and another succeeds", func() {
+			It("should prefer the address that succeeds", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().
+					WithDialTimeout(policy.ConstantTimeout(10 * time.Millisecond)).
+					WithClientTimeout(100 * time.Millisecond).
+					WithPort(3367))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3368))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				_, ok := t1.PreferredAddress(t2.Self())
+				Expect(ok).To(BeFalse())
+
+				// Nothing is listening on the bad address, so dials to it
+				// fail until the message times out.
+				bad := wire.NewUnsignedAddress(wire.TCP, "localhost:3369", uint64(time.Now().UnixNano()))
+				t1.Table().AddPeer(t2.Self(), bad)
+				sendCtx, sendCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+				defer sendCancel()
+				Expect(t1.Send(sendCtx, t2.Self(), wire.Msg{Data: []byte("hello")})).ToNot(Succeed())
+				preferred, ok := t1.PreferredAddress(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(preferred.Value).To(Equal(bad.Value))
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				good := wire.NewUnsignedAddress(wire.TCP, "localhost:3368", uint64(time.Now().UnixNano()))
+				t1.Table().AddPeer(t2.Self(), good)
+				Eventually(func() bool {
+					go func() {
+						_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+					}()
+					select {
+					case <-received:
+						return true
+					case <-time.After(100 * time.Millisecond):
+						return false
+					}
+				}, 5*time.Second).Should(BeTrue())
+
+				preferred, ok = t1.PreferredAddress(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(preferred.Value).To(Equal(good.Value))
+				qualities := t1.AddressQualities(t2.Self())
+				Expect(qualities).To(HaveLen(2))
+				Expect(qualities[0].Score()).To(BeNumerically(">", qualities[1].Score()))
+			})
+		})
+
+		Context("when the address in the table is worse than the preferred address", func() {
+			It("should dial the preferred address", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithClientTimeout(200 * time.Millisecond).WithPort(3468))
+				t2, _ := newTransport(transport.DefaultOptions().WithServerTimeout(200 * time.Millisecond).WithPort(3469))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				good := wire.NewUnsignedAddress(wire.TCP, "localhost:3469", uint64(time.Now().UnixNano()))
+				t1.Table().AddPeer(t2.Self(), good)
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+				Eventually(func() bool { return t2.IsConnected(t1.Self()) }, 5*time.Second).Should(BeFalse())
+
+				// Nothing is listening on the bad address, but it has never
+				// been dialed, so the good address is still preferred.
+				bad := wire.NewUnsignedAddress(wire.TCP, "localhost:3470", uint64(time.Now().UnixNano()))
+				t1.Table().AddPeer(t2.Self(), bad)
+				sendCtx, sendCancel := context.WithTimeout(ctx, 5*time.Second)
+				defer sendCancel()
+				Expect(t1.Send(sendCtx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+				Expect(t1.AddressQualities(t2.Self())).To(HaveLen(1))
+			})
+		})
+
+		Context("when addresses have similar scores, and there is an address distance", func() {
+			It("should dial the nearest address", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				dialed := make(chan string, 16)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceDialStart {
+						dialed <- event.Addr
+					}
+				}
+				near := net.IPv4(127, 0, 0, 2)
+				t1, _ := newTransport(transport.DefaultOptions().
+					WithAddressDistance(func(remote net.IP) int {
+						if remote.Equal(near) {
+							return 0
+						}
+						return 1
+					}).
+					WithTracer(tracer).
+					WithAddressQualityHalfLife(100 * time.Millisecond).
+					WithClientTimeout(200 * time.Millisecond).
+					WithPort(3485))
+				t2, _ := newTransport(transport.DefaultOptions().WithListenAddresses("127.0.0.1:3486", "127.0.0.2:3486").WithServerTimeout(200 * time.Millisecond))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				// The far address is dialed successfully, and its success
+				// is mostly forgotten, so its score is only slightly better
+				// than the score of the near address, which has never been
+				// dialed.
+				far := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3486", uint64(time.Now().UnixNano()))
+				t1.Table().AddPeer(t2.Self(), far)
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(dialed, 5*time.Second).Should(Receive(Equal(far.Value)))
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+				Eventually(func() bool { return t2.IsConnected(t1.Self()) }, 5*time.Second).Should(BeFalse())
+				Eventually(func() float64 { return t1.AddressQualities(t2.Self())[0].Score() }, 5*time.Second).Should(BeNumerically("<", 0.6))
+				Expect(t1.AddressQualities(t2.Self())[0].Score()).To(BeNumerically(">", 0.5))
+
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.2:3486", uint64(time.Now().UnixNano())))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(dialed, 5*time.Second).Should(Receive(Equal("127.0.0.2:3486")))
+			})
+		})
+
+		Context("when a peer is deleted from the table", func() {
+			It("should forget the qualities of its addresses", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPruneSelf(true).WithPort(3471))
+				go t1.Run(ctx)
+
+				// The address of the remote peer points to the local peer, so
+				// the remote peer is deleted once it has been dialed.
+				remote := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "localhost:3471", uint64(time.Now().UnixNano())))
+				sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+				defer sendCancel()
+				_ = t1.Send(sendCtx, remote, wire.Msg{Data: []byte("hello")})
+				Eventually(func() int { return t1.Table().NumPeers() }, 5*time.Second).Should(Equal(0))
+				Expect(t1.AddressQualities(remote)).To(BeEmpty())
+			})
+		})
+
+		Context("when there is an address distance", func() {
+			It("should order peers from nearest to farthest", func() {
+				local := net.IPv4(10, 0, 0, 0).Mask(net.CIDRMask(16, 32))
+				t1, _ := newTransport(transport.DefaultOptions().
+					WithAddressDistance(func(remote net.IP) int {
+						if remote.Mask(net.CIDRMask(16, 32)).Equal(local) {
+							return 0
+						}
+						return 1
+					}).
+					WithPort(3438))
+
+				far, near, named, unknown := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(far, wire.NewUnsignedAddress(wire.TCP, "192.168.0.1:3000", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(near, wire.NewUnsignedAddress(wire.TCP, "10.0.1.1:3000", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(named, wire.NewUnsignedAddress(wire.TCP, "example.com:3000", uint64(time.Now().UnixNano())))
+
+				Expect(t1.NearestPeers([]id.Signatory{unknown, named, far, near})).To(Equal([]id.Signatory{near, far, unknown, named}))
+
+				// Without a distance, the order is kept.
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3439))
+				t2.Table().AddPeer(far, wire.NewUnsignedAddress(wire.TCP, "192.168.0.1:3000", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(near, wire.NewUnsignedAddress(wire.TCP, "10.0.1.1:3000", uint64(time.Now().UnixNano())))
+				Expect(t2.NearestPeers([]id.Signatory{far, near})).To(Equal([]id.Signatory{far, near}))
+			})
+		})
+	})
+
+	Describe("Compression", func() {
+		Context("when both peers negotiate compression", func() {
+			It("should deliver compressed messages", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				compressions := []codec.Compression{codec.CompressionFlate}
+				t1, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithPort(3370))
+				t2, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithPort(3371))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3371", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan wire.Packet, 1)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- packet
+					return nil
+				})
+				data := bytes.Repeat([]byte("hello "), 500)
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: data})).To(Succeed())
+
+				var packet wire.Packet
+				Eventually(received, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal(data))
+
+				c, ok := t1.Compression(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(c).To(Equal(codec.CompressionFlate))
+				c, ok = t2.Compression(t1.Self())
+				Expect(ok).To(BeTrue())
+				Expect(c).To(Equal(codec.CompressionFlate))
+			})
+		})
+
+		Context("when the connection is closed", func() {
+			It("should forget the negotiated compression", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				compressions := []codec.Compression{codec.CompressionFlate}
+				t1, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithClientTimeout(200 * time.Millisecond).WithPort(3474))
+				t2, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithPort(3475))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3475", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+				_, ok := t1.Compression(t2.Self())
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when messages override the compression threshold", func() {
+			It("should deliver messages whether or not they are compressed", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				compressions := []codec.Compression{codec.CompressionFlate}
+				compressionOpts := codec.DefaultCompressionOptions().WithThreshold(1024)
+				t1, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithCompressionOptions(compressionOpts).WithPort(3447))
+				t2, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithPort(3448))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3448", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan wire.Packet, 4)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- packet
+					return nil
+				})
+				small := bytes.Repeat([]byte("hello "), 10)
+				large := bytes.Repeat([]byte("hello "), 500)
+				msgs := []wire.Msg{
+					{Data: small},
+					wire.Msg{Data: small}.WithCompression(true),
+					{Data: large},
+					wire.Msg{Data: large}.WithCompression(false),
+				}
+				for _, msg := range msgs {
+					Expect(t1.Send(ctx, t2.Self(), msg)).To(Succeed())
+				}
+				for _, msg := range msgs {
+					var packet wire.Packet
+					Eventually(received, 5*time.Second).Should(Receive(&packet))
+					Expect(packet.Msg.Data).To(Equal(msg.Data))
+					Expect(packet.Msg.Flags).To(Equal(msg.Flags))
+				}
+			})
+		})
+	})
+
+	Describe("Metadata", func() {
+		Context("when both peers exchange metadata", func() {
+			It("should pass the metadata of the remote peer to the callback", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				metadata1, metadata2 := make(chan []byte, 1), make(chan []byte, 1)
+				onMetadata := func(metadata chan []byte) func(id.Signatory, []byte) error {
+					return func(_ id.Signatory, m []byte) error {
+						select {
+						case metadata <- m:
+						default:
+						}
+						return nil
+					}
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithMetadata([]byte("v1")).WithOnMetadata(onMetadata(metadata1)).WithPort(3372))
+				t2, _ := newTransport(transport.DefaultOptions().WithMetadata([]byte("v2")).WithOnMetadata(onMetadata(metadata2)).WithPort(3373))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3373", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				Expect(<-metadata1).To(Equal([]byte("v2")))
+				Expect(<-metadata2).To(Equal([]byte("v1")))
+			})
+		})
+
+		Context("when the max metadata size is larger than the handshake limit", func() {
+			It("should reject larger metadata before allocating it", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				handshakeErrs := make(chan error, 1)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceHandshakeDone && event.Err != nil {
+						select {
+						case handshakeErrs <- event.Err:
+						default:
+						}
+					}
+				}
+				opts1 := transport.DefaultOptions().WithOnMetadata(func(id.Signatory, []byte) error { return nil }).WithTracer(tracer)
+				opts1 = opts1.WithMaxMetadataSize(8192).WithMaxHandshakeMsgSize(256)
+				t1, _ := newTransport(opts1.WithPort(3476))
+				t2, _ := newTransport(transport.DefaultOptions().WithMetadata(make([]byte, 512)).WithPort(3477))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3476", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+				defer sendCancel()
+				_ = t2.Send(sendCtx, t1.Self(), wire.Msg{Data: []byte("hello")})
+				var err error
+				Eventually(handshakeErrs, 5*time.Second).Should(Receive(&err))
+				Expect(errors.Is(err, handshake.ErrMetadataTooLarge)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Shutting down", func() {
+		Context("when messages are sent concurrently with shutdown", func() {
+			It("should not panic", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+
+				t1, _ := newTransport(transport.DefaultOptions().WithSendGoodbye(true).WithPort(3374))
+				t2, _ := newTransport(transport.DefaultOptions().WithSendGoodbye(true).WithPort(3375))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3375", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3374", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error { return nil })
+
+				wg := new(sync.WaitGroup)
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						for j := 0; j < 100; j++ {
+							sendCtx, sendCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+							from, to := t1, t2
+							if i%2 == 1 {
+								from, to = t2, t1
+							}
+							// Errors are expected once shutdown has started.
+							_ = from.Send(sendCtx, to.Self(), wire.Msg{Data: []byte("hello")})
+							sendCancel()
+							if i%4 == 0 {
+								from.Link(to.Self())
+								from.Unlink(to.Self())
+							}
+						}
+					}(i)
+				}
+
+				time.Sleep(100 * time.Millisecond)
+				cancel()
+
+				done := make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(done)
+				}()
+				Eventually(done, 30*time.Second).Should(BeClosed())
+			})
+		})
+	})
+
+	Describe("Custom listeners", func() {
+		Context("when a listen function is set", func() {
+			It("should accept connections from the listener", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				listened := make(chan string, 1)
+				accepted := make(chan struct{}, 1)
+				listen := func(ctx context.Context, addr string) (net.Listener, error) {
+					listened <- addr
+					listener, err := new(net.ListenConfig).Listen(ctx, "tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					return &notifyListener{Listener: listener, accepted: accepted}, nil
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithListen(listen).WithPort(3376))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3377))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3376", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t1.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(<-listened).To(Equal(net.JoinHostPort(transport.DefaultHost, "3376")))
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+				Expect(accepted).To(Receive())
+			})
+		})
+	})
+
+	Describe("Custom dialers", func() {
+		Context("when a dial function is set", func() {
+			It("should send messages over the dialed connections", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				listener := newPipeListener()
+				listen := func(context.Context, string) (net.Listener, error) {
+					return listener, nil
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithListen(listen))
+				t2, _ := newTransport(transport.DefaultOptions().WithDialOptions(tcp.DefaultDialOptions().WithDial(listener.dial)).WithListen(func(context.Context, string) (net.Listener, error) {
+					return newPipeListener(), nil
+				}))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "in-memory:1", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t1.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+			})
+		})
+	})
+
+	Describe("Probing", func() {
+		Context("when the remote peer is reachable", func() {
+			It("should report the remote peer as reachable", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3378))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3379))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3379", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				var result transport.ProbeResult
+				Eventually(func() error {
+					var err error
+					result, err = t1.Probe(ctx, t2.Self())
+					return err
+				}, 5*time.Second).Should(Succeed())
+				Expect(result.Reachable).To(BeTrue())
+				Expect(result.Connected).To(BeFalse())
+				Expect(result.RTT).To(BeNumerically(">", 0))
+				Expect(t1.IsConnected(t2.Self())).To(BeFalse())
+
+				_, ok := t1.PreferredAddress(t2.Self())
+				Expect(ok).To(BeTrue())
+			})
+		})
+
+		Context("when the remote peer is already connected", func() {
+			It("should not dial the remote peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3380))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3381))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3381", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Link(t2.Self())
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error { return nil })
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				result, err := t1.Probe(ctx, t2.Self())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result).To(Equal(transport.ProbeResult{Reachable: true, Connected: true}))
+			})
+		})
+
+		Context("when the remote peer is unreachable", func() {
+			It("should return an error promptly", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3382))
+				remote := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "localhost:3383", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+
+				start := time.Now()
+				result, err := t1.Probe(ctx, remote)
+				Expect(err).To(HaveOccurred())
+				Expect(result.Reachable).To(BeFalse())
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			})
+		})
+	})
+
+	Describe("Key rotation", func() {
+		Context("when a remote peer has rotated its key", func() {
+			It("should reach the remote peer by its previous signatory", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				previous, current := id.NewPrivKey(), id.NewPrivKey()
+				t1, _ := newTransport(transport.DefaultOptions().WithRotation().WithPort(3384))
+				t2 := newTransportWithKey(transport.DefaultOptions().WithRotation(previous).WithPort(3385), current)
+				t1.Table().AddPeer(previous.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3385", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, previous.Signatory(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				alias, ok := t1.Table().Alias(previous.Signatory())
+				Expect(ok).To(BeTrue())
+				Expect(alias).To(Equal(current.Signatory()))
+				_, ok = t1.Table().PeerAddress(current.Signatory())
+				Expect(ok).To(BeTrue())
+
+				// Later messages are sent to the current signatory.
+				Expect(t1.Send(ctx, previous.Signatory(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+			})
+		})
+	})
+
+	Describe("Capacity", func() {
+		Context("when connected to the max number of remote peers", func() {
+			It("should refuse to connect to new remote peers", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithMaxConns(1).WithPort(3388))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3389))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3390))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3389", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(t3.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3390", uint64(time.Now().UnixNano())))
+				t3.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3388", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				go t3.Run(ctx)
+
+				Expect(t1.AtCapacity()).To(BeFalse())
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(t1.AtCapacity, 5*time.Second).Should(BeTrue())
+
+				// Outbound connections to new remote peers are refused.
+				err := t1.Send(ctx, t3.Self(), wire.Msg{Data: []byte("hello")})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorAtCapacity))
+				Expect(errors.Is(err, transport.ErrAtCapacity)).To(BeTrue())
+
+				// Inbound connections from new remote peers are dropped.
+				self3 := t3.Self()
+				received := make(chan struct{}, 1)
+				t1.Receive(ctx, func(from id.Signatory, _ wire.Packet) error {
+					if from.Equal(&self3) {
+						received <- struct{}{}
+					}
+					return nil
+				})
+				sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+				defer sendCancel()
+				t3.Send(sendCtx, t1.Self(), wire.Msg{Data: []byte("hello")})
+				Consistently(received, time.Second).ShouldNot(Receive())
+				Expect(t1.IsConnected(t3.Self())).To(BeFalse())
+
+				// Remote peers that are already connected are unaffected.
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello again")})).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Capacity policy", func() {
+		Context("when preferring known remote peers at capacity", func() {
+			It("should evict an unknown remote peer for a known remote peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				opts := transport.DefaultOptions().WithMaxConns(1).WithCapacityPolicy(transport.CapacityPreferKnown)
+				t1, _ := newTransport(opts.WithPort(3391))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3392))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3393))
+				t1.Table().AddPeer(t3.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3393", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3391", uint64(time.Now().UnixNano())))
+				t3.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3391", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				go t3.Run(ctx)
+
+				received := make(chan id.Signatory, 2)
+				t1.Receive(ctx, func(from id.Signatory, _ wire.Packet) error {
+					received <- from
+					return nil
+				})
+
+				// The unknown remote peer is admitted while there is room.
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(t2.Self())))
+				Eventually(t1.AtCapacity, 5*time.Second).Should(BeTrue())
+
+				// The known remote peer evicts it.
+				Expect(t3.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(t3.Self())))
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+				Expect(t1.IsConnected(t3.Self())).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Identity mismatch", func() {
+		Context("when the address of a remote peer presents an unexpected signatory", func() {
+			It("should refuse the connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3394))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3395))
+				expected := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(expected, wire.NewUnsignedAddress(wire.TCP, "localhost:3395", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				// Probe until the remote peer is listening.
+				Eventually(func() bool {
+					_, err := t1.Probe(ctx, expected)
+					return errors.Is(err, transport.ErrIdentityMismatch)
+				}, 5*time.Second).Should(BeTrue())
+
+				err := t1.Send(ctx, expected, wire.Msg{Data: []byte("hello")})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorIdentityMismatch))
+				Expect(errors.Is(err, transport.ErrIdentityMismatch)).To(BeTrue())
+				Consistently(received, time.Second).ShouldNot(Receive())
+				Expect(t1.IsConnected(expected)).To(BeFalse())
+				Expect(t1.IsConnected(t2.Self())).To(BeFalse())
+			})
+
+			It("should fail sends once the dial has detected the mismatch", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3396))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3397))
+				expected := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(expected, wire.NewUnsignedAddress(wire.TCP, "localhost:3397", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Eventually(func() bool {
+					sendCtx, sendCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+					defer sendCancel()
+					err := t1.Send(sendCtx, expected, wire.Msg{Data: []byte("hello")})
+					return errors.Is(err, transport.ErrIdentityMismatch)
+				}, 5*time.Second, 200*time.Millisecond).Should(BeTrue())
+
+				// Once the address changes, the mismatch is forgotten.
+				t1.Table().AddPeer(expected, wire.NewUnsignedAddress(wire.TCP, "localhost:3398", uint64(time.Now().UnixNano())))
+				sendCtx, sendCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer sendCancel()
+				err := t1.Send(sendCtx, expected, wire.Msg{Data: []byte("hello")})
+				Expect(errors.Is(err, transport.ErrIdentityMismatch)).To(BeFalse())
+			})
+
+			It("should forget the mismatch once the TTL has passed", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				fake := clock.NewFake(time.Now())
+				t1, _ := newTransport(transport.DefaultOptions().WithClock(fake).WithMismatchTTL(time.Minute).WithPort(3478))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3479))
+				expected := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(expected, wire.NewUnsignedAddress(wire.TCP, "localhost:3479", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Eventually(func() bool {
+					_, err := t1.Probe(ctx, expected)
+					return errors.Is(err, transport.ErrIdentityMismatch)
+				}, 5*time.Second).Should(BeTrue())
+				sendCtx, sendCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer sendCancel()
+				err := t1.Send(sendCtx, expected, wire.Msg{Data: []byte("hello")})
+				Expect(errors.Is(err, transport.ErrIdentityMismatch)).To(BeTrue())
+
+				fake.Advance(2 * time.Minute)
+				err = t1.Send(sendCtx, expected, wire.Msg{Data: []byte("hello")})
+				Expect(errors.Is(err, transport.ErrIdentityMismatch)).To(BeFalse())
+			})
+		})
+
+		Context("when the remote peer connects with the expected signatory", func() {
+			It("should forget the mismatch", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				ctx2, cancel2 := context.WithCancel(ctx)
+				defer cancel2()
+				ctx3, cancel3 := context.WithCancel(ctx)
+				defer cancel3()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithServerTimeout(time.Second).WithPort(3480))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3481))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3482))
+				// The address of t2 in the table of t1 is the address of t3.
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3482", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3480", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx2)
+				go t3.Run(ctx3)
+
+				Eventually(func() bool {
+					_, err := t1.Probe(ctx, t2.Self())
+					return errors.Is(err, transport.ErrIdentityMismatch)
+				}, 5*time.Second).Should(BeTrue())
+				cancel3()
+
+				// The remote peer connects, and then goes away again.
+				Expect(t2.Send(ctx2, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+				cancel2()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+
+				sendCtx, sendCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer sendCancel()
+				err := t1.Send(sendCtx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				Expect(errors.Is(err, transport.ErrIdentityMismatch)).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Sessions", func() {
+		Context("when a connection is established", func() {
+			It("should expose the negotiated parameters to handlers", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				compressions := []codec.Compression{codec.CompressionFlate}
+				var t1 *transport.Transport
+				sessions1 := make(chan transport.Session, 1)
+				onConnected := func(remote id.Signatory, _ string) {
+					session, ok := t1.Session(remote)
+					Expect(ok).To(BeTrue())
+					sessions1 <- session
+				}
+				t1, _ = newTransport(transport.DefaultOptions().WithCompressions(compressions).WithNegotiateVersion(true).WithMetadata([]byte("v1")).WithOnConnected(onConnected).WithPort(3399))
+				t2, _ := newTransport(transport.DefaultOptions().WithCompressions(compressions).WithNegotiateVersion(true).WithMetadata([]byte("v2")).WithPort(3400))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3400", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				sessions2 := make(chan transport.Session, 1)
+				t2.Receive(ctx, func(from id.Signatory, _ wire.Packet) error {
+					session, ok := t2.Session(from)
+					Expect(ok).To(BeTrue())
+					sessions2 <- session
+					return nil
+				})
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+
+				var session transport.Session
+				Eventually(sessions1, 5*time.Second).Should(Receive(&session))
+				Expect(session.Remote).To(Equal(t2.Self()))
+				Expect(session.Addr).To(HaveSuffix(":3400"))
+				Expect(session.Direction).To(Equal(transport.DirectionOutbound))
+				Expect(session.Compression).To(Equal(codec.CompressionFlate))
+				Expect(session.Version).To(Equal(wire.MsgVersionLatest))
+				Expect(session.Metadata).To(Equal([]byte("v2")))
+				Expect(session.Established.IsZero()).To(BeFalse())
+
+				Eventually(sessions2, 5*time.Second).Should(Receive(&session))
+				Expect(session.Remote).To(Equal(t1.Self()))
+				Expect(session.Direction).To(Equal(transport.DirectionInbound))
+				Expect(session.Compression).To(Equal(codec.CompressionFlate))
+				Expect(session.Version).To(Equal(wire.MsgVersionLatest))
+				Expect(session.Metadata).To(Equal([]byte("v1")))
+
+				// There is no Session without a connection.
+				_, ok := t1.Session(id.NewPrivKey().Signatory())
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when versions are not negotiated", func() {
+			It("should not send chunked messages as chunks", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3483))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3484))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3484", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan wire.Packet, 1)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- packet
+					return nil
+				})
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				data := bytes.Repeat([]byte("hello"), 1024)
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: data}.Chunked())).To(Succeed())
+
+				var packet wire.Packet
+				Eventually(received, 5*time.Second).Should(Receive(&packet))
+				Expect(packet.Body).To(BeNil())
+				Expect(packet.Msg.Data).To(Equal(data))
+				session, ok := t1.Session(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(session.Version).To(Equal(wire.MsgVersion4))
+			})
+		})
+	})
+
+	Describe("Address refresh", func() {
+		Context("when the address of a remote peer is stale", func() {
+			It("should retry with the new address from the table", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				var t1 *transport.Transport
+				var t2 *transport.Transport
+				dialed := make(chan string, 16)
+				updated := uint32(0)
+				tracer := func(event transport.TraceEvent) {
+					switch event.Stage {
+					case transport.TraceDialStart:
+						dialed <- event.Addr
+					case transport.TraceDialFailed:
+						// The remote peer re-announces itself on a new address
+						// after the stale address has failed.
+						if atomic.CompareAndSwapUint32(&updated, 0, 1) {
+							t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3402", uint64(time.Now().UnixNano())))
+						}
+					}
+				}
+				t1, _ = newTransport(transport.DefaultOptions().WithTracer(tracer).WithPort(3401))
+				t2, _ = newTransport(transport.DefaultOptions().WithPort(3402))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3403", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 10*time.Second).Should(Receive())
+
+				Expect(<-dialed).To(Equal("localhost:3403"))
+				Expect(<-dialed).To(Equal("localhost:3402"))
+			})
+		})
+	})
+
+	Describe("Listen addresses", func() {
+		Context("when listening on several addresses", func() {
+			It("should accept connections on all of them and count them per address", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3404).WithListenAddresses("localhost:3405"))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3406))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3407))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3404", uint64(time.Now().UnixNano())))
+				t3.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3405", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				go t3.Run(ctx)
+				Expect(t1.ListenAddresses()).To(Equal([]string{"localhost:3404", "localhost:3405"}))
+
+				received := make(chan id.Signatory, 2)
+				t1.Receive(ctx, func(from id.Signatory, _ wire.Packet) error {
+					received <- from
+					return nil
+				})
+
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(t2.Self())))
+				Expect(t3.Send(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(t3.Self())))
+
+				listeners := t1.Stats().Listeners
+				Expect(listeners).To(HaveLen(2))
+				for i, addr := range t1.ListenAddresses() {
+					Expect(listeners[i].Addr).To(Equal(addr))
+					Expect(listeners[i].Accepted).To(BeNumerically(">=", 1))
+					Expect(listeners[i].Active).To(BeNumerically(">=", 1))
+				}
+			})
+		})
+	})
+
+	Describe("Spans", func() {
+		Context("when sending to a remote peer that is not connected", func() {
+			It("should start spans for sending, dialing, and handshaking", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				spans1, spans2 := newSpanRecorder(), newSpanRecorder()
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3408).WithSpanStarter(spans1))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3409).WithSpanStarter(spans2))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3408", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t1.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				sendCtx, sendCancel := context.WithTimeout(context.WithValue(ctx, spanKey{}, "root"), 5*time.Second)
+				defer sendCancel()
+				Expect(t2.Send(sendCtx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				// Outbound spans are children of the span passed to Send.
+				Eventually(spans2.finished, 5*time.Second).Should(ConsistOf(
+					span{name: transport.SpanSend, parent: "root"},
+					span{name: transport.SpanDial, parent: transport.SpanSend},
+					span{name: transport.SpanHandshake, parent: transport.SpanSend},
+				))
+				Eventually(spans1.finished, 5*time.Second).Should(ConsistOf(
+					span{name: transport.SpanHandshake},
+				))
+			})
+		})
+	})
+
+	Describe("Address resolver", func() {
+		Context("when the remote peer is not in the table", func() {
+			It("should resolve the address, and add it to the table", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3410))
+				self := t1.Self()
+				resolved := int64(0)
+				resolver := func(ctx context.Context, remote id.Signatory) (wire.Address, error) {
+					atomic.AddInt64(&resolved, 1)
+					if !remote.Equal(&self) {
+						return wire.Address{}, errors.New("not found")
+					}
+					return wire.NewUnsignedAddress(wire.TCP, "localhost:3410", uint64(time.Now().UnixNano())), nil
+				}
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3411).WithAddressResolver(resolver))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t1.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				for i := 0; i < 2; i++ {
+					sendCtx, sendCancel := context.WithTimeout(ctx, 5*time.Second)
+					Expect(t2.Send(sendCtx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+					sendCancel()
+					Eventually(received, 5*time.Second).Should(Receive())
+				}
+				Expect(atomic.LoadInt64(&resolved)).To(Equal(int64(1)))
+				addr, ok := t2.Table().PeerAddress(t1.Self())
+				Expect(ok).To(BeTrue())
+				Expect(addr.Value).To(Equal("localhost:3410"))
+
+				// Remote peers that cannot be resolved are unknown.
+				remote := id.NewPrivKey().Signatory()
+				err := t2.Send(ctx, remote, wire.Msg{})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorUnknownPeer))
+				_, ok = t2.Table().PeerAddress(remote)
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Connection lifetimes", func() {
+		Context("when the last connection with a remote peer is closed", func() {
+			It("should notify the session and the time at which it was closed", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				type closedSession struct {
+					session transport.Session
+					closed  time.Time
+				}
+				closed := make(chan closedSession, 1)
+				onClosed := func(session transport.Session, at time.Time) {
+					select {
+					case closed <- closedSession{session, at}:
+					default:
+					}
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3412).WithOnClosed(onClosed))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3413))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3413", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+				session, ok := t1.Session(t2.Self())
+				Expect(ok).To(BeTrue())
+				Consistently(closed, 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(t1.Goodbye(ctx, t2.Self(), wire.GoodbyeMaintenance)).To(Succeed())
+				var c closedSession
+				Eventually(closed, 5*time.Second).Should(Receive(&c))
+				Expect(c.session.Remote).To(Equal(t2.Self()))
+				Expect(c.session.ID).To(Equal(session.ID))
+				Expect(c.session.Established).To(Equal(session.Established))
+				Expect(c.closed.Sub(c.session.Established)).To(BeNumerically(">=", 100*time.Millisecond))
+			})
+		})
+	})
+
+	Describe("Connection IDs", func() {
+		Context("when a connection is established", func() {
+			It("should use the same connection ID for traces, spans, callbacks, and the session", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				authorized := make(chan transport.TraceID, 1)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceAuthorized && event.Err == nil {
+						select {
+						case authorized <- event.ID:
+						default:
+						}
+					}
+				}
+				opened := make(chan transport.ConnID, 1)
+				onOpened := func(session transport.Session) {
+					select {
+					case opened <- session.ID:
+					default:
+					}
+				}
+				spans := newConnIDRecorder()
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3414).WithTracer(tracer).WithSpanStarter(spans).WithOnOpened(onOpened))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3415))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3415", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+				session, ok := t1.Session(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(session.ID).ToNot(BeZero())
+
+				var traceID transport.TraceID
+				Eventually(authorized, 5*time.Second).Should(Receive(&traceID))
+				Expect(traceID).To(Equal(session.ID))
+				Eventually(spans.connIDs, 5*time.Second).Should(ContainElement(session.ID))
+				Expect(opened).To(Receive(Equal(session.ID)))
+			})
+		})
+	})
+
+	Describe("Static tables", func() {
+		Context("when the remote peers are in a static table", func() {
+			It("should send, re-use connections, and notify connections", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				privKey1, privKey2 := id.NewPrivKey(), id.NewPrivKey()
+				self1, self2 := privKey1.Signatory(), privKey2.Signatory()
+				addrs := map[id.Signatory]wire.Address{
+					self1: wire.NewUnsignedAddress(wire.TCP, "localhost:3416", 0),
+					self2: wire.NewUnsignedAddress(wire.TCP, "localhost:3417", 0),
+				}
+				newStaticTransport := func(opts transport.Options, privKey *id.PrivKey) *transport.Transport {
+					self := privKey.Signatory()
+					h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
+					client := channel.NewClient(channel.DefaultOptions(), self)
+					return transport.New(opts, self, client, h, dht.NewStaticTable(self, addrs))
+				}
+
+				connected := make(chan id.Signatory, 2)
+				onOpened := func(session transport.Session) {
+					if session.Direction == transport.DirectionOutbound {
+						connected <- session.Remote
+					}
+				}
+				t1 := newStaticTransport(transport.DefaultOptions().WithPort(3416).WithOnOpened(onOpened), privKey1)
+				t2 := newStaticTransport(transport.DefaultOptions().WithPort(3417), privKey2)
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				t1.Link(self2)
+				defer t1.Unlink(self2)
+				for i := 0; i < 2; i++ {
+					sendCtx, sendCancel := context.WithTimeout(ctx, 5*time.Second)
+					Expect(t1.Send(sendCtx, self2, wire.Msg{Data: []byte("hello")})).To(Succeed())
+					sendCancel()
+					Eventually(received, 5*time.Second).Should(Receive())
+				}
+				Eventually(connected, 5*time.Second).Should(Receive(Equal(self2)))
+				Consistently(connected, 100*time.Millisecond).ShouldNot(Receive())
+				Expect(t1.IsConnected(self2)).To(BeTrue())
+
+				// Remote peers that are not in the static table are unknown.
+				remote := id.NewPrivKey().Signatory()
+				err := t1.Send(ctx, remote, wire.Msg{})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorUnknownPeer))
+			})
+		})
+	})
+
+	Describe("Budgets", func() {
+		Context("when a batch of sends exhausts its budget", func() {
+			It("should skip remote peers that are not connected", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3418).WithDialTimeout(func(int) time.Duration { return 50 * time.Millisecond }))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3419))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3419", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 2)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				// Nobody is listening on the network addresses of these
+				// remote peers.
+				unreachable1, unreachable2 := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(unreachable1, wire.NewUnsignedAddress(wire.TCP, "localhost:3420", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(unreachable2, wire.NewUnsignedAddress(wire.TCP, "localhost:3420", uint64(time.Now().UnixNano())))
+
+				budget := transport.NewBudget(3, 0)
+				batchCtx := transport.WithBudget(ctx, budget)
+
+				sendCtx, sendCancel := context.WithTimeout(batchCtx, time.Second)
+				defer sendCancel()
+				Expect(t1.Send(sendCtx, unreachable1, wire.Msg{})).ToNot(Succeed())
+				Eventually(budget.Remaining, 5*time.Second).Should(BeZero())
+
+				err := t1.Send(batchCtx, unreachable2, wire.Msg{})
+				sendErr := new(transport.SendError)
+				Expect(errors.As(err, &sendErr)).To(BeTrue())
+				Expect(sendErr.Kind).To(Equal(transport.SendErrorBudgetExhausted))
+				Expect(errors.Is(err, transport.ErrBudgetExhausted)).To(BeTrue())
+				Expect(budget.Skipped()).To(Equal([]id.Signatory{unreachable2}))
+
+				// Remote peers that are already connected do not need to be
+				// dialed, so they are still sent to.
+				Expect(t1.Send(batchCtx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+			})
+		})
+
+		Context("when a send exhausts its budget", func() {
+			It("should dial exactly as many times as the budget allows", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				attempts := int64(0)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceDialFailed {
+						atomic.AddInt64(&attempts, 1)
+					}
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3496).WithTracer(tracer).WithDialTimeout(func(int) time.Duration { return 50 * time.Millisecond }))
+				go t1.Run(ctx)
+
+				// Nobody is listening on the network address of the remote
+				// peer.
+				unreachable := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:3497", uint64(time.Now().UnixNano())))
+
+				budget := transport.NewBudget(3, 0)
+				sendCtx, sendCancel := context.WithTimeout(transport.WithBudget(ctx, budget), 5*time.Second)
+				defer sendCancel()
+				Expect(t1.Send(sendCtx, unreachable, wire.Msg{})).ToNot(Succeed())
+				Eventually(func() int64 { return atomic.LoadInt64(&attempts) }, 5*time.Second).Should(Equal(int64(3)))
+				Consistently(func() int64 { return atomic.LoadInt64(&attempts) }, 500*time.Millisecond).Should(Equal(int64(3)))
+				Expect(budget.Remaining()).To(BeZero())
+			})
+
+			It("should dial exactly as many times as the budget allows across an address refresh", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				var t1 *transport.Transport
+				unreachable := id.NewPrivKey().Signatory()
+				attempts := int64(0)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceDialFailed {
+						// The remote peer re-announces itself on a new
+						// address (that nobody is listening on either) after
+						// the first attempt has failed.
+						if atomic.AddInt64(&attempts, 1) == 1 {
+							t1.Table().AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:3498", uint64(time.Now().UnixNano())))
+						}
+					}
+				}
+				t1, _ = newTransport(transport.DefaultOptions().WithPort(3499).WithTracer(tracer).WithDialTimeout(func(int) time.Duration { return 50 * time.Millisecond }))
+				go t1.Run(ctx)
+				t1.Table().AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:3497", uint64(time.Now().UnixNano())))
+
+				budget := transport.NewBudget(3, 0)
+				sendCtx, sendCancel := context.WithTimeout(transport.WithBudget(ctx, budget), 5*time.Second)
+				defer sendCancel()
+				Expect(t1.Send(sendCtx, unreachable, wire.Msg{})).ToNot(Succeed())
+				Eventually(func() int64 { return atomic.LoadInt64(&attempts) }, 5*time.Second).Should(Equal(int64(3)))
+				Consistently(func() int64 { return atomic.LoadInt64(&attempts) }, 500*time.Millisecond).Should(Equal(int64(3)))
+				Expect(budget.Remaining()).To(BeZero())
+			})
+		})
+	})
+
+	Describe("Ban draining", func() {
+		Context("when banning a connected remote peer", func() {
+			It("should deliver sent messages, say goodbye, and make the remote peer back off", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				dials := int64(0)
+				tracer := func(event transport.TraceEvent) {
+					if event.Stage == transport.TraceDialStart {
+						atomic.AddInt64(&dials, 1)
+					}
+				}
+				disconnected := make(chan transport.DisconnectEvent, 1)
+				onDisconnected := func(event transport.DisconnectEvent) {
+					select {
+					case disconnected <- event:
+					default:
+					}
+				}
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3421).WithBanDrainTimeout(time.Second))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3422).WithClientTimeout(2 * time.Second).WithBannedBackoff(transport.DefaultBannedBackoff).WithTracer(tracer).WithOnDisconnected(onDisconnected))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3422", uint64(time.Now().UnixNano())))
+				t2.Table().AddPeer(t1.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3421", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan byte, 10)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					if len(packet.Msg.Data) == 1 {
+						received <- packet.Msg.Data[0]
+					}
+					return nil
+				})
+
+				sendCtx, sendCancel := context.WithTimeout(ctx, 5*time.Second)
+				defer sendCancel()
+				Expect(t2.Send(sendCtx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				n := 3
+				for i := 0; i < n; i++ {
+					Expect(t1.Send(sendCtx, t2.Self(), wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+				}
+				t1.Ban(t2.Self(), time.Minute)
+
+				for i := 0; i < n; i++ {
+					var b byte
+					Eventually(received, 5*time.Second).Should(Receive(&b))
+					Expect(b).To(Equal(byte(i)))
+				}
+				var event transport.DisconnectEvent
+				Eventually(disconnected, 5*time.Second).Should(Receive(&event))
+				Expect(event.Reason).To(Equal(wire.GoodbyeBanned))
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+
+				// Once its side of the connection has timed out, the remote
+				// peer does not re-dial the peer that banned it.
+				Eventually(func() bool { return t2.IsConnected(t1.Self()) }, 5*time.Second).Should(BeFalse())
+				before := atomic.LoadInt64(&dials)
+				retryCtx, retryCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+				defer retryCancel()
+				_ = t2.Send(retryCtx, t1.Self(), wire.Msg{})
+				Expect(atomic.LoadInt64(&dials)).To(Equal(before))
+			})
+		})
+	})
+
+	Describe("TCP info", func() {
+		Context("when connected to a remote peer", func() {
+			It("should return the TCP info of the connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3423))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3424))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3424", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				_, err := t1.TCPInfo(t2.Self())
+				Expect(err).To(HaveOccurred())
+
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				Eventually(func() error {
+					_, err := t1.TCPInfo(t2.Self())
+					if runtime.GOOS != "linux" && errors.Is(err, tcp.ErrTCPInfoUnsupported) {
+						return nil
+					}
+					return err
+				}, 5*time.Second).Should(Succeed())
+			})
+		})
+	})
+
+	Describe("Tags", func() {
+		Context("when broadcasting to tagged connections", func() {
+			It("should only send to the remote peers that are selected", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithMaxTags(2).WithPort(3427))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3428))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3429))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3428", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(t3.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3429", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				go t3.Run(ctx)
+
+				Expect(t1.TagConnection(t2.Self(), "validator")).ToNot(Succeed())
+
+				received := make(chan id.Signatory, 10)
+				for _, t := range []*transport.Transport{t2, t3} {
+					t := t
+					t.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+						if string(packet.Msg.Data) == "broadcast" {
+							received <- t.Self()
+						}
+						return nil
+					})
+				}
+				for _, remote := range []id.Signatory{t2.Self(), t3.Self()} {
+					remote := remote
+					t1.Link(remote)
+					defer t1.Unlink(remote)
+					go func() {
+						_ = t1.Send(ctx, remote, wire.Msg{Data: []byte("hello")})
+					}()
+					Eventually(func() bool { return t1.IsConnected(remote) }, 5*time.Second).Should(BeTrue())
+				}
+
+				Expect(t1.TagConnection(t2.Self(), "validator", "full-node")).To(Succeed())
+				Expect(t1.TagConnection(t3.Self(), "full-node")).To(Succeed())
+				Expect(errors.Is(t1.TagConnection(t2.Self(), "archive"), transport.ErrTooManyTags)).To(BeTrue())
+				Expect(t1.Tags(t2.Self())).To(Equal([]string{"full-node", "validator"}))
+
+				// Remote peers are returned in a stable order.
+				peers := t1.ConnectedPeers()
+				Expect(sort.SliceIsSorted(peers, func(i, j int) bool {
+					return string(peers[i][:]) < string(peers[j][:])
+				})).To(BeTrue())
+				Expect(t1.TaggedPeers(transport.HasTag("full-node"))).To(Equal(peers))
+
+				Expect(t1.BroadcastTagged(ctx, transport.AllOf(transport.HasTag("validator"), transport.HasTag("full-node")), wire.Msg{Data: []byte("broadcast")})).To(BeEmpty())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(t2.Self())))
+				Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(t1.BroadcastTagged(ctx, transport.AnyOf(transport.HasTag("validator"), transport.HasTag("full-node")), wire.Msg{Data: []byte("broadcast")})).To(BeEmpty())
+				Eventually(received, 5*time.Second).Should(Receive())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				t1.UntagConnection(t2.Self(), "validator")
+				Expect(t1.TaggedPeers(transport.HasTag("validator"))).To(BeEmpty())
+			})
+		})
+
+		Context("when a tagged connection is closed", func() {
+			It("should clear the tags", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3430))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3431))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3431", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				t1.Link(t2.Self())
+				go func() {
+					_ = t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+				Expect(t1.TagConnection(t2.Self(), "validator")).To(Succeed())
+
+				Expect(t1.Goodbye(ctx, t2.Self(), wire.GoodbyeMaintenance)).To(Succeed())
+				t1.Unlink(t2.Self())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+				Expect(t1.Tags(t2.Self())).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Batches", func() {
+		Context("when sending a batch of messages", func() {
+			It("should deliver each message separately, and in order", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithMaxBatchSize(1024).WithPort(3432))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3433))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3433", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan []byte, 100)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					Expect(packet.Msg.Type).ToNot(Equal(wire.MsgTypeBatch))
+					received <- packet.Msg.Data
+					return nil
+				})
+
+				msgs := make([]wire.Msg, 10)
+				for i := range msgs {
+					msgs[i] = wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}}
+				}
+				Expect(t1.SendBatch(ctx, t2.Self(), msgs)).To(Succeed())
+				for i := range msgs {
+					Eventually(received, 5*time.Second).Should(Receive(Equal([]byte{byte(i)})))
+				}
+
+				// Batches that are too large are not sent.
+				err := t1.SendBatch(ctx, t2.Self(), []wire.Msg{{Type: wire.MsgTypeSend, Data: make([]byte, 1024)}})
+				Expect(errors.Is(err, transport.ErrBatchTooLarge)).To(BeTrue())
+				Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+			})
+		})
+	})
+
+	Describe("Auto-scoring", func() {
+		newScoringTransport := func(opts transport.Options) (*transport.Transport, *scoringTable) {
+			privKey := id.NewPrivKey()
+			self := privKey.Signatory()
+			h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
+			client := channel.NewClient(channel.DefaultOptions(), self)
+			table := newScoringTable(dht.NewInMemTable(self))
+			return transport.New(opts, self, client, h, table), table
+		}
+
+		Context("when the table is a scorer", func() {
+			It("should record the outcomes of connecting to remote peers", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, table1 := newScoringTransport(transport.DefaultOptions().WithPort(3434))
+				t2, table2 := newScoringTransport(transport.DefaultOptions().WithPort(3435))
+				unreachable := id.NewPrivKey().Signatory()
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3435", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:3420", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() int { return table1.successes(t2.Self()) }, 5*time.Second).Should(BeNumerically(">", 0))
+				Eventually(func() int { return table2.successes(t1.Self()) }, 5*time.Second).Should(BeNumerically(">", 0))
+
+				go func() {
+					_ = t1.Send(ctx, unreachable, wire.Msg{Data: []byte("hello")})
+				}()
+				Eventually(func() int { return table1.failures(unreachable) }, 5*time.Second).Should(BeNumerically(">", 0))
+				Expect(table1.successes(unreachable)).To(Equal(0))
+			})
+		})
+
+		Context("when auto-scoring is disabled", func() {
+			It("should not record anything", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, table1 := newScoringTransport(transport.DefaultOptions().WithAutoScore(false).WithPort(3436))
+				t2, _ := newScoringTransport(transport.DefaultOptions().WithPort(3437))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3437", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+				Consistently(func() int { return table1.successes(t2.Self()) }, 100*time.Millisecond).Should(Equal(0))
+			})
+		})
+	})
+
+	Describe("Detaching", func() {
+		Context("when both peers detach their connection", func() {
+			It("should let the connection be used directly, and queue messages until it is reattached", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3440))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3441))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3441", uint64(time.Now().UnixNano())))
+				t1.Link(t2.Self())
+				t2.Link(t1.Self())
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan []byte, 10)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg.Data
+					return nil
+				})
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("before")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal([]byte("before"))))
+
+				// Only linked remote peers can be detached.
+				_, err := t1.Detach(ctx, id.NewPrivKey().Signatory())
+				Expect(err).To(HaveOccurred())
+
+				d1, err := t1.Detach(ctx, t2.Self())
+				Expect(err).ToNot(HaveOccurred())
+				d2, err := t2.Detach(ctx, t1.Self())
+				Expect(err).ToNot(HaveOccurred())
+
+				// The connection can be used directly while it is detached.
+				_, err = d1.Encoder()(d1.Conn(), []byte("direct"))
+				Expect(err).ToNot(HaveOccurred())
+				buf := make([]byte, 64)
+				n, err := d2.Decoder()(d2.Conn(), buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buf[:n]).To(Equal([]byte("direct")))
+
+				// Messages that are sent while detached are not written until
+				// the connection is reattached.
+				sent := make(chan error, 1)
+				go func() {
+					sent <- t1.Send(ctx, t2.Self(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("after")})
+				}()
+				Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(d2.Reattach(ctx)).To(Succeed())
+				Expect(d1.Reattach(ctx)).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal([]byte("after"))))
+				Eventually(sent).Should(Receive(BeNil()))
+			})
+		})
+	})
+
+	Describe("Announce address", func() {
+		Context("when the announce address is changed at runtime", func() {
+			It("should only accept addresses that can be dialed", func() {
+				t, _ := newTransport(transport.DefaultOptions().WithPort(3442).WithAnnounceAddress("203.0.113.1:4000"))
+				addr, ok := t.AnnounceAddress()
+				Expect(ok).To(BeTrue())
+				Expect(addr).To(Equal("203.0.113.1:4000"))
+				Expect(t.AnnouncePort()).To(Equal(uint16(4000)))
+
+				err := t.SetAnnounceAddress("[::]:4001")
+				Expect(errors.Is(err, transport.ErrInvalidAnnounceAddress)).To(BeTrue())
+				addr, _ = t.AnnounceAddress()
+				Expect(addr).To(Equal("203.0.113.1:4000"))
+
+				Expect(t.SetAnnounceAddress("node.example.com:4001")).To(Succeed())
+				Expect(t.AnnouncePort()).To(Equal(uint16(4001)))
+
+				// Removing the announce address falls back to the port of the
+				// Transport.
+				Expect(t.SetAnnounceAddress("")).To(Succeed())
+				_, ok = t.AnnounceAddress()
+				Expect(ok).To(BeFalse())
+				Expect(t.AnnouncePort()).To(Equal(uint16(3442)))
+			})
+		})
+	})
+
+	Describe("Flushing", func() {
+		Context("when flushing the messages sent to a remote peer", func() {
+			It("should return once they have been written", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3443))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3444))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3444", uint64(time.Now().UnixNano())))
+				t1.Link(t2.Self())
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan []byte, 10)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg.Data
+					return nil
+				})
+
+				// There is nothing to flush to a remote peer that has no
+				// Channel.
+				Expect(t1.FlushPeer(ctx, id.NewPrivKey().Signatory())).ToNot(Succeed())
+
+				for i := 0; i < 5; i++ {
+					Expect(t1.Send(ctx, t2.Self(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}})).To(Succeed())
+				}
+				flushCtx, flushCancel := context.WithTimeout(ctx, 5*time.Second)
+				defer flushCancel()
+				Expect(t1.FlushPeer(flushCtx, t2.Self())).To(Succeed())
+				for i := 0; i < 5; i++ {
+					Eventually(received, 5*time.Second).Should(Receive(Equal([]byte{byte(i)})))
+				}
+			})
+		})
+	})
+
+	Describe("Inbound sizes", func() {
+		Context("when receiving messages", func() {
+			It("should count their sizes overall, and for each remote peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3445))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3446))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3446", uint64(time.Now().UnixNano())))
+				t2.Link(t1.Self())
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 10)
+				t2.Receive(ctx, func(_ id.Signatory, packet wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+
+				_, ok := t2.InboundSizes(id.NewPrivKey().Signatory())
+				Expect(ok).To(BeFalse())
+
+				for i := 0; i < 3; i++ {
+					Expect(t1.Send(ctx, t2.Self(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: make([]byte, 1000)})).To(Succeed())
+					Eventually(received, 5*time.Second).Should(Receive())
+				}
+
+				sizes, ok := t2.InboundSizes(t1.Self())
+				Expect(ok).To(BeTrue())
+				Expect(sizes.Count()).To(Equal(uint64(3)))
+				Expect(sizes.Buckets).To(Equal(channel.DefaultSizeBuckets))
+				Expect(t2.Stats().InboundSizes.Count()).To(BeNumerically(">=", 3))
+			})
+		})
+	})
+
+	Describe("Exporting keys", func() {
+		Context("when both peers export keys", func() {
+			It("should derive the same keys from their sessions", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithExportKeys(true).WithPort(3449))
+				t2, _ := newTransport(transport.DefaultOptions().WithExportKeys(true).WithPort(3450))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3450", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				session1, ok := t1.Session(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(session1.Exporter).ToNot(BeNil())
+				Eventually(func() bool {
+					_, ok := t2.Session(t1.Self())
+					return ok
+				}).Should(BeTrue())
+				session2, _ := t2.Session(t1.Self())
+				Expect(session2.Exporter).ToNot(BeNil())
+				Expect(session1.Exporter.DeriveKey("test", 32)).To(Equal(session2.Exporter.DeriveKey("test", 32)))
+			})
+		})
+
+		Context("when keys are not exported", func() {
+			It("should not have an exporter", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithPort(3451))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3452))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3452", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				received := make(chan struct{}, 1)
+				t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				session, ok := t1.Session(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(session.Exporter).To(BeNil())
+			})
+		})
+	})
+
+	Describe("Reading until closed", func() {
+		// newTransportWithTimeout returns a Transport whose Channels read until
+		// they are closed after saying goodbye, for at most the timeout.
+		newTransportWithTimeout := func(opts transport.Options, timeout time.Duration) *transport.Transport {
+			privKey := id.NewPrivKey()
+			client := channel.NewClient(channel.DefaultOptions().WithCloseReadTimeout(timeout), privKey.Signatory())
+			return transport.New(opts, privKey.Signatory(), client, handshake.ECIES(privKey), dht.NewInMemTable(privKey.Signatory()))
+		}
+
+		// goodbye connects the Transports, and returns how long it takes the
+		// first Transport to say goodbye to the second Transport.
+		goodbye := func(ctx context.Context, t1, t2 *transport.Transport, port uint16) time.Duration {
+			t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", port), uint64(time.Now().UnixNano())))
+			go t1.Run(ctx)
+			go t2.Run(ctx)
+
+			received := make(chan struct{}, 1)
+			t2.Receive(ctx, func(id.Signatory, wire.Packet) error {
+				received <- struct{}{}
+				return nil
+			})
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+			Eventually(received, 5*time.Second).Should(Receive())
+
+			start := time.Now()
+			Expect(t1.Goodbye(ctx, t2.Self(), wire.GoodbyeShutdown)).To(Succeed())
+			return time.Since(start)
+		}
+
+		Context("when saying goodbye to a remote peer", func() {
+			It("should stop reading once the remote peer has received the goodbye", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := newTransportWithTimeout(transport.DefaultOptions().WithGoodbyeTimeout(10*time.Second).WithPort(3453), 10*time.Second)
+				t2 := newTransportWithTimeout(transport.DefaultOptions().WithPort(3454), 10*time.Second)
+				Expect(goodbye(ctx, t1, t2, 3454)).To(BeNumerically("<", 5*time.Second))
+			})
+		})
+
+		Context("when the remote peer does not read until closed", func() {
+			It("should keep reading until the timeout expires", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				// The remote peer has not opted in, so it does not stop
+				// writing when it receives the goodbye.
+				t1 := newTransportWithTimeout(transport.DefaultOptions().WithGoodbyeTimeout(10*time.Second).WithPort(3490), 500*time.Millisecond)
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3491))
+				Expect(goodbye(ctx, t1, t2, 3491)).To(And(BeNumerically(">=", 400*time.Millisecond), BeNumerically("<", 5*time.Second)))
+			})
+		})
+	})
+
+	Describe("Overriding options for a remote peer", func() {
+		Context("when the client timeout is overridden", func() {
+			It("should keep connections to the remote peer for longer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithClientTimeout(500 * time.Millisecond).WithPort(3455))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3456))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3456", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				peerOpts := transport.PeerOptions{}.WithClientTimeout(10 * time.Second).WithKeepAlive(time.Second)
+				Expect(t1.SetPeerOptions(t2.Self(), peerOpts)).To(Succeed())
+				got, ok := t1.PeerOptions(t2.Self())
+				Expect(ok).To(BeTrue())
+				Expect(got).To(Equal(peerOpts))
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }).Should(BeTrue())
+				Consistently(func() bool { return t1.IsConnected(t2.Self()) }, 2*time.Second).Should(BeTrue())
+			})
+		})
+
+		Context("when the client timeout is overridden for a connected peer", func() {
+			It("should apply the override to the existing connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithClientTimeout(time.Second).WithPort(3494))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3495))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3495", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }).Should(BeTrue())
+
+				// The longer timeout keeps the existing connection past the
+				// timeout of the transport.
+				Expect(t1.SetPeerOptions(t2.Self(), transport.PeerOptions{}.WithClientTimeout(10*time.Second))).To(Succeed())
+				Consistently(func() bool { return t1.IsConnected(t2.Self()) }, 2*time.Second).Should(BeTrue())
+
+				// Once the override is cleared, the timeout of the transport
+				// has already elapsed, so the connection is dropped.
+				t1.ClearPeerOptions(t2.Self())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, time.Second).Should(BeFalse())
+			})
+		})
+
+		Context("when the overrides are cleared", func() {
+			It("should fall back to the options of the transport", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1, _ := newTransport(transport.DefaultOptions().WithClientTimeout(500 * time.Millisecond).WithPort(3457))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3458))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3458", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.SetPeerOptions(t2.Self(), transport.PeerOptions{}.WithClientTimeout(10*time.Second))).To(Succeed())
+				t1.ClearPeerOptions(t2.Self())
+				_, ok := t1.PeerOptions(t2.Self())
+				Expect(ok).To(BeFalse())
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeFalse())
+			})
+		})
+
+		Context("when the overrides are cleared while the remote peer is connected", func() {
+			It("should restore the keepalive of the existing connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				conns := make(chan *keepAliveConn, 1)
+				dial := func(ctx context.Context, addr string) (net.Conn, error) {
+					conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					keepAliveConn := &keepAliveConn{TCPConn: conn.(*net.TCPConn), period: new(int64)}
+					conns <- keepAliveConn
+					return keepAliveConn, nil
+				}
+				t1, _ := newTransport(transport.DefaultOptions().
+					WithPort(3492).
+					WithClientTimeout(10 * time.Second).
+					WithDialOptions(tcp.DefaultDialOptions().WithDial(dial)))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3493))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3493", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				conn := <-conns
+
+				// The override is only applied once the connection is
+				// attached.
+				Eventually(func() time.Duration {
+					Expect(t1.SetPeerOptions(t2.Self(), transport.PeerOptions{}.WithKeepAlive(time.Second))).To(Succeed())
+					return time.Duration(atomic.LoadInt64(conn.period))
+				}).Should(Equal(time.Second))
+				t1.ClearPeerOptions(t2.Self())
+				Expect(time.Duration(atomic.LoadInt64(conn.period))).To(Equal(15 * time.Second))
+			})
+		})
+
+		Context("when the overrides are invalid", func() {
+			It("should return an error", func() {
+				t, _ := newTransport(transport.DefaultOptions())
+				remote := id.NewPrivKey().Signatory()
+				Expect(t.SetPeerOptions(remote, transport.PeerOptions{}.WithServerTimeout(0))).ToNot(Succeed())
+				Expect(t.SetPeerOptions(remote, transport.PeerOptions{}.WithRateLimit(-1))).ToNot(Succeed())
+				_, ok := t.PeerOptions(remote)
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Scaling keepalives", func() {
+		It("should grow the period with the number of connected peers, within bounds", func() {
+			scaler := transport.ScaledKeepAlive(time.Second, 10, 500*time.Millisecond, 10*time.Second)
+			Expect(scaler(0)).To(Equal(time.Second))
+			Expect(scaler(10)).To(Equal(time.Second))
+			Expect(scaler(20)).To(Equal(2 * time.Second))
+			Expect(scaler(1000)).To(Equal(10 * time.Second))
+
+			unbounded := transport.ScaledKeepAlive(time.Second, 10, 2*time.Second, 0)
+			Expect(unbounded(5)).To(Equal(2 * time.Second))
+			Expect(unbounded(1000)).To(Equal(100 * time.Second))
+
+			fixed := transport.FixedKeepAlive(time.Second)
+			Expect(fixed(1000)).To(Equal(time.Second))
+		})
+
+		Context("when remote peers connect", func() {
+			It("should apply the scaled period to all connections", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				connsMu, conns := new(sync.Mutex), []*keepAliveConn{}
+				dial := func(ctx context.Context, addr string) (net.Conn, error) {
+					conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					keepAliveConn := &keepAliveConn{TCPConn: conn.(*net.TCPConn), period: new(int64)}
+					connsMu.Lock()
+					conns = append(conns, keepAliveConn)
+					connsMu.Unlock()
+					return keepAliveConn, nil
+				}
+				periods := func() []time.Duration {
+					connsMu.Lock()
+					defer connsMu.Unlock()
+					periods := make([]time.Duration, len(conns))
+					for i, conn := range conns {
+						periods[i] = time.Duration(atomic.LoadInt64(conn.period))
+					}
+					return periods
+				}
+
+				t1, _ := newTransport(transport.DefaultOptions().
+					WithPort(3487).
+					WithClientTimeout(10 * time.Second).
+					WithDialOptions(tcp.DefaultDialOptions().WithDial(dial)).
+					WithKeepAliveScaler(transport.ScaledKeepAlive(time.Second, 1, time.Second, 0)))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3488))
+				t3, _ := newTransport(transport.DefaultOptions().WithPort(3489))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3488", uint64(time.Now().UnixNano())))
+				t1.Table().AddPeer(t3.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3489", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+				go t3.Run(ctx)
+				Expect(t1.KeepAlivePeriod()).To(Equal(time.Second))
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(periods, 5*time.Second).Should(Equal([]time.Duration{time.Second}))
+
+				Expect(t1.Send(ctx, t3.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(periods, 5*time.Second).Should(Equal([]time.Duration{2 * time.Second, 2 * time.Second}))
+				Expect(t1.KeepAlivePeriod()).To(Equal(2 * time.Second))
+			})
+		})
+	})
+
+	Describe("Subscribing", func() {
+		Context("when the transport stops running", func() {
+			It("should close the subscription channels", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t, _ := newTransport(transport.DefaultOptions().WithPort(3463))
+				msgs := t.Subscribe(context.Background(), channel.MatchType(wire.MsgTypePush), 1)
+				batches := t.SubscribeBatch(context.Background(), channel.MatchType(wire.MsgTypePush), 1, 0)
+				runCtx, runCancel := context.WithCancel(ctx)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					t.Run(runCtx)
+				}()
+				Consistently(msgs).ShouldNot(BeClosed())
+				runCancel()
+				Eventually(done, 5*time.Second).Should(BeClosed())
+				Eventually(msgs).Should(BeClosed())
+				Eventually(batches).Should(BeClosed())
+			})
+		})
+	})
+
+	Describe("Stats window", func() {
+		Context("when the stats window has passed", func() {
+			It("should forget recent handshakes", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				fake := clock.NewFake(time.Now())
+				t1, _ := newTransport(transport.DefaultOptions().WithClock(fake).WithStatsWindow(time.Hour).WithPort(3464))
+				t2, _ := newTransport(transport.DefaultOptions().WithPort(3465))
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:3465", uint64(time.Now().UnixNano())))
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() uint64 { return t1.Stats().RecentHandshakes }, 5*time.Second).Should(Equal(uint64(1)))
+
+				fake.Advance(time.Hour)
+				Expect(t1.Stats().RecentHandshakes).To(Equal(uint64(1)))
+				fake.Advance(2 * time.Hour)
+				Expect(t1.Stats().RecentHandshakes).To(BeZero())
+				Expect(t1.Stats().Handshakes).To(Equal(uint64(1)))
+			})
+		})
+	})
+})
+
+func newTransport(opts transport.Options) (*transport.Transport, *id.PrivKey) {
+	privKey := id.NewPrivKey()
+	return newTransportWithKey(opts, privKey), privKey
+}
+
+func newTransportWithKey(opts transport.Options, privKey *id.PrivKey) *transport.Transport {
+	self := privKey.Signatory()
+	h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
+	client := channel.NewClient(
+		channel.DefaultOptions(),
+		self)
+	table := dht.NewInMemTable(self)
+	return transport.New(opts, self, client, h, table)
+}
+
+// scoringTable is a dht.Table that is also a dht.Scorer, and counts the
+// outcomes that are recorded for each peer.
+type scoringTable struct {
+	dht.Table
+
+	mu       *sync.Mutex
+	outcomes map[id.Signatory][2]int
+}
+
+func newScoringTable(table dht.Table) *scoringTable {
+	return &scoringTable{Table: table, mu: new(sync.Mutex), outcomes: map[id.Signatory][2]int{}}
+}
+
+func (table *scoringTable) RecordSuccess(peer id.Signatory) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	outcomes := table.outcomes[peer]
+	outcomes[0]++
+	table.outcomes[peer] = outcomes
+}
+
+func (table *scoringTable) RecordFailure(peer id.Signatory) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	outcomes := table.outcomes[peer]
+	outcomes[1]++
+	table.outcomes[peer] = outcomes
+}
+
+func (table *scoringTable) successes(peer id.Signatory) int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	return table.outcomes[peer][0]
+}
+
+func (table *scoringTable) failures(peer id.Signatory) int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	return table.outcomes[peer][1]
+}
+
+// notifyListener is a net.Listener that notifies a channel whenever it accepts
+// a connection.
+type notifyListener struct {
+	net.Listener
+	accepted chan struct{}
+}
+
+func (listener *notifyListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		select {
+		case listener.accepted <- struct{}{}:
+		default:
+		}
+	}
+	return conn, err
+}
+
+// pipeListener is an in-memory net.Listener that accepts the connections
+// returned by its dial function.
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+}
+
+func (listener *pipeListener) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, other := net.Pipe()
+	select {
+	case listener.conns <- other:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (listener *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *pipeListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.done) })
+	return nil
+}
+
+func (listener *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// spanKey is the context key under which a spanRecorder stores the name of the
+// current span.
+type spanKey struct{}
+
+type span struct {
+	name, parent string
+}
+
+// spanRecorder is a transport.SpanStarter that records finished spans.
+type spanRecorder struct {
+	mu    *sync.Mutex
+	spans []span
+}
+
+func newSpanRecorder() *spanRecorder {
+	return &spanRecorder{mu: new(sync.Mutex)}
+}
+
+func (recorder *spanRecorder) StartSpan(ctx context.Context, name string) (context.Context, func()) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	return context.WithValue(ctx, spanKey{}, name), func() {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		recorder.spans = append(recorder.spans, span{name: name, parent: parent})
+	}
+}
+
+func (recorder *spanRecorder) finished() []span {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return append([]span{}, recorder.spans...)
+}
+
+// connIDRecorder is a transport.SpanStarter that records the ConnIDs carried by
+// the contexts of started spans.
+type connIDRecorder struct {
+	mu  *sync.Mutex
+	ids []transport.ConnID
+}
+
+func newConnIDRecorder() *connIDRecorder {
+	return &connIDRecorder{mu: new(sync.Mutex)}
+}
+
+func (recorder *connIDRecorder) StartSpan(ctx context.Context, name string) (context.Context, func()) {
+	if connID, ok := transport.ConnIDFromContext(ctx); ok {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		recorder.ids = append(recorder.ids, connID)
+	}
+	return ctx, func() {}
+}
+
+func (recorder *connIDRecorder) connIDs() []transport.ConnID {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return append([]transport.ConnID{}, recorder.ids...)
+}
+
+// keepAliveConn is a net.TCPConn that records the most recent keepalive period
+// that it was given, in nanoseconds.
+type keepAliveConn struct {
+	*net.TCPConn
+	period *int64
+}
+
+func (conn *keepAliveConn) SetKeepAlivePeriod(period time.Duration) error {
+	atomic.StoreInt64(conn.period, int64(period))
+	return conn.TCPConn.SetKeepAlivePeriod(period)
+}
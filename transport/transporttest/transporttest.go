@@ -0,0 +1,238 @@
+// Package transporttest provides a fake Transport, so that applications built
+// on aw can test how they send and receive messages without a network. The
+// fake records every message that is sent, and tests inject the messages that
+// are received.
+package transporttest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/muirglacier/aw/transport"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+)
+
+// A Messenger sends and receives messages on behalf of the local peer. It is
+// implemented by *transport.Transport, and by the Fake, so applications that
+// depend on a Messenger can use the Fake in their tests.
+type Messenger interface {
+	Self() id.Signatory
+	Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error
+	Receive(ctx context.Context, receiver func(id.Signatory, wire.Packet) error)
+	Link(remote id.Signatory)
+	Unlink(remote id.Signatory)
+	IsLinked(remote id.Signatory) bool
+	IsConnected(remote id.Signatory) bool
+}
+
+var (
+	_ Messenger = (*transport.Transport)(nil)
+	_ Messenger = (*Fake)(nil)
+)
+
+// Sent is a message that was sent using a Fake.
+type Sent struct {
+	To  id.Signatory
+	Msg wire.Msg
+}
+
+type receiver struct {
+	ctx context.Context
+	f   func(id.Signatory, wire.Packet) error
+}
+
+// A Fake is a Messenger that does not use the network. Messages that are sent
+// are recorded (see Sent), and messages that are received are injected by the
+// test (see Inject). It is safe for concurrent use.
+type Fake struct {
+	self id.Signatory
+
+	mu        *sync.Mutex
+	sent      []Sent
+	sendErrs  map[id.Signatory]error
+	receivers []*receiver
+	links     map[id.Signatory]bool
+	conns     map[id.Signatory]bool
+}
+
+// NewFake returns a Fake for the local peer.
+func NewFake(self id.Signatory) *Fake {
+	return &Fake{
+		self: self,
+
+		mu:       new(sync.Mutex),
+		sendErrs: map[id.Signatory]error{},
+		links:    map[id.Signatory]bool{},
+		conns:    map[id.Signatory]bool{},
+	}
+}
+
+// Self returns the signatory of the local peer.
+func (fake *Fake) Self() id.Signatory {
+	return fake.self
+}
+
+// Send records the message, and connects to the remote peer. If the context is
+// already done, then the message is not recorded, and the error of the context
+// is returned. If FailSends has been called for the remote peer, then the
+// message is not recorded, and its error is returned.
+func (fake *Fake) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.sendErrs[remote]; err != nil {
+		return err
+	}
+	fake.sent = append(fake.sent, Sent{To: remote, Msg: msg})
+	fake.conns[remote] = true
+	return nil
+}
+
+// Receive registers a receiver for injected messages, until the context is
+// done. Like a Transport, it returns immediately.
+func (fake *Fake) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.receivers = append(fake.receivers, &receiver{ctx: ctx, f: f})
+}
+
+// Link the remote peer.
+func (fake *Fake) Link(remote id.Signatory) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.links[remote] = true
+}
+
+// Unlink the remote peer.
+func (fake *Fake) Unlink(remote id.Signatory) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	delete(fake.links, remote)
+}
+
+// IsLinked returns true if the remote peer is linked.
+func (fake *Fake) IsLinked(remote id.Signatory) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.links[remote]
+}
+
+// IsConnected returns true if a message has been sent to, or injected from, the
+// remote peer since it was last disconnected.
+func (fake *Fake) IsConnected(remote id.Signatory) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.conns[remote]
+}
+
+// Disconnect the remote peer, as if its connection had been closed.
+func (fake *Fake) Disconnect(remote id.Signatory) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	delete(fake.conns, remote)
+}
+
+// FailSends to the remote peer with the error, until FailSends is called again
+// with a nil error. For example, the error can be a *transport.SendError.
+func (fake *Fake) FailSends(remote id.Signatory, err error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err == nil {
+		delete(fake.sendErrs, remote)
+		return
+	}
+	fake.sendErrs[remote] = err
+}
+
+// Inject a message from the remote peer, and pass it to every receiver whose
+// context is not done, in the order in which they were registered. Receivers
+// are called synchronously, so the message has been handled once Inject
+// returns. If a receiver returns an error, then the remote peer is
+// disconnected, and the receiver is dropped, so that it is not passed any more
+// messages. The message is still passed to the rest of the receivers, and the
+// first error is returned.
+func (fake *Fake) Inject(from id.Signatory, packet wire.Packet) error {
+	fake.mu.Lock()
+	fake.conns[from] = true
+	receivers := make([]*receiver, 0, len(fake.receivers))
+	for _, r := range fake.receivers {
+		if r.ctx.Err() == nil {
+			receivers = append(receivers, r)
+		}
+	}
+	fake.receivers = receivers
+	fake.mu.Unlock()
+
+	// Receivers are called without holding the lock, so that they can use
+	// the Fake (for example, to reply).
+	var firstErr error
+	failed := map[*receiver]bool{}
+	for _, r := range receivers {
+		if err := r.f(from, packet); err != nil {
+			failed[r] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+
+	fake.mu.Lock()
+	receivers = make([]*receiver, 0, len(fake.receivers))
+	for _, r := range fake.receivers {
+		if !failed[r] {
+			receivers = append(receivers, r)
+		}
+	}
+	fake.receivers = receivers
+	fake.mu.Unlock()
+
+	fake.Disconnect(from)
+	return firstErr
+}
+
+// Sent returns all messages that have been sent, in the order in which they
+// were sent.
+func (fake *Fake) Sent() []Sent {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]Sent{}, fake.sent...)
+}
+
+// SentTo returns all messages that have been sent to the remote peer, in the
+// order in which they were sent.
+func (fake *Fake) SentTo(remote id.Signatory) []wire.Msg {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	msgs := []wire.Msg{}
+	for _, sent := range fake.sent {
+		if sent.To.Equal(&remote) {
+			msgs = append(msgs, sent.Msg)
+		}
+	}
+	return msgs
+}
+
+// Reset forgets all messages that have been sent.
+func (fake *Fake) Reset() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.sent = nil
+}
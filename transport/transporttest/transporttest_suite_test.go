@@ -0,0 +1,13 @@
+package transporttest_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTransporttest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Transporttest suite")
+}
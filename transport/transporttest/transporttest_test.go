@@ -0,0 +1,107 @@
+package transporttest_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/muirglacier/aw/transport/transporttest"
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fake", func() {
+	// echo replies to every message with the same data.
+	echo := func(ctx context.Context, m transporttest.Messenger) {
+		m.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+			return m.Send(ctx, from, wire.Msg{Data: packet.Msg.Data})
+		})
+	}
+
+	Context("when injecting messages", func() {
+		It("should pass them to the receivers, and record the replies", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fake := transporttest.NewFake(id.NewPrivKey().Signatory())
+			echo(ctx, fake)
+
+			remote := id.NewPrivKey().Signatory()
+			Expect(fake.Inject(remote, wire.Packet{Msg: wire.Msg{Data: []byte("hello")}})).To(Succeed())
+			Expect(fake.Sent()).To(Equal([]transporttest.Sent{{To: remote, Msg: wire.Msg{Data: []byte("hello")}}}))
+			Expect(fake.SentTo(remote)).To(HaveLen(1))
+			Expect(fake.SentTo(id.NewPrivKey().Signatory())).To(BeEmpty())
+			Expect(fake.IsConnected(remote)).To(BeTrue())
+
+			fake.Reset()
+			Expect(fake.Sent()).To(BeEmpty())
+		})
+	})
+
+	Context("when the context of a receiver is done", func() {
+		It("should not pass messages to the receiver", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			fake := transporttest.NewFake(id.NewPrivKey().Signatory())
+			echo(ctx, fake)
+			cancel()
+
+			Expect(fake.Inject(id.NewPrivKey().Signatory(), wire.Packet{})).To(Succeed())
+			Expect(fake.Sent()).To(BeEmpty())
+		})
+	})
+
+	Context("when a receiver returns an error", func() {
+		It("should disconnect the remote peer, and return the error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fake := transporttest.NewFake(id.NewPrivKey().Signatory())
+			errBad := errors.New("bad message")
+			fake.Receive(ctx, func(id.Signatory, wire.Packet) error { return errBad })
+
+			remote := id.NewPrivKey().Signatory()
+			Expect(fake.Inject(remote, wire.Packet{})).To(MatchError(errBad))
+			Expect(fake.IsConnected(remote)).To(BeFalse())
+		})
+
+		It("should drop the receiver, and pass the message to the rest of the receivers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fake := transporttest.NewFake(id.NewPrivKey().Signatory())
+			errBad := errors.New("bad message")
+			failures := 0
+			fake.Receive(ctx, func(id.Signatory, wire.Packet) error {
+				failures++
+				return errBad
+			})
+			echo(ctx, fake)
+
+			remote := id.NewPrivKey().Signatory()
+			Expect(fake.Inject(remote, wire.Packet{Msg: wire.Msg{Data: []byte("hello")}})).To(MatchError(errBad))
+			Expect(fake.SentTo(remote)).To(HaveLen(1))
+			Expect(fake.Inject(remote, wire.Packet{Msg: wire.Msg{Data: []byte("hello")}})).To(Succeed())
+			Expect(fake.SentTo(remote)).To(HaveLen(2))
+			Expect(failures).To(Equal(1))
+			Expect(fake.IsConnected(remote)).To(BeTrue())
+		})
+	})
+
+	Context("when sends to a remote peer are failing", func() {
+		It("should return the error without recording the message", func() {
+			fake := transporttest.NewFake(id.NewPrivKey().Signatory())
+			remote := id.NewPrivKey().Signatory()
+			errUnreachable := errors.New("unreachable")
+
+			fake.FailSends(remote, errUnreachable)
+			Expect(fake.Send(context.Background(), remote, wire.Msg{})).To(MatchError(errUnreachable))
+			Expect(fake.Sent()).To(BeEmpty())
+
+			fake.FailSends(remote, nil)
+			Expect(fake.Send(context.Background(), remote, wire.Msg{})).To(Succeed())
+			Expect(fake.Sent()).To(HaveLen(1))
+		})
+	})
+})
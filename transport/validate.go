@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/muirglacier/aw/handshake"
+)
+
+// ErrInvalidOptions is returned by Options.Validate when the Options cannot be
+// used to build a functional Transport.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Validate the Options, and return an error wrapping ErrInvalidOptions that
+// describes the first problem found. This allows misconfiguration to be caught
+// when the Transport is built, instead of failing opaquely at runtime. The
+// Options returned by DefaultOptions are always valid.
+func (opts Options) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %v", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case opts.Logger == nil:
+		return invalid("nil logger")
+	case opts.Encoder == nil:
+		return invalid("nil encoder")
+	case opts.Decoder == nil:
+		return invalid("nil decoder")
+	case opts.DialTimeout == nil:
+		return invalid("nil dial timeout")
+	case opts.KeepConnectedBackoff == nil:
+		return invalid("nil keep connected backoff")
+	case opts.Clock == nil:
+		return invalid("nil clock")
+	}
+
+	switch {
+	case opts.ClientTimeout <= 0:
+		return invalid("client timeout must be positive, got %v", opts.ClientTimeout)
+	case opts.ServerTimeout <= 0:
+		return invalid("server timeout must be positive, got %v", opts.ServerTimeout)
+	case opts.ExpiryDuration <= 0:
+		return invalid("expiry must be positive, got %v", opts.ExpiryDuration)
+	case opts.ExpiryDuration < opts.ClientTimeout:
+		// Otherwise, peers can be deleted from the table before a single
+		// connection attempt has been given the chance to complete.
+		return invalid("expiry must not be shorter than the client timeout, got %v < %v", opts.ExpiryDuration, opts.ClientTimeout)
+	case opts.SendGoodbye && opts.GoodbyeTimeout <= 0:
+		return invalid("goodbye timeout must be positive when sending goodbyes, got %v", opts.GoodbyeTimeout)
+	case opts.ListenErrorInterval < 0:
+		return invalid("listen error interval must not be negative, got %v", opts.ListenErrorInterval)
+	case opts.InboundFilterBan < 0:
+		return invalid("inbound filter ban must not be negative, got %v", opts.InboundFilterBan)
+	case opts.CompressionOptions.Threshold < 0:
+		return invalid("compression threshold must not be negative, got %v", opts.CompressionOptions.Threshold)
+	case opts.MaxMetadataSize < 0:
+		return invalid("max metadata size must not be negative, got %v", opts.MaxMetadataSize)
+	case len(opts.Metadata) > opts.MaxMetadataSize:
+		return invalid("metadata must not be larger than the max metadata size, got %v > %v", len(opts.Metadata), opts.MaxMetadataSize)
+	case len(opts.PreviousKeys) > handshake.MaxPreviousKeys:
+		return invalid("previous keys must not be more than %v, got %v", handshake.MaxPreviousKeys, len(opts.PreviousKeys))
+	case opts.StatsWindow <= 0:
+		return invalid("stats window must be positive, got %v", opts.StatsWindow)
+	case opts.MismatchTTL < 0:
+		return invalid("mismatch ttl must not be negative, got %v", opts.MismatchTTL)
+	case opts.AddressQualityHalfLife < 0:
+		return invalid("address quality half-life must not be negative, got %v", opts.AddressQualityHalfLife)
+	case opts.MaxHandshakeMsgSize <= 0:
+		return invalid("max handshake message size must be positive, got %v", opts.MaxHandshakeMsgSize)
+	case (opts.Metadata != nil || opts.OnMetadata != nil) && opts.MaxMetadataSize+handshake.MaxMessageOverhead > opts.MaxHandshakeMsgSize:
+		return invalid("max handshake message size must leave room for the max metadata size, got %v < %v", opts.MaxHandshakeMsgSize, opts.MaxMetadataSize+handshake.MaxMessageOverhead)
+	}
+
+	switch {
+	case opts.MaxBans < 0:
+		return invalid("max bans must not be negative, got %v", opts.MaxBans)
+	case opts.MaxAddressQualities <= 0:
+		return invalid("max address qualities must be positive, got %v", opts.MaxAddressQualities)
+	case opts.MaxTags < 0:
+		return invalid("max tags must not be negative, got %v", opts.MaxTags)
+	case opts.MaxBatchSize < 0:
+		return invalid("max batch size must not be negative, got %v", opts.MaxBatchSize)
+	case opts.MaxConns < 0:
+		return invalid("max conns must not be negative, got %v", opts.MaxConns)
+	case opts.CapacityPolicy > CapacityPreferKnown:
+		return invalid("unknown capacity policy %v", opts.CapacityPolicy)
+	case opts.ListenOptions.Workers < 0:
+		return invalid("listen workers must not be negative, got %v", opts.ListenOptions.Workers)
+	case opts.ListenOptions.QueueSize < 0:
+		return invalid("listen queue size must not be negative, got %v", opts.ListenOptions.QueueSize)
+	}
+
+	if err := opts.LengthPrefixOptions.Validate(); err != nil {
+		return invalid("%v", err)
+	}
+
+	if opts.AnnounceAddress != "" {
+		if err := validateAnnounceAddress(opts.AnnounceAddress); err != nil {
+			return invalid("%v", err)
+		}
+	}
+	for _, addr := range opts.ListenAddresses {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			return invalid("bad listen address %q: %v", addr, err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return invalid("bad listen address port %q: %v", addr, err)
+		}
+	}
+	if len(opts.ListenWeights) > 0 {
+		addrs := map[string]bool{}
+		for _, addr := range listenAddresses(opts) {
+			addrs[addr] = true
+		}
+		advertised := false
+		for _, addr := range listenAddresses(opts) {
+			weight, ok := opts.ListenWeights[addr]
+			advertised = advertised || !ok || weight > 0
+		}
+		for addr, weight := range opts.ListenWeights {
+			switch {
+			case !addrs[addr]:
+				return invalid("listen weight for %q, which is not a listen address", addr)
+			case weight < 0:
+				return invalid("listen weight for %q must not be negative, got %v", addr, weight)
+			}
+		}
+		if !advertised {
+			return invalid("at least one listen address must have a positive weight")
+		}
+	}
+	return nil
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/muirglacier/id"
@@ -81,7 +84,8 @@ func NewAddressHashWithBuffer(protocol Protocol, value string, nonce uint64, dat
 // specific peer. The peer can be verified by checking the Signatory of the peer
 // against the Signature in the Address. The Address can be expired by issuing a
 // new Address for the same peer, using a later nonce. By convention, nonces are
-// interpreted as seconds since UNIX epoch.
+// generated by NewNonce, which guarantees that a later Address from the same
+// process always has a greater nonce.
 type Address struct {
 	Protocol  Protocol     `json:"protocol"`
 	Value     string       `json:"value"`
@@ -89,9 +93,45 @@ type Address struct {
 	Signature id.Signature `json:"signature"`
 }
 
-// NewUnsignedAddress returns an Address that has an empty signature. The Sign
-// method should be called before the returned Address is used.
+// AddressOptions configure how Addresses are created.
+type AddressOptions struct {
+	// Normalize is used to normalize the value of an Address before it is
+	// signed, so that equivalent spellings of the same value compare equal.
+	// Nil means that values are not normalized.
+	Normalize func(value string) string
+}
+
+// DefaultAddressOptions returns AddressOptions that normalize values using
+// CanonicalHostPort.
+func DefaultAddressOptions() AddressOptions {
+	return AddressOptions{
+		Normalize: CanonicalHostPort,
+	}
+}
+
+// WithNormalize sets the function that is used to normalize the value of an
+// Address before it is signed. Applications that use values which are not a
+// host and port can set it to nil, or to their own function. Addresses that are
+// decoded are not normalized, because that would invalidate their signature.
+func (opts AddressOptions) WithNormalize(normalize func(value string) string) AddressOptions {
+	opts.Normalize = normalize
+	return opts
+}
+
+// NewUnsignedAddress returns an Address that has an empty signature, using the
+// DefaultAddressOptions. The Sign method should be called before the returned
+// Address is used.
 func NewUnsignedAddress(protocol Protocol, value string, nonce uint64) Address {
+	return NewUnsignedAddressWithOptions(DefaultAddressOptions(), protocol, value, nonce)
+}
+
+// NewUnsignedAddressWithOptions returns an Address that has an empty
+// signature. The value is normalized using the AddressOptions. The Sign method
+// should be called before the returned Address is used.
+func NewUnsignedAddressWithOptions(opts AddressOptions, protocol Protocol, value string, nonce uint64) Address {
+	if opts.Normalize != nil {
+		value = opts.Normalize(value)
+	}
 	return Address{
 		Protocol: protocol,
 		Value:    value,
@@ -99,6 +139,48 @@ func NewUnsignedAddress(protocol Protocol, value string, nonce uint64) Address {
 	}
 }
 
+// NewSignedAddress returns an Address that has been signed by the private key,
+// using a nonce from NewNonce and the DefaultAddressOptions. Addresses returned
+// by later calls always have a greater nonce, so they always take precedence
+// over earlier Addresses.
+func NewSignedAddress(privKey *id.PrivKey, protocol Protocol, value string) (Address, error) {
+	return NewSignedAddressWithOptions(DefaultAddressOptions(), privKey, protocol, value)
+}
+
+// NewSignedAddressWithOptions returns an Address that has been signed by the
+// private key, using a nonce from NewNonce. The value is normalized using the
+// AddressOptions.
+func NewSignedAddressWithOptions(opts AddressOptions, privKey *id.PrivKey, protocol Protocol, value string) (Address, error) {
+	addr := NewUnsignedAddressWithOptions(opts, protocol, value, NewNonce())
+	if err := addr.Sign(privKey); err != nil {
+		return Address{}, err
+	}
+	return addr, nil
+}
+
+// lastNonce is the nonce that was most recently returned by NewNonce.
+var lastNonce uint64
+
+// NewNonce returns a nonce for an Address. Nonces are seeded from the number of
+// nanoseconds since UNIX epoch, but are strictly increasing within a process:
+// every nonce is greater than all nonces previously returned by NewNonce, even
+// if the system clock goes backwards, or two nonces are generated within the
+// same nanosecond. Nonces are not guaranteed to be increasing across restarts
+// of a process if the system clock goes backwards while it is not running. It
+// is safe for concurrent use.
+func NewNonce() uint64 {
+	for {
+		prev := atomic.LoadUint64(&lastNonce)
+		next := uint64(time.Now().UnixNano())
+		if next <= prev {
+			next = prev + 1
+		}
+		if atomic.CompareAndSwapUint64(&lastNonce, prev, next) {
+			return next
+		}
+	}
+}
+
 // SizeHint returns the number of bytes needed to represent this Address in
 // binary.
 func (addr Address) SizeHint() int {
@@ -274,3 +356,36 @@ func DecodeString(addr string) (Address, error) {
 		Signature: sig,
 	}, nil
 }
+
+// CanonicalHostPort returns the canonical form of an Address value that is a
+// host and port. IPv6 addresses are bracketed, compressed, and lower-cased, and
+// their zone is kept, so that "[FE80:0::1%eth0]:3333" and "[fe80::1%eth0]:3333"
+// have the same canonical form. Host names are lower-cased and have their
+// trailing dot removed, and numeric ports have their leading zeros removed, so
+// that "Example.COM.:03333" and "example.com:3333" have the same canonical
+// form. Values that are not a host and port are returned unchanged.
+func CanonicalHostPort(value string) string {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return value
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		port = strconv.FormatUint(p, 10)
+	}
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Zones only belong to IP addresses, so this is a host name (which is
+		// case-insensitive, and fully qualified with or without a trailing
+		// dot).
+		host = strings.ToLower(host + zone)
+		if host != "." {
+			host = strings.TrimSuffix(host, ".")
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return net.JoinHostPort(ip.String()+zone, port)
+}
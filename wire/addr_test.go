@@ -1,9 +1,12 @@
 package wire_test
 
 import (
+	"encoding/json"
 	"math/rand"
 
 	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+	"github.com/muirglacier/surge"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -43,4 +46,117 @@ var _ = Describe("Address", func() {
 			Expect(h3).ToNot(Equal(h4))
 		})
 	})
+
+	Context("when generating nonces", func() {
+		It("should be strictly increasing across goroutines", func() {
+			const numGoroutines, numNonces = 8, 1000
+			results := make(chan []uint64, numGoroutines)
+			for i := 0; i < numGoroutines; i++ {
+				go func() {
+					nonces := make([]uint64, numNonces)
+					for j := range nonces {
+						nonces[j] = wire.NewNonce()
+					}
+					results <- nonces
+				}()
+			}
+			seen := map[uint64]bool{}
+			for i := 0; i < numGoroutines; i++ {
+				nonces := <-results
+				for j := range nonces {
+					if j > 0 {
+						Expect(nonces[j]).To(BeNumerically(">", nonces[j-1]))
+					}
+					Expect(seen[nonces[j]]).To(BeFalse())
+					seen[nonces[j]] = true
+				}
+			}
+		})
+	})
+
+	Context("when creating a signed address", func() {
+		It("should be verifiable and have a greater nonce than earlier addresses", func() {
+			privKey := id.NewPrivKey()
+			addr1, err := wire.NewSignedAddress(privKey, wire.TCP, "localhost:3333")
+			Expect(err).ToNot(HaveOccurred())
+			addr2, err := wire.NewSignedAddress(privKey, wire.TCP, "localhost:3333")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(addr1.Verify(privKey.Signatory())).To(Succeed())
+			Expect(addr2.Verify(privKey.Signatory())).To(Succeed())
+			Expect(addr2.Nonce).To(BeNumerically(">", addr1.Nonce))
+		})
+	})
+
+	Context("when canonicalizing a host and port", func() {
+		It("should normalize IP addresses and keep zones", func() {
+			Expect(wire.CanonicalHostPort("127.0.0.1:3333")).To(Equal("127.0.0.1:3333"))
+			Expect(wire.CanonicalHostPort("[::]:3333")).To(Equal("[::]:3333"))
+			Expect(wire.CanonicalHostPort("[0:0::0]:3333")).To(Equal("[::]:3333"))
+			Expect(wire.CanonicalHostPort("[2001:DB8::0:1]:3333")).To(Equal("[2001:db8::1]:3333"))
+			Expect(wire.CanonicalHostPort("[FE80::1%eth0]:3333")).To(Equal("[fe80::1%eth0]:3333"))
+			Expect(wire.CanonicalHostPort("localhost:3333")).To(Equal("localhost:3333"))
+			Expect(wire.CanonicalHostPort("fe80::1")).To(Equal("fe80::1"))
+		})
+
+		It("should normalize host names and ports", func() {
+			for _, value := range []string{
+				"example.com:3333",
+				"EXAMPLE.com:3333",
+				"example.com.:3333",
+				"Example.COM.:03333",
+				"example.com:0003333",
+			} {
+				Expect(wire.CanonicalHostPort(value)).To(Equal("example.com:3333"))
+			}
+			Expect(wire.CanonicalHostPort("127.0.0.1:03333")).To(Equal("127.0.0.1:3333"))
+			Expect(wire.CanonicalHostPort("example.com:http")).To(Equal("example.com:http"))
+		})
+	})
+
+	Context("when creating an address", func() {
+		It("should sign the normalized value", func() {
+			privKey := id.NewPrivKey()
+			addr, err := wire.NewSignedAddress(privKey, wire.TCP, "Example.COM.:03333")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addr.Value).To(Equal("example.com:3333"))
+			Expect(addr.Verify(privKey.Signatory())).To(Succeed())
+			Expect(addr.Equal(&wire.Address{Protocol: addr.Protocol, Value: "example.com:3333", Nonce: addr.Nonce, Signature: addr.Signature})).To(BeTrue())
+		})
+
+		It("should not normalize the value without a normalize function", func() {
+			privKey := id.NewPrivKey()
+			addr, err := wire.NewSignedAddressWithOptions(wire.DefaultAddressOptions().WithNormalize(nil), privKey, wire.TCP, "Example.COM.:03333")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addr.Value).To(Equal("Example.COM.:03333"))
+			Expect(addr.Verify(privKey.Signatory())).To(Succeed())
+		})
+	})
+
+	Context("when encoding an IPv6 address with a zone", func() {
+		It("should round-trip the value without corruption", func() {
+			privKey := id.NewPrivKey()
+			for _, value := range []string{"[fe80::1%eth0]:3333", "[::]:3333", "[2001:db8::1]:3333"} {
+				addr, err := wire.NewSignedAddress(privKey, wire.TCP, value)
+				Expect(err).ToNot(HaveOccurred())
+
+				data, err := surge.ToBinary(addr)
+				Expect(err).ToNot(HaveOccurred())
+				unmarshaled := wire.Address{}
+				Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+				Expect(unmarshaled.Equal(&addr)).To(BeTrue())
+
+				data, err = json.Marshal(addr)
+				Expect(err).ToNot(HaveOccurred())
+				unmarshaled = wire.Address{}
+				Expect(json.Unmarshal(data, &unmarshaled)).To(Succeed())
+				Expect(unmarshaled.Equal(&addr)).To(BeTrue())
+
+				decoded, err := wire.DecodeString(addr.String())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded.Equal(&addr)).To(BeTrue())
+				Expect(decoded.Verify(privKey.Signatory())).To(Succeed())
+			}
+		})
+	})
 })
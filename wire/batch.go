@@ -0,0 +1,90 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/muirglacier/id"
+	"github.com/muirglacier/surge"
+)
+
+// minMsgSize is the smallest number of bytes used to represent a Msg in binary.
+// It is used to bound the number of messages expected in a batch, before they
+// are unmarshaled.
+const minMsgSize = surge.SizeHintU16 + surge.SizeHintU16 + id.SizeHintHash + surge.SizeHintU32
+
+// NewBatch returns a Msg that carries all of the messages in a single frame.
+// The remote peer unpacks the batch, and delivers each message separately, in
+// the same order as they are in the batch. This saves the framing, and the
+// writes, of sending many small messages to the same remote peer one at a time.
+// Messages that are handled by the connection itself (sync messages, goodbyes,
+// chunked messages, and other batches) cannot be batched, and an error is
+// returned if there are any, or if there are no messages. Batches are only
+// understood by remote peers that understand MsgVersion5.
+func NewBatch(msgs []Msg) (Msg, error) {
+	if len(msgs) == 0 {
+		return Msg{}, fmt.Errorf("empty batch")
+	}
+	size := surge.SizeHintU32
+	for i, msg := range msgs {
+		if err := batchable(msg); err != nil {
+			return Msg{}, fmt.Errorf("bad msg %v: %v", i, err)
+		}
+		size += msg.SizeHint()
+	}
+
+	data := make([]byte, size)
+	buf, rem, err := surge.MarshalU32(uint32(len(msgs)), data, size)
+	if err != nil {
+		return Msg{}, fmt.Errorf("marshal batch size: %v", err)
+	}
+	for i, msg := range msgs {
+		if buf, rem, err = msg.Marshal(buf, rem); err != nil {
+			return Msg{}, fmt.Errorf("marshal msg %v: %v", i, err)
+		}
+	}
+	return Msg{
+		Version: MsgVersion1,
+		Type:    MsgTypeBatch,
+		Data:    data,
+	}, nil
+}
+
+// Batch returns the messages carried by a Msg with MsgTypeBatch, in order. An
+// error is returned if the Msg has a different type, or its Data is malformed.
+func (msg Msg) Batch() ([]Msg, error) {
+	if msg.Type != MsgTypeBatch {
+		return nil, fmt.Errorf("bad type: expected %v, got %v", MsgTypeBatch, msg.Type)
+	}
+	n := uint32(0)
+	buf, rem, err := surge.UnmarshalU32(&n, msg.Data, len(msg.Data))
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal batch size: %v", err)
+	}
+	if int64(n) > int64(len(buf)/minMsgSize) {
+		return nil, fmt.Errorf("bad batch size: expected at most %v msgs, got %v msgs", len(buf)/minMsgSize, n)
+	}
+	msgs := make([]Msg, n)
+	for i := range msgs {
+		if buf, rem, err = msgs[i].Unmarshal(buf, rem); err != nil {
+			return nil, fmt.Errorf("unmarshal msg %v: %v", i, err)
+		}
+		if err := batchable(msgs[i]); err != nil {
+			return nil, fmt.Errorf("bad msg %v: %v", i, err)
+		}
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("bad data: %v trailing bytes", len(buf))
+	}
+	return msgs, nil
+}
+
+// batchable returns an error if the Msg cannot be carried by a batch.
+func batchable(msg Msg) error {
+	switch {
+	case msg.Type == MsgTypeSync, msg.Type == MsgTypeGoodbye, msg.Type == MsgTypeBatch:
+		return fmt.Errorf("type %v cannot be batched", msg.Type)
+	case msg.IsChunked():
+		return fmt.Errorf("chunked msgs cannot be batched")
+	}
+	return nil
+}
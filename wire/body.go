@@ -0,0 +1,126 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ContentType declares the serialization format of the Data in a Msg. The
+// transport does not interpret the ContentType; it is passed through so that
+// applications can choose how to unmarshal the Data.
+type ContentType uint8
+
+// Enumerate all well-known ContentType values. Applications are free to define
+// their own values, but should avoid conflicting with the values defined here.
+const (
+	ContentTypeUndefined = ContentType(0)
+	ContentTypeBinary    = ContentType(1)
+	ContentTypeJSON      = ContentType(2)
+	ContentTypeProtobuf  = ContentType(3)
+	ContentTypeMsgpack   = ContentType(4)
+)
+
+func (contentType ContentType) String() string {
+	switch contentType {
+	case ContentTypeUndefined:
+		return "undefined"
+	case ContentTypeBinary:
+		return "binary"
+	case ContentTypeJSON:
+		return "json"
+	case ContentTypeProtobuf:
+		return "protobuf"
+	case ContentTypeMsgpack:
+		return "msgpack"
+	default:
+		return fmt.Sprintf("%d", uint8(contentType))
+	}
+}
+
+// A BodyCodec marshals application types into the Data of a Msg, and
+// unmarshals the Data of a Msg back into application types.
+type BodyCodec interface {
+	// ContentType declared by Msgs with Data that was marshaled by this
+	// BodyCodec.
+	ContentType() ContentType
+	// Marshal an application type into bytes.
+	Marshal(interface{}) ([]byte, error)
+	// Unmarshal bytes into an application type.
+	Unmarshal([]byte, interface{}) error
+}
+
+var (
+	// JSONBody is a BodyCodec that uses the encoding/json package.
+	JSONBody BodyCodec = jsonBody{}
+
+	// ProtoBody is a BodyCodec for protobuf messages. To avoid depending on a
+	// specific protobuf implementation, it requires that values implement
+	// Marshal() ([]byte, error) when marshaling, and Unmarshal([]byte) error
+	// when unmarshaling (as generated by gogo/protobuf, for example).
+	ProtoBody BodyCodec = protoBody{}
+)
+
+type jsonBody struct{}
+
+func (jsonBody) ContentType() ContentType {
+	return ContentTypeJSON
+}
+
+func (jsonBody) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonBody) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoBody struct{}
+
+func (protoBody) ContentType() ContentType {
+	return ContentTypeProtobuf
+}
+
+func (protoBody) Marshal(v interface{}) ([]byte, error) {
+	marshaler, ok := v.(interface{ Marshal() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("marshal protobuf: %T does not implement Marshal", v)
+	}
+	return marshaler.Marshal()
+}
+
+func (protoBody) Unmarshal(data []byte, v interface{}) error {
+	unmarshaler, ok := v.(interface{ Unmarshal([]byte) error })
+	if !ok {
+		return fmt.Errorf("unmarshal protobuf: %T does not implement Unmarshal", v)
+	}
+	return unmarshaler.Unmarshal(data)
+}
+
+// EncodeBody uses the BodyCodec to marshal a value into the Data of the Msg,
+// and sets the ContentType of the Msg. If the Msg version does not support
+// ContentTypes, it is upgraded to MsgVersion2.
+func (msg *Msg) EncodeBody(codec BodyCodec, v interface{}) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode body: %v", err)
+	}
+	if msg.Version < MsgVersion2 {
+		msg.Version = MsgVersion2
+	}
+	msg.Data = data
+	msg.ContentType = codec.ContentType()
+	return nil
+}
+
+// DecodeBody uses the BodyCodec to unmarshal the Data of the Msg into a value.
+// An error is returned if the Msg declares a ContentType that is different
+// from the ContentType of the BodyCodec.
+func (msg *Msg) DecodeBody(codec BodyCodec, v interface{}) error {
+	if msg.ContentType != ContentTypeUndefined && msg.ContentType != codec.ContentType() {
+		return fmt.Errorf("decode body: expected content type %v, got %v", codec.ContentType(), msg.ContentType)
+	}
+	if err := codec.Unmarshal(msg.Data, v); err != nil {
+		return fmt.Errorf("decode body: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package wire
+
+// Enumerate all MsgFlag values. Flags are combined using bitwise or.
+const (
+	// MsgFlagChunked marks a Msg with Data that is written as a sequence of
+	// chunks, after the Msg itself, instead of in the Msg. The remote peer
+	// reads the chunks as they arrive (see Packet.Body).
+	MsgFlagChunked = uint8(1)
+	// MsgFlagCompress marks a Msg that should be compressed, regardless of
+	// its size, if the connection has negotiated compression.
+	MsgFlagCompress = uint8(2)
+	// MsgFlagNoCompress marks a Msg that should never be compressed (for
+	// example, because its Data is already compressed).
+	MsgFlagNoCompress = uint8(4)
+)
+
+// Chunked returns a copy of the Msg that is marked as chunked, so that its
+// Data is delivered to the remote peer as a stream of chunks, instead of all at
+// once. This lets the remote peer start processing large Data before all of it
+// has arrived, and lets the Data be larger than the maximum message size. If
+// the Msg version does not support flags, it is upgraded to MsgVersion5.
+func (msg Msg) Chunked() Msg {
+	if msg.Version < MsgVersion5 {
+		msg.Version = MsgVersion5
+	}
+	msg.Flags |= MsgFlagChunked
+	return msg
+}
+
+// IsChunked returns true if the Msg is marked as chunked, otherwise it returns
+// false.
+func (msg Msg) IsChunked() bool {
+	return msg.Version >= MsgVersion5 && msg.Flags&MsgFlagChunked != 0
+}
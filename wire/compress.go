@@ -0,0 +1,36 @@
+package wire
+
+// WithCompression returns a copy of the Msg that is marked to be compressed
+// (if compress is true), or to never be compressed (if compress is false),
+// overriding the size threshold used by the connection. Compression cannot be
+// forced on a connection that has not negotiated it, and the remote peer
+// decompresses the Msg based on how it was actually encoded. If the Msg
+// version does not support flags, it is upgraded to MsgVersion5.
+func (msg Msg) WithCompression(compress bool) Msg {
+	if msg.Version < MsgVersion5 {
+		msg.Version = MsgVersion5
+	}
+	msg.Flags &^= MsgFlagCompress | MsgFlagNoCompress
+	if compress {
+		msg.Flags |= MsgFlagCompress
+	} else {
+		msg.Flags |= MsgFlagNoCompress
+	}
+	return msg
+}
+
+// CompressionOverride returns whether or not the Msg overrides the size
+// threshold used by the connection to decide whether or not to compress it,
+// and if it does, whether or not it should be compressed.
+func (msg Msg) CompressionOverride() (compress bool, ok bool) {
+	if msg.Version < MsgVersion5 {
+		return false, false
+	}
+	switch {
+	case msg.Flags&MsgFlagNoCompress != 0:
+		return false, true
+	case msg.Flags&MsgFlagCompress != 0:
+		return true, true
+	}
+	return false, false
+}
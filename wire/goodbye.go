@@ -0,0 +1,62 @@
+package wire
+
+import (
+	"fmt"
+)
+
+// GoodbyeReason declares why a peer is deliberately closing its connection.
+// Peers can use it to decide how to react to the connection being closed. For
+// example, a peer that is going away for maintenance should not be re-dialed
+// immediately.
+type GoodbyeReason uint8
+
+// Enumerate all well-known GoodbyeReason values. Applications are free to
+// define their own values, but should avoid conflicting with the values defined
+// here.
+const (
+	GoodbyeUnknown     = GoodbyeReason(0)
+	GoodbyeShutdown    = GoodbyeReason(1)
+	GoodbyeBanned      = GoodbyeReason(2)
+	GoodbyeMaintenance = GoodbyeReason(3)
+	GoodbyeCapacity    = GoodbyeReason(4)
+)
+
+func (reason GoodbyeReason) String() string {
+	switch reason {
+	case GoodbyeUnknown:
+		return "unknown"
+	case GoodbyeShutdown:
+		return "shutdown"
+	case GoodbyeBanned:
+		return "banned"
+	case GoodbyeMaintenance:
+		return "maintenance"
+	case GoodbyeCapacity:
+		return "capacity"
+	default:
+		return fmt.Sprintf("%d", uint8(reason))
+	}
+}
+
+// NewGoodbye returns a Msg that tells the remote peer that the connection is
+// about to be closed, and why. It is the last Msg written to a connection.
+func NewGoodbye(reason GoodbyeReason) Msg {
+	return Msg{
+		Version: MsgVersion1,
+		Type:    MsgTypeGoodbye,
+		Data:    []byte{uint8(reason)},
+	}
+}
+
+// GoodbyeReason returns the GoodbyeReason declared by a Msg with
+// MsgTypeGoodbye. An error is returned if the Msg has a different type, or its
+// Data is malformed.
+func (msg Msg) GoodbyeReason() (GoodbyeReason, error) {
+	if msg.Type != MsgTypeGoodbye {
+		return GoodbyeUnknown, fmt.Errorf("bad type: expected %v, got %v", MsgTypeGoodbye, msg.Type)
+	}
+	if len(msg.Data) != 1 {
+		return GoodbyeUnknown, fmt.Errorf("bad data: expected 1 byte, got %v bytes", len(msg.Data))
+	}
+	return GoodbyeReason(msg.Data[0]), nil
+}
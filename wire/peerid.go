@@ -0,0 +1,50 @@
+package wire
+
+import (
+	"bytes"
+
+	"github.com/muirglacier/id"
+)
+
+// A PeerID identifies a peer. It allows the points at which peers are compared
+// and serialized to be independent of the identity scheme used by the peers.
+// Implementations must be comparable by their bytes: two PeerIDs are equal if,
+// and only if, their bytes are equal.
+type PeerID interface {
+	// Bytes returns the serialized form of the PeerID. The bytes must not be
+	// modified by the caller.
+	Bytes() []byte
+	// Equal returns true if the PeerID identifies the same peer as another
+	// PeerID, otherwise it returns false.
+	Equal(other PeerID) bool
+	// String returns a human-readable form of the PeerID.
+	String() string
+}
+
+// SignatoryPeerID is a PeerID for peers that are identified by an
+// id.Signatory. It is the identity scheme used throughout this module.
+type SignatoryPeerID id.Signatory
+
+// Bytes returns the bytes of the id.Signatory.
+func (peerID SignatoryPeerID) Bytes() []byte {
+	return peerID[:]
+}
+
+// Equal returns true if the other PeerID has the same bytes, otherwise it
+// returns false.
+func (peerID SignatoryPeerID) Equal(other PeerID) bool {
+	return other != nil && bytes.Equal(peerID[:], other.Bytes())
+}
+
+// String returns the id.Signatory encoded as a string.
+func (peerID SignatoryPeerID) String() string {
+	return id.Signatory(peerID).String()
+}
+
+// ComparePeerIDs returns an integer comparing the bytes of two PeerIDs. The
+// result is 0 if a == b, -1 if a < b, and +1 if a > b. Peers use it to make
+// symmetric decisions, such as which of two duplicate connections to keep, so
+// both peers must compare the same bytes.
+func ComparePeerIDs(a, b PeerID) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
@@ -0,0 +1,55 @@
+package wire_test
+
+import (
+	"bytes"
+
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// namePeerID is a PeerID for an alternative identity scheme, where peers are
+// identified by their name.
+type namePeerID string
+
+func (peerID namePeerID) Bytes() []byte {
+	return []byte(peerID)
+}
+
+func (peerID namePeerID) Equal(other wire.PeerID) bool {
+	return other != nil && bytes.Equal(peerID.Bytes(), other.Bytes())
+}
+
+func (peerID namePeerID) String() string {
+	return string(peerID)
+}
+
+var _ = Describe("PeerID", func() {
+	Context("when comparing signatories", func() {
+		It("should compare their bytes", func() {
+			fst := id.NewPrivKey().Signatory()
+			snd := id.NewPrivKey().Signatory()
+
+			Expect(wire.SignatoryPeerID(fst).Bytes()).To(Equal(fst[:]))
+			Expect(wire.SignatoryPeerID(fst).String()).To(Equal(fst.String()))
+			Expect(wire.SignatoryPeerID(fst).Equal(wire.SignatoryPeerID(fst))).To(BeTrue())
+			Expect(wire.SignatoryPeerID(fst).Equal(wire.SignatoryPeerID(snd))).To(BeFalse())
+			Expect(wire.SignatoryPeerID(fst).Equal(nil)).To(BeFalse())
+			Expect(wire.ComparePeerIDs(wire.SignatoryPeerID(fst), wire.SignatoryPeerID(snd))).To(Equal(bytes.Compare(fst[:], snd[:])))
+		})
+	})
+
+	Context("when using an alternative identity scheme", func() {
+		It("should compare with signatories that have the same bytes", func() {
+			signatory := id.NewPrivKey().Signatory()
+			name := namePeerID(signatory[:])
+
+			Expect(name.Equal(wire.SignatoryPeerID(signatory))).To(BeTrue())
+			Expect(wire.SignatoryPeerID(signatory).Equal(name)).To(BeTrue())
+			Expect(wire.ComparePeerIDs(name, wire.SignatoryPeerID(signatory))).To(Equal(0))
+			Expect(wire.ComparePeerIDs(namePeerID("a"), namePeerID("b"))).To(Equal(-1))
+		})
+	})
+})
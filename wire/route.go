@@ -0,0 +1,18 @@
+package wire
+
+import (
+	"github.com/muirglacier/id"
+)
+
+// WithRoutingKey returns a copy of the Msg with a RoutingKey, which allows
+// applications to make placement decisions based on the key (for example, by
+// sending the Msg to the peers that are closest to the key). If the Msg version
+// does not support RoutingKeys, it is upgraded to MsgVersion4. Peers that do
+// not route ignore the RoutingKey.
+func (msg Msg) WithRoutingKey(key id.Hash) Msg {
+	if msg.Version < MsgVersion4 {
+		msg.Version = MsgVersion4
+	}
+	msg.RoutingKey = &key
+	return msg
+}
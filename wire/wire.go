@@ -2,6 +2,7 @@ package wire
 
 import (
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/muirglacier/id"
@@ -9,43 +10,86 @@ import (
 	"github.com/muirglacier/surge"
 )
 
-// Enumerate all valid MsgVersion values.
+// Enumerate all valid MsgVersion values. Messages with MsgVersion2, or later,
+// declare the ContentType of their data. Messages with MsgVersion3, or later,
+// declare the Stream to which they belong. Messages with MsgVersion4, or later,
+// can declare a RoutingKey. Messages with MsgVersion5, or later, declare their
+// Flags.
 const (
 	MsgVersion1 = uint16(1)
+	MsgVersion2 = uint16(2)
+	MsgVersion3 = uint16(3)
+	MsgVersion4 = uint16(4)
+	MsgVersion5 = uint16(5)
+
+	// MsgVersionLatest is the latest MsgVersion that is understood by this
+	// package.
+	MsgVersionLatest = MsgVersion5
 )
 
 // Enumerate all valid MsgType values.
 const (
-	MsgTypePush    = uint16(1)
-	MsgTypePull    = uint16(2)
-	MsgTypeSync    = uint16(3)
-	MsgTypeSend    = uint16(4)
-	MsgTypePing    = uint16(5)
-	MsgTypePingAck = uint16(6)
+	MsgTypePush     = uint16(1)
+	MsgTypePull     = uint16(2)
+	MsgTypeSync     = uint16(3)
+	MsgTypeSend     = uint16(4)
+	MsgTypePing     = uint16(5)
+	MsgTypePingAck  = uint16(6)
+	MsgTypeGoodbye  = uint16(7)
+	MsgTypeTransfer = uint16(8)
+	MsgTypeWindow   = uint16(9)
+	// MsgTypeStreamRefused tells a remote peer that a Stream it opened was
+	// refused, because it already had too many Streams.
+	MsgTypeStreamRefused = uint16(10)
+	// MsgTypeBatch carries many messages in a single frame (see NewBatch).
+	MsgTypeBatch = uint16(11)
 )
 
 // Msg defines the low-level message structure that is sent on-the-wire between
 // peers.
 type Msg struct {
-	Version  uint16  `json:"version"`
-	Type     uint16  `json:"type"`
-	To       id.Hash `json:"to"`
-	Data     []byte  `json:"data"`
-	SyncData []byte  `json:"syncData"`
+	Version     uint16      `json:"version"`
+	Type        uint16      `json:"type"`
+	To          id.Hash     `json:"to"`
+	Data        []byte      `json:"data"`
+	ContentType ContentType `json:"contentType"`
+	Stream      uint16      `json:"stream"`
+	SyncData    []byte      `json:"syncData"`
+	RoutingKey  *id.Hash    `json:"routingKey,omitempty"`
+	Flags       uint8       `json:"flags"`
 }
 
 // Packet defines a struct that captures the incoming message and the corresponding IP address
 type Packet struct {
 	Msg    Msg
 	IPAddr net.Addr
+	// Body is the Data of a chunked Msg, which is read as it arrives, instead
+	// of being in the Msg. It is nil if the Msg is not chunked (see Chunked).
+	Body io.ReadCloser
 }
 
 // SizeHint returns the number of bytes required to represent a Msg in binary.
 func (msg Msg) SizeHint() int {
-	return surge.SizeHintU16 +
+	sizeHint := surge.SizeHintU16 +
 		surge.SizeHintU16 +
 		id.SizeHintHash +
 		surge.SizeHintBytes(msg.Data)
+	if msg.Version >= MsgVersion2 {
+		sizeHint += surge.SizeHintU8
+	}
+	if msg.Version >= MsgVersion3 {
+		sizeHint += surge.SizeHintU16
+	}
+	if msg.Version >= MsgVersion4 {
+		sizeHint += surge.SizeHintU8
+		if msg.RoutingKey != nil {
+			sizeHint += id.SizeHintHash
+		}
+	}
+	if msg.Version >= MsgVersion5 {
+		sizeHint += surge.SizeHintU8
+	}
+	return sizeHint
 }
 
 // Marshal a Msg to binary.
@@ -66,6 +110,43 @@ func (msg Msg) Marshal(buf []byte, rem int) ([]byte, int, error) {
 	if err != nil {
 		return buf, rem, fmt.Errorf("marshal data: %v", err)
 	}
+	// The content type, stream, routing key, and flags are marshaled last, so
+	// that peers that only understand earlier versions can still unmarshal the
+	// rest of the Msg.
+	if msg.Version >= MsgVersion2 {
+		buf, rem, err = surge.MarshalU8(uint8(msg.ContentType), buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal content type: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion3 {
+		buf, rem, err = surge.MarshalU16(msg.Stream, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal stream: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion4 {
+		hasRoutingKey := uint8(0)
+		if msg.RoutingKey != nil {
+			hasRoutingKey = 1
+		}
+		buf, rem, err = surge.MarshalU8(hasRoutingKey, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal has routing key: %v", err)
+		}
+		if msg.RoutingKey != nil {
+			buf, rem, err = surge.Marshal(*msg.RoutingKey, buf, rem)
+			if err != nil {
+				return buf, rem, fmt.Errorf("marshal routing key: %v", err)
+			}
+		}
+	}
+	if msg.Version >= MsgVersion5 {
+		buf, rem, err = surge.MarshalU8(msg.Flags, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal flags: %v", err)
+		}
+	}
 	return buf, rem, err
 }
 
@@ -87,5 +168,39 @@ func (msg *Msg) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
 	if err != nil {
 		return buf, rem, fmt.Errorf("unmarshal data: %v", err)
 	}
+	if msg.Version >= MsgVersion2 {
+		buf, rem, err = surge.UnmarshalU8((*uint8)(&msg.ContentType), buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("unmarshal content type: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion3 {
+		buf, rem, err = surge.UnmarshalU16(&msg.Stream, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("unmarshal stream: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion4 {
+		hasRoutingKey := uint8(0)
+		buf, rem, err = surge.UnmarshalU8(&hasRoutingKey, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("unmarshal has routing key: %v", err)
+		}
+		msg.RoutingKey = nil
+		if hasRoutingKey != 0 {
+			routingKey := id.Hash{}
+			buf, rem, err = surge.Unmarshal(&routingKey, buf, rem)
+			if err != nil {
+				return buf, rem, fmt.Errorf("unmarshal routing key: %v", err)
+			}
+			msg.RoutingKey = &routingKey
+		}
+	}
+	if msg.Version >= MsgVersion5 {
+		buf, rem, err = surge.UnmarshalU8(&msg.Flags, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("unmarshal flags: %v", err)
+		}
+	}
 	return buf, rem, err
 }
@@ -1 +1,202 @@
 package wire_test
+
+import (
+	"github.com/muirglacier/aw/wire"
+	"github.com/muirglacier/id"
+	"github.com/muirglacier/surge"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Msg", func() {
+	Context("when marshaling and unmarshaling a version 1 message", func() {
+		It("should not include the content type", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello"), ContentType: wire.ContentTypeJSON}
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveLen(msg.SizeHint()))
+
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.Data).To(Equal(msg.Data))
+			Expect(unmarshaled.ContentType).To(Equal(wire.ContentTypeUndefined))
+		})
+	})
+
+	Context("when marshaling and unmarshaling a message with a routing key", func() {
+		It("should round-trip the routing key", func() {
+			key := id.NewHash([]byte("key"))
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}.WithRoutingKey(key)
+			Expect(msg.Version).To(Equal(wire.MsgVersion4))
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveLen(msg.SizeHint()))
+
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.RoutingKey).ToNot(BeNil())
+			Expect(*unmarshaled.RoutingKey).To(Equal(key))
+			Expect(unmarshaled.Data).To(Equal(msg.Data))
+		})
+
+		It("should be optional", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveLen(msg.SizeHint()))
+
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.RoutingKey).To(BeNil())
+		})
+	})
+
+	Context("when marshaling and unmarshaling a chunked message", func() {
+		It("should round-trip the flags", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend}.Chunked()
+			Expect(msg.Version).To(Equal(wire.MsgVersion5))
+			Expect(msg.IsChunked()).To(BeTrue())
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveLen(msg.SizeHint()))
+
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.IsChunked()).To(BeTrue())
+		})
+
+		It("should not be chunked before version 5", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Flags: wire.MsgFlagChunked}
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(msg.IsChunked()).To(BeFalse())
+			Expect(unmarshaled.Flags).To(BeZero())
+		})
+	})
+
+	Context("when overriding the compression of a message", func() {
+		It("should round-trip the override", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend}
+			_, ok := msg.CompressionOverride()
+			Expect(ok).To(BeFalse())
+
+			for _, compress := range []bool{true, false} {
+				msg := msg.Chunked().WithCompression(!compress).WithCompression(compress)
+				Expect(msg.Version).To(Equal(wire.MsgVersion5))
+				Expect(msg.IsChunked()).To(BeTrue())
+				data, err := surge.ToBinary(msg)
+				Expect(err).ToNot(HaveOccurred())
+
+				unmarshaled := wire.Msg{}
+				Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+				override, ok := unmarshaled.CompressionOverride()
+				Expect(ok).To(BeTrue())
+				Expect(override).To(Equal(compress))
+			}
+		})
+	})
+
+	Context("when encoding and decoding a JSON body", func() {
+		It("should round-trip the body and the content type", func() {
+			type body struct {
+				Foo string
+				Bar int
+			}
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend}
+			Expect(msg.EncodeBody(wire.JSONBody, body{Foo: "foo", Bar: 42})).To(Succeed())
+			Expect(msg.Version).To(Equal(wire.MsgVersion2))
+			Expect(msg.ContentType).To(Equal(wire.ContentTypeJSON))
+
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveLen(msg.SizeHint()))
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.ContentType).To(Equal(wire.ContentTypeJSON))
+
+			decoded := body{}
+			Expect(unmarshaled.DecodeBody(wire.JSONBody, &decoded)).To(Succeed())
+			Expect(decoded).To(Equal(body{Foo: "foo", Bar: 42}))
+
+			Expect(unmarshaled.DecodeBody(wire.ProtoBody, &decoded)).ToNot(Succeed())
+		})
+	})
+
+	Context("when marshaling and unmarshaling a goodbye message", func() {
+		It("should round-trip the reason", func() {
+			data, err := surge.ToBinary(wire.NewGoodbye(wire.GoodbyeMaintenance))
+			Expect(err).ToNot(HaveOccurred())
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.Type).To(Equal(wire.MsgTypeGoodbye))
+
+			reason, err := unmarshaled.GoodbyeReason()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(Equal(wire.GoodbyeMaintenance))
+
+			_, err = wire.Msg{Type: wire.MsgTypeSend, Data: []byte{1}}.GoodbyeReason()
+			Expect(err).To(HaveOccurred())
+			_, err = wire.Msg{Type: wire.MsgTypeGoodbye}.GoodbyeReason()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when marshaling and unmarshaling a batch", func() {
+		It("should round-trip the messages in order", func() {
+			msgs := []wire.Msg{
+				{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("first")},
+				{Version: wire.MsgVersion3, Type: wire.MsgTypePush, Data: []byte("second"), Stream: 7},
+				{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, ContentType: wire.ContentTypeJSON},
+			}
+			batch, err := wire.NewBatch(msgs)
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := surge.ToBinary(batch)
+			Expect(err).ToNot(HaveOccurred())
+			unmarshaled := wire.Msg{}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.Type).To(Equal(wire.MsgTypeBatch))
+
+			unpacked, err := unmarshaled.Batch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unpacked).To(HaveLen(3))
+			Expect(unpacked[0].Data).To(Equal([]byte("first")))
+			Expect(unpacked[1].Data).To(Equal([]byte("second")))
+			Expect(unpacked[1].Stream).To(Equal(uint16(7)))
+			Expect(unpacked[2].ContentType).To(Equal(wire.ContentTypeJSON))
+		})
+
+		It("should not batch messages that are handled by the connection", func() {
+			_, err := wire.NewBatch(nil)
+			Expect(err).To(HaveOccurred())
+			_, err = wire.NewBatch([]wire.Msg{wire.NewGoodbye(wire.GoodbyeShutdown)})
+			Expect(err).To(HaveOccurred())
+			_, err = wire.NewBatch([]wire.Msg{wire.Msg{Type: wire.MsgTypeSend}.Chunked()})
+			Expect(err).To(HaveOccurred())
+
+			batch, err := wire.NewBatch([]wire.Msg{{Type: wire.MsgTypeSend}})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = wire.NewBatch([]wire.Msg{batch})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject malformed batches", func() {
+			_, err := wire.Msg{Type: wire.MsgTypeSend}.Batch()
+			Expect(err).To(HaveOccurred())
+
+			// The batch declares more messages than it has room for.
+			_, err = wire.Msg{Type: wire.MsgTypeBatch, Data: []byte{0xff, 0xff, 0xff, 0xff}}.Batch()
+			Expect(err).To(HaveOccurred())
+
+			batch, err := wire.NewBatch([]wire.Msg{{Type: wire.MsgTypeSend, Data: []byte("hello")}})
+			Expect(err).ToNot(HaveOccurred())
+			batch.Data = batch.Data[:len(batch.Data)-1]
+			_, err = batch.Batch()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})